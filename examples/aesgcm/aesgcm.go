@@ -0,0 +1,67 @@
+// Package aesgcm is an example of an external cipher: importing it
+// registers AES-256-GCM with cryptotimed, so that a build linking it in can
+// encrypt files with "encrypt --cipher aes256gcm" and decrypt them.  Builds
+// without it refuse such files before solving their puzzle.
+//
+// A package of your own is written the same way: pick an unused ID from
+// crypto.ExternalIDBase up, register the cipher from an init function and
+// import the package for its side effect from a main package (see
+// cmd/cryptotimed-aesgcm).
+package aesgcm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+
+	"cryptotimed/src/crypto"
+)
+
+// ID is the cipher ID files sealed with AES-256-GCM record in their header.
+const ID = crypto.ExternalIDBase
+
+// Name is the name encrypt --cipher takes.
+const Name = "aes256gcm"
+
+func init() {
+	if err := crypto.RegisterCipher(ID, Name, Seal, Open); err != nil {
+		panic(err)
+	}
+}
+
+// Seal encrypts plaintext with AES-256-GCM under key, binding ad, and
+// returns the random nonce followed by the ciphertext and tag.
+func Seal(key [32]byte, plaintext, ad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, ad), nil
+}
+
+// Open reverses Seal.
+func Open(key [32]byte, sealed, ad []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
+
+// newGCM returns AES-256-GCM keyed with key.
+func newGCM(key [32]byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,63 @@
+package aesgcm
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// TestRoundTrip encrypts a file with the registered cipher and decrypts it.
+func TestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "notes.txt")
+	plaintext := []byte("sealed with AES-256-GCM")
+	if err := os.WriteFile(input, plaintext, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	enc, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  input,
+		WorkFactor: 1000,
+		Cipher:     Name,
+	})
+	if err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+	header, err := utils.ReadFileHeader(enc.OutputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Ext.Cipher != ID || header.MinReaderVersion != types.VersionAlgorithms {
+		t.Errorf("header records cipher 0x%02x and reader version %d, want 0x%02x and %d",
+			header.Ext.Cipher, header.MinReaderVersion, ID, types.VersionAlgorithms)
+	}
+
+	// The data section is not ChaCha20-Poly1305
+	ef, err := utils.ReadEncryptedFile(enc.OutputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile:  enc.OutputFile,
+		OutputFile: filepath.Join(dir, "notes.out"),
+	}, nil)
+	if err != nil {
+		t.Fatalf("decrypt failed: %v", err)
+	}
+	if _, err := crypto.DecryptData(dec.Key, ef.Data); err == nil {
+		t.Error("data section opens as ChaCha20-Poly1305")
+	}
+	got, err := os.ReadFile(dec.OutputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("decrypted %q, want %q", got, plaintext)
+	}
+}
@@ -0,0 +1,15 @@
+// Command cryptotimed-aesgcm is cryptotimed built with the example
+// AES-256-GCM cipher registered.
+package main
+
+import (
+	"os"
+
+	"cryptotimed/src/cmd"
+
+	_ "cryptotimed/examples/aesgcm"
+)
+
+func main() {
+	os.Exit(cmd.Execute(os.Args[1:]))
+}
@@ -1,48 +1,152 @@
 package cmd
 
 import (
-	"flag"
 	"fmt"
-	"os"
+	"io"
+	"strings"
 	"time"
 
 	"cryptotimed/src/operations"
 	"cryptotimed/src/utils"
 )
 
+var benchmarkCommand = &Command{
+	Name:    "benchmark",
+	Summary: "Benchmark modular squaring performance",
+	Synopsis: []string{
+		"[--precision P] [--max-duration DURATION] [--samples COUNT] [--duration DURATION] [--pin-thread] [--match-file FILE] [--export PROFILE]",
+		"--compare-trapdoor [--work ITERATIONS]",
+		"--for-file FILE [--duration DURATION] [--save]",
+		"--import PROFILE",
+	},
+	Description: fmt.Sprintf("Benchmark modular squaring performance to estimate work factors\n"+
+		"\n"+
+		"By default samples are taken until the rate is known to within --precision\n"+
+		"or --max-duration is reached. Pass --samples for a fixed number of samples.\n"+
+		"With --match-file, squaring is done modulo that encrypted file's own modulus and\n"+
+		"the time to solve its puzzle is estimated from the rate.\n"+
+		"\n"+
+		"With --compare-trapdoor, shows why encrypting is instant while decrypting is slow.\n"+
+		"\n"+
+		"With --for-file, times each stage of decrypting that file on this machine: squaring\n"+
+		"on its modulus for --duration (default %v), one Argon2id derivation and decrypting\n"+
+		"its data section. --save keeps the result, which check then shows.\n"+
+		"\n"+
+		"--export writes this machine's calibration profile, with a fingerprint of its\n"+
+		"hardware, for check --profile and encrypt --profile on another machine. The\n"+
+		"benchmark supplies the rate for its modulus size if no solve here has yet.\n"+
+		"--import merges a profile into this machine's own, warning if it was clearly\n"+
+		"measured on different hardware.", operations.DefaultFileProbeDuration),
+	Examples: []string{
+		"cryptotimed benchmark",
+		"cryptotimed benchmark --precision 0.01 --max-duration 2m",
+		"cryptotimed benchmark --duration 30s --samples 5",
+		"cryptotimed benchmark --pin-thread",
+		"cryptotimed benchmark --match-file document.pdf.locked",
+		"cryptotimed benchmark --compare-trapdoor --work 2000000",
+		"cryptotimed benchmark --for-file document.pdf.locked --save",
+		"cryptotimed benchmark --export big-server.json",
+		"cryptotimed benchmark --import big-server.json",
+	},
+	run: runBenchmark,
+}
+
 // BenchmarkCommand handles the benchmark subcommand
 func BenchmarkCommand(args []string) error {
-	fs := flag.NewFlagSet("benchmark", flag.ExitOnError)
+	return benchmarkCommand.Run(args)
+}
+
+func runBenchmark(c *Command, args []string) error {
+	fs := c.FlagSet()
 
 	var (
-		duration = fs.Duration("duration", 10*time.Second, "How long to run the benchmark")
-		samples  = fs.Int("samples", 3, "Number of benchmark samples to take")
+		duration    = fs.Duration("duration", 0, "Length of each sample (default 1s adaptive, 10s with --samples, 5s squaring probe with --for-file)")
+		samples     = fs.Int("samples", 0, "Take exactly this many samples instead of sampling adaptively")
+		precision   = fs.Float64("precision", operations.DefaultBenchmarkPrecision, "Target relative standard error of the rate in adaptive mode")
+		maxDuration = fs.Duration("max-duration", operations.DefaultBenchmarkMaxDuration, "Time cap for adaptive mode")
+		pinThread   = fs.Bool("pin-thread", false, "Lock the squaring loop to one OS thread (as decrypt --pin-thread)")
+		trapdoor    = fs.Bool("compare-trapdoor", false, "Instead, time computing one puzzle's target through the trapdoor and by sequential squaring")
+		work        = fs.Uint64("work", operations.DefaultTrapdoorWork, "Work factor of the puzzle timed by --compare-trapdoor")
+		forFile     = fs.String("for-file", "", "Instead, estimate decrypting this encrypted file: its modulus, key derivation and data size")
+		save        = fs.Bool("save", false, "Store the --for-file result in the calibration profile")
+		matchFile   = fs.String("match-file", "", "Square modulo this encrypted file's modulus and estimate solving its puzzle")
+		export      = fs.String("export", "", "Write this machine's calibration profile and hardware fingerprint to this file")
+		importFile  = fs.String("import", "", "Instead, merge a profile exported on another machine into this machine's")
 	)
 
-	fs.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s benchmark [--duration DURATION] [--samples COUNT]\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "\nBenchmark modular squaring performance to estimate work factors\n\n")
-		fmt.Fprintf(os.Stderr, "Options:\n")
-		fs.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "\nExamples:\n")
-		fmt.Fprintf(os.Stderr, "  %s benchmark\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s benchmark --duration 30s --samples 5\n", os.Args[0])
+	if _, err := c.Parse(fs, args); err != nil {
+		return err
 	}
 
-	if err := fs.Parse(args); err != nil {
-		return err
+	if *importFile != "" {
+		for _, name := range []string{"duration", "samples", "precision", "max-duration", "pin-thread", "compare-trapdoor", "work", "for-file", "save", "match-file", "export"} {
+			if flagSet(fs, name) {
+				return fmt.Errorf("--%s cannot be used with --import", name)
+			}
+		}
+		return importProfile(c.stdout, *importFile)
+	}
+
+	if *forFile != "" {
+		for _, name := range []string{"samples", "precision", "max-duration", "pin-thread", "compare-trapdoor", "work", "match-file", "export"} {
+			if flagSet(fs, name) {
+				return fmt.Errorf("--%s cannot be used with --for-file", name)
+			}
+		}
+		return benchmarkFile(c.stdout, *forFile, *duration, *save)
+	}
+	if *save {
+		return fmt.Errorf("--save is only used with --for-file")
+	}
+	if *trapdoor {
+		if *matchFile != "" || *export != "" {
+			return fmt.Errorf("--match-file and --export cannot be used with --compare-trapdoor")
+		}
+		return compareTrapdoor(c.stdout, *work)
+	}
+	if flagSet(fs, "work") {
+		return fmt.Errorf("--work is only used with --compare-trapdoor")
+	}
+
+	if *samples < 0 {
+		return fmt.Errorf("--samples must be positive")
+	}
+	if *samples == 0 && *precision <= 0 {
+		return fmt.Errorf("--precision must be positive (or use --samples for fixed mode)")
 	}
 
 	// Prepare options for the operation
 	opts := operations.BenchmarkOptions{
-		Duration: *duration,
-		Samples:  *samples,
+		Duration:  *duration,
+		Samples:   *samples,
+		PinThread: *pinThread,
+		MatchFile: *matchFile,
+	}
+	if *samples == 0 {
+		opts.TargetPrecision = *precision
+		opts.MaxDuration = *maxDuration
+		if opts.Duration == 0 {
+			opts.Duration = time.Second
+		}
+	} else if opts.Duration == 0 {
+		opts.Duration = 10 * time.Second
 	}
 
 	// Display initial progress messages
-	fmt.Printf("Benchmarking modular squaring performance...\n")
-	fmt.Printf("Duration per sample: %v\n", *duration)
-	fmt.Printf("Number of samples: %d\n\n", *samples)
+	fmt.Fprintf(c.stdout, "Benchmarking modular squaring performance...\n")
+	fmt.Fprintf(c.stdout, "Duration per sample: %v\n", opts.Duration)
+	if opts.TargetPrecision > 0 {
+		fmt.Fprintf(c.stdout, "Sampling until: ±%.1f%% relative standard error (at most %v)\n", opts.TargetPrecision*100, opts.MaxDuration)
+	} else {
+		fmt.Fprintf(c.stdout, "Number of samples: %d\n", opts.Samples)
+	}
+	if *pinThread {
+		fmt.Fprintf(c.stdout, "Solver thread: pinned\n")
+	}
+	if *matchFile != "" {
+		fmt.Fprintf(c.stdout, "Modulus: that of %s\n", *matchFile)
+	}
+	fmt.Fprintf(c.stdout, "\n")
 
 	// Perform the benchmark operation
 	result, err := operations.RunBenchmark(opts)
@@ -52,27 +156,149 @@ func BenchmarkCommand(args []string) error {
 
 	// Display sample results
 	for i, sample := range result.Samples {
-		fmt.Printf("Running sample %d/%d...\n", i+1, *samples)
-		fmt.Printf("  Operations: %d\n", sample.Operations)
-		fmt.Printf("  Time: %v\n", sample.Elapsed)
-		fmt.Printf("  Rate: %.0f ops/sec\n\n", sample.OpsPerSecond)
+		fmt.Fprintf(c.stdout, "Sample %d/%d:\n", i+1, len(result.Samples))
+		fmt.Fprintf(c.stdout, "  Operations: %d\n", sample.Operations)
+		fmt.Fprintf(c.stdout, "  Time: %v\n", sample.Elapsed)
+		fmt.Fprintf(c.stdout, "  Rate: %.0f ops/sec\n\n", sample.OpsPerSecond)
 	}
 
 	// Display overall results
-	fmt.Printf("=== Benchmark Results ===\n")
-	fmt.Printf("Average rate: %.0f squarings/second\n", result.AvgOpsPerSecond)
-	fmt.Printf("Total operations: %d\n", result.TotalOps)
-	fmt.Printf("Total time: %v\n\n", result.TotalTime)
+	fmt.Fprintf(c.stdout, "=== Benchmark Results ===\n")
+	fmt.Fprintf(c.stdout, "Average rate: %.0f squarings/second\n", result.AvgOpsPerSecond)
+	fmt.Fprintf(c.stdout, "Total operations: %d\n", result.TotalOps)
+	fmt.Fprintf(c.stdout, "Total time: %v\n", result.TotalTime)
+	if len(result.Samples) > 1 {
+		fmt.Fprintf(c.stdout, "Std deviation: %.0f squarings/second\n", result.StdDev)
+		fmt.Fprintf(c.stdout, "Relative std error: ±%.2f%%\n", result.RelStdErr*100)
+	}
+	if result.Adaptive {
+		if result.Converged {
+			fmt.Fprintf(c.stdout, "Converged after %d samples\n", len(result.Samples))
+		} else {
+			fmt.Fprintf(c.stdout, "Time cap reached after %d samples without reaching the target precision\n", len(result.Samples))
+		}
+	}
+	fmt.Fprintf(c.stdout, "\n")
 
 	// Display time estimates
-	fmt.Printf("=== Time Estimates ===\n")
+	fmt.Fprintf(c.stdout, "=== Time Estimates ===\n")
 	for _, estimate := range result.TimeEstimates {
-		fmt.Printf("Work factor %d: %s\n", estimate.WorkFactor, utils.FormatDuration(estimate.EstimatedTime))
+		fmt.Fprintf(c.stdout, "Work factor %d: %s\n", estimate.WorkFactor, utils.FormatDuration(estimate.EstimatedTime))
+	}
+
+	if *export != "" {
+		profile, err := operations.ExportProfile(*export, result)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stdout, "\n=== Exported profile ===\n")
+		printProfile(c.stdout, profile)
+	}
+
+	if m := result.Match; m != nil {
+		fmt.Fprintf(c.stdout, "\n=== Matched to %s ===\n", m.InputFile)
+		fmt.Fprintf(c.stdout, "Modulus: %d bits\n", m.ModulusBits)
+		fmt.Fprintf(c.stdout, "Work factor %d: %s\n", m.WorkFactor, utils.FormatDuration(m.EstimatedTime))
+		return nil
+	}
+
+	fmt.Fprintf(c.stdout, "\nTo encrypt with a specific delay, use:\n")
+	fmt.Fprintf(c.stdout, "  cryptotimed encrypt --input file.txt --work ITERATIONS\n")
+	fmt.Fprintf(c.stdout, "\nWhere ITERATIONS = desired_seconds × %.0f\n", result.AvgOpsPerSecond)
+
+	return nil
+}
+
+// compareTrapdoor times the encryptor's and the decryptor's way of computing
+// the target of one puzzle.
+func compareTrapdoor(w io.Writer, work uint64) error {
+	if work == 0 {
+		return fmt.Errorf("--work must be > 0")
+	}
+	fmt.Fprintf(w, "Computing the target of one puzzle (%d squarings) both ways...\n", work)
+	cmp, err := operations.CompareTargetComputation(work)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\n", cmp)
+	fmt.Fprintf(w, "\nThe encryptor knows the factors of N and reduces the exponent 2^T modulo φ(N),\n")
+	fmt.Fprintf(w, "so its cost barely depends on T; everyone else squares T times in sequence.\n")
+	return nil
+}
+
+// benchmarkFile times each stage of decrypting one encrypted file.
+func benchmarkFile(w io.Writer, input string, probe time.Duration, save bool) error {
+	if probe == 0 {
+		probe = operations.DefaultFileProbeDuration
+	}
+	if probe < 0 {
+		return fmt.Errorf("--duration must be positive")
+	}
+	fmt.Fprintf(w, "Benchmarking decryption of %s (squaring for %v)...\n\n", input, probe)
+	b, err := operations.BenchmarkFile(operations.FileBenchmarkOptions{
+		InputFile:     input,
+		ProbeDuration: probe,
+		Save:          save,
+	})
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("\nTo encrypt with a specific delay, use:\n")
-	fmt.Printf("  cryptotimed encrypt --input file.txt --work ITERATIONS\n")
-	fmt.Printf("\nWhere ITERATIONS = desired_seconds × %.0f\n", result.AvgOpsPerSecond)
+	fmt.Fprintf(w, "=== Stages ===\n")
+	fmt.Fprintf(w, "Puzzle:         %d squarings on a %d-bit modulus at %.0f squarings/second: %s\n",
+		b.WorkFactor, b.ModulusBits, b.Rate, utils.FormatDuration(b.Solve))
+	if b.KeyDerivation > 0 {
+		fmt.Fprintf(w, "Key derivation: one Argon2id derivation: %v\n", b.KeyDerivation.Round(time.Millisecond))
+	} else {
+		fmt.Fprintf(w, "Key derivation: none (no passphrase required)\n")
+	}
+	fmt.Fprintf(w, "Decryption:     %d bytes at %.1f MB/s: %v\n", b.DataSize, b.AEADRate/1e6, b.Decrypt.Round(time.Microsecond))
+	fmt.Fprintf(w, "\nEstimated time to decrypt: %s\n", utils.FormatDuration(b.Estimate))
+	if b.Saved {
+		fmt.Fprintf(w, "Saved to the calibration profile under fingerprint %s\n", utils.ShortFingerprint(b.Fingerprint))
+	}
+	return nil
+}
 
+// importProfile merges a profile exported on another machine into this
+// machine's calibration profile.
+func importProfile(w io.Writer, path string) error {
+	profile, merged, err := operations.ImportProfile(path)
+	if err != nil {
+		return err
+	}
+	if profile.Host == nil {
+		fmt.Fprintf(w, "Warning: %s records no hardware fingerprint; it may not describe this machine\n", path)
+	}
+	for _, diff := range profile.Mismatch {
+		fmt.Fprintf(w, "Warning: %s does not match this machine: %s\n", path, diff)
+	}
+	if len(profile.Mismatch) > 0 {
+		fmt.Fprintf(w, "Warning: estimates here will follow that machine until solves here replace its rates\n")
+	}
+	printProfile(w, profile)
+	if len(merged) == 0 {
+		fmt.Fprintf(w, "Imported: nothing (this machine's rates are all more recent)\n")
+	} else {
+		fmt.Fprintf(w, "Imported: rates for moduli of %s bits\n", strings.Trim(fmt.Sprint(merged), "[]"))
+	}
 	return nil
 }
+
+// printProfile describes an exported profile: the host it was measured on
+// and its rate per modulus size.
+func printProfile(w io.Writer, p *operations.Profile) {
+	fmt.Fprintf(w, "Profile: %s\n", p.Path)
+	if h := p.Host; h != nil {
+		fmt.Fprintf(w, "Host: %s\n", h)
+		fmt.Fprintf(w, "Exported: %s\n", h.Exported.Format("2006-01-02 15:04"))
+	}
+	for _, bits := range p.ModulusSizes() {
+		e := p.Moduli[bits]
+		source := fmt.Sprintf("%d solve(s)", e.Samples)
+		if e.Samples == 0 {
+			source = "a benchmark"
+		}
+		fmt.Fprintf(w, "  %5d-bit modulus: %.0f squarings/second from %s (%s)\n", bits, e.Rate, source, e.Updated.Format("2006-01-02"))
+	}
+}
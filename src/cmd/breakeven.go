@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/utils"
+)
+
+var breakevenCommand = &Command{
+	Name:    "breakeven",
+	Summary: "Estimate whether to solve now or wait for faster hardware",
+	Synopsis: []string{
+		"--work ITERATIONS --growth FACTOR [--rate SQUARINGS]",
+	},
+	Description: "Weigh starting a solve today against waiting for faster hardware, when the fastest\n" +
+		"hardware gets --growth times faster every year: a solve started later runs faster, and\n" +
+		"for a long enough one the best start is some years away. The rate today is --rate, else\n" +
+		"this machine's calibrated rate, else a quick benchmark.\n" +
+		"A checkpoint can move to new hardware mid-solve, so starting now and upgrading as faster\n" +
+		"hardware appears finishes sooner still; that estimate is printed too.",
+	Examples: []string{
+		"cryptotimed breakeven --work 81000000000000 --growth 1.3",
+		"cryptotimed breakeven --work 81000000000000 --growth 1.4 --rate 2000000",
+	},
+	run: runBreakeven,
+}
+
+// BreakevenCommand handles the breakeven subcommand
+func BreakevenCommand(args []string) error {
+	return breakevenCommand.Run(args)
+}
+
+func runBreakeven(c *Command, args []string) error {
+	fs := c.FlagSet()
+
+	var (
+		workFactor = fs.Uint64("work", 0, "Number of sequential squarings of the puzzle (required)")
+		growth     = fs.Float64("growth", 0, "Factor the speed of the fastest hardware grows by every year, e.g. 1.3 (required)")
+		rate       = fs.Float64("rate", 0, "Squarings per second of the fastest hardware today (default: this machine's)")
+	)
+
+	if _, err := c.Parse(fs, args); err != nil {
+		return err
+	}
+	if *workFactor == 0 || *growth == 0 {
+		fs.Usage()
+		return fmt.Errorf("--work and --growth are required")
+	}
+	if !(*growth > 1) {
+		return fmt.Errorf("--growth must be more than 1: hardware that gets no faster is never worth waiting for")
+	}
+	if flagSet(fs, "rate") && !(*rate > 0) {
+		return fmt.Errorf("--rate must be positive")
+	}
+
+	source := "--rate"
+	if *rate == 0 {
+		if e := utils.CalibratedRate(crypto.DefaultModulusBits); e != nil {
+			*rate, source = e.Rate, "this machine's calibrated rate"
+		} else {
+			fmt.Fprintf(c.stdout, "Measuring squaring rate...\n")
+			bench, err := operations.RunBenchmark(operations.BenchmarkOptions{Duration: rateProbeDuration, Samples: 1})
+			if err != nil {
+				return err
+			}
+			*rate, source = bench.AvgOpsPerSecond, "a quick benchmark of this machine"
+		}
+	}
+
+	result, err := operations.EstimateBreakEven(operations.BreakEvenOptions{
+		WorkFactor: *workFactor,
+		Rate:       *rate,
+		Growth:     *growth,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stdout, "Work factor: %d sequential squarings\n", result.WorkFactor)
+	fmt.Fprintf(c.stdout, "Rate today: %.0f squarings/second (%s)\n", result.Rate, source)
+	fmt.Fprintf(c.stdout, "Hardware growth: %g× a year\n", result.Growth)
+	fmt.Fprintln(c.stdout)
+	fmt.Fprintf(c.stdout, "Solving now:        %s\n", formatYears(result.SolveNow))
+	if result.Wait == 0 {
+		fmt.Fprintf(c.stdout, "Best start:         now; waiting never pays off for a solve this short\n")
+	} else {
+		fmt.Fprintf(c.stdout, "Best start:         in %s, on hardware doing %.0f squarings/second\n", formatYears(result.Wait), result.WaitRate)
+		fmt.Fprintf(c.stdout, "Solved after:       %s from now (%s sooner than solving now)\n",
+			formatYears(result.Finish), formatYears(result.SolveNow-result.Finish))
+	}
+	fmt.Fprintf(c.stdout, "Solving now and moving the checkpoint to faster hardware as it appears: %s\n", formatYears(result.Upgrading))
+	return nil
+}
+
+// formatYears formats d in years once it is that long, and as
+// utils.FormatDuration does below.
+func formatYears(d time.Duration) string {
+	years := d.Hours() / 24 / 365.25
+	if years < 1 {
+		return utils.FormatDuration(d)
+	}
+	return fmt.Sprintf("%.2f years", years)
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"cryptotimed/src/operations"
+)
+
+var bundleCommand = &Command{
+	Name:    "bundle",
+	Summary: "Merge files sharing one puzzle into one file",
+	Synopsis: []string{
+		"FILE FILE... --output FILE",
+	},
+	Description: "Merge encrypted files that share one puzzle (encrypt --shared-puzzle) into a single\n" +
+		"file, so that one solve decrypts them all. Nothing is decrypted or re-encrypted.\n" +
+		"Decrypting the bundle writes every member into a directory named after it.",
+	Examples: []string{
+		"cryptotimed bundle a.txt.locked b.txt.locked --output all.locked",
+		"cryptotimed bundle release/*.locked --output release.locked",
+	},
+	run: runBundle,
+}
+
+// BundleCommand handles the bundle subcommand
+func BundleCommand(args []string) error {
+	return bundleCommand.Run(args)
+}
+
+func runBundle(c *Command, args []string) error {
+	fs := c.FlagSet()
+
+	var (
+		outputFile = fs.String("output", "", "Bundle file to write (required)")
+	)
+
+	// Files may come before, between and after the options
+	inputs, err := c.Parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	// Validate required arguments
+	if *outputFile == "" {
+		fs.Usage()
+		return fmt.Errorf("--output is required")
+	}
+	if len(inputs) < 2 {
+		fs.Usage()
+		return fmt.Errorf("a bundle needs at least two files (got %d)", len(inputs))
+	}
+	for _, input := range inputs {
+		if filepath.Clean(input) == filepath.Clean(*outputFile) {
+			return fmt.Errorf("--output %s is also an input", *outputFile)
+		}
+	}
+
+	result, err := operations.BundleFiles(operations.BundleOptions{
+		InputFiles: inputs,
+		OutputFile: *outputFile,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stdout, "Bundled %d files sharing one puzzle (%d sequential squarings)\n", len(result.Members), result.WorkFactor)
+	for _, m := range result.Members {
+		fmt.Fprintf(c.stdout, "  %s (%d bytes)\n", m.Name, m.Length)
+	}
+	fmt.Fprintf(c.stdout, "Output file: %s (%d bytes)\n", result.OutputFile, result.BundleSize)
+	fmt.Fprintf(c.stdout, "Decrypt them all with: %s decrypt --input %s\n", os.Args[0], result.OutputFile)
+	return nil
+}
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/types"
+)
+
+var capabilitiesCommand = &Command{
+	Name:        "capabilities",
+	Summary:     "List the format version, ciphers and key derivations this build supports",
+	Synopsis:    []string{""},
+	Description: "List the newest file format version this build reads and the ciphers and key derivations it can encrypt and decrypt with, including any registered by packages linked into a custom build",
+	Examples: []string{
+		"cryptotimed capabilities",
+	},
+	run: runCapabilities,
+}
+
+// CapabilitiesCommand handles the capabilities subcommand
+func CapabilitiesCommand(args []string) error {
+	return capabilitiesCommand.Run(args)
+}
+
+func runCapabilities(c *Command, args []string) error {
+	fs := c.FlagSet()
+	if _, err := c.Parse(fs, args); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stdout, "Format version: %d (reads any file whose minimum reader version is at most that)\n", types.CurrentVersion)
+	fmt.Fprintf(c.stdout, "Ciphers (encrypt --cipher):\n")
+	for _, cipher := range crypto.Ciphers() {
+		fmt.Fprintf(c.stdout, "  0x%02x  %s\n", cipher.ID, cipher.Name)
+	}
+	fmt.Fprintf(c.stdout, "Key derivations (encrypt --key-hash):\n")
+	fmt.Fprintf(c.stdout, "  %4d  %s, read only\n", crypto.KeyDerivationLegacy, crypto.KeyDerivationName(crypto.KeyDerivationLegacy))
+	for _, kdf := range crypto.KDFs() {
+		params := ""
+		if kdf.Params != nil {
+			params = " (with parameters)"
+		}
+		fmt.Fprintf(c.stdout, "  %4d  %s%s\n", kdf.ID, kdf.Name, params)
+	}
+	return nil
+}
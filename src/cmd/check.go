@@ -1,103 +1,428 @@
 package cmd
 
 import (
-	"flag"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"strconv"
+	"time"
 
 	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
 )
 
+// rateProbeDuration is how long check/decrypt benchmark this machine when
+// comparing against the encryptor's recorded rate.
+const rateProbeDuration = 500 * time.Millisecond
+
+var checkCommand = &Command{
+	Name:    "check",
+	Summary: "Inspect an encrypted file and show metadata",
+	Synopsis: []string{
+		"--input FILE [--list | --dump-header | [--profile PROFILE] [--estimate-only]] [--json]",
+	},
+	Description: "Inspect an encrypted file and display its metadata\n" +
+		"Of an http:// or https:// input only the header is fetched, with a range request.\n" +
+		"--dump-header instead shows every header field as laid out on disk: its offset,\n" +
+		"length, name, raw bytes and decoded value, then the first bytes of the data.\n" +
+		"--profile estimates the solve on the machine a profile was exported from\n" +
+		"(benchmark --export) instead of this one.\n" +
+		"--json prints the metadata, --list or --dump-header output as JSON (raw bytes in base64).",
+	Examples: []string{
+		"cryptotimed check --input document.pdf.locked",
+		"cryptotimed check --input secret.txt.locked",
+		"cryptotimed check --input photos.locked --list --json",
+		"cryptotimed check --input document.pdf.locked --dump-header",
+		"cryptotimed check --input document.pdf.locked --json",
+		"cryptotimed check --input https://example.com/secret.txt.locked",
+		"SECONDS=$(cryptotimed check --input secret.txt.locked --estimate-only)",
+		"cryptotimed check --input secret.txt.locked --profile big-server.json",
+	},
+	JSON: true,
+	run:  runCheck,
+}
+
 // CheckCommand handles the check subcommand
 func CheckCommand(args []string) error {
-	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	return checkCommand.Run(args)
+}
+
+func runCheck(c *Command, args []string) error {
+	fs := c.FlagSet()
 
 	var (
 		inputFile = fs.String("input", "", "Encrypted file to inspect (required)")
+		list      = fs.Bool("list", false, "List the entries of a container without solving")
+		dump      = fs.Bool("dump-header", false, "Show an annotated hex dump of every header field and the first bytes of the data")
+		estimate  = fs.Bool("estimate-only", false, "Print only the estimated decryption time in seconds")
+		timeout   = fs.Duration("timeout", utils.DefaultFetchTimeout, "Give up fetching an http(s) --input after this long")
+		profile   = fs.String("profile", "", "Estimate the solve on the machine this profile was exported from (benchmark --export)")
 	)
 
-	fs.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s check --input FILE\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "\nInspect an encrypted file and display its metadata\n\n")
-		fmt.Fprintf(os.Stderr, "Options:\n")
-		fs.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "\nExamples:\n")
-		fmt.Fprintf(os.Stderr, "  %s check --input document.pdf.locked\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s check --input secret.txt.locked\n", os.Args[0])
-	}
-
-	if err := fs.Parse(args); err != nil {
+	if _, err := c.Parse(fs, args); err != nil {
 		return err
 	}
+	jsonOut := globalBool(fs, "json")
 
 	// Validate required arguments
 	if *inputFile == "" {
 		fs.Usage()
 		return fmt.Errorf("--input is required")
 	}
+	if jsonOut && *estimate {
+		return fmt.Errorf("--json cannot be combined with --estimate-only")
+	}
+	if *estimate && *list {
+		return fmt.Errorf("--estimate-only cannot be combined with --list")
+	}
+	if *dump && (*list || *estimate) {
+		return fmt.Errorf("--dump-header cannot be combined with --list or --estimate-only")
+	}
+	if *profile != "" && (*list || *dump) {
+		return fmt.Errorf("--profile cannot be combined with --list or --dump-header")
+	}
+	if *timeout < 0 {
+		return fmt.Errorf("--timeout must not be negative")
+	}
+
+	if *list {
+		listing, err := operations.ListContainer(operations.ListOptions{InputFile: *inputFile, FetchTimeout: *timeout})
+		if err != nil {
+			return describeParseError(c.stdout, *inputFile, err)
+		}
+		if jsonOut {
+			return printListingJSON(c.output, listing)
+		}
+		printListing(c.stdout, listing)
+		return nil
+	}
 
 	// Prepare options for the operation
 	opts := operations.CheckOptions{
-		InputFile: *inputFile,
+		InputFile:    *inputFile,
+		FetchTimeout: *timeout,
+		Profile:      *profile,
+	}
+
+	if *dump {
+		fields, err := operations.DumpHeader(opts)
+		if jsonOut {
+			if jerr := printHeaderDumpJSON(c.output, *inputFile, fields, err); jerr != nil {
+				return jerr
+			}
+			return err
+		}
+		printHeaderDump(c.stdout, fields)
+		if err != nil {
+			return describeParseError(c.stdout, *inputFile, err)
+		}
+		return nil
 	}
 
 	// Perform the check operation
 	result, err := operations.CheckFile(opts)
 	if err != nil {
-		return err
+		return describeParseError(c.stdout, *inputFile, err)
+	}
+
+	// Scripting mode: a bare number and nothing else
+	if *estimate {
+		fmt.Fprintln(c.output, strconv.FormatFloat(result.EstimatedSecs, 'f', -1, 64))
+		return nil
+	}
+
+	if jsonOut {
+		return printCheckJSON(c.output, result)
+	}
+
+	// Compare against the encryptor's machine when its rate was recorded;
+	// with a profile, this machine's rate is beside the point
+	var rateCmp *operations.RateComparison
+	if result.EncryptorRate > 0 && result.Profile == nil {
+		cmp := operations.CompareRates(result.EncryptorRate, operations.MeasureRate(result.ModulusN, rateProbeDuration))
+		rateCmp = &cmp
 	}
 
 	// Display results in a pretty format
-	printCheckResults(result)
+	printCheckResults(utils.ASCIIWriter(c.stdout, utils.StdoutConsole()), result, rateCmp)
 
 	return nil
 }
 
-// printCheckResults displays the check results in a formatted way
-func printCheckResults(result *operations.CheckResult) {
-	fmt.Printf("═══════════════════════════════════════════════════════════════════════════════\n")
-	fmt.Printf("                          ENCRYPTED FILE METADATA\n")
-	fmt.Printf("═══════════════════════════════════════════════════════════════════════════════\n")
-	fmt.Printf("\n")
+// printHeaderDump prints the fields of a header dump, each with its raw
+// bytes below it, 16 to a line.
+func printHeaderDump(w io.Writer, fields []utils.HeaderField) {
+	fmt.Fprintf(w, "%-10s  %8s  %-36s  %s\n", "OFFSET", "LENGTH", "FIELD", "VALUE")
+	for _, f := range fields {
+		fmt.Fprintf(w, "0x%08x  %8d  %-36s  %s\n", f.Offset, f.Length, f.Field, f.Value)
+		for i := 0; i < len(f.Raw); i += 16 {
+			line := f.Raw[i:min(i+16, len(f.Raw))]
+			fmt.Fprintf(w, "    0x%08x  % x\n", f.Offset+int64(i), line)
+		}
+	}
+}
+
+// printHeaderDumpJSON prints a header dump as JSON, with the error that
+// ended it if the header is malformed.
+func printHeaderDumpJSON(w io.Writer, input string, fields []utils.HeaderField, dumpErr error) error {
+	out := struct {
+		Input  string              `json:"input"`
+		Fields []utils.HeaderField `json:"fields"`
+		Error  string              `json:"error,omitempty"`
+	}{Input: input, Fields: fields}
+	if out.Fields == nil {
+		out.Fields = []utils.HeaderField{}
+	}
+	if dumpErr != nil {
+		out.Error = dumpErr.Error()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// printCheckJSON prints the metadata of an encrypted file as JSON, with
+// its fingerprints in full.
+func printCheckJSON(w io.Writer, result *operations.CheckResult) error {
+	out := struct {
+		Input             string  `json:"input"`
+		FileSHA256        string  `json:"file_sha256,omitempty"`
+		HeaderFingerprint string  `json:"header_fingerprint"`
+		Version           uint32  `json:"version"`
+		MinReader         uint32  `json:"min_reader,omitempty"`
+		TotalSize         int64   `json:"total_size"`
+		DataSize          int     `json:"data_size"`
+		PlaintextSize     *int    `json:"plaintext_size,omitempty"`
+		WorkFactor        uint64  `json:"work_factor"`
+		Puzzles           int     `json:"puzzles,omitempty"`
+		TotalWork         uint64  `json:"total_work,omitempty"`
+		EstimatedSeconds  float64 `json:"estimated_seconds"`
+		ModulusBits       int     `json:"modulus_bits"`
+		KeyRequired       bool    `json:"key_required"`
+		FileID            string  `json:"file_id,omitempty"`
+		KeyDerivation     string  `json:"key_derivation"`
+		Cipher            string  `json:"cipher"`
+		ChunkSize         uint32  `json:"chunk_size,omitempty"`
+		Container         bool    `json:"container,omitempty"`
+		DataKey           bool    `json:"data_key,omitempty"`
+		KeySlots          int     `json:"key_slots,omitempty"`
+		BundleMembers     int     `json:"bundle_members,omitempty"`
+	}{
+		Input:             result.InputFile,
+		HeaderFingerprint: hex.EncodeToString(result.HeaderFingerprint[:]),
+		Version:           result.Version,
+		MinReader:         result.MinReader,
+		TotalSize:         result.TotalFileSize,
+		DataSize:          result.DataSize,
+		WorkFactor:        result.WorkFactor,
+		EstimatedSeconds:  result.EstimatedSecs,
+		ModulusBits:       result.ModulusN.BitLen(),
+		KeyRequired:       result.KeyRequired,
+		KeyDerivation:     result.KeyDerivation,
+		Cipher:            result.Cipher,
+		ChunkSize:         result.ChunkSize,
+		Container:         result.Container,
+		DataKey:           result.DataKey,
+		KeySlots:          result.KeySlots,
+		BundleMembers:     len(result.Bundle),
+	}
+	if result.PuzzleCount > 1 {
+		out.Puzzles, out.TotalWork = result.PuzzleCount, result.TotalWork
+	}
+	if result.FileSHA256 != nil {
+		out.FileSHA256 = hex.EncodeToString(result.FileSHA256[:])
+	}
+	if result.FileID != nil {
+		out.FileID = hex.EncodeToString(result.FileID[:])
+	}
+	// Sizes only known once solved are left out rather than reported as 0
+	known := !result.DataTooShort && !result.OtherCipher && result.Bundle == nil && result.KeySlots == 0 && !(result.Container && result.PrivateTable)
+	if known {
+		out.PlaintextSize = &result.PlaintextSize
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// printCheckResults displays the check results in a formatted way.  The
+// caller passes a writer that can show its decorations (see
+// utils.ASCIIWriter).
+func printCheckResults(w io.Writer, result *operations.CheckResult, rateCmp *operations.RateComparison) {
+	fmt.Fprintf(w, "═══════════════════════════════════════════════════════════════════════════════\n")
+	fmt.Fprintf(w, "                          ENCRYPTED FILE METADATA\n")
+	fmt.Fprintf(w, "═══════════════════════════════════════════════════════════════════════════════\n")
+	fmt.Fprintf(w, "\n")
 
 	// File Information
-	fmt.Printf("📁 FILE INFORMATION\n")
-	fmt.Printf("   File:           %s\n", result.InputFile)
-	fmt.Printf("   Total Size:     %d bytes (%.2f KB)\n", result.TotalFileSize, float64(result.TotalFileSize)/1024)
-	fmt.Printf("   Data Size:      %d bytes (%.2f KB)\n", result.DataSize, float64(result.DataSize)/1024)
-	fmt.Printf("   Format Version: %d\n", result.Version)
-	fmt.Printf("\n")
+	fmt.Fprintf(w, "📁 FILE INFORMATION\n")
+	fmt.Fprintf(w, "   File:           %s\n", result.InputFile)
+	fmt.Fprintf(w, "   Total Size:     %d bytes (%.2f KB)\n", result.TotalFileSize, float64(result.TotalFileSize)/1024)
+	fmt.Fprintf(w, "   Data Size:      %d bytes (%.2f KB)\n", result.DataSize, float64(result.DataSize)/1024)
+	switch {
+	case result.Bundle != nil:
+		fmt.Fprintf(w, "   Plaintext Size: per member, known once solved\n")
+	case result.KeySlots != 0:
+		fmt.Fprintf(w, "   Plaintext Size: per passphrase, known once solved\n")
+	case result.Container && result.PrivateTable:
+		fmt.Fprintf(w, "   Plaintext Size: unknown until solved\n")
+	case result.Container:
+		fmt.Fprintf(w, "   Plaintext Size: %d bytes\n", result.PlaintextSize)
+	case result.OtherCipher:
+		fmt.Fprintf(w, "   Plaintext Size: unknown (depends on the overhead of its cipher)\n")
+	case result.DataTooShort && result.ChunkSize != 0:
+		fmt.Fprintf(w, "   Plaintext Size: invalid (data section does not match the chunk layout; file is corrupted)\n")
+	case result.DataTooShort:
+		fmt.Fprintf(w, "   Plaintext Size: invalid (data section shorter than nonce and tag; file is corrupted)\n")
+	case result.PlaintextSize == 0:
+		fmt.Fprintf(w, "   Plaintext Size: 0 bytes (empty input; data section is only nonce and tag)\n")
+	default:
+		fmt.Fprintf(w, "   Plaintext Size: %d bytes\n", result.PlaintextSize)
+	}
+	if result.FileSHA256 != nil {
+		fmt.Fprintf(w, "   File SHA-256:   %s… (whole file)\n", utils.ShortFingerprint(*result.FileSHA256))
+	}
+	fmt.Fprintf(w, "   Fingerprint:    %s… (header only; also matches rewritten copies)\n", utils.ShortFingerprint(result.HeaderFingerprint))
+	fmt.Fprintf(w, "   Format Version: %d\n", result.Version)
+	if result.MinReader != 0 {
+		fmt.Fprintf(w, "   Min Reader:     format v%d or later\n", result.MinReader)
+	}
+	if result.ChunkSize != 0 {
+		fmt.Fprintf(w, "   Chunk Size:     %d bytes (%.0f KiB)\n", result.ChunkSize, float64(result.ChunkSize)/1024)
+	}
+	if result.DataKey {
+		fmt.Fprintf(w, "   Payload:        wrapped data key (decrypting outputs the key, not a document)\n")
+	}
+	if result.Container {
+		if result.PrivateTable {
+			fmt.Fprintf(w, "   Container:      Yes (entry table encrypted; listing requires solving)\n")
+		} else {
+			fmt.Fprintf(w, "   Container:      Yes (%d entries; use --list to show them)\n", result.EntryCount)
+		}
+	}
+	if result.Bundle != nil {
+		fmt.Fprintf(w, "   Bundle:         %d encrypted files, unlocked by one solve\n", len(result.Bundle))
+		for _, m := range result.Bundle {
+			fmt.Fprintf(w, "                   %s (%d bytes)\n", m.Name, m.Length)
+		}
+	}
+	fmt.Fprintf(w, "\n")
 
 	// Security Information
-	fmt.Printf("🔒 SECURITY INFORMATION\n")
-	fmt.Printf("   Security Level: %s\n", result.SecurityLevel)
-	fmt.Printf("   Key Required:   %s\n", formatBool(result.KeyRequired))
+	fmt.Fprintf(w, "🔒 SECURITY INFORMATION\n")
+	fmt.Fprintf(w, "   Security Level: %s\n", result.SecurityLevel)
+	fmt.Fprintf(w, "   Key Required:   %s\n", formatBool(result.KeyRequired))
 	if result.KeyRequired {
-		fmt.Printf("   Salt:           %x\n", result.Salt)
+		fmt.Fprintf(w, "   Salt:           %x\n", result.Salt)
+	}
+	if result.FileID != nil {
+		fmt.Fprintf(w, "   Base Tweak:     file ID %x, mixed with the work factor into the base\n", *result.FileID)
+	}
+	fmt.Fprintf(w, "   Key Derivation: %s\n", result.KeyDerivation)
+	fmt.Fprintf(w, "   Cipher:         %s\n", result.Cipher)
+	if result.KeySlots != 0 {
+		fmt.Fprintf(w, "   Key Slots:      %d (each passphrase opens a payload of its own)\n", result.KeySlots)
 	}
-	fmt.Printf("\n")
+	if g := result.SharedGroup; g != nil {
+		fmt.Fprintf(w, "   Shared Puzzle:  shared puzzle group %s (file %d of %d)\n", hex.EncodeToString(g.Group[:]), g.Index+1, g.Count)
+		fmt.Fprintf(w, "                   solving any file of the group unlocks all %d\n", g.Count)
+	}
+	fmt.Fprintf(w, "\n")
 
 	// Time-Lock Puzzle Information
-	fmt.Printf("⏰ TIME-LOCK PUZZLE\n")
-	fmt.Printf("   Work Factor:    %s operations\n", formatNumber(result.WorkFactor))
-	fmt.Printf("   Estimated Time: %s*\n", result.EstimatedTime)
-	fmt.Printf("\n")
+	fmt.Fprintf(w, "⏰ TIME-LOCK PUZZLE\n")
+	fmt.Fprintf(w, "   Work Factor:    %s operations\n", formatNumber(result.WorkFactor))
+	if result.PuzzleCount > 1 {
+		fmt.Fprintf(w, "   Puzzles:        %d, all of which must be solved (%s operations in all)\n", result.PuzzleCount, formatNumber(result.TotalWork))
+	}
+	fmt.Fprintf(w, "   Estimated Time: %s*\n", result.EstimatedTime)
+	machine := "this machine"
+	if p := result.Profile; p != nil {
+		machine = "the profiled machine"
+		fmt.Fprintf(w, "   Profile:        %s\n", p.Path)
+		if p.Host != nil {
+			fmt.Fprintf(w, "   Profiled Host:  %s (exported %s)\n", p.Host, p.Host.Exported.Format("2006-01-02"))
+		}
+	}
+	if c := result.Calibration; c != nil {
+		source := fmt.Sprintf("%d solve(s)", c.Samples)
+		if c.Samples == 0 {
+			source = "a benchmark"
+		}
+		fmt.Fprintf(w, "   Calibrated:     %.0f squarings/s from %s on %s (last %s)\n",
+			c.Rate, source, machine, c.Updated.Format("2006-01-02"))
+	}
+	if b := result.Benchmark; b != nil {
+		fmt.Fprintf(w, "   Benchmarked:    %s end to end on %s (%s)\n",
+			utils.FormatDuration(b.Estimate), machine, b.Measured.Format("2006-01-02"))
+	}
+	if rateCmp != nil {
+		intended := utils.EstimateTime(result.TotalWork, rateCmp.EncryptorRate)
+		fmt.Fprintf(w, "   Intended Delay: %s (encryptor: %.0f squarings/s)\n", utils.FormatDuration(intended), rateCmp.EncryptorRate)
+		fmt.Fprintf(w, "   Local Rate:     %.0f squarings/s\n", rateCmp.LocalRate)
+		fmt.Fprintf(w, "   Note:           %s\n", rateCmp.Message)
+	}
+	fmt.Fprintf(w, "\n")
 
 	// Cryptographic Parameters
-	fmt.Printf("🔢 CRYPTOGRAPHIC PARAMETERS\n")
-	fmt.Printf("   RSA Modulus (N):\n")
-	fmt.Printf("     Bit Length:   %d bits\n", result.ModulusN.BitLen())
-	fmt.Printf("     Hex (first 64 chars): %s...\n", fmt.Sprintf("%x", result.ModulusN)[:64])
-	fmt.Printf("\n")
-	fmt.Printf("   Base (G):\n")
-	fmt.Printf("     Bit Length:   %d bits\n", result.BaseG.BitLen())
-	fmt.Printf("     Hex (first 64 chars): %s...\n", fmt.Sprintf("%x", result.BaseG)[:64])
-	fmt.Printf("\n")
+	fmt.Fprintf(w, "🔢 CRYPTOGRAPHIC PARAMETERS\n")
+	fmt.Fprintf(w, "   RSA Modulus (N):\n")
+	fmt.Fprintf(w, "     Bit Length:   %d bits\n", result.ModulusN.BitLen())
+	fmt.Fprintf(w, "     Hex (first 64 chars): %s...\n", fmt.Sprintf("%064x", result.ModulusN)[:64])
+	fmt.Fprintf(w, "\n")
+	fmt.Fprintf(w, "   Base (G):\n")
+	fmt.Fprintf(w, "     Bit Length:   %d bits\n", result.BaseG.BitLen())
+	fmt.Fprintf(w, "     Hex (first 64 chars): %s...\n", fmt.Sprintf("%064x", result.BaseG)[:64])
+	fmt.Fprintf(w, "\n")
 
 	// Footer note
-	fmt.Printf("───────────────────────────────────────────────────────────────────────────────\n")
-	fmt.Printf("* Estimated time is approximate and depends on hardware performance\n")
-	fmt.Printf("  Use 'cryptotimed benchmark' to get more accurate estimates for your system\n")
+	fmt.Fprintf(w, "───────────────────────────────────────────────────────────────────────────────\n")
+	fmt.Fprintf(w, "* Estimated time is approximate and depends on hardware performance\n")
+	if result.Calibration == nil {
+		fmt.Fprintf(w, "  It is calibrated from solves on this machine once one has taken %s or more\n", utils.FormatDuration(utils.MinCalibrationSolve))
+	}
+}
+
+// describeParseError prints where a malformed file stops making sense,
+// with the bytes found there when the file is local, and returns a short
+// error in its place.  Other errors are returned as they are.
+func describeParseError(w io.Writer, input string, err error) error {
+	var pe *types.ParseError
+	if !errors.As(err, &pe) {
+		return err
+	}
+	fmt.Fprintf(w, "Malformed file: %s\n", input)
+	fmt.Fprintf(w, "  Field:    %s\n", pe.Field)
+	fmt.Fprintf(w, "  Offset:   %d (0x%x)\n", pe.Offset, pe.Offset)
+	fmt.Fprintf(w, "  Expected: %d bytes\n", pe.Length)
+	fmt.Fprintf(w, "  Problem:  %v\n", pe.Err)
+	if info, err := os.Stat(input); err == nil && info.Mode().IsRegular() && pe.Length > 0 {
+		// Show the start of what is there
+		avail := max(info.Size()-pe.Offset, 0)
+		found := make([]byte, min(avail, pe.Length, 16))
+		if f, err := os.Open(input); err == nil {
+			f.ReadAt(found, pe.Offset)
+			f.Close()
+		}
+		more := ""
+		if int64(len(found)) < min(avail, pe.Length) {
+			more = "..."
+		}
+		switch {
+		case avail == 0:
+			fmt.Fprintf(w, "  Found:    end of file\n")
+		case avail < pe.Length:
+			fmt.Fprintf(w, "  Found:    %x%s (%d bytes, then end of file)\n", found, more, avail)
+		default:
+			fmt.Fprintf(w, "  Found:    %x%s\n", found, more)
+		}
+	}
+	return fmt.Errorf("%s is not a valid encrypted file", input)
 }
 
 // formatBool formats a boolean value for display
@@ -125,3 +450,60 @@ func formatNumber(n uint64) string {
 	}
 	return result
 }
+
+// printListing prints a container's entry table in an ls -l like format.
+func printListing(w io.Writer, listing *operations.ListResult) {
+	if listing.Private {
+		fmt.Fprintf(w, "%s: the entry table is encrypted (created with --private-listing).\n", listing.InputFile)
+		fmt.Fprintf(w, "Listing its entries requires solving the puzzle; use decrypt to extract them.\n")
+		return
+	}
+
+	for _, e := range listing.Entries {
+		name := e.Name
+		if e.IsDir() {
+			name += "/"
+		}
+		fmt.Fprintf(w, "%s %12d  %s  %s\n", fs.FileMode(e.Mode), e.Size,
+			time.Unix(0, e.ModTime).Format("2006-01-02 15:04"), name)
+	}
+	fmt.Fprintf(w, "%d entries, %d bytes (listing is authenticated only when the container is decrypted)\n",
+		len(listing.Entries), listing.TotalSize)
+}
+
+// listingEntryJSON is the JSON form of a container entry.
+type listingEntryJSON struct {
+	Name    string `json:"name"`
+	Size    uint64 `json:"size"`
+	Mode    string `json:"mode"`
+	Dir     bool   `json:"dir"`
+	ModTime string `json:"mod_time"`
+}
+
+// printListingJSON prints a container's entry table as a JSON document.
+func printListingJSON(w io.Writer, listing *operations.ListResult) error {
+	out := struct {
+		File      string             `json:"file"`
+		Private   bool               `json:"private"`
+		Entries   []listingEntryJSON `json:"entries"`
+		TotalSize uint64             `json:"total_size"`
+	}{
+		File:      listing.InputFile,
+		Private:   listing.Private,
+		Entries:   []listingEntryJSON{},
+		TotalSize: listing.TotalSize,
+	}
+	for _, e := range listing.Entries {
+		out.Entries = append(out.Entries, listingEntryJSON{
+			Name:    e.Name,
+			Size:    e.Size,
+			Mode:    fs.FileMode(e.Mode).String(),
+			Dir:     e.IsDir(),
+			ModTime: time.Unix(0, e.ModTime).UTC().Format(time.RFC3339),
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"cryptotimed/src/operations"
+	"cryptotimed/src/utils"
+)
+
+var checkpointCommand = &Command{
+	Name:    "checkpoint",
+	Summary: "List saved decrypt checkpoints or remove stale ones",
+	Synopsis: []string{
+		"list [--dir DIR]...",
+		"gc [--dir DIR]... [--older-than DURATION] [--dry-run]",
+	},
+	Description: "List the checkpoints decrypt saves while solving, found under --dir (default: the current\n" +
+		"directory and the state directory, $" + utils.StateDirEnv + "), with the file each belongs to,\n" +
+		"its progress, age and size. A checkpoint FILE.resume belongs to FILE; one saved under another\n" +
+		"name with --checkpoint-file is taken to belong to a missing file.\n" +
+		"gc removes the checkpoints whose solve completed or whose file is gone or holds another puzzle,\n" +
+		"with the partly written output they recorded, if any.",
+	Examples: []string{
+		"cryptotimed checkpoint list",
+		"cryptotimed checkpoint list --dir ~/archive",
+		"cryptotimed checkpoint gc --dry-run",
+		"cryptotimed checkpoint gc --dir ~/archive --older-than 720h",
+	},
+	run: runCheckpoint,
+}
+
+// CheckpointCommand handles the checkpoint subcommand
+func CheckpointCommand(args []string) error {
+	return checkpointCommand.Run(args)
+}
+
+func runCheckpoint(c *Command, args []string) error {
+	fs := c.FlagSet()
+
+	var (
+		olderThan = fs.Duration("older-than", 0, "With gc, only remove checkpoints last updated longer ago than this, e.g. 720h")
+		dryRun    = fs.Bool("dry-run", false, "With gc, show what would be removed without removing it")
+		dirs      stringList
+	)
+	fs.Var(&dirs, "dir", "Look for checkpoints under this directory (repeatable; default: the current and state directories)")
+
+	rest, err := c.Parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 1 || (rest[0] != "list" && rest[0] != "gc") {
+		fs.Usage()
+		return fmt.Errorf("expected list or gc")
+	}
+	if rest[0] == "list" && (flagSet(fs, "older-than") || *dryRun) {
+		return fmt.Errorf("--older-than and --dry-run are only used with gc")
+	}
+	if *olderThan < 0 {
+		return fmt.Errorf("--older-than must be positive")
+	}
+	list := operations.CheckpointListOptions{Dirs: dirs}
+
+	if rest[0] == "list" {
+		checkpoints, err := operations.ListCheckpoints(list)
+		if err != nil {
+			return err
+		}
+		if len(checkpoints) == 0 {
+			fmt.Fprintf(c.stdout, "No checkpoints found\n")
+			return nil
+		}
+		for i, cp := range checkpoints {
+			if i > 0 {
+				fmt.Fprintln(c.stdout)
+			}
+			printCheckpoint(c.stdout, cp)
+		}
+		return nil
+	}
+
+	result, err := operations.GCCheckpoints(operations.CheckpointGCOptions{
+		CheckpointListOptions: list,
+		OlderThan:             *olderThan,
+		DryRun:                *dryRun,
+	})
+	if err != nil {
+		return err
+	}
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	for _, cp := range result.Removed {
+		fmt.Fprintf(c.stdout, "%s %s (%s: %s, %s)\n", verb, cp.Path, cp.State, checkpointReason(cp), utils.FormatSize(cp.Size))
+	}
+	for _, e := range result.Errors {
+		fmt.Fprintf(c.stdout, "Failed to remove %s\n", e)
+	}
+	fmt.Fprintf(c.stdout, "%s %d checkpoints (%s), kept %d\n", verb, len(result.Removed), utils.FormatSize(result.Freed), len(result.Kept))
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("failed to remove %d checkpoints", len(result.Errors))
+	}
+	return nil
+}
+
+// printCheckpoint prints one checkpoint of checkpoint list.
+func printCheckpoint(w io.Writer, cp operations.CheckpointInfo) {
+	fmt.Fprintf(w, "Checkpoint: %s (%s)\n", cp.Path, cp.State)
+	if cp.State == operations.CheckpointInvalid {
+		fmt.Fprintf(w, "  %s\n", cp.Reason)
+		return
+	}
+	file := cp.LockedFile
+	if cp.Puzzle > 1 {
+		file = fmt.Sprintf("%s, puzzle %d", file, cp.Puzzle)
+	}
+	if cp.Reason != "" {
+		file = fmt.Sprintf("%s: %s", file, cp.Reason)
+	}
+	fmt.Fprintf(w, "  File: %s\n", file)
+	fmt.Fprintf(w, "  Puzzle fingerprint: %s\n", hex.EncodeToString(cp.Fingerprint[:]))
+	fmt.Fprintf(w, "  Progress: %d of %d squarings (%.2f%%)\n", cp.Done, cp.WorkFactor, cp.Percent)
+	fmt.Fprintf(w, "  Age: %s (updated %s)\n", utils.FormatDuration(time.Since(cp.Updated)), cp.Updated.Format(time.RFC3339))
+	fmt.Fprintf(w, "  Size: %s\n", utils.FormatSize(cp.Size))
+}
+
+// checkpointReason says why gc removes a checkpoint.
+func checkpointReason(cp operations.CheckpointInfo) string {
+	if cp.Reason != "" {
+		return cp.Reason
+	}
+	return "solve finished"
+}
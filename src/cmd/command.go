@@ -0,0 +1,403 @@
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ConfigEnv names the environment variable giving the default --config file.
+const ConfigEnv = "CRYPTOTIMED_CONFIG"
+
+// ExitUnfinished is the exit status of a command that saved its progress
+// without finishing, e.g. decrypt --solve-for: running it again carries on.
+const ExitUnfinished = 3
+
+// exitStatus is returned by a command that has reported its outcome itself
+// and ends with a status other than 0 or 1.
+type exitStatus int
+
+func (s exitStatus) Error() string {
+	return fmt.Sprintf("exit status %d", int(s))
+}
+
+// Command describes a subcommand.  Its usage message and its line in the
+// command list are both generated from these fields, so that every command's
+// help has the same layout.
+type Command struct {
+	Name        string
+	Summary     string   // one line for the command list
+	Synopsis    []string // forms of the command line, after the command name
+	Description string   // printed below the synopsis
+	Sections    []string // further help printed after the options
+	Examples    []string // full command lines, with the program called cryptotimed
+	Hidden      []string // flags left out of the help, for internal use
+	JSON        bool     // whether the command has output for the global --json
+
+	run func(c *Command, args []string) error
+
+	// The streams of the current run (see Run).  stdout gets the messages
+	// the command prints, output the output asked for (--output -, --json,
+	// check --estimate-only, derive-key's key).  Both are stdout, but --quiet
+	// discards the messages, and an output written to stdout sends them to
+	// stderr (see stdoutFS).
+	stdout, output, stderr io.Writer
+}
+
+// commands lists every subcommand in the order of the command list.  It is
+// filled in by init because the commands look their config sections up in it.
+var commands []*Command
+
+func init() {
+	commands = []*Command{
+		encryptCommand,
+		decryptCommand,
+		verifySolveProofCommand,
+		checkCommand,
+		deriveKeyCommand,
+		bundleCommand,
+		extractDataCommand,
+		attachDataCommand,
+		reconstructCommand,
+		verifyLogCommand,
+		auditNoncesCommand,
+		puzzleCommand,
+		solvePuzzleCommand,
+		attachCommand,
+		installSolveCommand,
+		uninstallSolveCommand,
+		inspectResumeCommand,
+		checkpointCommand,
+		benchmarkCommand,
+		capabilitiesCommand,
+		overheadCommand,
+		breakevenCommand,
+		upgradeCommand,
+	}
+}
+
+// mainExamples are the examples of the top-level help.
+var mainExamples = []string{
+	`cryptotimed encrypt --input document.pdf --work 81000000`,
+	`cryptotimed encrypt --input document.pdf --work 81000000 --key "passphrase"`,
+	`cryptotimed decrypt --input document.pdf.locked`,
+	`cryptotimed decrypt --input document.pdf.locked --key "passphrase"`,
+	`cryptotimed decrypt --input document.pdf.locked --detach`,
+	`cryptotimed attach --pidfile document.pdf.locked.pid`,
+	`cryptotimed decrypt --input document.pdf.locked --emit-proof proof.json`,
+	`cryptotimed verify-solve-proof --proof proof.json --input document.pdf.locked`,
+	`cryptotimed check --input document.pdf.locked`,
+	`cryptotimed derive-key --input document.pdf.locked --output document.key`,
+	`cryptotimed bundle a.txt.locked b.txt.locked --output all.locked`,
+	`cryptotimed extract-data --input document.pdf.locked --output data.bin`,
+	`cryptotimed reconstruct --data data.bin --puzzle puzzle.json --output document.pdf.locked`,
+	`cryptotimed encrypt --input notes.txt --work 81000000 --append-to archive.ctlog`,
+	`cryptotimed verify-log --input archive.ctlog`,
+	`cryptotimed audit-nonces --input-glob "*.locked"`,
+	`cryptotimed puzzle --work 81000000 --output puzzle.json`,
+	`cryptotimed solve-puzzle --input puzzle.json`,
+	`cryptotimed inspect-resume --file document.pdf.locked.resume`,
+	`cryptotimed checkpoint gc --dry-run`,
+	`cryptotimed benchmark`,
+	`cryptotimed capabilities`,
+	`cryptotimed overhead --count 10000 --avg-size 4KiB`,
+	`cryptotimed breakeven --work 81000000000000 --growth 1.3`,
+	`cryptotimed upgrade --input old.txt.locked`,
+	`cryptotimed --config ~/.cryptotimed.conf decrypt --input document.pdf.locked`,
+}
+
+// Run runs the command with the arguments following its name, printing to
+// os.Stdout and os.Stderr.
+func (c *Command) Run(args []string) error {
+	return c.runWith(os.Stdout, os.Stderr, args)
+}
+
+// runWith runs the command printing to stdout and stderr.
+func (c *Command) runWith(stdout, stderr io.Writer, args []string) error {
+	c.stdout, c.output, c.stderr = stdout, stdout, stderr
+	return c.run(c, args)
+}
+
+// Execute runs the command line args (without the program name) and returns
+// the exit status.  Global options may come before the command name as well
+// as after it.
+func Execute(args []string) int {
+	return ExecuteWith(args, os.Stdout, os.Stderr)
+}
+
+// ExecuteWith is Execute printing to stdout and stderr instead of the
+// process's own.
+func ExecuteWith(args []string, stdout, stderr io.Writer) int {
+	global := newGlobalFlagSet("cryptotimed")
+	global.SetOutput(io.Discard)
+	if err := global.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			printUsage(stdout)
+			return 0
+		}
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	globalArgs := args[:len(args)-global.NArg()]
+	args = global.Args()
+	if len(args) == 0 {
+		printUsage(stdout)
+		return 1
+	}
+
+	name, args := args[0], args[1:]
+	if name == "help" {
+		if len(args) == 0 {
+			printUsage(stdout)
+			return 0
+		}
+		// help COMMAND is COMMAND --help
+		name, args = args[0], []string{"--help"}
+	}
+	c := lookupCommand(name)
+	if c == nil {
+		fmt.Fprintf(stderr, "Unknown command: %s\n\n", name)
+		printUsage(stdout)
+		return 1
+	}
+
+	// Global options given before the name are passed on to the command
+	err := c.runWith(stdout, stderr, append(append([]string{}, globalArgs...), args...))
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	var status exitStatus
+	if errors.As(err, &status) {
+		return int(status)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// lookupCommand returns the command with this name, or nil.
+func lookupCommand(name string) *Command {
+	for _, c := range commands {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// newGlobalFlagSet returns a flag set with only the global options, which
+// every command accepts.
+func newGlobalFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	addGlobalFlags(fs)
+	return fs
+}
+
+// addGlobalFlags defines the global options in fs.
+func addGlobalFlags(fs *flag.FlagSet) {
+	fs.String("config", os.Getenv(ConfigEnv), "Read default option values from this `FILE` (default $"+ConfigEnv+")")
+	fs.Bool("quiet", false, "Print nothing to stdout but the output asked for (--output -, --json, check --estimate-only, derive-key's key); errors and warnings still go to stderr")
+	fs.Bool("json", false, "Print the command's output as JSON, for the commands that have one (see their help)")
+}
+
+// globalBool returns the value of the boolean global option name in fs,
+// which must come from Command.FlagSet.
+func globalBool(fs *flag.FlagSet, name string) bool {
+	return fs.Lookup(name).Value.(flag.Getter).Get().(bool)
+}
+
+// FlagSet returns a flag set for the command's options, with the global
+// options already defined and its usage message set.
+func (c *Command) FlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.Name, flag.ContinueOnError)
+	addGlobalFlags(fs)
+	fs.Usage = func() { c.printUsage(fs) }
+	return fs
+}
+
+// Parse parses args with fs, which must come from c.FlagSet, then gives the
+// options not on the command line their values from the config file.
+// Options may come before, between and after the other arguments, which are
+// returned in order; everything after a "--" is an argument.  A -h or --help
+// prints the usage and returns flag.ErrHelp.
+func (c *Command) Parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	usage := fs.Usage
+	fs.Usage = func() {}
+	fs.SetOutput(io.Discard)
+	defer func() {
+		fs.Usage = usage
+		fs.SetOutput(nil)
+	}()
+
+	options, rest := splitArgs(fs, args)
+	if err := fs.Parse(options); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			usage()
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s: %v (see '%s %s --help')", c.Name, err, os.Args[0], c.Name)
+	}
+
+	if config := fs.Lookup("config").Value.String(); config != "" {
+		if err := c.applyConfig(fs, config); err != nil {
+			return nil, err
+		}
+	}
+	if globalBool(fs, "json") && !c.JSON {
+		return nil, fmt.Errorf("%s has no JSON output", c.Name)
+	}
+	if globalBool(fs, "quiet") {
+		c.stdout = io.Discard
+	}
+	return rest, nil
+}
+
+// splitArgs separates the options in args, with their values, from the
+// other arguments, keeping both in order.  An option that takes a value
+// takes the next argument, whatever it is; any other "--" ends the options,
+// and every argument after it is one of the others.
+func splitArgs(fs *flag.FlagSet, args []string) (options, rest []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return options, append(rest, args[i+1:]...)
+		case len(arg) < 2 || arg[0] != '-':
+			rest = append(rest, arg)
+			continue
+		}
+		options = append(options, arg)
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") || i+1 == len(args) {
+			continue
+		}
+		if f := fs.Lookup(name); f != nil {
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+				i++
+				options = append(options, args[i])
+			}
+		}
+	}
+	return options, rest
+}
+
+// applyConfig sets the options in the command's section of the config file
+// that were not given on the command line.  The file holds one option per
+// line, as "name = value", under a "[command]" line naming the command it is
+// for; blank lines and lines starting with # are ignored.  A repeated option
+// is set once per line, like a repeated flag.
+func (c *Command) applyConfig(fs *flag.FlagSet, filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %v", err)
+	}
+	defer file.Close()
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if lookupCommand(section) == nil {
+				return fmt.Errorf("%s:%d: unknown command %q", filename, n, section)
+			}
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected \"name = value\" or \"[command]\"", filename, n)
+		}
+		name = strings.TrimPrefix(strings.TrimSpace(name), "--")
+		value = strings.TrimSpace(value)
+		if section == "" {
+			return fmt.Errorf("%s:%d: option %s is not under a [command] line", filename, n, name)
+		}
+		if section != c.Name {
+			continue
+		}
+		if name == "config" || fs.Lookup(name) == nil {
+			return fmt.Errorf("%s:%d: %s has no option --%s", filename, n, c.Name, name)
+		}
+		if given[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q for --%s: %v", filename, n, value, name, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+	return nil
+}
+
+// printUsage prints the command's usage message to stderr.
+func (c *Command) printUsage(fs *flag.FlagSet) {
+	w := c.stderr
+	for i, synopsis := range c.Synopsis {
+		prefix := "Usage:"
+		if i > 0 {
+			prefix = "      "
+		}
+		fmt.Fprintf(w, "%s %s %s %s\n", prefix, os.Args[0], c.Name, synopsis)
+	}
+	fmt.Fprintf(w, "\n%s\n\n", c.Description)
+
+	global := newGlobalFlagSet(c.Name)
+	hidden := append([]string{}, c.Hidden...)
+	global.VisitAll(func(f *flag.Flag) { hidden = append(hidden, f.Name) })
+	fmt.Fprintf(w, "Options:\n")
+	printDefaults(fs, w, hidden...)
+	fmt.Fprintf(w, "\nGlobal options:\n")
+	printDefaults(global, w)
+	for _, section := range c.Sections {
+		fmt.Fprintf(w, "\n%s", section)
+	}
+	if len(c.Examples) > 0 {
+		fmt.Fprintf(w, "\nExamples:\n")
+		printExamples(w, c.Examples)
+	}
+}
+
+// printUsage prints the top-level help, listing every command.
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "cryptotimed - RSA Time-Lock Puzzle Encryption Tool\n\n")
+	fmt.Fprintf(w, "Usage:\n")
+	fmt.Fprintf(w, "  %s [global options] <command> [options]\n\n", os.Args[0])
+	fmt.Fprintf(w, "Commands:\n")
+	width := len("help")
+	for _, c := range commands {
+		width = max(width, len(c.Name))
+	}
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-*s %s\n", width, c.Name, c.Summary)
+	}
+	fmt.Fprintf(w, "  %-*s %s\n\n", width, "help", "Show this help message, or a command's with help COMMAND")
+	fmt.Fprintf(w, "Global options:\n")
+	printDefaults(newGlobalFlagSet("cryptotimed"), w)
+	fmt.Fprintf(w, "\nExamples:\n")
+	printExamples(w, mainExamples)
+	fmt.Fprintf(w, "\nFor detailed help on a command, use:\n")
+	fmt.Fprintf(w, "  %s <command> --help\n", os.Args[0])
+}
+
+// printExamples prints example command lines, naming the program as it was
+// run.
+func printExamples(w io.Writer, examples []string) {
+	for _, example := range examples {
+		fmt.Fprintf(w, "  %s\n", strings.ReplaceAll(example, "cryptotimed ", os.Args[0]+" "))
+	}
+}
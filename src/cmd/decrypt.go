@@ -1,37 +1,139 @@
 package cmd
 
 import (
-	"flag"
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"cryptotimed/src/crypto"
 	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
 	"cryptotimed/src/utils"
 )
 
+// defaultCheckpointInterval is how often decrypt saves solving progress.
+const defaultCheckpointInterval = 10 * time.Minute
+
+// memoryCheckpointEvery is how many squarings apart decrypt
+// --checkpoint-on-signal keeps the solve's state in memory, about as much as
+// a checkpoint written on request can lose.
+const memoryCheckpointEvery = crypto.DefaultSnapshotInterval
+
+var decryptCommand = &Command{
+	Name:    "decrypt",
+	Summary: "Decrypt a time-locked file",
+	Synopsis: []string{
+		"[--input] FILE|DIR|GLOB|- [FILE...] [--key KEY] [--output FILE|- [--force] | --output-dir DIR] [--output-template TEMPLATE] [--entry GLOB]... [--cache-target | --target HEX | --emit-proof FILE] [--yes] [--confirm-over DURATION] [--checkpoint-file FILE] [--resume] [--checkpoint-interval DURATION] [--checkpoint-every ITERATIONS] [--checkpoint-on-signal] [--solve-for DURATION] [--detach [--pidfile FILE] [--log-file FILE]] [--publish-key URL [--publish-secret KEY] [--publish-dry-run]] [--pin-thread] [--cpu-limit PERCENT] [--skip-space-check] [--in-place] [--ephemeral DURATION --keep-alive]",
+	},
+	Description: "Decrypt a file encrypted with RSA time-lock puzzle\n" +
+		"A directory, glob or several files decrypts every .locked file found, one after another.\n" +
+		"An http:// or https:// input is fetched into memory; its outputs go to the current directory.\n" +
+		"With --input -, the encrypted file is copied from stdin to a temporary file, not memory, and progress is\n" +
+		"only checkpointed to an explicit --checkpoint-file; the plaintext goes to stdout unless an output is named.\n" +
+		"With --output -, the plaintext is written to stdout and every message goes to stderr; a chunked file is\n" +
+		"written chunk by chunk as each is authenticated.\n" +
+		"Plaintext is not written to a terminal unless --force is given.\n" +
+		"With --in-place, only the plaintext is left; run it again to finish an operation interrupted by a crash.\n" +
+		"With --solve-for, the solve stops with a checkpoint after that long and exits with status 3 (progress\n" +
+		"saved, not finished), without asking to confirm a long solve, so that cron can run it again to carry on.\n" +
+		"With --emit-proof, a proof that the puzzle was solved is written alongside the output; anyone can check it\n" +
+		"with verify-solve-proof in a small fraction of the solve time. It needs the puzzle solved from the start.\n" +
+		"A checkpoint that does not fit the file is ignored with a warning; with --resume it is an error, as is a\n" +
+		"missing one, so a wrong --checkpoint-file never starts a long solve over.\n" +
+		"With --cpu-limit, the solve sleeps between batches of squarings to use about that share of one core,\n" +
+		"taking as much longer; the share actually used is reported at the end.",
+	Sections: []string{templateHelp, controlsHelp},
+	Examples: []string{
+		"cryptotimed decrypt --input document.pdf.locked",
+		`cryptotimed decrypt --input document.pdf.locked --key "my passphrase"`,
+		"cryptotimed decrypt --input document.pdf.locked --key @file:keyfile.txt",
+		"cryptotimed decrypt --input photos.locked --entry 'album/*.jpg' --cache-target",
+		"cryptotimed decrypt --input /media/backup --output-dir restored/",
+		"cryptotimed decrypt --input report.tlp --output-template 'restored/{date}/{base}'",
+		"cryptotimed decrypt --input https://example.com/archive.tar.locked --timeout 10m",
+		"cryptotimed decrypt --input - --output - --yes < mydb.sql.locked | psql mydb",
+		"cryptotimed decrypt --yes - < project.tar.locked | tar x",
+		"cryptotimed decrypt --input archive.tar.locked --detach",
+		"cryptotimed decrypt --input archive.tar.locked --confirm-over 720h",
+		"cryptotimed decrypt --input archive.tar.locked --solve-for 8h",
+		"cryptotimed decrypt --input archive.tar.locked --checkpoint-file /mnt/usb/archive.resume --resume",
+		"cryptotimed decrypt --input prediction.txt.locked --publish-key https://example.com/release --publish-secret @file:hmac.key",
+		"cryptotimed decrypt --input document.pdf.locked --pin-thread",
+		"cryptotimed decrypt --input archive.tar.locked --cpu-limit 50% --detach",
+		`cryptotimed decrypt --input document.pdf.locked --target "$(jq -r .target release.json)"`,
+		"cryptotimed decrypt --input prediction.txt.locked --emit-proof proof.json",
+		"cryptotimed decrypt --input disk.img.locked --in-place",
+		"cryptotimed decrypt --input document.pdf.locked --ephemeral 10m --keep-alive",
+	},
+	Hidden: []string{"detached-pidfile"},
+	run:    runDecrypt,
+}
+
 // DecryptCommand handles the decrypt subcommand
 func DecryptCommand(args []string) error {
-	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	return decryptCommand.Run(args)
+}
+
+func runDecrypt(c *Command, args []string) error {
+	fs := c.FlagSet()
 
 	var (
-		inputFile  = fs.String("input", "", "Encrypted file to decrypt (required)")
+		inputFile  = fs.String("input", "", "Encrypted file to decrypt, or - for stdin (required, or as the first argument)")
 		keyInput   = fs.String("key", "", "Passphrase or @file:path (required if file was encrypted with key)")
 		outputFile = fs.String("output", "", "Output file (default: removes .locked extension)")
+		outputDir  = fs.String("output-dir", "", "Write outputs under this directory, keeping relative paths in batch mode")
+		template   = fs.String("output-template", "", "Name outputs from a template (default "+operations.DefaultDecryptTemplate+"; see placeholders below)")
+		ephemeral  = fs.Duration("ephemeral", 0, "Securely delete the output after this long (requires --keep-alive)")
+		keepAlive  = fs.Bool("keep-alive", false, "Stay in the foreground until the --ephemeral deletion has run")
+		pinThread  = fs.Bool("pin-thread", false, "Lock the solver to one OS thread for a steadier squaring rate")
+		gcPercent  = fs.Int("gogc", 0, "GOGC value while solving (0 = leave unchanged, -1 = disable GC)")
+		cpuLimit   = fs.String("cpu-limit", "", "Hold the solve to about this share of one core, e.g. 50% (default: all of it)")
+		noCalib    = fs.Bool("no-calibrate", false, "Keep this solve's rate out of the calibration profile used for estimates (e.g. while benchmarking)")
+		redraw     = fs.Duration("progress-interval", utils.DefaultRedrawInterval, "Redraw the progress bar at least this often (0 = only on progress)")
+		cache      = fs.Bool("cache-target", false, "Reuse a cached puzzle solution and cache this one (anyone who can read the cache can decrypt)")
+		checkpoint = fs.String("checkpoint-file", "", "Save solving progress to this file and resume from it (default: INPUT.resume)")
+		statusFile = fs.String("status-file", "", "Keep a JSON description of the solve's progress in this file")
+		resume     = fs.Bool("resume", false, "Carry on from the checkpoint and fail if there is none to resume, instead of starting over")
+		interval   = fs.Duration("checkpoint-interval", defaultCheckpointInterval, "Save a checkpoint this often while solving (0 = only on request or quit)")
+		every      = fs.Uint64("checkpoint-every", 0, "Also save a checkpoint every this many squarings (0 = by time only)")
+		onSignal   = fs.Bool("checkpoint-on-signal", false, "Keep progress in memory and only write a checkpoint on c, SIGUSR2, quit or an explicit --checkpoint-interval or --checkpoint-every")
+		solveFor   = fs.Duration("solve-for", 0, "Solve for this long, not counting pauses, then save a checkpoint and exit with status 3 (0 = until solved)")
+		yes        = fs.Bool("yes", false, "Start solving without asking, however long it is estimated to take")
+		confirm    = fs.Duration("confirm-over", operations.DefaultConfirmOver, "Ask before starting a solve estimated to take longer than this on this machine (0 = never ask)")
+		detach     = fs.Bool("detach", false, "Solve in the background and return immediately (follow it with attach)")
+		pidFile    = fs.String("pidfile", "", "With --detach, record the background process ID in this file (default: INPUT.pid)")
+		logFile    = fs.String("log-file", "", "With --detach, append the background output to this file (default: INPUT.log)")
+		timeout    = fs.Duration("timeout", utils.DefaultFetchTimeout, "Give up fetching an http(s) --input after this long")
+		skipSpace  = fs.Bool("skip-space-check", false, "Do not compare the output filesystem's free space with the output size before solving (for filesystems that misreport it)")
+		inPlace    = fs.Bool("in-place", false, "Replace a chunked input with its plaintext; without room for both it is decrypted over its own bytes")
+		targetHex  = fs.String("target", "", "Decrypt with this puzzle solution, in hex (e.g. from a key release), instead of solving")
+		proofFile  = fs.String("emit-proof", "", "Write a proof that the puzzle was solved to this file (check it with verify-solve-proof)")
+		force      = fs.Bool("force", false, "With --output -, write the plaintext to stdout even when it is a terminal")
+		detached   = fs.String("detached-pidfile", "", "") // internal: set in the process started by --detach
+		entries    stringList
 	)
+	fs.Var(&entries, "entry", "Extract only container entries matching this glob (repeatable)")
+	publish := addPublishFlags(fs)
 
-	fs.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s decrypt --input FILE [--key KEY] [--output FILE]\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "\nDecrypt a file encrypted with RSA time-lock puzzle\n\n")
-		fmt.Fprintf(os.Stderr, "Options:\n")
-		fs.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "\nExamples:\n")
-		fmt.Fprintf(os.Stderr, "  %s decrypt --input document.pdf.locked\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s decrypt --input document.pdf.locked --key \"my passphrase\"\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s decrypt --input document.pdf.locked --key @file:keyfile.txt\n", os.Args[0])
+	// Extra file arguments (e.g. from a shell glob) may come between the options
+	extra, err := c.Parse(fs, args)
+	if err != nil {
+		return err
 	}
 
-	if err := fs.Parse(args); err != nil {
-		return err
+	// The input may also be the first argument, e.g. "-" in a pipe
+	if *inputFile == "" && len(extra) > 0 {
+		*inputFile, extra = extra[0], extra[1:]
 	}
 
 	// Validate required arguments
@@ -39,51 +141,789 @@ func DecryptCommand(args []string) error {
 		fs.Usage()
 		return fmt.Errorf("--input is required")
 	}
+	if *ephemeral < 0 {
+		return fmt.Errorf("--ephemeral must be a positive duration")
+	}
+	if *ephemeral > 0 && !*keepAlive {
+		return fmt.Errorf("--ephemeral requires --keep-alive: the output is only deleted while this process keeps running")
+	}
+	if err := publish.validate(); err != nil {
+		return err
+	}
+	if *interval < 0 {
+		return fmt.Errorf("--checkpoint-interval must not be negative")
+	}
+	if *solveFor < 0 {
+		return fmt.Errorf("--solve-for must not be negative")
+	}
+	if *confirm < 0 {
+		return fmt.Errorf("--confirm-over must not be negative")
+	}
+	if *timeout < 0 {
+		return fmt.Errorf("--timeout must not be negative")
+	}
+	var throttle *crypto.CPUThrottle
+	if *cpuLimit != "" {
+		limit, err := parseCPULimit(*cpuLimit)
+		if err != nil {
+			return fmt.Errorf("--cpu-limit: %v", err)
+		}
+		if throttle, err = crypto.NewCPUThrottle(limit); err != nil {
+			return fmt.Errorf("--cpu-limit: %v", err)
+		}
+	}
+	if (*pidFile != "" || *logFile != "") && !*detach {
+		return fmt.Errorf("--pidfile and --log-file require --detach")
+	}
+	if *outputFile != "" && *outputDir != "" {
+		return fmt.Errorf("--output and --output-dir cannot be used together")
+	}
+	if *template != "" {
+		if *outputFile != "" {
+			return fmt.Errorf("--output and --output-template cannot be used together")
+		}
+		if _, err := operations.ParseOutputTemplate(*template); err != nil {
+			return err
+		}
+	}
+	if *inPlace {
+		switch {
+		case *outputFile != "" || *outputDir != "" || *template != "":
+			return fmt.Errorf("--in-place cannot be used with --output, --output-dir or --output-template")
+		case *ephemeral > 0:
+			return fmt.Errorf("--in-place cannot be used with --ephemeral: nothing would be left")
+		case len(extra) > 0 || isBatch([]string{*inputFile}):
+			return fmt.Errorf("--in-place decrypts a single file")
+		case utils.IsURL(*inputFile):
+			return fmt.Errorf("--in-place needs a local file")
+		}
+	}
+
+	// A pipe in goes to a pipe out, unless told otherwise
+	if *inputFile == stdio && *outputFile == "" && *outputDir == "" && *template == "" && !*inPlace {
+		*outputFile = stdio
+	}
+	if *force && *outputFile != stdio {
+		return fmt.Errorf("--force is only used with --output -")
+	}
+	if *outputFile == stdio {
+		switch {
+		case isTerminal(c.output) && !*force:
+			return fmt.Errorf("refusing to write the plaintext to a terminal (redirect stdout, use --output FILE, or --force)")
+		case *ephemeral > 0:
+			return fmt.Errorf("--ephemeral cannot be used with --output -: there is no file to delete")
+		case *detach:
+			return fmt.Errorf("--detach cannot be used with --output -: a background solve has no stdout to write to")
+		}
+	}
+	if *inputFile == stdio {
+		switch {
+		case len(extra) > 0:
+			return fmt.Errorf("--input - decrypts a single file")
+		case *detach:
+			return fmt.Errorf("--detach cannot be used with --input -: a background solve cannot read stdin")
+		case *inPlace:
+			return fmt.Errorf("--in-place needs a local file")
+		case *checkpoint == "" && (*resume || *solveFor > 0):
+			return fmt.Errorf("--resume and --solve-for need --checkpoint-file with --input -")
+		}
+	}
+
+	var target *big.Int
+	if *targetHex != "" {
+		if target, err = parseTarget(*targetHex); err != nil {
+			return fmt.Errorf("--target: %v", err)
+		}
+		if *detach {
+			return fmt.Errorf("--target cannot be used with --detach: there is nothing to solve")
+		}
+		if *solveFor > 0 {
+			return fmt.Errorf("--target cannot be used with --solve-for: there is nothing to solve")
+		}
+		if *resume {
+			return fmt.Errorf("--target cannot be used with --resume: there is nothing to solve")
+		}
+	}
+	if *proofFile != "" {
+		switch {
+		case target != nil || *cache:
+			return fmt.Errorf("--emit-proof cannot be used with --target or --cache-target: the puzzle must be solved here")
+		case *solveFor > 0:
+			return fmt.Errorf("--emit-proof cannot be used with --solve-for: the puzzle must be solved in one run")
+		case *resume:
+			return fmt.Errorf("--emit-proof cannot be used with --resume: the puzzle must be solved from the start")
+		}
+	}
+
+	// With --output -, stdout carries the plaintext alone
+	var outputFS utils.WriteFS
+	if *outputFile == stdio {
+		outputFS = c.stdoutFS()
+	}
 
 	// Prepare options for the operation
 	opts := operations.DecryptOptions{
-		InputFile:  *inputFile,
-		KeyInput:   *keyInput,
-		OutputFile: *outputFile,
+		InputFile:      *inputFile,
+		KeyInput:       *keyInput,
+		OutputFile:     *outputFile,
+		OutputDir:      *outputDir,
+		OutputTemplate: *template,
+		PinThread:      *pinThread,
+		GCPercent:      *gcPercent,
+		NoCalibrate:    *noCalib,
+		Entries:        entries,
+		CacheTarget:    *cache,
+		FetchTimeout:   *timeout,
+		SkipSpaceCheck: *skipSpace,
+		InPlace:        *inPlace,
+		Target:         target,
+		ProofFile:      *proofFile,
+		Throttle:       throttle,
+		OutputFS:       outputFS,
+	}
+
+	// Solves estimated to take very long are only started when confirmed;
+	// a time-boxed one spends no more than its budget
+	gate := operations.SolveGate{Threshold: *confirm, Yes: *yes || *solveFor > 0, Prompt: terminalPrompt(c.stdout)}
+
+	// Several files, a directory or a glob are decrypted as a batch
+	inputs := append([]string{*inputFile}, extra...)
+	if isBatch(inputs) {
+		switch {
+		case *outputFile != "":
+			return fmt.Errorf("--output cannot be used when decrypting several files (use --output-dir)")
+		case len(entries) > 0:
+			return fmt.Errorf("--entry cannot be used when decrypting several files")
+		case *ephemeral > 0:
+			return fmt.Errorf("--ephemeral cannot be used when decrypting several files")
+		case *checkpoint != "":
+			return fmt.Errorf("--checkpoint-file cannot be used when decrypting several files")
+		case *statusFile != "":
+			return fmt.Errorf("--status-file cannot be used when decrypting several files")
+		case publish.enabled():
+			return fmt.Errorf("--publish-key cannot be used when decrypting several files")
+		case *detach:
+			return fmt.Errorf("--detach cannot be used when decrypting several files")
+		case target != nil:
+			return fmt.Errorf("--target cannot be used when decrypting several files")
+		case *solveFor > 0:
+			return fmt.Errorf("--solve-for cannot be used when decrypting several files")
+		case *every > 0:
+			return fmt.Errorf("--checkpoint-every cannot be used when decrypting several files")
+		case *onSignal:
+			return fmt.Errorf("--checkpoint-on-signal cannot be used when decrypting several files")
+		case *resume:
+			return fmt.Errorf("--resume cannot be used when decrypting several files")
+		case *proofFile != "":
+			return fmt.Errorf("--emit-proof cannot be used when decrypting several files")
+		}
+		return decryptBatch(c.stdout, inputs, opts, *redraw, gate)
+	}
+
+	// An interrupted in-place operation is finished without solving
+	if _, err := os.Stat(utils.InPlaceJournalPath(*inputFile)); err == nil {
+		if !*inPlace {
+			return fmt.Errorf("%s was left half-transformed by an interrupted in-place operation; run again with --in-place to finish it", *inputFile)
+		}
+		fmt.Fprintf(c.stdout, "Finishing an interrupted in-place operation on %s...\n", *inputFile)
+		result, err := operations.DecryptFile(opts, nil)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stdout, "Finished the interrupted operation: %s is now %s\n", result.InputFile, result.OutputFile)
+		return nil
+	}
+
+	// Checkpoints let an interrupted solve carry on where it stopped; stdin
+	// has no name to keep one next to
+	opts.CheckpointPath = *checkpoint
+	if opts.CheckpointPath == "" && *inputFile != stdio {
+		opts.CheckpointPath = operations.InputName(*inputFile) + ".resume"
+	}
+	input := *inputFile
+	if *inputFile == stdio {
+		var remove func()
+		if input, remove, err = spoolStdin(); err != nil {
+			return err
+		}
+		defer remove()
+		opts.LocalCopy = input
+	}
+	opts.RequireCheckpoint = *resume
+	if *resume {
+		// Fail before estimating, confirming or detaching
+		if _, err := os.Stat(opts.CheckpointPath); err != nil {
+			return fmt.Errorf("--resume: no checkpoint at %s to resume from", opts.CheckpointPath)
+		}
+	}
+
+	if *detach {
+		if utils.IsURL(*inputFile) {
+			return fmt.Errorf("--detach needs a local file (download the URL first)")
+		}
+		return detachDecrypt(c.stdout, args, detachPaths{
+			input:      *inputFile,
+			pidFile:    *pidFile,
+			logFile:    *logFile,
+			statusFile: *statusFile,
+			checkpoint: opts.CheckpointPath,
+		}, *keyInput != "", gate)
+	}
+	if *detached != "" {
+		// Started by --detach: remove the pidfile on the way out
+		defer utils.RemovePIDFile(*detached, os.Getpid())
+		fmt.Fprintf(c.stdout, "Background solve started %s (pid %d)\n", time.Now().Format(time.RFC3339), os.Getpid())
 	}
 
 	// Display initial progress messages
-	fmt.Printf("Reading encrypted file: %s\n", *inputFile)
+	fmt.Fprintf(c.stdout, "Reading encrypted file: %s\n", *inputFile)
 
-	// Read encrypted file to get work factor for progress display
-	ef, err := utils.ReadEncryptedFile(*inputFile)
+	// Read the header to get work factor for progress display
+	header, err := operations.ReadInputHeader(opts.FS, input, *timeout)
 	if err != nil {
-		return fmt.Errorf("failed to read encrypted file: %v", err)
+		return err
+	}
+	if outputFS != nil && (header.Ext.Container != nil || header.Ext.Bundle != nil) {
+		return fmt.Errorf("--output - needs a single file, but this one decrypts to a directory")
 	}
 
 	// Check if key is required and provide warning if needed
-	if ef.KeyRequired == 0 && *keyInput != "" {
-		fmt.Printf("Warning: key provided but file was encrypted without key (ignoring key)\n")
+	if header.KeyRequired == 0 && *keyInput != "" {
+		fmt.Fprintf(c.stdout, "Warning: key provided but file was encrypted without key (ignoring key)\n")
 	}
 
-	fmt.Printf("Solving time-lock puzzle (%d sequential squarings)...\n", ef.WorkFactor)
+	// Estimate the solve on this machine before committing to it; a
+	// throttled solve takes as much longer as it squares at a fraction of
+	// the rate
+	if target == nil {
+		squarings := remainingSquarings(header, opts.CheckpointPath)
+		if throttle != nil {
+			squarings = uint64(float64(squarings) / throttle.Limit())
+		}
+		if err := estimateSolve(c.stdout, []*types.FileHeader{header}, squarings, gate); err != nil {
+			return err
+		}
+	}
+
+	if target == nil && header.PuzzleCount() > 1 {
+		fmt.Fprintf(c.stdout, "Solving %d time-lock puzzles one after another (%d sequential squarings in all)...\n", header.PuzzleCount(), header.TotalWork())
+	} else if target == nil {
+		fmt.Fprintf(c.stdout, "Solving time-lock puzzle (%d sequential squarings)...\n", header.TotalWork())
+	}
 
 	// Create progress bar
-	progressBar := utils.NewProgressBar(ef.WorkFactor)
+	progressBar := utils.NewProgressBar(header.TotalWork())
+	progressBar.SetOutput(c.stdout)
+	if *detached != "" || target != nil {
+		// Output goes to the log file; attach draws the bar from the status file.
+		// With --target there is nothing to solve.
+		progressBar.HideBar()
+	}
+	progressBar.StartTicker(*redraw)
+
+	// Other processes can follow the solve through the status file
+	status := newStatusReporter(*statusFile, *inputFile, header.TotalWork(), progressBar)
+	status.update(utils.StatusSolving, nil)
+
+	opts.Control = &crypto.SolveControl{}
+	opts.CheckpointInterval = *interval
+	opts.CheckpointEvery = *every
+	checkpointNow := opts.Control.RequestCheckpoint
+	if *onSignal {
+		// Checkpoints are written from the state kept in memory, only when asked
+		if !flagSet(fs, "checkpoint-interval") {
+			opts.CheckpointInterval = 0
+		}
+		opts.MemoryCheckpointEvery = memoryCheckpointEvery
+		flush := make(chan struct{}, 1)
+		opts.FlushCheckpoint = flush
+		checkpointNow = func() {
+			select {
+			case flush <- struct{}{}:
+			default: // a flush is already on its way
+			}
+		}
+	}
+	opts.SolveFor = *solveFor
+	checkpoints := &checkpointClock{}
+	opts.OnResume = func(done uint64) {
+		if info, err := os.Stat(opts.CheckpointPath); err == nil {
+			checkpoints.saved(info.ModTime())
+		}
+		progressBar.SetBaseline(done)
+		progressBar.Printf("Resuming from checkpoint %s (%d of %d squarings done)", opts.CheckpointPath, done, header.TotalWork())
+		status.set(func(s *utils.SolveStatus) { s.Resumed = done })
+	}
+	opts.OnCheckpoint = func(state crypto.SolvingState, err error) {
+		if err != nil {
+			progressBar.Printf("Warning: failed to save checkpoint: %v", err)
+			return
+		}
+		checkpoints.saved(time.Now())
+		progressBar.Printf("Checkpoint saved: %s (%d squarings done)", opts.CheckpointPath, state.Done)
+		if state.Done > progressBar.Info().Done {
+			progressBar.Update(state.Done)
+		}
+		status.set(func(s *utils.SolveStatus) { s.Checkpoint = opts.CheckpointPath })
+	}
+
+	// Signals stop the solve with a checkpoint; single keys steer it when attended
+	var keys *utils.KeyReader
+	var keyPresses <-chan byte
+	if utils.IsTerminal(os.Stdin) {
+		if keys, err = utils.NewKeyReader(os.Stdin); err == nil {
+			defer keys.Close() // also on panics
+			keyPresses = keys.Keys()
+			fmt.Fprintf(c.stdout, "Keys: p pause/resume, c checkpoint now, q checkpoint and quit, s status\n")
+		}
+	}
+	controls := watchControls(c.stderr, keyPresses, opts.Control, checkpointNow, progressBar, status, checkpoints)
+	opts.Context = controls.ctx
 
 	// Perform the decryption operation with progress tracking
 	result, err := operations.DecryptFile(opts, func(done uint64) {
 		progressBar.Update(done)
+		status.progress()
 	})
+	controls.stop()
+	if keys != nil {
+		keys.Close()
+	}
+	if errors.Is(err, operations.ErrSolveTimeUp) {
+		progressBar.StopTicker()
+		status.update(utils.StatusStopped, nil)
+		fmt.Fprintf(c.stdout, "\nStopped: %v\n", err)
+		printSolveLeft(c.stdout, progressBar, *solveFor)
+		fmt.Fprintf(c.stdout, "Run the same command again to carry on.\n")
+		return exitStatus(ExitUnfinished)
+	}
+	if errors.Is(err, crypto.ErrSolveStopped) {
+		progressBar.StopTicker()
+		status.update(utils.StatusStopped, nil)
+		fmt.Fprintf(c.stdout, "\nStopped: %v\n", err)
+		if opts.CheckpointPath != "" {
+			fmt.Fprintf(c.stdout, "Run the same command again to resume.\n")
+		}
+		if errors.Is(err, errInterrupted) {
+			return errInterrupted
+		}
+		return nil
+	}
 	if err != nil {
+		progressBar.StopTicker()
+		status.update(utils.StatusFailed, err)
 		return err
 	}
 
+	status.set(func(s *utils.SolveStatus) {
+		s.State = utils.StatusDone
+		s.OutputFile = result.OutputFile
+	})
 	progressBar.Finish()
 
+	for _, warning := range result.Warnings {
+		fmt.Fprintf(c.stdout, "Warning: %s\n", warning)
+	}
+
 	// Display results
-	fmt.Printf("Puzzle solved!\n")
-	fmt.Printf("Decrypting data...\n")
-	fmt.Printf("Writing decrypted file: %s\n", result.OutputFile)
-	fmt.Printf("Decryption complete!\n")
-	fmt.Printf("Input file: %s\n", result.InputFile)
-	fmt.Printf("Output file: %s (%d bytes)\n", result.OutputFile, result.PlaintextSize)
-	fmt.Printf("Work factor: %d sequential squarings\n", result.WorkFactor)
+	if target != nil {
+		fmt.Fprintf(c.stdout, "Puzzle solution given with --target (no solving needed)\n")
+	} else if result.FromCache {
+		fmt.Fprintf(c.stdout, "Puzzle solution loaded from cache (no solving needed)\n")
+	} else {
+		fmt.Fprintf(c.stdout, "Puzzle solved!\n")
+	}
+	fmt.Fprintf(c.stdout, "Decrypting data...\n")
+	if result.ResumedChunks > 0 {
+		fmt.Fprintf(c.stdout, "Carried on from an interrupted decrypt: %d chunks of the output were already written\n", result.ResumedChunks)
+	}
+	switch {
+	case result.DataKey != nil:
+		fmt.Fprintf(c.stdout, "Decryption complete!\n")
+		fmt.Fprintf(c.stdout, "Input file: %s\n", result.InputFile)
+		if result.OutputFile != "" {
+			fmt.Fprintf(c.stdout, "Data key written: %s (hex)\n", result.OutputFile)
+		} else {
+			fmt.Fprintf(c.stdout, "Data key: %s\n", hex.EncodeToString(result.DataKey))
+		}
+	case result.Bundle:
+		fmt.Fprintf(c.stdout, "Writing decrypted files: %s\n", result.OutputFile)
+		fmt.Fprintf(c.stdout, "Decryption complete!\n")
+		fmt.Fprintf(c.stdout, "Input file: %s\n", result.InputFile)
+		fmt.Fprintf(c.stdout, "Output directory: %s (%d files, %d bytes)\n", result.OutputFile, result.EntryCount, result.PlaintextSize)
+	case result.Container:
+		fmt.Fprintf(c.stdout, "Writing decrypted file: %s\n", result.OutputFile)
+		fmt.Fprintf(c.stdout, "Decryption complete!\n")
+		fmt.Fprintf(c.stdout, "Input file: %s\n", result.InputFile)
+		fmt.Fprintf(c.stdout, "Output directory: %s (%d entries, %d bytes)\n", result.OutputFile, result.EntryCount, result.PlaintextSize)
+	default:
+		fmt.Fprintf(c.stdout, "Writing decrypted file: %s\n", result.OutputFile)
+		fmt.Fprintf(c.stdout, "Decryption complete!\n")
+		fmt.Fprintf(c.stdout, "Input file: %s\n", result.InputFile)
+		fmt.Fprintf(c.stdout, "Output file: %s (%d bytes)\n", result.OutputFile, result.PlaintextSize)
+	}
+	if result.InPlaceOverwrite {
+		fmt.Fprintf(c.stdout, "In place: input decrypted over its own bytes (no room for a copy) and renamed\n")
+	} else if result.InPlace {
+		fmt.Fprintf(c.stdout, "In place: input removed\n")
+	}
+	fmt.Fprintf(c.stdout, "Work factor: %d sequential squarings\n", result.WorkFactor)
+	if throttle != nil && throttle.Utilization() > 0 {
+		fmt.Fprintf(c.stdout, "CPU used while solving: %.1f%% of one core (limit %s)\n", throttle.Utilization()*100, formatPercent(throttle.Limit()))
+	}
+	if result.ProofFile != "" {
+		fmt.Fprintf(c.stdout, "Proof of the solve written: %s (holds the solution; check it with verify-solve-proof)\n", result.ProofFile)
+	}
+
+	if publish.enabled() {
+		if err := publish.publish(c.stdout, result); err != nil {
+			return err
+		}
+	}
+
+	if *ephemeral > 0 && result.OutputFile != "" {
+		return waitAndWipe(c.stdout, result.OutputFile, *ephemeral)
+	}
+
+	return nil
+}
 
+// parseTarget parses a puzzle solution written in hex, as key releases
+// record it, with or without a 0x prefix.
+func parseTarget(s string) (*big.Int, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "0x")
+	target, ok := new(big.Int).SetString(s, 16)
+	if !ok || target.Sign() <= 0 {
+		return nil, fmt.Errorf("not a positive hex number")
+	}
+	return target, nil
+}
+
+// parseCPULimit parses a share of one core written as a percentage, with or
+// without the % sign ("50%", "12.5"), into a fraction.
+func parseCPULimit(s string) (float64, error) {
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("not a percentage: %q", s)
+	}
+	return percent / 100, nil
+}
+
+// formatPercent writes a fraction as a percentage, as --cpu-limit takes it.
+func formatPercent(f float64) string {
+	return strconv.FormatFloat(f*100, 'f', -1, 64) + "%"
+}
+
+// isBatch reports whether inputs name more than one encrypted file: several
+// arguments, a glob pattern or a directory.  A single URL is one file.
+func isBatch(inputs []string) bool {
+	if len(inputs) > 1 {
+		return true
+	}
+	if utils.IsURL(inputs[0]) {
+		return false
+	}
+	if strings.ContainsAny(inputs[0], "*?[") {
+		return true
+	}
+	info, err := os.Stat(inputs[0])
+	return err == nil && info.IsDir()
+}
+
+// decryptBatch decrypts every encrypted file found in inputs, showing the
+// progress of each puzzle and of the whole batch.  gate is checked against the
+// estimated time of all solves together.
+func decryptBatch(w io.Writer, inputs []string, opts operations.DecryptOptions, redraw time.Duration, gate operations.SolveGate) error {
+	items, err := operations.PlanBatch(inputs, opts.OutputDir)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Decrypting %d files\n", len(items))
+
+	var headers []*types.FileHeader
+	var squarings uint64
+	groups := make(map[[16]byte]bool)
+	for _, item := range items {
+		// Unreadable files are reported when their turn comes
+		header, err := operations.ReadInputHeader(nil, item.InputFile, opts.FetchTimeout)
+		if err != nil {
+			continue
+		}
+		headers = append(headers, header)
+		// A shared puzzle is solved once for the whole group
+		if g := header.Ext.Shared; g != nil {
+			if groups[g.Group] {
+				continue
+			}
+			groups[g.Group] = true
+		}
+		squarings += header.TotalWork()
+	}
+	if err := estimateSolve(w, headers, squarings, gate); err != nil {
+		return err
+	}
+
+	// A signal stops the solve under way, which keeps its checkpoint
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	opts.Context = ctx
+
+	// One line per solve and a totals line; on a terminal they are redrawn
+	// in place, elsewhere logged
+	progress := utils.NewMultiProgress(w)
+	progress.Expect(len(items), squarings)
+	progress.StartTicker(redraw)
+	var task *utils.ProgressTask
+	finish := func() {
+		if task != nil {
+			task.Finish()
+			task = nil
+		}
+	}
+
+	results, err := operations.DecryptBatch(inputs, opts, func(item operations.BatchItem) operations.ProgressCallback {
+		finish()
+		if opts.OutputTemplate != "" {
+			progress.Printf("[%s]", item.InputFile)
+		} else {
+			progress.Printf("[%s] -> %s", item.InputFile, item.OutputFile)
+		}
+		header, err := operations.ReadInputHeader(nil, item.InputFile, opts.FetchTimeout)
+		if err != nil {
+			// DecryptFile reports the error
+			return nil
+		}
+		task = progress.Add(item.InputFile, header.TotalWork())
+		return task.Update
+	})
+	if err != nil {
+		progress.Stop()
+		fmt.Fprintf(w, "Decrypted %d of %d files before the failure\n", len(results), len(items))
+		return err
+	}
+	finish()
+	progress.Stop()
+
+	total, reused := 0, 0
+	for _, result := range results {
+		total += result.PlaintextSize
+		if result.Reused {
+			reused++
+		}
+		if result.DataKey != nil && result.OutputFile == "" {
+			fmt.Fprintf(w, "Data key of %s: %s\n", result.InputFile, hex.EncodeToString(result.DataKey))
+		}
+	}
+	fmt.Fprintf(w, "Decryption complete!\n")
+	fmt.Fprintf(w, "Decrypted %d files (%d bytes)\n", len(results), total)
+	if reused > 0 {
+		fmt.Fprintf(w, "Shared puzzles: reused an earlier solution for %d of them\n", reused)
+	}
+	if opts.OutputDir != "" {
+		fmt.Fprintf(w, "Output directory: %s\n", opts.OutputDir)
+	}
+	return nil
+}
+
+// estimateSolve measures this machine's squaring rate against the first
+// header's modulus, prints how long the given squarings should take (and,
+// for a single file that recorded one, how this machine compares with the
+// encryptor's) to out, and checks the estimate against gate.  The benchmark is
+// skipped when there is nothing to print or decide.
+func estimateSolve(out io.Writer, headers []*types.FileHeader, squarings uint64, gate operations.SolveGate) error {
+	if len(headers) == 0 {
+		return nil
+	}
+	encryptorRate := headers[0].Ext.EncryptorRate
+	if len(headers) > 1 {
+		encryptorRate = 0
+	}
+	if encryptorRate <= 0 && (gate.Threshold <= 0 || gate.Yes) {
+		return nil
+	}
+
+	N := headers[0].Modulus()
+	rate := operations.MeasureRate(N, rateProbeDuration)
+
+	// Warn when this machine is much slower or faster than the encryptor's
+	if encryptorRate > 0 {
+		cmp := operations.CompareRates(encryptorRate, rate)
+		fmt.Fprintf(out, "Note: %s\n", cmp.Message)
+	}
+	estimate := utils.EstimateTime(squarings, rate)
+	if estimate > 0 {
+		fmt.Fprintf(out, "Estimated solve time on this machine: %s (%.0f squarings/second)\n", utils.FormatDuration(estimate), rate)
+	}
+	return gate.Check(estimate)
+}
+
+// remainingSquarings returns the squarings left to solve header's puzzles:
+// the work factor of each, less the progress saved in a checkpoint that
+// appears to belong to it (see operations.PuzzleCheckpointPath).  It is
+// only an estimate; the solve checks the checkpoints properly.
+func remainingSquarings(header *types.FileHeader, checkpoint string) uint64 {
+	puzzles := append([]crypto.Puzzle{{N: header.Modulus(), T: header.WorkFactor}},
+		utils.AndPuzzlesFromHeader(header)...)
+	var remaining uint64
+	for i, p := range puzzles {
+		remaining += p.T
+		if checkpoint == "" {
+			continue
+		}
+		state, err := utils.LoadState(operations.PuzzleCheckpointPath(checkpoint, i))
+		if err == nil && state.Puzzle.T == p.T && state.Done <= p.T && state.Puzzle.N.Cmp(p.N) == 0 {
+			remaining -= state.Done
+		}
+	}
+	return remaining
+}
+
+// terminalPrompt returns a yes/no prompt printed to out and answered on the
+// terminal, or nil when stdin is not a terminal or --quiet discards out.
+func terminalPrompt(out io.Writer) func(question string) (bool, error) {
+	if !utils.IsTerminal(os.Stdin) || out == io.Discard {
+		return nil
+	}
+	return func(question string) (bool, error) {
+		fmt.Fprintf(out, "%s [y/N] ", question)
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return false, err
+		}
+		answer := strings.ToLower(strings.TrimSpace(line))
+		return answer == "y" || answer == "yes", nil
+	}
+}
+
+// errInterrupted is the cause of a solve stopped by an interrupt or
+// termination signal.
+var errInterrupted = errors.New("interrupted")
+
+// solveControls serves the ways a running solve can be steered: interrupt
+// and termination signals, the status and checkpoint signals, and single
+// keys when attended.
+type solveControls struct {
+	// ctx is done once a signal interrupts the solve, with errInterrupted as
+	// its cause; it is the DecryptOptions.Context of the solve.
+	ctx  context.Context
+	stop func()
+}
+
+// watchControls serves the controls until stop is called.  A signal quits
+// like q, through the context of the controls, so the checkpoint is saved
+// (and the terminal restored) on the way out.  keys may be nil when there is
+// no terminal.  The c key and SIGUSR2 save a checkpoint through
+// checkpointNow.
+func watchControls(stderr io.Writer, keys <-chan byte, ctl *crypto.SolveControl, checkpointNow func(), progressBar *utils.ProgressBar, status *statusReporter, checkpoints *checkpointClock) *solveControls {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	stopSnapshots := watchSnapshotSignals(stderr, progressBar, checkpointNow, checkpoints)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	ctx, interrupt := context.WithCancelCause(context.Background())
+	c := &solveControls{ctx: ctx}
+
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-done:
+				return
+			case <-sigs:
+				progressBar.Printf("Interrupted; saving checkpoint...")
+				interrupt(errInterrupted)
+			case key, ok := <-keys:
+				if !ok {
+					keys = nil
+					continue
+				}
+				switch key {
+				case 'p', 'P':
+					paused := ctl.TogglePause()
+					progressBar.SetPaused(paused)
+					if paused {
+						status.update(utils.StatusPaused, nil)
+					} else {
+						status.update(utils.StatusSolving, nil)
+					}
+				case 'c', 'C':
+					checkpointNow()
+				case 'q', 'Q':
+					progressBar.Printf("Saving checkpoint and quitting...")
+					ctl.Stop()
+				case 's', 'S':
+					printStatus(progressBar)
+				}
+			}
+		}
+	}()
+
+	c.stop = func() {
+		stopSnapshots()
+		signal.Stop(sigs)
+		close(done)
+		<-finished
+		interrupt(nil)
+	}
+	return c
+}
+
+// printStatus prints a snapshot of the solve above the progress bar.
+func printStatus(progressBar *utils.ProgressBar) {
+	info := progressBar.Info()
+	state := "running"
+	if info.IsPaused {
+		state = "paused"
+	}
+	rate, eta := "unknown", "unknown"
+	if info.Rate > 0 {
+		rate = fmt.Sprintf("%.0f squarings/s", info.Rate)
+		eta = utils.FormatDuration(info.ETA)
+	}
+	progressBar.Printf("Status: %s, %d of %d squarings (%.2f%%), rate %s, elapsed %s, paused %s, ETA %s",
+		state, info.Done, info.Total, float64(info.Done)/float64(info.Total)*100, rate,
+		utils.FormatDuration(info.Elapsed), utils.FormatDuration(info.Paused), eta)
+}
+
+// printSolveLeft prints the progress of a time-boxed solve and how long the
+// rest should take at the rate of this run, in runs of budget.
+func printSolveLeft(w io.Writer, progressBar *utils.ProgressBar, budget time.Duration) {
+	info := progressBar.Info()
+	fmt.Fprintf(w, "Progress: %d of %d squarings (%.2f%%)\n", info.Done, info.Total, float64(info.Done)/float64(info.Total)*100)
+	if info.Rate <= 0 {
+		return
+	}
+	runs := "one more run"
+	if n := (info.ETA + budget - 1) / budget; n > 1 {
+		runs = fmt.Sprintf("%d more runs", n)
+	}
+	fmt.Fprintf(w, "Estimated solving time left: %s at %.0f squarings/second (about %s of %s)\n",
+		utils.FormatDuration(info.ETA), info.Rate, runs, utils.FormatDuration(budget))
+}
+
+// waitAndWipe keeps the process in the foreground until the ephemeral output
+// has been securely deleted, either after the timeout or on interrupt.
+func waitAndWipe(w io.Writer, path string, after time.Duration) error {
+	fmt.Fprintf(w, "Warning: %s will be securely deleted in %v\n", path, after)
+	fmt.Fprintf(w, "Keep this process running; press Ctrl+C to delete it now.\n")
+
+	wipe := utils.ScheduleSecureDelete(path, after)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	var err error
+	select {
+	case <-sigs:
+		wipe.DeleteNow()
+		err = <-wipe.Done()
+	case err = <-wipe.Done():
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to delete ephemeral output: %v", err)
+	}
+	fmt.Fprintf(w, "Ephemeral output deleted: %s\n", path)
 	return nil
 }
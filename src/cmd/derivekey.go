@@ -0,0 +1,209 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+var deriveKeyCommand = &Command{
+	Name:    "derive-key",
+	Summary: "Solve a file's puzzle and output its key without decrypting",
+	Synopsis: []string{
+		"--input FILE [--key KEY] [--output FILE | --insecure-print] [--cache-target] [--yes] [--confirm-over DURATION] [--checkpoint-file FILE] [--checkpoint-interval DURATION] [--pin-thread]",
+	},
+	Description: "Solve a file's time-lock puzzle and output the 32-byte key its data is sealed\n" +
+		"under, as hex, without decrypting anything.  Progress goes to stderr.\n" +
+		"The key is not printed to a terminal unless --insecure-print is given.",
+	Sections: []string{controlsHelp},
+	Examples: []string{
+		"cryptotimed derive-key --input document.pdf.locked --output document.key",
+		`cryptotimed derive-key --input document.pdf.locked --key "my passphrase" | my-decryptor`,
+	},
+	run: runDeriveKey,
+}
+
+// DeriveKeyCommand handles the derive-key subcommand
+func DeriveKeyCommand(args []string) error {
+	return deriveKeyCommand.Run(args)
+}
+
+func runDeriveKey(c *Command, args []string) error {
+	fs := c.FlagSet()
+
+	var (
+		inputFile  = fs.String("input", "", "Encrypted file whose puzzle to solve (required)")
+		keyInput   = fs.String("key", "", "Passphrase or @file:path (required if file was encrypted with key)")
+		outputFile = fs.String("output", "", "Write the key to this file, readable only by you (default: stdout)")
+		insecure   = fs.Bool("insecure-print", false, "Print the key even when stdout is a terminal")
+		pinThread  = fs.Bool("pin-thread", false, "Lock the solver to one OS thread for a steadier squaring rate")
+		gcPercent  = fs.Int("gogc", 0, "GOGC value while solving (0 = leave unchanged, -1 = disable GC)")
+		noCalib    = fs.Bool("no-calibrate", false, "Keep this solve's rate out of the calibration profile used for estimates (e.g. while benchmarking)")
+		redraw     = fs.Duration("progress-interval", utils.DefaultRedrawInterval, "Redraw the progress bar at least this often (0 = only on progress)")
+		cache      = fs.Bool("cache-target", false, "Reuse a cached puzzle solution and cache this one (anyone who can read the cache can decrypt)")
+		checkpoint = fs.String("checkpoint-file", "", "Save solving progress to this file and resume from it (default: INPUT.resume)")
+		interval   = fs.Duration("checkpoint-interval", defaultCheckpointInterval, "Save a checkpoint this often while solving (0 = only on request or quit)")
+		yes        = fs.Bool("yes", false, "Start solving without asking, however long it is estimated to take")
+		confirm    = fs.Duration("confirm-over", operations.DefaultConfirmOver, "Ask before starting a solve estimated to take longer than this on this machine (0 = never ask)")
+		timeout    = fs.Duration("timeout", utils.DefaultFetchTimeout, "Give up fetching the header of an http(s) --input after this long")
+	)
+
+	if _, err := c.Parse(fs, args); err != nil {
+		return err
+	}
+
+	// Validate required arguments
+	if *inputFile == "" {
+		fs.Usage()
+		return fmt.Errorf("--input is required")
+	}
+	if *interval < 0 {
+		return fmt.Errorf("--checkpoint-interval must not be negative")
+	}
+	if *confirm < 0 {
+		return fmt.Errorf("--confirm-over must not be negative")
+	}
+	if *timeout < 0 {
+		return fmt.Errorf("--timeout must not be negative")
+	}
+	if *outputFile != "" && *insecure {
+		return fmt.Errorf("--insecure-print cannot be used with --output")
+	}
+	// Refuse before solving rather than after
+	if *outputFile == "" && isTerminal(c.output) && !*insecure {
+		return fmt.Errorf("refusing to print the key to a terminal (use --output FILE, redirect stdout, or --insecure-print)")
+	}
+
+	opts := operations.DecryptOptions{
+		InputFile:          *inputFile,
+		KeyInput:           *keyInput,
+		PinThread:          *pinThread,
+		GCPercent:          *gcPercent,
+		NoCalibrate:        *noCalib,
+		CacheTarget:        *cache,
+		CheckpointPath:     *checkpoint,
+		CheckpointInterval: *interval,
+		FetchTimeout:       *timeout,
+	}
+	if opts.CheckpointPath == "" {
+		opts.CheckpointPath = operations.InputName(*inputFile) + ".resume"
+	}
+
+	// Everything but the key goes to stderr, so stdout can be piped
+	header, err := operations.ReadInputHeader(nil, *inputFile, *timeout)
+	if err != nil {
+		return err
+	}
+	gate := operations.SolveGate{Threshold: *confirm, Yes: *yes, Prompt: terminalPrompt(c.stderr)}
+	if err := estimateSolve(c.stderr, []*types.FileHeader{header}, remainingSquarings(header, opts.CheckpointPath), gate); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stderr, "Solving time-lock puzzle (%d sequential squarings)...\n", header.TotalWork())
+	progressBar := utils.NewProgressBar(header.TotalWork())
+	progressBar.SetOutput(c.stderr)
+	progressBar.StartTicker(*redraw)
+
+	checkpoints := &checkpointClock{}
+	opts.OnResume = func(done uint64) {
+		if info, err := os.Stat(opts.CheckpointPath); err == nil {
+			checkpoints.saved(info.ModTime())
+		}
+		progressBar.SetBaseline(done)
+		progressBar.Printf("Resuming from checkpoint %s (%d of %d squarings done)", opts.CheckpointPath, done, header.TotalWork())
+	}
+	opts.OnCheckpoint = func(state crypto.SolvingState, err error) {
+		if err != nil {
+			progressBar.Printf("Warning: failed to save checkpoint: %v", err)
+			return
+		}
+		checkpoints.saved(time.Now())
+		progressBar.Printf("Checkpoint saved: %s (%d squarings done)", opts.CheckpointPath, state.Done)
+		if state.Done > progressBar.Info().Done {
+			progressBar.Update(state.Done)
+		}
+	}
+
+	// Signals stop the solve with a checkpoint; single keys steer it when attended
+	opts.Control = &crypto.SolveControl{}
+	var keys *utils.KeyReader
+	var keyPresses <-chan byte
+	if utils.IsTerminal(os.Stdin) {
+		if keys, err = utils.NewKeyReader(os.Stdin); err == nil {
+			defer keys.Close() // also on panics
+			keyPresses = keys.Keys()
+			fmt.Fprintf(c.stderr, "Keys: p pause/resume, c checkpoint now, q checkpoint and quit, s status\n")
+		}
+	}
+	controls := watchControls(c.stderr, keyPresses, opts.Control, opts.Control.RequestCheckpoint, progressBar, nil, checkpoints)
+	opts.Context = controls.ctx
+
+	result, err := operations.DeriveKey(opts, progressBar.Update)
+	controls.stop()
+	if keys != nil {
+		keys.Close()
+	}
+	if errors.Is(err, crypto.ErrSolveStopped) {
+		progressBar.StopTicker()
+		fmt.Fprintf(c.stderr, "\nStopped: %v\n", err)
+		fmt.Fprintf(c.stderr, "Run the same command again to resume.\n")
+		if errors.Is(err, errInterrupted) {
+			return errInterrupted
+		}
+		return nil
+	}
+	if err != nil {
+		progressBar.StopTicker()
+		return err
+	}
+	progressBar.Finish()
+
+	for _, warning := range result.Warnings {
+		fmt.Fprintf(c.stderr, "Warning: %s\n", warning)
+	}
+	if result.FromCache {
+		fmt.Fprintf(c.stderr, "Puzzle solution loaded from cache (no solving needed)\n")
+	} else {
+		fmt.Fprintf(c.stderr, "Puzzle solved!\n")
+	}
+	if result.Container {
+		fmt.Fprintf(c.stderr, "Note: this is a container's root key; each entry is sealed under a key derived from it\n")
+	}
+
+	encoded := hex.EncodeToString(result.Key[:]) + "\n"
+	if *outputFile == "" {
+		_, err := io.WriteString(c.output, encoded)
+		return err
+	}
+	if err := writeKeyFile(*outputFile, []byte(encoded)); err != nil {
+		return fmt.Errorf("failed to write key file: %v", err)
+	}
+	fmt.Fprintf(c.stderr, "Key written: %s\n", *outputFile)
+	return nil
+}
+
+// writeKeyFile writes data to path readable only by the owner, tightening
+// the permissions of an existing file before anything is written to it.
+func writeKeyFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,243 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// attachPollInterval is how often attach rereads the status file.
+const attachPollInterval = time.Second
+
+// detachPaths are the files of a decrypt --detach run; empty ones get
+// defaults next to the input.
+type detachPaths struct {
+	input      string
+	pidFile    string
+	logFile    string
+	statusFile string
+	checkpoint string
+}
+
+// detachDecrypt runs this decrypt command again in the background, with the
+// pidfile, status file and checkpoint set explicitly, and returns as soon as
+// it has started.  args are the decrypt arguments as given.  A long solve is
+// confirmed before detaching.
+func detachDecrypt(w io.Writer, args []string, paths detachPaths, haveKey bool, gate operations.SolveGate) error {
+	// Report what would make the background run fail straight away
+	header, err := utils.ReadFileHeader(paths.input)
+	if err != nil {
+		return fmt.Errorf("failed to read encrypted file: %v", err)
+	}
+	if header.KeyRequired == 1 && !haveKey {
+		return fmt.Errorf("this file requires a key to decrypt (use --key)")
+	}
+
+	// Confirm a long solve here, while someone is there to answer
+	if err := estimateSolve(w, []*types.FileHeader{header}, remainingSquarings(header, paths.checkpoint), gate); err != nil {
+		return err
+	}
+
+	if paths.pidFile == "" {
+		paths.pidFile = paths.input + ".pid"
+	}
+	if paths.logFile == "" {
+		paths.logFile = paths.input + ".log"
+	}
+	if paths.statusFile == "" {
+		paths.statusFile = defaultStatusFile(paths.pidFile)
+	}
+	if paths.checkpoint == "" {
+		paths.checkpoint = paths.input + ".resume"
+	}
+
+	// Replace any status of an earlier run, so attach never reports it
+	now := time.Now()
+	if err := utils.WriteStatus(paths.statusFile, &utils.SolveStatus{
+		InputFile:  paths.input,
+		State:      utils.StatusSolving,
+		Total:      header.TotalWork(),
+		Checkpoint: paths.checkpoint,
+		Started:    now,
+		Updated:    now,
+	}); err != nil {
+		return fmt.Errorf("failed to write status file: %v", err)
+	}
+
+	// Flags given later win, so these override the ones in args
+	childArgs := append([]string{"decrypt"}, args...)
+	childArgs = append(childArgs,
+		"--detach=false",
+		"--yes",
+		"--detached-pidfile="+paths.pidFile,
+		"--status-file="+paths.statusFile,
+		"--checkpoint-file="+paths.checkpoint,
+	)
+	result, err := operations.Detach(operations.DetachOptions{
+		Args:    childArgs,
+		PIDFile: paths.pidFile,
+		LogFile: paths.logFile,
+	})
+	if err != nil {
+		return err
+	}
+
+	if result.StalePID != 0 {
+		fmt.Fprintf(w, "Removed stale pidfile %s (pid %d is no longer running)\n", paths.pidFile, result.StalePID)
+	}
+	fmt.Fprintf(w, "Solving %s in the background (pid %d, %d sequential squarings)\n", paths.input, result.PID, header.TotalWork())
+	fmt.Fprintf(w, "Pidfile: %s\n", paths.pidFile)
+	fmt.Fprintf(w, "Status file: %s\n", paths.statusFile)
+	fmt.Fprintf(w, "Log file: %s\n", paths.logFile)
+	fmt.Fprintf(w, "Checkpoint file: %s\n", paths.checkpoint)
+	fmt.Fprintf(w, "Follow progress with: %s attach --pidfile %s\n", os.Args[0], paths.pidFile)
+	fmt.Fprintf(w, "Stop it (saving a checkpoint) with: kill %d\n", result.PID)
+	return nil
+}
+
+// defaultStatusFile returns the status file that goes with a pidfile:
+// INPUT.pid becomes INPUT.status.json.
+func defaultStatusFile(pidFile string) string {
+	return strings.TrimSuffix(pidFile, ".pid") + ".status.json"
+}
+
+var attachCommand = &Command{
+	Name:    "attach",
+	Summary: "Follow a solve started with decrypt --detach",
+	Synopsis: []string{
+		"--pidfile FILE [--status-file FILE]",
+	},
+	Description: "Follow a background solve started with decrypt --detach\n" +
+		"Shows its progress until it finishes. Ctrl+C detaches again without stopping it.",
+	Examples: []string{
+		"cryptotimed attach --pidfile archive.tar.locked.pid",
+	},
+	run: runAttach,
+}
+
+// AttachCommand handles the attach subcommand
+func AttachCommand(args []string) error {
+	return attachCommand.Run(args)
+}
+
+func runAttach(c *Command, args []string) error {
+	fs := c.FlagSet()
+
+	var (
+		pidFile    = fs.String("pidfile", "", "Pidfile of a decrypt --detach run (required)")
+		statusFile = fs.String("status-file", "", "Status file of the run (default: the pidfile with .pid replaced by .status.json)")
+		redraw     = fs.Duration("progress-interval", utils.DefaultRedrawInterval, "Redraw the progress bar at least this often (0 = only on progress)")
+	)
+
+	if _, err := c.Parse(fs, args); err != nil {
+		return err
+	}
+	if *pidFile == "" {
+		fs.Usage()
+		return fmt.Errorf("--pidfile is required")
+	}
+	if *statusFile == "" {
+		*statusFile = defaultStatusFile(*pidFile)
+	}
+
+	pid, running, err := utils.CheckPIDFile(*pidFile)
+	if err != nil {
+		return err
+	}
+	status, err := utils.ReadStatus(*statusFile)
+	if err != nil {
+		return fmt.Errorf("failed to read status file: %v", err)
+	}
+	if !running {
+		if pid != 0 {
+			fmt.Fprintf(c.stdout, "Removed stale pidfile %s (pid %d is no longer running)\n", *pidFile, pid)
+		}
+		if !status.Finished() {
+			return notFinished(status)
+		}
+		return reportFinished(c.stdout, status)
+	}
+
+	fmt.Fprintf(c.stdout, "Attached to the background solve of %s (pid %d); Ctrl+C detaches without stopping it\n", status.InputFile, pid)
+	progressBar := utils.NewProgressBar(status.Total)
+	progressBar.SetOutput(c.stdout)
+	baseline := status.Done
+	progressBar.SetBaseline(baseline)
+	progressBar.SetPaused(status.State == utils.StatusPaused)
+	progressBar.StartTicker(*redraw)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	ticker := time.NewTicker(attachPollInterval)
+	defer ticker.Stop()
+
+	for !status.Finished() {
+		select {
+		case <-sigs:
+			progressBar.StopTicker()
+			fmt.Fprintf(c.stdout, "\nDetached; the solve continues in the background (pid %d)\n", pid)
+			return nil
+		case <-ticker.C:
+		}
+
+		// Check the process first: a final status is written before it exits
+		exited := !utils.ProcessRunning(pid)
+		if s, err := utils.ReadStatus(*statusFile); err == nil {
+			status = s
+			if status.Resumed > baseline {
+				// Resumed work is not part of the rate
+				baseline = status.Resumed
+				progressBar.SetBaseline(baseline)
+			}
+			progressBar.SetPaused(status.State == utils.StatusPaused)
+			progressBar.Update(status.Done)
+		}
+		if exited && !status.Finished() {
+			progressBar.StopTicker()
+			fmt.Fprintln(c.stdout)
+			if _, _, err := utils.CheckPIDFile(*pidFile); err != nil {
+				fmt.Fprintf(c.stdout, "Warning: %v\n", err)
+			}
+			return notFinished(status)
+		}
+	}
+
+	if status.State == utils.StatusDone {
+		progressBar.Finish()
+	} else {
+		progressBar.StopTicker()
+		fmt.Fprintln(c.stdout)
+	}
+	return reportFinished(c.stdout, status)
+}
+
+// notFinished describes a background solve that is no longer running but
+// did not record an end, e.g. because it was killed.
+func notFinished(status *utils.SolveStatus) error {
+	return fmt.Errorf("the background solve of %s is not running and did not finish (last %s at %d of %d squarings); see its log file",
+		status.InputFile, status.State, status.Done, status.Total)
+}
+
+// reportFinished prints how a background solve ended.
+func reportFinished(w io.Writer, status *utils.SolveStatus) error {
+	switch status.State {
+	case utils.StatusDone:
+		fmt.Fprintf(w, "Puzzle solved!\n")
+		fmt.Fprintf(w, "Output: %s\n", status.OutputFile)
+	case utils.StatusStopped:
+		fmt.Fprintf(w, "Stopped at %d of %d squarings (%.2f%%)\n", status.Done, status.Total, status.Percent)
+		fmt.Fprintf(w, "Checkpoint: %s; run decrypt --detach again to resume\n", status.Checkpoint)
+	default:
+		return fmt.Errorf("background solve of %s failed: %s", status.InputFile, status.Error)
+	}
+	return nil
+}
@@ -1,36 +1,137 @@
 package cmd
 
 import (
-	"flag"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"strings"
+	"time"
 
+	"cryptotimed/src/crypto"
 	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
 )
 
+var encryptCommand = &Command{
+	Name:    "encrypt",
+	Summary: "Encrypt a file with time-lock puzzle",
+	Synopsis: []string{
+		"[--input] FILE|- [--shared-puzzle FILE...] (--work ITERATIONS | --work-relative MULTIPLIER | (--target-time | --work-duration | --time) DURATION [--confidence PERCENT | --profile PROFILE]) [--key KEY] [--record-rate] [--private-listing] [--exclude PATTERN...] [--exclude-from FILE] [--chunk-size SIZE | --chunk-above SIZE] [--output FILE|- | --output-template TEMPLATE | --append-to LOG] [--no-trapdoor] [--data-key KEY] [--decoy FILE --decoy-key KEY] [--in-place] [--and-puzzles COUNT] [--modulus-bits | --rsa-bits BITS] [--key-hash HASH] [--cipher CIPHER] [--pad-header SIZE] [--verify [--verify-solve-max ITERATIONS]] [--verify-puzzle [--verify-puzzle-steps ITERATIONS]] [--tweak-base]",
+	},
+	Description: "Encrypt a file with RSA time-lock puzzle\n" +
+		"A directory is packed into a single container file.\n" +
+		"With --shared-puzzle, every input is encrypted to its own file under one puzzle: solving any of them unlocks them all.\n" +
+		"With --data-key, only the given key is time-locked; decrypting the file outputs the key.\n" +
+		"With --decoy, decrypting with --decoy-key instead of --key yields the decoy; the file does not tell which is real.\n" +
+		"With --in-place, only the encrypted file is left; run it again to finish an operation interrupted by a crash.\n" +
+		"With --target-time (or its other names --work-duration and --time), the work factor is what this machine\n" +
+		"solves in that long at its calibrated rate, kept from its solves, or else at the lower end of the rate\n" +
+		"interval of a benchmark of about a second.\n" +
+		"With --confidence, this machine is benchmarked until its rate is known to within an interval of that\n" +
+		"confidence; the lower end is used, so the solve here takes at most that long.\n" +
+		"With --profile, it is picked from the rate of the machine the profile was exported from instead.\n" +
+		"With --work-relative, it is that multiple of the squarings a quick benchmark does here in one second.\n" +
+		"With --record-rate, the rate the work factor was picked at is recorded for check to compare (with --work,\n" +
+		"that of a quick benchmark).\n" +
+		"With --modulus-bits, the puzzle and these benchmarks use a modulus of that size: each squaring of a\n" +
+		"larger modulus is slower, so the same --work locks the file for longer.\n" +
+		"An input larger than --chunk-above (256MiB unless set) is sealed in chunks, like with --chunk-size, and\n" +
+		"written as it is sealed: files larger than memory can be locked and decrypted back.\n" +
+		"With --input -, the input is read from stdin and sealed in chunks as it arrives, however large, and the\n" +
+		"encrypted file goes to stdout unless an output is named; with --output -, it is written to stdout and every\n" +
+		"message goes to stderr, so cryptotimed can sit in a pipe. The input may also be given as the first argument.",
+	Sections: []string{templateHelp},
+	Examples: []string{
+		"cryptotimed encrypt --input document.pdf --work 81000000",
+		`cryptotimed encrypt --input document.pdf --work 81000000 --key "my passphrase"`,
+		"cryptotimed encrypt --input document.pdf --work 81000000 --key @file:keyfile.txt",
+		"cryptotimed encrypt --input photos/ --work 81000000 --private-listing",
+		"cryptotimed encrypt --input project/ --work 81000000 --exclude .git/ --exclude node_modules/ --exclude '*.o'",
+		"cryptotimed encrypt --input project/ --work 81000000 --exclude-from project/.gitignore",
+		"cryptotimed encrypt --input backup.tar --work 81000000 --chunk-size 1MiB",
+		"cryptotimed encrypt --input disk.img --work 81000000 --chunk-above 1GiB",
+		"cryptotimed encrypt --input document.pdf --target-time 24h --confidence 95",
+		"cryptotimed encrypt --input document.pdf --target-time 24h --profile big-server.json",
+		"cryptotimed encrypt --input document.pdf --time 12h --record-rate",
+		"cryptotimed encrypt --input document.pdf --work-relative 3600",
+		"cryptotimed encrypt --input backup.tar --work 81000000 --verify",
+		"cryptotimed encrypt --input backup.tar --work 81000000 --verify-puzzle",
+		"cryptotimed encrypt --input will.pdf --work 81000000 --no-trapdoor",
+		"cryptotimed encrypt --input will.pdf --work 81000000 --and-puzzles 3",
+		"cryptotimed encrypt --input will.pdf --target-time 720h --modulus-bits 4096",
+		"cryptotimed encrypt --input report.pdf --work 81000000 --key-hash blake2b",
+		"cryptotimed encrypt --input photos/ --work 81000000 --pad-header 64KiB",
+		"cryptotimed encrypt --input disk.img --work 81000000 --in-place",
+		"cryptotimed encrypt --input report.pdf --work 81000000 --output-template 'archive/{name}.{workfactor}.{date}.tlp'",
+		"cryptotimed encrypt --input minutes-2024-05.txt --work 81000000 --append-to archive.ctlog",
+		"pg_dump mydb | cryptotimed encrypt --input - --output - --work 81000000 > mydb.sql.locked",
+		"tar c project/ | cryptotimed encrypt --work 81000000 - > project.tar.locked",
+		"cryptotimed encrypt --shared-puzzle --input release/*.tar.gz --work 81000000",
+		"cryptotimed encrypt --input payload.key --data-key @file:payload.key.hex --work 81000000",
+		"cryptotimed encrypt --input diary.txt --key @file:real.txt --decoy shopping.txt --decoy-key @file:duress.txt --work 81000000",
+	},
+	run: runEncrypt,
+}
+
 // EncryptCommand handles the encrypt subcommand
 func EncryptCommand(args []string) error {
-	fs := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	return encryptCommand.Run(args)
+}
+
+func runEncrypt(c *Command, args []string) error {
+	fs := c.FlagSet()
 
 	var (
-		inputFile  = fs.String("input", "", "Input file to encrypt (required)")
-		workFactor = fs.Uint64("work", 0, "Number of sequential squarings required (required)")
+		inputFile  = fs.String("input", "", "Input file or directory to encrypt, or - for stdin (required, or as the first argument)")
+		workFactor = fs.Uint64("work", 0, "Number of sequential squarings required (required unless --target-time or --work-relative)")
+		relative   = fs.Float64("work-relative", 0, "Instead of --work, benchmark this machine and use this multiple of the squarings it does in one second, e.g. 2.0")
+		targetTime = fs.Duration("target-time", 0, "Instead of --work, pick the work factor this machine solves in this long, e.g. 24h, from its calibrated rate or a quick benchmark")
+		confidence = fs.Float64("confidence", operations.DefaultTuneConfidence*100, "With --target-time, benchmark this machine until its rate is known to within an interval of this confidence level in percent")
+		profile    = fs.String("profile", "", "With --target-time, pick the work factor the machine this profile was exported from (benchmark --export) solves in that time")
 		keyInput   = fs.String("key", "", "Optional passphrase or @file:path")
+		recordRate = fs.Bool("record-rate", false, "Record the squaring rate the work factor was picked at in the header (with --work, benchmark this machine for it)")
+		private    = fs.Bool("private-listing", false, "For directories, encrypt the entry table so names and sizes are hidden until solved")
+		outputFile = fs.String("output", "", "Write the encrypted file to this path instead of naming it from --output-template (- for stdout)")
+		template   = fs.String("output-template", operations.DefaultEncryptTemplate, "Name the encrypted file from a template (see placeholders below)")
+		noTrapdoor = fs.Bool("no-trapdoor", false, "Compute the puzzle by sequential squaring without the RSA trapdoor (encrypting takes as long as decrypting)")
+		chunkSize  = fs.String("chunk-size", "", "Seal the data in chunks of this size, e.g. 64KiB or 1MiB (default: one piece up to --chunk-above)")
+		chunkAbove = fs.String("chunk-above", "", "Seal inputs larger than this in chunks of the default size when --chunk-size is not given (default 256MiB; off = never)")
+		appendTo   = fs.String("append-to", "", "Append the encrypted file as a record to this hash-chained log instead of writing its own file")
+		shared     = fs.Bool("shared-puzzle", false, "Encrypt all the given inputs under one puzzle, so solving any of them unlocks them all")
+		dataKey    = fs.String("data-key", "", "Time-lock this 32-byte key (hex, base64 or @file:path) instead of the input's contents; --input only names the output")
+		decoy      = fs.String("decoy", "", "Store this file alongside the input, decrypted instead of it with --decoy-key (requires --key)")
+		decoyKey   = fs.String("decoy-key", "", "Duress passphrase or @file:path that decrypts the file to --decoy")
+		inPlace    = fs.Bool("in-place", false, "Replace the input with the encrypted file, chunked; without room for both it is encrypted over its own bytes")
+		keyHash    = fs.String("key-hash", "sha256", "Hash the key is derived from the puzzle solution with: "+strings.Join(crypto.KeyHashNames(), ", "))
+		cipher     = fs.String("cipher", crypto.CipherName(crypto.CipherChaCha20Poly1305), "Cipher the data is sealed with (a single file sealed in one piece only): "+strings.Join(crypto.CipherNames(), ", "))
+		padHeader  = fs.String("pad-header", "", "Pad the header with random bytes to this size, e.g. 4KiB, so its size does not reveal entry names or key slots")
+		verify     = fs.Bool("verify", false, "Read the encrypted file back once written and check it; small work factors are also solved and decrypted")
+		solveMax   = fs.Uint64("verify-solve-max", operations.DefaultVerifySolveLimit, "With --verify, solve and decrypt files of at most this work factor (0 = only read back)")
+		vPuzzle    = fs.Bool("verify-puzzle", false, "Check the generated puzzle before encrypting: values in range and the target against a sequential solve")
+		vSteps     = fs.Uint64("verify-puzzle-steps", crypto.DefaultVerifySteps, "With --verify-puzzle, squarings to compare with a sequential solve; a puzzle this short is solved outright")
+		tweakBase  = fs.Bool("tweak-base", false, "Mix a random file ID and the work factor into the base derived from --key, so the same passphrase cannot be correlated across files (needs a format 9 reader)")
+		andPuzzles = fs.Int("and-puzzles", 1, "Lock the input under this many independent puzzles of --work squarings each, all of which must be solved (needs a format 11 reader)")
+		bits       = fs.Int("modulus-bits", crypto.DefaultModulusBits, fmt.Sprintf("Size of the puzzle's RSA modulus, a multiple of %d from %d to %d bits; larger moduli make each squaring slower (other sizes than %d bits need a format %d reader)", crypto.ModulusBitsStep, crypto.MinModulusBits, crypto.MaxModulusBits, crypto.DefaultModulusBits, types.VersionModulusSize))
+		excludeArg = fs.String("exclude-from", "", "For directories, leave out paths matching the patterns in this gitignore-style file")
+		excludes   stringList
 	)
+	fs.IntVar(bits, "rsa-bits", crypto.DefaultModulusBits, "Same as --modulus-bits")
+	fs.DurationVar(targetTime, "work-duration", 0, "Same as --target-time")
+	fs.DurationVar(targetTime, "time", 0, "Same as --target-time")
+	fs.Var(&excludes, "exclude", "For directories, leave out paths matching this gitignore-style pattern, relative to the input (repeatable)")
 
-	fs.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s encrypt --input FILE --work ITERATIONS [--key KEY]\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "\nEncrypt a file with RSA time-lock puzzle\n\n")
-		fmt.Fprintf(os.Stderr, "Options:\n")
-		fs.PrintDefaults()
-		fmt.Fprintf(os.Stderr, "\nExamples:\n")
-		fmt.Fprintf(os.Stderr, "  %s encrypt --input document.pdf --work 81000000\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s encrypt --input document.pdf --work 81000000 --key \"my passphrase\"\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s encrypt --input document.pdf --work 81000000 --key @file:keyfile.txt\n", os.Args[0])
+	// Extra file arguments (e.g. from a shell glob) may come between the options
+	extra, err := c.Parse(fs, args)
+	if err != nil {
+		return err
 	}
 
-	if err := fs.Parse(args); err != nil {
-		return err
+	// The input may also be the first argument, e.g. "-" in a pipe
+	if *inputFile == "" && len(extra) > 0 {
+		*inputFile, extra = extra[0], extra[1:]
 	}
 
 	// Validate required arguments
@@ -38,40 +139,570 @@ func EncryptCommand(args []string) error {
 		fs.Usage()
 		return fmt.Errorf("--input is required")
 	}
-	if *workFactor == 0 {
+	// --work-duration and --time are other names for --target-time
+	timeFlag := "--target-time"
+	var timeFlags []string
+	for _, name := range []string{"target-time", "work-duration", "time"} {
+		if flagSet(fs, name) {
+			timeFlags = append(timeFlags, "--"+name)
+		}
+	}
+	if len(timeFlags) > 1 {
+		return fmt.Errorf("%s and %s cannot be used together: they are the same option", timeFlags[0], timeFlags[1])
+	} else if len(timeFlags) == 1 {
+		timeFlag = timeFlags[0]
+	}
+	switch {
+	case *targetTime != 0 && flagSet(fs, "work"):
+		return fmt.Errorf("--work and %s cannot be used together", timeFlag)
+	case *targetTime < 0:
+		return fmt.Errorf("%s must be positive", timeFlag)
+	case flagSet(fs, "work-relative") && (flagSet(fs, "work") || *targetTime != 0):
+		return fmt.Errorf("--work-relative cannot be used with --work or %s", timeFlag)
+	case flagSet(fs, "work-relative") && !(*relative > 0 && !math.IsInf(*relative, 1)):
+		return fmt.Errorf("--work-relative must be a positive multiplier")
+	case *targetTime == 0 && *relative == 0 && *workFactor == 0:
 		fs.Usage()
 		return fmt.Errorf("--work is required and must be > 0")
 	}
+	if flagSet(fs, "confidence") && *targetTime == 0 {
+		return fmt.Errorf("--confidence is only used with --target-time")
+	}
+	if *profile != "" && *targetTime == 0 {
+		return fmt.Errorf("--profile is only used with --target-time")
+	}
+	if *profile != "" && flagSet(fs, "confidence") {
+		return fmt.Errorf("--confidence cannot be used with --profile: a profile records only an average rate")
+	}
+	if !(*confidence > 0 && *confidence < 100) {
+		return fmt.Errorf("--confidence must be between 0 and 100 (a percentage)")
+	}
+	inputs := append([]string{*inputFile}, extra...)
+	if len(extra) > 0 && !*shared {
+		return fmt.Errorf("several inputs are only encrypted together with --shared-puzzle (got %d)", len(inputs))
+	}
+	if *shared && len(inputs) < 2 {
+		return fmt.Errorf("--shared-puzzle needs at least two inputs")
+	}
+
+	if *dataKey != "" {
+		switch {
+		case *shared:
+			return fmt.Errorf("--data-key cannot be used with --shared-puzzle")
+		case *chunkSize != "":
+			return fmt.Errorf("--data-key cannot be used with --chunk-size")
+		case *private:
+			return fmt.Errorf("--data-key cannot be used with --private-listing")
+		}
+	}
+
+	if (*decoy == "") != (*decoyKey == "") {
+		return fmt.Errorf("--decoy and --decoy-key must be given together")
+	}
+	if *decoy != "" {
+		switch {
+		case *keyInput == "":
+			return fmt.Errorf("--decoy needs the real passphrase as --key")
+		case *shared:
+			return fmt.Errorf("--decoy cannot be used with --shared-puzzle")
+		case *dataKey != "":
+			return fmt.Errorf("--decoy cannot be used with --data-key")
+		case *chunkSize != "":
+			return fmt.Errorf("--decoy cannot be used with --chunk-size")
+		}
+	}
+
+	if *inPlace {
+		switch {
+		case *shared:
+			return fmt.Errorf("--in-place cannot be used with --shared-puzzle")
+		case *dataKey != "":
+			return fmt.Errorf("--in-place cannot be used with --data-key")
+		case *decoy != "":
+			return fmt.Errorf("--in-place cannot be used with --decoy")
+		case *private:
+			return fmt.Errorf("--in-place cannot be used with --private-listing")
+		case *appendTo != "":
+			return fmt.Errorf("--in-place cannot be used with --append-to")
+		case flagSet(fs, "output-template"):
+			return fmt.Errorf("--in-place cannot be used with --output-template")
+		case *verify:
+			return fmt.Errorf("--in-place cannot be used with --verify: the input is gone to compare against")
+		}
+	}
+	if flagSet(fs, "verify-solve-max") && !*verify {
+		return fmt.Errorf("--verify-solve-max is only used with --verify")
+	}
+	if flagSet(fs, "verify-puzzle-steps") && !*vPuzzle {
+		return fmt.Errorf("--verify-puzzle-steps is only used with --verify-puzzle")
+	}
+	if *vSteps == 0 {
+		return fmt.Errorf("--verify-puzzle-steps must be positive")
+	}
+	if *andPuzzles < 1 || *andPuzzles > types.MaxAndPuzzles {
+		return fmt.Errorf("--and-puzzles must be between 1 and %d", types.MaxAndPuzzles)
+	}
+	if *andPuzzles > 1 {
+		switch {
+		case *targetTime != 0:
+			return fmt.Errorf("--and-puzzles cannot be used with %s: give the work factor of each puzzle with --work", timeFlag)
+		case *decoy != "":
+			return fmt.Errorf("--and-puzzles cannot be used with --decoy")
+		}
+	}
+	if err := crypto.CheckModulusBits(*bits); err != nil {
+		return fmt.Errorf("--modulus-bits: %v", err)
+	}
+	if *tweakBase && *keyInput == "" {
+		return fmt.Errorf("--tweak-base needs a passphrase (--key) whose base it tweaks")
+	}
+
+	if *excludeArg != "" {
+		lines, err := utils.ReadExcludeFile(*excludeArg)
+		if err != nil {
+			return fmt.Errorf("--exclude-from: %v", err)
+		}
+		excludes = append(excludes, lines...)
+	}
+	if len(excludes) > 0 || *excludeArg != "" {
+		if _, err := utils.NewExcluder(excludes); err != nil {
+			return err
+		}
+		if !anyDirectory(inputs) {
+			return fmt.Errorf("--exclude and --exclude-from only apply to directory inputs")
+		}
+	}
+
+	if _, err := operations.ParseOutputTemplate(*template); err != nil {
+		return err
+	}
+	if *appendTo != "" && flagSet(fs, "output-template") {
+		return fmt.Errorf("--append-to and --output-template cannot be used together")
+	}
+	if *inputFile == stdio {
+		if *inPlace {
+			return fmt.Errorf("--in-place needs a local file")
+		}
+		// A pipe in goes to a pipe out, unless told otherwise
+		if *outputFile == "" && !flagSet(fs, "output-template") && *appendTo == "" {
+			*outputFile = stdio
+		}
+		switch {
+		case *outputFile == "":
+			return fmt.Errorf("--input - needs --output: there is no input name to name the encrypted file after")
+		case *dataKey != "":
+			return fmt.Errorf("--input - cannot be used with --data-key: the input only names the output")
+		case *decoy != "":
+			return fmt.Errorf("--input - cannot be used with --decoy")
+		}
+	}
+	if *outputFile != "" {
+		switch {
+		case flagSet(fs, "output-template"):
+			return fmt.Errorf("--output and --output-template cannot be used together")
+		case *appendTo != "":
+			return fmt.Errorf("--output and --append-to cannot be used together")
+		case *inPlace:
+			return fmt.Errorf("--output cannot be used with --in-place: the encrypted file replaces the input")
+		case *shared:
+			return fmt.Errorf("--output cannot be used with --shared-puzzle: each input gets its own file (use --output-template)")
+		case *outputFile == stdio && *verify:
+			return fmt.Errorf("--verify cannot read back a file written to stdout")
+		}
+	}
+
+	var chunk int64
+	if *chunkSize != "" {
+		var err error
+		if chunk, err = utils.ParseSize(*chunkSize); err != nil {
+			return fmt.Errorf("--chunk-size: %v", err)
+		}
+		if err := crypto.ValidateChunkSize(int(min(chunk, crypto.MaxChunkSize+1))); err != nil {
+			return fmt.Errorf("--chunk-size: %v", err)
+		}
+	}
+	var above int64
+	switch {
+	case *chunkAbove == "off":
+		above = -1
+	case *chunkAbove != "":
+		if *chunkSize != "" {
+			return fmt.Errorf("--chunk-size and --chunk-above cannot be used together")
+		}
+		var err error
+		if above, err = utils.ParseSize(*chunkAbove); err != nil {
+			return fmt.Errorf("--chunk-above: %v", err)
+		}
+		if above == 0 {
+			return fmt.Errorf("--chunk-above must be positive (use --chunk-size to chunk every input)")
+		}
+	}
+	if _, err := crypto.KeyDerivationForHash(*keyHash); err != nil {
+		return fmt.Errorf("--key-hash: %v", err)
+	}
+	if _, err := crypto.CipherForName(*cipher); err != nil {
+		return fmt.Errorf("--cipher: %v", err)
+	}
+	var padSize int64
+	if *padHeader != "" {
+		var err error
+		if padSize, err = utils.ParseSize(*padHeader); err != nil {
+			return fmt.Errorf("--pad-header: %v", err)
+		}
+		if padSize <= 0 || padSize > types.MaxExtensionSize {
+			return fmt.Errorf("--pad-header: size must be between 1 byte and %d bytes", types.MaxExtensionSize)
+		}
+	}
+
+	// With --output -, stdout carries the encrypted file alone
+	var outputFS utils.WriteFS
+	if *outputFile == stdio {
+		outputFS = c.stdoutFS()
+	}
+
+	// Pick the work factor from the rate of a profiled machine, a confidence
+	// interval on this machine's rate, or its calibrated rate, keeping the
+	// rate it was picked at
+	var pickedRate float64
+	if *targetTime != 0 {
+		var tuning *operations.Tuning
+		switch {
+		case *profile != "":
+			tuning, err = profileWorkFactor(c.stdout, *profile, *targetTime, *bits)
+		case flagSet(fs, "confidence"):
+			tuning, err = tuneWorkFactor(c.stdout, *targetTime, *confidence/100, *bits)
+		default:
+			tuning, err = durationWorkFactor(c.stdout, *targetTime, *bits)
+		}
+		if err != nil {
+			return err
+		}
+		*workFactor, pickedRate = tuning.WorkFactor, tuning.Rate.Lower
+	} else if *relative != 0 {
+		rel, err := relativeWorkFactor(c.stdout, *relative, *bits)
+		if err != nil {
+			return err
+		}
+		*workFactor, pickedRate = rel.WorkFactor, rel.Rate
+	}
 
 	// Prepare options for the operation
 	opts := operations.EncryptOptions{
-		InputFile:  *inputFile,
-		WorkFactor: *workFactor,
-		KeyInput:   *keyInput,
+		InputFile:      *inputFile,
+		WorkFactor:     *workFactor,
+		KeyInput:       *keyInput,
+		PrivateListing: *private,
+		Exclude:        excludes,
+		ChunkSize:      int(chunk),
+		ChunkAbove:     above,
+		OutputTemplate: *template,
+		OutputFile:     *outputFile,
+		OutputFS:       outputFS,
+		NoTrapdoor:     *noTrapdoor,
+		AppendTo:       *appendTo,
+		DecoyFile:      *decoy,
+		DecoyKeyInput:  *decoyKey,
+		InPlace:        *inPlace,
+		KeyHash:        *keyHash,
+		Cipher:         *cipher,
+		Verify:         *verify,
+		PadHeader:      int(padSize),
+		VerifyPuzzle:   *vPuzzle,
+		BaseTweak:      *tweakBase,
+		AndPuzzles:     *andPuzzles,
+		ModulusBits:    *bits,
+	}
+	if *inputFile == stdio {
+		opts.Input = os.Stdin
+	}
+	if *vPuzzle {
+		opts.VerifyPuzzleSteps = *vSteps
+	}
+	if *verify {
+		opts.VerifySolveLimit = *solveMax
+		opts.VerifyProgress = verifyProgress(c.stdout, *workFactor*uint64(*andPuzzles))
+	}
+	if *dataKey != "" {
+		key, err := utils.ParseDataKey(*dataKey)
+		if err != nil {
+			return fmt.Errorf("--data-key: %v", err)
+		}
+		opts.DataKey = &key
+	}
+
+	// Record the rate the work factor was picked at, or measure this
+	// machine's, so decryptors can compare
+	if *recordRate && pickedRate > 0 {
+		opts.OpsPerSecond = pickedRate
+		fmt.Fprintf(c.stdout, "Recording rate: %.0f squarings/second\n", opts.OpsPerSecond)
+	} else if *recordRate {
+		fmt.Fprintf(c.stdout, "Measuring squaring rate...\n")
+		bench, err := operations.RunBenchmark(operations.BenchmarkOptions{
+			Duration:    rateProbeDuration,
+			Samples:     1,
+			ModulusBits: *bits,
+		})
+		if err != nil {
+			return err
+		}
+		opts.OpsPerSecond = bench.AvgOpsPerSecond
+		fmt.Fprintf(c.stdout, "Recording rate: %.0f squarings/second\n", opts.OpsPerSecond)
+	}
+
+	// An interrupted in-place operation is finished without a new puzzle
+	resuming := false
+	if opts.InPlace {
+		_, err := os.Stat(utils.InPlaceJournalPath(*inputFile))
+		resuming = err == nil
 	}
 
 	// Display progress messages
-	fmt.Printf("Reading input file: %s\n", *inputFile)
-	fmt.Printf("Generating time-lock puzzle (work factor: %d)...\n", *workFactor)
+	if resuming {
+		fmt.Fprintf(c.stdout, "Finishing an interrupted in-place operation on %s...\n", *inputFile)
+	} else if *shared {
+		fmt.Fprintf(c.stdout, "Reading %d input files\n", len(inputs))
+		fmt.Fprintf(c.stdout, "Generating one time-lock puzzle for all of them (work factor: %d)...\n", *workFactor)
+	} else if opts.DataKey == nil {
+		fmt.Fprintf(c.stdout, "Reading input file: %s\n", *inputFile)
+		fmt.Fprintf(c.stdout, "Generating time-lock puzzle (work factor: %d)...\n", *workFactor)
+	}
+
+	// Without the trapdoor the target is solved like a decryptor would
+	var progressBar *utils.ProgressBar
+	if !resuming && (opts.NoTrapdoor || !crypto.TrapdoorAvailable()) {
+		squarings := *workFactor * uint64(*andPuzzles)
+		if opts.DecoyFile != "" {
+			// One target per passphrase
+			squarings *= 2
+		}
+		fmt.Fprintf(c.stdout, "Computing the puzzle target by sequential squaring (no trapdoor; this takes as long as decrypting)...\n")
+		progressBar = utils.NewProgressBar(squarings)
+		progressBar.SetOutput(c.stdout)
+		progressBar.StartTicker(utils.DefaultRedrawInterval)
+		opts.Progress = progressBar.Update
+	}
 
 	// Perform the encryption operation
-	result, err := operations.EncryptFile(opts)
+	var results []*operations.EncryptResult
+	if *shared {
+		results, err = operations.EncryptGroup(inputs, opts)
+	} else {
+		var result *operations.EncryptResult
+		if result, err = operations.EncryptFile(opts); err == nil {
+			results = append(results, result)
+		}
+	}
+	if progressBar != nil {
+		if err != nil {
+			progressBar.StopTicker()
+		} else {
+			progressBar.Finish()
+		}
+	}
+	for _, result := range results {
+		printEncryptResult(c.stdout, result, opts)
+	}
 	if err != nil {
+		if *shared {
+			fmt.Fprintf(c.stdout, "Encrypted %d of %d files before the failure\n", len(results), len(inputs))
+		}
 		return err
 	}
+	if *shared {
+		g := results[0].Shared
+		fmt.Fprintf(c.stdout, "\nShared puzzle group: %s (%d files)\n", hex.EncodeToString(g.Group[:]), g.Count)
+		fmt.Fprintf(c.stdout, "Solving any one of these files unlocks all of them.\n")
+	}
+	return nil
+}
 
-	// Display results
-	fmt.Printf("Encrypting data (%d bytes)...\n", result.PlaintextSize)
-	fmt.Printf("Writing encrypted file: %s\n", result.OutputFile)
-	fmt.Printf("Encryption complete!\n")
-	fmt.Printf("Input file: %s (%d bytes)\n", result.InputFile, result.PlaintextSize)
-	fmt.Printf("Output file: %s (%d bytes)\n", result.OutputFile, result.EncryptedSize)
-	fmt.Printf("Work factor: %d sequential squarings\n", result.WorkFactor)
-	if result.KeyRequired {
-		fmt.Printf("Key required: Yes (puzzle + passphrase)\n")
+// printEncryptResult displays the outcome of encrypting one input.
+func printEncryptResult(w io.Writer, result *operations.EncryptResult, opts operations.EncryptOptions) {
+	if result.InPlaceResumed {
+		fmt.Fprintf(w, "Finished the interrupted operation: %s is now %s\n", result.InputFile, result.OutputFile)
+		return
+	}
+	fmt.Fprintf(w, "Encrypting data (%d bytes)...\n", result.PlaintextSize)
+	if opts.AppendTo != "" {
+		fmt.Fprintf(w, "Appending record %d to log: %s\n", result.LogRecord, result.OutputFile)
 	} else {
-		fmt.Printf("Key required: No (puzzle only)\n")
+		fmt.Fprintf(w, "Writing encrypted file: %s\n", result.OutputFile)
 	}
+	fmt.Fprintf(w, "Encryption complete!\n")
+	switch {
+	case result.DataKey:
+		fmt.Fprintf(w, "Data key: %d bytes, wrapped under the puzzle key (decrypting outputs the key)\n", result.PlaintextSize)
+	case result.Container:
+		fmt.Fprintf(w, "Input directory: %s (%d entries, %d bytes)\n", result.InputFile, result.EntryCount, result.PlaintextSize)
+		if result.SkippedCount > 0 {
+			fmt.Fprintf(w, "Skipped: %d entries that are not regular files or directories\n", result.SkippedCount)
+		}
+		for _, e := range result.Excluded {
+			fmt.Fprintf(w, "Excluded: %d entries matching %s\n", e.Count, e.Pattern)
+		}
+		if result.DuplicateCount > 0 {
+			fmt.Fprintf(w, "Deduplicated: %d files identical to another stored once (ratio %.2f)\n", result.DuplicateCount, result.DedupRatio)
+		}
+		if opts.PrivateListing {
+			fmt.Fprintf(w, "Entry table: encrypted (listing requires solving)\n")
+		}
+	default:
+		fmt.Fprintf(w, "Input file: %s (%d bytes)\n", result.InputFile, result.PlaintextSize)
+	}
+	if opts.DecoyFile != "" {
+		fmt.Fprintf(w, "Decoy file: %s (%d bytes, decrypted instead with the decoy passphrase)\n", opts.DecoyFile, result.DecoySize)
+	}
+	if result.ChunkSize != 0 && opts.ChunkSize == 0 && !result.InPlace {
+		fmt.Fprintf(w, "Chunk size: %d bytes (chosen for a large input; see --chunk-above)\n", result.ChunkSize)
+	} else if result.ChunkSize != 0 {
+		fmt.Fprintf(w, "Chunk size: %d bytes\n", result.ChunkSize)
+	}
+	if result.InPlaceOverwrite {
+		fmt.Fprintf(w, "In place: input encrypted over its own bytes (no room for a copy) and renamed\n")
+	} else if result.InPlace {
+		fmt.Fprintf(w, "In place: input removed\n")
+	}
+	if opts.AppendTo != "" {
+		fmt.Fprintf(w, "Record size: %d bytes\n", result.EncryptedSize)
+		fmt.Fprintf(w, "Log head: %s (record this to detect records later removed from the end)\n", hex.EncodeToString(result.LogHead[:]))
+	} else {
+		fmt.Fprintf(w, "Output file: %s (%d bytes)\n", result.OutputFile, result.EncryptedSize)
+	}
+	fmt.Fprintf(w, "Work factor: %d sequential squarings\n", result.WorkFactor)
+	if opts.AndPuzzles > 1 {
+		fmt.Fprintf(w, "Puzzles: %d, all of which must be solved (%d sequential squarings in all)\n", opts.AndPuzzles, result.WorkFactor*uint64(opts.AndPuzzles))
+	}
+	if result.KeyRequired && opts.BaseTweak {
+		fmt.Fprintf(w, "Key required: Yes (puzzle + passphrase, base tweaked with a file ID)\n")
+	} else if result.KeyRequired {
+		fmt.Fprintf(w, "Key required: Yes (puzzle + passphrase)\n")
+	} else {
+		fmt.Fprintf(w, "Key required: No (puzzle only)\n")
+	}
+	if g := result.Shared; g != nil {
+		fmt.Fprintf(w, "Shared puzzle: file %d of %d in group %s\n", g.Index+1, g.Count, hex.EncodeToString(g.Group[:]))
+	}
+	if check := result.PuzzleCheck; check != nil {
+		switch {
+		case check.Full:
+			fmt.Fprintf(w, "Puzzle verified: values in range, target matches a sequential solve of %d squarings\n", check.Steps)
+		case check.Steps > 0:
+			fmt.Fprintf(w, "Puzzle verified: values in range, trapdoor matches a sequential solve of the first %d squarings\n", check.Steps)
+		default:
+			fmt.Fprintf(w, "Puzzle verified: values in range only (no trapdoor to compare a partial solve with)\n")
+		}
+	}
+	if opts.Verify {
+		source := "from the page cache (it could not be bypassed here)"
+		if result.VerifiedFromDisk {
+			source = "from disk"
+		}
+		fmt.Fprintf(w, "Verified: %s, read %s\n", result.Verified, source)
+		if result.VerifySkipped != "" {
+			fmt.Fprintf(w, "Not solved: %s\n", result.VerifySkipped)
+		}
+	}
+}
 
-	return nil
+// anyDirectory reports whether one of inputs is a directory.
+func anyDirectory(inputs []string) bool {
+	for _, input := range inputs {
+		if info, err := os.Stat(input); err == nil && info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// tuneWorkFactor benchmarks this machine with a bits-bit modulus and prints
+// the work factor it picks for target and the rate interval it was picked
+// from.
+func tuneWorkFactor(w io.Writer, target time.Duration, confidence float64, bits int) (*operations.Tuning, error) {
+	fmt.Fprintf(w, "Benchmarking squaring rate to pick the work factor for %s at %g%% confidence...\n", utils.FormatDuration(target), confidence*100)
+	tuning, err := operations.TuneWorkFactor(operations.TuneOptions{
+		TargetTime: target,
+		Confidence: confidence,
+		Benchmark:  operations.BenchmarkOptions{ModulusBits: bits},
+	})
+	if err != nil {
+		return nil, err
+	}
+	rate := tuning.Rate
+	fmt.Fprintf(w, "Rate: %.0f squarings/second (%d samples, std deviation %.0f)\n", rate.Mean, rate.Samples, rate.StdDev)
+	fmt.Fprintf(w, "%g%% confidence interval: %.0f to %.0f squarings/second\n", rate.Confidence*100, rate.Lower, rate.Upper)
+	fmt.Fprintf(w, "Work factor: %d (%s at the lower bound, %s at the mean rate)\n",
+		tuning.WorkFactor, utils.FormatDuration(tuning.TargetTime), utils.FormatDuration(tuning.MeanTime))
+	return tuning, nil
+}
+
+// durationWorkFactor prints the work factor this machine solves in about
+// target with a bits-bit modulus, picked from its calibrated rate or a
+// quick benchmark.
+func durationWorkFactor(w io.Writer, target time.Duration, bits int) (*operations.Tuning, error) {
+	tuning, err := operations.WorkFactorForDuration(target, bits)
+	if err != nil {
+		return nil, err
+	}
+	if tuning.Benchmark == nil {
+		fmt.Fprintf(w, "Rate: %.0f squarings/second (from this machine's calibrated rate)\n", tuning.Rate.Lower)
+	} else {
+		rate := tuning.Rate
+		fmt.Fprintf(w, "Rate: %.0f squarings/second (from a quick benchmark, the lower end of %.0f to %.0f at %g%% confidence)\n",
+			rate.Lower, rate.Lower, rate.Upper, rate.Confidence*100)
+	}
+	fmt.Fprintf(w, "Work factor: %d (%s at that rate)\n", tuning.WorkFactor, utils.FormatDuration(tuning.TargetTime))
+	return tuning, nil
+}
+
+// relativeWorkFactor benchmarks this machine with a bits-bit modulus and
+// prints the work factor of multiplier times the squarings it does in
+// operations.RelativeWorkSample.
+func relativeWorkFactor(w io.Writer, multiplier float64, bits int) (*operations.RelativeWork, error) {
+	fmt.Fprintf(w, "Benchmarking squaring rate to pick %g times the squarings of %s...\n", multiplier, utils.FormatDuration(operations.RelativeWorkSample))
+	rel, err := operations.WorkFactorRelative(multiplier, bits)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(w, "Rate: %.0f squarings/second (reference: %d squarings)\n", rel.Rate, rel.Reference)
+	fmt.Fprintf(w, "Work factor: %d (%g × %d, %s at this rate)\n", rel.WorkFactor, rel.Multiplier, rel.Reference, utils.FormatDuration(rel.EstimatedTime))
+	return rel, nil
+}
+
+// profileWorkFactor prints the work factor the machine a profile was
+// exported from solves in target with a bits-bit modulus.
+func profileWorkFactor(w io.Writer, path string, target time.Duration, bits int) (*operations.Tuning, error) {
+	profile, err := operations.LoadProfile(path)
+	if err != nil {
+		return nil, err
+	}
+	tuning, err := operations.WorkFactorForProfile(profile, target, bits)
+	if err != nil {
+		return nil, err
+	}
+	host := "a machine without a recorded fingerprint"
+	if profile.Host != nil {
+		host = profile.Host.String()
+	}
+	fmt.Fprintf(w, "Picking the work factor for %s on %s (profile %s)\n", utils.FormatDuration(target), host, path)
+	fmt.Fprintf(w, "Rate: %.0f squarings/second\n", tuning.Rate.Lower)
+	fmt.Fprintf(w, "Work factor: %d\n", tuning.WorkFactor)
+	return tuning, nil
+}
+
+// verifyProgress returns a progress callback for the solves of --verify,
+// showing a bar of total squarings for each.
+func verifyProgress(w io.Writer, total uint64) operations.ProgressCallback {
+	var bar *utils.ProgressBar
+	return func(done uint64) {
+		if bar == nil {
+			fmt.Fprintf(w, "Verifying: solving the puzzle read back...\n")
+			bar = utils.NewProgressBar(total)
+			bar.SetOutput(w)
+		}
+		bar.Update(done)
+		if done >= total {
+			bar.Finish()
+			bar = nil
+		}
+	}
 }
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"flag"
+	"io"
+	"strings"
+)
+
+// stringList is a flag.Value that collects every occurrence of a repeatable
+// flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// printDefaults prints the defaults of every flag in fs to w, except the
+// hidden ones.
+func printDefaults(fs *flag.FlagSet, w io.Writer, hidden ...string) {
+	visible := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	visible.SetOutput(w)
+	fs.VisitAll(func(f *flag.Flag) {
+		for _, name := range hidden {
+			if f.Name == name {
+				return
+			}
+		}
+		visible.Var(f.Value, f.Name, f.Usage)
+	})
+	visible.PrintDefaults()
+}
+
+// flagSet reports whether the flag with this name was given on the command
+// line.
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// templateHelp describes the --output-template placeholders.
+const templateHelp = `Output template placeholders:
+  {path}         input path as given
+  {unlocked}     input path without .locked (or with .decrypted appended)
+  {dir}          directory of the input
+  {base}         input file name (without .locked when decrypting)
+  {name}, {ext}  {base} split before its last extension ({ext} includes the dot)
+  {workfactor}   number of sequential squarings
+  {date}, {time} current local date (2006-01-02) and time (150405)
+  {timestamp}    current Unix time in seconds
+  {fingerprint}  first 8 hex digits of the SHA-256 of the file header
+`
+
+// controlsHelp describes the keys understood while solving in a terminal.
+const controlsHelp = `Controls while solving (in a terminal):
+  p  pause or resume (paused time is left out of the rate and ETA)
+  c  save a checkpoint now
+  q  save a checkpoint and quit; run the same command again to resume
+  s  print a status snapshot
+
+Signals (Unix):
+  SIGUSR1  print a status line to stderr, even with output redirected
+  SIGUSR2  save a checkpoint now, without pausing
+  SIGINT, SIGTERM  save a checkpoint and quit
+`
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+var overheadCommand = &Command{
+	Name:    "overhead",
+	Summary: "Estimate the storage overhead of encrypting many files",
+	Synopsis: []string{
+		"--count FILES --avg-size SIZE [--chunk-size SIZE] [--name-length BYTES]",
+	},
+	Description: "Estimate what an archive of many small files costs beyond its data when every file\n" +
+		"is locked on its own (a header of at least " + fmt.Sprint(types.HeaderSize) + " bytes each, mostly the modulus and base)\n" +
+		"and when the files are encrypted together as a directory, to decide between the two.\n" +
+		"Nothing is read or written; the sizes are those of the headers encrypt writes.",
+	Examples: []string{
+		"cryptotimed overhead --count 10000 --avg-size 4KiB",
+		"cryptotimed overhead --count 200 --avg-size 50MiB --chunk-size 1MiB",
+	},
+	run: runOverhead,
+}
+
+// OverheadCommand handles the overhead subcommand
+func OverheadCommand(args []string) error {
+	return overheadCommand.Run(args)
+}
+
+func runOverhead(c *Command, args []string) error {
+	fs := c.FlagSet()
+
+	var (
+		count      = fs.Int64("count", 0, "Number of files (required)")
+		avgSize    = fs.String("avg-size", "", "Average file size, e.g. 4096, 4KiB or 1.5MiB (required)")
+		chunkSize  = fs.String("chunk-size", "", "Chunk size separate files would be sealed in, as for encrypt")
+		nameLength = fs.Int("name-length", operations.DefaultOverheadNameLength, "Average path length of a file within the directory, in bytes")
+	)
+
+	if _, err := c.Parse(fs, args); err != nil {
+		return err
+	}
+	if *count == 0 || *avgSize == "" {
+		fs.Usage()
+		return fmt.Errorf("--count and --avg-size are required")
+	}
+	if *count < 0 {
+		return fmt.Errorf("--count must be positive")
+	}
+	size, err := utils.ParseSize(*avgSize)
+	if err != nil {
+		return fmt.Errorf("--avg-size: %v", err)
+	}
+	var chunk int64
+	if *chunkSize != "" {
+		if chunk, err = utils.ParseSize(*chunkSize); err != nil {
+			return fmt.Errorf("--chunk-size: %v", err)
+		}
+		if err := crypto.ValidateChunkSize(int(min(chunk, crypto.MaxChunkSize+1))); err != nil {
+			return fmt.Errorf("--chunk-size: %v", err)
+		}
+	}
+	if *nameLength <= 0 {
+		return fmt.Errorf("--name-length must be positive")
+	}
+
+	result, err := operations.EstimateOverhead(operations.OverheadOptions{
+		Count:      *count,
+		AvgSize:    size,
+		ChunkSize:  int(chunk),
+		NameLength: *nameLength,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stdout, "Files: %d averaging %s\n", result.Count, utils.FormatSize(result.AvgSize))
+	fmt.Fprintf(c.stdout, "Payload: %s\n", utils.FormatSize(result.Payload))
+	fmt.Fprintln(c.stdout)
+	fmt.Fprintf(c.stdout, "Each file locked on its own:\n")
+	printOverhead(c.stdout, result.Separate, result.Payload, fmt.Sprintf("%d × %d bytes", result.Count, types.HeaderSize))
+	fmt.Fprintln(c.stdout)
+	fmt.Fprintf(c.stdout, "All files encrypted as one directory (encrypt --input DIR):\n")
+	printOverhead(c.stdout, result.Container, result.Payload, "one header")
+	if result.Container.ExceedsHeader {
+		fmt.Fprintf(c.stdout, "  The entry table exceeds the %s header limit: use --private-listing or split the files.\n",
+			utils.FormatSize(types.MaxExtensionSize))
+	}
+	fmt.Fprintln(c.stdout)
+	if saved := result.Separate.Total - result.Container.Total; saved > 0 {
+		fmt.Fprintf(c.stdout, "A directory saves %s, at the price of a single puzzle for every file.\n", utils.FormatSize(saved))
+	} else {
+		fmt.Fprintf(c.stdout, "Locking files on their own costs no more than a directory.\n")
+	}
+	return nil
+}
+
+// printOverhead prints the breakdown of an overhead estimate and its share
+// of the payload.
+func printOverhead(w io.Writer, o operations.Overhead, payload int64, fixed string) {
+	fmt.Fprintf(w, "  Fixed headers:    %10s  (%s)\n", utils.FormatSize(o.FixedHeader), fixed)
+	fmt.Fprintf(w, "  Header extensions: %9s\n", utils.FormatSize(o.Extensions))
+	fmt.Fprintf(w, "  Framing:          %10s  (lengths, nonces and tags)\n", utils.FormatSize(o.Framing))
+	if payload > 0 {
+		fmt.Fprintf(w, "  Total:            %10s  (%.3g%% of the payload, %d bytes per file)\n",
+			utils.FormatSize(o.Total), 100*float64(o.Total)/float64(payload), o.PerFile)
+	} else {
+		fmt.Fprintf(w, "  Total:            %10s  (%d bytes per file)\n", utils.FormatSize(o.Total), o.PerFile)
+	}
+}
@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"cryptotimed/src/utils"
+)
+
+// stdio is the --input and --output value that stands for stdin and stdout.
+const stdio = "-"
+
+// spoolStdin copies stdin, for a decrypt --input of "-", to a temporary
+// file that remove deletes.  Its header is needed before the solve and its
+// data after, and a pipe can only be read once, so the encrypted file is
+// read from disk like any other rather than held in memory.
+func spoolStdin() (path string, remove func(), err error) {
+	f, err := os.CreateTemp("", "cryptotimed-stdin-*.locked")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	remove = func() { os.Remove(f.Name()) }
+	_, err = io.Copy(f, os.Stdin)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		remove()
+		return "", nil, fmt.Errorf("failed to read stdin: %v", err)
+	}
+	return f.Name(), remove, nil
+}
+
+// stdoutFS returns a filesystem writing the output to stdout, for an
+// --output of "-", and sends everything the command prints from now on to
+// stderr (unless --quiet already discards it), so it cannot corrupt the
+// output.
+func (c *Command) stdoutFS() utils.WriteFS {
+	if c.stdout != io.Discard {
+		c.stdout = c.stderr
+	}
+	return utils.NewWriterFS(c.output)
+}
+
+// isTerminal reports whether w writes to a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && utils.IsTerminal(f)
+}
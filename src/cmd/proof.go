@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"cryptotimed/src/operations"
+)
+
+var verifySolveProofCommand = &Command{
+	Name:    "verify-solve-proof",
+	Summary: "Check a proof that a puzzle was solved, without solving it",
+	Synopsis: []string{
+		"--proof FILE [--input FILE]",
+	},
+	Description: "Check a proof written by decrypt --emit-proof that the solution it holds is the base\n" +
+		"of the puzzle squared as many times as its work factor says. This takes a small fraction\n" +
+		"of the squarings the solve took. With --input, the proof must also be about the puzzle of\n" +
+		"that encrypted file; no passphrase is needed for this. The proof convinces anyone but the\n" +
+		"encryptor, who could forge one with the puzzle's trapdoor.",
+	Examples: []string{
+		"cryptotimed verify-solve-proof --proof proof.json",
+		"cryptotimed verify-solve-proof --proof proof.json --input prediction.txt.locked",
+	},
+	run: runVerifySolveProof,
+}
+
+// VerifySolveProofCommand handles the verify-solve-proof subcommand
+func VerifySolveProofCommand(args []string) error {
+	return verifySolveProofCommand.Run(args)
+}
+
+func runVerifySolveProof(c *Command, args []string) error {
+	fs := c.FlagSet()
+
+	var (
+		proofFile = fs.String("proof", "", "Proof written by decrypt --emit-proof (required)")
+		inputFile = fs.String("input", "", "Encrypted file the proof must be about")
+	)
+
+	if _, err := c.Parse(fs, args); err != nil {
+		return err
+	}
+	if *proofFile == "" {
+		fs.Usage()
+		return fmt.Errorf("--proof is required")
+	}
+
+	result, err := operations.VerifySolveProof(operations.VerifySolveProofOptions{
+		ProofFile: *proofFile,
+		InputFile: *inputFile,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stdout, "Proof verified: %s\n", result.ProofFile)
+	if result.InputFile != "" {
+		fmt.Fprintf(c.stdout, "Encrypted file: %s (the proof is about its puzzle)\n", result.InputFile)
+	}
+	fmt.Fprintf(c.stdout, "Work factor: %d sequential squarings\n", result.WorkFactor)
+	fmt.Fprintf(c.stdout, "Puzzle fingerprint: %s\n", hex.EncodeToString(result.Fingerprint[:]))
+	if !result.Created.IsZero() {
+		fmt.Fprintf(c.stdout, "Created: %s\n", result.Created.Format(time.RFC3339))
+	}
+	return nil
+}
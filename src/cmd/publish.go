@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"cryptotimed/src/operations"
+	"cryptotimed/src/utils"
+)
+
+// publishFlags are the --publish-* options shared by commands that solve.
+type publishFlags struct {
+	url      *string
+	secret   *string
+	fallback *string
+	retries  *int
+	dryRun   *bool
+}
+
+// addPublishFlags registers the --publish-* options on fs.
+func addPublishFlags(fs *flag.FlagSet) publishFlags {
+	return publishFlags{
+		url:      fs.String("publish-key", "", "POST the solved target and key as signed JSON to this URL when done"),
+		secret:   fs.String("publish-secret", "", "HMAC-SHA256 secret for signing the published body (or @file:path)"),
+		fallback: fs.String("publish-fallback", "", "Save the body here if publishing fails (default: INPUT.release.json)"),
+		retries:  fs.Int("publish-retries", 5, "Attempts before giving up on publishing"),
+		dryRun:   fs.Bool("publish-dry-run", false, "Print the body and signature instead of sending them"),
+	}
+}
+
+// enabled reports whether a key is to be published.
+func (f publishFlags) enabled() bool {
+	return *f.url != ""
+}
+
+// validate checks the options before any solving is done.
+func (f publishFlags) validate() error {
+	if !f.enabled() {
+		if *f.secret != "" || *f.fallback != "" || *f.dryRun {
+			return fmt.Errorf("--publish-secret, --publish-fallback and --publish-dry-run require --publish-key")
+		}
+		return nil
+	}
+	u, err := url.Parse(*f.url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("--publish-key must be an http or https URL")
+	}
+	if *f.retries < 1 {
+		return fmt.Errorf("--publish-retries must be at least 1")
+	}
+	if _, err := utils.ParseKeyInput(*f.secret); err != nil {
+		return fmt.Errorf("failed to read --publish-secret: %v", err)
+	}
+	return nil
+}
+
+// publish sends the key recovered by result, as configured by the flags.
+func (f publishFlags) publish(w io.Writer, result *operations.DecryptResult) error {
+	secret, err := utils.ParseKeyInput(*f.secret)
+	if err != nil {
+		return fmt.Errorf("failed to read --publish-secret: %v", err)
+	}
+	fallback := *f.fallback
+	if fallback == "" {
+		fallback = operations.InputName(result.InputFile) + ".release.json"
+	}
+
+	opts := operations.PublishOptions{
+		URL:          *f.url,
+		Secret:       secret,
+		Attempts:     *f.retries,
+		Backoff:      time.Second,
+		MaxBackoff:   time.Minute,
+		FallbackFile: fallback,
+		DryRun:       *f.dryRun,
+		OnRetry: func(attempt int, delay time.Duration, err error) {
+			fmt.Fprintf(w, "Publishing attempt %d failed (%v); retrying in %v\n", attempt, err, delay)
+		},
+	}
+	if !opts.DryRun {
+		fmt.Fprintf(w, "Publishing key to %s...\n", opts.URL)
+	}
+	published, err := operations.PublishKey(operations.NewKeyRelease(result, time.Now()), opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.DryRun {
+		fmt.Fprintf(w, "Dry run: would POST to %s\n", opts.URL)
+		if published.Signature != "" {
+			fmt.Fprintf(w, "%s: %s\n", operations.SignatureHeader, published.Signature)
+		}
+		fmt.Fprintf(w, "%s\n", published.Body)
+		return nil
+	}
+	fmt.Fprintf(w, "Key published (HTTP %d after %d attempt(s))\n", published.Status, published.Attempts)
+	return nil
+}
@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/utils"
+)
+
+var puzzleCommand = &Command{
+	Name:    "puzzle",
+	Summary: "Generate a time-lock puzzle with no payload",
+	Synopsis: []string{
+		"--work ITERATIONS --output FILE [--no-trapdoor]",
+	},
+	Description: "Generate a time-lock puzzle with no encrypted payload\n" +
+		"The file holds N, G and T and a commitment to the solution, so solvers can\n" +
+		"check their answer without the creator revealing it.",
+	Examples: []string{
+		"cryptotimed puzzle --work 81000000 --output puzzle.json",
+	},
+	run: runPuzzle,
+}
+
+// PuzzleCommand handles the puzzle subcommand
+func PuzzleCommand(args []string) error {
+	return puzzleCommand.Run(args)
+}
+
+func runPuzzle(c *Command, args []string) error {
+	fs := c.FlagSet()
+
+	var (
+		workFactor = fs.Uint64("work", 0, "Number of sequential squarings required (required)")
+		outputFile = fs.String("output", "", "Puzzle file to write (required)")
+		noTrapdoor = fs.Bool("no-trapdoor", false, "Compute the target by sequential squaring without the RSA trapdoor (takes as long as solving)")
+	)
+
+	if _, err := c.Parse(fs, args); err != nil {
+		return err
+	}
+
+	// Validate required arguments
+	if *workFactor == 0 {
+		fs.Usage()
+		return fmt.Errorf("--work is required and must be > 0")
+	}
+	if *outputFile == "" {
+		fs.Usage()
+		return fmt.Errorf("--output is required")
+	}
+
+	opts := operations.PuzzleOptions{
+		WorkFactor: *workFactor,
+		OutputFile: *outputFile,
+		NoTrapdoor: *noTrapdoor,
+	}
+
+	fmt.Fprintf(c.stdout, "Generating time-lock puzzle (work factor: %d)...\n", *workFactor)
+
+	// Without the trapdoor the target is solved like a solver would
+	var progressBar *utils.ProgressBar
+	if opts.NoTrapdoor || !crypto.TrapdoorAvailable() {
+		fmt.Fprintf(c.stdout, "Computing the puzzle target by sequential squaring (no trapdoor; this takes as long as solving)...\n")
+		progressBar = utils.NewProgressBar(*workFactor)
+		progressBar.SetOutput(c.stdout)
+		progressBar.StartTicker(utils.DefaultRedrawInterval)
+		opts.Progress = progressBar.Update
+	}
+
+	result, err := operations.GeneratePuzzleFile(opts)
+	if progressBar != nil {
+		if err != nil {
+			progressBar.StopTicker()
+		} else {
+			progressBar.Finish()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stdout, "Puzzle written: %s\n", result.OutputFile)
+	fmt.Fprintf(c.stdout, "Work factor: %d sequential squarings\n", result.WorkFactor)
+	fmt.Fprintf(c.stdout, "Fingerprint: %x\n", result.Fingerprint)
+	fmt.Fprintf(c.stdout, "Commitment: %x\n", result.Commitment)
+	fmt.Fprintf(c.stdout, "Solve with: %s solve-puzzle --input %s\n", os.Args[0], result.OutputFile)
+	return nil
+}
+
+var solvePuzzleCommand = &Command{
+	Name:    "solve-puzzle",
+	Summary: "Solve a puzzle file and verify the solution",
+	Synopsis: []string{
+		"--input FILE [--pin-thread]",
+	},
+	Description: "Solve a puzzle made by the puzzle command and check the solution against its commitment",
+	Examples: []string{
+		"cryptotimed solve-puzzle --input puzzle.json",
+	},
+	run: runSolvePuzzle,
+}
+
+// SolvePuzzleCommand handles the solve-puzzle subcommand
+func SolvePuzzleCommand(args []string) error {
+	return solvePuzzleCommand.Run(args)
+}
+
+func runSolvePuzzle(c *Command, args []string) error {
+	fs := c.FlagSet()
+
+	var (
+		inputFile = fs.String("input", "", "Puzzle file to solve (required)")
+		pinThread = fs.Bool("pin-thread", false, "Lock the solver to one OS thread for a steadier squaring rate")
+		gcPercent = fs.Int("gogc", 0, "GOGC value while solving (0 = leave unchanged, -1 = disable GC)")
+		noCalib   = fs.Bool("no-calibrate", false, "Keep this solve's rate out of the calibration profile used for estimates (e.g. while benchmarking)")
+		redraw    = fs.Duration("progress-interval", utils.DefaultRedrawInterval, "Redraw the progress bar at least this often (0 = only on progress)")
+	)
+
+	if _, err := c.Parse(fs, args); err != nil {
+		return err
+	}
+
+	// Validate required arguments
+	if *inputFile == "" {
+		fs.Usage()
+		return fmt.Errorf("--input is required")
+	}
+
+	workFactor, err := operations.ReadPuzzleWorkFactor(*inputFile)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "Solving time-lock puzzle (%d sequential squarings)...\n", workFactor)
+
+	progressBar := utils.NewProgressBar(workFactor)
+	progressBar.SetOutput(c.stdout)
+	progressBar.StartTicker(*redraw)
+
+	// SIGUSR1 prints a status line; there are no checkpoints to save
+	stopSnapshots := watchSnapshotSignals(c.stderr, progressBar, nil, nil)
+	result, err := operations.SolvePuzzleFile(operations.SolvePuzzleFileOptions{
+		InputFile:   *inputFile,
+		PinThread:   *pinThread,
+		GCPercent:   *gcPercent,
+		NoCalibrate: *noCalib,
+	}, progressBar.Update)
+	stopSnapshots()
+	if err != nil {
+		progressBar.StopTicker()
+		return err
+	}
+	progressBar.Finish()
+	for _, warning := range result.Warnings {
+		fmt.Fprintf(c.stdout, "Warning: %s\n", warning)
+	}
+
+	if !result.Verified {
+		return fmt.Errorf("the solution does not match the puzzle's commitment (the file was altered or not generated honestly)")
+	}
+	fmt.Fprintf(c.stdout, "Puzzle solved and verified against the commitment!\n")
+	fmt.Fprintf(c.stdout, "Target: %x\n", result.Target)
+	return nil
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"cryptotimed/src/operations"
+	"cryptotimed/src/utils"
+)
+
+var inspectResumeCommand = &Command{
+	Name:    "inspect-resume",
+	Summary: "Show the progress saved in a decrypt checkpoint",
+	Synopsis: []string{
+		"--file FILE.resume [--input FILE.locked]",
+	},
+	Description: "Show the progress saved in a decrypt checkpoint and which encrypted file it belongs to",
+	Examples: []string{
+		"cryptotimed inspect-resume --file document.pdf.locked.resume",
+		"cryptotimed inspect-resume --file progress.resume --input document.pdf.locked",
+	},
+	run: runInspectResume,
+}
+
+// InspectResumeCommand handles the inspect-resume subcommand
+func InspectResumeCommand(args []string) error {
+	return inspectResumeCommand.Run(args)
+}
+
+func runInspectResume(c *Command, args []string) error {
+	fs := c.FlagSet()
+
+	var (
+		file  = fs.String("file", "", "Resume checkpoint to inspect (required)")
+		input = fs.String("input", "", "Encrypted file to compare it against (default: FILE without .resume)")
+	)
+
+	if _, err := c.Parse(fs, args); err != nil {
+		return err
+	}
+
+	// Validate required arguments
+	if *file == "" {
+		fs.Usage()
+		return fmt.Errorf("--file is required")
+	}
+
+	result, err := operations.InspectResume(operations.InspectResumeOptions{
+		CheckpointFile: *file,
+		LockedFile:     *input,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stdout, "Checkpoint: %s\n", result.CheckpointFile)
+	fmt.Fprintf(c.stdout, "Puzzle fingerprint: %s\n", hex.EncodeToString(result.Fingerprint[:]))
+	switch {
+	case result.LockedFile == "":
+		fmt.Fprintf(c.stdout, "Encrypted file: unknown (use --input to compare against one)\n")
+	case result.Matches:
+		fmt.Fprintf(c.stdout, "Encrypted file: %s (fingerprint matches)\n", result.LockedFile)
+	default:
+		fmt.Fprintf(c.stdout, "Encrypted file: %s does NOT match: %s\n", result.LockedFile, result.Mismatch)
+	}
+	fmt.Fprintf(c.stdout, "Progress: %d of %d squarings (%.2f%%)\n", result.Done, result.WorkFactor, result.Percent)
+	fmt.Fprintf(c.stdout, "Last updated: %s (%s ago)\n", result.Updated.Format(time.RFC3339), utils.FormatDuration(time.Since(result.Updated)))
+
+	if result.LockedFile != "" && !result.Matches {
+		fmt.Fprintf(c.stdout, "\nThis checkpoint cannot be resumed for %s; decrypting it starts over.\n", result.LockedFile)
+	} else if result.Matches {
+		fmt.Fprintf(c.stdout, "\nRun decrypt on %s to resume from here.\n", result.LockedFile)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"cryptotimed/src/operations"
+)
+
+var installSolveCommand = &Command{
+	Name:    "install-solve",
+	Summary: "Solve a file in a supervised background service",
+	Synopsis: []string{
+		"--input FILE [--key-file FILE] [--user] [--output FILE] [--name NAME] [--state-dir DIR] [--dry-run]",
+	},
+	Description: "Solve an encrypted file in a supervised background service\n" +
+		"Writes a systemd service (Linux) or launchd job (macOS) that runs decrypt at low\n" +
+		"priority with checkpoints and a status file, resumes after reboots, and stops for\n" +
+		"good once the output exists. It is enabled and started right away.",
+	Examples: []string{
+		"cryptotimed install-solve --input archive.tar.locked --user",
+		"cryptotimed install-solve --input will.pdf.locked --key-file /root/will.key",
+		"cryptotimed uninstall-solve --input archive.tar.locked --user",
+	},
+	run: runInstallSolve,
+}
+
+// InstallSolveCommand handles the install-solve subcommand
+func InstallSolveCommand(args []string) error {
+	return installSolveCommand.Run(args)
+}
+
+func runInstallSolve(c *Command, args []string) error {
+	fs := c.FlagSet()
+
+	var (
+		inputFile = fs.String("input", "", "Encrypted file to solve in the background (required)")
+		keyFile   = fs.String("key-file", "", "File holding the passphrase (required if the file was encrypted with a key)")
+		output    = fs.String("output", "", "Output file (default: removes .locked extension)")
+		user      = fs.Bool("user", false, "Install a per-user service instead of a system one")
+		name      = fs.String("name", "", "Service name (default: derived from the input path)")
+		stateDir  = fs.String("state-dir", "", "Directory for the checkpoint, status file and log (created private)")
+		interval  = fs.Duration("checkpoint-interval", defaultCheckpointInterval, "Save a checkpoint this often while solving")
+		dryRun    = fs.Bool("dry-run", false, "Print the service definition and commands without installing anything")
+	)
+
+	if _, err := c.Parse(fs, args); err != nil {
+		return err
+	}
+
+	// Validate required arguments
+	if *inputFile == "" {
+		fs.Usage()
+		return fmt.Errorf("--input is required")
+	}
+	if *interval <= 0 {
+		return fmt.Errorf("--checkpoint-interval must be positive")
+	}
+
+	plan, err := operations.PlanService(operations.ServiceOptions{
+		InputFile:          *inputFile,
+		KeyFile:            *keyFile,
+		OutputFile:         *output,
+		User:               *user,
+		Name:               *name,
+		StateDir:           *stateDir,
+		CheckpointInterval: *interval,
+	})
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		fmt.Fprintf(c.stdout, "Would write %s:\n\n%s\n", plan.UnitFile, plan.Unit)
+		fmt.Fprintf(c.stdout, "Would create %s (mode 0700) and run:\n", plan.StateDir)
+		for _, cmd := range plan.Enable {
+			fmt.Fprintf(c.stdout, "  %s\n", strings.Join(cmd, " "))
+		}
+		return nil
+	}
+
+	if err := operations.InstallService(plan, commandRunner(c.stdout, c.stderr)); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.stdout, "Installed and started %s\n", plan.Name)
+	fmt.Fprintf(c.stdout, "Service definition: %s\n", plan.UnitFile)
+	fmt.Fprintf(c.stdout, "State directory: %s\n", plan.StateDir)
+	fmt.Fprintf(c.stdout, "Output file: %s\n", plan.OutputFile)
+	fmt.Fprintf(c.stdout, "Follow progress with:\n")
+	for _, cmd := range plan.Follow {
+		fmt.Fprintf(c.stdout, "  %s\n", cmd)
+	}
+	if plan.Platform == "linux" && plan.User {
+		fmt.Fprintf(c.stdout, "To keep solving while logged out and resume at boot, run: loginctl enable-linger %s\n", os.Getenv("USER"))
+	}
+	fmt.Fprintf(c.stdout, "Remove it with: %s uninstall-solve --name %s%s\n", os.Args[0], plan.Name, userFlag(plan.User))
+	return nil
+}
+
+var uninstallSolveCommand = &Command{
+	Name:    "uninstall-solve",
+	Summary: "Remove a background solve service",
+	Synopsis: []string{
+		"--input FILE | --name NAME [--user] [--purge]",
+	},
+	Description: "Stop and remove a background solve installed with install-solve\n" +
+		"The checkpoint is kept unless --purge is given.",
+	run: runUninstallSolve,
+}
+
+// UninstallSolveCommand handles the uninstall-solve subcommand
+func UninstallSolveCommand(args []string) error {
+	return uninstallSolveCommand.Run(args)
+}
+
+func runUninstallSolve(c *Command, args []string) error {
+	fs := c.FlagSet()
+
+	var (
+		inputFile = fs.String("input", "", "Encrypted file the service was installed for")
+		name      = fs.String("name", "", "Service name (instead of --input)")
+		user      = fs.Bool("user", false, "The service is a per-user one")
+		stateDir  = fs.String("state-dir", "", "State directory, if it was given at install time")
+		purge     = fs.Bool("purge", false, "Also delete the state directory, including the checkpoint")
+	)
+
+	if _, err := c.Parse(fs, args); err != nil {
+		return err
+	}
+
+	// Validate required arguments
+	if (*inputFile == "") == (*name == "") {
+		fs.Usage()
+		return fmt.Errorf("exactly one of --input and --name is required")
+	}
+
+	opts := operations.ServiceOptions{Name: *name, User: *user, StateDir: *stateDir}
+	if *name == "" {
+		// Only the name derived from the input is needed
+		plan, err := operations.PlanService(operations.ServiceOptions{InputFile: *inputFile, User: *user})
+		if err != nil {
+			return err
+		}
+		opts.Name = plan.Name
+	}
+	plan, err := operations.PlanService(opts)
+	if err != nil {
+		return err
+	}
+
+	if err := operations.UninstallService(plan, commandRunner(c.stdout, c.stderr), *purge); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "Removed %s\n", plan.Name)
+	if *purge {
+		fmt.Fprintf(c.stdout, "Deleted state directory: %s\n", plan.StateDir)
+	} else {
+		fmt.Fprintf(c.stdout, "Checkpoint and status kept in: %s\n", plan.StateDir)
+	}
+	return nil
+}
+
+// commandRunner returns a CommandRunner that runs an external command with
+// its output going to stdout and stderr.
+func commandRunner(stdout, stderr io.Writer) operations.CommandRunner {
+	return func(name string, args ...string) error {
+		cmd := exec.Command(name, args...)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		return cmd.Run()
+	}
+}
+
+// userFlag returns " --user" for per-user services.
+func userFlag(user bool) string {
+	if user {
+		return " --user"
+	}
+	return ""
+}
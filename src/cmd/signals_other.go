@@ -0,0 +1,11 @@
+//go:build !unix
+
+package cmd
+
+import "os"
+
+// The status and checkpoint signals are Unix only.
+var (
+	statusSignals     []os.Signal
+	checkpointSignals []os.Signal
+)
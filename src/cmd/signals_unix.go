@@ -0,0 +1,14 @@
+//go:build unix
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+)
+
+// statusSignals ask a running solve to print a status line, like dd.
+var statusSignals = []os.Signal{syscall.SIGUSR1}
+
+// checkpointSignals ask a running solve to save a checkpoint now.
+var checkpointSignals = []os.Signal{syscall.SIGUSR2}
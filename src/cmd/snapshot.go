@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"time"
+
+	"cryptotimed/src/utils"
+)
+
+// checkpointClock remembers when progress was last saved, for status lines.
+type checkpointClock struct {
+	last atomic.Int64 // Unix nanoseconds, 0 if never
+}
+
+// saved records a checkpoint written at t.
+func (c *checkpointClock) saved(t time.Time) {
+	c.last.Store(t.UnixNano())
+}
+
+// time returns when the last checkpoint was saved (zero if never).
+func (c *checkpointClock) time() time.Time {
+	if ns := c.last.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// watchSnapshotSignals serves the signals that query a solve from outside
+// until the returned function is called: SIGUSR1 prints a status line to
+// stderr and SIGUSR2 saves a checkpoint without pausing through
+// checkpointNow (only when it is set).  Both are Unix only.  Signals arriving while one is being served
+// are merged into it, so repeated signals are harmless.
+func watchSnapshotSignals(stderr io.Writer, progressBar *utils.ProgressBar, checkpointNow func(), checkpoints *checkpointClock) func() {
+	if len(statusSignals) == 0 {
+		return func() {}
+	}
+	status := make(chan os.Signal, 1)
+	signal.Notify(status, statusSignals...)
+	checkpoint := make(chan os.Signal, 1)
+	if checkpointNow != nil {
+		signal.Notify(checkpoint, checkpointSignals...)
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-done:
+				return
+			case <-status:
+				var last time.Time
+				if checkpoints != nil {
+					last = checkpoints.time()
+				}
+				fmt.Fprintf(stderr, "cryptotimed: %s\n", progressBar.Info().Snapshot(last))
+			case <-checkpoint:
+				checkpointNow()
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(status)
+		signal.Stop(checkpoint)
+		close(done)
+		<-finished
+	}
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"cryptotimed/src/utils"
+)
+
+// statusWriteInterval limits how often progress rewrites the status file.
+const statusWriteInterval = time.Second
+
+// statusReporter keeps a --status-file up to date from the progress bar.  A
+// nil reporter does nothing, so callers need not check whether one is set.
+type statusReporter struct {
+	path   string
+	bar    *utils.ProgressBar
+	mu     sync.Mutex
+	status utils.SolveStatus
+	last   time.Time
+	failed bool // a write failed; the warning has been printed
+}
+
+// newStatusReporter returns a reporter writing to path, or nil if path is
+// empty.
+func newStatusReporter(path, input string, total uint64, bar *utils.ProgressBar) *statusReporter {
+	if path == "" {
+		return nil
+	}
+	now := time.Now()
+	return &statusReporter{
+		path: path,
+		bar:  bar,
+		status: utils.SolveStatus{
+			PID:       os.Getpid(),
+			InputFile: input,
+			State:     utils.StatusSolving,
+			Total:     total,
+			Started:   now,
+		},
+	}
+}
+
+// progress records solving progress, at most once per statusWriteInterval.
+func (r *statusReporter) progress() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.last) < statusWriteInterval {
+		return
+	}
+	r.writeLocked()
+}
+
+// update changes the state of the solve and writes it immediately.
+func (r *statusReporter) update(state string, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.State = state
+	if err != nil {
+		r.status.Error = err.Error()
+	}
+	r.writeLocked()
+}
+
+// set applies fn to the status and writes it immediately.
+func (r *statusReporter) set(fn func(s *utils.SolveStatus)) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&r.status)
+	r.writeLocked()
+}
+
+// writeLocked fills in the progress numbers and writes the file.  The caller
+// must hold r.mu.
+func (r *statusReporter) writeLocked() {
+	info := r.bar.Info()
+	s := &r.status
+	s.Done = info.Done
+	if s.State == utils.StatusDone {
+		s.Done = s.Total
+	}
+	s.Percent = 100
+	if s.Total > 0 {
+		s.Percent = float64(s.Done) / float64(s.Total) * 100
+	}
+	s.Rate = info.Rate
+	s.ETASeconds = info.ETA.Seconds()
+	s.Updated = time.Now()
+	r.last = s.Updated
+
+	if err := utils.WriteStatus(r.path, s); err != nil && !r.failed {
+		r.failed = true
+		r.bar.Printf("Warning: failed to write status file: %v", err)
+	}
+}
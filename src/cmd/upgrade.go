@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+var upgradeCommand = &Command{
+	Name:    "upgrade",
+	Summary: "Rewrite files of an old format version in the current format",
+	Synopsis: []string{
+		"--input FILE [FILE...] [--key KEY] [--dry-run] [--cache-target] [--yes] [--confirm-over DURATION] [--checkpoint-interval DURATION] [--pin-thread]",
+	},
+	Description: fmt.Sprintf("Rewrite encrypted files written before format version %d in the current format (version %d),\n", types.VersionMinReader, types.CurrentVersion) +
+		"replacing each only once its new version is complete.  The puzzle is kept: the same\n" +
+		"passphrase opens the file and it takes as long to solve as before.\n" +
+		"Version 2 files are upgraded at once.  Version 1 files seal their data under a key\n" +
+		"derived with the legacy SHA-256 derivation, so their puzzle is solved (or its solution\n" +
+		"taken from the target cache with --cache-target) and the data sealed anew.  An\n" +
+		"interrupted solve resumes from INPUT.resume.  Files already in the current layout are\n" +
+		"left alone.  Several files, glob patterns and directories (searched for .locked files)\n" +
+		"may be given.",
+	Examples: []string{
+		"cryptotimed upgrade --input old.txt.locked --dry-run",
+		"cryptotimed upgrade --input archive/ --cache-target",
+		`cryptotimed upgrade --input "*.locked" --key "passphrase"`,
+	},
+	run: runUpgrade,
+}
+
+// UpgradeCommand handles the upgrade subcommand
+func UpgradeCommand(args []string) error {
+	return upgradeCommand.Run(args)
+}
+
+func runUpgrade(c *Command, args []string) error {
+	fs := c.FlagSet()
+
+	var (
+		inputFile = fs.String("input", "", "Encrypted file, glob pattern or directory to upgrade (required)")
+		keyInput  = fs.String("key", "", "Passphrase or @file:path (required if the files were encrypted with key)")
+		dryRun    = fs.Bool("dry-run", false, "Report what would change without solving or writing anything")
+		pinThread = fs.Bool("pin-thread", false, "Lock the solver to one OS thread for a steadier squaring rate")
+		gcPercent = fs.Int("gogc", 0, "GOGC value while solving (0 = leave unchanged, -1 = disable GC)")
+		noCalib   = fs.Bool("no-calibrate", false, "Keep the solves' rates out of the calibration profile used for estimates")
+		redraw    = fs.Duration("progress-interval", utils.DefaultRedrawInterval, "Redraw the progress bar at least this often (0 = only on progress)")
+		cache     = fs.Bool("cache-target", false, "Reuse cached puzzle solutions and cache new ones (anyone who can read the cache can decrypt)")
+		interval  = fs.Duration("checkpoint-interval", defaultCheckpointInterval, "Save a checkpoint this often while solving (0 = only on request or quit)")
+		yes       = fs.Bool("yes", false, "Start solving without asking, however long it is estimated to take")
+		confirm   = fs.Duration("confirm-over", operations.DefaultConfirmOver, "Ask before starting solves estimated to take longer than this on this machine (0 = never ask)")
+	)
+
+	// Extra file arguments (e.g. from a shell glob) may come between the options
+	extra, err := c.Parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if *inputFile == "" {
+		fs.Usage()
+		return fmt.Errorf("--input is required")
+	}
+	if *interval < 0 {
+		return fmt.Errorf("--checkpoint-interval must not be negative")
+	}
+	if *confirm < 0 {
+		return fmt.Errorf("--confirm-over must not be negative")
+	}
+	inputs := append([]string{*inputFile}, extra...)
+	for _, input := range inputs {
+		if utils.IsURL(input) {
+			return fmt.Errorf("cannot upgrade %s: only local files can be upgraded", input)
+		}
+	}
+	items, err := operations.PlanBatch(inputs, "")
+	if err != nil {
+		return err
+	}
+
+	// Plan every upgrade first, so nothing is changed when a file cannot be
+	// read or upgraded
+	var plans []*operations.UpgradeResult
+	var headers []*types.FileHeader
+	var squarings uint64
+	for _, item := range items {
+		opts := operations.UpgradeOptions{DecryptOptions: operations.DecryptOptions{InputFile: item.InputFile}, DryRun: true}
+		plan, err := operations.UpgradeFile(opts, nil)
+		if err != nil {
+			return fmt.Errorf("%s: %v", item.InputFile, err)
+		}
+		plans = append(plans, plan)
+		if plan.Current {
+			fmt.Fprintf(c.stdout, "%s: already current (format version %d)\n", plan.InputFile, plan.FromVersion)
+			continue
+		}
+		fmt.Fprintf(c.stdout, "%s:\n", plan.InputFile)
+		for _, change := range plan.Changes {
+			fmt.Fprintf(c.stdout, "  %s\n", change)
+		}
+		if plan.NeedsSolve {
+			header, err := operations.ReadInputHeader(nil, plan.InputFile, 0)
+			if err != nil {
+				return fmt.Errorf("%s: %v", plan.InputFile, err)
+			}
+			headers = append(headers, header)
+			squarings += remainingSquarings(header, upgradeCheckpoint(plan.InputFile))
+		}
+	}
+	if *dryRun {
+		fmt.Fprintf(c.stdout, "Dry run: nothing was changed\n")
+		return nil
+	}
+
+	gate := operations.SolveGate{Threshold: *confirm, Yes: *yes, Prompt: terminalPrompt(c.stdout)}
+	if err := estimateSolve(c.stdout, headers, squarings, gate); err != nil {
+		return err
+	}
+
+	upgraded := 0
+	for _, plan := range plans {
+		if plan.Current {
+			continue
+		}
+		opts := operations.UpgradeOptions{DecryptOptions: operations.DecryptOptions{
+			InputFile:          plan.InputFile,
+			KeyInput:           *keyInput,
+			PinThread:          *pinThread,
+			GCPercent:          *gcPercent,
+			NoCalibrate:        *noCalib,
+			CacheTarget:        *cache,
+			CheckpointPath:     upgradeCheckpoint(plan.InputFile),
+			CheckpointInterval: *interval,
+		}}
+		result, err := upgradeOne(c.stdout, c.stderr, opts, plan, *redraw)
+		if err != nil {
+			if upgraded > 0 {
+				fmt.Fprintf(c.stdout, "Upgraded %d files before the failure\n", upgraded)
+			}
+			return fmt.Errorf("%s: %v", plan.InputFile, err)
+		}
+		for _, warning := range result.Warnings {
+			fmt.Fprintf(c.stdout, "Warning: %s\n", warning)
+		}
+		fmt.Fprintf(c.stdout, "Upgraded %s to format version %d (%d bytes)\n", result.InputFile, result.ToVersion, result.EncryptedSize)
+		upgraded++
+	}
+	fmt.Fprintf(c.stdout, "Upgraded %d of %d files\n", upgraded, len(plans))
+	return nil
+}
+
+// upgradeCheckpoint returns where the solve of input's puzzle is saved: the
+// checkpoint decrypt would use, so either command resumes the other's solve.
+func upgradeCheckpoint(input string) string {
+	return operations.InputName(input) + ".resume"
+}
+
+// upgradeOne upgrades the file plan describes, with a progress bar and
+// checkpoints when its puzzle has to be solved.
+func upgradeOne(w, stderr io.Writer, opts operations.UpgradeOptions, plan *operations.UpgradeResult, redraw time.Duration) (*operations.UpgradeResult, error) {
+	if !plan.NeedsSolve {
+		return operations.UpgradeFile(opts, nil)
+	}
+
+	header, err := operations.ReadInputHeader(nil, opts.InputFile, 0)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(w, "Solving the puzzle of %s (%d sequential squarings)...\n", opts.InputFile, header.WorkFactor)
+	progressBar := utils.NewProgressBar(header.WorkFactor)
+	progressBar.SetOutput(w)
+	progressBar.StartTicker(redraw)
+
+	checkpoints := &checkpointClock{}
+	opts.OnResume = func(done uint64) {
+		if info, err := os.Stat(opts.CheckpointPath); err == nil {
+			checkpoints.saved(info.ModTime())
+		}
+		progressBar.SetBaseline(done)
+		progressBar.Printf("Resuming from checkpoint %s (%d of %d squarings done)", opts.CheckpointPath, done, header.WorkFactor)
+	}
+	opts.OnCheckpoint = func(state crypto.SolvingState, err error) {
+		if err != nil {
+			progressBar.Printf("Warning: failed to save checkpoint: %v", err)
+			return
+		}
+		checkpoints.saved(time.Now())
+		progressBar.Printf("Checkpoint saved: %s (%d squarings done)", opts.CheckpointPath, state.Done)
+	}
+
+	// Signals stop the solve with a checkpoint
+	opts.Control = &crypto.SolveControl{}
+	controls := watchControls(stderr, nil, opts.Control, opts.Control.RequestCheckpoint, progressBar, nil, checkpoints)
+	opts.Context = controls.ctx
+	result, err := operations.UpgradeFile(opts, progressBar.Update)
+	controls.stop()
+	if err != nil {
+		progressBar.StopTicker()
+		if errors.Is(err, crypto.ErrSolveStopped) {
+			fmt.Fprintf(w, "\nStopped: %v\n", err)
+			fmt.Fprintf(w, "Run the same command again to resume; the file was not changed.\n")
+			return nil, fmt.Errorf("interrupted")
+		}
+		return nil, err
+	}
+	progressBar.Finish()
+	if result.FromCache {
+		fmt.Fprintf(w, "Puzzle solution loaded from cache (no solving needed)\n")
+	}
+	return result, nil
+}
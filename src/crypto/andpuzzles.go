@@ -0,0 +1,18 @@
+package crypto
+
+// andpuzzles.go holds the key schedule for files of several puzzles that
+// must all be solved.  Each puzzle's solution yields a key as usual; the
+// file's puzzle key is their XOR, so every solution short of the last
+// leaves it uniformly random and nothing is learnt until all are solved.
+
+// CombinePuzzleKeys returns the puzzle key of a file of several puzzles
+// from the keys of each of them, in any order.
+func CombinePuzzleKeys(keys ...[32]byte) [32]byte {
+	var combined [32]byte
+	for _, key := range keys {
+		for i := range combined {
+			combined[i] ^= key[i]
+		}
+	}
+	return combined
+}
@@ -0,0 +1,34 @@
+package crypto
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestCombinePuzzleKeys(t *testing.T) {
+	var keys [][32]byte
+	for i := int64(1); i <= 3; i++ {
+		keys = append(keys, DerivePuzzleKey(big.NewInt(1000+i), testModulus))
+	}
+	combined := CombinePuzzleKeys(keys...)
+
+	if got := CombinePuzzleKeys(keys[2], keys[0], keys[1]); got != combined {
+		t.Error("combining in another order gave another key")
+	}
+	if CombinePuzzleKeys(keys[0]) != keys[0] {
+		t.Error("the key of a single puzzle is not its own")
+	}
+
+	// Every solution is needed: no proper subset gives the key
+	for _, subset := range [][][32]byte{{keys[0]}, {keys[0], keys[1]}, {keys[1], keys[2]}, {keys[0], keys[2]}} {
+		if CombinePuzzleKeys(subset...) == combined {
+			t.Errorf("%d of %d keys gave the combined key", len(subset), len(keys))
+		}
+	}
+	// A wrong solution for any one puzzle gives another key
+	wrong := append([][32]byte{}, keys...)
+	wrong[1] = DerivePuzzleKey(big.NewInt(999), testModulus)
+	if CombinePuzzleKeys(wrong...) == combined {
+		t.Error("a wrong solution gave the combined key")
+	}
+}
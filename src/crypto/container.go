@@ -0,0 +1,52 @@
+package crypto
+
+// container.go holds the key schedule for multi-file containers.  Every entry
+// is sealed independently under its own subkey, derived from the puzzle key
+// and the entry's index, so that any single entry can be opened without
+// touching the others.  The (optional) encrypted entry table has a subkey of
+// its own.
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// containerEntryLabel prefixes the HKDF info string of entry subkeys.
+	containerEntryLabel = "cryptotimed container entry v1"
+
+	// containerTableLabel is the HKDF info string of the entry-table subkey.
+	containerTableLabel = "cryptotimed container table v1"
+)
+
+// DeriveEntryKey derives the subkey that seals container entry index.
+func DeriveEntryKey(key [32]byte, index uint64) ([32]byte, error) {
+	info := binary.BigEndian.AppendUint64([]byte(containerEntryLabel), index)
+	return deriveSubkey(key, info)
+}
+
+// DeriveTableKey derives the subkey that seals a private entry table.
+func DeriveTableKey(key [32]byte) ([32]byte, error) {
+	return deriveSubkey(key, []byte(containerTableLabel))
+}
+
+// EntryTableDigest returns the associated data that binds every sealed
+// entry to the encoded entry table, so a modified table (renamed entries,
+// changed sizes or offsets) makes the entries fail to open.
+func EntryTableDigest(table []byte) []byte {
+	sum := sha256.Sum256(table)
+	return sum[:]
+}
+
+// deriveSubkey expands key with HKDF-SHA256 under the given info string.
+func deriveSubkey(key [32]byte, info []byte) ([32]byte, error) {
+	var sub [32]byte
+	kdf := hkdf.Expand(sha256.New, key[:], info)
+	if _, err := io.ReadFull(kdf, sub[:]); err != nil {
+		return sub, err
+	}
+	return sub, nil
+}
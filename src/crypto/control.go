@@ -0,0 +1,206 @@
+package crypto
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Request flags polled by the solving loop.
+const (
+	ctlPause uint32 = 1 << iota
+	ctlCheckpoint
+	ctlStop
+)
+
+// SolveControl lets other goroutines pause, resume, checkpoint and stop a
+// running SolvePuzzleWithOptions.  The solver polls it every few hundred
+// squarings with a single atomic load, so an idle control costs nothing
+// measurable.  The zero value is ready to use; a control drives one solve.
+type SolveControl struct {
+	flags atomic.Uint32
+
+	mu        sync.Mutex
+	wake      chan struct{} // closed when a pause ends
+	pausedAt  time.Time
+	pausedFor time.Duration
+}
+
+// Pause suspends the solve at its next poll.  Pausing twice is a no-op.
+func (c *SolveControl) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.flags.Load()&ctlPause != 0 {
+		return
+	}
+	c.wake = make(chan struct{})
+	c.pausedAt = time.Now()
+	c.flags.Store(c.flags.Load() | ctlPause)
+}
+
+// Resume continues a paused solve.
+func (c *SolveControl) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resumeLocked()
+}
+
+func (c *SolveControl) resumeLocked() {
+	if c.flags.Load()&ctlPause == 0 {
+		return
+	}
+	c.pausedFor += time.Since(c.pausedAt)
+	c.flags.Store(c.flags.Load() &^ ctlPause)
+	close(c.wake)
+}
+
+// TogglePause pauses a running solve or resumes a paused one, and reports
+// whether the solve is now paused.
+func (c *SolveControl) TogglePause() bool {
+	if c.Paused() {
+		c.Resume()
+		return false
+	}
+	c.Pause()
+	return true
+}
+
+// Paused reports whether the solve is paused.
+func (c *SolveControl) Paused() bool {
+	return c.flags.Load()&ctlPause != 0
+}
+
+// PausedFor returns the total time spent paused, including a pause in
+// progress, so rates and estimates can leave it out.
+func (c *SolveControl) PausedFor() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d := c.pausedFor
+	if c.flags.Load()&ctlPause != 0 {
+		d += time.Since(c.pausedAt)
+	}
+	return d
+}
+
+// RequestCheckpoint asks the solver to deliver a checkpoint at its next poll.
+func (c *SolveControl) RequestCheckpoint() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flags.Store(c.flags.Load() | ctlCheckpoint)
+}
+
+// Stop makes the solver deliver a final checkpoint and return
+// ErrSolveStopped.  It also ends a pause.
+func (c *SolveControl) Stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flags.Store(c.flags.Load() | ctlStop)
+	c.resumeLocked()
+}
+
+// StopWhenDone stops the solve once ctx is done, e.g. cancelled by the
+// daemon or user interface running it.  The returned function stops
+// watching ctx and reports whether ctx had already stopped the solve.
+func (c *SolveControl) StopWhenDone(ctx context.Context) (cancel func() bool) {
+	stop := context.AfterFunc(ctx, c.Stop)
+	return func() bool {
+		return !stop() && ctx.Err() != nil
+	}
+}
+
+// StopAfter stops the solve once it has run for d from now, not counting
+// the time it spends paused.  The returned function cancels the deadline
+// and reports whether it had already stopped the solve.
+func (c *SolveControl) StopAfter(d time.Duration) (cancel func() bool) {
+	start := time.Now()
+	paused := c.PausedFor()
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	var fired atomic.Bool
+
+	go func() {
+		defer close(finished)
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-timer.C:
+			}
+			// Time spent paused since the start does not count
+			left := d - (time.Since(start) - (c.PausedFor() - paused))
+			if left <= 0 {
+				fired.Store(true)
+				c.Stop()
+				return
+			}
+			timer.Reset(left)
+		}
+	}()
+
+	var once sync.Once
+	return func() bool {
+		once.Do(func() { close(done) })
+		<-finished
+		return fired.Load()
+	}
+}
+
+// pending reports whether any request is waiting for the solver.
+func (c *SolveControl) pending() bool {
+	return c.flags.Load() != 0
+}
+
+// handle serves the pending requests on the solving goroutine, with result
+// being the value after done squarings.  It blocks while paused and reports
+// whether the solve must stop.
+func (c *SolveControl) handle(p Puzzle, result *big.Int, done uint64, checkpoints chan<- SolvingState) bool {
+	for {
+		flags := c.flags.Load()
+		switch {
+		case flags&ctlStop != 0:
+			if checkpoints != nil {
+				checkpoints <- snapshot(p, result, done)
+			}
+			return true
+
+		case flags&ctlCheckpoint != 0:
+			// Only the solver sends, so an empty channel has room.  If the
+			// previous checkpoint is still queued, try again at the next poll.
+			if checkpoints != nil && len(checkpoints) > 0 {
+				return false
+			}
+			if checkpoints != nil {
+				checkpoints <- snapshot(p, result, done)
+			}
+			c.mu.Lock()
+			c.flags.Store(c.flags.Load() &^ ctlCheckpoint)
+			c.mu.Unlock()
+
+		case flags&ctlPause != 0:
+			c.mu.Lock()
+			wake := c.wake
+			c.mu.Unlock()
+			if wake != nil {
+				<-wake
+			}
+
+		default:
+			return false
+		}
+	}
+}
+
+// snapshot copies the state of a solve for a checkpoint or a snapshot.
+func snapshot(p Puzzle, result *big.Int, done uint64) SolvingState {
+	p.Target = nil
+	return SolvingState{
+		Puzzle:  p,
+		Result:  new(big.Int).Set(result),
+		Done:    done,
+		Updated: time.Now(),
+	}
+}
@@ -7,12 +7,29 @@ import (
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
+// DataNonceSize is the length of the random nonce that starts a ciphertext
+// of EncryptData.
+const DataNonceSize = chacha20poly1305.NonceSize
+
+// DataOverhead is the number of bytes EncryptData adds to a plaintext: the
+// random nonce followed by the Poly1305 authentication tag.  An empty
+// plaintext encrypts to exactly DataOverhead bytes.
+const DataOverhead = DataNonceSize + chacha20poly1305.Overhead
+
 // Note: DeriveFinalKey removed - we now use DerivePuzzleKey directly since
 // password is integrated into the puzzle itself
 
 // EncryptData encrypts plaintext using ChaCha20-Poly1305 with the given key.
-// Returns ciphertext (including authentication tag).
+// Returns ciphertext (including authentication tag).  An empty plaintext is
+// valid and produces a ciphertext of exactly DataOverhead bytes.
 func EncryptData(key [32]byte, plaintext []byte) ([]byte, error) {
+	return EncryptDataWithAD(key, plaintext, nil)
+}
+
+// EncryptDataWithAD is EncryptData with additional authenticated data: ad is
+// not stored in the ciphertext but must be passed unchanged to
+// DecryptDataWithAD.
+func EncryptDataWithAD(key [32]byte, plaintext, ad []byte) ([]byte, error) {
 	aead, err := chacha20poly1305.New(key[:])
 	if err != nil {
 		return nil, err
@@ -25,26 +42,33 @@ func EncryptData(key [32]byte, plaintext []byte) ([]byte, error) {
 	}
 
 	// Encrypt and authenticate
-	ciphertext := aead.Seal(nonce, nonce, plaintext, nil)
+	ciphertext := aead.Seal(nonce, nonce, plaintext, ad)
 	return ciphertext, nil
 }
 
 // DecryptData decrypts ciphertext using ChaCha20-Poly1305 with the given key.
-// The ciphertext should include the nonce at the beginning.
+// The ciphertext should include the nonce at the beginning.  A ciphertext of
+// exactly DataOverhead bytes decrypts to an empty plaintext.
 func DecryptData(key [32]byte, ciphertext []byte) ([]byte, error) {
+	return DecryptDataWithAD(key, ciphertext, nil)
+}
+
+// DecryptDataWithAD reverses EncryptDataWithAD; it fails unless ad matches
+// the value used for encryption.
+func DecryptDataWithAD(key [32]byte, ciphertext, ad []byte) ([]byte, error) {
 	aead, err := chacha20poly1305.New(key[:])
 	if err != nil {
 		return nil, err
 	}
 
-	if len(ciphertext) < aead.NonceSize() {
+	if len(ciphertext) < aead.NonceSize()+aead.Overhead() {
 		return nil, errors.New("ciphertext too short")
 	}
 
 	nonce := ciphertext[:aead.NonceSize()]
 	ciphertext = ciphertext[aead.NonceSize():]
 
-	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	plaintext, err := aead.Open(nil, nonce, ciphertext, ad)
 	if err != nil {
 		return nil, err
 	}
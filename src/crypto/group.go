@@ -0,0 +1,18 @@
+package crypto
+
+// group.go holds the key schedule for shared puzzle groups.  Every file of a
+// group carries the same puzzle, so one solve yields the puzzle key of all
+// of them; each file's data is then sealed under a subkey bound to its own
+// header, so no two members share a data key.
+
+import "crypto/sha256"
+
+// groupMemberLabel prefixes the HKDF info string of group member subkeys.
+const groupMemberLabel = "cryptotimed shared puzzle member v1"
+
+// DeriveMemberKey derives the data key of a shared puzzle group member from
+// the group's puzzle key and the SHA-256 fingerprint of the member's header.
+func DeriveMemberKey(key [32]byte, headerFingerprint [sha256.Size]byte) ([32]byte, error) {
+	info := append([]byte(groupMemberLabel), headerFingerprint[:]...)
+	return deriveSubkey(key, info)
+}
@@ -0,0 +1,76 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/sha3"
+)
+
+// keyHash is a hash the puzzle key can be derived with.  Each has its own
+// key-derivation version, which the file header records, so a file is
+// always decrypted with the hash it was encrypted with.
+type keyHash struct {
+	name    string // as given to encrypt --key-hash
+	display string // as shown by check
+	label   string // HKDF info string
+	new     func() hash.Hash
+}
+
+// keyHashes lists the hashes of the HKDF key derivations by version, which
+// are registered as built-in key derivations.  A new hash gets a new version
+// here; existing entries never change.
+var keyHashes = map[uint8]keyHash{
+	KeyDerivationHKDFv1:      {"sha256", "SHA256", hkdfV1Label, sha256.New},
+	KeyDerivationHKDFBLAKE2b: {"blake2b", "BLAKE2b-256", "cryptotimed puzzle key v2 blake2b-256", newBLAKE2b256},
+	KeyDerivationHKDFSHA3:    {"sha3", "SHA3-256", "cryptotimed puzzle key v3 sha3-256", sha3.New256},
+}
+
+// newBLAKE2b256 returns an unkeyed BLAKE2b-256, which cannot fail.
+func newBLAKE2b256() hash.Hash {
+	h, _ := blake2b.New256(nil)
+	return h
+}
+
+// hkdfDerive returns the derivation running HKDF over h.
+func hkdfDerive(h keyHash) DeriveFunc {
+	return func(secret, _ []byte) ([32]byte, error) {
+		var key [32]byte
+		kdf := hkdf.New(h.new, secret, nil, []byte(h.label))
+		if _, err := io.ReadFull(kdf, key[:]); err != nil {
+			return key, err
+		}
+		return key, nil
+	}
+}
+
+// KeyDerivationForHash returns the key-derivation version that hashes with
+// name ("sha256", "blake2b" or "sha3", or one registered with RegisterKDF;
+// see KeyHashNames).  An empty name is CurrentKeyDerivation.
+func KeyDerivationForHash(name string) (uint8, error) {
+	if name == "" {
+		return CurrentKeyDerivation, nil
+	}
+	for _, k := range KDFs() {
+		if k.Name == strings.ToLower(name) {
+			return k.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown key-derivation hash %q (known: %s)", name, strings.Join(KeyHashNames(), ", "))
+}
+
+// KeyHashNames returns the names KeyDerivationForHash accepts, in version
+// order.
+func KeyHashNames() []string {
+	list := KDFs()
+	names := make([]string, len(list))
+	for i, k := range list {
+		names[i] = k.Name
+	}
+	return names
+}
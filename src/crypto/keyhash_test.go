@@ -0,0 +1,87 @@
+package crypto
+
+import (
+	"io"
+	"math/big"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/sha3"
+)
+
+// TestKeyHashes checks that every key-derivation hash derives deterministic
+// keys, distinct from each other's, with the hash it names.
+func TestKeyHashes(t *testing.T) {
+	target := new(big.Int).Lsh(big.NewInt(0xC0FFEE), 1000)
+	secret := target.FillBytes(make([]byte, ModulusBytes(testModulus)))
+
+	seen := map[[32]byte]string{}
+	for _, name := range KeyHashNames() {
+		version, err := KeyDerivationForHash(name)
+		if err != nil {
+			t.Fatalf("KeyDerivationForHash(%q) failed: %v", name, err)
+		}
+		if err := CheckKeyDerivationVersion(version); err != nil {
+			t.Fatalf("version %d of %s rejected: %v", version, name, err)
+		}
+		a, err := DerivePuzzleKeyVersion(target, testModulus, version)
+		if err != nil {
+			t.Fatalf("%s: derivation failed: %v", name, err)
+		}
+		b, _ := DerivePuzzleKeyVersion(new(big.Int).Set(target), testModulus, version)
+		if a != b {
+			t.Errorf("%s: derivation is not deterministic", name)
+		}
+		if other, ok := seen[a]; ok {
+			t.Errorf("%s derives the same key as %s", name, other)
+		}
+		seen[a] = name
+	}
+	legacy := DerivePuzzleKey(target, testModulus)
+	if other, ok := seen[legacy]; ok {
+		t.Errorf("%s derives the legacy key", other)
+	}
+
+	// Each runs HKDF with the hash it names
+	for version, h := range map[uint8]func() []byte{
+		KeyDerivationHKDFBLAKE2b: func() []byte {
+			key := make([]byte, 32)
+			io.ReadFull(hkdf.New(newBLAKE2b256, secret, nil, []byte("cryptotimed puzzle key v2 blake2b-256")), key)
+			return key
+		},
+		KeyDerivationHKDFSHA3: func() []byte {
+			key := make([]byte, 32)
+			io.ReadFull(hkdf.New(sha3.New256, secret, nil, []byte("cryptotimed puzzle key v3 sha3-256")), key)
+			return key
+		},
+	} {
+		got, _ := DerivePuzzleKeyVersion(target, testModulus, version)
+		if want := h(); string(got[:]) != string(want) {
+			t.Errorf("version %d: got %x, want %x", version, got, want)
+		}
+	}
+	if newBLAKE2b256().Size() != blake2b.Size256 {
+		t.Errorf("BLAKE2b output is not 256 bits")
+	}
+
+	if v, err := KeyDerivationForHash(""); err != nil || v != CurrentKeyDerivation {
+		t.Errorf("default hash = %d (%v), want %d", v, err, CurrentKeyDerivation)
+	}
+	if v, err := KeyDerivationForHash("SHA3"); err != nil || v != KeyDerivationHKDFSHA3 {
+		t.Errorf("names are not case-insensitive: %d (%v)", v, err)
+	}
+	for _, name := range []string{"md5", "sha512", "blake2s"} {
+		if _, err := KeyDerivationForHash(name); err == nil {
+			t.Errorf("KeyDerivationForHash(%q) accepted an unknown hash", name)
+		}
+	}
+	for _, version := range []uint8{4, 0x7F, 0xFF} {
+		if _, err := DerivePuzzleKeyVersion(target, testModulus, version); err == nil {
+			t.Errorf("derived a key with unknown version %d", version)
+		}
+		if err := CheckKeyDerivationVersion(version); err == nil {
+			t.Errorf("CheckKeyDerivationVersion accepted unknown version %d", version)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build notrapdoor
+
+package crypto
+
+// trapdoorDisabled forces GeneratePuzzle to compute targets by sequential
+// squaring.  This is an audited build: φ(N) is never computed.
+const trapdoorDisabled = true
@@ -1,6 +1,8 @@
 package crypto
 
 import (
+	"math/big"
+	"strings"
 	"testing"
 )
 
@@ -10,7 +12,7 @@ func TestPasswordIntegratedPuzzle(t *testing.T) {
 	password := []byte("test password 123")
 
 	// Generate puzzle with password
-	puzzle1, _, err := GeneratePuzzle(squarings, password)
+	puzzle1, _, err := GeneratePuzzle(squarings, password, DefaultModulusBits)
 	if err != nil {
 		t.Fatalf("GeneratePuzzle with password failed: %v", err)
 	}
@@ -24,7 +26,7 @@ func TestPasswordIntegratedPuzzle(t *testing.T) {
 	}
 
 	// Generate another puzzle with same password - should have different salt but same G when derived
-	puzzle2, _, err := GeneratePuzzle(squarings, password)
+	puzzle2, _, err := GeneratePuzzle(squarings, password, DefaultModulusBits)
 	if err != nil {
 		t.Fatalf("Second GeneratePuzzle with password failed: %v", err)
 	}
@@ -54,7 +56,7 @@ func TestPasswordIntegratedPuzzle(t *testing.T) {
 	}
 
 	// Solve puzzle with correct password-derived G
-	target1 := SolvePuzzle(puzzle1, nil)
+	target1 := solve(t, puzzle1)
 	if target1.Cmp(puzzle1.Target) != 0 {
 		t.Error("SolvePuzzle should produce correct target")
 	}
@@ -62,7 +64,7 @@ func TestPasswordIntegratedPuzzle(t *testing.T) {
 	// Create puzzle with wrong G and solve - should get different target
 	puzzleWrongG := puzzle1
 	puzzleWrongG.G = derivedGWrong
-	targetWrong := SolvePuzzle(puzzleWrongG, nil)
+	targetWrong := solve(t, puzzleWrongG)
 	if targetWrong.Cmp(puzzle1.Target) == 0 {
 		t.Error("Wrong G should produce different target")
 	}
@@ -73,14 +75,14 @@ func TestPasswordVsNonPasswordPuzzles(t *testing.T) {
 	const squarings = 5
 
 	// Generate puzzle without password (legacy mode)
-	puzzleNoPassword, _, err := GeneratePuzzle(squarings, nil)
+	puzzleNoPassword, _, err := GeneratePuzzle(squarings, nil, DefaultModulusBits)
 	if err != nil {
 		t.Fatalf("GeneratePuzzle without password failed: %v", err)
 	}
 
 	// Generate puzzle with password
 	password := []byte("test password")
-	puzzleWithPassword, _, err := GeneratePuzzle(squarings, password)
+	puzzleWithPassword, _, err := GeneratePuzzle(squarings, password, DefaultModulusBits)
 	if err != nil {
 		t.Fatalf("GeneratePuzzle with password failed: %v", err)
 	}
@@ -107,12 +109,12 @@ func TestPasswordVsNonPasswordPuzzles(t *testing.T) {
 	}
 
 	// Both puzzles should solve correctly
-	target1 := SolvePuzzle(puzzleNoPassword, nil)
+	target1 := solve(t, puzzleNoPassword)
 	if target1.Cmp(puzzleNoPassword.Target) != 0 {
 		t.Error("Non-password puzzle should solve correctly")
 	}
 
-	target2 := SolvePuzzle(puzzleWithPassword, nil)
+	target2 := solve(t, puzzleWithPassword)
 	if target2.Cmp(puzzleWithPassword.Target) != 0 {
 		t.Error("Password puzzle should solve correctly")
 	}
@@ -125,7 +127,7 @@ func TestPasswordDeterminism(t *testing.T) {
 	params := DefaultArgon2idParams
 
 	// Generate a test modulus
-	puzzle, _, err := GeneratePuzzle(1, nil)
+	puzzle, _, err := GeneratePuzzle(1, nil, DefaultModulusBits)
 	if err != nil {
 		t.Fatalf("Failed to generate test puzzle: %v", err)
 	}
@@ -172,3 +174,160 @@ func TestPasswordDeterminism(t *testing.T) {
 		t.Error("Different salts should produce different G values")
 	}
 }
+
+// TestBaseTweak tests that a file ID changes the password base, as does the
+// work factor it is mixed with, and that generated puzzles solve to the base
+// DerivePuzzleBase recreates
+func TestBaseTweak(t *testing.T) {
+	password := []byte("same passphrase")
+	puzzle, _, err := GeneratePuzzleWithOptions(20, password, GenerateOptions{BaseTweak: true})
+	if err != nil {
+		t.Fatalf("GeneratePuzzleWithOptions failed: %v", err)
+	}
+	if puzzle.FileID == nil {
+		t.Fatal("no file ID drawn")
+	}
+	g, err := DerivePuzzleBase(password, puzzle)
+	if err != nil {
+		t.Fatalf("DerivePuzzleBase failed: %v", err)
+	}
+	if g.Cmp(puzzle.G) != 0 {
+		t.Error("DerivePuzzleBase does not recreate the generated base")
+	}
+	if solve(t, puzzle).Cmp(puzzle.Target) != 0 {
+		t.Error("target does not match the solution")
+	}
+
+	untweaked, err := DeriveBaseFromPassword(password, puzzle.Salt, puzzle.KdfParams, puzzle.N)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherID := puzzle
+	otherID.FileID = &[FileIDSize]byte{1}
+	otherT := puzzle
+	otherT.T++
+	for name, p := range map[string]Puzzle{"another file ID": otherID, "another work factor": otherT} {
+		other, err := DerivePuzzleBase(password, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other.Cmp(g) == 0 || other.Cmp(untweaked) == 0 {
+			t.Errorf("%s derives the same base", name)
+		}
+	}
+	if untweaked.Cmp(g) == 0 {
+		t.Error("the file ID does not change the base")
+	}
+
+	// Without a file ID the derivation is the one files always had
+	puzzle.FileID = nil
+	if g, err := DerivePuzzleBase(password, puzzle); err != nil || g.Cmp(untweaked) != 0 {
+		t.Errorf("DerivePuzzleBase without a file ID = %v, %v; want the untweaked base", g, err)
+	}
+	if p, _, err := GeneratePuzzleWithOptions(1, nil, GenerateOptions{BaseTweak: true}); err != nil || p.FileID != nil {
+		t.Errorf("puzzle without a password: file ID %v, %v", p.FileID, err)
+	}
+}
+
+// TestPasswordZeroKdfParams tests that zeroed KDF parameters are reported
+// as corrupt instead of panicking inside Argon2id
+func TestPasswordZeroKdfParams(t *testing.T) {
+	puzzle, _, err := GeneratePuzzle(1, nil, DefaultModulusBits)
+	if err != nil {
+		t.Fatalf("Failed to generate test puzzle: %v", err)
+	}
+
+	for _, params := range []Argon2idParams{
+		{},
+		{Memory: 64 * 1024, Parallelism: 1, KeyLen: 32},
+		{Time: 3, Parallelism: 1, KeyLen: 32},
+		{Memory: 64 * 1024, Time: 3, KeyLen: 32},
+	} {
+		_, err := DeriveBaseFromPassword([]byte("password"), [16]byte{}, params, puzzle.N)
+		if err == nil || !strings.Contains(err.Error(), "corrupt KDF parameters") {
+			t.Errorf("DeriveBaseFromPassword(%+v) = %v, want a corrupt KDF parameters error", params, err)
+		}
+	}
+}
+
+// TestPasswordWeakKdfParams tests that a password puzzle is not generated
+// with KDF parameters below the minimums
+func TestPasswordWeakKdfParams(t *testing.T) {
+	for _, params := range []Argon2idParams{
+		{},
+		{Memory: MinArgon2idMemory - 1, Time: 3, Parallelism: 1, KeyLen: 32},
+		{Memory: 1, Time: 1, Parallelism: 1, KeyLen: 32},
+		{Memory: 64 * 1024, Parallelism: 1, KeyLen: 32},
+	} {
+		_, _, err := GeneratePuzzleWithOptions(1, []byte("password"), GenerateOptions{KdfParams: &params})
+		if err == nil {
+			t.Errorf("GeneratePuzzleWithOptions(%+v) succeeded, want an error", params)
+		}
+	}
+
+	// Without a password the KDF is not used, so its parameters do not matter
+	if _, _, err := GeneratePuzzleWithOptions(1, nil, GenerateOptions{KdfParams: &Argon2idParams{}}); err != nil {
+		t.Errorf("GeneratePuzzleWithOptions without a password failed: %v", err)
+	}
+
+	// The minimums themselves are accepted, and used
+	params := Argon2idParams{Memory: MinArgon2idMemory, Time: MinArgon2idTime, Parallelism: 1, KeyLen: 32}
+	puzzle, _, err := GeneratePuzzleWithOptions(1, []byte("password"), GenerateOptions{KdfParams: &params})
+	if err != nil {
+		t.Fatalf("GeneratePuzzleWithOptions(%+v) failed: %v", params, err)
+	}
+	if puzzle.KdfParams != params {
+		t.Errorf("puzzle KDF parameters = %+v, want %+v", puzzle.KdfParams, params)
+	}
+	g, err := DeriveBaseFromPassword([]byte("password"), puzzle.Salt, params, puzzle.N)
+	if err != nil || g.Cmp(puzzle.G) != 0 {
+		t.Errorf("base not derived with the given parameters (%v)", err)
+	}
+	if err := DefaultArgon2idParams.CheckStrength(); err != nil {
+		t.Errorf("default parameters are too weak: %v", err)
+	}
+}
+
+// TestSelectBaseMatchesResample tests that the fixed-iteration base selection
+// picks the same coprime G as the variable-time re-sampling loop
+func TestSelectBaseMatchesResample(t *testing.T) {
+	one := big.NewInt(1)
+	// 143 = 11*13 has short runs of non-coprime values; 210 = 2*3*5*7 has
+	// runs longer than baseCandidates (2..10), exercising the fallback.
+	for _, n := range []int64{143, 210} {
+		N := big.NewInt(n)
+		for g0 := int64(2); g0 <= n-2; g0++ {
+			got := selectBase(big.NewInt(g0), N)
+			want := resampleBase(big.NewInt(g0), N)
+			if got.Cmp(want) != 0 {
+				t.Fatalf("N=%d g0=%d: selectBase = %v, resampleBase = %v", n, g0, got, want)
+			}
+			if new(big.Int).GCD(nil, nil, got, N).Cmp(one) != 0 {
+				t.Fatalf("N=%d g0=%d: G = %v is not coprime to N", n, g0, got)
+			}
+			if got.Cmp(big.NewInt(2)) < 0 || got.Cmp(big.NewInt(n-2)) > 0 {
+				t.Fatalf("N=%d g0=%d: G = %v is outside [2, N-2]", n, g0, got)
+			}
+		}
+	}
+
+	puzzle, _, err := GeneratePuzzle(1, nil, DefaultModulusBits)
+	if err != nil {
+		t.Fatalf("Failed to generate test puzzle: %v", err)
+	}
+	password, salt := []byte("constant time"), [16]byte{7}
+	g, err := DeriveBaseFromPassword(password, salt, DefaultArgon2idParams, puzzle.N)
+	if err != nil {
+		t.Fatalf("DeriveBaseFromPassword failed: %v", err)
+	}
+	if new(big.Int).GCD(nil, nil, g, puzzle.N).Cmp(one) != 0 {
+		t.Error("Derived G is not coprime to N")
+	}
+	g0, err := passwordSeed(password, salt, nil, DefaultArgon2idParams, puzzle.N)
+	if err != nil {
+		t.Fatalf("passwordSeed failed: %v", err)
+	}
+	if resampleBase(g0, puzzle.N).Cmp(g) != 0 {
+		t.Error("Derived G differs from the variable-time result")
+	}
+}
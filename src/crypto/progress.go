@@ -0,0 +1,46 @@
+package crypto
+
+import "time"
+
+// ProgressStrategy decides how often a solve reports progress.  The solve
+// loop consults it every 256 squarings, so reports come no more often than
+// that, and implementations must be cheap and must not allocate.  A
+// FixedStep is the exception: the loop counts its steps itself and reports
+// at every one without consulting it.  The final report (T squarings) is
+// always made, whatever the strategy says.
+type ProgressStrategy interface {
+	// ShouldReport reports whether progress should be reported now, with
+	// done of total squarings performed and since elapsed since the last
+	// report (or the start of the solve).
+	ShouldReport(done, total uint64, since time.Duration) bool
+}
+
+// DefaultProgressStrategy is used when SolveOptions.ProgressStrategy is nil.
+var DefaultProgressStrategy ProgressStrategy = FixedStep(progressStep)
+
+// FixedStep reports every that many squarings (every squaring if zero).
+type FixedStep uint64
+
+// ShouldReport implements ProgressStrategy.
+func (s FixedStep) ShouldReport(done, total uint64, since time.Duration) bool {
+	return s == 0 || done%uint64(s) == 0
+}
+
+// TimeBased reports when at least that long has passed since the last
+// report, however many squarings that was.
+type TimeBased time.Duration
+
+// ShouldReport implements ProgressStrategy.
+func (s TimeBased) ShouldReport(done, total uint64, since time.Duration) bool {
+	return since >= time.Duration(s)
+}
+
+// Always reports each time the solve consults it, every 256 squarings.
+// Reports are still skipped while the progress callback is busy with an
+// earlier one.
+type Always struct{}
+
+// ShouldReport implements ProgressStrategy.
+func (Always) ShouldReport(done, total uint64, since time.Duration) bool {
+	return true
+}
@@ -0,0 +1,133 @@
+package crypto
+
+import (
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProgressStrategies(t *testing.T) {
+	cases := []struct {
+		name     string
+		strategy ProgressStrategy
+		done     uint64
+		since    time.Duration
+		want     bool
+	}{
+		{"fixed step on a multiple", FixedStep(100), 300, 0, true},
+		{"fixed step between multiples", FixedStep(100), 301, time.Hour, false},
+		{"fixed step zero", FixedStep(0), 7, 0, true},
+		{"time based too soon", TimeBased(time.Second), 1 << 30, 999 * time.Millisecond, false},
+		{"time based due", TimeBased(time.Second), 1, time.Second, true},
+		{"always", Always{}, 1, 0, true},
+	}
+	for _, c := range cases {
+		if got := c.strategy.ShouldReport(c.done, 1<<40, c.since); got != c.want {
+			t.Errorf("%s: ShouldReport(%d, since %v) = %v, want %v", c.name, c.done, c.since, got, c.want)
+		}
+	}
+}
+
+// solveReports solves a small puzzle with strategy and returns the progress
+// reports received.
+func solveReports(t *testing.T, T uint64, strategy ProgressStrategy) []uint64 {
+	t.Helper()
+	p := Puzzle{N: big.NewInt(1000003), G: big.NewInt(3), T: T}
+	var mu sync.Mutex
+	var reports []uint64
+	_, err := SolvePuzzleWithOptions(p, SolveOptions{
+		ProgressStrategy: strategy,
+		Progress: func(done uint64) {
+			mu.Lock()
+			reports = append(reports, done)
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		t.Fatalf("solve failed: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reports) == 0 || reports[len(reports)-1] != T {
+		t.Fatalf("final report missing: %v", reports)
+	}
+	return reports
+}
+
+func TestSolveProgressFixedStep(t *testing.T) {
+	const T = 1000
+	reports := solveReports(t, T, FixedStep(100))
+	for _, done := range reports[:len(reports)-1] {
+		if done%100 != 0 {
+			t.Fatalf("report %d is not a multiple of the step: %v", done, reports)
+		}
+	}
+}
+
+func TestSolveProgressDefaultStrategy(t *testing.T) {
+	// Under the default step, a short solve reports only its end
+	reports := solveReports(t, 1000, nil)
+	if len(reports) != 1 {
+		t.Fatalf("expected only the final report, got %v", reports)
+	}
+}
+
+func TestSolveProgressAlways(t *testing.T) {
+	// The callback may be busy and skip some, but reports are frequent
+	const T = 50000
+	reports := solveReports(t, T, Always{})
+	if len(reports) < 2 {
+		t.Fatalf("expected intermediate reports, got %v", reports)
+	}
+	for i := 1; i < len(reports); i++ {
+		if reports[i] <= reports[i-1] {
+			t.Fatalf("progress not monotonic: %v", reports)
+		}
+	}
+}
+
+func TestSolveProgressTimeBased(t *testing.T) {
+	// No interval passes during a short solve
+	if reports := solveReports(t, 1000, TimeBased(time.Hour)); len(reports) != 1 {
+		t.Fatalf("expected only the final report, got %v", reports)
+	}
+	// A zero interval reports whenever the callback is free
+	if reports := solveReports(t, 50000, TimeBased(0)); len(reports) < 2 {
+		t.Fatalf("expected intermediate reports, got %v", reports)
+	}
+}
+
+// countingStrategy reports every time and counts how often it is consulted.
+type countingStrategy struct{ calls *int }
+
+func (s countingStrategy) ShouldReport(done, total uint64, since time.Duration) bool {
+	*s.calls++
+	return done%controlStep == 0
+}
+
+func TestSolveProgressConsultedEveryControlStep(t *testing.T) {
+	// The loop does not call the strategy for every squaring
+	const T = 50 * controlStep
+	calls := 0
+	reports := solveReports(t, T, countingStrategy{&calls})
+	if uint64(calls) != T/controlStep-1 {
+		t.Errorf("strategy consulted %d times, want %d", calls, T/controlStep-1)
+	}
+	for _, done := range reports {
+		if done%controlStep != 0 {
+			t.Fatalf("report %d is not at a control step: %v", done, reports)
+		}
+	}
+
+	// A fixed step smaller than that is still honoured exactly
+	reports = solveReports(t, 10000, FixedStep(3))
+	if len(reports) < 2 {
+		t.Fatalf("expected intermediate reports, got %v", reports)
+	}
+	for _, done := range reports[:len(reports)-1] {
+		if done%3 != 0 {
+			t.Fatalf("report %d is not a multiple of the step: %v", done, reports)
+		}
+	}
+}
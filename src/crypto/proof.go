@@ -0,0 +1,195 @@
+package crypto
+
+// proof.go proves that a puzzle was solved: a Pietrzak proof of exponentiation
+// built from intermediate values kept during the sequential solve, which lets
+// anyone check the claimed solution with a small fraction of the squarings.
+//
+// The solve is split at T' = m·2^d squarings into 2^d segments of m
+// squarings, and the value at the end of each segment is kept.  Each of the
+// d rounds of the proof halves the claim x^(2^(k·m)) = y by sending the
+// midpoint μ and folding both halves into one with a random challenge r
+// derived from the claim (Fiat-Shamir): x' = x^r·μ and y' = μ^r·y.  The
+// verifier ends with a claim of m squarings, which it checks directly,
+// before squaring the remaining tail T - T' itself.  The verifier works on
+// the squares of the values sent, as is usual for RSA groups, where -1 is
+// an element of small order that a prover could otherwise slip in.
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/bits"
+)
+
+// MaxProofRounds bounds the halving rounds of a solve proof: the prover
+// keeps 2^MaxProofRounds+1 intermediate values (some tens of megabytes for
+// a 2048-bit modulus), and the verifier squares about T/2^MaxProofRounds
+// plus 2^MaxProofRounds times.
+const MaxProofRounds = 16
+
+// proofLabel domain-separates the challenges of solve proofs.
+const proofLabel = "cryptotimed solve proof v1"
+
+// proofShape returns how a proof of T squarings is split: its rounds, the
+// squarings m of each of the 2^rounds segments and the tail squared by the
+// verifier.  The tail is at least one squaring for T > 0, so the solution
+// itself is pinned down, not only its square.
+func proofShape(T uint64) (rounds int, segment, tail uint64) {
+	if T == 0 {
+		return 0, 0, 0
+	}
+	rounds = min(MaxProofRounds, (bits.Len64(T)-1)/2)
+	segment = (T - 1) >> rounds
+	return rounds, segment, T - segment<<rounds
+}
+
+// SolveProof is a proof that G^(2^T) mod N, for a puzzle with a given N, G
+// and T, is a claimed value (see VerifySolveProof).
+type SolveProof struct {
+	// Partial is G^(2^T') for the T' = T - tail squarings the halving
+	// rounds cover.
+	Partial *big.Int
+
+	// Mu holds the midpoint sent in each halving round, in order.
+	Mu []*big.Int
+}
+
+// ProofRecorder keeps the intermediate values of a solve that a SolveProof
+// is built from (see SolveOptions.Proof).  It must see the solve from G.
+type ProofRecorder struct {
+	puzzle  Puzzle
+	rounds  int
+	segment uint64
+	values  []*big.Int // G^(2^(i·segment)) for i = 0, 1, ...
+}
+
+// NewProofRecorder returns a recorder for a solve of p.
+func NewProofRecorder(p Puzzle) *ProofRecorder {
+	rounds, segment, _ := proofShape(p.T)
+	values := make([]*big.Int, 1, 1<<rounds+1)
+	values[0] = new(big.Int).Set(p.G)
+	return &ProofRecorder{puzzle: p, rounds: rounds, segment: segment, values: values}
+}
+
+// next returns the squarings after which the next value is due, or 0 once
+// all have been kept.
+func (r *ProofRecorder) next() uint64 {
+	if r.segment == 0 || len(r.values) > 1<<r.rounds {
+		return 0
+	}
+	return uint64(len(r.values)) * r.segment
+}
+
+// record keeps a copy of the value due at next.
+func (r *ProofRecorder) record(v *big.Int) {
+	r.values = append(r.values, new(big.Int).Set(v))
+}
+
+// Prove builds the proof that the recorded solve ends at y.  It fails if the
+// solve did not run through all the segments, e.g. because it was stopped.
+// The halving rounds take about 2^rounds exponentiations by 128-bit
+// challenges, well under a minute at most.
+func (r *ProofRecorder) Prove(y *big.Int) (*SolveProof, error) {
+	if r.segment > 0 && len(r.values) != 1<<r.rounds+1 {
+		return nil, fmt.Errorf("the solve kept %d of the %d values a proof needs", len(r.values), 1<<r.rounds+1)
+	}
+	N := r.puzzle.N
+	values := r.values
+	proof := &SolveProof{Partial: new(big.Int).Set(values[len(values)-1])}
+	square := func(v *big.Int) *big.Int { return new(big.Int).Exp(v, big.NewInt(2), N) }
+
+	for round := 0; round < r.rounds; round++ {
+		half := len(values) / 2
+		mu := values[half]
+		c := proofChallenge(r.puzzle, round, square(values[0]), square(values[len(values)-1]), square(mu))
+		folded := make([]*big.Int, half+1)
+		for i := range folded {
+			v := new(big.Int).Exp(values[i], c, N)
+			folded[i] = v.Mod(v.Mul(v, values[i+half]), N)
+		}
+		proof.Mu = append(proof.Mu, new(big.Int).Set(mu))
+		values = folded
+	}
+	return proof, nil
+}
+
+// proofChallenge derives the 128-bit challenge of a halving round from the
+// puzzle and the squared claim x^(2^k) = y with midpoint mu.
+func proofChallenge(p Puzzle, round int, x, y, mu *big.Int) *big.Int {
+	width := ModulusBytes(p.N)
+	fp := p.Fingerprint()
+	h := sha256.New()
+	h.Write([]byte(proofLabel))
+	h.Write(fp[:])
+	h.Write(binary.BigEndian.AppendUint32(nil, uint32(round)))
+	for _, v := range []*big.Int{x, y, mu} {
+		h.Write(v.FillBytes(make([]byte, width)))
+	}
+	return new(big.Int).SetBytes(h.Sum(nil)[:16])
+}
+
+// VerifySolveProof checks that y is G^(2^T) mod N for p, as proof claims.
+// It takes about T/2^MaxProofRounds plus 2^MaxProofRounds squarings for a
+// long puzzle instead of T.  The proof is sound as long as nobody who can
+// factor N made it: a proof for one of the puzzles this program generates
+// convinces anyone but the encryptor.
+func VerifySolveProof(p Puzzle, y *big.Int, proof *SolveProof) error {
+	if err := CheckKeyModulus(p.N); err != nil {
+		return err
+	}
+	N := p.N
+	inRange := func(v *big.Int) bool { return v != nil && v.Sign() > 0 && v.Cmp(N) < 0 }
+	if !inRange(p.G) {
+		return errors.New("puzzle base G is outside [1, N-1]")
+	}
+	if !inRange(y) {
+		return errors.New("the claimed solution is outside [1, N-1]")
+	}
+	if proof == nil || !inRange(proof.Partial) {
+		return errors.New("the proof's partial solution is missing or outside [1, N-1]")
+	}
+	rounds, segment, tail := proofShape(p.T)
+	if len(proof.Mu) != rounds {
+		return fmt.Errorf("the proof has %d rounds, a work factor of %d needs %d", len(proof.Mu), p.T, rounds)
+	}
+	for _, mu := range proof.Mu {
+		if !inRange(mu) {
+			return errors.New("the proof holds a value outside [1, N-1]")
+		}
+	}
+	if p.T == 0 {
+		if y.Cmp(p.G) != 0 || proof.Partial.Cmp(p.G) != 0 {
+			return errors.New("a puzzle of no work is solved by its base")
+		}
+		return nil
+	}
+
+	two := big.NewInt(2)
+	x := new(big.Int).Exp(p.G, two, N)
+	z := new(big.Int).Exp(proof.Partial, two, N)
+	for round, mu := range proof.Mu {
+		m := new(big.Int).Exp(mu, two, N)
+		c := proofChallenge(p, round, x, z, m)
+		x.Mod(x.Mul(x.Exp(x, c, N), m), N)
+		z.Mod(z.Mul(z, m.Exp(m, c, N)), N)
+	}
+	if squareTimes(x, segment, N).Cmp(z) != 0 {
+		return errors.New("the proof does not check out: the partial solution is not the base squared as many times as the puzzle asks")
+	}
+	if squareTimes(new(big.Int).Set(proof.Partial), tail, N).Cmp(y) != 0 {
+		return errors.New("the proof does not check out: the claimed solution does not follow from the partial solution")
+	}
+	return nil
+}
+
+// squareTimes squares v modulo N n times in place and returns it.
+func squareTimes(v *big.Int, n uint64, N *big.Int) *big.Int {
+	square := new(big.Int)
+	for i := uint64(0); i < n; i++ {
+		square.Mul(v, v)
+		v.Mod(square, N)
+	}
+	return v
+}
@@ -0,0 +1,103 @@
+package crypto
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+)
+
+// solveWithProof solves p from G, keeping what its proof is built from.
+func solveWithProof(t *testing.T, p Puzzle) (*big.Int, *SolveProof) {
+	t.Helper()
+	recorder := NewProofRecorder(p)
+	y, err := SolvePuzzleWithOptions(p, SolveOptions{Proof: recorder})
+	if err != nil {
+		t.Fatalf("solve failed: %v", err)
+	}
+	proof, err := recorder.Prove(y)
+	if err != nil {
+		t.Fatalf("Prove failed: %v", err)
+	}
+	return y, proof
+}
+
+// TestSolveProofRoundTrip proves and verifies solves of small work factors,
+// covering each shape of proof: no work, no rounds, and rounds whose
+// segments do and do not divide the work.
+func TestSolveProofRoundTrip(t *testing.T) {
+	base := solverTestPuzzle(t, 1)
+	for _, work := range []uint64{0, 1, 2, 3, 4, 5, 16, 17, 1000, 1<<12 + 3, 100_000} {
+		t.Run(fmt.Sprint(work), func(t *testing.T) {
+			p := Puzzle{N: base.N, G: base.G, T: work}
+			y, proof := solveWithProof(t, p)
+			if want := solve(t, p); y.Cmp(want) != 0 {
+				t.Fatal("solving with a proof recorder changed the solution")
+			}
+			if rounds, _, _ := proofShape(work); len(proof.Mu) != rounds {
+				t.Errorf("proof has %d rounds, want %d", len(proof.Mu), rounds)
+			}
+			if err := VerifySolveProof(p, y, proof); err != nil {
+				t.Fatalf("valid proof rejected: %v", err)
+			}
+		})
+	}
+}
+
+// TestSolveProofRejectsTampering checks that a wrong solution, partial
+// solution or midpoint, or a proof of another puzzle, fails to verify.
+func TestSolveProofRejectsTampering(t *testing.T) {
+	p := solverTestPuzzle(t, 5000)
+	y, proof := solveWithProof(t, p)
+	one := big.NewInt(1)
+	bump := func(v *big.Int) *big.Int { return new(big.Int).Add(v, one) }
+
+	if err := VerifySolveProof(p, bump(y), proof); err == nil {
+		t.Error("a wrong solution verified")
+	}
+	if err := VerifySolveProof(p, new(big.Int).Sub(p.N, y), proof); err == nil {
+		t.Error("the negated solution verified")
+	}
+	if err := VerifySolveProof(p, y, &SolveProof{Partial: bump(proof.Partial), Mu: proof.Mu}); err == nil {
+		t.Error("a wrong partial solution verified")
+	}
+	for i := range proof.Mu {
+		mu := append([]*big.Int(nil), proof.Mu...)
+		mu[i] = bump(mu[i])
+		if err := VerifySolveProof(p, y, &SolveProof{Partial: proof.Partial, Mu: mu}); err == nil {
+			t.Errorf("a wrong midpoint in round %d verified", i)
+		}
+	}
+	if err := VerifySolveProof(p, y, &SolveProof{Partial: proof.Partial, Mu: proof.Mu[1:]}); err == nil {
+		t.Error("a proof missing a round verified")
+	}
+	other := Puzzle{N: p.N, G: p.G, T: p.T + 1}
+	if err := VerifySolveProof(other, y, proof); err == nil {
+		t.Error("a proof verified for another work factor")
+	}
+	if err := VerifySolveProof(p, new(big.Int).Set(p.N), proof); err == nil {
+		t.Error("a solution outside the modulus verified")
+	}
+}
+
+// TestSolveProofNeedsWholeSolve checks that a proof cannot be built from a
+// resumed or stopped solve.
+func TestSolveProofNeedsWholeSolve(t *testing.T) {
+	p := solverTestPuzzle(t, 5000)
+	state := SolvingState{Puzzle: p, Result: solve(t, Puzzle{N: p.N, G: p.G, T: 10}), Done: 10}
+	if _, err := SolvePuzzleWithOptions(p, SolveOptions{Resume: &state, Proof: NewProofRecorder(p)}); err == nil {
+		t.Error("a resumed solve kept values for a proof")
+	}
+	if _, err := SolvePuzzleWithOptions(p, SolveOptions{Proof: NewProofRecorder(Puzzle{N: p.N, G: p.G, T: 10})}); err == nil {
+		t.Error("a recorder of another puzzle was used")
+	}
+
+	recorder := NewProofRecorder(p)
+	ctl := &SolveControl{}
+	ctl.Stop()
+	if _, err := SolvePuzzleWithOptions(p, SolveOptions{Proof: recorder, Control: ctl}); err != ErrSolveStopped {
+		t.Fatalf("stopped solve returned %v", err)
+	}
+	if _, err := recorder.Prove(p.Target); err == nil {
+		t.Error("a proof was built from a stopped solve")
+	}
+}
@@ -0,0 +1,129 @@
+package crypto
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// DefaultVerifySteps is the number of squarings VerifyPuzzle compares with a
+// sequential solve when given no limit (a fraction of a second).
+const DefaultVerifySteps uint64 = 1 << 16
+
+// PuzzleCheck is what VerifyPuzzle checked beyond the ranges of the puzzle's
+// values.
+type PuzzleCheck struct {
+	Steps    uint64 // squarings compared with a sequential solve
+	Full     bool   // Steps is the work factor: the target itself was solved for
+	Trapdoor bool   // the private key was checked and the target recomputed through it
+}
+
+// VerifyPuzzle sanity-checks a freshly generated puzzle before anything is
+// locked with it, to catch a faulty key generation or target computation
+// while the encryptor can still start over.  It checks that N is an odd
+// modulus of a size puzzles are solved with, that G lies in [2, N-2] and is
+// coprime to N and that the target lies in [1, N-1].  Given priv, the
+// private key returned with p, it checks the key and recomputes the target
+// through it.  A puzzle of at most maxSteps squarings (DefaultVerifySteps
+// if zero) is then solved sequentially and its target compared; for a
+// longer one, the trapdoor is instead compared with a sequential solve of
+// maxSteps squarings of the same base, which needs priv.
+func VerifyPuzzle(p Puzzle, priv *rsa.PrivateKey, maxSteps uint64) (*PuzzleCheck, error) {
+	if maxSteps == 0 {
+		maxSteps = DefaultVerifySteps
+	}
+	if err := checkPuzzleValues(p); err != nil {
+		return nil, err
+	}
+
+	check := &PuzzleCheck{}
+	if priv != nil && !trapdoorDisabled {
+		if err := checkTrapdoor(p, priv); err != nil {
+			return nil, err
+		}
+		check.Trapdoor = true
+	}
+
+	if p.T <= maxSteps {
+		if computeTarget(p, nil, nil).Cmp(p.Target) != 0 {
+			return nil, fmt.Errorf("puzzle target differs from a sequential solve of %d squarings", p.T)
+		}
+		check.Steps, check.Full = p.T, true
+		return check, nil
+	}
+
+	// The target itself is out of reach: check the trapdoor on a prefix of
+	// the squaring chain instead
+	if check.Trapdoor {
+		prefix := p
+		prefix.T = maxSteps
+		target, err := TrapdoorTarget(prefix, priv)
+		if err != nil {
+			return nil, err
+		}
+		if computeTarget(prefix, nil, nil).Cmp(target) != 0 {
+			return nil, fmt.Errorf("trapdoor differs from a sequential solve of %d squarings", maxSteps)
+		}
+		check.Steps = maxSteps
+	}
+	return check, nil
+}
+
+// Verify reports whether p holds together, as far as its private key priv
+// can tell in O(log T) time: the values pass the checks of VerifyPuzzle,
+// the target lies in [2, N-2] and recomputing it through priv gives the
+// same.  Nothing is solved sequentially.  Without priv, as in a build
+// without the trapdoor, it reports false.
+func (p Puzzle) Verify(priv *rsa.PrivateKey) bool {
+	if priv == nil || trapdoorDisabled || checkPuzzleValues(p) != nil {
+		return false
+	}
+	two := big.NewInt(2)
+	if p.Target.Cmp(two) < 0 || p.Target.Cmp(new(big.Int).Sub(p.N, two)) > 0 {
+		return false
+	}
+	return checkTrapdoor(p, priv) == nil
+}
+
+// checkPuzzleValues checks that N is an odd modulus of a size puzzles are
+// solved with, that G lies in [2, N-2] and is coprime to N and that the
+// target lies in [1, N-1].
+func checkPuzzleValues(p Puzzle) error {
+	if err := CheckKeyModulus(p.N); err != nil {
+		return err
+	}
+	if p.N.Bit(0) == 0 {
+		return errors.New("puzzle modulus is even")
+	}
+	two := big.NewInt(2)
+	if p.G == nil || p.G.Cmp(two) < 0 || p.G.Cmp(new(big.Int).Sub(p.N, two)) > 0 {
+		return errors.New("puzzle base G is outside [2, N-2]")
+	}
+	if new(big.Int).GCD(nil, nil, p.G, p.N).Cmp(big.NewInt(1)) != 0 {
+		return errors.New("puzzle base G shares a factor with N")
+	}
+	if p.Target == nil || p.Target.Sign() <= 0 || p.Target.Cmp(p.N) >= 0 {
+		return errors.New("puzzle target is outside [1, N-1]")
+	}
+	return nil
+}
+
+// checkTrapdoor checks priv, the private key of p, and that the target
+// recomputed through it is p's.
+func checkTrapdoor(p Puzzle, priv *rsa.PrivateKey) error {
+	if priv.N.Cmp(p.N) != 0 {
+		return errors.New("private key does not match the puzzle")
+	}
+	if err := priv.Validate(); err != nil {
+		return fmt.Errorf("invalid RSA key: %v", err)
+	}
+	target, err := TrapdoorTarget(p, priv)
+	if err != nil {
+		return err
+	}
+	if target.Cmp(p.Target) != 0 {
+		return errors.New("puzzle target differs from the one computed through the trapdoor")
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package crypto
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestVerifyPuzzle(t *testing.T) {
+	puzzle, priv, err := GeneratePuzzle(500, nil, DefaultModulusBits)
+	if err != nil {
+		t.Fatalf("GeneratePuzzle failed: %v", err)
+	}
+
+	// A small work factor is solved outright
+	check, err := VerifyPuzzle(puzzle, priv, 1000)
+	if err != nil {
+		t.Fatalf("well-formed puzzle rejected: %v", err)
+	}
+	if !check.Full || check.Steps != 500 || check.Trapdoor != (priv != nil) {
+		t.Errorf("check %+v, want a full solve of 500 squarings", check)
+	}
+
+	// A larger one only has the trapdoor checked on a prefix
+	if priv != nil {
+		check, err = VerifyPuzzle(puzzle, priv, 100)
+		if err != nil {
+			t.Fatalf("well-formed puzzle rejected: %v", err)
+		}
+		if check.Full || check.Steps != 100 || !check.Trapdoor {
+			t.Errorf("check %+v, want 100 squarings of the trapdoor", check)
+		}
+	}
+}
+
+func TestVerifyPuzzleCatchesFaults(t *testing.T) {
+	puzzle, priv, err := GeneratePuzzle(300, nil, DefaultModulusBits)
+	if err != nil {
+		t.Fatalf("GeneratePuzzle failed: %v", err)
+	}
+
+	faults := map[string]func(p *Puzzle) string{
+		"G out of range": func(p *Puzzle) string {
+			p.G = new(big.Int).Sub(p.N, big.NewInt(1))
+			return "outside [2, N-2]"
+		},
+		"G sharing a factor with N": func(p *Puzzle) string {
+			if priv == nil {
+				p.G = big.NewInt(0)
+				return "outside"
+			}
+			p.G = new(big.Int).Set(priv.Primes[0])
+			return "shares a factor"
+		},
+		"G corrupted after the target was computed": func(p *Puzzle) string {
+			p.G = new(big.Int).Add(p.G, big.NewInt(1))
+			return "differs"
+		},
+		"target out of range": func(p *Puzzle) string {
+			p.Target = new(big.Int).Set(p.N)
+			return "outside [1, N-1]"
+		},
+		"even modulus": func(p *Puzzle) string {
+			p.N = new(big.Int).SetBit(p.N, 0, 0)
+			return "even"
+		},
+	}
+	for name, inject := range faults {
+		t.Run(name, func(t *testing.T) {
+			p := puzzle
+			want := inject(&p)
+			// The key no longer matches a changed modulus
+			key := priv
+			if p.N != puzzle.N {
+				key = nil
+			}
+			if _, err := VerifyPuzzle(p, key, 1000); err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("got %v, want an error containing %q", err, want)
+			}
+		})
+	}
+}
+
+func TestPuzzleVerify(t *testing.T) {
+	if trapdoorDisabled {
+		t.Skip("the trapdoor is disabled in this build")
+	}
+
+	// A work factor far out of reach of a solve is checked all the same
+	puzzle, priv, err := GeneratePuzzle(1<<40, nil, DefaultModulusBits)
+	if err != nil {
+		t.Fatalf("GeneratePuzzle failed: %v", err)
+	}
+	if !puzzle.Verify(priv) {
+		t.Fatal("well-formed puzzle rejected")
+	}
+	if puzzle.Verify(nil) {
+		t.Error("a puzzle was verified without its private key")
+	}
+
+	other, otherPriv, err := GeneratePuzzle(100, nil, DefaultModulusBits)
+	if err != nil {
+		t.Fatalf("GeneratePuzzle failed: %v", err)
+	}
+	if puzzle.Verify(otherPriv) || other.Verify(priv) {
+		t.Error("a puzzle was verified with another puzzle's key")
+	}
+
+	for name, inject := range map[string]func(p *Puzzle){
+		"target off by one": func(p *Puzzle) { p.Target = new(big.Int).Add(p.Target, big.NewInt(1)) },
+		"target of 1":       func(p *Puzzle) { p.Target = big.NewInt(1) },
+		"target of N-1":     func(p *Puzzle) { p.Target = new(big.Int).Sub(p.N, big.NewInt(1)) },
+		"missing target":    func(p *Puzzle) { p.Target = nil },
+		"another T":         func(p *Puzzle) { p.T++ },
+		"G sharing N's factor": func(p *Puzzle) {
+			p.G = new(big.Int).Set(priv.Primes[0])
+		},
+	} {
+		p := puzzle
+		inject(&p)
+		if p.Verify(priv) {
+			t.Errorf("%s: verified", name)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package crypto
+
+// raceEnabled reports whether the race detector is on.  It randomly drops
+// sync.Pool entries, so allocation counts are not meaningful under it.
+const raceEnabled = true
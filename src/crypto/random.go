@@ -0,0 +1,27 @@
+package crypto
+
+import (
+	"bufio"
+	"crypto/rand"
+	"io"
+)
+
+// bufferedRandSize is how many bytes NewBufferedRand fetches at a time.
+const bufferedRandSize = 4096
+
+// NewBufferedRand returns a source of cryptographically secure random bytes
+// that reads crypto/rand.Reader in 4 KiB blocks, for passing to
+// GeneratePuzzleWithOptions as GenerateOptions.Rand.  Key generation makes
+// many small reads, and serving them from a private buffer keeps goroutines
+// that generate puzzles concurrently off the shared system source.  Prime
+// search usually dominates generation time, so compare
+// BenchmarkGeneratePuzzleParallel with its Buffered variant on the target
+// machine before relying on it.
+//
+// The returned reader is NOT safe for concurrent use: give each goroutine its
+// own.  Unread random bytes stay in the buffer until it is garbage collected,
+// so do not keep one around longer than needed.  crypto/rand.Reader itself is
+// safe for concurrent use and remains the default.
+func NewBufferedRand() io.Reader {
+	return bufio.NewReaderSize(rand.Reader, bufferedRandSize)
+}
@@ -0,0 +1,226 @@
+package crypto
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Ciphers seal a file's data section and key derivations turn the puzzle
+// solution into the key it is sealed under.  Both are looked up by the ID
+// the file header records (types.HeaderExtensions.Cipher and KeyDerivation),
+// so a build that does not know an ID refuses the file rather than guessing.
+// The built-in algorithms are registered like any other; a separate package
+// can add its own with RegisterCipher and RegisterKDF from an init function
+// and be linked into a custom build.  External algorithms should take IDs
+// from ExternalIDBase up, which this project never assigns.
+
+// CipherChaCha20Poly1305 is the ID of the built-in cipher, used when the
+// header records none.
+const CipherChaCha20Poly1305 uint8 = 0
+
+// ExternalIDBase is the first cipher and key-derivation ID left to external
+// packages.
+const ExternalIDBase uint8 = 0x80
+
+// SealFunc encrypts and authenticates plaintext under key, binding ad, and
+// returns the sealed bytes with whatever nonce and tag the cipher needs.
+type SealFunc func(key [32]byte, plaintext, ad []byte) ([]byte, error)
+
+// OpenFunc reverses a SealFunc; it fails unless key and ad are the ones the
+// data was sealed with.
+type OpenFunc func(key [32]byte, sealed, ad []byte) ([]byte, error)
+
+// DeriveFunc derives a file key from secret, the puzzle target zero-padded
+// to the modulus size, and the parameters the header records for it.
+type DeriveFunc func(secret, params []byte) ([32]byte, error)
+
+// ParamCodec handles the parameters of a key derivation that takes some.
+// Encode returns those of a newly encrypted file; Decode checks those read
+// from a header and describes them for check.
+type ParamCodec interface {
+	Encode() ([]byte, error)
+	Decode(params []byte) (string, error)
+}
+
+// Cipher is a registered cipher.
+type Cipher struct {
+	ID   uint8
+	Name string
+	Seal SealFunc
+	Open OpenFunc
+}
+
+// KDF is a registered key derivation.  Params is nil for a derivation
+// without parameters.
+type KDF struct {
+	ID     uint8
+	Name   string
+	Derive DeriveFunc
+	Params ParamCodec
+}
+
+var (
+	registryMu sync.RWMutex
+	ciphers    = map[uint8]Cipher{}
+	kdfs       = map[uint8]KDF{}
+)
+
+func init() {
+	mustRegister(RegisterCipher(CipherChaCha20Poly1305, "chacha20poly1305", EncryptDataWithAD, DecryptDataWithAD))
+	for version, h := range keyHashes {
+		mustRegister(RegisterKDF(version, h.name, hkdfDerive(h), nil))
+	}
+}
+
+// mustRegister panics if registering a built-in algorithm failed, which
+// only a clash between two built-ins can cause.
+func mustRegister(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// RegisterCipher makes a cipher available under id and name, for files to
+// be sealed with (see CipherForName) and opened by.  It fails if either is
+// already taken.
+func RegisterCipher(id uint8, name string, seal SealFunc, open OpenFunc) error {
+	name = strings.ToLower(name)
+	if name == "" || seal == nil || open == nil {
+		return fmt.Errorf("cipher 0x%02x needs a name and both seal and open functions", id)
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if c, ok := ciphers[id]; ok {
+		return fmt.Errorf("cipher ID 0x%02x is already registered as %s", id, c.Name)
+	}
+	for _, c := range ciphers {
+		if c.Name == name {
+			return fmt.Errorf("cipher %s is already registered as 0x%02x", name, c.ID)
+		}
+	}
+	ciphers[id] = Cipher{ID: id, Name: name, Seal: seal, Open: open}
+	return nil
+}
+
+// RegisterKDF makes a key derivation available under id and name, for
+// files to be encrypted with (see KeyDerivationForHash) and decrypted by.
+// params is nil unless the derivation takes parameters.  It fails if id or
+// name is already taken; ID KeyDerivationLegacy always is.
+func RegisterKDF(id uint8, name string, derive DeriveFunc, params ParamCodec) error {
+	name = strings.ToLower(name)
+	if name == "" || derive == nil {
+		return fmt.Errorf("key derivation %d needs a name and a derive function", id)
+	}
+	if id == KeyDerivationLegacy {
+		return fmt.Errorf("key derivation ID %d is reserved for the legacy derivation", id)
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if k, ok := kdfs[id]; ok {
+		return fmt.Errorf("key derivation ID %d is already registered as %s", id, k.Name)
+	}
+	for _, k := range kdfs {
+		if k.Name == name {
+			return fmt.Errorf("key derivation %s is already registered as %d", name, k.ID)
+		}
+	}
+	kdfs[id] = KDF{ID: id, Name: name, Derive: derive, Params: params}
+	return nil
+}
+
+// LookupCipher returns the cipher registered under id.
+func LookupCipher(id uint8) (Cipher, error) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	c, ok := ciphers[id]
+	if !ok {
+		return Cipher{}, fmt.Errorf("unsupported cipher 0x%02x (not built in or registered)", id)
+	}
+	return c, nil
+}
+
+// lookupKDF returns the key derivation registered under version.
+func lookupKDF(version uint8) (KDF, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	k, ok := kdfs[version]
+	return k, ok
+}
+
+// CipherForName returns the ID of the cipher registered as name.  An empty
+// name is CipherChaCha20Poly1305.
+func CipherForName(name string) (uint8, error) {
+	if name == "" {
+		return CipherChaCha20Poly1305, nil
+	}
+	for _, c := range Ciphers() {
+		if c.Name == strings.ToLower(name) {
+			return c.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher %q (known: %s)", name, strings.Join(CipherNames(), ", "))
+}
+
+// CipherName returns the name of a cipher ID, or a placeholder for one this
+// build does not know.
+func CipherName(id uint8) string {
+	if c, err := LookupCipher(id); err == nil {
+		return c.Name
+	}
+	return fmt.Sprintf("unknown (0x%02x)", id)
+}
+
+// Ciphers returns the registered ciphers in ID order.
+func Ciphers() []Cipher {
+	registryMu.RLock()
+	list := make([]Cipher, 0, len(ciphers))
+	for _, c := range ciphers {
+		list = append(list, c)
+	}
+	registryMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// CipherNames returns the names CipherForName accepts, in ID order.
+func CipherNames() []string {
+	list := Ciphers()
+	names := make([]string, len(list))
+	for i, c := range list {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// KDFs returns the registered key derivations in ID order.  The legacy
+// derivation, which new files never use, is not among them.
+func KDFs() []KDF {
+	registryMu.RLock()
+	list := make([]KDF, 0, len(kdfs))
+	for _, k := range kdfs {
+		list = append(list, k)
+	}
+	registryMu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Seal seals plaintext under key with the cipher registered as id.
+func Seal(id uint8, key [32]byte, plaintext, ad []byte) ([]byte, error) {
+	c, err := LookupCipher(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.Seal(key, plaintext, ad)
+}
+
+// Open reverses Seal.
+func Open(id uint8, key [32]byte, sealed, ad []byte) ([]byte, error) {
+	c, err := LookupCipher(id)
+	if err != nil {
+		return nil, err
+	}
+	return c.Open(key, sealed, ad)
+}
@@ -0,0 +1,102 @@
+package crypto
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func TestRegisterCollisions(t *testing.T) {
+	seal, open := EncryptDataWithAD, DecryptDataWithAD
+	if err := RegisterCipher(CipherChaCha20Poly1305, "other", seal, open); err == nil {
+		t.Error("cipher ID of the built-in cipher registered again")
+	}
+	if err := RegisterCipher(0xF0, "ChaCha20Poly1305", seal, open); err == nil {
+		t.Error("name of the built-in cipher registered again")
+	}
+	if err := RegisterCipher(0xF0, "", seal, open); err == nil {
+		t.Error("cipher without a name registered")
+	}
+
+	derive := func(secret, params []byte) ([32]byte, error) { return [32]byte{}, nil }
+	for _, id := range []uint8{KeyDerivationLegacy, KeyDerivationHKDFv1, KeyDerivationHKDFSHA3} {
+		if err := RegisterKDF(id, "other", derive, nil); err == nil {
+			t.Errorf("key derivation ID %d registered again", id)
+		}
+	}
+	if err := RegisterKDF(0xF0, "blake2b", derive, nil); err == nil {
+		t.Error("name of a built-in key derivation registered again")
+	}
+	if _, ok := lookupKDF(0xF0); ok {
+		t.Error("a failed registration was kept")
+	}
+}
+
+// testParams is a ParamCodec of a single byte that must be 7.
+type testParams struct{}
+
+func (testParams) Encode() ([]byte, error) { return []byte{7}, nil }
+
+func (testParams) Decode(params []byte) (string, error) {
+	if len(params) != 1 || params[0] != 7 {
+		return "", errors.New("want the single byte 7")
+	}
+	return "seven", nil
+}
+
+func TestRegisteredKDF(t *testing.T) {
+	const id = 0xF1
+	derive := func(secret, params []byte) ([32]byte, error) {
+		var key [32]byte
+		key[0], key[1] = secret[len(secret)-1], params[0]
+		return key, nil
+	}
+	if err := RegisterKDF(id, "Test-KDF", derive, testParams{}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		registryMu.Lock()
+		delete(kdfs, id)
+		registryMu.Unlock()
+	}()
+
+	version, err := KeyDerivationForHash("test-kdf")
+	if err != nil || version != id {
+		t.Fatalf("KeyDerivationForHash = %d, %v; want %d", version, err, id)
+	}
+	params, err := KeyDerivationParams(id)
+	if err != nil || string(params) != "\x07" {
+		t.Fatalf("KeyDerivationParams = %x, %v", params, err)
+	}
+	key, err := DerivePuzzleKeyParams(big.NewInt(42), testModulus, id, params)
+	if err != nil || key[0] != 42 || key[1] != 7 {
+		t.Errorf("derived %x, %v", key[:2], err)
+	}
+	for _, bad := range [][]byte{nil, {8}} {
+		if _, err := DerivePuzzleKeyParams(big.NewInt(42), testModulus, id, bad); err == nil {
+			t.Errorf("parameters %x accepted", bad)
+		}
+	}
+
+	// Built-in derivations take no parameters
+	if err := CheckKeyDerivation(KeyDerivationHKDFv1, []byte{7}); err == nil {
+		t.Error("parameters accepted for HKDF-SHA256")
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	var key [32]byte
+	sealed, err := Seal(CipherChaCha20Poly1305, key, []byte("data"), []byte("ad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := DecryptDataWithAD(key, sealed, []byte("ad")); err != nil || string(plaintext) != "data" {
+		t.Errorf("built-in cipher does not match DecryptDataWithAD: %q, %v", plaintext, err)
+	}
+	if plaintext, err := Open(CipherChaCha20Poly1305, key, sealed, []byte("ad")); err != nil || string(plaintext) != "data" {
+		t.Errorf("Open = %q, %v", plaintext, err)
+	}
+	if _, err := Open(ExternalIDBase, key, sealed, nil); err == nil {
+		t.Error("opened with an unregistered cipher")
+	}
+}
@@ -0,0 +1,313 @@
+package crypto
+
+// solver.go runs the sequential squaring loop of SolvePuzzle with optional
+// runtime tuning for long solves.
+//
+// The squaring loop is the only hot path in the program, so it is written to
+// never allocate: the square and the reduction reuse two scratch integers, and
+// progress reports are handed to a separate goroutine over a channel instead
+// of calling back into the caller from inside the loop.  This keeps slow
+// callbacks (terminal output, checkpoint files) from stretching individual
+// steps and keeps the garbage collector quiet while a solve is running.
+// Checkpoints are handed off the same way; only copying the intermediate
+// value for a checkpoint allocates, and that happens on request.
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+const (
+	// progressStep is the number of squarings between progress reports
+	// under DefaultProgressStrategy.
+	progressStep uint64 = 1 << 20 // roughly every million steps
+
+	// controlStep is the number of squarings between checks for pause,
+	// checkpoint and stop requests (a fraction of a millisecond of work).
+	controlStep uint64 = 1 << 8
+)
+
+// DefaultSnapshotInterval is the number of squarings between snapshots when
+// SolveOptions.SnapshotInterval is zero (some tens of seconds of work).
+const DefaultSnapshotInterval uint64 = 1 << 24
+
+// ErrSolveStopped is returned by SolvePuzzleWithOptions when the solve was
+// stopped through its SolveControl.  A final checkpoint has been delivered.
+var ErrSolveStopped = errors.New("solve stopped")
+
+// SolveOptions tunes how SolvePuzzleWithOptions runs.  The zero value solves
+// without progress reporting and leaves the runtime untouched.
+type SolveOptions struct {
+	// Progress, if set, receives the number of squarings performed so far.
+	// It runs on its own goroutine; reports are monotonic, intermediate ones
+	// may be skipped if the callback is slow, and the final report (T) is
+	// always delivered before SolvePuzzleWithOptions returns.
+	Progress func(done uint64)
+
+	// ProgressStrategy decides when Progress is called
+	// (DefaultProgressStrategy if nil).
+	ProgressStrategy ProgressStrategy
+
+	// PinThread locks the solving goroutine to its OS thread for the
+	// duration of the solve, so the scheduler does not migrate the hot loop
+	// between threads.
+	PinThread bool
+
+	// GCPercent, if non-zero, is the GOGC value applied while solving
+	// (negative disables the collector).  The previous value is restored
+	// afterwards.
+	GCPercent int
+
+	// MemoryLimit, if positive, is the soft memory limit in bytes applied
+	// while solving.  The previous limit is restored afterwards.
+	MemoryLimit int64
+
+	// Resume, if set, continues a solve from a checkpoint of the same
+	// puzzle instead of starting from G.
+	Resume *SolvingState
+
+	// Control, if set, lets other goroutines pause, checkpoint or stop the
+	// solve while it runs.
+	Control *SolveControl
+
+	// Checkpoint receives the intermediate state whenever Control requests
+	// a checkpoint and when the solve is stopped.  Like Progress it runs on
+	// its own goroutine, and every checkpoint has been delivered before
+	// SolvePuzzleWithOptions returns.
+	Checkpoint func(state SolvingState)
+
+	// Snapshot, if set, receives the intermediate value after every
+	// SnapshotInterval squarings (counted from G, also when resuming), so
+	// that observers can audit a long solve while it runs: each value must
+	// be a residue modulo N, and squaring one as many times as the steps
+	// between them must give the next.  Like Checkpoint it runs on its own
+	// goroutine.  No snapshot is skipped, so a callback slower than the
+	// interval holds up the solve.
+	Snapshot func(state SolvingState)
+
+	// SnapshotInterval is the number of squarings between snapshots
+	// (DefaultSnapshotInterval if zero).
+	SnapshotInterval uint64
+
+	// Proof, if set, keeps the intermediate values a proof of the solve is
+	// built from (see ProofRecorder.Prove).  It needs the solve from G, so
+	// it cannot be combined with a Resume past it.
+	Proof *ProofRecorder
+
+	// Throttle, if set, holds the solve to a fraction of one core by
+	// sleeping between batches of squarings.  Pauses do not count.
+	Throttle *CPUThrottle
+}
+
+// SolvePuzzleWithOptions computes g^{2^T} mod N exactly like SolvePuzzle, with
+// the runtime tuning described by opts.  The result does not depend on the
+// options.  It fails only if opts.Resume does not belong to p or cannot be
+// combined with opts.Proof, or the solve is stopped through opts.Control
+// (ErrSolveStopped).
+func SolvePuzzleWithOptions(p Puzzle, opts SolveOptions) (*big.Int, error) {
+	result := new(big.Int).Set(p.G)
+	start := uint64(0)
+	if opts.Resume != nil {
+		if err := opts.Resume.Matches(p); err != nil {
+			return nil, err
+		}
+		result.Set(opts.Resume.Result)
+		start = opts.Resume.Done
+	}
+	proofAt := uint64(0)
+	if opts.Proof != nil {
+		if opts.Proof.puzzle.Fingerprint() != p.Fingerprint() {
+			return nil, errors.New("proof recorder belongs to a different puzzle")
+		}
+		if start > 0 {
+			return nil, fmt.Errorf("a proof of the solve needs it from the start, not resumed after %d squarings", start)
+		}
+		proofAt = opts.Proof.next()
+	}
+
+	if opts.PinThread {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+	if opts.GCPercent != 0 {
+		defer debug.SetGCPercent(debug.SetGCPercent(opts.GCPercent))
+	}
+	if opts.MemoryLimit > 0 {
+		defer debug.SetMemoryLimit(debug.SetMemoryLimit(opts.MemoryLimit))
+	}
+
+	var reports chan uint64
+	var reporterDone chan struct{}
+	strategy := opts.ProgressStrategy
+	if strategy == nil {
+		strategy = DefaultProgressStrategy
+	}
+	lastReport := time.Now()
+
+	// A fixed step is counted by the loop itself; any other strategy is
+	// consulted every controlStep squarings, so that the loop stays a bare
+	// modular squaring in between
+	step, fixed := strategy.(FixedStep)
+	reportEvery := uint64(step)
+	if !fixed {
+		reportEvery = controlStep
+	} else if reportEvery == 0 {
+		reportEvery = 1
+	}
+	nextReport := (start/reportEvery + 1) * reportEvery
+	if opts.Progress != nil {
+		reports = make(chan uint64, 1)
+		reporterDone = make(chan struct{})
+		go func() {
+			defer close(reporterDone)
+			for done := range reports {
+				opts.Progress(done)
+			}
+		}()
+	}
+
+	var checkpoints chan SolvingState
+	var checkpointerDone chan struct{}
+	if opts.Checkpoint != nil {
+		checkpoints = make(chan SolvingState, 1)
+		checkpointerDone = make(chan struct{})
+		go func() {
+			defer close(checkpointerDone)
+			for state := range checkpoints {
+				opts.Checkpoint(state)
+			}
+		}()
+	}
+
+	var snapshots chan SolvingState
+	var snapshotterDone chan struct{}
+	interval := opts.SnapshotInterval
+	if interval == 0 {
+		interval = DefaultSnapshotInterval
+	}
+	nextSnapshot := (start/interval + 1) * interval
+	if opts.Snapshot != nil {
+		snapshots = make(chan SolvingState, 4)
+		snapshotterDone = make(chan struct{})
+		go func() {
+			defer close(snapshotterDone)
+			for state := range snapshots {
+				opts.Snapshot(state)
+			}
+		}()
+	}
+
+	finish := func() {
+		if reports != nil {
+			close(reports)
+			<-reporterDone
+		}
+		if checkpoints != nil {
+			close(checkpoints)
+			<-checkpointerDone
+		}
+		if snapshots != nil {
+			close(snapshots)
+			<-snapshotterDone
+		}
+	}
+
+	square := new(big.Int)
+	quotient := new(big.Int)
+	modulus := p.N
+	ctl := opts.Control
+	throttle := opts.Throttle
+	if throttle != nil {
+		throttle.start()
+	}
+
+	for i := start; i < p.T; i++ {
+		if ctl != nil && i%controlStep == 0 && ctl.pending() {
+			if stop := ctl.handle(p, result, i, checkpoints); stop {
+				finish()
+				return nil, ErrSolveStopped
+			}
+			if throttle != nil {
+				// A pause is not work to make up for
+				throttle.start()
+			}
+		}
+		if throttle != nil && i%controlStep == 0 && i > start {
+			throttle.pace()
+		}
+
+		// result = result^2 mod N, reusing the scratch integers
+		square.Mul(result, result)
+		quotient.QuoRem(square, modulus, result)
+
+		if proofAt != 0 && i+1 == proofAt {
+			opts.Proof.record(result)
+			proofAt = opts.Proof.next()
+		}
+
+		if snapshots != nil && i+1 == nextSnapshot {
+			snapshots <- snapshot(p, result, i+1)
+			nextSnapshot += interval
+		}
+
+		if reports != nil && i+1 == nextReport {
+			nextReport += reportEvery
+			if i+1 != p.T && (fixed || strategy.ShouldReport(i+1, p.T, time.Since(lastReport))) {
+				// Never block the loop: if the reporter is still busy with
+				// the previous value, skip this one.
+				select {
+				case reports <- i + 1:
+					lastReport = time.Now()
+				default:
+				}
+			}
+		}
+	}
+
+	if throttle != nil {
+		throttle.account()
+	}
+	if reports != nil && p.T > 0 {
+		reports <- p.T
+	}
+	finish()
+	return result, nil
+}
+
+// SolvingState is a snapshot of a solve in progress: Result is G squared
+// Done times modulo N.  It is what checkpoint files hold.
+type SolvingState struct {
+	Puzzle  Puzzle   // N, G and T of the puzzle being solved
+	Result  *big.Int // intermediate value after Done squarings
+	Done    uint64
+	Updated time.Time // when the snapshot was taken
+}
+
+// Matches reports whether the state is a valid starting point for p.
+func (s *SolvingState) Matches(p Puzzle) error {
+	if s.Puzzle.N == nil || s.Puzzle.G == nil || s.Result == nil {
+		return errors.New("incomplete solving state")
+	}
+	if s.Puzzle.Fingerprint() != p.Fingerprint() {
+		// Say what changed, typically the file having been encrypted again
+		switch {
+		case s.Puzzle.N.Cmp(p.N) != 0:
+			return errors.New("solving state belongs to a different puzzle (another modulus)")
+		case s.Puzzle.G.Cmp(p.G) != 0:
+			return errors.New("solving state belongs to a different puzzle (another base; for a passphrase file, another passphrase)")
+		default:
+			return fmt.Errorf("solving state belongs to a different puzzle (work factor %d, not %d)", s.Puzzle.T, p.T)
+		}
+	}
+	if s.Done > p.T {
+		return fmt.Errorf("solving state is past the end of the puzzle (%d > %d squarings)", s.Done, p.T)
+	}
+	if s.Result.Sign() < 0 || s.Result.Cmp(p.N) >= 0 {
+		return errors.New("solving state holds a value outside the modulus")
+	}
+	return nil
+}
@@ -0,0 +1,367 @@
+package crypto
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// solverTestPuzzle returns a real 2048-bit puzzle so the squaring loop runs
+// on multi-word integers, as it does in production.
+func solverTestPuzzle(t testing.TB, work uint64) Puzzle {
+	p, _, err := GeneratePuzzle(work, nil, DefaultModulusBits)
+	if err != nil {
+		t.Fatalf("GeneratePuzzle failed: %v", err)
+	}
+	return p
+}
+
+// TestSolveOptionsDoNotChangeResult checks that pinning and GC tuning leave
+// the solution unchanged.
+func TestSolveOptionsDoNotChangeResult(t *testing.T) {
+	p := solverTestPuzzle(t, 5000)
+
+	cases := map[string]SolveOptions{
+		"default":      {},
+		"pinned":       {PinThread: true},
+		"gc_tuned":     {GCPercent: 400, MemoryLimit: 1 << 30},
+		"gc_disabled":  {GCPercent: -1},
+		"all_together": {PinThread: true, GCPercent: 400, Progress: func(uint64) {}},
+	}
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			if got, err := SolvePuzzleWithOptions(p, opts); err != nil || got.Cmp(p.Target) != 0 {
+				t.Fatalf("wrong solution with options %+v", opts)
+			}
+		})
+	}
+}
+
+// TestSolveProgressSlowCallback checks that a slow progress callback sees
+// monotonic reports and always receives the final count before the solve
+// returns.
+func TestSolveProgressSlowCallback(t *testing.T) {
+	p := Puzzle{N: big.NewInt(1000003), G: big.NewInt(3), T: 5*progressStep + 7}
+
+	var mu sync.Mutex
+	var reports []uint64
+	SolvePuzzleWithOptions(p, SolveOptions{Progress: func(done uint64) {
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		reports = append(reports, done)
+		mu.Unlock()
+	}})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reports) == 0 {
+		t.Fatal("progress callback never invoked")
+	}
+	for i := 1; i < len(reports); i++ {
+		if reports[i] <= reports[i-1] {
+			t.Fatalf("progress not monotonic: %v", reports)
+		}
+	}
+	if last := reports[len(reports)-1]; last != p.T {
+		t.Fatalf("final report = %d, want %d", last, p.T)
+	}
+}
+
+// TestSolveLoopDoesNotAllocate checks that the number of allocations does not
+// grow with the work factor, i.e. the squaring loop itself never allocates.
+func TestSolveLoopDoesNotAllocate(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts are unreliable under the race detector")
+	}
+	small := solverTestPuzzle(t, 10)
+	large := small
+	large.T = 2000
+
+	allocs := func(p Puzzle) float64 {
+		return testing.AllocsPerRun(5, func() { SolvePuzzleWithOptions(p, SolveOptions{Control: &SolveControl{}}) })
+	}
+	if a, b := allocs(small), allocs(large); b > a {
+		t.Fatalf("allocations grow with work factor: %.0f for T=%d, %.0f for T=%d", a, small.T, b, large.T)
+	}
+}
+
+// TestSolveStopAndResume stops a solve part way through and resumes it from
+// the final checkpoint, which must give the same solution.
+func TestSolveStopAndResume(t *testing.T) {
+	p := Puzzle{N: big.NewInt(1000003), G: big.NewInt(3), T: 3*progressStep + 11}
+	want := solve(t, p)
+
+	ctl := &SolveControl{}
+	var states []SolvingState
+	_, err := SolvePuzzleWithOptions(p, SolveOptions{
+		Control: ctl,
+		Progress: func(done uint64) {
+			if done >= progressStep {
+				ctl.Stop()
+			}
+		},
+		Checkpoint: func(state SolvingState) { states = append(states, state) },
+	})
+	if err != ErrSolveStopped {
+		t.Fatalf("expected ErrSolveStopped, got %v", err)
+	}
+	if len(states) != 1 {
+		t.Fatalf("expected one final checkpoint, got %d", len(states))
+	}
+	state := states[0]
+	if state.Done == 0 || state.Done >= p.T || state.Done%controlStep != 0 {
+		t.Fatalf("unexpected checkpoint position %d", state.Done)
+	}
+
+	got, err := SolvePuzzleWithOptions(p, SolveOptions{Resume: &state})
+	if err != nil {
+		t.Fatalf("resume failed: %v", err)
+	}
+	if got.Cmp(want) != 0 {
+		t.Fatal("resumed solve gave a different solution")
+	}
+
+	// A state for another puzzle is refused, saying what differs
+	other := p
+	other.T++
+	if _, err := SolvePuzzleWithOptions(other, SolveOptions{Resume: &state}); err == nil || !strings.Contains(err.Error(), "work factor") {
+		t.Fatalf("resumed from a checkpoint of a different work factor: %v", err)
+	}
+	other = p
+	other.G = new(big.Int).Add(p.G, big.NewInt(1))
+	if _, err := SolvePuzzleWithOptions(other, SolveOptions{Resume: &state}); err == nil || !strings.Contains(err.Error(), "another base") {
+		t.Fatalf("resumed from a checkpoint of a different base: %v", err)
+	}
+}
+
+// TestSolvePauseAndCheckpoint pauses a solve, takes a checkpoint while paused
+// and resumes it.
+func TestSolvePauseAndCheckpoint(t *testing.T) {
+	p := Puzzle{N: big.NewInt(1000003), G: big.NewInt(3), T: 2 * progressStep}
+	want := solve(t, p)
+
+	ctl := &SolveControl{}
+	ctl.Pause()
+	ctl.RequestCheckpoint()
+
+	checkpoints := make(chan SolvingState, 4)
+	type outcome struct {
+		target *big.Int
+		err    error
+	}
+	solved := make(chan outcome, 1)
+	go func() {
+		target, err := SolvePuzzleWithOptions(p, SolveOptions{
+			Control:    ctl,
+			Checkpoint: func(state SolvingState) { checkpoints <- state },
+		})
+		solved <- outcome{target, err}
+	}()
+
+	// The checkpoint is served before the solver parks on the pause
+	state := <-checkpoints
+	if state.Done != 0 || state.Result.Cmp(p.G) != 0 {
+		t.Fatalf("checkpoint at start has done=%d", state.Done)
+	}
+	select {
+	case <-solved:
+		t.Fatal("paused solve finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if !ctl.Paused() || ctl.PausedFor() <= 0 {
+		t.Fatal("control does not report the pause")
+	}
+
+	if ctl.TogglePause() {
+		t.Fatal("TogglePause did not resume")
+	}
+	res := <-solved
+	if res.err != nil || res.target.Cmp(want) != 0 {
+		t.Fatalf("solve after pause: %v", res.err)
+	}
+}
+
+// TestStopAfterLeavesOutPauses checks that a solve deadline only counts the
+// time the solve runs.
+func TestStopAfterLeavesOutPauses(t *testing.T) {
+	stopped := func(c *SolveControl) bool { return c.flags.Load()&ctlStop != 0 }
+
+	ctl := &SolveControl{}
+	ctl.Pause()
+	timeUp := ctl.StopAfter(20 * time.Millisecond)
+	time.Sleep(60 * time.Millisecond)
+	if stopped(ctl) {
+		t.Fatal("deadline counted time spent paused")
+	}
+	ctl.Resume()
+	for start := time.Now(); !stopped(ctl); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("deadline never stopped the solve")
+		}
+	}
+	if !timeUp() {
+		t.Error("cancel does not report the stop")
+	}
+
+	// A deadline cancelled in time stops nothing
+	ctl = &SolveControl{}
+	if ctl.StopAfter(time.Hour)() || stopped(ctl) {
+		t.Error("cancelled deadline stopped the solve")
+	}
+}
+
+// TestStopWhenDone checks that a done context stops the solve and that an
+// unwatched one stops nothing.
+func TestStopWhenDone(t *testing.T) {
+	p := solverTestPuzzle(t, 1<<30)
+	ctx, cancel := context.WithCancel(context.Background())
+	ctl := &SolveControl{}
+	cancelled := ctl.StopWhenDone(ctx)
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := SolvePuzzleWithOptions(p, SolveOptions{Control: ctl}); err != ErrSolveStopped {
+		t.Fatalf("expected ErrSolveStopped, got %v", err)
+	}
+	if !cancelled() {
+		t.Error("cancel does not report the stop")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	ctl = &SolveControl{}
+	if ctl.StopWhenDone(ctx)() {
+		t.Error("an unwatched context reported a stop")
+	}
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	if ctl.flags.Load()&ctlStop != 0 {
+		t.Error("an unwatched context stopped the solve")
+	}
+}
+
+// TestThrottledSolve checks that a throttled solve finds the same target
+// and sleeps for about its share of the time.  The bounds are loose, for
+// busy test machines.
+func TestThrottledSolve(t *testing.T) {
+	p := solverTestPuzzle(t, 0)
+	p.T = 50000
+	want := solve(t, p)
+
+	throttle, err := NewCPUThrottle(0.5)
+	if err != nil {
+		t.Fatalf("NewCPUThrottle failed: %v", err)
+	}
+	got, err := SolvePuzzleWithOptions(p, SolveOptions{Throttle: throttle})
+	if err != nil {
+		t.Fatalf("throttled solve failed: %v", err)
+	}
+	if got.Cmp(want) != 0 {
+		t.Fatal("throttling changed the solution")
+	}
+	if u := throttle.Utilization(); u < 0.3 || u > 0.7 {
+		t.Errorf("throttled to 50%%, used %.1f%% of a core", u*100)
+	}
+	if throttle.Slept() == 0 {
+		t.Error("throttled solve never slept")
+	}
+
+	for _, limit := range []float64{0, -0.5, 1.5} {
+		if _, err := NewCPUThrottle(limit); err == nil {
+			t.Errorf("accepted a CPU limit of %g", limit)
+		}
+	}
+}
+
+func benchmarkSolve(b *testing.B, opts SolveOptions) {
+	p := solverTestPuzzle(b, 0)
+	p.T = 10000
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		SolvePuzzleWithOptions(p, opts)
+	}
+	b.ReportMetric(float64(p.T)*float64(b.N)/b.Elapsed().Seconds(), "squarings/s")
+}
+
+func BenchmarkSolvePuzzle(b *testing.B)       { benchmarkSolve(b, SolveOptions{}) }
+func BenchmarkSolvePuzzlePinned(b *testing.B) { benchmarkSolve(b, SolveOptions{PinThread: true}) }
+func BenchmarkSolvePuzzleGCTuned(b *testing.B) {
+	benchmarkSolve(b, SolveOptions{PinThread: true, GCPercent: 400})
+}
+
+// BenchmarkSequentialSquaring measures the allocating helper for comparison
+// with the in-place loop used by the solver.
+func BenchmarkSequentialSquaring(b *testing.B) {
+	p := solverTestPuzzle(b, 0)
+	x := new(big.Int).Set(p.G)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		x = SequentialSquaring(x, p.N)
+	}
+}
+
+func BenchmarkSolvePuzzleProgress(b *testing.B) {
+	benchmarkSolve(b, SolveOptions{Progress: func(uint64) {}})
+}
+
+// TestSolveSnapshots checks that snapshots arrive at every interval, each a
+// residue modulo N that squares into the next, also when resuming.
+func TestSolveSnapshots(t *testing.T) {
+	p := solverTestPuzzle(t, 5500)
+	const interval = 1000
+
+	var states []SolvingState
+	got, err := SolvePuzzleWithOptions(p, SolveOptions{
+		Snapshot:         func(state SolvingState) { states = append(states, state) },
+		SnapshotInterval: interval,
+	})
+	if err != nil || got.Cmp(p.Target) != 0 {
+		t.Fatalf("wrong solution with snapshots: %v", err)
+	}
+	if len(states) != 5 {
+		t.Fatalf("got %d snapshots, want 5", len(states))
+	}
+
+	one := big.NewInt(1)
+	prev := SolvingState{Result: p.G}
+	for i, state := range states {
+		if want := uint64(i+1) * interval; state.Done != want {
+			t.Fatalf("snapshot %d after %d squarings, want %d", i, state.Done, want)
+		}
+		if state.Result.Sign() <= 0 || state.Result.Cmp(p.N) >= 0 {
+			t.Fatalf("snapshot %d is not reduced modulo N", i)
+		}
+		if new(big.Int).GCD(nil, nil, state.Result, p.N).Cmp(one) != 0 {
+			t.Fatalf("snapshot %d is not a unit modulo N", i)
+		}
+		if err := state.Matches(p); err != nil {
+			t.Fatalf("snapshot %d does not match the puzzle: %v", i, err)
+		}
+
+		// An observer re-derives it from the previous one
+		check := Puzzle{N: p.N, G: prev.Result, T: state.Done - prev.Done}
+		if solve(t, check).Cmp(state.Result) != 0 {
+			t.Fatalf("snapshot %d does not follow from snapshot %d", i, i-1)
+		}
+		prev = state
+	}
+
+	// Resuming keeps to the same positions
+	var resumed []SolvingState
+	start := SolvingState{Puzzle: p, Result: solve(t, Puzzle{N: p.N, G: p.G, T: 1500}), Done: 1500}
+	if _, err := SolvePuzzleWithOptions(p, SolveOptions{
+		Resume:           &start,
+		Snapshot:         func(state SolvingState) { resumed = append(resumed, state) },
+		SnapshotInterval: interval,
+	}); err != nil {
+		t.Fatalf("resume failed: %v", err)
+	}
+	if len(resumed) != 4 {
+		t.Fatalf("got %d snapshots after resuming, want 4", len(resumed))
+	}
+	if resumed[0].Done != 2000 || resumed[0].Result.Cmp(states[1].Result) != 0 {
+		t.Fatalf("first snapshot after resuming is after %d squarings or differs", resumed[0].Done)
+	}
+}
@@ -0,0 +1,490 @@
+package crypto
+
+// stream.go implements chunked ChaCha20‑Poly1305 encryption for payloads that
+// are too large to seal in one shot.
+//
+// The stream starts with a 7‑byte random nonce prefix followed by a sequence of
+// independently sealed chunks.  Each chunk i is sealed with the nonce
+//
+//	prefix (7 bytes) || i (4 bytes, big‑endian) || last (1 byte)
+//
+// where `last` is 1 only for the final chunk (the STREAM construction).  The
+// counter makes reordering detectable and the final flag makes truncation at a
+// chunk boundary detectable.  An empty plaintext is encoded as a single empty
+// final chunk.
+//
+// Because every chunk has its own nonce, sealing and opening are independent
+// per chunk and are spread over a pool of workers.  Output order is preserved
+// by a bounded reordering buffer, so the bytes produced are identical to the
+// serial path for the same key and nonce prefix.
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// DefaultChunkSize is the plaintext size of each chunk in a stream.
+	DefaultChunkSize = 64 * 1024
+
+	// StreamNoncePrefixSize is the length of the random prefix that starts
+	// every stream.
+	StreamNoncePrefixSize = 7
+
+	// StreamChunkOverhead is the number of bytes each sealed chunk adds.
+	StreamChunkOverhead = chacha20poly1305.Overhead
+
+	// MinChunkSize and MaxChunkSize bound the chunk sizes accepted for
+	// encrypted files: smaller chunks waste space on tags, larger ones cost
+	// memory per worker.
+	MinChunkSize = 4 * 1024
+	MaxChunkSize = 64 * 1024 * 1024
+
+	// maxStreamChunks is the number of chunks addressable by the 32-bit counter.
+	maxStreamChunks = 1 << 32
+)
+
+// ValidateChunkSize checks that a chunk size is within the bounds accepted
+// for encrypted files.
+func ValidateChunkSize(chunkSize int) error {
+	if chunkSize < MinChunkSize || chunkSize > MaxChunkSize {
+		return fmt.Errorf("chunk size %d is outside the supported range %d to %d bytes", chunkSize, MinChunkSize, MaxChunkSize)
+	}
+	return nil
+}
+
+// StreamOptions configures EncryptStreamWithOptions and DecryptStreamWithOptions.
+type StreamOptions struct {
+	ChunkSize   int    // plaintext bytes per chunk (DefaultChunkSize if zero)
+	Concurrency int    // number of sealing/opening workers (GOMAXPROCS if zero)
+	NoncePrefix []byte // fixed nonce prefix for deterministic output (random if nil, encrypt only)
+
+	// Skip, when decrypting, passes over this many chunks after the nonce
+	// prefix without opening them and starts the output at the next one,
+	// e.g. to finish an output whose first chunks were already written.  A
+	// reader that is an io.Seeker is seeked past them.
+	Skip uint64
+}
+
+// streamChunk is one unit of work flowing through the chunk pipeline.
+type streamChunk struct {
+	index uint64
+	last  bool
+	in    []byte
+	out   []byte
+	err   error
+}
+
+// EncryptStream encrypts r to w in chunks of DefaultChunkSize using all
+// available CPUs.
+func EncryptStream(key [32]byte, r io.Reader, w io.Writer) error {
+	return EncryptStreamWithOptions(key, r, w, StreamOptions{})
+}
+
+// DecryptStream reverses EncryptStream, writing the plaintext to w.  Output is
+// written as chunks are authenticated, so on error w may hold a prefix of the
+// plaintext and callers should discard it.
+func DecryptStream(key [32]byte, r io.Reader, w io.Writer) error {
+	return DecryptStreamWithOptions(key, r, w, StreamOptions{})
+}
+
+// EncryptStreamWithOptions encrypts r to w using the given chunk size,
+// concurrency and (optionally) a fixed nonce prefix.
+func EncryptStreamWithOptions(key [32]byte, r io.Reader, w io.Writer, opts StreamOptions) error {
+	chunkSize, workers, err := opts.resolve()
+	if err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		return err
+	}
+
+	prefix := opts.NoncePrefix
+	if prefix == nil {
+		prefix = make([]byte, StreamNoncePrefixSize)
+		if _, err := rand.Read(prefix); err != nil {
+			return err
+		}
+	}
+	if len(prefix) != StreamNoncePrefixSize {
+		return fmt.Errorf("stream nonce prefix must be %d bytes", StreamNoncePrefixSize)
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return err
+	}
+
+	seal := func(c *streamChunk) {
+		nonce := streamNonce(prefix, c.index, c.last)
+		c.out = aead.Seal(make([]byte, 0, len(c.in)+aead.Overhead()), nonce, c.in, nil)
+	}
+	return runChunkPipeline(newChunkReader(r, chunkSize), workers, seal, w)
+}
+
+// DecryptStreamWithOptions decrypts a stream produced by EncryptStreamWithOptions.
+// opts.ChunkSize must match the value used for encryption.
+func DecryptStreamWithOptions(key [32]byte, r io.Reader, w io.Writer, opts StreamOptions) error {
+	chunkSize, workers, err := opts.resolve()
+	if err != nil {
+		return err
+	}
+	aead, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		return err
+	}
+
+	prefix := make([]byte, StreamNoncePrefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return errors.New("ciphertext too short")
+	}
+	if opts.Skip > 0 {
+		if err := skipChunks(r, opts.Skip, chunkSize+aead.Overhead()); err != nil {
+			return err
+		}
+	}
+
+	open := func(c *streamChunk) {
+		if len(c.in) < aead.Overhead() {
+			c.err = errors.New("truncated stream chunk")
+			return
+		}
+		nonce := streamNonce(prefix, c.index, c.last)
+		c.out, c.err = aead.Open(make([]byte, 0, len(c.in)-aead.Overhead()), nonce, c.in, nil)
+		if c.err != nil {
+			c.err = fmt.Errorf("chunk %d: %w", c.index, c.err)
+		}
+	}
+	cr := newChunkReader(r, chunkSize+aead.Overhead())
+	cr.index = opts.Skip
+	return runChunkPipeline(cr, workers, open, w)
+}
+
+// skipChunks moves r past count sealed chunks of sealedSize bytes, all of
+// which must be there and be followed by at least one more byte, since a
+// stream always ends with a chunk.
+func skipChunks(r io.Reader, count uint64, sealedSize int) error {
+	if count >= maxStreamChunks {
+		return errors.New("stream exceeds maximum number of chunks")
+	}
+	n := int64(count) * int64(sealedSize)
+	if seeker, ok := r.(io.Seeker); ok {
+		cur, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if end-cur <= n {
+			return errors.New("stream ends before the chunks to skip")
+		}
+		_, err = seeker.Seek(cur+n, io.SeekStart)
+		return err
+	}
+	if copied, err := io.CopyN(io.Discard, r, n); err != nil {
+		if copied < n {
+			return errors.New("stream ends before the chunks to skip")
+		}
+		return err
+	}
+	return nil
+}
+
+// SealStreamChunk seals chunk index of a stream with the given nonce prefix,
+// exactly as EncryptStreamWithOptions seals it; last marks the final chunk.
+// It lets a stream be written out of order, e.g. while encrypting a file in
+// place.
+func SealStreamChunk(key [32]byte, prefix []byte, index uint64, last bool, plaintext []byte) ([]byte, error) {
+	if len(prefix) != StreamNoncePrefixSize {
+		return nil, fmt.Errorf("stream nonce prefix must be %d bytes", StreamNoncePrefixSize)
+	}
+	if index >= maxStreamChunks {
+		return nil, errors.New("stream exceeds maximum number of chunks")
+	}
+	aead, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(make([]byte, 0, len(plaintext)+aead.Overhead()), streamNonce(prefix, index, last), plaintext, nil), nil
+}
+
+// OpenStreamChunk reverses SealStreamChunk.
+func OpenStreamChunk(key [32]byte, prefix []byte, index uint64, last bool, sealed []byte) ([]byte, error) {
+	if len(prefix) != StreamNoncePrefixSize {
+		return nil, fmt.Errorf("stream nonce prefix must be %d bytes", StreamNoncePrefixSize)
+	}
+	aead, err := chacha20poly1305.New(key[:])
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.Overhead() {
+		return nil, errors.New("truncated stream chunk")
+	}
+	plaintext, err := aead.Open(make([]byte, 0, len(sealed)-aead.Overhead()), streamNonce(prefix, index, last), sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d: %w", index, err)
+	}
+	return plaintext, nil
+}
+
+// StreamCiphertextSize returns the exact number of bytes EncryptStream emits
+// for a plaintext of the given size.
+func StreamCiphertextSize(plaintextSize int64, chunkSize int) int64 {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	chunks := (plaintextSize + int64(chunkSize) - 1) / int64(chunkSize)
+	if chunks == 0 {
+		chunks = 1 // empty plaintext is a single empty final chunk
+	}
+	return StreamNoncePrefixSize + plaintextSize + chunks*StreamChunkOverhead
+}
+
+// StreamPlaintextSize is the inverse of StreamCiphertextSize.  It fails if
+// no plaintext size produces a stream of exactly ciphertextSize bytes.
+func StreamPlaintextSize(ciphertextSize int64, chunkSize int) (int64, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	body := ciphertextSize - StreamNoncePrefixSize
+	if body < StreamChunkOverhead {
+		return 0, errors.New("stream too short")
+	}
+	sealed := int64(chunkSize) + StreamChunkOverhead
+	full, rest := body/sealed, body%sealed
+	if rest == 0 {
+		return full * int64(chunkSize), nil
+	}
+	if rest < StreamChunkOverhead {
+		return 0, errors.New("stream ends with a truncated chunk")
+	}
+	return full*int64(chunkSize) + rest - StreamChunkOverhead, nil
+}
+
+// resolve fills in defaults and validates the options.
+func (o StreamOptions) resolve() (chunkSize, workers int, err error) {
+	chunkSize = o.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if chunkSize < 0 {
+		return 0, 0, errors.New("chunk size must be positive")
+	}
+	workers = o.Concurrency
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return chunkSize, workers, nil
+}
+
+// streamNonce builds the per-chunk nonce described at the top of this file.
+func streamNonce(prefix []byte, index uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[StreamNoncePrefixSize:], uint32(index))
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// chunkReader splits a reader into fixed-size chunks, reading one chunk ahead
+// so that it can tell which chunk is the last.
+type chunkReader struct {
+	r     io.Reader
+	size  int
+	index uint64
+	ahead []byte
+	eof   bool
+	done  bool
+}
+
+func newChunkReader(r io.Reader, size int) *chunkReader {
+	return &chunkReader{r: r, size: size}
+}
+
+// fill reads the next chunk into a fresh buffer.  It reports io.EOF only when
+// no bytes at all were available.
+func (cr *chunkReader) fill() ([]byte, error) {
+	buf := make([]byte, cr.size)
+	n, err := io.ReadFull(cr.r, buf)
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		cr.eof = true
+		return buf[:n], nil
+	case err == io.EOF:
+		cr.eof = true
+		return nil, io.EOF
+	case err != nil:
+		return nil, err
+	}
+	return buf, nil
+}
+
+// next returns the next chunk, or nil when the stream is exhausted.
+func (cr *chunkReader) next() (*streamChunk, error) {
+	if cr.done {
+		return nil, nil
+	}
+
+	cur := cr.ahead
+	cr.ahead = nil
+	if cur == nil {
+		if cr.eof && cr.index > 0 {
+			cr.done = true
+			return nil, nil
+		}
+		var err error
+		cur, err = cr.fill()
+		if err == io.EOF {
+			cur = []byte{} // empty stream: one empty final chunk
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	last := cr.eof
+	if !last {
+		next, err := cr.fill()
+		if err == io.EOF {
+			last = true
+		} else if err != nil {
+			return nil, err
+		} else {
+			cr.ahead = next
+		}
+	}
+
+	if cr.index >= maxStreamChunks {
+		return nil, errors.New("stream exceeds maximum number of chunks")
+	}
+	c := &streamChunk{index: cr.index, last: last, in: cur}
+	cr.index++
+	if last {
+		cr.done = true
+	}
+	return c, nil
+}
+
+// runChunkPipeline reads chunks from cr, transforms each with process on a
+// pool of workers, and writes the results to w in their original order.  At
+// most 2×workers chunks are in flight at once, which bounds both memory use
+// and the size of the reordering buffer.
+func runChunkPipeline(cr *chunkReader, workers int, process func(*streamChunk), w io.Writer) error {
+	if workers == 1 {
+		for {
+			c, err := cr.next()
+			if err != nil {
+				return err
+			}
+			if c == nil {
+				return nil
+			}
+			process(c)
+			if c.err != nil {
+				return c.err
+			}
+			if _, err := w.Write(c.out); err != nil {
+				return err
+			}
+		}
+	}
+
+	jobs := make(chan *streamChunk)
+	results := make(chan *streamChunk, workers)
+	tokens := make(chan struct{}, 2*workers)
+	quit := make(chan struct{})
+	var quitOnce sync.Once
+	stop := func() { quitOnce.Do(func() { close(quit) }) }
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range jobs {
+				process(c)
+				results <- c
+			}
+		}()
+	}
+
+	// The writer emits chunks in index order, from the reader's first one.
+	// After a failure it keeps draining results (releasing their tokens) so
+	// that nothing blocks.
+	first := cr.index
+	writeErr := make(chan error, 1)
+	go func() {
+		var firstErr error
+		pending := make(map[uint64]*streamChunk)
+		nextIndex := first
+		for c := range results {
+			if firstErr != nil {
+				<-tokens
+				continue
+			}
+			pending[c.index] = c
+			for {
+				ready, ok := pending[nextIndex]
+				if !ok {
+					break
+				}
+				delete(pending, nextIndex)
+				nextIndex++
+				<-tokens
+				if ready.err != nil {
+					firstErr = ready.err
+				} else if _, err := w.Write(ready.out); err != nil {
+					firstErr = err
+				}
+				if firstErr != nil {
+					stop()
+					for range pending {
+						<-tokens
+					}
+					pending = nil
+					break
+				}
+			}
+		}
+		writeErr <- firstErr
+	}()
+
+	var readErr error
+read:
+	for {
+		select {
+		case <-quit:
+			break read
+		default:
+		}
+		select {
+		case tokens <- struct{}{}:
+		case <-quit:
+			break read
+		}
+		c, err := cr.next()
+		if err != nil || c == nil {
+			<-tokens
+			readErr = err
+			break
+		}
+		jobs <- c
+	}
+	close(jobs)
+	wg.Wait()
+	close(results)
+
+	if err := <-writeErr; err != nil {
+		return err
+	}
+	return readErr
+}
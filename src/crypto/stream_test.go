@@ -0,0 +1,234 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+)
+
+var streamTestKey = [32]byte{9, 8, 7, 6, 5, 4, 3, 2, 1, 0, 1, 2, 3, 4, 5, 6,
+	7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22}
+
+func randomBytes(t testing.TB, n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatalf("rand.Read failed: %v", err)
+	}
+	return b
+}
+
+// TestStreamRoundTrip encrypts and decrypts payloads around the chunk
+// boundaries with both the serial and the parallel pipeline.
+func TestStreamRoundTrip(t *testing.T) {
+	const chunk = 1024
+	sizes := []int{0, 1, chunk - 1, chunk, chunk + 1, 2 * chunk, 7*chunk + 5}
+
+	for _, size := range sizes {
+		for _, workers := range []int{1, 4} {
+			t.Run(fmt.Sprintf("size_%d_workers_%d", size, workers), func(t *testing.T) {
+				plaintext := randomBytes(t, size)
+				opts := StreamOptions{ChunkSize: chunk, Concurrency: workers}
+
+				var ct bytes.Buffer
+				if err := EncryptStreamWithOptions(streamTestKey, bytes.NewReader(plaintext), &ct, opts); err != nil {
+					t.Fatalf("EncryptStream failed: %v", err)
+				}
+				if int64(ct.Len()) != StreamCiphertextSize(int64(size), chunk) {
+					t.Fatalf("ciphertext is %d bytes, StreamCiphertextSize says %d",
+						ct.Len(), StreamCiphertextSize(int64(size), chunk))
+				}
+				if got, err := StreamPlaintextSize(int64(ct.Len()), chunk); err != nil || got != int64(size) {
+					t.Fatalf("StreamPlaintextSize = %d, %v; want %d", got, err, size)
+				}
+
+				var pt bytes.Buffer
+				if err := DecryptStreamWithOptions(streamTestKey, &ct, &pt, opts); err != nil {
+					t.Fatalf("DecryptStream failed: %v", err)
+				}
+				if !bytes.Equal(pt.Bytes(), plaintext) {
+					t.Fatalf("round trip mismatch for %d bytes", size)
+				}
+			})
+		}
+	}
+}
+
+// TestStreamParallelMatchesSerial checks that the worker pool emits exactly the
+// same bytes as the serial path when the nonce prefix is fixed, and that
+// either pipeline opens what the other sealed.
+func TestStreamParallelMatchesSerial(t *testing.T) {
+	plaintext := randomBytes(t, 300*1024+17)
+	prefix := []byte{1, 2, 3, 4, 5, 6, 7}
+
+	var serial, parallel bytes.Buffer
+	if err := EncryptStreamWithOptions(streamTestKey, bytes.NewReader(plaintext), &serial,
+		StreamOptions{ChunkSize: 4096, Concurrency: 1, NoncePrefix: prefix}); err != nil {
+		t.Fatalf("serial EncryptStream failed: %v", err)
+	}
+	if err := EncryptStreamWithOptions(streamTestKey, bytes.NewReader(plaintext), &parallel,
+		StreamOptions{ChunkSize: 4096, Concurrency: 8, NoncePrefix: prefix}); err != nil {
+		t.Fatalf("parallel EncryptStream failed: %v", err)
+	}
+	if !bytes.Equal(serial.Bytes(), parallel.Bytes()) {
+		t.Fatalf("parallel output differs from serial output")
+	}
+
+	for _, workers := range []int{1, 8} {
+		var pt bytes.Buffer
+		if err := DecryptStreamWithOptions(streamTestKey, bytes.NewReader(parallel.Bytes()), &pt,
+			StreamOptions{ChunkSize: 4096, Concurrency: workers}); err != nil {
+			t.Fatalf("DecryptStream with %d workers failed: %v", workers, err)
+		}
+		if !bytes.Equal(pt.Bytes(), plaintext) {
+			t.Fatalf("DecryptStream with %d workers: round trip mismatch", workers)
+		}
+	}
+}
+
+// TestStreamDetectsTampering covers truncation, reordering and bit flips.
+func TestStreamDetectsTampering(t *testing.T) {
+	const chunk = 512
+	plaintext := randomBytes(t, 4*chunk)
+	opts := StreamOptions{ChunkSize: chunk, Concurrency: 2}
+
+	var ct bytes.Buffer
+	if err := EncryptStreamWithOptions(streamTestKey, bytes.NewReader(plaintext), &ct, opts); err != nil {
+		t.Fatalf("EncryptStream failed: %v", err)
+	}
+	sealed := chunk + StreamChunkOverhead
+	data := ct.Bytes()
+
+	tests := map[string][]byte{
+		"truncated_last_chunk": data[:len(data)-sealed],
+		"truncated_mid_chunk":  data[:len(data)-10],
+		"prefix_only":          data[:StreamNoncePrefixSize],
+	}
+
+	swapped := append([]byte(nil), data...)
+	first := swapped[StreamNoncePrefixSize : StreamNoncePrefixSize+sealed]
+	second := append([]byte(nil), swapped[StreamNoncePrefixSize+sealed:StreamNoncePrefixSize+2*sealed]...)
+	copy(swapped[StreamNoncePrefixSize+sealed:], first)
+	copy(swapped[StreamNoncePrefixSize:], second)
+	tests["reordered_chunks"] = swapped
+
+	flipped := append([]byte(nil), data...)
+	flipped[len(flipped)/2] ^= 0x01
+	tests["bit_flip"] = flipped
+
+	for name, tampered := range tests {
+		t.Run(name, func(t *testing.T) {
+			var pt bytes.Buffer
+			if err := DecryptStreamWithOptions(streamTestKey, bytes.NewReader(tampered), &pt, opts); err == nil {
+				t.Fatalf("tampered stream decrypted without error")
+			}
+		})
+	}
+
+	wrongKey := streamTestKey
+	wrongKey[0] ^= 0xFF
+	var pt bytes.Buffer
+	if err := DecryptStreamWithOptions(wrongKey, bytes.NewReader(data), &pt, opts); err == nil {
+		t.Fatalf("stream decrypted with the wrong key")
+	}
+}
+
+func benchmarkEncryptStream(b *testing.B, workers int) {
+	plaintext := randomBytes(b, 32<<20)
+	opts := StreamOptions{Concurrency: workers}
+
+	b.SetBytes(int64(len(plaintext)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out bytes.Buffer
+		out.Grow(len(plaintext) + len(plaintext)/64)
+		if err := EncryptStreamWithOptions(streamTestKey, bytes.NewReader(plaintext), &out, opts); err != nil {
+			b.Fatalf("EncryptStream failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkEncryptStreamSerial(b *testing.B)      { benchmarkEncryptStream(b, 1) }
+func BenchmarkEncryptStreamParallel2(b *testing.B)   { benchmarkEncryptStream(b, 2) }
+func BenchmarkEncryptStreamParallel4(b *testing.B)   { benchmarkEncryptStream(b, 4) }
+func BenchmarkEncryptStreamParallelMax(b *testing.B) { benchmarkEncryptStream(b, 0) }
+
+// TestStreamChunksMatchStream checks that chunks sealed one at a time, in
+// any order, make up the stream EncryptStreamWithOptions writes, and that
+// each opens on its own only at its own position.
+func TestStreamChunksMatchStream(t *testing.T) {
+	const chunk = 1024
+	prefix := []byte{1, 2, 3, 4, 5, 6, 7}
+	for _, size := range []int{0, chunk, 3*chunk + 9} {
+		plaintext := randomBytes(t, size)
+		var stream bytes.Buffer
+		if err := EncryptStreamWithOptions(streamTestKey, bytes.NewReader(plaintext), &stream,
+			StreamOptions{ChunkSize: chunk, NoncePrefix: prefix}); err != nil {
+			t.Fatalf("EncryptStream failed: %v", err)
+		}
+
+		n := max((size+chunk-1)/chunk, 1)
+		sealed := make([][]byte, n)
+		for i := n - 1; i >= 0; i-- {
+			var err error
+			sealed[i], err = SealStreamChunk(streamTestKey, prefix, uint64(i), i == n-1, plaintext[i*chunk:min((i+1)*chunk, size)])
+			if err != nil {
+				t.Fatalf("SealStreamChunk failed: %v", err)
+			}
+		}
+		if got := append(append([]byte(nil), prefix...), bytes.Join(sealed, nil)...); !bytes.Equal(got, stream.Bytes()) {
+			t.Fatalf("size %d: chunks sealed one at a time differ from the stream", size)
+		}
+
+		for i := range sealed {
+			got, err := OpenStreamChunk(streamTestKey, prefix, uint64(i), i == n-1, sealed[i])
+			if err != nil || !bytes.Equal(got, plaintext[i*chunk:min((i+1)*chunk, size)]) {
+				t.Fatalf("size %d: chunk %d did not open (%v)", size, i, err)
+			}
+			if _, err := OpenStreamChunk(streamTestKey, prefix, uint64(i), i != n-1, sealed[i]); err == nil {
+				t.Errorf("size %d: chunk %d opened with the wrong final flag", size, i)
+			}
+		}
+	}
+}
+
+// TestStreamSkip checks that decrypting with Skip outputs the plaintext from
+// that chunk on, whether or not the reader can seek, and that the stream
+// must go on past the chunks skipped.
+func TestStreamSkip(t *testing.T) {
+	const chunk = 1024
+	plaintext := randomBytes(t, 5*chunk+100)
+	var stream bytes.Buffer
+	if err := EncryptStreamWithOptions(streamTestKey, bytes.NewReader(plaintext), &stream, StreamOptions{ChunkSize: chunk}); err != nil {
+		t.Fatalf("EncryptStream failed: %v", err)
+	}
+
+	for skip := uint64(0); skip <= 5; skip++ {
+		for _, seekable := range []bool{true, false} {
+			var r io.Reader = bytes.NewReader(stream.Bytes())
+			if !seekable {
+				r = io.MultiReader(r)
+			}
+			var out bytes.Buffer
+			err := DecryptStreamWithOptions(streamTestKey, r, &out, StreamOptions{ChunkSize: chunk, Skip: skip, Concurrency: 2})
+			if err != nil {
+				t.Fatalf("skip %d (seekable %v): %v", skip, seekable, err)
+			}
+			if !bytes.Equal(out.Bytes(), plaintext[skip*chunk:]) {
+				t.Fatalf("skip %d (seekable %v): wrong plaintext", skip, seekable)
+			}
+		}
+	}
+
+	// Skipping every chunk leaves no final chunk to open
+	for _, seekable := range []bool{true, false} {
+		var r io.Reader = bytes.NewReader(stream.Bytes())
+		if !seekable {
+			r = io.MultiReader(r)
+		}
+		if err := DecryptStreamWithOptions(streamTestKey, r, io.Discard, StreamOptions{ChunkSize: chunk, Skip: 6}); err == nil {
+			t.Errorf("skipping every chunk succeeded (seekable %v)", seekable)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package crypto
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// throttleMinSleep is the shortest sleep a CPUThrottle takes: shorter
+// sleeps are owed until they add up, since the scheduler cannot keep them
+// accurately.
+const throttleMinSleep = 10 * time.Millisecond
+
+// CPUThrottle keeps a solve to a fraction of one core (see
+// SolveOptions.Throttle).  The solver measures how long each batch of
+// squarings took and sleeps in proportion between batches.  The squaring
+// loop runs on a single goroutine, so the time spent working is the CPU
+// time it takes.  Sleeps that overrun are paid back by working longer
+// before the next one, so the share used converges on the limit whatever
+// the timer resolution.  A throttle may pace several solves one after
+// another.
+type CPUThrottle struct {
+	limit float64
+
+	// Owned by the solving goroutine
+	last time.Time     // end of the last batch accounted for
+	owed time.Duration // sleep due but not yet taken (negative: overslept)
+
+	busy  atomic.Int64 // nanoseconds spent squaring
+	slept atomic.Int64 // nanoseconds spent sleeping
+}
+
+// NewCPUThrottle returns a throttle to limit, the fraction of one core a
+// solve may use, in (0, 1].  A limit of 1 never sleeps but still measures
+// the use.
+func NewCPUThrottle(limit float64) (*CPUThrottle, error) {
+	if !(limit > 0 && limit <= 1) {
+		return nil, fmt.Errorf("CPU limit must be more than 0%% and at most 100%% of one core, not %g%%", limit*100)
+	}
+	return &CPUThrottle{limit: limit}, nil
+}
+
+// Limit returns the fraction of one core the throttle allows.
+func (t *CPUThrottle) Limit() float64 {
+	return t.limit
+}
+
+// Utilization returns the fraction of one core the solves paced so far
+// used, not counting pauses, or 0 before any work.
+func (t *CPUThrottle) Utilization() float64 {
+	busy, slept := t.busy.Load(), t.slept.Load()
+	if busy == 0 {
+		return 0
+	}
+	return float64(busy) / float64(busy+slept)
+}
+
+// Slept returns the total time the throttle has held solves back.
+func (t *CPUThrottle) Slept() time.Duration {
+	return time.Duration(t.slept.Load())
+}
+
+// start begins accounting for a solve, or again after a pause, so the
+// time in between does not count as work.
+func (t *CPUThrottle) start() {
+	t.last = time.Now()
+}
+
+// pace accounts for the work since the last call and sleeps once enough is
+// owed to hold the solve to the limit.
+func (t *CPUThrottle) pace() {
+	now := t.account()
+	if t.owed >= throttleMinSleep {
+		time.Sleep(t.owed)
+		slept := time.Since(now)
+		t.slept.Add(int64(slept))
+		t.owed -= slept
+		t.last = time.Now()
+	}
+}
+
+// account adds the work since the last call, and the sleep it is owed, at
+// the end of a solve or of a batch.  It returns the time it took stock.
+func (t *CPUThrottle) account() time.Time {
+	now := time.Now()
+	work := now.Sub(t.last)
+	t.busy.Add(int64(work))
+	t.owed += time.Duration(float64(work) * (1/t.limit - 1))
+	t.last = now
+	return now
+}
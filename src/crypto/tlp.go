@@ -14,10 +14,13 @@ package crypto
 // is easy to unit‑test and to reuse.
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"math/big"
 
@@ -29,8 +32,40 @@ const (
 	// when no custom size is requested.
 	DefaultModulusBits = 2048
 
-	// rsa2048Bytes is the length in bytes of a 2048‑bit modulus or element.
-	rsa2048Bytes = DefaultModulusBits / 8
+	// MinModulusBits and MaxModulusBits bound the modulus sizes puzzles are
+	// generated and solved with: below 1024 bits N can be factored, and
+	// above 8192 bits each squaring is slow enough to mean nothing more.
+	// Sizes go in steps of ModulusBitsStep.
+	MinModulusBits  = 1024
+	MaxModulusBits  = 8192
+	ModulusBitsStep = 256
+
+	// fingerprintBytes is the least width N, G and the target are
+	// zero-padded to in fingerprints and commitments.
+	fingerprintBytes = DefaultModulusBits / 8
+)
+
+// Key-derivation versions for turning a puzzle target into a symmetric key.
+// The version is stored in the file header so that decryption always uses the
+// derivation the file was encrypted with.
+const (
+	// KeyDerivationLegacy is SHA‑256 over the zero‑padded target.
+	KeyDerivationLegacy uint8 = 0
+
+	// KeyDerivationHKDFv1 is HKDF‑SHA256 over the zero‑padded target with
+	// the domain label hkdfV1Label.
+	KeyDerivationHKDFv1 uint8 = 1
+
+	// KeyDerivationHKDFBLAKE2b and KeyDerivationHKDFSHA3 are the same with
+	// BLAKE2b-256 and SHA3-256 in place of SHA-256 (see keyHashes).
+	KeyDerivationHKDFBLAKE2b uint8 = 2
+	KeyDerivationHKDFSHA3    uint8 = 3
+
+	// CurrentKeyDerivation is the version used for newly encrypted files.
+	CurrentKeyDerivation = KeyDerivationHKDFv1
+
+	// hkdfV1Label is the HKDF info string for KeyDerivationHKDFv1.
+	hkdfV1Label = "cryptotimed puzzle key v1"
 )
 
 // Argon2idParams holds the parameters for Argon2id KDF
@@ -49,6 +84,37 @@ var DefaultArgon2idParams = Argon2idParams{
 	KeyLen:      32,        // 256-bit output
 }
 
+// Validate rejects parameters that Argon2id cannot run with, such as the
+// all-zero parameters of a corrupted or truncated header.
+func (p Argon2idParams) Validate() error {
+	if p.Memory == 0 || p.Time == 0 || p.Parallelism == 0 || p.KeyLen == 0 {
+		return fmt.Errorf("corrupt KDF parameters (memory %d KiB, time %d, parallelism %d, key length %d)",
+			p.Memory, p.Time, p.Parallelism, p.KeyLen)
+	}
+	return nil
+}
+
+// Minimum Argon2id parameters for a newly generated password puzzle.  Below
+// them a passphrase guess costs too little for the KDF to be worth having.
+const (
+	MinArgon2idMemory = 8 * 1024 // KiB (8 MiB)
+	MinArgon2idTime   = 1
+)
+
+// CheckStrength rejects parameters too weak to derive a new puzzle base
+// with: any Validate rejects, and those below MinArgon2idMemory or
+// MinArgon2idTime.  Existing files are still read with whatever they record.
+func (p Argon2idParams) CheckStrength() error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if p.Memory < MinArgon2idMemory || p.Time < MinArgon2idTime {
+		return fmt.Errorf("KDF parameters too weak (memory %d KiB, time %d; at least %d KiB and %d required)",
+			p.Memory, p.Time, MinArgon2idMemory, MinArgon2idTime)
+	}
+	return nil
+}
+
 // Puzzle encapsulates all public information necessary to solve a time‑lock
 // puzzle.  All fields are public so that callers can marshal/unmarshal as they
 // wish –  tlp.go stays agnostic to any particular on‑disk format.
@@ -86,6 +152,25 @@ type Puzzle struct {
 	Salt      [16]byte       // Random salt for password-based G derivation
 	KdfID     uint8          // KDF identifier (0=none, 1=Argon2id)
 	KdfParams Argon2idParams // KDF parameters
+
+	// FileID, if set, is mixed with T into the derivation of a password
+	// base (see BaseTweak), so that the same passphrase gives unrelated
+	// bases in different files even with their salts known.
+	FileID *[FileIDSize]byte
+}
+
+// FileIDSize is the size of the random file ID of a tweaked password base.
+const FileIDSize = 16
+
+// BaseTweak returns the bytes p mixes into the Argon2id input of its
+// password base after the salt: T (little-endian) and the file ID, or nil
+// for a puzzle without a file ID.
+func BaseTweak(p Puzzle) []byte {
+	if p.FileID == nil {
+		return nil
+	}
+	tweak := binary.LittleEndian.AppendUint64(make([]byte, 0, 8+FileIDSize), p.T)
+	return append(tweak, p.FileID[:]...)
 }
 
 // GeneratePuzzle creates a new RSA trapdoor time‑lock puzzle that requires ~T
@@ -95,6 +180,8 @@ type Puzzle struct {
 //	password – optional password to integrate into the puzzle base G.
 //	           If empty, G is chosen randomly (legacy mode).
 //	           If provided, G is derived from password+salt using Argon2id.
+//	bits     – size of the modulus N (see CheckModulusBits), e.g.
+//	           DefaultModulusBits.
 //
 // The function returns the public puzzle and, separately, the private key (so
 // that callers _may_ re‑use N or its factors if they wish).  Most applications
@@ -103,15 +190,103 @@ type Puzzle struct {
 // When a password is provided, each wrong password guess forces the attacker
 // to recompute the full sequential squaring chain from scratch, making offline
 // dictionary attacks scale linearly with both password space and time-lock work.
-func GeneratePuzzle(t uint64, password []byte) (Puzzle, *rsa.PrivateKey, error) {
-	bits := DefaultModulusBits
-	randR := rand.Reader
-	if bits < 1024 {
-		return Puzzle{}, nil, errors.New("RSA modulus too small for security")
+func GeneratePuzzle(t uint64, password []byte, bits int) (Puzzle, *rsa.PrivateKey, error) {
+	if err := CheckModulusBits(bits); err != nil {
+		return Puzzle{}, nil, err
+	}
+	return GeneratePuzzleWithOptions(t, password, GenerateOptions{Bits: bits})
+}
+
+// CheckModulusBits reports whether puzzles can be generated with a modulus
+// of bits bits: a multiple of ModulusBitsStep from MinModulusBits to
+// MaxModulusBits.
+func CheckModulusBits(bits int) error {
+	switch {
+	case bits < MinModulusBits:
+		return fmt.Errorf("a %d-bit modulus is too small: at least %d bits are needed to resist factoring", bits, MinModulusBits)
+	case bits > MaxModulusBits:
+		return fmt.Errorf("a %d-bit modulus is too large: at most %d bits are supported", bits, MaxModulusBits)
+	case bits%ModulusBitsStep != 0:
+		return fmt.Errorf("a %d-bit modulus is not a multiple of %d bits", bits, ModulusBitsStep)
 	}
+	return nil
+}
+
+// ModulusBytes returns the byte length of N, the width puzzle targets are
+// zero-padded to before key derivation.
+func ModulusBytes(N *big.Int) int {
+	return (N.BitLen() + 7) / 8
+}
+
+// GeneratePuzzleWithRand is GeneratePuzzle drawing the modulus, the base
+// and the salt from r instead of crypto/rand.  r must be cryptographically
+// secure outside of tests.  The same bytes from r do not always give the
+// same puzzle: crypto/rsa deliberately varies how much of r key generation
+// consumes.
+func GeneratePuzzleWithRand(r io.Reader, t uint64, password []byte) (Puzzle, *rsa.PrivateKey, error) {
+	if r == nil {
+		return Puzzle{}, nil, errors.New("no randomness source")
+	}
+	return GeneratePuzzleWithOptions(t, password, GenerateOptions{Rand: r})
+}
+
+// GenerateOptions configures GeneratePuzzleWithOptions.
+type GenerateOptions struct {
+	// NoTrapdoor computes the target by T sequential squarings instead of
+	// through φ(N), taking as long as solving the puzzle.  The factors are
+	// discarded without being used, so not even the encryptor can have
+	// shortcut the puzzle.  Builds with the notrapdoor tag always do this.
+	NoTrapdoor bool
+
+	// Progress receives the number of squarings done while the target is
+	// computed sequentially (NoTrapdoor only).
+	Progress func(done uint64)
+
+	// Rand is the source of randomness for the modulus, the base and the
+	// salt (crypto/rand.Reader if nil).  It must be cryptographically
+	// secure; see NewBufferedRand for concurrent generation.
+	Rand io.Reader
+
+	// BaseTweak draws a random file ID for a password puzzle and mixes it
+	// with T into the derivation of the base (see Puzzle.FileID).  It does
+	// nothing without a password.
+	BaseTweak bool
+
+	// Bits is the size of the modulus (DefaultModulusBits if zero); see
+	// CheckModulusBits.
+	Bits int
+
+	// KdfParams derives the base of a password puzzle (DefaultArgon2idParams
+	// if nil).  They must pass CheckStrength.  Encrypted files do not record
+	// them and are always read with the defaults.
+	KdfParams *Argon2idParams
+}
+
+// GeneratePuzzleWithOptions is GeneratePuzzle with options.  Without the
+// trapdoor no private key is returned.
+func GeneratePuzzleWithOptions(t uint64, password []byte, opts GenerateOptions) (Puzzle, *rsa.PrivateKey, error) {
+	noTrapdoor := opts.NoTrapdoor || trapdoorDisabled
+	randR := opts.Rand
 	if randR == nil {
 		randR = rand.Reader
 	}
+	kdfParams := DefaultArgon2idParams
+	if opts.KdfParams != nil {
+		kdfParams = *opts.KdfParams
+	}
+	bits := opts.Bits
+	if bits == 0 {
+		bits = DefaultModulusBits
+	}
+	if err := CheckModulusBits(bits); err != nil {
+		return Puzzle{}, nil, err
+	}
+	if len(password) != 0 {
+		// Refuse a weak KDF before spending time on the modulus
+		if err := kdfParams.CheckStrength(); err != nil {
+			return Puzzle{}, nil, err
+		}
+	}
 
 	// 1. Generate a fresh RSA key.
 	priv, err := rsa.GenerateKey(randR, bits)
@@ -120,13 +295,15 @@ func GeneratePuzzle(t uint64, password []byte) (Puzzle, *rsa.PrivateKey, error)
 	}
 	N := new(big.Int).Set(priv.N) // defensive copy –  caller owns Puzzle
 
-	// 2. Compute φ(N) = (p‑1)(q‑1).  We only need it temporarily.
-	if len(priv.Primes) < 2 {
-		return Puzzle{}, nil, errors.New("invalid RSA key: missing primes")
+	// 2. Compute φ(N) = (p‑1)(q‑1).  We only need it temporarily.  Without
+	// the trapdoor the factors are destroyed before anything else happens.
+	var phiN *big.Int
+	if noTrapdoor {
+		discardPrivateKey(priv)
+		priv = nil
+	} else if phiN, err = totient(priv); err != nil {
+		return Puzzle{}, nil, err
 	}
-	pMinus1 := new(big.Int).Sub(priv.Primes[0], big.NewInt(1))
-	qMinus1 := new(big.Int).Sub(priv.Primes[1], big.NewInt(1))
-	phiN := new(big.Int).Mul(pMinus1, qMinus1)
 
 	// 3. Initialize puzzle structure
 	puzzle := Puzzle{
@@ -146,67 +323,297 @@ func GeneratePuzzle(t uint64, password []byte) (Puzzle, *rsa.PrivateKey, error)
 	} else {
 		// Password mode: derive G from password + salt
 		// Generate random salt
-		if _, err := rand.Read(puzzle.Salt[:]); err != nil {
+		if _, err := io.ReadFull(randR, puzzle.Salt[:]); err != nil {
 			return Puzzle{}, nil, err
 		}
 
+		if opts.BaseTweak {
+			puzzle.FileID = new([FileIDSize]byte)
+			if _, err := io.ReadFull(randR, puzzle.FileID[:]); err != nil {
+				return Puzzle{}, nil, err
+			}
+		}
+
 		puzzle.KdfID = 1 // Argon2id
-		puzzle.KdfParams = DefaultArgon2idParams
+		puzzle.KdfParams = kdfParams
 
-		G, err = deriveBaseFromPassword(password, puzzle.Salt, puzzle.KdfParams, N)
+		G, err = DerivePuzzleBase(password, puzzle)
 		if err != nil {
 			return Puzzle{}, nil, err
 		}
 	}
 	puzzle.G = G
 
-	// 5. Compute e = 2^T mod φ(N) efficiently (O(log T)).
-	e := powTwoMod(phiN, t)
-
-	// 6. target = g^e mod N – fast **because** we reduced the exponent modulo φ(N).
-	puzzle.Target = new(big.Int).Exp(G, e, N)
+	// 5. Compute the target, through the trapdoor if we kept it.
+	puzzle.Target = computeTarget(puzzle, phiN, opts.Progress)
 
 	return puzzle, priv, nil
 }
 
+// PuzzleForPassword returns the puzzle p would have been had its base been
+// derived from password: the same modulus, work factor and salt, with a base
+// and target of its own.  The target is computed through priv, the private
+// key returned with p, or by sequential squaring (reporting to progress) if
+// priv is nil.  p must be a password puzzle.
+func PuzzleForPassword(p Puzzle, priv *rsa.PrivateKey, password []byte, progress func(done uint64)) (Puzzle, error) {
+	if p.KdfID != 1 || len(password) == 0 {
+		return Puzzle{}, errors.New("only a password puzzle has a puzzle for another password")
+	}
+	var phiN *big.Int
+	if priv != nil && !trapdoorDisabled {
+		if priv.N.Cmp(p.N) != 0 {
+			return Puzzle{}, errors.New("private key does not match the puzzle")
+		}
+		var err error
+		if phiN, err = totient(priv); err != nil {
+			return Puzzle{}, err
+		}
+	}
+
+	other := Puzzle{
+		N:         p.N,
+		T:         p.T,
+		Salt:      p.Salt,
+		KdfID:     p.KdfID,
+		KdfParams: p.KdfParams,
+		FileID:    p.FileID,
+	}
+	G, err := DerivePuzzleBase(password, other)
+	if err != nil {
+		return Puzzle{}, err
+	}
+	other.G = G
+	other.Target = computeTarget(other, phiN, progress)
+	return other, nil
+}
+
+// TrapdoorTarget computes the target of p through φ(N), using priv, the
+// private key returned with p, as GeneratePuzzle does.
+func TrapdoorTarget(p Puzzle, priv *rsa.PrivateKey) (*big.Int, error) {
+	if trapdoorDisabled {
+		return nil, errors.New("the trapdoor is disabled in this build")
+	}
+	if priv == nil || priv.N.Cmp(p.N) != 0 {
+		return nil, errors.New("private key does not match the puzzle")
+	}
+	phiN, err := totient(priv)
+	if err != nil {
+		return nil, err
+	}
+	return computeTarget(p, phiN, nil), nil
+}
+
+// totient returns φ(N) = (p-1)(q-1) of a two-prime RSA key.
+func totient(priv *rsa.PrivateKey) (*big.Int, error) {
+	if len(priv.Primes) < 2 {
+		return nil, errors.New("invalid RSA key: missing primes")
+	}
+	pMinus1 := new(big.Int).Sub(priv.Primes[0], big.NewInt(1))
+	qMinus1 := new(big.Int).Sub(priv.Primes[1], big.NewInt(1))
+	return new(big.Int).Mul(pMinus1, qMinus1), nil
+}
+
+// computeTarget returns g^{2^T} mod N.  With φ(N) it reduces the exponent
+// first, which is fast; with phiN nil it squares T times like a solver.
+func computeTarget(p Puzzle, phiN *big.Int, progress func(done uint64)) *big.Int {
+	if phiN == nil {
+		// Without Resume or Control the solve cannot fail
+		target, _ := SolvePuzzleWithOptions(p, SolveOptions{Progress: progress})
+		return target
+	}
+
+	// e = 2^T mod φ(N), computed in O(log T)
+	e := powTwoMod(phiN, p.T)
+
+	// target = g^e mod N – fast **because** we reduced the exponent modulo φ(N)
+	return new(big.Int).Exp(p.G, e, p.N)
+}
+
+// TrapdoorAvailable reports whether this build may compute targets through
+// φ(N).  It is false in builds with the notrapdoor tag.
+func TrapdoorAvailable() bool {
+	return !trapdoorDisabled
+}
+
+// discardPrivateKey overwrites the secret parts of an RSA key.  Copies made
+// by the runtime cannot be reached, but nothing derived from the factors
+// outlives this call.
+func discardPrivateKey(priv *rsa.PrivateKey) {
+	priv.D.SetInt64(0)
+	for _, p := range priv.Primes {
+		p.SetInt64(0)
+	}
+	priv.Precomputed = rsa.PrecomputedValues{}
+}
+
 // SolvePuzzle computes g^{2^T} mod N by T sequential squarings, returning the
 // result.  The work is strictly sequential; each square depends on the
 // previous value so cannot be parallelised with known techniques.
 //
 // A caller may pass an optional progress callback.  The callback is invoked
-// whenever another `step` squarings have completed (see implementation for
-// constant step size) or when the computation finishes.  It receives the number
-// of squarings performed so far (in the range 1…T).
-func SolvePuzzle(p Puzzle, progress func(done uint64)) *big.Int {
-	result := new(big.Int).Set(p.G)
-	modulus := p.N
-
-	const step uint64 = 1 << 20 // call progress roughly every million steps
-
-	for i := uint64(0); i < p.T; i++ {
-		// result = result^2 mod N
-		result.Mul(result, result)
-		result.Mod(result, modulus)
-
-		if progress != nil {
-			if (i+1)%step == 0 || i+1 == p.T {
-				progress(i + 1)
-			}
-		}
+// as DefaultProgressStrategy decides (every 2^20 squarings) and when the
+// computation finishes.  It receives the number of
+// squarings performed so far (in the range 1…T).  See SolvePuzzleWithOptions
+// for runtime tuning.
+//
+// Once ctx is done the solve stops within a fraction of a millisecond and
+// SolvePuzzle returns an error wrapping both ErrSolveStopped and the
+// context's error (context.Canceled or context.DeadlineExceeded).
+func SolvePuzzle(ctx context.Context, p Puzzle, progress func(done uint64)) (*big.Int, error) {
+	control := &SolveControl{}
+	cancelled := control.StopWhenDone(ctx)
+	target, err := SolvePuzzleWithOptions(p, SolveOptions{Progress: progress, Control: control})
+	if cancelled() && errors.Is(err, ErrSolveStopped) {
+		return nil, fmt.Errorf("%w: %w", err, context.Cause(ctx))
 	}
-	return result
+	return target, err
+}
+
+// Fingerprint identifies a puzzle by its public parameters: SHA‑256 over the
+// zero‑padded N and G followed by T (8 bytes, big‑endian).  Puzzles with the
+// same fingerprint have the same solution, so it is a safe key for caching
+// or resuming work.  For password files G is the password‑derived base, so
+// the fingerprint also changes with the password.
+func (p Puzzle) Fingerprint() [32]byte {
+	width := max(ModulusBytes(p.N), fingerprintBytes)
+	h := sha256.New()
+	h.Write(p.N.FillBytes(make([]byte, width)))
+	h.Write(p.G.FillBytes(make([]byte, width)))
+	h.Write(binary.BigEndian.AppendUint64(nil, p.T))
+
+	var fp [32]byte
+	copy(fp[:], h.Sum(nil))
+	return fp
+}
+
+// commitmentLabel domain-separates target commitments from other hashes.
+const commitmentLabel = "cryptotimed target commitment v1"
+
+// Commitment returns SHA‑256 over a domain label, the puzzle fingerprint and
+// the zero‑padded target.  Publishing it lets solvers check a solution
+// without the creator revealing it; binding the fingerprint keeps a
+// commitment from being reused for another puzzle.
+func (p Puzzle) Commitment(target *big.Int) [32]byte {
+	fp := p.Fingerprint()
+	width := max(ModulusBytes(p.N), fingerprintBytes)
+	h := sha256.New()
+	h.Write([]byte(commitmentLabel))
+	h.Write(fp[:])
+	h.Write(target.FillBytes(make([]byte, width)))
+
+	var c [32]byte
+	copy(c[:], h.Sum(nil))
+	return c
 }
 
 // DerivePuzzleKey returns SHA‑256(target) as a fixed 32‑byte array suitable for
-// use as a symmetric key (e.g. for ChaCha20).
-func DerivePuzzleKey(target *big.Int) [32]byte {
+// use as a symmetric key (e.g. for ChaCha20), N being the puzzle modulus.
+// This is the legacy derivation (KeyDerivationLegacy) used by format
+// version 1 files.
+func DerivePuzzleKey(target, N *big.Int) [32]byte {
 	// target.Bytes() is big‑endian with no leading zero padding; make it 0‑padded
-	// to rsa2048Bytes so that the mapping is injective across moduli of the same
-	// size.
-	buf := target.FillBytes(make([]byte, rsa2048Bytes))
+	// to the byte length of N so that the mapping is injective across moduli of
+	// the same size.
+	buf := target.FillBytes(make([]byte, ModulusBytes(N)))
 	return sha256.Sum256(buf)
 }
 
+// DerivePuzzleKeyVersion derives the symmetric key from the puzzle target
+// using the given key-derivation version, without parameters (see
+// DerivePuzzleKeyParams).
+func DerivePuzzleKeyVersion(target, N *big.Int, version uint8) ([32]byte, error) {
+	return DerivePuzzleKeyParams(target, N, version, nil)
+}
+
+// DerivePuzzleKeyParams derives the symmetric key from the puzzle target
+// using the given key-derivation version and the parameters the header
+// records for it.  Version KeyDerivationLegacy is plain SHA‑256 (see
+// DerivePuzzleKey); the built-in others run HKDF over the hash keyHashes
+// lists for them, with a versioned domain label so later derivation changes
+// can never collide with earlier ones, and any other must have been
+// registered with RegisterKDF.  Every derivation zero-pads the target to
+// the byte length of the puzzle modulus N.
+func DerivePuzzleKeyParams(target, N *big.Int, version uint8, params []byte) ([32]byte, error) {
+	if err := CheckKeyDerivation(version, params); err != nil {
+		return [32]byte{}, err
+	}
+	if target.Sign() < 0 || ModulusBytes(target) > ModulusBytes(N) {
+		return [32]byte{}, errors.New("puzzle target is wider than its modulus")
+	}
+	if version == KeyDerivationLegacy {
+		return DerivePuzzleKey(target, N), nil
+	}
+	k, _ := lookupKDF(version)
+	return k.Derive(target.FillBytes(make([]byte, ModulusBytes(N))), params)
+}
+
+// CheckKeyModulus reports whether N has a size puzzles are generated with
+// (see CheckModulusBits).  Targets are zero-padded to the byte length of N
+// before key derivation, so a modulus of another size (e.g. a damaged
+// header's) is rejected before solving the puzzle rather than failing
+// authentication afterwards.
+func CheckKeyModulus(N *big.Int) error {
+	if N == nil || N.Sign() <= 0 {
+		return errors.New("invalid puzzle modulus")
+	}
+	if err := CheckModulusBits(N.BitLen()); err != nil {
+		return fmt.Errorf("invalid puzzle modulus: %v", err)
+	}
+	return nil
+}
+
+// CheckKeyDerivationVersion reports whether DerivePuzzleKeyVersion supports
+// the given version, so callers can reject a file before solving its puzzle.
+func CheckKeyDerivationVersion(version uint8) error {
+	if _, ok := lookupKDF(version); !ok && version != KeyDerivationLegacy {
+		return fmt.Errorf("unsupported key-derivation version %d", version)
+	}
+	return nil
+}
+
+// CheckKeyDerivation is CheckKeyDerivationVersion that also checks the
+// parameters recorded for the derivation: none unless it takes some.
+func CheckKeyDerivation(version uint8, params []byte) error {
+	if err := CheckKeyDerivationVersion(version); err != nil {
+		return err
+	}
+	k, _ := lookupKDF(version)
+	if k.Params == nil {
+		if len(params) != 0 {
+			return fmt.Errorf("key derivation %s takes no parameters", KeyDerivationName(version))
+		}
+		return nil
+	}
+	if _, err := k.Params.Decode(params); err != nil {
+		return fmt.Errorf("invalid %s parameters: %v", k.Name, err)
+	}
+	return nil
+}
+
+// KeyDerivationParams returns the parameters recorded for a new file
+// derived with version (nil for a derivation without any).
+func KeyDerivationParams(version uint8) ([]byte, error) {
+	k, ok := lookupKDF(version)
+	if !ok || k.Params == nil {
+		return nil, nil
+	}
+	return k.Params.Encode()
+}
+
+// KeyDerivationName returns a human-readable name for a key-derivation version.
+func KeyDerivationName(version uint8) string {
+	if version == KeyDerivationLegacy {
+		return "SHA-256 (legacy)"
+	}
+	if h, ok := keyHashes[version]; ok {
+		return fmt.Sprintf("HKDF-%s (v%d)", h.display, version)
+	}
+	if k, ok := lookupKDF(version); ok {
+		return fmt.Sprintf("%s (v%d)", k.Name, version)
+	}
+	return fmt.Sprintf("unknown (%d)", version)
+}
+
 // randomCoprime chooses a uniform random integer g in [2, N‑2] such that
 // gcd(g,N)=1.  It may loop a few times but the expected number of iterations is
 // tiny for RSA moduli because most numbers are coprime to N.
@@ -248,18 +655,41 @@ func powTwoMod(m *big.Int, t uint64) *big.Int {
 // DeriveBaseFromPassword recreates the puzzle base G from a password and salt.
 // This function is used during decryption to reconstruct G for each password attempt.
 // Each wrong password will produce a different G, forcing a complete re-solve of the puzzle.
+// It takes no tweak; see DerivePuzzleBase for puzzles with a file ID.
 func DeriveBaseFromPassword(password []byte, salt [16]byte, kdfParams Argon2idParams, N *big.Int) (*big.Int, error) {
-	return deriveBaseFromPassword(password, salt, kdfParams, N)
+	return deriveBaseFromPassword(password, salt, nil, kdfParams, N)
+}
+
+// DerivePuzzleBase recreates the base of the password puzzle p from a
+// password, with p's salt, KDF parameters and tweak (see BaseTweak).
+func DerivePuzzleBase(password []byte, p Puzzle) (*big.Int, error) {
+	return deriveBaseFromPassword(password, p.Salt, BaseTweak(p), p.KdfParams, p.N)
 }
 
 // deriveBaseFromPassword implements the core password-to-base derivation logic.
-// It uses Argon2id to derive a 256-bit value from password||salt, then maps it
-// to a valid base G in [2, N-2] with gcd(G, N) = 1.
-func deriveBaseFromPassword(password []byte, salt [16]byte, kdfParams Argon2idParams, N *big.Int) (*big.Int, error) {
-	// Use Argon2id to derive key material from password + salt
+// It uses Argon2id to derive a 256-bit value from password||salt||tweak, then
+// maps it to a valid base G in [2, N-2] with gcd(G, N) = 1.
+func deriveBaseFromPassword(password []byte, salt [16]byte, tweak []byte, kdfParams Argon2idParams, N *big.Int) (*big.Int, error) {
+	g0, err := passwordSeed(password, salt, tweak, kdfParams, N)
+	if err != nil {
+		return nil, err
+	}
+	return selectBase(g0, N), nil
+}
+
+// passwordSeed maps the Argon2id output for password||salt||tweak to the
+// first candidate base in [2, N-2].  The tweak extends the Argon2id salt, so
+// an empty one derives what files without a tweak always have.
+func passwordSeed(password []byte, salt [16]byte, tweak []byte, kdfParams Argon2idParams, N *big.Int) (*big.Int, error) {
+	// argon2.IDKey panics on zero rounds or parallelism
+	if err := kdfParams.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Use Argon2id to derive key material from password + salt + tweak
 	keyMaterial := argon2.IDKey(
 		password,
-		salt[:],
+		append(salt[:], tweak...),
 		kdfParams.Time,
 		kdfParams.Memory,
 		kdfParams.Parallelism,
@@ -269,27 +699,62 @@ func deriveBaseFromPassword(password []byte, salt [16]byte, kdfParams Argon2idPa
 	// Convert the 256-bit key material to a big integer
 	keyInt := new(big.Int).SetBytes(keyMaterial)
 
-	// Map to range [2, N-2] and ensure gcd(G, N) = 1
+	// Map to range [2, N-2]
 	two := big.NewInt(2)
 	nMinus3 := new(big.Int).Sub(N, big.NewInt(3)) // N - 3
 
 	// g0 = (keyInt mod (N-3)) + 2, ensuring g0 ∈ [2, N-2]
 	g0 := new(big.Int).Mod(keyInt, nMinus3)
 	g0.Add(g0, two)
+	return g0, nil
+}
 
-	// Re-sample until gcd(g0, N) = 1
-	// This loop is expected to terminate quickly for RSA moduli
-	for {
-		if new(big.Int).GCD(nil, nil, g0, N).Cmp(big.NewInt(1)) == 0 {
-			return g0, nil
+// baseCandidates is the number of consecutive candidates selectBase checks
+// regardless of which is the first valid one.
+const baseCandidates = 8
+
+// selectBase returns the first G >= g0 (wrapping within [2, N-2]) with
+// gcd(G, N) = 1, like resampleBase.  It always checks baseCandidates
+// candidates, so the time taken does not depend on how far the first valid
+// one lies from g0 and so on the password.  A run of baseCandidates values
+// sharing a factor with an RSA modulus is out of reach in practice; should
+// it happen, the search continues variable-time.
+func selectBase(g0, N *big.Int) *big.Int {
+	one := big.NewInt(1)
+	gcd := new(big.Int)
+	candidate := new(big.Int).Set(g0)
+
+	var chosen *big.Int
+	for i := 0; i < baseCandidates; i++ {
+		valid := gcd.GCD(nil, nil, candidate, N).Cmp(one) == 0
+		if valid && chosen == nil {
+			chosen = new(big.Int).Set(candidate)
 		}
+		nextBase(candidate, N)
+	}
+	if chosen != nil {
+		return chosen
+	}
+	return resampleBase(candidate, N)
+}
 
-		// If gcd != 1, increment and try again
-		g0.Add(g0, big.NewInt(1))
-		if g0.Cmp(new(big.Int).Sub(N, big.NewInt(1))) >= 0 {
-			// Wrap around if we exceed N-2
-			g0.Set(two)
-		}
+// resampleBase returns the first G >= g0 (wrapping within [2, N-2]) with
+// gcd(G, N) = 1, taking as many steps as needed.
+func resampleBase(g0, N *big.Int) *big.Int {
+	one := big.NewInt(1)
+	g := new(big.Int).Set(g0)
+	for new(big.Int).GCD(nil, nil, g, N).Cmp(one) != 0 {
+		nextBase(g, N)
+	}
+	return g
+}
+
+// nextBase advances g to the next candidate base, wrapping around to 2 past
+// N-2.
+func nextBase(g, N *big.Int) {
+	g.Add(g, big.NewInt(1))
+	if g.Cmp(new(big.Int).Sub(N, big.NewInt(1))) >= 0 {
+		g.SetInt64(2)
 	}
 }
 
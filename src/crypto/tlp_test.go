@@ -1,16 +1,34 @@
 package crypto
 
 import (
+	"context"
+	"errors"
+	"io"
 	"math/big"
 	"testing"
+	"time"
 )
 
+// testModulus is a stand-in 2048-bit modulus for deriving keys from bare
+// targets.
+var testModulus = new(big.Int).Lsh(big.NewInt(1), DefaultModulusBits-1)
+
+// solve solves p by sequential squaring, failing the test if it cannot.
+func solve(t *testing.T, p Puzzle) *big.Int {
+	t.Helper()
+	target, err := SolvePuzzle(context.Background(), p, nil)
+	if err != nil {
+		t.Fatalf("SolvePuzzle failed: %v", err)
+	}
+	return target
+}
+
 // TestGenerateAndSolvePuzzle creates a full puzzle, solves it by sequential
 // squaring and checks all invariants.
 func TestGenerateAndSolvePuzzle(t *testing.T) {
 	const squarings = 20 // keep unit‑test quick
 
-	puzzle, priv, err := GeneratePuzzle(squarings, nil) // No password for test
+	puzzle, priv, err := GeneratePuzzle(squarings, nil, DefaultModulusBits) // No password for test
 	if err != nil {
 		t.Fatalf("GeneratePuzzle failed: %v", err)
 	}
@@ -18,26 +36,28 @@ func TestGenerateAndSolvePuzzle(t *testing.T) {
 		t.Fatalf("unexpected modulus size %d", puzzle.N.BitLen())
 	}
 
-	// 1. Target must equal G^{2^T mod φ(N)} mod N.
-	phiN := new(big.Int).Mul(
-		new(big.Int).Sub(priv.Primes[0], big.NewInt(1)),
-		new(big.Int).Sub(priv.Primes[1], big.NewInt(1)),
-	)
-	exp := powTwoMod(phiN, puzzle.T)
-	expectedTarget := new(big.Int).Exp(puzzle.G, exp, puzzle.N)
-	if expectedTarget.Cmp(puzzle.Target) != 0 {
-		t.Fatalf("target mismatch: want %s got %s", expectedTarget, puzzle.Target)
+	// 1. Target must equal G^{2^T mod φ(N)} mod N (no key in notrapdoor builds).
+	if priv != nil {
+		phiN := new(big.Int).Mul(
+			new(big.Int).Sub(priv.Primes[0], big.NewInt(1)),
+			new(big.Int).Sub(priv.Primes[1], big.NewInt(1)),
+		)
+		exp := powTwoMod(phiN, puzzle.T)
+		expectedTarget := new(big.Int).Exp(puzzle.G, exp, puzzle.N)
+		if expectedTarget.Cmp(puzzle.Target) != 0 {
+			t.Fatalf("target mismatch: want %s got %s", expectedTarget, puzzle.Target)
+		}
 	}
 
 	// 2. Sequential solver must reproduce Target exactly.
-	got := SolvePuzzle(puzzle, nil)
+	got := solve(t, puzzle)
 	if got.Cmp(puzzle.Target) != 0 {
 		t.Fatalf("SolvePuzzle incorrect result\nwant: %s\n got: %s", puzzle.Target, got)
 	}
 
 	// 3. Key derivation must be deterministic and equal for both big.Int copies.
-	k1 := DerivePuzzleKey(got)
-	k2 := DerivePuzzleKey(puzzle.Target)
+	k1 := DerivePuzzleKey(got, puzzle.N)
+	k2 := DerivePuzzleKey(puzzle.Target, puzzle.N)
 	if k1 != k2 {
 		t.Fatalf("DerivePuzzleKey mismatch: %x vs %x", k1, k2)
 	}
@@ -84,22 +104,353 @@ func TestProgressCallback(t *testing.T) {
 		T: 5,
 	}
 	var calls int
-	SolvePuzzle(p, func(done uint64) { calls++ })
+	if _, err := SolvePuzzle(context.Background(), p, func(done uint64) { calls++ }); err != nil {
+		t.Fatalf("SolvePuzzle failed: %v", err)
+	}
 	if calls == 0 {
 		t.Fatalf("progress callback never invoked")
 	}
 }
 
+// TestSolvePuzzleContext checks that a done context stops a solve and is
+// told apart from other failures.
+func TestSolvePuzzleContext(t *testing.T) {
+	p := Puzzle{N: testModulus, G: big.NewInt(3), T: 1 << 40}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	target, err := SolvePuzzle(ctx, p, nil)
+	if target != nil || !errors.Is(err, ErrSolveStopped) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("SolvePuzzle = %v, %v; want ErrSolveStopped and the deadline", target, err)
+	}
+
+	done, stop := context.WithCancel(context.Background())
+	stop()
+	if _, err := SolvePuzzle(done, p, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("a cancelled context did not stop the solve: %v", err)
+	}
+}
+
 // TestZeroWorkFactor checks corner‑case T = 0.
 func TestZeroWorkFactor(t *testing.T) {
-	puzz, _, err := GeneratePuzzle(0, nil) // No password for test
+	puzz, _, err := GeneratePuzzle(0, nil, DefaultModulusBits) // No password for test
 	if err != nil {
 		t.Fatalf("GeneratePuzzle(T=0) failed: %v", err)
 	}
 	if puzz.Target.Cmp(puzz.G) != 0 {
 		t.Fatalf("for T=0 target should equal G")
 	}
-	if res := SolvePuzzle(puzz, nil); res.Cmp(puzz.G) != 0 {
+	if res := solve(t, puzz); res.Cmp(puzz.G) != 0 {
 		t.Fatalf("SolvePuzzle(T=0) wrong: want %s got %s", puzz.G, res)
 	}
 }
+
+// TestDerivePuzzleKeyVersion checks that the versioned derivation is
+// deterministic, distinct from the legacy one, and rejects unknown versions.
+func TestDerivePuzzleKeyVersion(t *testing.T) {
+	target := new(big.Int).Lsh(big.NewInt(0xC0FFEE), 1000)
+
+	legacy, err := DerivePuzzleKeyVersion(target, testModulus, KeyDerivationLegacy)
+	if err != nil {
+		t.Fatalf("legacy derivation failed: %v", err)
+	}
+	if legacy != DerivePuzzleKey(target, testModulus) {
+		t.Fatalf("legacy version must match DerivePuzzleKey")
+	}
+
+	v1a, err := DerivePuzzleKeyVersion(target, testModulus, KeyDerivationHKDFv1)
+	if err != nil {
+		t.Fatalf("HKDF derivation failed: %v", err)
+	}
+	v1b, err := DerivePuzzleKeyVersion(new(big.Int).Set(target), testModulus, KeyDerivationHKDFv1)
+	if err != nil {
+		t.Fatalf("HKDF derivation failed: %v", err)
+	}
+	if v1a != v1b {
+		t.Fatalf("HKDF derivation is not deterministic: %x vs %x", v1a, v1b)
+	}
+	if v1a == legacy {
+		t.Fatalf("HKDF derivation must differ from legacy derivation")
+	}
+
+	other, _ := DerivePuzzleKeyVersion(new(big.Int).Add(target, big.NewInt(1)), testModulus, KeyDerivationHKDFv1)
+	if other == v1a {
+		t.Fatalf("different targets produced the same key")
+	}
+
+	if _, err := DerivePuzzleKeyVersion(target, testModulus, 0xFF); err == nil {
+		t.Fatalf("expected error for unknown key-derivation version")
+	}
+	if err := CheckKeyDerivationVersion(0xFF); err == nil {
+		t.Fatalf("CheckKeyDerivationVersion accepted an unknown version")
+	}
+}
+
+// TestNoTrapdoorMatchesTrapdoor checks that sequential squaring and the
+// φ(N) shortcut give the same target, and that the no-trapdoor generator
+// keeps no private key.
+func TestNoTrapdoorMatchesTrapdoor(t *testing.T) {
+	if !TrapdoorAvailable() {
+		t.Skip("built without the trapdoor")
+	}
+	for _, T := range []uint64{0, 1, 2, 17, 1000} {
+		p, priv, err := GeneratePuzzle(T, nil, DefaultModulusBits)
+		if err != nil {
+			t.Fatalf("GeneratePuzzle failed: %v", err)
+		}
+		phiN := new(big.Int).Mul(
+			new(big.Int).Sub(priv.Primes[0], big.NewInt(1)),
+			new(big.Int).Sub(priv.Primes[1], big.NewInt(1)))
+		trapdoor := computeTarget(p, phiN, nil)
+		sequential := computeTarget(p, nil, nil)
+		if trapdoor.Cmp(sequential) != 0 || trapdoor.Cmp(p.Target) != 0 {
+			t.Fatalf("T=%d: trapdoor and sequential targets differ", T)
+		}
+	}
+
+	var calls int
+	p, priv, err := GeneratePuzzleWithOptions(3000, []byte("pw"), GenerateOptions{
+		NoTrapdoor: true,
+		Progress:   func(uint64) { calls++ },
+	})
+	if err != nil {
+		t.Fatalf("GeneratePuzzleWithOptions failed: %v", err)
+	}
+	if priv != nil {
+		t.Fatal("no-trapdoor generation returned a private key")
+	}
+	if calls == 0 {
+		t.Error("no progress reported while computing the target")
+	}
+	if solve(t, p).Cmp(p.Target) != 0 {
+		t.Fatal("no-trapdoor target does not match the solution")
+	}
+}
+
+// TestPuzzleForPassword checks that the puzzle of a second password shares
+// the modulus and salt but has its own base, with a target that both ways of
+// computing it agree on.
+func TestPuzzleForPassword(t *testing.T) {
+	p, priv, err := GeneratePuzzle(500, []byte("real"), DefaultModulusBits)
+	if err != nil {
+		t.Fatalf("GeneratePuzzle failed: %v", err)
+	}
+
+	other, err := PuzzleForPassword(p, priv, []byte("duress"), nil)
+	if err != nil {
+		t.Fatalf("PuzzleForPassword failed: %v", err)
+	}
+	if other.N.Cmp(p.N) != 0 || other.Salt != p.Salt || other.T != p.T {
+		t.Fatal("puzzle for another password changed the modulus, salt or work factor")
+	}
+	if other.G.Cmp(p.G) == 0 || other.Fingerprint() == p.Fingerprint() {
+		t.Fatal("puzzle for another password has the same base")
+	}
+	want, err := DeriveBaseFromPassword([]byte("duress"), p.Salt, p.KdfParams, p.N)
+	if err != nil || other.G.Cmp(want) != 0 {
+		t.Fatalf("base is not the one derived from the password (%v)", err)
+	}
+	if solve(t, other).Cmp(other.Target) != 0 {
+		t.Fatal("target does not match the solution")
+	}
+
+	sequential, err := PuzzleForPassword(p, nil, []byte("duress"), nil)
+	if err != nil || sequential.Target.Cmp(other.Target) != 0 {
+		t.Fatalf("sequential target differs (%v)", err)
+	}
+
+	unkeyed, _, err := GeneratePuzzle(10, nil, DefaultModulusBits)
+	if err != nil {
+		t.Fatalf("GeneratePuzzle failed: %v", err)
+	}
+	if _, err := PuzzleForPassword(unkeyed, nil, []byte("duress"), nil); err == nil {
+		t.Error("PuzzleForPassword accepted a puzzle without a password")
+	}
+}
+
+// TestCheckKeyModulus checks that only moduli of the supported sizes are
+// accepted.
+func TestCheckKeyModulus(t *testing.T) {
+	for _, bits := range []int{MinModulusBits, DefaultModulusBits, 3072, MaxModulusBits} {
+		if err := CheckKeyModulus(new(big.Int).Lsh(big.NewInt(1), uint(bits-1))); err != nil {
+			t.Errorf("%d-bit modulus rejected: %v", bits, err)
+		}
+	}
+
+	for name, N := range map[string]*big.Int{
+		"short": new(big.Int).Lsh(big.NewInt(1), MinModulusBits-2),
+		"odd":   new(big.Int).Lsh(big.NewInt(1), DefaultModulusBits-9),
+		"long":  new(big.Int).Lsh(big.NewInt(1), MaxModulusBits),
+		"zero":  new(big.Int),
+		"nil":   nil,
+	} {
+		if err := CheckKeyModulus(N); err == nil {
+			t.Errorf("%s modulus accepted", name)
+		}
+	}
+}
+
+// TestGenerateModulusBits checks that puzzles are generated with the
+// modulus size asked for, within the supported range, and that their keys
+// are derived from targets padded to that size.
+func TestGenerateModulusBits(t *testing.T) {
+	p, _, err := GeneratePuzzle(10, nil, MinModulusBits)
+	if err != nil {
+		t.Fatalf("GeneratePuzzle failed: %v", err)
+	}
+	if p.N.BitLen() != MinModulusBits {
+		t.Fatalf("modulus is %d bits, want %d", p.N.BitLen(), MinModulusBits)
+	}
+	if got := solve(t, p); got.Cmp(p.Target) != 0 {
+		t.Fatal("SolvePuzzle disagrees with the generated target")
+	}
+
+	key, err := DerivePuzzleKeyVersion(p.Target, p.N, KeyDerivationHKDFv1)
+	if err != nil {
+		t.Fatalf("derivation failed: %v", err)
+	}
+	wide, _ := DerivePuzzleKeyVersion(p.Target, testModulus, KeyDerivationHKDFv1)
+	if key == wide {
+		t.Error("the target was not padded to the width of its modulus")
+	}
+	if _, err := DerivePuzzleKeyVersion(testModulus, p.N, KeyDerivationHKDFv1); err == nil {
+		t.Error("derived a key from a target wider than the modulus")
+	}
+
+	for _, bits := range []int{0, 512, MinModulusBits - 1, 2000, MaxModulusBits + 1} {
+		if _, _, err := GeneratePuzzle(10, nil, bits); err == nil {
+			t.Errorf("generated a puzzle with a %d-bit modulus", bits)
+		}
+	}
+}
+
+// TestPuzzleFingerprint checks that the fingerprint is stable and changes
+// with each public parameter.
+func TestPuzzleFingerprint(t *testing.T) {
+	base := Puzzle{N: big.NewInt(1000003), G: big.NewInt(3), T: 10}
+	fp := base.Fingerprint()
+	if fp != base.Fingerprint() {
+		t.Fatal("fingerprint is not deterministic")
+	}
+
+	variants := []Puzzle{
+		{N: big.NewInt(1000033), G: base.G, T: base.T},
+		{N: base.N, G: big.NewInt(5), T: base.T},
+		{N: base.N, G: base.G, T: base.T + 1},
+	}
+	for i, v := range variants {
+		if v.Fingerprint() == fp {
+			t.Errorf("variant %d has the same fingerprint", i)
+		}
+	}
+
+	// The solution and the salt are not part of the identity
+	withTarget := base
+	withTarget.Target = big.NewInt(42)
+	withTarget.Salt[0] = 1
+	if withTarget.Fingerprint() != fp {
+		t.Error("fingerprint should depend only on N, G and T")
+	}
+}
+
+// TestPuzzleCommitment checks that a commitment accepts only the puzzle's
+// own target.
+func TestPuzzleCommitment(t *testing.T) {
+	p, _, err := GeneratePuzzle(50, nil, DefaultModulusBits)
+	if err != nil {
+		t.Fatalf("GeneratePuzzle failed: %v", err)
+	}
+	c := p.Commitment(p.Target)
+	if p.Commitment(solve(t, p)) != c {
+		t.Fatal("solved target does not match the commitment")
+	}
+	if p.Commitment(new(big.Int).Add(p.Target, big.NewInt(1))) == c {
+		t.Error("a different target matched the commitment")
+	}
+	other := p
+	other.T++
+	if other.Commitment(p.Target) == c {
+		t.Error("the commitment should be bound to the puzzle")
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// TestGenerateUsesRandOption checks that all randomness comes from
+// GenerateOptions.Rand when it is set, with and without a password.
+func TestGenerateUsesRandOption(t *testing.T) {
+	for _, password := range [][]byte{nil, []byte("pw")} {
+		src := &countingReader{r: NewBufferedRand()}
+		p, _, err := GeneratePuzzleWithOptions(10, password, GenerateOptions{Rand: src})
+		if err != nil {
+			t.Fatalf("GeneratePuzzleWithOptions failed: %v", err)
+		}
+		if src.n == 0 {
+			t.Errorf("password %q: no bytes read from the given source", password)
+		}
+		if solve(t, p).Cmp(p.Target) != 0 {
+			t.Errorf("password %q: target does not match the solution", password)
+		}
+	}
+}
+
+// failingReader fails every read.
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("source exhausted")
+}
+
+// TestGeneratePuzzleWithRand checks that GeneratePuzzleWithRand draws from
+// the given reader alone, never falling back to crypto/rand.
+func TestGeneratePuzzleWithRand(t *testing.T) {
+	for _, password := range [][]byte{nil, []byte("pw")} {
+		src := &countingReader{r: NewBufferedRand()}
+		p, priv, err := GeneratePuzzleWithRand(src, 10, password)
+		if err != nil {
+			t.Fatalf("GeneratePuzzleWithRand failed: %v", err)
+		}
+		if src.n == 0 || priv == nil {
+			t.Errorf("password %q: read %d bytes, private key %v", password, src.n, priv != nil)
+		}
+		if solve(t, p).Cmp(p.Target) != 0 {
+			t.Errorf("password %q: target does not match the solution", password)
+		}
+		if _, _, err := GeneratePuzzleWithRand(failingReader{}, 10, password); err == nil {
+			t.Errorf("password %q: generated a puzzle from a failing source", password)
+		}
+	}
+	if _, _, err := GeneratePuzzleWithRand(nil, 10, nil); err == nil {
+		t.Error("generated a puzzle without a source")
+	}
+}
+
+// benchmarkGenerateParallel generates puzzles on every GOMAXPROCS goroutine,
+// each with its own buffered source if buffered is set.
+func benchmarkGenerateParallel(b *testing.B, buffered bool) {
+	b.RunParallel(func(pb *testing.PB) {
+		var opts GenerateOptions
+		if buffered {
+			opts.Rand = NewBufferedRand()
+		}
+		for pb.Next() {
+			if _, _, err := GeneratePuzzleWithOptions(1, nil, opts); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkGeneratePuzzleParallel(b *testing.B)         { benchmarkGenerateParallel(b, false) }
+func BenchmarkGeneratePuzzleParallelBuffered(b *testing.B) { benchmarkGenerateParallel(b, true) }
@@ -0,0 +1,7 @@
+//go:build !notrapdoor
+
+package crypto
+
+// trapdoorDisabled forces GeneratePuzzle to compute targets by sequential
+// squaring.  Build with -tags notrapdoor to set it.
+const trapdoorDisabled = false
@@ -0,0 +1,156 @@
+package operations
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"time"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// PuzzleCheckpointPath returns where the solve of puzzle index (from 0) of a
+// file of several puzzles (see types.AndPuzzles) is checkpointed, given the
+// checkpoint path of the file: that path itself for the first puzzle,
+// suffixed with the puzzle's number for the others.
+func PuzzleCheckpointPath(path string, index int) string {
+	if path == "" || index == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s.%d", path, index+1)
+}
+
+// solveHeader finds the solution of every puzzle of header, puzzle being
+// its first (see headerPuzzle), and returns how the first was found with
+// the puzzle key they yield together.  The further puzzles of a file that
+// has them are solved one after another, each through findTarget with its
+// own checkpoint (see PuzzleCheckpointPath), and progress counts through
+// all of them.  The checkpoint of a solved puzzle is kept, finished, until
+// the last is solved, so a stopped solve never starts one over.
+func solveHeader(header *types.FileHeader, puzzle crypto.Puzzle, opts DecryptOptions, progress ProgressCallback, solved map[[32]byte]*big.Int) (*solveResult, [32]byte, error) {
+	var key [32]byte
+	more := utils.AndPuzzlesFromHeader(header)
+	if len(more) > 0 && opts.Target != nil {
+		return nil, key, fmt.Errorf("this file needs %d puzzles solved; a solution to one of them is not enough", len(more)+1)
+	}
+	if len(more) > 0 && opts.ProofFile != "" {
+		return nil, key, fmt.Errorf("a proof of the solve covers one puzzle; this file needs %d solved", len(more)+1)
+	}
+
+	puzzles := append([]crypto.Puzzle{puzzle}, more...)
+	var first *solveResult
+	var keys [][32]byte
+	var finished []string
+	done := uint64(0)
+	for i, p := range puzzles {
+		solve, err := findTarget(p, puzzleOptions(opts, i, done), offsetProgress(progress, done), solved)
+		if err != nil {
+			return nil, key, err
+		}
+		k, err := derivePuzzleKey(header, p.N, solve.target)
+		if err != nil {
+			return nil, key, fmt.Errorf("failed to derive decryption key: %v", err)
+		}
+		keys = append(keys, k)
+
+		if first == nil {
+			first = solve
+		} else {
+			first.more = append(first.more, solve.target)
+			first.resumedFrom += solve.resumedFrom
+			first.warnings = append(first.warnings, solve.warnings...)
+		}
+		if path := PuzzleCheckpointPath(opts.CheckpointPath, i); path != "" && i < len(puzzles)-1 {
+			if err := utils.SaveState(crypto.SolvingState{Puzzle: p, Result: solve.target, Done: p.T, Updated: time.Now()}, path); err != nil {
+				first.warnings = append(first.warnings, fmt.Sprintf("failed to keep the solution of puzzle %d: %v", i+1, err))
+			} else {
+				finished = append(finished, path)
+			}
+		}
+		done += p.T
+	}
+
+	for _, path := range finished {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			first.warnings = append(first.warnings, fmt.Sprintf("failed to remove checkpoint: %v", err))
+		}
+	}
+	return first, crypto.CombinePuzzleKeys(keys...), nil
+}
+
+// puzzleOptions returns opts for solving puzzle index of a file, done
+// squarings into its puzzles: its checkpoint path, which need not exist
+// yet, and callbacks that count the squarings of the puzzles before it.
+func puzzleOptions(opts DecryptOptions, index int, done uint64) DecryptOptions {
+	if index == 0 {
+		return opts
+	}
+	opts.CheckpointPath = PuzzleCheckpointPath(opts.CheckpointPath, index)
+	opts.RequireCheckpoint = false
+	if onResume := opts.OnResume; onResume != nil {
+		opts.OnResume = func(resumed uint64) { onResume(done + resumed) }
+	}
+	if onCheckpoint := opts.OnCheckpoint; onCheckpoint != nil {
+		opts.OnCheckpoint = func(state crypto.SolvingState, err error) {
+			state.Done += done
+			onCheckpoint(state, err)
+		}
+	}
+	return opts
+}
+
+// offsetProgress returns progress reporting done more squarings than it is
+// given, nil if progress is.
+func offsetProgress(progress ProgressCallback, done uint64) ProgressCallback {
+	if progress == nil || done == 0 {
+		return progress
+	}
+	return func(n uint64) { progress(done + n) }
+}
+
+// moreLockedPuzzles generates the puzzles of a file beyond its first (see
+// EncryptOptions.AndPuzzles) and adds them to header, returning the puzzle
+// key combined from key, the first puzzle's, and theirs.  Their bases are
+// random: only the first puzzle's is derived from a passphrase.
+func moreLockedPuzzles(opts EncryptOptions, header *types.FileHeader, key [32]byte) ([32]byte, error) {
+	if opts.AndPuzzles < 2 {
+		return key, nil
+	}
+	header.Ext.AndPuzzles = &types.AndPuzzles{}
+	keys := [][32]byte{key}
+	for i := 1; i < opts.AndPuzzles; i++ {
+		var progress func(done uint64)
+		if opts.Progress != nil {
+			offset := uint64(i) * opts.WorkFactor
+			progress = func(done uint64) { opts.Progress(offset + done) }
+		}
+		puzzle, priv, err := crypto.GeneratePuzzleWithOptions(opts.WorkFactor, nil, crypto.GenerateOptions{
+			NoTrapdoor: opts.NoTrapdoor,
+			Progress:   progress,
+			Bits:       opts.ModulusBits,
+		})
+		if err != nil {
+			return key, fmt.Errorf("failed to generate puzzle %d: %v", i+1, err)
+		}
+		if _, err := verifyPuzzle(opts, puzzle, priv); err != nil {
+			return key, fmt.Errorf("puzzle %d: %v", i+1, err)
+		}
+		k, err := derivePuzzleKey(header, puzzle.N, puzzle.Target)
+		if err != nil {
+			return key, fmt.Errorf("failed to derive encryption key: %v", err)
+		}
+		keys = append(keys, k)
+
+		nBytes, gBytes := utils.PuzzleToBytes(puzzle)
+		header.Ext.AndPuzzles.Puzzles = append(header.Ext.AndPuzzles.Puzzles, types.AndPuzzle{
+			WorkFactor: opts.WorkFactor,
+			ModulusN:   nBytes,
+			BaseG:      gBytes,
+		})
+	}
+	return crypto.CombinePuzzleKeys(keys...), nil
+}
@@ -0,0 +1,167 @@
+package operations
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// Kinds of nonce an audit compares.  Nonces of different kinds are never
+// compared with each other.
+const (
+	NonceData         = "nonce"        // the random nonce starting a data section (crypto.DataNonceSize bytes)
+	NonceStreamPrefix = "stream nonce" // the random prefix of a chunked data section (crypto.StreamNoncePrefixSize bytes)
+)
+
+// AuditNoncesOptions contains all the parameters needed for auditing the
+// nonces of encrypted files
+type AuditNoncesOptions struct {
+	Inputs []string // files or glob patterns
+}
+
+// NonceCollision is a nonce found in more than one data section.
+type NonceCollision struct {
+	Kind  string // NonceData or NonceStreamPrefix
+	Nonce []byte
+	Files []string // the data sections it starts, "bundle:member" for a bundle member
+}
+
+// SkippedFile is a file whose nonce an audit could not take, and why.
+type SkippedFile struct {
+	File   string
+	Reason string
+}
+
+// AuditNoncesResult contains the results of a nonce audit
+type AuditNoncesResult struct {
+	Audited    int // data sections whose nonce was compared
+	Collisions []NonceCollision
+	Skipped    []SkippedFile
+}
+
+// AuditNonces takes the nonce starting the data section of every file
+// matching opts.Inputs, and of every member of a bundle, and reports any
+// nonce found more than once.  Every file is sealed under a key of its own,
+// so a repeated nonce does not by itself break anything, but random 96-bit
+// nonces should never repeat: a collision points at a broken random number
+// generator or at data sealed twice.  Files that cannot be read, or whose
+// cipher has no nonce layout known here, are skipped rather than failing
+// the audit.  A file named by two patterns is audited once.
+func AuditNonces(opts AuditNoncesOptions) (*AuditNoncesResult, error) {
+	files, err := auditFiles(opts.Inputs)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &AuditNoncesResult{}
+	type nonceKey struct{ kind, nonce string }
+	seen := make(map[nonceKey][]string)
+	var order []nonceKey
+	record := func(name, kind string, nonce []byte) {
+		key := nonceKey{kind, string(nonce)}
+		if _, ok := seen[key]; !ok {
+			order = append(order, key)
+		}
+		seen[key] = append(seen[key], name)
+		result.Audited++
+	}
+
+	for _, file := range files {
+		ef, m, err := utils.ReadEncryptedFileMapped(file)
+		if err != nil {
+			result.Skipped = append(result.Skipped, SkippedFile{file, fmt.Sprintf("not a readable encrypted file: %v", err)})
+			continue
+		}
+		err = m.Access(func([]byte) error {
+			auditFileNonces(file, ef, record, result)
+			return nil
+		})
+		m.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", file, err)
+		}
+	}
+
+	for _, key := range order {
+		if names := seen[key]; len(names) > 1 {
+			result.Collisions = append(result.Collisions, NonceCollision{Kind: key.kind, Nonce: []byte(key.nonce), Files: names})
+		}
+	}
+	return result, nil
+}
+
+// auditFileNonces records the nonce of the data section of ef, named name,
+// or of each member of a bundle, and adds anything that has none to the
+// skipped files of result.
+func auditFileNonces(name string, ef *types.EncryptedFile, record func(name, kind string, nonce []byte), result *AuditNoncesResult) {
+	if bundle := ef.Ext.Bundle; bundle != nil {
+		offset := uint64(0)
+		for _, m := range bundle.Members {
+			member := name + ":" + m.Name
+			if m.Length > uint64(len(ef.Data))-offset {
+				result.Skipped = append(result.Skipped, SkippedFile{member, "truncated bundle member"})
+				return
+			}
+			mef, err := utils.ParseEncryptedFile(ef.Data[offset : offset+m.Length])
+			offset += m.Length
+			if err != nil {
+				result.Skipped = append(result.Skipped, SkippedFile{member, fmt.Sprintf("not a valid encrypted file: %v", err)})
+				continue
+			}
+			auditFileNonces(member, mef, record, result)
+		}
+		return
+	}
+
+	kind, size := NonceData, crypto.DataNonceSize
+	switch {
+	case ef.Ext.Cipher != crypto.CipherChaCha20Poly1305:
+		result.Skipped = append(result.Skipped, SkippedFile{name, fmt.Sprintf("cipher 0x%02x has no known nonce layout", ef.Ext.Cipher)})
+		return
+	case ef.Ext.ChunkSize != 0:
+		kind, size = NonceStreamPrefix, crypto.StreamNoncePrefixSize
+	}
+	if len(ef.Data) < size {
+		result.Skipped = append(result.Skipped, SkippedFile{name, fmt.Sprintf("data section of %d bytes holds no %s", len(ef.Data), kind)})
+		return
+	}
+	record(name, kind, ef.Data[:size])
+}
+
+// auditFiles expands inputs into the regular files they name, each once
+// and sorted.
+func auditFiles(inputs []string) ([]string, error) {
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("no files to audit")
+	}
+	unique := make(map[string]bool)
+	for _, input := range inputs {
+		matches, err := filepath.Glob(input)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input pattern %q: %v", input, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no such file: %s", input)
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if info.Mode().IsRegular() {
+				unique[filepath.Clean(match)] = true
+			}
+		}
+	}
+	files := make([]string, 0, len(unique))
+	for file := range unique {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files, nil
+}
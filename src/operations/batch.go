@@ -0,0 +1,193 @@
+package operations
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cryptotimed/src/utils"
+)
+
+// BatchItem is one encrypted file of a batch and where its output goes
+type BatchItem struct {
+	InputFile  string
+	OutputFile string
+}
+
+// PlanBatch expands inputs into the encrypted files to decrypt.  An input may
+// be a file, a glob pattern, a directory, which is searched recursively for
+// .locked files, or an http(s) URL.  With outputDir set, outputs are placed under it, keeping
+// each file's path relative to the directory it was found in; otherwise they
+// land next to their inputs.
+func PlanBatch(inputs []string, outputDir string) ([]BatchItem, error) {
+	if outputDir != "" {
+		if err := checkOutputDir(inputs, outputDir); err != nil {
+			return nil, err
+		}
+	}
+
+	var items []BatchItem
+	seen := make(map[string]string)
+	add := func(input, rel string) error {
+		output := defaultOutputFile(InputName(input))
+		if outputDir != "" {
+			output = filepath.Join(outputDir, defaultOutputFile(rel))
+		}
+		if prev, ok := seen[output]; ok {
+			return fmt.Errorf("%s and %s would both be decrypted to %s", prev, input, output)
+		}
+		seen[output] = input
+		items = append(items, BatchItem{InputFile: input, OutputFile: output})
+		return nil
+	}
+
+	for _, input := range inputs {
+		// URLs are fetched when their turn comes
+		if utils.IsURL(input) {
+			if err := add(input, utils.URLBase(input)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		matches, err := filepath.Glob(input)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input pattern %q: %v", input, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no such file: %s", input)
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				if err := add(match, filepath.Base(match)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			err = filepath.WalkDir(match, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.IsDir() || !strings.HasSuffix(path, ".locked") {
+					return nil
+				}
+				rel, err := filepath.Rel(match, path)
+				if err != nil {
+					return err
+				}
+				return add(path, rel)
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to scan %s: %v", match, err)
+			}
+		}
+	}
+
+	if len(items) == 0 {
+		return nil, errors.New("no .locked files found")
+	}
+	return items, nil
+}
+
+// DecryptBatch decrypts every file planned from inputs with the shared
+// options (key, solver settings, OutputDir).  With an OutputTemplate, each
+// output is named by the template (under OutputDir, if set) instead of
+// mirroring the input tree.  start is called before each file and returns
+// the progress callback to solve it with.  Files sharing a puzzle (see
+// EncryptGroup) are solved once and the solution reused.  It stops at the
+// first failure and returns the results of the files decrypted so far.
+func DecryptBatch(inputs []string, opts DecryptOptions, start func(item BatchItem) ProgressCallback) ([]*DecryptResult, error) {
+	if opts.Target != nil {
+		return nil, errors.New("a puzzle solution can only be given for a single file")
+	}
+	items, err := PlanBatch(inputs, opts.OutputDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*DecryptResult
+	solved := make(map[[32]byte]*big.Int)
+	for _, item := range items {
+		var progress ProgressCallback
+		if start != nil {
+			progress = start(item)
+		}
+
+		fileOpts := opts
+		fileOpts.InputFile = item.InputFile
+		if opts.OutputTemplate == "" {
+			fileOpts.OutputFile = item.OutputFile
+			fileOpts.OutputDir = ""
+		}
+		result, err := decryptFile(fileOpts, progress, solved)
+		if err != nil {
+			return results, fmt.Errorf("%s: %v", item.InputFile, err)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// defaultOutputFile returns the output name for an encrypted file: the
+// input without its .locked extension, or with .decrypted appended.
+func defaultOutputFile(input string) string {
+	if strings.HasSuffix(input, ".locked") {
+		return strings.TrimSuffix(input, ".locked")
+	}
+	return input + ".decrypted"
+}
+
+// checkOutputDir refuses an output directory inside an input directory: the
+// outputs would be picked up as inputs by the next recursive run.
+func checkOutputDir(inputs []string, outputDir string) error {
+	out, err := resolvePath(outputDir)
+	if err != nil {
+		return err
+	}
+	for _, input := range inputs {
+		matches, _ := filepath.Glob(input)
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || !info.IsDir() {
+				continue
+			}
+			dir, err := resolvePath(match)
+			if err != nil {
+				return err
+			}
+			if rel, err := filepath.Rel(dir, out); err == nil && filepath.IsLocal(rel) {
+				return fmt.Errorf("output directory %s is inside input directory %s", outputDir, match)
+			}
+		}
+	}
+	return nil
+}
+
+// resolvePath returns the absolute form of path with symlinks resolved in
+// the part of it that already exists.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	var missing []string
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...), nil
+		}
+		if filepath.Dir(dir) == dir {
+			return abs, nil
+		}
+		missing = append([]string{filepath.Base(dir)}, missing...)
+	}
+}
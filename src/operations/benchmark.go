@@ -1,20 +1,60 @@
 package operations
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"math"
 	"math/big"
+	"runtime"
 	"time"
 
 	"cryptotimed/src/crypto"
+	"cryptotimed/src/types"
 	"cryptotimed/src/utils"
 )
 
-// BenchmarkOptions contains all the parameters needed for benchmarking
+// BenchmarkOptions contains all the parameters needed for benchmarking.
+//
+// With TargetPrecision zero the benchmark takes exactly Samples samples of
+// Duration each (fixed mode, for scripted comparisons).  With TargetPrecision
+// set it keeps sampling until the relative standard error of the rate drops
+// below TargetPrecision or MaxDuration has been spent (adaptive mode).
 type BenchmarkOptions struct {
-	Duration time.Duration
-	Samples  int
+	Duration        time.Duration // length of each sample
+	Samples         int           // number of samples in fixed mode
+	PinThread       bool          // lock the squaring loop to one OS thread, as decrypt --pin-thread does
+	TargetPrecision float64       // target relative standard error, e.g. 0.02 (0 = fixed mode)
+	MaxDuration     time.Duration // time cap for adaptive mode (DefaultBenchmarkMaxDuration if zero)
+
+	// MatchFile is an encrypted file whose own modulus is squared instead
+	// of a freshly generated one, so the rate is the one its puzzle will be
+	// solved at (empty = generate a modulus).
+	MatchFile string
+
+	// ModulusBits is the size of the generated modulus (0 =
+	// crypto.DefaultModulusBits), for a rate to tune the work factor of a
+	// file encrypted with that size.  Unused with MatchFile.
+	ModulusBits int
 }
 
+const (
+	// DefaultBenchmarkPrecision is the relative standard error adaptive
+	// benchmarks aim for.
+	DefaultBenchmarkPrecision = 0.02
+
+	// DefaultBenchmarkMaxDuration caps how long an adaptive benchmark runs.
+	DefaultBenchmarkMaxDuration = time.Minute
+
+	// minAdaptiveSamples is the number of samples taken before the standard
+	// error is trusted.
+	minAdaptiveSamples = 3
+)
+
 // BenchmarkSample represents a single benchmark sample
 type BenchmarkSample struct {
 	Operations   uint64
@@ -28,7 +68,24 @@ type BenchmarkResult struct {
 	TotalOps        uint64
 	TotalTime       time.Duration
 	AvgOpsPerSecond float64
+	StdDev          float64 // sample standard deviation of the per-sample rates
+	RelStdErr       float64 // standard error of the mean rate ÷ mean rate (0 with fewer than 2 samples)
+	Adaptive        bool    // samples were taken until TargetPrecision or MaxDuration
+	Converged       bool    // adaptive mode reached TargetPrecision before the time cap
 	TimeEstimates   []TimeEstimate
+	Modulus         *big.Int // the modulus squared modulo
+
+	// Match is the estimate for BenchmarkOptions.MatchFile (nil if unset)
+	Match *MatchedFile
+}
+
+// MatchedFile is the time a benchmark matched to an encrypted file's
+// modulus estimates for solving that file's puzzle.
+type MatchedFile struct {
+	InputFile     string
+	ModulusBits   int
+	WorkFactor    uint64
+	EstimatedTime time.Duration
 }
 
 // TimeEstimate represents an estimated time for a given work factor
@@ -39,18 +96,57 @@ type TimeEstimate struct {
 
 // RunBenchmark performs the core benchmarking logic
 func RunBenchmark(opts BenchmarkOptions) (*BenchmarkResult, error) {
-	// Generate a test puzzle to get realistic RSA modulus (no password for benchmark)
-	testPuzzle, _, err := crypto.GeneratePuzzle(1, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate test puzzle: %v", err)
+	if opts.Duration <= 0 {
+		return nil, errors.New("benchmark sample duration must be positive")
+	}
+	if opts.TargetPrecision <= 0 && opts.Samples <= 0 {
+		return nil, errors.New("benchmark needs at least one sample")
+	}
+
+	// Square modulo the file's modulus, or generate a test puzzle to get a
+	// realistic RSA modulus (no password for benchmark)
+	var testPuzzle crypto.Puzzle
+	var match *MatchedFile
+	if opts.MatchFile != "" {
+		ef, err := utils.ReadEncryptedFile(opts.MatchFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", opts.MatchFile, err)
+		}
+		testPuzzle = utils.PuzzleFromEncryptedFile(ef)
+		if testPuzzle.N.Sign() <= 0 {
+			return nil, fmt.Errorf("%s has no puzzle modulus", opts.MatchFile)
+		}
+		match = &MatchedFile{
+			InputFile:   opts.MatchFile,
+			ModulusBits: testPuzzle.N.BitLen(),
+			WorkFactor:  ef.WorkFactor,
+		}
+	} else {
+		var err error
+		testPuzzle, _, err = crypto.GeneratePuzzleWithOptions(1, nil, crypto.GenerateOptions{Bits: opts.ModulusBits})
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate test puzzle: %v", err)
+		}
 	}
 
 	var samples []BenchmarkSample
 	var totalOps uint64
 	var totalTime time.Duration
 
-	for sample := 1; sample <= opts.Samples; sample++ {
-		ops, elapsed := benchmarkSquaring(testPuzzle.N, opts.Duration)
+	adaptive := opts.TargetPrecision > 0
+	maxDuration := opts.MaxDuration
+	if maxDuration <= 0 {
+		maxDuration = DefaultBenchmarkMaxDuration
+	}
+
+	var stdDev, relStdErr float64
+	converged := false
+	for sample := 1; ; sample++ {
+		if !adaptive && sample > opts.Samples {
+			break
+		}
+
+		ops, elapsed := benchmarkSquaring(testPuzzle.N, opts.Duration, opts.PinThread)
 		opsPerSecond := float64(ops) / elapsed.Seconds()
 
 		sampleResult := BenchmarkSample{
@@ -62,6 +158,18 @@ func RunBenchmark(opts BenchmarkOptions) (*BenchmarkResult, error) {
 		samples = append(samples, sampleResult)
 		totalOps += ops
 		totalTime += elapsed
+		stdDev, relStdErr = rateStatistics(samples)
+
+		if adaptive {
+			if len(samples) >= minAdaptiveSamples && relStdErr <= opts.TargetPrecision {
+				converged = true
+				break
+			}
+			// Stop when another sample would run past the time cap
+			if totalTime+opts.Duration > maxDuration {
+				break
+			}
+		}
 	}
 
 	// Calculate average performance
@@ -83,22 +191,318 @@ func RunBenchmark(opts BenchmarkOptions) (*BenchmarkResult, error) {
 			EstimatedTime: estimatedTime,
 		})
 	}
+	if match != nil {
+		match.EstimatedTime = utils.EstimateTime(match.WorkFactor, avgOpsPerSecond)
+	}
 
 	return &BenchmarkResult{
 		Samples:         samples,
 		TotalOps:        totalOps,
 		TotalTime:       totalTime,
 		AvgOpsPerSecond: avgOpsPerSecond,
+		StdDev:          stdDev,
+		RelStdErr:       relStdErr,
+		Adaptive:        adaptive,
+		Converged:       converged,
 		TimeEstimates:   timeEstimates,
+		Modulus:         testPuzzle.N,
+		Match:           match,
 	}, nil
 }
 
+// rateStatistics returns the sample standard deviation of the per-sample rates
+// and the relative standard error of their mean.
+func rateStatistics(samples []BenchmarkSample) (stdDev, relStdErr float64) {
+	n := float64(len(samples))
+	if len(samples) < 2 {
+		return 0, 0
+	}
+
+	var mean float64
+	for _, s := range samples {
+		mean += s.OpsPerSecond
+	}
+	mean /= n
+
+	var sumSq float64
+	for _, s := range samples {
+		d := s.OpsPerSecond - mean
+		sumSq += d * d
+	}
+	stdDev = math.Sqrt(sumSq / (n - 1))
+	if mean > 0 {
+		relStdErr = stdDev / math.Sqrt(n) / mean
+	}
+	return stdDev, relStdErr
+}
+
+// MeasureRate runs a short squaring benchmark against the given modulus and
+// returns the observed squarings per second.  Using the modulus of the file
+// being examined keeps the measurement representative of the real solve.
+func MeasureRate(N *big.Int, duration time.Duration) float64 {
+	ops, elapsed := benchmarkSquaring(N, duration, false)
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(ops) / elapsed.Seconds()
+}
+
+// DefaultTrapdoorWork is the work factor CompareTargetComputation uses when
+// given none: small enough to solve in about a second.
+const DefaultTrapdoorWork = 1000000
+
+// TargetComparison times the two ways of computing the target of one puzzle:
+// through the trapdoor, as the encryptor does, and by sequential squaring,
+// as a decryptor must.
+type TargetComparison struct {
+	WorkFactor       uint64
+	Trapdoor         time.Duration
+	Sequential       time.Duration
+	Ratio            float64 // Sequential ÷ Trapdoor
+	TrapdoorTarget   *big.Int
+	SequentialTarget *big.Int
+}
+
+// String summarizes the comparison in one line.
+func (c *TargetComparison) String() string {
+	return fmt.Sprintf("trapdoor: %.0fµs, sequential: %.0fms, ratio: %.0f",
+		float64(c.Trapdoor)/float64(time.Microsecond), float64(c.Sequential)/float64(time.Millisecond), c.Ratio)
+}
+
+// CompareTargetComputation generates a puzzle of workFactor squarings
+// (DefaultTrapdoorWork if 0) and computes its target both ways, showing why
+// encrypting is instant while decrypting takes as long as the work factor
+// says.  Generating the modulus is not timed.
+func CompareTargetComputation(workFactor uint64) (*TargetComparison, error) {
+	if workFactor == 0 {
+		workFactor = DefaultTrapdoorWork
+	}
+	if !crypto.TrapdoorAvailable() {
+		return nil, errors.New("this build has no trapdoor to compare (built with notrapdoor)")
+	}
+	puzzle, priv, err := crypto.GeneratePuzzle(workFactor, nil, crypto.DefaultModulusBits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate puzzle: %v", err)
+	}
+
+	cmp := &TargetComparison{WorkFactor: workFactor}
+	start := time.Now()
+	cmp.TrapdoorTarget, err = crypto.TrapdoorTarget(puzzle, priv)
+	cmp.Trapdoor = time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+	start = time.Now()
+	cmp.SequentialTarget, err = crypto.SolvePuzzle(context.Background(), puzzle, nil)
+	cmp.Sequential = time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+
+	if cmp.TrapdoorTarget.Cmp(cmp.SequentialTarget) != 0 {
+		return nil, errors.New("trapdoor and sequential targets differ")
+	}
+	if cmp.Trapdoor > 0 {
+		cmp.Ratio = float64(cmp.Sequential) / float64(cmp.Trapdoor)
+	}
+	return cmp, nil
+}
+
+// FileBenchmarkOptions contains all the parameters needed for benchmarking
+// the decryption of one encrypted file
+type FileBenchmarkOptions struct {
+	InputFile     string
+	FS            fs.FS         // filesystem InputFile is read from (utils.OS if nil)
+	ProbeDuration time.Duration // length of the squaring probe (DefaultFileProbeDuration if zero)
+	Save          bool          // store the result in the calibration profile under the file's fingerprint
+}
+
+const (
+	// DefaultFileProbeDuration is how long BenchmarkFile squares on the
+	// file's modulus.
+	DefaultFileProbeDuration = 5 * time.Second
+
+	// aeadSampleSize caps the data BenchmarkFile decrypts to measure AEAD
+	// throughput; larger data sections are extrapolated from it.
+	aeadSampleSize = 16 << 20
+
+	// aeadMinDuration is how long BenchmarkFile keeps decrypting its sample,
+	// so a small data section is timed over many runs.
+	aeadMinDuration = 200 * time.Millisecond
+)
+
+// FileBenchmark is the expected cost of decrypting one file on this machine,
+// stage by stage.
+type FileBenchmark struct {
+	InputFile   string
+	Fingerprint [32]byte // SHA-256 of the file header
+	utils.FileCalibration
+	Solve   time.Duration // WorkFactor squarings at Rate
+	Decrypt time.Duration // DataSize bytes at AEADRate
+	Saved   bool          // stored in the calibration profile
+}
+
+// BenchmarkFile measures what decrypting one encrypted file costs on this
+// machine: a squaring probe on the file's own modulus, one Argon2id
+// derivation with the parameters the file requires (against a dummy
+// passphrase) and the throughput of ChaCha20-Poly1305 over a data section
+// laid out like the file's.  Their sum is an end-to-end estimate that a
+// generic benchmark, run on a modulus of its own, cannot give.
+func BenchmarkFile(opts FileBenchmarkOptions) (*FileBenchmark, error) {
+	header, dataSize, _, err := checkInput(CheckOptions{InputFile: opts.InputFile, FS: opts.FS})
+	if err != nil {
+		return nil, err
+	}
+	if opts.ProbeDuration <= 0 {
+		opts.ProbeDuration = DefaultFileProbeDuration
+	}
+	if header.Ext.ChunkSize != 0 {
+		if err := crypto.ValidateChunkSize(int(header.Ext.ChunkSize)); err != nil {
+			return nil, fmt.Errorf("unsupported file: %v", err)
+		}
+	}
+	puzzle := utils.PuzzleFromEncryptedFile(types.NewEncryptedFile(header, nil))
+
+	b := &FileBenchmark{
+		InputFile:   opts.InputFile,
+		Fingerprint: header.Fingerprint(),
+		FileCalibration: utils.FileCalibration{
+			ModulusBits: puzzle.N.BitLen(),
+			WorkFactor:  header.WorkFactor,
+			DataSize:    int64(dataSize),
+			Measured:    time.Now(),
+		},
+	}
+	b.Rate = MeasureRate(puzzle.N, opts.ProbeDuration)
+	if b.Rate <= 0 {
+		return nil, errors.New("squaring probe measured no progress")
+	}
+	b.Solve = utils.EstimateTime(header.TotalWork(), b.Rate)
+
+	if header.KeyRequired == 1 {
+		start := time.Now()
+		if _, err := crypto.DerivePuzzleBase([]byte("benchmark"), puzzle); err != nil {
+			return nil, fmt.Errorf("failed to derive puzzle base: %v", err)
+		}
+		b.KeyDerivation = time.Since(start)
+	}
+
+	if dataSize > 0 {
+		b.AEADRate, err = measureAEADRate(dataSize, int(header.Ext.ChunkSize))
+		if err != nil {
+			return nil, fmt.Errorf("failed to measure decryption throughput: %v", err)
+		}
+		b.Decrypt = time.Duration(float64(dataSize) / b.AEADRate * float64(time.Second))
+	}
+	b.Estimate = b.Solve + b.KeyDerivation + b.Decrypt
+
+	if opts.Save {
+		if err := utils.RecordFileBenchmark(b.Fingerprint, &b.FileCalibration); err != nil {
+			return nil, fmt.Errorf("failed to update calibration profile: %v", err)
+		}
+		b.Saved = true
+	}
+	return b, nil
+}
+
+// measureAEADRate returns the bytes per second this machine authenticates
+// and decrypts of a data section of dataSize bytes, sealed in one piece or
+// in chunks of chunkSize.
+func measureAEADRate(dataSize, chunkSize int) (float64, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return 0, err
+	}
+	size := dataSize
+	if size > aeadSampleSize {
+		size = aeadSampleSize
+	}
+	plaintext := make([]byte, size)
+
+	var open func() error
+	if chunkSize != 0 {
+		var sealed bytes.Buffer
+		opts := crypto.StreamOptions{ChunkSize: chunkSize}
+		if err := crypto.EncryptStreamWithOptions(key, bytes.NewReader(plaintext), &sealed, opts); err != nil {
+			return 0, err
+		}
+		open = func() error {
+			return crypto.DecryptStreamWithOptions(key, bytes.NewReader(sealed.Bytes()), io.Discard, opts)
+		}
+	} else {
+		sealed, err := crypto.EncryptData(key, plaintext)
+		if err != nil {
+			return 0, err
+		}
+		open = func() error {
+			_, err := crypto.DecryptData(key, sealed)
+			return err
+		}
+	}
+
+	var runs int
+	start := time.Now()
+	for runs == 0 || time.Since(start) < aeadMinDuration {
+		if err := open(); err != nil {
+			return 0, err
+		}
+		runs++
+	}
+	return float64(runs*size) / time.Since(start).Seconds(), nil
+}
+
+// RateComparison relates the encryptor's recorded squaring rate to the rate
+// measured on this machine.
+type RateComparison struct {
+	EncryptorRate float64 // squarings/second recorded in the file header
+	LocalRate     float64 // squarings/second measured locally
+	DelayFactor   float64 // expected actual delay ÷ intended delay (>1 means slower here)
+	Message       string  // human-readable summary
+}
+
+// rateTolerance is the relative difference below which two rates are reported
+// as comparable.
+const rateTolerance = 1.2
+
+// CompareRates compares the encryptor's rate with the local rate.  The
+// intended delay of a file is WorkFactor ÷ encryptorRate, so a machine that is
+// k times slower needs about k times the intended delay.
+func CompareRates(encryptorRate, localRate float64) RateComparison {
+	cmp := RateComparison{EncryptorRate: encryptorRate, LocalRate: localRate}
+	if encryptorRate <= 0 || localRate <= 0 {
+		cmp.Message = "encryptor rate unknown; cannot compare machines"
+		return cmp
+	}
+
+	cmp.DelayFactor = encryptorRate / localRate
+	switch {
+	case cmp.DelayFactor >= rateTolerance:
+		cmp.Message = fmt.Sprintf("this machine is ~%.1fx slower than the encryptor's; expect ~%.1fx the intended delay",
+			cmp.DelayFactor, cmp.DelayFactor)
+	case cmp.DelayFactor <= 1/rateTolerance:
+		cmp.Message = fmt.Sprintf("this machine is ~%.1fx faster than the encryptor's; expect ~%.2fx the intended delay",
+			1/cmp.DelayFactor, cmp.DelayFactor)
+	default:
+		cmp.Message = "this machine runs at about the encryptor's speed; expect roughly the intended delay"
+	}
+	return cmp
+}
+
 // benchmarkSquaring performs modular squaring operations for the specified duration
-// and returns the number of operations performed and actual elapsed time
-func benchmarkSquaring(N *big.Int, duration time.Duration) (uint64, time.Duration) {
+// and returns the number of operations performed and actual elapsed time.  The
+// loop mirrors crypto.SolvePuzzleWithOptions (in-place squaring, optional
+// thread pinning) so the measured rate matches a real solve.
+func benchmarkSquaring(N *big.Int, duration time.Duration, pinThread bool) (uint64, time.Duration) {
+	if pinThread {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+
 	// Start with a random value
 	x := big.NewInt(12345)
 	x.Mod(x, N)
+	square := new(big.Int)
+	quotient := new(big.Int)
 
 	var operations uint64
 	start := time.Now()
@@ -107,7 +511,8 @@ func benchmarkSquaring(N *big.Int, duration time.Duration) (uint64, time.Duratio
 	for time.Now().Before(end) {
 		// Perform a batch of squaring operations to reduce time.Now() overhead
 		for i := 0; i < 1000; i++ {
-			x = crypto.SequentialSquaring(x, N)
+			square.Mul(x, x)
+			quotient.QuoRem(square, N, x)
 			operations++
 		}
 	}
@@ -0,0 +1,82 @@
+package operations
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// year is the unit hardware growth is given in.
+const year = 365.25 * 24 * time.Hour
+
+// BreakEvenOptions describes a solve weighed against waiting for faster
+// hardware.
+type BreakEvenOptions struct {
+	WorkFactor uint64
+	Rate       float64 // squarings per second of the fastest hardware today
+	Growth     float64 // factor that rate grows by every year, more than 1
+}
+
+// BreakEven is when to start a solve while hardware keeps getting faster.
+// Hardware bought d years from now squares Rate·Growth^d times a second, so
+// a solve started then finishes after d + T/(Rate·Growth^d).  That is
+// shortest for Growth^d = S·ln(Growth), S being the solve today in years,
+// or at d = 0 when S·ln(Growth) ≤ 1: from then on, what waiting longer
+// saves in the solve no longer makes up for the wait itself.
+type BreakEven struct {
+	WorkFactor uint64
+	Rate       float64
+	Growth     float64
+
+	SolveNow time.Duration // the solve started today
+	Wait     time.Duration // the best time to start it (0 = start now)
+	WaitRate float64       // squarings per second of the hardware bought then
+	Finish   time.Duration // from now until solved, starting after Wait
+
+	// Upgrading is from now until solved when the solve starts today and
+	// its checkpoint moves to the fastest hardware as it appears, which
+	// beats any wait: progress accrues at Rate·Growth^t, so it takes t
+	// years with Growth^t = 1 + S·ln(Growth).
+	Upgrading time.Duration
+}
+
+// EstimateBreakEven finds when to start solving a puzzle of opts.WorkFactor
+// squarings while hardware gets faster by opts.Growth a year.
+func EstimateBreakEven(opts BreakEvenOptions) (*BreakEven, error) {
+	switch {
+	case opts.WorkFactor == 0:
+		return nil, errors.New("work factor must be positive")
+	case !(opts.Rate > 0) || math.IsInf(opts.Rate, 1):
+		return nil, errors.New("squaring rate must be positive")
+	case !(opts.Growth > 1) || math.IsInf(opts.Growth, 1):
+		return nil, errors.New("hardware growth must be a factor of more than 1 a year")
+	}
+
+	seconds := float64(opts.WorkFactor) / opts.Rate
+	if seconds >= time.Duration(math.MaxInt64).Seconds() {
+		return nil, errors.New("the solve takes too long to weigh (over 290 years today)")
+	}
+	years := seconds / year.Seconds()
+	lnG := math.Log(opts.Growth)
+	wait := 0.0
+	if x := years * lnG; x > 1 {
+		wait = math.Log(x) / lnG
+	}
+
+	result := &BreakEven{
+		WorkFactor: opts.WorkFactor,
+		Rate:       opts.Rate,
+		Growth:     opts.Growth,
+		SolveNow:   inYears(years),
+		Wait:       inYears(wait),
+		WaitRate:   opts.Rate * math.Pow(opts.Growth, wait),
+		Finish:     inYears(wait + years*math.Pow(opts.Growth, -wait)),
+		Upgrading:  inYears(math.Log1p(years*lnG) / lnG),
+	}
+	return result, nil
+}
+
+// inYears returns a duration of y years.
+func inYears(y float64) time.Duration {
+	return time.Duration(y * float64(year))
+}
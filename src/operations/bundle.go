@@ -0,0 +1,208 @@
+package operations
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"path/filepath"
+	"time"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// BundleOptions contains all the parameters needed for bundling files
+type BundleOptions struct {
+	InputFiles []string      // encrypted files sharing one puzzle
+	OutputFile string        // the bundle to write
+	FS         fs.FS         // filesystem the inputs are read from (utils.OS if nil)
+	OutputFS   utils.WriteFS // filesystem the bundle is written to (utils.OS if nil)
+}
+
+// BundleResult contains the results of the bundle operation
+type BundleResult struct {
+	OutputFile  string
+	Members     []types.BundleMember
+	BundleSize  int
+	WorkFactor  uint64
+	KeyRequired bool
+}
+
+// BundleFiles merges encrypted files that share one puzzle, such as the
+// members of a shared puzzle group (see EncryptGroup), into a single bundle,
+// so that one solve unpacks them all.  The members are stored whole, under
+// their file names, so nothing is decrypted or re-sealed: the bundle's
+// header carries the common puzzle and a manifest of the members.
+func BundleFiles(opts BundleOptions) (*BundleResult, error) {
+	if len(opts.InputFiles) < 2 {
+		return nil, fmt.Errorf("a bundle needs at least two files")
+	}
+	if opts.OutputFile == "" {
+		return nil, fmt.Errorf("the bundle needs an output file")
+	}
+
+	fsys := utils.OrOS(opts.FS)
+	var first *types.FileHeader
+	var manifest types.BundleManifest
+	var data []byte
+	seen := make(map[string]string)
+	for _, input := range opts.InputFiles {
+		ef, err := utils.ReadEncryptedFileFS(fsys, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", input, err)
+		}
+		header := ef.Header()
+		if header.Ext.Bundle != nil {
+			return nil, fmt.Errorf("%s is already a bundle", input)
+		}
+		if header.Ext.AndPuzzles != nil {
+			return nil, fmt.Errorf("%s needs several puzzles solved; a bundle shares only one", input)
+		}
+		if first == nil {
+			first = header
+		} else if err := samePuzzle(first, header); err != nil {
+			return nil, fmt.Errorf("%s does not share the puzzle of %s: %v", input, opts.InputFiles[0], err)
+		}
+
+		name := filepath.Base(input)
+		if err := types.ValidateMemberName(name); err != nil {
+			return nil, fmt.Errorf("%s: %v", input, err)
+		}
+		if prev, ok := seen[name]; ok {
+			return nil, fmt.Errorf("%s and %s have the same file name", prev, input)
+		}
+		seen[name] = input
+
+		encoded, err := utils.EncodeEncryptedFile(ef)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %v", input, err)
+		}
+		manifest.Members = append(manifest.Members, types.BundleMember{Name: name, Length: uint64(len(encoded))})
+		data = append(data, encoded...)
+	}
+
+	// The bundle's own header is the common puzzle, with nothing of any
+	// member but the manifest
+	header := &types.FileHeader{
+		Version:     types.CurrentVersion,
+		WorkFactor:  first.WorkFactor,
+		KeyRequired: first.KeyRequired,
+		Salt:        first.Salt,
+		Ext: types.HeaderExtensions{
+			KeyDerivation: first.Ext.KeyDerivation,
+			KDFParams:     first.Ext.KDFParams,
+			EncryptorRate: first.Ext.EncryptorRate,
+			BaseTweak:     first.Ext.BaseTweak,
+			Bundle:        &manifest,
+		},
+	}
+	if err := header.SetModulus(first.Modulus(), first.Base()); err != nil {
+		return nil, err
+	}
+	header.MinReaderVersion = header.RequiredReaderVersion()
+
+	ef := types.NewEncryptedFile(header, data)
+	if err := utils.WriteEncryptedFileFS(utils.WritableOrOS(opts.OutputFS), opts.OutputFile, ef); err != nil {
+		return nil, fmt.Errorf("failed to write bundle: %v", err)
+	}
+	return &BundleResult{
+		OutputFile:  opts.OutputFile,
+		Members:     manifest.Members,
+		BundleSize:  header.Size() + 8 + len(data),
+		WorkFactor:  header.WorkFactor,
+		KeyRequired: header.KeyRequired == 1,
+	}, nil
+}
+
+// samePuzzle checks that two headers lock their files with the same puzzle
+// and derive the puzzle key the same way.
+func samePuzzle(a, b *types.FileHeader) error {
+	switch {
+	case a.Modulus().Cmp(b.Modulus()) != 0:
+		return fmt.Errorf("different modulus")
+	case a.Base().Cmp(b.Base()) != 0 || a.Salt != b.Salt || a.KeyRequired != b.KeyRequired || !sameBaseTweak(a.Ext.BaseTweak, b.Ext.BaseTweak):
+		return fmt.Errorf("different base")
+	case a.WorkFactor != b.WorkFactor:
+		return fmt.Errorf("different work factor (%d and %d)", a.WorkFactor, b.WorkFactor)
+	case a.Ext.KeyDerivation != b.Ext.KeyDerivation || !bytes.Equal(a.Ext.KDFParams.Bytes(), b.Ext.KDFParams.Bytes()):
+		return fmt.Errorf("different key derivation")
+	}
+	return nil
+}
+
+// sameBaseTweak reports whether two headers derive their password bases
+// with the same tweak, or both without one.
+func sameBaseTweak(a, b *types.BaseTweak) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// decryptBundle unpacks the bundle ef, whose puzzle has been solved, into the
+// directory outputDir of outputFS.  Every member is decrypted with the
+// bundle's solution and named as decrypt would name it on its own.
+func decryptBundle(opts DecryptOptions, ef *types.EncryptedFile, input *utils.MappedFile, outputFS utils.WriteFS, outputDir string, puzzle crypto.Puzzle, target *big.Int) ([]*DecryptResult, error) {
+	// Split the data section into the member files
+	members := make(map[string][]byte)
+	err := input.Access(func([]byte) error {
+		var offset uint64
+		for _, m := range ef.Ext.Bundle.Members {
+			if m.Length > uint64(len(ef.Data))-offset {
+				return fmt.Errorf("bundle member %s overruns data section", m.Name)
+			}
+			if _, ok := members[m.Name]; ok {
+				return fmt.Errorf("bundle member %s appears more than once", m.Name)
+			}
+			members[m.Name] = append([]byte(nil), ef.Data[offset:offset+m.Length]...)
+			offset += m.Length
+		}
+		if offset != uint64(len(ef.Data)) {
+			return fmt.Errorf("trailing bytes after the last bundle member")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	input.Close()
+
+	// The members' puzzle is the bundle's, so none of them is solved again
+	memberOpts := opts
+	memberOpts.FS = utils.NewMemoryFS(members, time.Time{})
+	memberOpts.OutputFS = outputFS
+	memberOpts.OutputDir = ""
+	memberOpts.OutputTemplate = ""
+	memberOpts.CacheTarget = false
+	memberOpts.CheckpointPath = ""
+	memberOpts.Control = nil
+	solved := map[[32]byte]*big.Int{puzzle.Fingerprint(): target}
+
+	// Never solve a member whose puzzle is not the bundle's after all
+	for _, m := range ef.Ext.Bundle.Members {
+		header, err := utils.ReadFileHeaderFS(memberOpts.FS, m.Name)
+		if err != nil {
+			return nil, fmt.Errorf("bundle member %s: %v", m.Name, err)
+		}
+		if err := samePuzzle(ef.Header(), header); err != nil {
+			return nil, fmt.Errorf("bundle member %s does not share the bundle's puzzle: %v", m.Name, err)
+		}
+		if header.Ext.Bundle != nil {
+			return nil, fmt.Errorf("bundle member %s is itself a bundle", m.Name)
+		}
+	}
+
+	var results []*DecryptResult
+	for _, m := range ef.Ext.Bundle.Members {
+		memberOpts.InputFile = m.Name
+		memberOpts.OutputFile = filepath.Join(outputDir, defaultOutputFile(m.Name))
+		result, err := decryptFile(memberOpts, nil, solved)
+		if err != nil {
+			return results, fmt.Errorf("bundle member %s: %v", m.Name, err)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
@@ -1,78 +1,292 @@
 package operations
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"io/fs"
 	"math/big"
+	"time"
 
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/types"
 	"cryptotimed/src/utils"
 )
 
 // CheckOptions contains all the parameters needed for checking file metadata
 type CheckOptions struct {
 	InputFile string
+	FS        fs.FS // filesystem InputFile is read from (utils.OS if nil)
+
+	// FetchTimeout bounds fetching InputFile when it is a URL
+	// (utils.DefaultFetchTimeout if 0).
+	FetchTimeout time.Duration
+
+	// Profile is a profile exported on another machine (see ExportProfile)
+	// to base the estimate on instead of this machine's.  It must have a
+	// rate for the file's modulus size.
+	Profile string
 }
 
 // CheckResult contains the metadata extracted from an encrypted file
 type CheckResult struct {
 	InputFile     string
 	Version       uint32
+	MinReader     uint32 // oldest format version able to decrypt the file (0 = not recorded)
 	WorkFactor    uint64
+	PuzzleCount   int    // puzzles that must all be solved, of WorkFactor squarings or so each (see types.AndPuzzles)
+	TotalWork     uint64 // squarings of all of them, which the estimate is for
 	ModulusN      *big.Int
 	BaseG         *big.Int
 	KeyRequired   bool
 	Salt          [16]byte
+	FileID        *[types.BaseTweakSize]byte // file ID mixed into the password base (nil = none)
+	KeyDerivation string
+	Cipher        string // cipher the data section is sealed with
+	OtherCipher   bool   // not ChaCha20-Poly1305, whose overhead PlaintextSize assumes (it is then 0)
+	EncryptorRate float64
 	DataSize      int
+	PlaintextSize int  // DataSize minus the nonce and tag (0 for an empty input)
+	DataTooShort  bool // data section cannot hold even the nonce and tag
 	TotalFileSize int64
 	EstimatedTime string
 	SecurityLevel string
+	EstimatedSecs float64 // unformatted EstimatedTime, for scripting
+	Container     bool    // multi-file container (see ListContainer)
+	EntryCount    int     // entries in the container (0 if PrivateTable)
+	PrivateTable  bool    // container entry table is encrypted
+	ChunkSize     uint32  // plaintext bytes per chunk (0 = sealed in one piece)
+	DataKey       bool    // the payload is a wrapped data key, not a document
+	KeySlots      int     // payloads, each opened by its own passphrase (0 = one payload)
+
+	// Bundle lists the encrypted files of a bundle (nil if the file is not
+	// one; see BundleFiles).  Each is sealed separately, so the bundle has
+	// no plaintext size of its own.
+	Bundle []types.BundleMember
+
+	// Calibration is this machine's rate for the file's modulus size from
+	// earlier solves (nil if none were recorded), which the estimate is
+	// based on when set.
+	Calibration *utils.CalibrationEntry
+
+	// Benchmark is what benchmark --for-file --save measured for this very
+	// file on this machine (nil if it was never run).
+	Benchmark *utils.FileCalibration
+
+	// Profile is CheckOptions.Profile, read (nil if not given).
+	// Calibration and Benchmark then come from it instead.
+	Profile *Profile
+
+	// FileSHA256 is the SHA-256 of the whole file (nil for a URL, of which
+	// only the header is fetched) and HeaderFingerprint that of its header
+	// alone (see utils.FileFingerprints).
+	FileSHA256        *[32]byte
+	HeaderFingerprint [32]byte
+
+	// SharedGroup is the shared puzzle group the file belongs to (nil if
+	// its puzzle is its own).  Solving any member unlocks the whole group.
+	SharedGroup *types.SharedPuzzle
 }
 
-// CheckFile inspects an encrypted file and extracts its metadata
+// CheckFile inspects an encrypted file and extracts its metadata.  For a URL
+// only the header is fetched (see utils.FetchHeader).
 func CheckFile(opts CheckOptions) (*CheckResult, error) {
-	// Read encrypted file
-	ef, err := utils.ReadEncryptedFile(opts.InputFile)
+	header, dataSize, totalSize, err := checkInput(opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read encrypted file: %v", err)
-	}
-
-	// Get file size
-	fileInfo, err := utils.GetFileInfo(opts.InputFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get file info: %v", err)
+		return nil, err
 	}
 
 	// Convert byte arrays to big.Int for display
-	modulusN := new(big.Int).SetBytes(ef.ModulusN[:])
-	baseG := new(big.Int).SetBytes(ef.BaseG[:])
+	modulusN := header.Modulus()
+	baseG := header.Base()
 
-	// Estimate time based on work factor (rough approximation)
-	estimatedTime := estimateDecryptionTime(ef.WorkFactor)
+	// The data section is the nonce, the ciphertext and the tag, so anything
+	// shorter than the overhead cannot be valid; exactly the overhead is an
+	// empty input.
+	plaintextSize := dataSize - crypto.DataOverhead
+	dataTooShort := plaintextSize < 0
+	if header.Ext.ChunkSize != 0 {
+		size, err := crypto.StreamPlaintextSize(int64(dataSize), int(header.Ext.ChunkSize))
+		plaintextSize, dataTooShort = int(size), err != nil
+	}
+	otherCipher := header.Ext.Cipher != crypto.CipherChaCha20Poly1305
+	if dataTooShort || otherCipher {
+		plaintextSize, dataTooShort = 0, dataTooShort && !otherCipher
+	}
+
+	// Estimate time from this machine's earlier solves if there were any,
+	// otherwise from a rough average; or from the machine a profile was
+	// measured on
+	rate := float64(avgOpsPerSecond)
+	calibration := utils.CalibratedRate(modulusN.BitLen())
+	benchmark := utils.CalibratedFile(header.Fingerprint())
+	var profile *Profile
+	if opts.Profile != "" {
+		if profile, err = LoadProfile(opts.Profile); err != nil {
+			return nil, err
+		}
+		if calibration, err = profile.ProfileRate(modulusN.BitLen()); err != nil {
+			return nil, err
+		}
+		benchmark = profile.File(header.Fingerprint())
+	}
+	if calibration != nil {
+		rate = calibration.Rate
+	}
+	estimatedTime := estimateDecryptionTime(header.TotalWork(), rate)
 
 	// Determine security level based on RSA key size
 	securityLevel := determineSecurityLevel(modulusN)
 
-	return &CheckResult{
+	result := &CheckResult{
 		InputFile:     opts.InputFile,
-		Version:       ef.Version,
-		WorkFactor:    ef.WorkFactor,
+		Version:       header.Version,
+		MinReader:     header.MinReaderVersion,
+		WorkFactor:    header.WorkFactor,
+		PuzzleCount:   header.PuzzleCount(),
+		TotalWork:     header.TotalWork(),
 		ModulusN:      modulusN,
 		BaseG:         baseG,
-		KeyRequired:   ef.KeyRequired == 1,
-		Salt:          ef.Salt,
-		DataSize:      len(ef.Data),
-		TotalFileSize: fileInfo.Size(),
+		KeyRequired:   header.KeyRequired == 1,
+		Salt:          header.Salt,
+		KeyDerivation: crypto.KeyDerivationName(header.Ext.KeyDerivation),
+		Cipher:        crypto.CipherName(header.Ext.Cipher),
+		OtherCipher:   otherCipher,
+		EncryptorRate: header.Ext.EncryptorRate,
+		DataSize:      dataSize,
+		PlaintextSize: plaintextSize,
+		DataTooShort:  dataTooShort,
+		TotalFileSize: totalSize,
 		EstimatedTime: estimatedTime,
 		SecurityLevel: securityLevel,
-	}, nil
+		EstimatedSecs: estimateDecryptionSeconds(header.TotalWork(), rate),
+		Calibration:   calibration,
+		Benchmark:     benchmark,
+		Profile:       profile,
+		ChunkSize:     header.Ext.ChunkSize,
+		SharedGroup:   header.Ext.Shared,
+		DataKey:       header.Ext.PayloadType == types.PayloadDataKey,
+
+		HeaderFingerprint: header.Fingerprint(),
+	}
+	if !(utils.IsURL(opts.InputFile) && utils.IsOS(opts.FS)) {
+		fp, err := utils.FingerprintFile(utils.OrOS(opts.FS), opts.InputFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fingerprint encrypted file: %v", err)
+		}
+		result.FileSHA256 = &fp.File
+	}
+	if t := header.Ext.BaseTweak; t != nil {
+		result.FileID = &t.FileID
+	}
+	if table := header.Ext.Container; table != nil {
+		// The data section holds many sealed entries, so the single-blob
+		// plaintext size does not apply
+		result.Container = true
+		result.EntryCount = len(table.Entries)
+		result.PrivateTable = table.Private
+		result.DataTooShort = false
+		result.PlaintextSize = 0
+		for _, e := range table.Entries {
+			result.PlaintextSize += int(e.Size)
+		}
+	}
+	if bundle := header.Ext.Bundle; bundle != nil {
+		result.Bundle = bundle.Members
+		result.DataTooShort = false
+		result.PlaintextSize = 0
+	}
+	if slots := header.Ext.KeySlots; slots != nil {
+		result.KeySlots = len(slots.Slots)
+		result.DataTooShort = false
+		result.PlaintextSize = 0
+	}
+	return result, nil
 }
 
-// estimateDecryptionTime provides a rough estimate of decryption time
-func estimateDecryptionTime(workFactor uint64) string {
-	// Rough estimate: assume ~500,000 operations per second on average hardware
-	// This is just an approximation and will vary significantly by hardware
-	const avgOpsPerSecond = 500000
+// DumpHeader returns the fields of the header of opts.InputFile as laid
+// out on disk (see utils.DumpHeader).  A URL is fetched whole.  When the
+// header is malformed the fields before the error are returned with it.
+func DumpHeader(opts CheckOptions) ([]utils.HeaderField, error) {
+	fsys, err := inputFS(opts.FS, opts.InputFile, opts.FetchTimeout)
+	if err != nil {
+		return nil, err
+	}
+	f, err := fsys.Open(opts.InputFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encrypted file: %v", err)
+	}
+	defer f.Close()
+	fields, err := utils.DumpHeader(bufio.NewReader(f))
+	if err != nil {
+		return fields, fmt.Errorf("failed to read encrypted file: %w", err)
+	}
+	return fields, nil
+}
+
+// checkInput returns the header of the file CheckFile inspects, the size of
+// its data section and the size of the whole file.
+func checkInput(opts CheckOptions) (*types.FileHeader, int, int64, error) {
+	if utils.IsURL(opts.InputFile) && utils.IsOS(opts.FS) {
+		header, size, err := utils.FetchHeader(opts.InputFile, opts.FetchTimeout)
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to read encrypted file: %w", err)
+		}
+		if size >= 0 {
+			dataSize := size - int64(header.Size()) - 8
+			if dataSize < 0 {
+				return nil, 0, 0, fmt.Errorf("failed to read encrypted file: %s is truncated", opts.InputFile)
+			}
+			return header, int(dataSize), size, nil
+		}
+		// The server did not say how large the file is; fetch all of it
+	}
+
+	fsys, err := inputFS(opts.FS, opts.InputFile, opts.FetchTimeout)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	f, err := fsys.Open(opts.InputFile)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to read encrypted file: %w", err)
+	}
+	defer f.Close()
 
-	estimatedSeconds := float64(workFactor) / avgOpsPerSecond
+	// Get file size
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to get file info: %v", err)
+	}
+
+	// A file that can be read at an offset, like a local file or a range
+	// reader over object storage, is only read as far as its header
+	if r, ok := f.(io.ReaderAt); ok {
+		header, dataSize, err := utils.ReadFileHeaderFromReaderAt(r, fileInfo.Size())
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to read encrypted file: %w", err)
+		}
+		return header, int(dataSize), fileInfo.Size(), nil
+	}
+	ef, err := utils.ReadEncryptedFileFS(fsys, opts.InputFile)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to read encrypted file: %w", err)
+	}
+	return ef.Header(), len(ef.Data), fileInfo.Size(), nil
+}
+
+// avgOpsPerSecond is the squaring rate assumed for an uncalibrated machine.
+// This is just an approximation and will vary significantly by hardware.
+const avgOpsPerSecond = 500000
+
+// estimateDecryptionSeconds estimates the decryption time in seconds at rate
+// squarings per second
+func estimateDecryptionSeconds(workFactor uint64, rate float64) float64 {
+	return float64(workFactor) / rate
+}
+
+// estimateDecryptionTime provides a rough estimate of decryption time
+func estimateDecryptionTime(workFactor uint64, rate float64) string {
+	estimatedSeconds := estimateDecryptionSeconds(workFactor, rate)
 
 	if estimatedSeconds < 60 {
 		return fmt.Sprintf("~%.1f seconds", estimatedSeconds)
@@ -93,11 +307,13 @@ func determineSecurityLevel(modulus *big.Int) string {
 	bitLength := modulus.BitLen()
 
 	switch {
+	case bitLength >= 3072:
+		return fmt.Sprintf("Very high (RSA-%d)", bitLength)
 	case bitLength >= 2048:
-		return "High (RSA-2048+)"
+		return fmt.Sprintf("High (RSA-%d)", bitLength)
 	case bitLength >= 1024:
-		return "Medium (RSA-1024+)"
+		return fmt.Sprintf("Medium (RSA-%d)", bitLength)
 	default:
-		return "Low (RSA-<1024)"
+		return fmt.Sprintf("Low (RSA-%d)", bitLength)
 	}
 }
@@ -0,0 +1,275 @@
+package operations
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// Checkpoint states reported by ListCheckpoints.
+const (
+	CheckpointActive   = "active"   // belongs to an encrypted file still to be decrypted
+	CheckpointComplete = "complete" // its solve finished; nothing is left to resume
+	CheckpointOrphaned = "orphaned" // its encrypted file is gone or holds another puzzle
+	CheckpointUnknown  = "unknown"  // its encrypted file could not be read
+	CheckpointInvalid  = "invalid"  // not a readable checkpoint
+)
+
+// CheckpointListOptions contains all the parameters needed for listing
+// decrypt checkpoints
+type CheckpointListOptions struct {
+	// Dirs are searched, with their subdirectories, for checkpoints
+	// (default: the current directory and utils.StateDir).
+	Dirs []string
+}
+
+// CheckpointInfo describes a checkpoint found by ListCheckpoints.
+type CheckpointInfo struct {
+	Path        string
+	State       string   // CheckpointActive, CheckpointComplete, ...
+	Reason      string   // why it is orphaned, unknown or invalid
+	Fingerprint [32]byte // puzzle fingerprint over N, G and T
+	Done        uint64   // squarings already done
+	WorkFactor  uint64
+	Percent     float64
+	Updated     time.Time
+	Size        int64 // bytes, with the record of a partly written output
+
+	LockedFile string // encrypted file it belongs to
+	Puzzle     int    // which puzzle of LockedFile it solves, from 1
+}
+
+// Removable reports whether the checkpoint can be deleted without losing
+// progress on a file: its solve completed or its file is gone.
+func (c *CheckpointInfo) Removable() bool {
+	return c.State == CheckpointComplete || c.State == CheckpointOrphaned
+}
+
+// CheckpointGCOptions contains all the parameters needed for removing
+// stale checkpoints
+type CheckpointGCOptions struct {
+	CheckpointListOptions
+	OlderThan time.Duration // only remove checkpoints last updated longer ago (0 = any)
+	DryRun    bool          // report what would be removed without removing it
+}
+
+// CheckpointGCResult contains the results of removing stale checkpoints
+type CheckpointGCResult struct {
+	Removed []CheckpointInfo // removed, or that would be with DryRun
+	Kept    []CheckpointInfo
+	Freed   int64    // bytes of the removed checkpoints
+	Errors  []string // checkpoints that could not be removed
+}
+
+// ListCheckpoints finds the checkpoints decrypt leaves while solving and
+// reports, for each, the file it belongs to and whether it is still needed.
+// A checkpoint named FILE.resume, or FILE.resume.N for further puzzles (see
+// PuzzleCheckpointPath), belongs to FILE; one in a background solve's state
+// directory belongs to the input its status file names.  A checkpoint saved
+// under another name is taken to belong to a missing file.  Nothing is
+// solved.
+func ListCheckpoints(opts CheckpointListOptions) ([]CheckpointInfo, error) {
+	dirs := opts.Dirs
+	if len(dirs) == 0 {
+		dirs = []string{"."}
+		// The state directory need not exist yet
+		if state, err := utils.StateDir(); err == nil {
+			if _, err := os.Stat(state); err == nil {
+				dirs = append(dirs, state)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	var list []CheckpointInfo
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if _, _, ok := checkpointName(path); !ok || !d.Type().IsRegular() {
+				return nil
+			}
+			abs, err := filepath.Abs(path)
+			if err != nil {
+				return err
+			}
+			if !seen[abs] {
+				seen[abs] = true
+				list = append(list, inspectCheckpoint(path))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list, nil
+}
+
+// GCCheckpoints removes the checkpoints ListCheckpoints finds removable,
+// with the record of the output they were writing, if any, and its partial
+// file.  Checkpoints whose file cannot be read, and files named like
+// checkpoints that are not, are kept.
+func GCCheckpoints(opts CheckpointGCOptions) (*CheckpointGCResult, error) {
+	list, err := ListCheckpoints(opts.CheckpointListOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &CheckpointGCResult{}
+	for _, c := range list {
+		if !c.Removable() || (opts.OlderThan > 0 && time.Since(c.Updated) < opts.OlderThan) {
+			result.Kept = append(result.Kept, c)
+			continue
+		}
+		if !opts.DryRun {
+			if err := removeCheckpoint(c.Path); err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", c.Path, err))
+				result.Kept = append(result.Kept, c)
+				continue
+			}
+		}
+		result.Removed = append(result.Removed, c)
+		result.Freed += c.Size
+	}
+	return result, nil
+}
+
+// checkpointName splits a checkpoint path into the path it was named after
+// and the puzzle it solves, from 1.  ok is false for files that are not
+// checkpoints by their name.
+func checkpointName(path string) (base string, puzzle int, ok bool) {
+	if strings.HasSuffix(path, ".resume") {
+		return strings.TrimSuffix(path, ".resume"), 1, true
+	}
+	i := strings.LastIndex(path, ".resume.")
+	if i < 0 {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(path[i+len(".resume."):])
+	if err != nil || n < 2 || n > types.MaxAndPuzzles {
+		return "", 0, false
+	}
+	return path[:i], n, true
+}
+
+// inspectCheckpoint reads the checkpoint at path and compares it with the
+// encrypted file it belongs to.
+func inspectCheckpoint(path string) CheckpointInfo {
+	base, puzzle, _ := checkpointName(path)
+	info := CheckpointInfo{Path: path, Puzzle: puzzle}
+	if fi, err := os.Stat(path); err == nil {
+		info.Size = fi.Size()
+		info.Updated = fi.ModTime()
+	}
+	if fi, err := os.Stat(utils.PartialOutputPath(path)); err == nil {
+		info.Size += fi.Size()
+	}
+
+	state, err := utils.LoadState(path)
+	if err != nil {
+		info.State, info.Reason = CheckpointInvalid, err.Error()
+		return info
+	}
+	info.Fingerprint = state.Puzzle.Fingerprint()
+	info.Done = state.Done
+	info.WorkFactor = state.Puzzle.T
+	info.Updated = state.Updated
+	info.Percent = 100
+	if state.Puzzle.T > 0 {
+		info.Percent = float64(state.Done) / float64(state.Puzzle.T) * 100
+	}
+
+	info.LockedFile = checkpointSource(base)
+	header, err := utils.ReadFileHeader(info.LockedFile)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		info.State, info.Reason = CheckpointOrphaned, "encrypted file not found"
+		return info
+	case err != nil:
+		info.State, info.Reason = CheckpointUnknown, fmt.Sprintf("failed to read encrypted file: %v", err)
+		return info
+	}
+
+	// The stored base is the one solved, password-derived or not
+	puzzles := append([]crypto.Puzzle{utils.PuzzleFromEncryptedFile(types.NewEncryptedFile(header, nil))}, utils.AndPuzzlesFromHeader(header)...)
+	if puzzle > len(puzzles) {
+		info.State, info.Reason = CheckpointOrphaned, fmt.Sprintf("encrypted file has no puzzle %d", puzzle)
+		return info
+	}
+	if err := state.Matches(puzzles[puzzle-1]); err != nil {
+		info.State, info.Reason = CheckpointOrphaned, err.Error()
+		return info
+	}
+
+	// A finished puzzle of several is kept until the last is solved
+	if state.Done >= state.Puzzle.T && len(puzzles) == 1 {
+		info.State = CheckpointComplete
+	} else {
+		info.State = CheckpointActive
+	}
+	return info
+}
+
+// checkpointSource returns the encrypted file a checkpoint named after base
+// belongs to: base itself, unless it does not exist and the status file of
+// a background solve in the same directory names another input.
+func checkpointSource(base string) string {
+	if _, err := os.Stat(base); err == nil {
+		return base
+	}
+	status, err := utils.ReadStatus(filepath.Join(filepath.Dir(base), "status.json"))
+	if err != nil || status.InputFile == "" {
+		return base
+	}
+	return status.InputFile
+}
+
+// removeCheckpoint removes the checkpoint at path, and the record of the
+// output it was writing with its partial file.
+func removeCheckpoint(path string) error {
+	record := utils.PartialOutputPath(path)
+	if partial, err := utils.LoadPartialOutput(record); err == nil && partial.Partial != "" {
+		if err := os.Remove(partial.Partial); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Remove(record); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// removeFinishedCheckpoints removes the checkpoints at path, or the paths of
+// the further puzzles of a file, that solve puzzles, the puzzles of a file
+// just decrypted.  A checkpoint of another puzzle is left alone.  It
+// returns warnings for checkpoints that could not be removed.
+func removeFinishedCheckpoints(path string, puzzles []crypto.Puzzle) []string {
+	if path == "" {
+		return nil
+	}
+	var warnings []string
+	for i, p := range puzzles {
+		checkpoint := PuzzleCheckpointPath(path, i)
+		state, err := utils.LoadState(checkpoint)
+		if err != nil || state.Matches(p) != nil {
+			continue
+		}
+		if err := os.Remove(checkpoint); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			warnings = append(warnings, fmt.Sprintf("failed to remove checkpoint: %v", err))
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,54 @@
+package operations
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"cryptotimed/src/utils"
+)
+
+// DefaultConfirmOver is how long a solve may be estimated to take before
+// decrypt asks for confirmation.
+const DefaultConfirmOver = 7 * 24 * time.Hour
+
+// ErrConfirmationRequired is returned by SolveGate.Check when a long solve
+// needs confirmation but nobody can be asked for it.
+var ErrConfirmationRequired = errors.New("confirmation required")
+
+// ErrSolveCancelled is returned by SolveGate.Check when the user declines a
+// long solve.
+var ErrSolveCancelled = errors.New("decryption cancelled")
+
+// SolveGate decides whether a solve may start given how long it is estimated
+// to take, so that a solve of weeks is not started by accident and left
+// looking hung.
+type SolveGate struct {
+	Threshold time.Duration // solves estimated to take longer need confirmation (0 = never ask)
+	Yes       bool          // confirmed in advance
+
+	// Prompt asks the user a yes/no question.  It is nil when there is
+	// nobody to ask (no terminal), in which case Yes is required.
+	Prompt func(question string) (bool, error)
+}
+
+// Check returns nil if a solve estimated to take estimate may start.  Solves
+// over the threshold need Yes or a confirming answer to Prompt.  An unknown
+// (zero) estimate never blocks.
+func (g SolveGate) Check(estimate time.Duration) error {
+	if g.Threshold <= 0 || estimate <= g.Threshold || g.Yes {
+		return nil
+	}
+	if g.Prompt == nil {
+		return fmt.Errorf("%w: solving would take about %s on this machine, more than %s; pass --yes to start anyway",
+			ErrConfirmationRequired, utils.FormatDuration(estimate), utils.FormatDuration(g.Threshold))
+	}
+	ok, err := g.Prompt(fmt.Sprintf("Solving will take about %s on this machine. Start anyway?", utils.FormatDuration(estimate)))
+	if err != nil {
+		return fmt.Errorf("failed to read confirmation: %v", err)
+	}
+	if !ok {
+		return ErrSolveCancelled
+	}
+	return nil
+}
@@ -0,0 +1,477 @@
+package operations
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// ListOptions contains all the parameters needed for listing a container
+type ListOptions struct {
+	InputFile string
+	FS        fs.FS // filesystem InputFile is read from (utils.OS if nil)
+
+	// FetchTimeout bounds fetching the header of InputFile when it is a URL
+	// (utils.DefaultFetchTimeout if 0).
+	FetchTimeout time.Duration
+}
+
+// ListResult contains the entry table of a container file
+type ListResult struct {
+	InputFile string
+	Private   bool // entry table is encrypted; listing requires solving
+	Entries   []types.ContainerEntry
+	TotalSize uint64
+}
+
+// ListContainer reads the entry table of a container from its header.  No
+// puzzle is solved, so the listing is not authenticated until the container
+// is decrypted (every entry is sealed with the table as associated data).
+func ListContainer(opts ListOptions) (*ListResult, error) {
+	header, err := ReadInputHeader(opts.FS, opts.InputFile, opts.FetchTimeout)
+	if err != nil {
+		return nil, err
+	}
+	table := header.Ext.Container
+	if table == nil {
+		return nil, fmt.Errorf("%s is not a container (it holds a single file)", opts.InputFile)
+	}
+
+	result := &ListResult{
+		InputFile: opts.InputFile,
+		Private:   table.Private,
+		Entries:   table.Entries,
+	}
+	for _, e := range table.Entries {
+		result.TotalSize += e.Size
+	}
+	return result, nil
+}
+
+// encryptContainer packs the directory opts.InputFile into a single
+// container file under the header and puzzle key returned by lock.  Each
+// regular file is sealed independently under its own subkey; directories are
+// recorded so that empty ones survive the round trip.
+func encryptContainer(opts EncryptOptions, lock lockFunc) (*EncryptResult, error) {
+	root := filepath.Clean(opts.InputFile)
+
+	excluder, err := utils.NewExcluder(opts.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	fsys := utils.OrOS(opts.FS)
+	entries, paths, skipped, excluded, err := collectEntries(fsys, root, excluder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input directory: %v", err)
+	}
+
+	header, encryptionKey, err := lock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Files with identical contents are stored once, sealed under the key
+	// of the first of them
+	hashes, err := hashEntries(fsys, entries, paths)
+	if err != nil {
+		return nil, err
+	}
+	owners := make([]int, len(entries))
+	seen := make(map[[32]byte]int)
+	duplicates := 0
+	for i, e := range entries {
+		owners[i] = i
+		if e.IsDir() {
+			continue
+		}
+		if j, ok := seen[hashes[i]]; ok && entries[j].Size == e.Size {
+			owners[i] = j
+			duplicates++
+		} else {
+			seen[hashes[i]] = i
+		}
+	}
+
+	// Lay out the data section.  Sealed sizes are known in advance, so the
+	// table (with offsets) can be encoded before anything is encrypted.
+	var offset uint64
+	if opts.PrivateListing {
+		offset = uint64(len(types.EncodeEntries(entries)) + crypto.DataOverhead)
+	}
+	var plaintextSize, storedSize int
+	for i := range entries {
+		if entries[i].IsDir() {
+			continue
+		}
+		plaintextSize += int(entries[i].Size)
+		if j := owners[i]; j != i {
+			entries[i].Offset, entries[i].Length = entries[j].Offset, entries[j].Length
+			continue
+		}
+		entries[i].Offset = offset
+		entries[i].Length = entries[i].Size + crypto.DataOverhead
+		offset += entries[i].Length
+		storedSize += int(entries[i].Size)
+	}
+	table := types.EncodeEntries(entries)
+	ad := crypto.EntryTableDigest(table)
+
+	// The header is complete once it holds the table (or its sealed length)
+	if opts.PrivateListing {
+		header.Ext.Container = &types.ContainerTable{Private: true, TableLength: uint64(len(table) + crypto.DataOverhead)}
+	} else {
+		header.Ext.Container = &types.ContainerTable{Entries: entries}
+	}
+	header.Ext.Container.Dedup = duplicates > 0
+	if err := padHeader(opts, header); err != nil {
+		return nil, err
+	}
+	encryptionKey, err = sealingKey(header, encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 0, offset)
+	if opts.PrivateListing {
+		tableKey, err := crypto.DeriveTableKey(encryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive table key: %v", err)
+		}
+		sealed, err := crypto.EncryptData(tableKey, table)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt entry table: %v", err)
+		}
+		if len(sealed) != len(table)+crypto.DataOverhead {
+			return nil, fmt.Errorf("sealed entry table has unexpected length %d", len(sealed))
+		}
+		data = append(data, sealed...)
+	}
+
+	for i, e := range entries {
+		if e.IsDir() || owners[i] != i {
+			continue
+		}
+		content, err := fs.ReadFile(fsys, paths[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", paths[i], err)
+		}
+		if uint64(len(content)) != e.Size {
+			return nil, fmt.Errorf("%s changed size while encrypting", paths[i])
+		}
+		if sha256.Sum256(content) != hashes[i] {
+			return nil, fmt.Errorf("%s changed while encrypting", paths[i])
+		}
+		entryKey, err := crypto.DeriveEntryKey(encryptionKey, uint64(i))
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive entry key: %v", err)
+		}
+		sealed, err := crypto.EncryptDataWithAD(entryKey, content, ad)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt %s: %v", e.Name, err)
+		}
+		data = append(data, sealed...)
+	}
+
+	ef := types.NewEncryptedFile(header, data)
+	result := &EncryptResult{
+		InputFile:     opts.InputFile,
+		PlaintextSize: plaintextSize,
+		EncryptedSize: ef.Header().Size() + 8 + len(data),
+		WorkFactor:    opts.WorkFactor,
+		KeyRequired:   ef.KeyRequired == 1,
+		Container:     true,
+		EntryCount:    len(entries),
+		SkippedCount:  skipped,
+		Shared:        ef.Ext.Shared,
+
+		DuplicateCount: duplicates,
+		DedupRatio:     1,
+		Excluded:       excluded,
+	}
+	if storedSize > 0 {
+		result.DedupRatio = float64(plaintextSize) / float64(storedSize)
+	}
+	if err := writeLocked(opts, root, ef, result, nil); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// hashEntries returns the SHA-256 of the contents of every file entry,
+// read from paths in fsys (zero for directories).
+func hashEntries(fsys fs.FS, entries []types.ContainerEntry, paths []string) ([][32]byte, error) {
+	hashes := make([][32]byte, len(entries))
+	for i, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		f, err := fsys.Open(paths[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", paths[i], err)
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", paths[i], err)
+		}
+		if uint64(n) != e.Size {
+			return nil, fmt.Errorf("%s changed size while encrypting", paths[i])
+		}
+		h.Sum(hashes[i][:0])
+	}
+	return hashes, nil
+}
+
+// ExcludeCount is the number of entries an exclude pattern left out of a
+// container.
+type ExcludeCount struct {
+	Pattern string
+	Count   int
+}
+
+// collectEntries walks root in fsys in lexical order and returns an entry for
+// every regular file and directory below it that excluder does not exclude,
+// the paths to read them from, the number of unsupported entries skipped and
+// the entries each pattern excluded.  Excluded directories are not walked.
+func collectEntries(fsys fs.FS, root string, excluder *utils.Excluder) ([]types.ContainerEntry, []string, int, []ExcludeCount, error) {
+	var entries []types.ContainerEntry
+	var paths []string
+	var excluded []ExcludeCount
+	skipped := 0
+
+	err := fs.WalkDir(fsys, root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if pattern, ok := excluder.Match(name, d.IsDir()); ok {
+			excluded = countExcluded(excluded, pattern)
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			skipped++
+			return nil
+		}
+
+		entry := types.ContainerEntry{
+			Name:    name,
+			Mode:    uint32(info.Mode()),
+			ModTime: info.ModTime().UnixNano(),
+		}
+		if info.Mode().IsRegular() {
+			entry.Size = uint64(info.Size())
+		}
+		if err := types.ValidateEntryName(entry.Name); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		paths = append(paths, path)
+		return nil
+	})
+	return entries, paths, skipped, excluded, err
+}
+
+// countExcluded adds one to the count of pattern in counts.
+func countExcluded(counts []ExcludeCount, pattern string) []ExcludeCount {
+	for i := range counts {
+		if counts[i].Pattern == pattern {
+			counts[i].Count++
+			return counts
+		}
+	}
+	return append(counts, ExcludeCount{Pattern: pattern, Count: 1})
+}
+
+// openContainer authenticates and decrypts the entries of a container held in
+// data that match patterns (all entries if patterns is empty).  Entries are
+// sealed independently, so unselected entries are never read.  Nothing is
+// returned unless every selected entry opens, so callers never write a
+// partial tree from a tampered file.
+func openContainer(table *types.ContainerTable, key [32]byte, data []byte, patterns []string) ([]types.ContainerEntry, [][]byte, error) {
+	entries := table.Entries
+	var encoded []byte
+	if table.Private {
+		if table.TableLength > uint64(len(data)) {
+			return nil, nil, errors.New("entry table overruns data section")
+		}
+		tableKey, err := crypto.DeriveTableKey(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		encoded, err = crypto.DecryptData(tableKey, data[:table.TableLength])
+		if err != nil {
+			return nil, nil, fmt.Errorf("entry table: %v", err)
+		}
+		entries, err = types.DecodeEntries(encoded)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		encoded = types.EncodeEntries(entries)
+	}
+	ad := crypto.EntryTableDigest(encoded)
+
+	selected, err := selectEntries(entries, patterns)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// An entry stored once for several is opened once, under its owner's key
+	owners := types.BlobOwners(entries, table.Dedup)
+	blobs := make(map[int][]byte)
+
+	var opened []types.ContainerEntry
+	var contents [][]byte
+	for i, e := range entries {
+		if !selected[i] {
+			continue
+		}
+		if e.IsDir() {
+			opened = append(opened, e)
+			contents = append(contents, nil)
+			continue
+		}
+		if e.Offset > uint64(len(data)) || e.Length > uint64(len(data))-e.Offset {
+			return nil, nil, fmt.Errorf("entry %s overruns data section", e.Name)
+		}
+		owner := owners[i]
+		content, ok := blobs[owner]
+		if !ok {
+			entryKey, err := crypto.DeriveEntryKey(key, uint64(owner))
+			if err != nil {
+				return nil, nil, err
+			}
+			content, err = crypto.DecryptDataWithAD(entryKey, data[e.Offset:e.Offset+e.Length], ad)
+			if err != nil {
+				return nil, nil, fmt.Errorf("entry %s: %v", e.Name, err)
+			}
+			blobs[owner] = content
+		}
+		if uint64(len(content)) != e.Size {
+			return nil, nil, fmt.Errorf("entry %s: size mismatch", e.Name)
+		}
+		opened = append(opened, e)
+		contents = append(contents, content)
+	}
+	return opened, contents, nil
+}
+
+// selectEntries reports which entries match at least one of the glob
+// patterns (path.Match syntax, matched against the slash-separated entry
+// name).  A pattern that matches a directory selects everything below it.
+// Every pattern must match something.
+func selectEntries(entries []types.ContainerEntry, patterns []string) ([]bool, error) {
+	selected := make([]bool, len(entries))
+	if len(patterns) == 0 {
+		for i := range selected {
+			selected[i] = true
+		}
+		return selected, nil
+	}
+
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(pattern, "/")
+		matched := false
+		for i, e := range entries {
+			ok, err := path.Match(pattern, e.Name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid entry pattern %q: %v", pattern, err)
+			}
+			if !ok {
+				// Entries below a matching directory
+				for dir := path.Dir(e.Name); dir != "." && !ok; dir = path.Dir(dir) {
+					ok, _ = path.Match(pattern, dir)
+				}
+			}
+			if ok {
+				selected[i] = true
+				matched = true
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("no container entry matches %q", pattern)
+		}
+	}
+	return selected, nil
+}
+
+// writeContainer recreates the entries under dir in fsys, restoring
+// permissions and, where fsys supports it, modification times.  It returns
+// the number of plaintext bytes written.
+//
+// Stored permissions come from whoever made the file, so they are masked by
+// the umask like any other new file's, never carry setuid, setgid or sticky
+// bits, and always leave the owner able to read and write (and enter
+// directories).
+func writeContainer(fsys utils.WriteFS, dir string, entries []types.ContainerEntry, contents [][]byte) (int, error) {
+	if err := fsys.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	umask := utils.Umask()
+	written := 0
+	for i, e := range entries {
+		rel := filepath.FromSlash(e.Name)
+		if !filepath.IsLocal(rel) {
+			return written, fmt.Errorf("unsafe container entry name %q", e.Name)
+		}
+		target := filepath.Join(dir, rel)
+		perm := fs.FileMode(e.Mode).Perm() &^ umask
+
+		if e.IsDir() {
+			if err := fsys.MkdirAll(target, perm|0700); err != nil {
+				return written, err
+			}
+			continue
+		}
+		if err := fsys.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return written, err
+		}
+		if err := fsys.WriteFile(target, contents[i], perm|0600); err != nil {
+			return written, err
+		}
+		written += len(contents[i])
+	}
+
+	// Restore modification times last, deepest entries first, so that
+	// creating children does not bump their parent directory's time.
+	chtimes, ok := fsys.(utils.ChtimesFS)
+	if !ok {
+		return written, nil
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		mtime := time.Unix(0, e.ModTime)
+		target := filepath.Join(dir, filepath.FromSlash(e.Name))
+		if err := chtimes.Chtimes(target, mtime, mtime); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,199 @@
+package operations
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// errNoKeySlot is returned when no key slot opens with the given passphrase.
+var errNoKeySlot = errors.New("no key slot opens with this passphrase")
+
+// encryptWithDecoy encrypts opts.InputFile to open with the passphrase of
+// opts.KeyInput and opts.DecoyFile to open with that of opts.DecoyKeyInput,
+// in a single file of key slots (see types.KeySlots).  Each passphrase
+// derives its own base for the same modulus, so each has a puzzle of its
+// own, and the file does not tell which passphrase is the real one.
+func encryptWithDecoy(opts EncryptOptions, userKeyRaw, decoyKeyRaw []byte) (*EncryptResult, error) {
+	fsys := utils.OrOS(opts.FS)
+	plaintext, err := fs.ReadFile(fsys, opts.InputFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input file: %v", err)
+	}
+	decoy, err := fs.ReadFile(fsys, opts.DecoyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read decoy file: %v", err)
+	}
+
+	// One modulus, one puzzle per passphrase.  Without the trapdoor both
+	// targets are computed by squaring, and progress counts through both.
+	puzzle, priv, err := crypto.GeneratePuzzleWithOptions(opts.WorkFactor, userKeyRaw, crypto.GenerateOptions{
+		NoTrapdoor: opts.NoTrapdoor,
+		Progress:   opts.Progress,
+		BaseTweak:  opts.BaseTweak,
+		Bits:       opts.ModulusBits,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate puzzle: %v", err)
+	}
+	var decoyProgress func(done uint64)
+	if opts.Progress != nil {
+		decoyProgress = func(done uint64) { opts.Progress(opts.WorkFactor + done) }
+	}
+	decoyPuzzle, err := crypto.PuzzleForPassword(puzzle, priv, decoyKeyRaw, decoyProgress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate decoy puzzle: %v", err)
+	}
+	check, err := verifyPuzzle(opts, puzzle, priv)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := verifyPuzzle(opts, decoyPuzzle, priv); err != nil {
+		return nil, fmt.Errorf("decoy %v", err)
+	}
+
+	// The stored base would match the real passphrase, so store a random
+	// one: a key-slot file's base is always derived from the passphrase
+	header, err := lockedHeader(opts, puzzle)
+	if err != nil {
+		return nil, err
+	}
+	cover, err := rand.Int(rand.Reader, puzzle.N)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate cover base: %v", err)
+	}
+	if err := header.SetModulus(puzzle.N, cover); err != nil {
+		return nil, err
+	}
+
+	realSlot, err := sealKeySlot(puzzle, header, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	decoySlot, err := sealKeySlot(decoyPuzzle, header, decoy)
+	if err != nil {
+		return nil, err
+	}
+
+	// Store the slots in random order so their position tells nothing
+	var coin [1]byte
+	if _, err := rand.Read(coin[:]); err != nil {
+		return nil, fmt.Errorf("failed to shuffle key slots: %v", err)
+	}
+	slots := []*sealedSlot{realSlot, decoySlot}
+	if coin[0]&1 == 1 {
+		slots[0], slots[1] = slots[1], slots[0]
+	}
+	header.Ext.KeySlots = &types.KeySlots{}
+	var data []byte
+	for _, s := range slots {
+		header.Ext.KeySlots.Slots = append(header.Ext.KeySlots.Slots, s.slot)
+		data = append(data, s.payload...)
+	}
+	if err := padHeader(opts, header); err != nil {
+		return nil, err
+	}
+
+	ef := types.NewEncryptedFile(header, data)
+	result := &EncryptResult{
+		InputFile:     opts.InputFile,
+		PlaintextSize: len(plaintext),
+		DecoySize:     len(decoy),
+		EncryptedSize: ef.Header().Size() + 8 + len(data),
+		WorkFactor:    opts.WorkFactor,
+		KeyRequired:   true,
+		PuzzleCheck:   check,
+	}
+	var plaintextHash *[32]byte
+	if opts.Verify {
+		sum := sha256.Sum256(plaintext)
+		plaintextHash = &sum
+	}
+	if err := writeLocked(opts, opts.InputFile, ef, result, plaintextHash); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// sealedSlot is a key slot with the payload sealed under its data key.
+type sealedSlot struct {
+	slot    types.KeySlot
+	payload []byte
+}
+
+// sealKeySlot seals plaintext under a fresh data key, wrapped under the key
+// derived from the solved puzzle as header describes.
+func sealKeySlot(puzzle crypto.Puzzle, header *types.FileHeader, plaintext []byte) (*sealedSlot, error) {
+	puzzleKey, err := derivePuzzleKey(header, puzzle.N, puzzle.Target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive encryption key: %v", err)
+	}
+	var dataKey [32]byte
+	if _, err := rand.Read(dataKey[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %v", err)
+	}
+
+	wrapped, err := crypto.EncryptData(puzzleKey, dataKey[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %v", err)
+	}
+	payload, err := crypto.EncryptData(dataKey, plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt data: %v", err)
+	}
+
+	if len(wrapped) != types.WrappedKeySize {
+		return nil, fmt.Errorf("wrapped data key is %d bytes, want %d", len(wrapped), types.WrappedKeySize)
+	}
+	s := &sealedSlot{payload: payload}
+	copy(s.slot.Wrapped[:], wrapped)
+	s.slot.Length = uint64(len(payload))
+	return s, nil
+}
+
+// unwrapKeySlot returns the index and data key of the slot that opens with
+// puzzleKey, or errNoKeySlot.
+func unwrapKeySlot(slots *types.KeySlots, puzzleKey [32]byte) (int, [32]byte, error) {
+	var dataKey [32]byte
+	for i, slot := range slots.Slots {
+		key, err := crypto.DecryptData(puzzleKey, slot.Wrapped[:])
+		if err != nil {
+			continue
+		}
+		if len(key) != len(dataKey) {
+			return 0, dataKey, fmt.Errorf("key slot %d holds a %d-byte key", i, len(key))
+		}
+		copy(dataKey[:], key)
+		return i, dataKey, nil
+	}
+	return 0, dataKey, errNoKeySlot
+}
+
+// openKeySlots returns the payload of the slot that opens with puzzleKey.
+func openKeySlots(slots *types.KeySlots, puzzleKey [32]byte, data []byte) ([]byte, error) {
+	// Find every payload first, so a bad table fails whatever the passphrase
+	payloads := make([][]byte, len(slots.Slots))
+	var offset uint64
+	for i, slot := range slots.Slots {
+		if slot.Length > uint64(len(data))-offset {
+			return nil, fmt.Errorf("key slot %d overruns data section", i)
+		}
+		payloads[i] = data[offset : offset+slot.Length]
+		offset += slot.Length
+	}
+	if offset != uint64(len(data)) {
+		return nil, fmt.Errorf("trailing bytes after the last key slot")
+	}
+
+	i, dataKey, err := unwrapKeySlot(slots, puzzleKey)
+	if err != nil {
+		return nil, err
+	}
+	return crypto.DecryptData(dataKey, payloads[i])
+}
@@ -1,10 +1,20 @@
 package operations
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"strings"
+	"io"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
 
 	"cryptotimed/src/crypto"
+	"cryptotimed/src/types"
 	"cryptotimed/src/utils"
 )
 
@@ -13,6 +23,167 @@ type DecryptOptions struct {
 	InputFile  string
 	KeyInput   string
 	OutputFile string
+	PinThread  bool // lock the solver to one OS thread
+	GCPercent  int  // GOGC while solving (0 = unchanged)
+
+	// OutputDir places the output (a file, or a container's extracted tree)
+	// under this directory, created if needed.  OutputFile takes precedence.
+	// A wrapped data key (see EncryptOptions.DataKey) is only written to a
+	// file when OutputFile or OutputDir is set; otherwise it is just
+	// returned in DecryptResult.DataKey.
+	OutputDir string
+
+	// OutputTemplate names the output when OutputFile is empty (see
+	// ParseOutputTemplate; DefaultDecryptTemplate if empty).
+	OutputTemplate string
+
+	// Entries restricts container extraction to entries matching these
+	// glob patterns (all entries if empty).
+	Entries []string
+
+	// CacheTarget reuses a previously cached puzzle solution and caches
+	// this one, so later runs on the same file skip the solve.  Anyone who
+	// can read the cache can decrypt the file immediately.
+	CacheTarget bool
+
+	// CheckpointPath, if set, is where solving progress is saved.  A
+	// checkpoint of the same puzzle found there is resumed, and the file is
+	// removed once the puzzle is solved, or the file decrypted without
+	// solving it, e.g. from the cache.
+	CheckpointPath string
+
+	// RequireCheckpoint refuses to solve from the start: a missing
+	// checkpoint at CheckpointPath, or one that cannot be resumed, is an
+	// error instead of a fresh start, so a mistyped path or a file
+	// encrypted again does not silently throw away days of progress.  It
+	// applies to the first puzzle of a file that has several; the
+	// checkpoints of the others only exist once the solve reached them.
+	RequireCheckpoint bool
+
+	// CheckpointInterval saves a checkpoint this often while solving (0 =
+	// only when Control asks for one or stops the solve).
+	CheckpointInterval time.Duration
+
+	// CheckpointEvery, if set, also saves a checkpoint every this many
+	// squarings (counted from G, also when resuming), whatever the time
+	// they take.
+	CheckpointEvery uint64
+
+	// MemoryCheckpointEvery, if set, keeps the solve's state in memory
+	// every this many squarings (see crypto.SolveOptions.Snapshot) instead
+	// of interrupting the solver for each checkpoint: CheckpointInterval
+	// and FlushCheckpoint write the latest state kept to disk, at the cost
+	// of losing the squarings done since.  Control still asks the solver
+	// for a fresh checkpoint, as does a stop.  With CheckpointEvery, the
+	// state kept is that of the latest checkpoint.
+	MemoryCheckpointEvery uint64
+
+	// FlushCheckpoint, if set, writes a checkpoint each time it receives,
+	// e.g. on a signal: the latest state kept in memory, even while the
+	// solve is paused, or without MemoryCheckpointEvery a fresh one
+	// requested through Control.
+	FlushCheckpoint <-chan struct{}
+
+	// Control pauses, checkpoints or stops the solve from another goroutine.
+	// A stopped solve saves a final checkpoint and DecryptFile returns an
+	// error wrapping crypto.ErrSolveStopped.
+	Control *crypto.SolveControl
+
+	// SolveFor time-boxes the solve: once it has run this long, not
+	// counting pauses, it is stopped with a checkpoint, like a Control
+	// stop, and DecryptFile returns an error wrapping ErrSolveTimeUp.
+	// Repeated runs carry on from the checkpoint until the puzzle is
+	// solved.  It requires CheckpointPath (0 = no limit).
+	SolveFor time.Duration
+
+	// Throttle, if set, holds the solve to a fraction of one core (see
+	// crypto.CPUThrottle); it measures the share actually used as well.
+	Throttle *crypto.CPUThrottle
+
+	// Context, if set, stops the solve once it is done, like a Control
+	// stop: DecryptFile returns an error wrapping both
+	// crypto.ErrSolveStopped and the context's error (context.Canceled or
+	// context.DeadlineExceeded), which errors.Is tells apart from a failure
+	// to decrypt.
+	Context context.Context
+
+	// ProgressStrategy decides how often the solve reports progress to the
+	// callback (crypto.DefaultProgressStrategy if nil).
+	ProgressStrategy crypto.ProgressStrategy
+
+	// SkipSpaceCheck skips comparing the free space of the output's
+	// filesystem with the size of the output before solving, for
+	// filesystems that misreport it.  Writability is still checked.
+	SkipSpaceCheck bool
+
+	// NoCalibrate keeps the rate of this solve out of the calibration
+	// profile (see utils.RecordSolveRate), e.g. while benchmarking.
+	NoCalibrate bool
+
+	// OnResume is called with the squarings already done when a checkpoint
+	// is resumed, before solving continues.
+	OnResume func(done uint64)
+
+	// FS is the filesystem InputFile is read from, and OutputFS the one the
+	// output is written to (utils.OS if nil).  Checkpoints and cached
+	// solutions always live on the OS filesystem.
+	FS       fs.FS
+	OutputFS utils.WriteFS
+
+	// Input, if set, is the encrypted file, of InputSize bytes, read at
+	// offsets like a range reader over object storage: its header is read
+	// and checked before its data is fetched.  InputFile then only names
+	// it, for the default output name.  Such an input is not decrypted in
+	// place and its finished checkpoints are left alone, as for a file
+	// outside the OS filesystem.
+	Input     io.ReaderAt
+	InputSize int64
+
+	// LocalCopy, if set, is a file of the OS filesystem holding the
+	// encrypted file, e.g. stdin copied to a temporary file, read like a
+	// local file instead of InputFile, which then only names it.  It is
+	// memory-mapped when large, so neither it nor its plaintext has to fit
+	// in memory.  As with Input, nothing is decrypted in place and finished
+	// checkpoints are left alone.
+	LocalCopy string
+
+	// FetchTimeout bounds downloading InputFile when it is an http:// or
+	// https:// URL (utils.DefaultFetchTimeout if 0).  The file is read into
+	// memory and outputs are named after the last element of its path.
+	FetchTimeout time.Duration
+
+	// OnCheckpoint is called after each checkpoint is written (err nil) or
+	// fails to be written.  It runs on the solver's checkpoint goroutine.
+	OnCheckpoint func(state crypto.SolvingState, err error)
+
+	// InPlace replaces InputFile, which must be a chunked file of the OS
+	// filesystem, with its plaintext under the default output name.  Where
+	// the filesystem has room for both, the plaintext is written to a new
+	// file and the input removed; otherwise it is decrypted over its own
+	// bytes (see utils.TransformInPlace).  An operation interrupted by a
+	// crash is finished instead.
+	InPlace bool
+
+	// InPlaceOverwrite decrypts over the input's own bytes even when there
+	// is room for a new file.
+	InPlaceOverwrite bool
+
+	// Target, if set, is the solution of the file's puzzle found elsewhere,
+	// e.g. by a faster machine: it is used instead of solving, and the
+	// cache is left alone.  It must lie in [1, N).  A file
+	// stores no commitment to its solution, so a wrong target is only
+	// noticed when the data fails to authenticate.  A file of several
+	// puzzles (see types.AndPuzzles) is refused: one solution is not enough.
+	Target *big.Int
+
+	// ProofFile, if set, is where a proof that the puzzle was solved (see
+	// crypto.SolveProof) is written once it is, for VerifySolveProof.  The
+	// proof is built during the solve, so the puzzle must be solved here
+	// from the start: it is refused with Target or CacheTarget, for a file
+	// of several puzzles, and when a checkpoint with progress would be
+	// resumed.  The proof holds the solution; it is written readable only
+	// by its owner.
+	ProofFile string
 }
 
 // DecryptResult contains the results of the decryption operation
@@ -21,82 +192,666 @@ type DecryptResult struct {
 	OutputFile    string
 	PlaintextSize int
 	WorkFactor    uint64
+	Container     bool     // OutputFile is a directory of extracted entries
+	Bundle        bool     // OutputFile is a directory of the bundle's decrypted members
+	DataKey       []byte   // the unwrapped data key, for a data-key file (see EncryptOptions.DataKey)
+	EntryCount    int      // entries extracted (containers) or members decrypted (bundles)
+	FromCache     bool     // the puzzle solution came from the target cache
+	Reused        bool     // the puzzle solution was reused from an earlier file of the batch
+	ResumedFrom   uint64   // squarings restored from a checkpoint
+	ResumedChunks uint64   // chunks of output kept from an interrupted decrypt (see utils.PartialOutput)
+	ProofFile     string   // where the proof of the solve was written (DecryptOptions.ProofFile)
+	Warnings      []string // non-fatal problems, e.g. an ignored checkpoint
+
+	InPlace          bool // the input was replaced by OutputFile (DecryptOptions.InPlace)
+	InPlaceOverwrite bool // it was decrypted over its own bytes
+	InPlaceResumed   bool // an interrupted in-place operation was finished instead
+
+	// The solved puzzle, for publishing the key (see NewKeyRelease).  For
+	// a file of several puzzles, Target solves the first, MoreTargets the
+	// others in order, and Key combines the keys of all of them.
+	Fingerprint   [32]byte // SHA-256 of the file header
+	Target        *big.Int
+	TargetWidth   int // bytes the targets are zero-padded to, the modulus width
+	MoreTargets   []*big.Int
+	Key           [32]byte
+	KeyDerivation uint8
 }
 
+// ErrSolveTimeUp is returned, wrapped with crypto.ErrSolveStopped, when
+// DecryptOptions.SolveFor ends a solve before it finished.
+var ErrSolveTimeUp = errors.New("solve time used up")
+
 // ProgressCallback is a function type for progress updates during puzzle solving
 type ProgressCallback func(done uint64)
 
 // DecryptFile performs the core decryption logic
 func DecryptFile(opts DecryptOptions, progressCallback ProgressCallback) (*DecryptResult, error) {
+	return decryptFile(opts, progressCallback, nil)
+}
+
+// DecryptWithTarget decrypts inputFile, opened with the passphrase key (or
+// none if empty), using target as the solution of its puzzle instead of
+// solving it (see DecryptOptions.Target): the puzzle can be solved on a
+// fast machine and the file decrypted on a slow one.
+func DecryptWithTarget(inputFile string, target *big.Int, key string) (*DecryptResult, error) {
+	if target == nil {
+		return nil, errors.New("no puzzle solution given")
+	}
+	return DecryptFile(DecryptOptions{InputFile: inputFile, KeyInput: key, Target: target}, nil)
+}
+
+// decryptFile decrypts like DecryptFile.  solved, if not nil, holds puzzle
+// solutions by puzzle fingerprint: a solution found there is reused instead
+// of solving, and a fresh one is added, so the members of a shared puzzle
+// group in a batch are solved once.
+func decryptFile(opts DecryptOptions, progressCallback ProgressCallback, solved map[[32]byte]*big.Int) (result *DecryptResult, err error) {
+	if opts.SolveFor > 0 && opts.CheckpointPath == "" {
+		return nil, fmt.Errorf("a time-boxed solve needs a checkpoint path to save its progress to")
+	}
+	if opts.ProofFile != "" && (opts.Target != nil || opts.CacheTarget) {
+		return nil, fmt.Errorf("a proof of the solve needs the puzzle solved here, not a supplied or cached solution")
+	}
+	if opts.ProofFile != "" && opts.SolveFor > 0 {
+		return nil, fmt.Errorf("a proof of the solve needs the puzzle solved in one run, not time-boxed")
+	}
+	if opts.ProofFile != "" && opts.RequireCheckpoint {
+		return nil, fmt.Errorf("a proof of the solve needs the puzzle solved from the start, not resumed")
+	}
+	if opts.RequireCheckpoint && opts.CheckpointPath == "" {
+		return nil, fmt.Errorf("resuming a solve needs the path of its checkpoint")
+	}
+
+	// Validate the output template before doing any work
+	if opts.OutputFile == "" && opts.OutputTemplate != "" {
+		if _, err := ParseOutputTemplate(opts.OutputTemplate); err != nil {
+			return nil, err
+		}
+	}
+
+	// Read encrypted file (the data section is memory-mapped when large)
+	var fsys fs.FS
+	if opts.Input == nil && opts.LocalCopy == "" {
+		if fsys, err = inputFS(opts.FS, opts.InputFile, opts.FetchTimeout); err != nil {
+			return nil, err
+		}
+	}
+	local := fsys != nil && utils.IsOS(fsys)
+	if opts.InPlace {
+		switch {
+		case opts.OutputFile != "" || opts.OutputDir != "" || opts.OutputTemplate != "":
+			return nil, fmt.Errorf("a file decrypted in place keeps the default name (no output file, directory or template)")
+		case !local || !utils.IsOS(opts.OutputFS):
+			return nil, fmt.Errorf("only files of the OS filesystem are decrypted in place")
+		}
+		if t, err := resumeInPlace(opts.InputFile); err != nil {
+			return nil, err
+		} else if t != nil {
+			return &DecryptResult{InputFile: opts.InputFile, OutputFile: t.Final, InPlace: true, InPlaceResumed: true}, nil
+		}
+	}
+	if local {
+		if err := checkNoInPlaceJournal(opts.InputFile); err != nil {
+			return nil, err
+		}
+	}
+	var ef *types.EncryptedFile
+	var input *utils.MappedFile
+	switch {
+	case opts.LocalCopy != "":
+		ef, input, err = utils.ReadEncryptedFileMapped(opts.LocalCopy)
+	case opts.Input != nil:
+		ef, input, err = utils.ReadEncryptedFileMappedFromReaderAt(opts.Input, opts.InputSize)
+	default:
+		ef, input, err = utils.ReadEncryptedFileMappedFS(fsys, opts.InputFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encrypted file: %w", err)
+	}
+	defer input.Close()
+	if opts.InPlace {
+		if err := checkInPlaceDecrypt(ef); err != nil {
+			return nil, err
+		}
+	}
+
 	// Determine output file name if not provided
 	outputFile := opts.OutputFile
 	if outputFile == "" {
-		if strings.HasSuffix(opts.InputFile, ".locked") {
-			outputFile = strings.TrimSuffix(opts.InputFile, ".locked")
-		} else {
-			outputFile = opts.InputFile + ".decrypted"
+		outputFile, err = expandOutputTemplate(opts.OutputTemplate, DefaultDecryptTemplate, TemplateVars{
+			Input:      InputName(opts.InputFile),
+			WorkFactor: ef.WorkFactor,
+			Header:     ef.Header(),
+		}, true)
+		if err != nil {
+			return nil, err
+		}
+		if opts.OutputDir != "" {
+			// A custom template is resolved relative to the output directory;
+			// the default one contributes only the file name
+			if opts.OutputTemplate == "" {
+				outputFile = filepath.Base(outputFile)
+			}
+			outputFile = filepath.Join(opts.OutputDir, outputFile)
+		}
+	}
+
+	if len(opts.Entries) > 0 && ef.Ext.Container == nil {
+		return nil, fmt.Errorf("--entry can only be used with container files")
+	}
+
+	puzzle, err := headerPuzzle(ef.Header(), opts.KeyInput)
+	if err != nil {
+		return nil, err
+	}
+
+	// A checkpoint of the file is of no more use once it is decrypted
+	defer func() {
+		if err == nil && local {
+			puzzles := append([]crypto.Puzzle{puzzle}, utils.AndPuzzlesFromHeader(ef.Header())...)
+			result.Warnings = append(result.Warnings, removeFinishedCheckpoints(opts.CheckpointPath, puzzles)...)
+		}
+	}()
+
+	// A data key is only written out when an output was asked for
+	dataKey := ef.Ext.PayloadType == types.PayloadDataKey
+	writeOutput := !dataKey || opts.OutputFile != "" || opts.OutputDir != ""
+
+	// Make sure the output can be written before spending hours on the puzzle
+	outputFS := utils.WritableOrOS(opts.OutputFS)
+	outputDir := filepath.Dir(outputFile)
+	if ef.Ext.Container != nil || ef.Ext.Bundle != nil {
+		outputDir = outputFile
+	}
+	overwrite := false
+	if opts.InPlace {
+		// Without room for a new file the input is decrypted over itself
+		if overwrite, err = inPlaceOverwrite(outputFile, outputSize(ef), opts.InPlaceOverwrite); err != nil {
+			return nil, fmt.Errorf("cannot write the output (checked before solving): %v", err)
+		}
+	} else if utils.IsOS(outputFS) && writeOutput {
+		size := outputSize(ef)
+		if opts.SkipSpaceCheck {
+			size = 0
+		}
+		if err := utils.CheckWritable(outputDir, size); errors.Is(err, utils.ErrNoSpace) {
+			return nil, fmt.Errorf("cannot write the output (checked before solving): %v (use --skip-space-check if the filesystem misreports its free space)", err)
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot write the output (checked before solving): %v", err)
+		}
+	}
+
+	// Solve the puzzle, or every puzzle of a file that has several, and
+	// derive the decryption key from the solutions
+	var timeUp func() bool
+	if opts.SolveFor > 0 {
+		if opts.Control == nil {
+			opts.Control = &crypto.SolveControl{}
+		}
+		timeUp = opts.Control.StopAfter(opts.SolveFor)
+	}
+	solve, puzzleKey, err := solveHeader(ef.Header(), puzzle, opts, progressCallback, solved)
+	if timeUp != nil && timeUp() && errors.Is(err, crypto.ErrSolveStopped) {
+		return nil, fmt.Errorf("%w after %s: %w", ErrSolveTimeUp, utils.FormatDuration(opts.SolveFor), err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if solve.proof != nil {
+		if err := writeSolveProof(opts.ProofFile, puzzle, ef.Header().Fingerprint(), solve.target, solve.proof); err != nil {
+			return nil, fmt.Errorf("failed to write the proof of the solve: %v", err)
+		}
+		// Every kind of file records where the proof went
+		defer func() {
+			if err == nil {
+				result.ProofFile = opts.ProofFile
+			}
+		}()
+	}
+	target, fromCache, reused := solve.target, solve.fromCache, solve.reused
+	decryptionKey, err := sealingKey(ef.Header(), puzzleKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bundles are unpacked into a directory named like the output file
+	if ef.Ext.Bundle != nil {
+		members, err := decryptBundle(opts, ef, input, outputFS, outputFile, puzzle, target)
+		if err != nil {
+			if fromCache {
+				// The cached solution may be what failed the members
+				utils.RemoveCachedTarget(puzzle)
+			}
+			return nil, err
+		}
+		result := &DecryptResult{
+			InputFile:     opts.InputFile,
+			OutputFile:    outputFile,
+			WorkFactor:    ef.WorkFactor,
+			Bundle:        true,
+			EntryCount:    len(members),
+			FromCache:     fromCache,
+			Reused:        reused,
+			ResumedFrom:   solve.resumedFrom,
+			Warnings:      solve.warnings,
+			Fingerprint:   ef.Header().Fingerprint(),
+			Target:        target,
+			TargetWidth:   crypto.ModulusBytes(puzzle.N),
+			MoreTargets:   solve.more,
+			Key:           puzzleKey,
+			KeyDerivation: ef.Ext.KeyDerivation,
+		}
+		for _, member := range members {
+			result.PlaintextSize += member.PlaintextSize
+			result.Warnings = append(result.Warnings, member.Warnings...)
+		}
+		return result, nil
+	}
+
+	// Containers are extracted into a directory named like the output file
+	if ef.Ext.Container != nil {
+		var entries []types.ContainerEntry
+		var contents [][]byte
+		err = input.Access(func([]byte) error {
+			var err error
+			entries, contents, err = openContainer(ef.Ext.Container, decryptionKey, ef.Data, opts.Entries)
+			return err
+		})
+		if err != nil {
+			return nil, decryptError(err, puzzle, solve)
+		}
+		input.Close()
+
+		written, err := writeContainer(outputFS, outputFile, entries, contents)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write decrypted files: %v", err)
 		}
+		return &DecryptResult{
+			InputFile:     opts.InputFile,
+			OutputFile:    outputFile,
+			PlaintextSize: written,
+			WorkFactor:    ef.WorkFactor,
+			Container:     true,
+			EntryCount:    len(entries),
+			FromCache:     fromCache,
+			Reused:        reused,
+			ResumedFrom:   solve.resumedFrom,
+			Warnings:      solve.warnings,
+			Fingerprint:   ef.Header().Fingerprint(),
+			Target:        target,
+			TargetWidth:   crypto.ModulusBytes(puzzle.N),
+			MoreTargets:   solve.more,
+			Key:           puzzleKey,
+			KeyDerivation: ef.Ext.KeyDerivation,
+		}, nil
 	}
 
-	// Read encrypted file
-	ef, err := utils.ReadEncryptedFile(opts.InputFile)
+	// Unwrap a data key; it is written out (as hex, owner-only) if asked to
+	if dataKey {
+		var key []byte
+		err = input.Access(func([]byte) error {
+			var err error
+			key, err = crypto.Open(ef.Ext.Cipher, decryptionKey, ef.Data, nil)
+			return err
+		})
+		if err != nil {
+			return nil, decryptError(err, puzzle, solve)
+		}
+		input.Close()
+		if len(key) != utils.DataKeySize {
+			return nil, fmt.Errorf("wrapped data key is %d bytes, want %d", len(key), utils.DataKeySize)
+		}
+
+		result := &DecryptResult{
+			InputFile:     opts.InputFile,
+			PlaintextSize: len(key),
+			WorkFactor:    ef.WorkFactor,
+			DataKey:       key,
+			FromCache:     fromCache,
+			Reused:        reused,
+			ResumedFrom:   solve.resumedFrom,
+			Warnings:      solve.warnings,
+			Fingerprint:   ef.Header().Fingerprint(),
+			Target:        target,
+			TargetWidth:   crypto.ModulusBytes(puzzle.N),
+			MoreTargets:   solve.more,
+			Key:           puzzleKey,
+			KeyDerivation: ef.Ext.KeyDerivation,
+		}
+		if writeOutput {
+			if err := outputFS.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+				return nil, fmt.Errorf("failed to create output directory: %v", err)
+			}
+			if err := outputFS.WriteFile(outputFile, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+				return nil, fmt.Errorf("failed to write data key: %v", err)
+			}
+			result.OutputFile = outputFile
+		}
+		return result, nil
+	}
+
+	result = &DecryptResult{
+		InputFile:     opts.InputFile,
+		OutputFile:    outputFile,
+		WorkFactor:    ef.WorkFactor,
+		FromCache:     fromCache,
+		Reused:        reused,
+		ResumedFrom:   solve.resumedFrom,
+		Warnings:      solve.warnings,
+		Fingerprint:   ef.Header().Fingerprint(),
+		Target:        target,
+		TargetWidth:   crypto.ModulusBytes(puzzle.N),
+		MoreTargets:   solve.more,
+		Key:           puzzleKey,
+		KeyDerivation: ef.Ext.KeyDerivation,
+		InPlace:       opts.InPlace,
+	}
+	if overwrite {
+		dataSize := int64(len(ef.Data))
+		input.Close()
+		plaintextSize, err := decryptInPlace(opts.InputFile, outputFile, ef.Header(), dataSize, decryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		result.PlaintextSize = int(plaintextSize)
+		result.InPlaceOverwrite = true
+		return result, nil
+	}
+
+	// Decrypt the data and write it out.  Where the filesystem allows, the
+	// output is written to a temporary file renamed into place once
+	// complete, and a chunked file is streamed into it chunk by chunk so the
+	// plaintext is never held in memory.
+	if err := outputFS.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %v", err)
+	}
+	var plaintextSize int64
+	var openErr error
+	write := func(w io.Writer) error {
+		out := &outputWriter{w: w}
+		err := input.Access(func([]byte) error {
+			var err error
+			plaintextSize, err = decryptTo(ef, decryptionKey, out)
+			return err
+		})
+		if err != nil && out.err == nil {
+			openErr = err
+		}
+		return err
+	}
+	if resumableOutput(ef, opts, outputFS, outputFile) {
+		// An interrupted write is carried on rather than started over
+		var partial *partialWrite
+		partial, err = writeResumable(ef, input, decryptionKey, outputFile, utils.PartialOutputPath(opts.CheckpointPath))
+		plaintextSize, openErr = partial.size, partial.openErr
+		result.ResumedChunks = partial.resumed
+		result.Warnings = append(result.Warnings, partial.warnings...)
+	} else if streamFS, ok := outputFS.(utils.StreamFS); ok {
+		err = streamFS.WriteFileFrom(outputFile, 0644, write)
+	} else {
+		var buf bytes.Buffer
+		if err = write(&buf); err == nil {
+			err = outputFS.WriteFile(outputFile, buf.Bytes(), 0644)
+		}
+	}
+	if openErr != nil {
+		return nil, decryptError(openErr, puzzle, solve)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to read encrypted file: %v", err)
+		return nil, fmt.Errorf("failed to write decrypted file: %v", err)
+	}
+	input.Close()
+	result.PlaintextSize = int(plaintextSize)
+
+	if opts.InPlace {
+		if err := os.Remove(opts.InputFile); err != nil {
+			return nil, fmt.Errorf("decrypted to %s but failed to remove %s: %v", outputFile, opts.InputFile, err)
+		}
+	}
+	return result, nil
+}
+
+// headerPuzzle checks that header can be decrypted by this version and
+// returns its puzzle, with the base derived from keyInput when the file
+// requires a key.  It does all this before any time is spent solving.
+func headerPuzzle(header *types.FileHeader, keyInput string) (crypto.Puzzle, error) {
+	// Reject unknown key derivations and ciphers before spending time on
+	// the puzzle
+	if err := crypto.CheckKeyDerivation(header.Ext.KeyDerivation, header.Ext.KDFParams.Bytes()); err != nil {
+		return crypto.Puzzle{}, err
+	}
+	if _, err := crypto.LookupCipher(header.Ext.Cipher); err != nil {
+		return crypto.Puzzle{}, fmt.Errorf("unsupported file: %v", err)
+	}
+
+	// Reject payloads this version does not know how to output
+	if header.Ext.PayloadType > types.PayloadDataKey {
+		return crypto.Puzzle{}, fmt.Errorf("unsupported file: unknown payload type %d", header.Ext.PayloadType)
+	}
+
+	// Reject chunk sizes this version would not have written
+	if header.Ext.ChunkSize != 0 {
+		if err := crypto.ValidateChunkSize(int(header.Ext.ChunkSize)); err != nil {
+			return crypto.Puzzle{}, fmt.Errorf("unsupported file: %v", err)
+		}
+	}
+
+	// Only data sealed in one piece is sealed with another cipher
+	if ext := header.Ext; ext.Cipher != crypto.CipherChaCha20Poly1305 &&
+		(ext.Container != nil || ext.ChunkSize != 0 || ext.KeySlots != nil || ext.Bundle != nil) {
+		return crypto.Puzzle{}, fmt.Errorf("unsupported file: cipher %s combined with another layout", crypto.CipherName(ext.Cipher))
+	}
+
+	// Key slots only ever hold single documents opened by a passphrase
+	if ext := header.Ext; ext.KeySlots != nil {
+		if header.KeyRequired != 1 || ext.Container != nil || ext.ChunkSize != 0 || ext.Shared != nil ||
+			ext.Bundle != nil || ext.PayloadType != types.PayloadDocument {
+			return crypto.Puzzle{}, fmt.Errorf("unsupported file: key slots combined with another layout")
+		}
+	}
+
+	// Further puzzles only ever lock a single payload, and their moduli
+	// are checked like the first's before any is solved
+	if ext := header.Ext; ext.AndPuzzles != nil {
+		if ext.KeySlots != nil || ext.Bundle != nil {
+			return crypto.Puzzle{}, fmt.Errorf("unsupported file: further puzzles combined with another layout")
+		}
+		for i, p := range utils.AndPuzzlesFromHeader(header) {
+			if err := crypto.CheckKeyModulus(p.N); err != nil {
+				return crypto.Puzzle{}, fmt.Errorf("unsupported file: puzzle %d: %v", i+2, err)
+			}
+		}
 	}
 
 	// Check if key is required
-	if ef.KeyRequired == 1 && opts.KeyInput == "" {
-		return nil, fmt.Errorf("this file requires a key to decrypt (use --key)")
+	if header.KeyRequired == 1 && keyInput == "" {
+		return crypto.Puzzle{}, fmt.Errorf("this file requires a key to decrypt (use --key)")
 	}
-	if ef.KeyRequired == 0 && opts.KeyInput != "" {
+	if header.KeyRequired == 0 && keyInput != "" {
 		// Warning: key provided but file was encrypted without key (ignoring key)
-		opts.KeyInput = ""
+		keyInput = ""
 	}
 
 	// Parse key input
-	userKeyRaw, err := utils.ParseKeyInput(opts.KeyInput)
+	userKeyRaw, err := utils.ParseKeyInput(keyInput)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse key input: %v", err)
+		return crypto.Puzzle{}, fmt.Errorf("failed to parse key input: %v", err)
 	}
 
-	// Extract puzzle from encrypted file
-	puzzle := utils.PuzzleFromEncryptedFile(ef)
+	// Extract puzzle from the header
+	puzzle := utils.PuzzleFromEncryptedFile(types.NewEncryptedFile(header, nil))
+
+	// The key is derived from the target padded to the modulus width, so a
+	// modulus of another length could never decrypt; refuse it before solving
+	if err := crypto.CheckKeyModulus(puzzle.N); err != nil {
+		return crypto.Puzzle{}, fmt.Errorf("unsupported file: %v", err)
+	}
 
 	// If this file uses password-based G derivation, we need to derive G from the password
-	if ef.KeyRequired == 1 {
+	if header.KeyRequired == 1 {
 		if len(userKeyRaw) == 0 {
-			return nil, fmt.Errorf("password required for this file")
+			return crypto.Puzzle{}, fmt.Errorf("password required for this file")
 		}
 
-		// Derive G from password + salt using app-defined KDF parameters
-		derivedG, err := crypto.DeriveBaseFromPassword(userKeyRaw, ef.Salt, puzzle.KdfParams, puzzle.N)
+		// Derive G from password + salt (and the file's tweak, if any)
+		// using app-defined KDF parameters
+		derivedG, err := crypto.DerivePuzzleBase(userKeyRaw, puzzle)
 		if err != nil {
-			return nil, fmt.Errorf("failed to derive puzzle base from password: %v", err)
+			return crypto.Puzzle{}, fmt.Errorf("failed to derive puzzle base from password: %v", err)
 		}
 		puzzle.G = derivedG
 	}
+	return puzzle, nil
+}
+
+// findTarget returns the solution of puzzle: opts.Target, from the target
+// cache when opts.CacheTarget is set, from solved (see decryptFile), or by
+// solving it.
+func findTarget(puzzle crypto.Puzzle, opts DecryptOptions, progressCallback ProgressCallback, solved map[[32]byte]*big.Int) (*solveResult, error) {
+	// A solution supplied out of band replaces the solve
+	if opts.Target != nil {
+		if opts.Target.Sign() <= 0 || opts.Target.Cmp(puzzle.N) >= 0 {
+			return nil, fmt.Errorf("invalid puzzle solution: not in the range [1, N) of the file's modulus")
+		}
+		return &solveResult{target: opts.Target, supplied: true}, nil
+	}
+
+	// Reuse a cached solution when asked to
+	solve := &solveResult{}
+	if opts.CacheTarget {
+		target, err := utils.LoadCachedTarget(puzzle)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cached puzzle solution: %v", err)
+		}
+		solve.target = target
+		solve.fromCache = target != nil
+	}
+	if solve.target == nil && solved != nil && opts.ProofFile == "" {
+		solve.target = solved[puzzle.Fingerprint()]
+		solve.reused = solve.target != nil
+	}
 
 	// Solve the puzzle with progress tracking
-	target := crypto.SolvePuzzle(puzzle, progressCallback)
+	if solve.target == nil {
+		var err error
+		solve, err = solvePuzzle(puzzle, opts, progressCallback)
+		if err != nil {
+			return nil, err
+		}
+		if opts.CacheTarget {
+			if err := utils.StoreCachedTarget(puzzle, solve.target); err != nil {
+				return nil, fmt.Errorf("failed to cache puzzle solution: %v", err)
+			}
+		}
+	}
+	if solved != nil {
+		solved[puzzle.Fingerprint()] = solve.target
+	}
+	return solve, nil
+}
 
-	// Derive decryption key directly from puzzle target
-	decryptionKey := crypto.DerivePuzzleKey(target)
+// decryptTo decrypts the data section of ef, or the payload of the key
+// slot that opens with key, and writes the plaintext to w.  A chunked data
+// section is written chunk by chunk as each is authenticated.
+func decryptTo(ef *types.EncryptedFile, key [32]byte, w io.Writer) (int64, error) {
+	if ef.Ext.ChunkSize != 0 {
+		cw := &countingWriter{w: w}
+		err := crypto.DecryptStreamWithOptions(key, bytes.NewReader(ef.Data), cw,
+			crypto.StreamOptions{ChunkSize: int(ef.Ext.ChunkSize)})
+		return cw.n, err
+	}
 
-	// Decrypt the data directly
-	plaintext, err := crypto.DecryptData(decryptionKey, ef.Data)
+	var plaintext []byte
+	var err error
+	if ef.Ext.KeySlots != nil {
+		plaintext, err = openKeySlots(ef.Ext.KeySlots, key, ef.Data)
+	} else {
+		plaintext, err = crypto.Open(ef.Ext.Cipher, key, ef.Data, nil)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt data (wrong passphrase?): %v", err)
+		return 0, err
 	}
+	n, err := w.Write(plaintext)
+	return int64(n), err
+}
 
-	// Write decrypted file
-	if err := utils.WriteFile(outputFile, plaintext); err != nil {
-		return nil, fmt.Errorf("failed to write decrypted file: %v", err)
+// outputWriter remembers a failure to write the output, so it is not
+// mistaken for a failure to decrypt.
+type outputWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (o *outputWriter) Write(p []byte) (int, error) {
+	n, err := o.w.Write(p)
+	if err != nil && o.err == nil {
+		o.err = err
 	}
+	return n, err
+}
 
-	return &DecryptResult{
-		InputFile:     opts.InputFile,
-		OutputFile:    outputFile,
-		PlaintextSize: len(plaintext),
-		WorkFactor:    ef.WorkFactor,
-	}, nil
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// outputSize returns about how many bytes decrypting ef writes: the
+// plaintext size where the header tells it, the size of the data section
+// otherwise.
+func outputSize(ef *types.EncryptedFile) int64 {
+	dataSize := int64(len(ef.Data))
+	switch {
+	case ef.Ext.PayloadType == types.PayloadDataKey:
+		return 2*utils.DataKeySize + 1
+	case ef.Ext.Container != nil && !ef.Ext.Container.Private:
+		var size int64
+		for _, e := range ef.Ext.Container.Entries {
+			size += int64(e.Size)
+		}
+		return size
+	case ef.Ext.KeySlots != nil:
+		// Either payload may be the one written
+		var size int64
+		for _, slot := range ef.Ext.KeySlots.Slots {
+			size = max(size, int64(slot.Length)-crypto.DataOverhead)
+		}
+		return size
+	case ef.Ext.ChunkSize != 0:
+		if size, err := crypto.StreamPlaintextSize(dataSize, int(ef.Ext.ChunkSize)); err == nil {
+			return size
+		}
+	case ef.Ext.Bundle == nil && ef.Ext.Container == nil:
+		return max(dataSize-crypto.DataOverhead, 0)
+	}
+	return dataSize
+}
+
+// decryptError describes a failure to open the data section with the
+// solution solve found.  A cached solution that does not decrypt the file
+// is dropped from the cache so the next run solves the puzzle again.
+func decryptError(err error, puzzle crypto.Puzzle, solve *solveResult) error {
+	if errors.Is(err, utils.ErrSourceModified) {
+		return fmt.Errorf("failed to decrypt data: %v", err)
+	}
+	if solve.supplied {
+		return fmt.Errorf("failed to decrypt data (wrong puzzle solution or passphrase?): %v", err)
+	}
+	if solve.fromCache {
+		if rmErr := utils.RemoveCachedTarget(puzzle); rmErr != nil {
+			return fmt.Errorf("failed to decrypt data with cached puzzle solution: %v (removing it failed: %v)", err, rmErr)
+		}
+		return fmt.Errorf("failed to decrypt data with cached puzzle solution (removed it; run again to solve): %v", err)
+	}
+	if solve.resumedFrom > 0 {
+		// The checkpoint was already removed after solving
+		return fmt.Errorf("failed to decrypt data (wrong passphrase, or a bad checkpoint that has been removed?): %v", err)
+	}
+	return fmt.Errorf("failed to decrypt data (wrong passphrase?): %v", err)
 }
@@ -0,0 +1,74 @@
+package operations
+
+import (
+	"fmt"
+
+	"cryptotimed/src/types"
+)
+
+// DeriveKeyResult contains the payload key of a solved file
+type DeriveKeyResult struct {
+	InputFile   string
+	WorkFactor  uint64
+	Key         [32]byte // the key the data section is sealed under
+	Container   bool     // Key is the container's root key (entry keys derive from it)
+	FromCache   bool     // the puzzle solution came from the target cache
+	ResumedFrom uint64   // squarings restored from a checkpoint
+	Warnings    []string // non-fatal problems, e.g. an ignored checkpoint
+}
+
+// DeriveKey solves the puzzle of opts.InputFile like DecryptFile, with the
+// same key, cache, checkpoint and control options, and returns the key its
+// payload is sealed under instead of decrypting it.  Only the header is
+// read (or fetched, for a URL); the output options are ignored.  For a
+// member of a shared puzzle group this is the member's own key, not the
+// group's puzzle key, and for a file with key slots it is the data key of
+// the passphrase's slot.
+func DeriveKey(opts DecryptOptions, progressCallback ProgressCallback) (*DeriveKeyResult, error) {
+	header, err := ReadInputHeader(opts.FS, opts.InputFile, opts.FetchTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Ext.Bundle != nil {
+		return nil, fmt.Errorf("%s is a bundle; each of its members has a key of its own", opts.InputFile)
+	}
+
+	key, solve, err := payloadKey(header, opts, progressCallback)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeriveKeyResult{
+		InputFile:   opts.InputFile,
+		WorkFactor:  header.WorkFactor,
+		Key:         key,
+		Container:   header.Ext.Container != nil,
+		FromCache:   solve.fromCache,
+		ResumedFrom: solve.resumedFrom,
+		Warnings:    solve.warnings,
+	}, nil
+}
+
+// payloadKey solves the puzzle of header and returns the key its payload is
+// sealed under, as DeriveKey describes.
+func payloadKey(header *types.FileHeader, opts DecryptOptions, progressCallback ProgressCallback) ([32]byte, *solveResult, error) {
+	var key [32]byte
+	puzzle, err := headerPuzzle(header, opts.KeyInput)
+	if err != nil {
+		return key, nil, err
+	}
+	solve, puzzleKey, err := solveHeader(header, puzzle, opts, progressCallback, nil)
+	if err != nil {
+		return key, nil, err
+	}
+	if key, err = sealingKey(header, puzzleKey); err != nil {
+		return key, nil, err
+	}
+	if header.Ext.KeySlots != nil {
+		if _, key, err = unwrapKeySlot(header.Ext.KeySlots, key); err != nil {
+			return key, nil, fmt.Errorf("failed to open key slot (wrong passphrase?): %v", err)
+		}
+	}
+	return key, solve, nil
+}
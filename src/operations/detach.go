@@ -0,0 +1,70 @@
+package operations
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"cryptotimed/src/utils"
+)
+
+// DetachOptions describes a command to start in the background
+type DetachOptions struct {
+	Binary  string   // executable to run (default: this one)
+	Args    []string // its arguments
+	PIDFile string   // records the process ID while it runs
+	LogFile string   // receives its output (appended)
+}
+
+// DetachResult describes a command started in the background
+type DetachResult struct {
+	PID      int
+	StalePID int // pid recorded in a stale pidfile that was removed (0 = none)
+}
+
+// Detach starts a command in its own session with no terminal, its output
+// appended to the log file, and records its pid in the pidfile.  It returns
+// without waiting for the command; the command is expected to remove the
+// pidfile when it exits (see utils.RemovePIDFile).  A pidfile left behind by
+// a process that is no longer running is removed first; one whose process is
+// still running is an error.
+func Detach(opts DetachOptions) (*DetachResult, error) {
+	pid, running, err := utils.CheckPIDFile(opts.PIDFile)
+	if err != nil {
+		return nil, err
+	}
+	if running {
+		return nil, fmt.Errorf("already running in the background (pid %d, see %s)", pid, opts.PIDFile)
+	}
+	result := &DetachResult{StalePID: pid}
+
+	binary := opts.Binary
+	if binary == "" {
+		if binary, err = os.Executable(); err != nil {
+			return nil, fmt.Errorf("failed to locate the cryptotimed binary: %v", err)
+		}
+	}
+
+	log, err := os.OpenFile(opts.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %v", err)
+	}
+	defer log.Close()
+
+	cmd := exec.Command(binary, opts.Args...)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	cmd.SysProcAttr = utils.DetachedProcAttr()
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start background process: %v", err)
+	}
+	result.PID = cmd.Process.Pid
+
+	if err := utils.CreatePIDFile(opts.PIDFile, result.PID); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("failed to write pidfile: %v", err)
+	}
+	cmd.Process.Release()
+	return result, nil
+}
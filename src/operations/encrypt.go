@@ -1,7 +1,18 @@
 package operations
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
 
 	"cryptotimed/src/crypto"
 	"cryptotimed/src/types"
@@ -10,9 +21,155 @@ import (
 
 // EncryptOptions contains all the parameters needed for encryption
 type EncryptOptions struct {
-	InputFile  string
-	WorkFactor uint64
-	KeyInput   string
+	InputFile    string
+	WorkFactor   uint64
+	KeyInput     string
+	OpsPerSecond float64 // benchmarked squaring rate to record in the header (0 = don't record)
+
+	// TargetDuration picks WorkFactor, which must be 0, as the squarings
+	// this machine does in this long (see WorkFactorForDuration).  The rate
+	// used is recorded as OpsPerSecond unless that is set, so check can
+	// explain the delay.
+	TargetDuration time.Duration
+
+	// PrivateListing stores a directory container's entry table in the
+	// encrypted data section instead of the header, so names and sizes are
+	// only visible after solving.
+	PrivateListing bool
+
+	// Exclude leaves out of a directory container the paths below it that
+	// match these gitignore-style patterns (see utils.Excluder).  Excluded
+	// directories are not walked.
+	Exclude []string
+
+	// NoTrapdoor computes the puzzle target by sequential squaring instead of
+	// the RSA trapdoor, so encrypting takes as long as decrypting.  Progress
+	// reports the squarings done meanwhile.
+	NoTrapdoor bool
+	Progress   ProgressCallback
+
+	// ModulusBits is the size of the puzzle's RSA modulus, from
+	// crypto.MinModulusBits to crypto.MaxModulusBits (0 =
+	// crypto.DefaultModulusBits).  Each squaring of a larger modulus takes
+	// longer, so the same work factor locks the file for longer.
+	ModulusBits int
+
+	// OutputTemplate names the encrypted file (see ParseOutputTemplate;
+	// DefaultEncryptTemplate if empty).
+	OutputTemplate string
+
+	// OutputFile names the encrypted file outright instead of
+	// OutputTemplate, for a single input.
+	OutputFile string
+
+	// ChunkSize seals the data in independently authenticated chunks of
+	// this many plaintext bytes (0 = seal the whole file in one piece).
+	// A chunked file is written as it is sealed, and later decrypted chunk
+	// by chunk, so neither needs memory for the whole file.
+	ChunkSize int
+
+	// ChunkAbove chunks a file larger than this many bytes with
+	// crypto.DefaultChunkSize when ChunkSize is 0, so that inputs larger
+	// than memory can be locked (0 = DefaultChunkAbove, negative = never).
+	// Files sealed with another cipher are never chunked.
+	ChunkAbove int64
+
+	// AppendTo appends the encrypted file as a record to this append-only
+	// log (see utils.AppendLogRecord) instead of writing it to its own file.
+	// The log is always a file of the OS filesystem.
+	AppendTo string
+
+	// FS is the filesystem InputFile is read from, and OutputFS the one the
+	// encrypted file is written to (utils.OS if nil).
+	FS       fs.FS
+	OutputFS utils.WriteFS
+
+	// Input, if set, is read to its end as the plaintext instead of
+	// InputFile, which then only names it, e.g. stdin in a pipe.  The size
+	// of a stream is only known once it ends, so it is always sealed in
+	// chunks (crypto.DefaultChunkSize if ChunkSize is 0), into a temporary
+	// file of ciphertext that is then copied behind the header: memory
+	// holds a chunk at a time, and the plaintext never reaches the disk.
+	// It cannot be combined with a data key, decoy, in-place encryption,
+	// shared puzzle or cipher other than ChaCha20-Poly1305.
+	Input io.Reader
+
+	// DataKey, if set, is time-locked instead of the contents of InputFile:
+	// the payload is this key, sealed under the puzzle key, and the header
+	// marks it as such (see types.PayloadDataKey).  The user's data is
+	// encrypted under it elsewhere.  InputFile only names the output and is
+	// not read.
+	DataKey *[utils.DataKeySize]byte
+
+	// DecoyFile, if set, is stored alongside InputFile under a second
+	// passphrase, DecoyKeyInput: decrypting with it yields the decoy, and
+	// the file does not tell which passphrase is the real one (see
+	// types.KeySlots).  KeyInput is required.
+	DecoyFile     string
+	DecoyKeyInput string
+
+	// InPlace replaces InputFile with the encrypted file, named by
+	// DefaultEncryptTemplate and always chunked (crypto.DefaultChunkSize
+	// if ChunkSize is 0).  Where the filesystem has room for both, the file
+	// is encrypted into a temporary file renamed into place and the input
+	// removed; otherwise it is encrypted over its own bytes (see
+	// utils.TransformInPlace).  An operation interrupted by a crash is
+	// finished instead.  InputFile must be a file of the OS filesystem.
+	InPlace bool
+
+	// InPlaceOverwrite encrypts over the input's own bytes even when there
+	// is room for a temporary file.
+	InPlaceOverwrite bool
+
+	// KeyHash is the hash the key is derived from the puzzle solution with
+	// (see crypto.KeyHashNames; crypto.CurrentKeyDerivation if empty).  The
+	// header records it, so decrypting needs no option.
+	KeyHash string
+
+	// Cipher is the cipher the data is sealed with (see crypto.CipherNames;
+	// ChaCha20-Poly1305 if empty).  Only a single file or data key sealed in
+	// one piece can use another; the header records it.
+	Cipher string
+
+	// Verify reads the encrypted file back once written and checks that
+	// its header and data section are the ones written, so that a write
+	// corrupted by failing hardware is found now rather than when the file
+	// is decrypted.  A file whose work factor is at most VerifySolveLimit
+	// (0 = none) is also solved and decrypted, and the plaintext compared
+	// with the input; VerifyProgress reports that solve.  Containers are
+	// only read back.  EncryptResult.Verified tells what was checked.
+	Verify           bool
+	VerifySolveLimit uint64
+	VerifyProgress   ProgressCallback
+
+	// PadHeader pads the header with random bytes to this many bytes (0 =
+	// no padding; see types.FileHeader.PadTo), so that the size of the file
+	// tells nothing about what the header describes, such as the names in a
+	// container's entry table, beyond the size of the data.
+	PadHeader int
+
+	// VerifyPuzzle checks the generated puzzle before anything is locked
+	// with it (see crypto.VerifyPuzzle): its values must be in range and, up
+	// to VerifyPuzzleSteps squarings (0 = crypto.DefaultVerifySteps), its
+	// target must match a sequential solve.  EncryptResult.PuzzleCheck
+	// tells what was checked.
+	VerifyPuzzle      bool
+	VerifyPuzzleSteps uint64
+
+	// BaseTweak mixes a random file ID, recorded in the header, and the
+	// work factor into the derivation of the password base (see
+	// crypto.GenerateOptions.BaseTweak), so that the same passphrase gives
+	// unrelated bases in different files.  KeyInput is required; the file
+	// needs a reader of format version 9.
+	BaseTweak bool
+
+	// AndPuzzles locks the file under this many independent puzzles of
+	// WorkFactor squarings each, all of which must be solved to derive its
+	// key (see types.AndPuzzles); 0 or 1 means one.  Solving takes this many
+	// times as long, unless the puzzles are solved in parallel.  With
+	// NoTrapdoor, Progress counts through every puzzle.  The file needs a
+	// reader of format version 11.
+	AndPuzzles int
 }
 
 // EncryptResult contains the results of the encryption operation
@@ -23,71 +180,787 @@ type EncryptResult struct {
 	EncryptedSize int
 	WorkFactor    uint64
 	KeyRequired   bool
+	Container     bool // the input was a directory packed into a container
+	DataKey       bool // the payload is a wrapped data key (EncryptOptions.DataKey)
+	DecoySize     int  // size of the decoy stored alongside the input (EncryptOptions.DecoyFile)
+	ChunkSize     int  // plaintext bytes per chunk (0 = sealed in one piece)
+	EntryCount    int  // files and directories packed (containers only)
+	SkippedCount  int  // unsupported entries such as symlinks that were left out
+
+	// Deduplication of a container's files: the number stored once for an
+	// identical earlier file, and the plaintext size over the size of the
+	// contents actually stored (1 when nothing was deduplicated)
+	DuplicateCount int
+	DedupRatio     float64
+
+	// Excluded counts the entries each EncryptOptions.Exclude pattern left
+	// out, in the order the patterns first matched; an excluded directory
+	// counts once, whatever it holds
+	Excluded []ExcludeCount
+
+	InPlace          bool // the input was replaced by OutputFile (EncryptOptions.InPlace)
+	InPlaceOverwrite bool // it was encrypted over its own bytes
+	InPlaceResumed   bool // an interrupted in-place operation was finished instead
+
+	// Appending to a log (AppendTo): OutputFile is the log
+	LogRecord int      // index of the appended record
+	LogHead   [32]byte // chain hash of the log after appending
+
+	// Shared is the shared puzzle group the file belongs to (EncryptGroup
+	// only)
+	Shared *types.SharedPuzzle
+
+	// Tuning is how WorkFactor was picked from EncryptOptions.TargetDuration
+	// (nil if it was given); its Benchmark is nil when the rate came from
+	// this machine's calibration profile
+	Tuning *Tuning
+
+	// What EncryptOptions.Verify checked, whether the file was read back
+	// from the device rather than from the page cache, and why it was not
+	// solved and decrypted (when Verified is VerifyReadBack)
+	Verified         VerifyLevel
+	VerifiedFromDisk bool
+	VerifySkipped    string
+
+	// What EncryptOptions.VerifyPuzzle checked (nil if not requested)
+	PuzzleCheck *crypto.PuzzleCheck
+}
+
+// DefaultChunkAbove is the input size above which EncryptFile chunks a file
+// when no chunk size is given (see EncryptOptions.ChunkAbove).
+const DefaultChunkAbove int64 = 256 << 20
+
+// inputChunkSize returns the chunk size a file of size bytes is sealed with
+// (0 = in one piece).
+func inputChunkSize(opts EncryptOptions, size int64) int {
+	threshold := opts.ChunkAbove
+	if threshold == 0 {
+		threshold = DefaultChunkAbove
+	}
+	if opts.ChunkSize != 0 || threshold < 0 || size <= threshold {
+		return opts.ChunkSize
+	}
+	if cipher, _ := crypto.CipherForName(opts.Cipher); cipher != crypto.CipherChaCha20Poly1305 {
+		return 0
+	}
+	return crypto.DefaultChunkSize
 }
 
+// lockFunc returns the header and puzzle key an input is encrypted under.
+// It is called once the input has been found readable, so a missing input
+// fails before any puzzle is generated.
+type lockFunc func() (*types.FileHeader, [32]byte, error)
+
 // EncryptFile performs the core encryption logic
 func EncryptFile(opts EncryptOptions) (*EncryptResult, error) {
+	userKeyRaw, err := checkEncryptOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	tuning, err := tuneEncrypt(&opts)
+	if err != nil {
+		return nil, err
+	}
+	result, err := encryptFile(opts, userKeyRaw)
+	if err != nil {
+		return nil, err
+	}
+	result.Tuning = tuning
+	return result, nil
+}
+
+// encryptFile encrypts opts.InputFile as EncryptFile does, once the
+// options are checked and the work factor known.
+func encryptFile(opts EncryptOptions, userKeyRaw []byte) (*EncryptResult, error) {
+	if opts.DecoyFile != "" {
+		for _, input := range []string{opts.InputFile, opts.DecoyFile} {
+			if info, err := fs.Stat(utils.OrOS(opts.FS), input); err != nil {
+				return nil, fmt.Errorf("failed to read input file: %v", err)
+			} else if info.IsDir() {
+				return nil, fmt.Errorf("%s is a directory; a decoy is stored alongside a single file", input)
+			}
+		}
+		decoyKeyRaw, err := utils.ParseKeyInput(opts.DecoyKeyInput)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse decoy key input: %v", err)
+		}
+		return encryptWithDecoy(opts, userKeyRaw, decoyKeyRaw)
+	}
+	if opts.InPlace {
+		return encryptInPlace(opts, userKeyRaw)
+	}
+	var check *crypto.PuzzleCheck
+	lock := func() (header *types.FileHeader, key [32]byte, err error) {
+		header, key, check, err = newLockedHeader(opts, userKeyRaw)
+		return header, key, err
+	}
+	var result *EncryptResult
+	var err error
+	if opts.DataKey != nil {
+		result, err = encryptDataKey(opts, lock)
+	} else if opts.Input != nil {
+		result, err = encryptStream(opts, lock)
+	} else if err = checkEncryptInput(opts, opts.InputFile); err == nil {
+		result, err = encryptInput(opts, lock)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.PuzzleCheck = check
+	return result, nil
+}
+
+// EncryptGroup encrypts every input under one shared puzzle, so that solving
+// any of the files yields the key of all of them.  Each file records the
+// group in its header and is sealed under a subkey bound to that header.
+// opts.InputFile is ignored.  It stops at the first failure and returns the
+// results of the files encrypted so far.
+func EncryptGroup(inputs []string, opts EncryptOptions) ([]*EncryptResult, error) {
+	userKeyRaw, err := checkEncryptOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	tuning, err := tuneEncrypt(&opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(inputs) < 2 {
+		return nil, fmt.Errorf("a shared puzzle needs at least two inputs")
+	}
+	if opts.DataKey != nil {
+		return nil, fmt.Errorf("a data key cannot be encrypted under a shared puzzle")
+	}
+	if opts.DecoyFile != "" {
+		return nil, fmt.Errorf("a decoy cannot be encrypted under a shared puzzle")
+	}
+	if opts.InPlace {
+		return nil, fmt.Errorf("files under a shared puzzle cannot be encrypted in place")
+	}
+	if opts.Input != nil {
+		return nil, fmt.Errorf("a stream cannot be encrypted under a shared puzzle")
+	}
+	if opts.OutputFile != "" {
+		return nil, fmt.Errorf("files under a shared puzzle cannot share one output file (use an output template)")
+	}
+	seen := make(map[string]bool)
+	for _, input := range inputs {
+		if err := checkEncryptInput(opts, input); err != nil {
+			return nil, fmt.Errorf("%s: %v", input, err)
+		}
+		if seen[filepath.Clean(input)] {
+			return nil, fmt.Errorf("%s is given more than once", input)
+		}
+		seen[filepath.Clean(input)] = true
+	}
+
+	// One puzzle for the whole group
+	header, encryptionKey, check, err := newLockedHeader(opts, userKeyRaw)
+	if err != nil {
+		return nil, err
+	}
+	var group [16]byte
+	if _, err := rand.Read(group[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate group ID: %v", err)
+	}
+
+	var results []*EncryptResult
+	for i, input := range inputs {
+		fileOpts := opts
+		fileOpts.InputFile = input
+		result, err := encryptInput(fileOpts, func() (*types.FileHeader, [32]byte, error) {
+			member := *header
+			member.Ext.Shared = &types.SharedPuzzle{Group: group, Index: uint32(i), Count: uint32(len(inputs))}
+			member.MinReaderVersion = member.RequiredReaderVersion()
+			return &member, encryptionKey, nil
+		})
+		if err != nil {
+			return results, fmt.Errorf("%s: %v", input, err)
+		}
+		result.PuzzleCheck = check
+		result.Tuning = tuning
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// checkEncryptOptions validates the options every input shares and returns
+// the parsed user key.
+func checkEncryptOptions(opts EncryptOptions) ([]byte, error) {
 	// Parse key input
 	userKeyRaw, err := utils.ParseKeyInput(opts.KeyInput)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse key input: %v", err)
 	}
 
-	// Read input file
-	plaintext, err := utils.ReadFile(opts.InputFile)
+	if opts.ChunkSize != 0 {
+		if err := crypto.ValidateChunkSize(opts.ChunkSize); err != nil {
+			return nil, err
+		}
+	}
+	if opts.BaseTweak && len(userKeyRaw) == 0 {
+		return nil, fmt.Errorf("only a base derived from a passphrase (--key) can be tweaked")
+	}
+	if opts.DataKey != nil && (opts.ChunkSize != 0 || opts.PrivateListing) {
+		return nil, fmt.Errorf("a data key is sealed in one piece (no chunking or private listing)")
+	}
+	if opts.AndPuzzles < 0 || opts.AndPuzzles > types.MaxAndPuzzles {
+		return nil, fmt.Errorf("a file is locked under 1 to %d puzzles, not %d", types.MaxAndPuzzles, opts.AndPuzzles)
+	}
+	if opts.OpsPerSecond != 0 {
+		if err := types.ValidateEncryptorRate(opts.OpsPerSecond); err != nil {
+			return nil, err
+		}
+	}
+	if opts.ModulusBits != 0 {
+		if err := crypto.CheckModulusBits(opts.ModulusBits); err != nil {
+			return nil, err
+		}
+	}
+	if opts.DecoyFile != "" {
+		switch {
+		case opts.AndPuzzles > 1:
+			return nil, fmt.Errorf("a decoy is locked under one puzzle per passphrase (no further puzzles)")
+		case len(userKeyRaw) == 0:
+			return nil, fmt.Errorf("a decoy needs a real passphrase (--key) besides its own")
+		case opts.DataKey != nil || opts.ChunkSize != 0:
+			return nil, fmt.Errorf("a decoy is sealed in one piece alongside a file (no data key or chunking)")
+		}
+		decoyKeyRaw, err := utils.ParseKeyInput(opts.DecoyKeyInput)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse decoy key input: %v", err)
+		}
+		if len(decoyKeyRaw) == 0 {
+			return nil, fmt.Errorf("a decoy needs a passphrase of its own")
+		}
+		if bytes.Equal(decoyKeyRaw, userKeyRaw) {
+			return nil, fmt.Errorf("the decoy passphrase must differ from the real one")
+		}
+	}
+	if opts.Input != nil && (opts.DataKey != nil || opts.DecoyFile != "" || opts.InPlace) {
+		return nil, fmt.Errorf("a stream is encrypted on its own (no data key, decoy or in-place encryption)")
+	}
+	if opts.InPlace {
+		switch {
+		case opts.OutputTemplate != "" && opts.OutputTemplate != DefaultEncryptTemplate, opts.OutputFile != "", opts.AppendTo != "":
+			return nil, fmt.Errorf("a file encrypted in place keeps the default name (no output file, template or log)")
+		case opts.DataKey != nil || opts.DecoyFile != "" || opts.PrivateListing:
+			return nil, fmt.Errorf("only a single file is encrypted in place (no data key, decoy or container)")
+		case !utils.IsOS(opts.FS) || !utils.IsOS(opts.OutputFS):
+			return nil, fmt.Errorf("only files of the OS filesystem are encrypted in place")
+		case opts.Verify:
+			return nil, fmt.Errorf("a file encrypted in place cannot be verified against its input, which is gone")
+		}
+	}
+	if _, err := utils.NewExcluder(opts.Exclude); err != nil {
+		return nil, err
+	}
+	if opts.OutputTemplate != "" {
+		if _, err := ParseOutputTemplate(opts.OutputTemplate); err != nil {
+			return nil, err
+		}
+	}
+	keyDerivation, err := crypto.KeyDerivationForHash(opts.KeyHash)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := crypto.KeyDerivationParams(keyDerivation); err != nil {
+		return nil, fmt.Errorf("failed to encode key-derivation parameters: %v", err)
+	}
+	cipher, err := crypto.CipherForName(opts.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	if cipher != crypto.CipherChaCha20Poly1305 && (opts.ChunkSize != 0 || opts.InPlace || opts.DecoyFile != "" || opts.Input != nil) {
+		return nil, fmt.Errorf("only a file sealed in one piece can use cipher %s (no chunking, in-place encryption, decoy or stream)", crypto.CipherName(cipher))
+	}
+	if opts.PadHeader < 0 {
+		return nil, fmt.Errorf("header padding size must not be negative")
+	}
+	return userKeyRaw, nil
+}
+
+// checkEncryptInput rejects an input the options cannot encrypt.
+func checkEncryptInput(opts EncryptOptions, input string) error {
+	info, err := fs.Stat(utils.OrOS(opts.FS), input)
+	if err != nil {
+		return fmt.Errorf("failed to read input file: %v", err)
+	}
+	if info.IsDir() && opts.ChunkSize != 0 {
+		return fmt.Errorf("chunked encryption is not supported for directories")
+	}
+	if info.IsDir() && opts.Cipher != "" {
+		if cipher, _ := crypto.CipherForName(opts.Cipher); cipher != crypto.CipherChaCha20Poly1305 {
+			return fmt.Errorf("containers are sealed with %s only", crypto.CipherName(crypto.CipherChaCha20Poly1305))
+		}
+	}
+	if utils.IsOS(opts.FS) {
+		return checkNoInPlaceJournal(input)
+	}
+	return nil
+}
+
+// encryptInput encrypts the file or directory opts.InputFile under the
+// header and puzzle key returned by lock.
+func encryptInput(opts EncryptOptions, lock lockFunc) (*EncryptResult, error) {
+	// Directories are packed into a single container file
+	if info, err := fs.Stat(utils.OrOS(opts.FS), opts.InputFile); err == nil && info.IsDir() {
+		return encryptContainer(opts, lock)
+	}
+
+	// Open input file (memory-mapped when large)
+	input, err := utils.OpenMappedFS(opts.FS, opts.InputFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read input file: %v", err)
 	}
+	defer input.Close()
+
+	// Generate the time-lock puzzle and the header describing it
+	header, encryptionKey, err := lock()
+	if err != nil {
+		return nil, err
+	}
+	chunkSize := inputChunkSize(opts, int64(len(input.Bytes())))
+	header.Ext.ChunkSize = uint32(chunkSize)
+	if err := padHeader(opts, header); err != nil {
+		return nil, err
+	}
+	encryptionKey, err = sealingKey(header, encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// A chunked file goes straight to its own file as it is sealed, unless
+	// it is appended to a log
+	outputFS := utils.WritableOrOS(opts.OutputFS)
+	if streamFS, ok := outputFS.(utils.StreamFS); ok && chunkSize != 0 && opts.AppendTo == "" {
+		return encryptStreamed(opts, header, encryptionKey, input, streamFS)
+	}
+
+	// Encrypt the data directly with the puzzle-derived key
+	var encryptedData []byte
+	var plaintextHash *[32]byte
+	err = input.Access(func(plaintext []byte) error {
+		if opts.Verify {
+			sum := sha256.Sum256(plaintext)
+			plaintextHash = &sum
+		}
+		if chunkSize != 0 {
+			var buf bytes.Buffer
+			buf.Grow(int(crypto.StreamCiphertextSize(int64(len(plaintext)), chunkSize)))
+			err := crypto.EncryptStreamWithOptions(encryptionKey, bytes.NewReader(plaintext), &buf,
+				crypto.StreamOptions{ChunkSize: chunkSize})
+			encryptedData = buf.Bytes()
+			return err
+		}
+		var err error
+		encryptedData, err = crypto.Seal(header.Ext.Cipher, encryptionKey, plaintext, nil)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt data: %v", err)
+	}
+	plaintextSize := len(input.Bytes())
+	input.Close()
+
+	// Create encrypted file structure
+	ef := types.NewEncryptedFile(header, encryptedData)
+
+	// Write encrypted file
+	result := &EncryptResult{
+		InputFile:     opts.InputFile,
+		PlaintextSize: plaintextSize,
+		EncryptedSize: ef.Header().Size() + 8 + len(encryptedData),
+		WorkFactor:    opts.WorkFactor,
+		KeyRequired:   ef.KeyRequired == 1,
+		Shared:        ef.Ext.Shared,
+		ChunkSize:     chunkSize,
+	}
+	if err := writeLocked(opts, opts.InputFile, ef, result, plaintextHash); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// encryptStreamed seals the chunked input under header and key straight
+// into its own encrypted file, so that neither the plaintext nor the
+// ciphertext is ever held in memory: the input is memory-mapped and the
+// output written through fsys chunk by chunk.  With opts.Verify the file
+// is then read back the same way (see verifyLocked).
+func encryptStreamed(opts EncryptOptions, header *types.FileHeader, key [32]byte, input *utils.MappedFile, fsys utils.StreamFS) (*EncryptResult, error) {
+	chunkSize := int(header.Ext.ChunkSize)
+	plaintextSize := int64(len(input.Bytes()))
+	var plaintextHash *[32]byte
+	seal := func(w io.Writer) error {
+		return input.Access(func(plaintext []byte) error {
+			if opts.Verify {
+				sum := sha256.Sum256(plaintext)
+				plaintextHash = &sum
+			}
+			return crypto.EncryptStreamWithOptions(key, bytes.NewReader(plaintext), w,
+				crypto.StreamOptions{ChunkSize: chunkSize})
+		})
+	}
+	dataSize := crypto.StreamCiphertextSize(plaintextSize, chunkSize)
+	result, data, err := writeSealed(opts, header, plaintextSize, dataSize, seal, fsys)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Verify {
+		if err := verifyLocked(opts, header, data, result, plaintextHash); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// encryptStream seals opts.Input, read to its end, under the header and
+// puzzle key returned by lock.  The file records the size of its data
+// section before the data, and the size of a stream is only known once it
+// ends, so the stream is sealed chunk by chunk into a temporary file first
+// and then copied behind the header.
+func encryptStream(opts EncryptOptions, lock lockFunc) (*EncryptResult, error) {
+	header, encryptionKey, err := lock()
+	if err != nil {
+		return nil, err
+	}
+	chunkSize := opts.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = crypto.DefaultChunkSize
+	}
+	header.Ext.ChunkSize = uint32(chunkSize)
+	if err := padHeader(opts, header); err != nil {
+		return nil, err
+	}
+	encryptionKey, err = sealingKey(header, encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only ciphertext is written to the temporary file
+	spool, err := os.CreateTemp("", "cryptotimed-*.sealed")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	plaintextHash := sha256.New()
+	plaintext := &countingWriter{w: plaintextHash}
+	sealed := &countingWriter{w: spool}
+	err = crypto.EncryptStreamWithOptions(encryptionKey, io.TeeReader(opts.Input, plaintext), sealed,
+		crypto.StreamOptions{ChunkSize: chunkSize})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt data: %v", err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to read temporary file: %v", err)
+	}
+	var sum *[32]byte
+	if opts.Verify {
+		sum = (*[32]byte)(plaintextHash.Sum(nil))
+	}
+
+	// A log record, or a file of a filesystem that cannot write one from a
+	// stream, is written in one piece
+	streamFS, ok := utils.WritableOrOS(opts.OutputFS).(utils.StreamFS)
+	if !ok || opts.AppendTo != "" {
+		data, err := io.ReadAll(spool)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read temporary file: %v", err)
+		}
+		ef := types.NewEncryptedFile(header, data)
+		result := &EncryptResult{
+			InputFile:     opts.InputFile,
+			PlaintextSize: int(plaintext.n),
+			EncryptedSize: header.Size() + 8 + len(data),
+			WorkFactor:    opts.WorkFactor,
+			KeyRequired:   header.KeyRequired == 1,
+			ChunkSize:     chunkSize,
+		}
+		if err := writeLocked(opts, opts.InputFile, ef, result, sum); err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+
+	copySealed := func(w io.Writer) error {
+		_, err := io.Copy(w, spool)
+		return err
+	}
+	result, data, err := writeSealed(opts, header, plaintext.n, sealed.n, copySealed, streamFS)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Verify {
+		if err := verifyLocked(opts, header, data, result, sum); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// writeSealed writes header and a data section of dataSize bytes, written
+// by seal, to the encrypted file of opts through fsys.  It returns the
+// result of sealing plaintextSize bytes, and the data section for
+// verifyLocked.
+func writeSealed(opts EncryptOptions, header *types.FileHeader, plaintextSize, dataSize int64, seal func(w io.Writer) error, fsys utils.StreamFS) (*EncryptResult, lockedData, error) {
+	header.MinReaderVersion = header.RequiredReaderVersion()
+	outputFile, err := encryptedOutputFile(opts, opts.InputFile, header)
+	if err != nil {
+		return nil, lockedData{}, err
+	}
+
+	dataHash := sha256.New()
+	write := func(w io.Writer) error {
+		if _, err := header.WriteTo(w); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.LittleEndian, uint64(dataSize)); err != nil {
+			return err
+		}
+		cw := &countingWriter{w: io.MultiWriter(w, dataHash)}
+		err := seal(cw)
+		if err == nil && cw.n != dataSize {
+			err = fmt.Errorf("sealed %d bytes of data, expected %d", cw.n, dataSize)
+		}
+		return err
+	}
+	if err := fsys.WriteFileFrom(outputFile, 0644, write); err != nil {
+		return nil, lockedData{}, fmt.Errorf("failed to write encrypted file: %v", err)
+	}
+	result := &EncryptResult{
+		InputFile:     opts.InputFile,
+		OutputFile:    outputFile,
+		PlaintextSize: int(plaintextSize),
+		EncryptedSize: header.Size() + 8 + int(dataSize),
+		WorkFactor:    opts.WorkFactor,
+		KeyRequired:   header.KeyRequired == 1,
+		Shared:        header.Ext.Shared,
+		ChunkSize:     int(header.Ext.ChunkSize),
+	}
+	return result, lockedData{size: dataSize, hash: [32]byte(dataHash.Sum(nil))}, nil
+}
+
+// encryptDataKey seals opts.DataKey under the header and puzzle key returned
+// by lock, producing a small file whatever the size of the data the key
+// protects.
+func encryptDataKey(opts EncryptOptions, lock lockFunc) (*EncryptResult, error) {
+	header, encryptionKey, err := lock()
+	if err != nil {
+		return nil, err
+	}
+	header.Ext.PayloadType = types.PayloadDataKey
+	if err := padHeader(opts, header); err != nil {
+		return nil, err
+	}
+	encryptionKey, err = sealingKey(header, encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := crypto.Seal(header.Ext.Cipher, encryptionKey, opts.DataKey[:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %v", err)
+	}
+
+	ef := types.NewEncryptedFile(header, wrapped)
+	result := &EncryptResult{
+		InputFile:     opts.InputFile,
+		PlaintextSize: len(opts.DataKey),
+		EncryptedSize: ef.Header().Size() + 8 + len(wrapped),
+		WorkFactor:    opts.WorkFactor,
+		KeyRequired:   ef.KeyRequired == 1,
+		DataKey:       true,
+	}
+	keyHash := sha256.Sum256(opts.DataKey[:])
+	if err := writeLocked(opts, opts.InputFile, ef, result, &keyHash); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// writeLocked writes ef to its own file named for input, or appends it to the
+// log opts.AppendTo, and records where it went in result.  With opts.Verify
+// it then checks the file (see verifyLocked); plaintextHash is the SHA-256
+// of what it decrypts to, or nil.
+func writeLocked(opts EncryptOptions, input string, ef *types.EncryptedFile, result *EncryptResult, plaintextHash *[32]byte) error {
+	// Tell readers which format they need once every header field is known
+	ef.MinReaderVersion = ef.Header().RequiredReaderVersion()
+
+	if opts.AppendTo != "" {
+		data, err := utils.EncodeEncryptedFile(ef)
+		if err != nil {
+			return fmt.Errorf("failed to encode encrypted file: %v", err)
+		}
+		rec, err := utils.AppendLogRecord(opts.AppendTo, data)
+		if err != nil {
+			return fmt.Errorf("failed to append to log: %v", err)
+		}
+		result.OutputFile = opts.AppendTo
+		result.LogRecord = rec.Index
+		result.LogHead = rec.Hash
+	} else {
+		outputFile, err := encryptedOutputFile(opts, input, ef.Header())
+		if err != nil {
+			return err
+		}
+		if err := utils.WriteEncryptedFileFS(utils.WritableOrOS(opts.OutputFS), outputFile, ef); err != nil {
+			return fmt.Errorf("failed to write encrypted file: %v", err)
+		}
+		result.OutputFile = outputFile
+	}
+
+	if opts.Verify {
+		data := lockedData{size: int64(len(ef.Data)), hash: sha256.Sum256(ef.Data)}
+		return verifyLocked(opts, ef.Header(), data, result, plaintextHash)
+	}
+	return nil
+}
+
+// encryptedOutputFile names the encrypted file for input and creates the
+// directory it goes in.
+func encryptedOutputFile(opts EncryptOptions, input string, header *types.FileHeader) (string, error) {
+	outputFile := opts.OutputFile
+	if outputFile == "" {
+		var err error
+		outputFile, err = expandOutputTemplate(opts.OutputTemplate, DefaultEncryptTemplate, TemplateVars{
+			Input:      input,
+			WorkFactor: opts.WorkFactor,
+			Header:     header,
+		}, false)
+		if err != nil {
+			return "", err
+		}
+	}
+	if err := utils.WritableOrOS(opts.OutputFS).MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+		return "", fmt.Errorf("failed to create output directory: %v", err)
+	}
+	return outputFile, nil
+}
+
+// padHeader pads header to opts.PadHeader bytes, if set.  It must be called
+// once every other header field is known and before sealingKey binds the
+// header.
+func padHeader(opts EncryptOptions, header *types.FileHeader) error {
+	if opts.PadHeader == 0 {
+		return nil
+	}
+	if err := header.PadTo(opts.PadHeader); err != nil {
+		return fmt.Errorf("cannot pad the header: %v", err)
+	}
+	return nil
+}
+
+// sealingKey returns the key that seals the data of a file with header: the
+// puzzle key itself or, for a member of a shared puzzle group, a subkey bound
+// to the complete header.
+func sealingKey(header *types.FileHeader, puzzleKey [32]byte) ([32]byte, error) {
+	if header.Ext.Shared == nil {
+		return puzzleKey, nil
+	}
+	key, err := crypto.DeriveMemberKey(puzzleKey, header.Fingerprint())
+	if err != nil {
+		return key, fmt.Errorf("failed to derive group member key: %v", err)
+	}
+	return key, nil
+}
+
+// newLockedHeader generates a fresh time-lock puzzle and returns the file
+// header describing it together with the puzzle-derived encryption key and
+// what opts.VerifyPuzzle checked of it.
+func newLockedHeader(opts EncryptOptions, userKeyRaw []byte) (*types.FileHeader, [32]byte, *crypto.PuzzleCheck, error) {
+	var encryptionKey [32]byte
 
 	// Generate time-lock puzzle
-	puzzle, _, err := crypto.GeneratePuzzle(opts.WorkFactor, userKeyRaw)
+	puzzle, priv, err := crypto.GeneratePuzzleWithOptions(opts.WorkFactor, userKeyRaw, crypto.GenerateOptions{
+		NoTrapdoor: opts.NoTrapdoor,
+		Progress:   opts.Progress,
+		BaseTweak:  opts.BaseTweak,
+		Bits:       opts.ModulusBits,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate puzzle: %v", err)
+		return nil, encryptionKey, nil, fmt.Errorf("failed to generate puzzle: %v", err)
+	}
+	check, err := verifyPuzzle(opts, puzzle, priv)
+	if err != nil {
+		return nil, encryptionKey, nil, err
 	}
 
 	// Derive encryption key directly from puzzle target
-	encryptionKey := crypto.DerivePuzzleKey(puzzle.Target)
+	header, err := lockedHeader(opts, puzzle)
+	if err != nil {
+		return nil, encryptionKey, nil, err
+	}
+	encryptionKey, err = derivePuzzleKey(header, puzzle.N, puzzle.Target)
+	if err != nil {
+		return nil, encryptionKey, nil, fmt.Errorf("failed to derive encryption key: %v", err)
+	}
+	if encryptionKey, err = moreLockedPuzzles(opts, header, encryptionKey); err != nil {
+		return nil, encryptionKey, nil, err
+	}
+
+	return header, encryptionKey, check, nil
+}
+
+// verifyPuzzle checks a generated puzzle if opts.VerifyPuzzle asks for it,
+// and returns nil otherwise.
+func verifyPuzzle(opts EncryptOptions, puzzle crypto.Puzzle, priv *rsa.PrivateKey) (*crypto.PuzzleCheck, error) {
+	if !opts.VerifyPuzzle {
+		return nil, nil
+	}
+	check, err := crypto.VerifyPuzzle(puzzle, priv, opts.VerifyPuzzleSteps)
+	if err != nil {
+		return nil, fmt.Errorf("puzzle failed verification: %v", err)
+	}
+	return check, nil
+}
+
+// derivePuzzleKey derives the key of a solved puzzle of modulus N with the
+// key derivation and parameters header records.
+func derivePuzzleKey(header *types.FileHeader, N, target *big.Int) ([32]byte, error) {
+	return crypto.DerivePuzzleKeyParams(target, N, header.Ext.KeyDerivation, header.Ext.KDFParams.Bytes())
+}
+
+// lockedHeader returns the file header describing puzzle.  opts.KeyHash
+// and opts.Cipher must have been checked by checkEncryptOptions.
+func lockedHeader(opts EncryptOptions, puzzle crypto.Puzzle) (*types.FileHeader, error) {
+	keyDerivation, _ := crypto.KeyDerivationForHash(opts.KeyHash)
+	cipher, _ := crypto.CipherForName(opts.Cipher)
+	var kdfParams *types.KDFParams
+	if params, err := crypto.KeyDerivationParams(keyDerivation); err != nil {
+		return nil, fmt.Errorf("failed to encode key-derivation parameters: %v", err)
+	} else if params != nil {
+		kdfParams = &types.KDFParams{Encoded: params}
+	}
 
 	// Determine if password was used (affects file format)
 	var keyRequired uint8
-	if len(userKeyRaw) > 0 {
+	if puzzle.KdfID != 0 {
 		keyRequired = 1
 	} else {
 		keyRequired = 0
 	}
 
-	// Encrypt the data directly with the puzzle-derived key
-	encryptedData, err := crypto.EncryptData(encryptionKey, plaintext)
-	if err != nil {
-		return nil, fmt.Errorf("failed to encrypt data: %v", err)
+	var baseTweak *types.BaseTweak
+	if puzzle.FileID != nil {
+		baseTweak = &types.BaseTweak{FileID: *puzzle.FileID}
 	}
 
-	// Convert puzzle to byte arrays for storage
-	nBytes, gBytes := utils.PuzzleToBytes(puzzle)
-
-	// Create encrypted file structure
-	ef := &types.EncryptedFile{
+	header := &types.FileHeader{
 		Version:     types.CurrentVersion,
 		WorkFactor:  opts.WorkFactor,
-		ModulusN:    nBytes,
-		BaseG:       gBytes,
 		KeyRequired: keyRequired,
 		Salt:        puzzle.Salt,
-		Data:        encryptedData,
+		Ext: types.HeaderExtensions{
+			KeyDerivation: keyDerivation,
+			EncryptorRate: opts.OpsPerSecond,
+			ChunkSize:     uint32(opts.ChunkSize),
+			Cipher:        cipher,
+			KDFParams:     kdfParams,
+			BaseTweak:     baseTweak,
+		},
 	}
-
-	// Write encrypted file
-	outputFile := opts.InputFile + ".locked"
-	if err := utils.WriteEncryptedFile(outputFile, ef); err != nil {
-		return nil, fmt.Errorf("failed to write encrypted file: %v", err)
+	if err := header.SetModulus(puzzle.N, puzzle.G); err != nil {
+		return nil, err
 	}
-
-	return &EncryptResult{
-		InputFile:     opts.InputFile,
-		OutputFile:    outputFile,
-		PlaintextSize: len(plaintext),
-		EncryptedSize: types.HeaderSize + 8 + len(encryptedData),
-		WorkFactor:    opts.WorkFactor,
-		KeyRequired:   keyRequired == 1,
-	}, nil
+	return header, nil
 }
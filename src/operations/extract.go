@@ -0,0 +1,227 @@
+package operations
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// ExtractDataOptions contains all the parameters needed for extracting the
+// data section of an encrypted file
+type ExtractDataOptions struct {
+	InputFile  string        // the encrypted file
+	OutputFile string        // file to write the data section to
+	HeaderFile string        // file to write the header to, for AttachData (none if empty)
+	PuzzleFile string        // file to write the puzzle parameters to, for Reconstruct (none if empty)
+	FS         fs.FS         // filesystem the input is read from (utils.OS if nil)
+	OutputFS   utils.WriteFS // filesystem the outputs are written to (utils.OS if nil)
+}
+
+// ExtractDataResult contains the results of the extract operation
+type ExtractDataResult struct {
+	OutputFile string
+	HeaderFile string
+	DataSize   int // bytes of ciphertext written to OutputFile
+	HeaderSize int // bytes written to HeaderFile, including the data length
+	PuzzleFile string
+}
+
+// ExtractData writes the data section of an encrypted file, the ciphertext
+// alone, to a file of its own, for entropy tests or to be stored apart from
+// the header.  Nothing is decrypted.  The header can be saved as well, with
+// the length of the data section it expects, and the two put back together
+// with AttachData.  Its puzzle parameters can be exported as well, to
+// rebuild the header with Reconstruct should it be damaged.
+func ExtractData(opts ExtractDataOptions) (*ExtractDataResult, error) {
+	if opts.OutputFile == "" {
+		return nil, fmt.Errorf("the data needs an output file")
+	}
+	if opts.OutputFile == opts.InputFile || (opts.HeaderFile != "" && opts.HeaderFile == opts.InputFile) {
+		return nil, fmt.Errorf("the outputs must not overwrite the input")
+	}
+	if opts.HeaderFile != "" && opts.HeaderFile == opts.OutputFile {
+		return nil, fmt.Errorf("the header and the data need different files")
+	}
+	if opts.PuzzleFile != "" && (opts.PuzzleFile == opts.InputFile || opts.PuzzleFile == opts.OutputFile || opts.PuzzleFile == opts.HeaderFile) {
+		return nil, fmt.Errorf("the puzzle parameters need a file of their own")
+	}
+
+	ef, input, err := utils.ReadEncryptedFileMappedFS(utils.OrOS(opts.FS), opts.InputFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encrypted file: %v", err)
+	}
+	defer input.Close()
+	var export *types.PuzzleExport
+	if opts.PuzzleFile != "" {
+		if export, err = exportPuzzle(ef.Header(), len(ef.Data)); err != nil {
+			return nil, err
+		}
+	}
+
+	outputFS := utils.WritableOrOS(opts.OutputFS)
+	result := &ExtractDataResult{OutputFile: opts.OutputFile, DataSize: len(ef.Data)}
+	err = input.Access(func([]byte) error {
+		return outputFS.WriteFile(opts.OutputFile, ef.Data, 0644)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write data: %v", err)
+	}
+
+	if opts.HeaderFile != "" {
+		var head bytes.Buffer
+		if _, err := ef.Header().WriteTo(&head); err != nil {
+			return nil, fmt.Errorf("failed to encode header: %v", err)
+		}
+		binary.Write(&head, binary.LittleEndian, uint64(len(ef.Data)))
+		if err := outputFS.WriteFile(opts.HeaderFile, head.Bytes(), 0644); err != nil {
+			return nil, fmt.Errorf("failed to write header: %v", err)
+		}
+		result.HeaderFile = opts.HeaderFile
+		result.HeaderSize = head.Len()
+	}
+
+	if export != nil {
+		if err := utils.WritePuzzleExport(opts.PuzzleFile, export); err != nil {
+			return nil, fmt.Errorf("failed to write puzzle parameters: %v", err)
+		}
+		result.PuzzleFile = opts.PuzzleFile
+	}
+	return result, nil
+}
+
+// exportPuzzle returns the puzzle parameters of a header with a data
+// section of dataLen bytes.  Only a header that describes no more than the
+// puzzle and how the data is sealed can be rebuilt from them: one with an
+// entry table, members, key slots, a shared group or further puzzles is
+// refused.
+func exportPuzzle(h *types.FileHeader, dataLen int) (*types.PuzzleExport, error) {
+	ext := h.Ext
+	switch {
+	case ext.Container != nil:
+		return nil, fmt.Errorf("a container's entry table cannot be rebuilt from its puzzle parameters; save the header instead")
+	case ext.Bundle != nil:
+		return nil, fmt.Errorf("a bundle's members cannot be rebuilt from its puzzle parameters; save the header instead")
+	case ext.KeySlots != nil:
+		return nil, fmt.Errorf("key slots cannot be rebuilt from puzzle parameters; save the header instead")
+	case ext.Shared != nil:
+		return nil, fmt.Errorf("a member of a shared puzzle group is sealed under its own header; save the header instead")
+	case ext.AndPuzzles != nil:
+		return nil, fmt.Errorf("a file of several puzzles cannot be rebuilt from the parameters of one; save the header instead")
+	}
+
+	pe := &types.PuzzleExport{
+		Format:        types.PuzzleExportFormat,
+		Version:       types.PuzzleExportVersion,
+		ModulusN:      h.Modulus().Text(16),
+		BaseG:         h.Base().Text(16),
+		WorkFactor:    h.WorkFactor,
+		KeyRequired:   h.KeyRequired == 1,
+		Salt:          hex.EncodeToString(h.Salt[:]),
+		KeyDerivation: ext.KeyDerivation,
+		Cipher:        ext.Cipher,
+		ChunkSize:     ext.ChunkSize,
+		PayloadType:   ext.PayloadType,
+		EncryptorRate: ext.EncryptorRate,
+		DataSize:      uint64(dataLen),
+		Created:       time.Now().UTC().Truncate(time.Second),
+	}
+	if ext.BaseTweak != nil {
+		pe.FileID = hex.EncodeToString(ext.BaseTweak.FileID[:])
+	}
+	if params := ext.KDFParams.Bytes(); params != nil {
+		pe.KDFParams = hex.EncodeToString(params)
+	}
+	return pe, nil
+}
+
+// AttachDataOptions contains all the parameters needed for attaching a data
+// section to a header
+type AttachDataOptions struct {
+	HeaderFile string        // header written by ExtractData, or any encrypted file
+	DataFile   string        // data section written by ExtractData
+	OutputFile string        // the encrypted file to write
+	FS         fs.FS         // filesystem the inputs are read from (utils.OS if nil)
+	OutputFS   utils.WriteFS // filesystem the output is written to (utils.OS if nil)
+}
+
+// AttachDataResult contains the results of the attach operation
+type AttachDataResult struct {
+	OutputFile    string
+	DataSize      int
+	EncryptedSize int
+}
+
+// AttachData reverses ExtractData: it writes the encrypted file made of the
+// header in opts.HeaderFile followed by the data section in opts.DataFile.
+// The data must be as long as the data length recorded after the header, so
+// a header only takes back data of the file it came from (or a copy of it).
+func AttachData(opts AttachDataOptions) (*AttachDataResult, error) {
+	if opts.OutputFile == "" {
+		return nil, fmt.Errorf("the encrypted file needs an output file")
+	}
+	if opts.OutputFile == opts.HeaderFile || opts.OutputFile == opts.DataFile {
+		return nil, fmt.Errorf("the output must not overwrite an input")
+	}
+
+	fsys := utils.OrOS(opts.FS)
+	header, dataLen, err := readHeaderAndLength(fsys, opts.HeaderFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header from %s: %v", opts.HeaderFile, err)
+	}
+
+	data, err := utils.OpenMappedFS(fsys, opts.DataFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data: %v", err)
+	}
+	defer data.Close()
+	if size := uint64(len(data.Bytes())); size != dataLen {
+		return nil, fmt.Errorf("%s holds %d bytes but the header expects %d", opts.DataFile, size, dataLen)
+	}
+	if chunkSize := int(header.Ext.ChunkSize); chunkSize != 0 {
+		if _, err := crypto.StreamPlaintextSize(int64(dataLen), chunkSize); err != nil {
+			return nil, fmt.Errorf("%s is not a chunked data section: %v", opts.DataFile, err)
+		}
+	}
+
+	err = data.Access(func(b []byte) error {
+		return utils.WriteEncryptedFileFS(utils.WritableOrOS(opts.OutputFS), opts.OutputFile, types.NewEncryptedFile(header, b))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write encrypted file: %v", err)
+	}
+	return &AttachDataResult{
+		OutputFile:    opts.OutputFile,
+		DataSize:      int(dataLen),
+		EncryptedSize: header.Size() + 8 + int(dataLen),
+	}, nil
+}
+
+// readHeaderAndLength reads the header of filename and the data length that
+// follows it, without reading the data section.
+func readHeaderAndLength(fsys fs.FS, filename string) (*types.FileHeader, uint64, error) {
+	f, err := fsys.Open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	header, err := utils.ReadHeader(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	var dataLen uint64
+	if err := binary.Read(f, binary.LittleEndian, &dataLen); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, fmt.Errorf("data length: %v", err)
+	}
+	return header, dataLen, nil
+}
@@ -0,0 +1,46 @@
+package operations
+
+import (
+	"fmt"
+	"io/fs"
+	"time"
+
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// InputName returns the local name an input stands for: the input itself or,
+// for a URL, the last element of its path.  Outputs and checkpoints of a
+// fetched file are named after it, in the current directory.
+func InputName(input string) string {
+	if utils.IsURL(input) {
+		return utils.URLBase(input)
+	}
+	return input
+}
+
+// inputFS returns the filesystem to read input from: fsys or, for a URL
+// when fsys is the OS filesystem, the file downloaded into memory.
+func inputFS(fsys fs.FS, input string, timeout time.Duration) (fs.FS, error) {
+	if utils.IsURL(input) && utils.IsOS(fsys) {
+		return utils.FetchFile(input, timeout)
+	}
+	return utils.OrOS(fsys), nil
+}
+
+// ReadInputHeader reads the header of the encrypted file input in fsys (the
+// OS filesystem if nil).  Of a URL, only the header is fetched.
+func ReadInputHeader(fsys fs.FS, input string, timeout time.Duration) (*types.FileHeader, error) {
+	if utils.IsURL(input) && utils.IsOS(fsys) {
+		header, _, err := utils.FetchHeader(input, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encrypted file: %w", err)
+		}
+		return header, nil
+	}
+	header, err := utils.ReadFileHeaderFS(utils.OrOS(fsys), input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encrypted file: %w", err)
+	}
+	return header, nil
+}
@@ -0,0 +1,187 @@
+package operations
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// encryptInPlace encrypts opts.InputFile into a chunked file that replaces
+// it (see EncryptOptions.InPlace).
+func encryptInPlace(opts EncryptOptions, userKeyRaw []byte) (*EncryptResult, error) {
+	if t, err := resumeInPlace(opts.InputFile); t != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return &EncryptResult{InputFile: opts.InputFile, OutputFile: t.Final, InPlace: true, InPlaceResumed: true}, nil
+	}
+
+	info, err := os.Stat(opts.InputFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input file: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file; only files are encrypted in place", opts.InputFile)
+	}
+	if opts.ChunkSize == 0 {
+		opts.ChunkSize = crypto.DefaultChunkSize
+	}
+	plaintextSize := info.Size()
+	dataSize := crypto.StreamCiphertextSize(plaintextSize, opts.ChunkSize)
+
+	header, encryptionKey, check, err := newLockedHeader(opts, userKeyRaw)
+	if err != nil {
+		return nil, err
+	}
+	if err := padHeader(opts, header); err != nil {
+		return nil, err
+	}
+	header.MinReaderVersion = header.RequiredReaderVersion()
+	outputFile, err := encryptedOutputFile(opts, opts.InputFile, header)
+	if err != nil {
+		return nil, err
+	}
+
+	// Everything before the first chunk: header, data length, nonce prefix
+	var head bytes.Buffer
+	if _, err := header.WriteTo(&head); err != nil {
+		return nil, fmt.Errorf("failed to encode header: %v", err)
+	}
+	binary.Write(&head, binary.LittleEndian, uint64(dataSize))
+	prefix := make([]byte, crypto.StreamNoncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce prefix: %v", err)
+	}
+	encryptedSize := int64(head.Len()) + dataSize
+
+	result := &EncryptResult{
+		InputFile:     opts.InputFile,
+		OutputFile:    outputFile,
+		PlaintextSize: int(plaintextSize),
+		EncryptedSize: int(encryptedSize),
+		WorkFactor:    opts.WorkFactor,
+		KeyRequired:   header.KeyRequired == 1,
+		ChunkSize:     opts.ChunkSize,
+		InPlace:       true,
+		PuzzleCheck:   check,
+	}
+	overwrite, err := inPlaceOverwrite(outputFile, encryptedSize, opts.InPlaceOverwrite)
+	if err != nil {
+		return nil, err
+	}
+	if overwrite {
+		err := utils.TransformInPlace(&utils.InPlace{
+			Path:      opts.InputFile,
+			Final:     outputFile,
+			Seal:      true,
+			Key:       encryptionKey[:],
+			ChunkSize: opts.ChunkSize,
+			Plaintext: plaintextSize,
+			HeadSize:  int64(head.Len()) + crypto.StreamNoncePrefixSize,
+			Head:      append(head.Bytes(), prefix...),
+			Prefix:    prefix,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt in place: %v", err)
+		}
+		result.InPlaceOverwrite = true
+		return result, nil
+	}
+
+	write := func(w io.Writer) error {
+		in, err := os.Open(opts.InputFile)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		if _, err := w.Write(head.Bytes()); err != nil {
+			return err
+		}
+		cw := &countingWriter{w: w}
+		err = crypto.EncryptStreamWithOptions(encryptionKey, io.LimitReader(in, plaintextSize), cw,
+			crypto.StreamOptions{ChunkSize: opts.ChunkSize, NoncePrefix: prefix})
+		if err == nil && cw.n != dataSize {
+			err = fmt.Errorf("%s changed size while being encrypted", opts.InputFile)
+		}
+		return err
+	}
+	if err := utils.OS.(utils.StreamFS).WriteFileFrom(outputFile, 0644, write); err != nil {
+		return nil, fmt.Errorf("failed to write encrypted file: %v", err)
+	}
+	if err := os.Remove(opts.InputFile); err != nil {
+		return nil, fmt.Errorf("encrypted to %s but failed to remove %s: %v", outputFile, opts.InputFile, err)
+	}
+	return result, nil
+}
+
+// checkInPlaceDecrypt rejects a file that cannot be decrypted in place:
+// only a single chunked document is.
+func checkInPlaceDecrypt(ef *types.EncryptedFile) error {
+	ext := ef.Ext
+	if ext.ChunkSize == 0 || ext.Container != nil || ext.Bundle != nil || ext.KeySlots != nil ||
+		ext.PayloadType != types.PayloadDocument {
+		return fmt.Errorf("only chunked files (encrypted with --chunk-size or --in-place) can be decrypted in place")
+	}
+	return nil
+}
+
+// decryptInPlace decrypts the chunked file path, whose header is header,
+// over its own bytes and renames it to outputFile.
+func decryptInPlace(path, outputFile string, header *types.FileHeader, dataSize int64, key [32]byte) (int64, error) {
+	chunkSize := int(header.Ext.ChunkSize)
+	plaintextSize, err := crypto.StreamPlaintextSize(dataSize, chunkSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decrypt data: %v", err)
+	}
+	err = utils.TransformInPlace(&utils.InPlace{
+		Path:      path,
+		Final:     outputFile,
+		Key:       key[:],
+		ChunkSize: chunkSize,
+		Plaintext: plaintextSize,
+		HeadSize:  int64(header.Size()) + 8 + crypto.StreamNoncePrefixSize,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to decrypt in place: %v", err)
+	}
+	return plaintextSize, nil
+}
+
+// inPlaceOverwrite reports whether a file is transformed over its own bytes
+// rather than into a new file next to it: when forced, or when the
+// filesystem has no room for size more bytes.
+func inPlaceOverwrite(outputFile string, size int64, force bool) (bool, error) {
+	err := utils.CheckWritable(filepath.Dir(outputFile), size)
+	if err != nil && !errors.Is(err, utils.ErrNoSpace) {
+		return false, err
+	}
+	return force || err != nil, nil
+}
+
+// resumeInPlace finishes an in-place transformation of path interrupted by
+// a crash, if there is one.
+func resumeInPlace(path string) (*utils.InPlace, error) {
+	t, err := utils.ResumeInPlace(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to finish the interrupted in-place operation on %s: %v", path, err)
+	}
+	return t, nil
+}
+
+// checkNoInPlaceJournal refuses a file left half-transformed by an
+// interrupted in-place operation.
+func checkNoInPlaceJournal(path string) error {
+	if _, err := os.Stat(utils.InPlaceJournalPath(path)); err == nil {
+		return fmt.Errorf("%s was left half-transformed by an interrupted in-place operation; run it again with --in-place to finish it", path)
+	}
+	return nil
+}
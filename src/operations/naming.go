@@ -0,0 +1,166 @@
+package operations
+
+import (
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cryptotimed/src/types"
+)
+
+// Default output templates.  They reproduce the built-in naming: encrypting
+// appends ".locked", decrypting strips it (or appends ".decrypted").
+const (
+	DefaultEncryptTemplate = "{path}.locked"
+	DefaultDecryptTemplate = "{unlocked}"
+)
+
+// TemplateVars are the values output templates are expanded with
+type TemplateVars struct {
+	Input      string // input path as given
+	WorkFactor uint64
+	Header     *types.FileHeader // header of the encrypted file (for {fingerprint})
+	Time       time.Time
+}
+
+// templatePlaceholders documents every placeholder and how it is expanded.
+// For decryption, {base}, {name} and {ext} describe the input with its
+// ".locked" extension removed, i.e. the original file name.
+var templatePlaceholders = map[string]func(v TemplateVars, decrypt bool) string{
+	"path":     func(v TemplateVars, _ bool) string { return v.Input },
+	"unlocked": func(v TemplateVars, _ bool) string { return defaultOutputFile(v.Input) },
+	"dir":      func(v TemplateVars, _ bool) string { return filepath.Dir(v.Input) },
+	"base":     func(v TemplateVars, decrypt bool) string { return templateBase(v.Input, decrypt) },
+	"name": func(v TemplateVars, decrypt bool) string {
+		base := templateBase(v.Input, decrypt)
+		return strings.TrimSuffix(base, filepath.Ext(base))
+	},
+	"ext":        func(v TemplateVars, decrypt bool) string { return filepath.Ext(templateBase(v.Input, decrypt)) },
+	"workfactor": func(v TemplateVars, _ bool) string { return strconv.FormatUint(v.WorkFactor, 10) },
+	"date":       func(v TemplateVars, _ bool) string { return v.Time.Format("2006-01-02") },
+	"time":       func(v TemplateVars, _ bool) string { return v.Time.Format("150405") },
+	"timestamp":  func(v TemplateVars, _ bool) string { return strconv.FormatInt(v.Time.Unix(), 10) },
+	"fingerprint": func(v TemplateVars, _ bool) string {
+		fp := v.Header.Fingerprint()
+		return hex.EncodeToString(fp[:4])
+	},
+}
+
+// OutputTemplate is a parsed output naming template: literal text with
+// {placeholder} fields.
+type OutputTemplate struct {
+	text   string
+	fields []templateField
+}
+
+// templateField is a literal run or, if placeholder is set, a placeholder.
+type templateField struct {
+	literal     string
+	placeholder string
+}
+
+// ParseOutputTemplate parses and validates a template such as
+// "{name}.{workfactor}.{date}.tlp".
+func ParseOutputTemplate(text string) (*OutputTemplate, error) {
+	if text == "" {
+		return nil, fmt.Errorf("output template is empty")
+	}
+	t := &OutputTemplate{text: text}
+	rest := text
+	for rest != "" {
+		open := strings.IndexByte(rest, '{')
+		if close := strings.IndexByte(rest, '}'); close >= 0 && (open < 0 || close < open) {
+			return nil, fmt.Errorf("unmatched '}' in output template %q", text)
+		}
+		if open < 0 {
+			t.fields = append(t.fields, templateField{literal: rest})
+			break
+		}
+		if open > 0 {
+			t.fields = append(t.fields, templateField{literal: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed '{' in output template %q", text)
+		}
+		name := rest[open+1 : open+end]
+		if _, ok := templatePlaceholders[name]; !ok {
+			return nil, fmt.Errorf("unknown placeholder {%s} in output template %q (known: %s)", name, text, knownPlaceholders())
+		}
+		t.fields = append(t.fields, templateField{placeholder: name})
+		rest = rest[open+end+1:]
+	}
+	return t, nil
+}
+
+// String returns the template text
+func (t *OutputTemplate) String() string {
+	return t.text
+}
+
+// Uses reports whether the template contains the placeholder
+func (t *OutputTemplate) Uses(placeholder string) bool {
+	for _, f := range t.fields {
+		if f.placeholder == placeholder {
+			return true
+		}
+	}
+	return false
+}
+
+// Expand returns the output path for an input.  decrypt selects the
+// decryption meaning of {base}, {name} and {ext}.
+func (t *OutputTemplate) Expand(v TemplateVars, decrypt bool) string {
+	var b strings.Builder
+	for _, f := range t.fields {
+		if f.placeholder == "" {
+			b.WriteString(f.literal)
+			continue
+		}
+		b.WriteString(templatePlaceholders[f.placeholder](v, decrypt))
+	}
+	return b.String()
+}
+
+// templateBase is the input's base name, without ".locked" when decrypting
+func templateBase(input string, decrypt bool) string {
+	base := filepath.Base(input)
+	if decrypt {
+		base = strings.TrimSuffix(base, ".locked")
+	}
+	return base
+}
+
+// knownPlaceholders lists the placeholder names for error messages
+func knownPlaceholders() string {
+	names := make([]string, 0, len(templatePlaceholders))
+	for name := range templatePlaceholders {
+		names = append(names, "{"+name+"}")
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// expandOutputTemplate parses text (or the default template if empty) and
+// expands it.  The header is only needed by {fingerprint}.
+func expandOutputTemplate(text, defaultText string, v TemplateVars, decrypt bool) (string, error) {
+	if text == "" {
+		text = defaultText
+	}
+	t, err := ParseOutputTemplate(text)
+	if err != nil {
+		return "", err
+	}
+	if v.Time.IsZero() {
+		v.Time = time.Now()
+	}
+	output := t.Expand(v, decrypt)
+	if output == "" {
+		return "", fmt.Errorf("output template %q expands to an empty path", text)
+	}
+	return output, nil
+}
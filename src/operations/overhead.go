@@ -0,0 +1,149 @@
+package operations
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"strings"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/types"
+)
+
+// DefaultOverheadNameLength is the length of the entry names EstimateOverhead
+// assumes for a container when given none.
+const DefaultOverheadNameLength = 24
+
+// maxOverheadCount and maxOverheadPerFile keep the totals of
+// EstimateOverhead within an int64 with room for a header and a container
+// entry of the longest name per file; payloads are further held to half the
+// range, which covers a chunk tag per 4 KiB.
+const (
+	maxOverheadCount   = 1 << 40
+	maxOverheadPerFile = 1 << 17
+)
+
+// OverheadOptions describes an archive whose storage overhead is estimated.
+type OverheadOptions struct {
+	Count      int64 // files in the archive
+	AvgSize    int64 // average plaintext size of a file in bytes
+	ChunkSize  int   // as EncryptOptions.ChunkSize (0 = seal each file in one piece)
+	NameLength int   // average entry name length in a container (DefaultOverheadNameLength if 0)
+}
+
+// Overhead is what an archive stores beyond its payload.
+type Overhead struct {
+	FixedHeader int64 // the fixed fields of every header: Count × types.HeaderSize for separate files
+	Extensions  int64 // version fields and extension records, such as a container's entry table
+	Framing     int64 // data length fields and sealing: nonces, tags and chunk framing
+	Total       int64
+	PerFile     int64 // Total ÷ Count
+
+	// ExceedsHeader is set when a container's entry table does not fit the
+	// header's extension block (types.MaxExtensionSize); the directory
+	// must then be encrypted with --private-listing or split.
+	ExceedsHeader bool
+}
+
+// OverheadResult compares locking every file of an archive on its own with
+// packing them all into one container.
+type OverheadResult struct {
+	Count     int64
+	AvgSize   int64
+	ChunkSize int
+	Payload   int64 // Count × AvgSize
+
+	Separate  Overhead // one encrypted file per input file
+	Container Overhead // one container of all of them, sealed per entry (never chunked)
+}
+
+// EstimateOverhead computes the storage overhead of an archive of
+// opts.Count files averaging opts.AvgSize bytes, from the headers encrypt
+// writes today.  The fixed header alone takes types.HeaderSize bytes per
+// file, mostly the modulus and base.  The files are assumed to differ: a
+// container stores identical files once.
+func EstimateOverhead(opts OverheadOptions) (*OverheadResult, error) {
+	if opts.Count <= 0 {
+		return nil, errors.New("file count must be positive")
+	}
+	if opts.AvgSize < 0 {
+		return nil, errors.New("average size must not be negative")
+	}
+	if opts.ChunkSize != 0 {
+		if err := crypto.ValidateChunkSize(opts.ChunkSize); err != nil {
+			return nil, err
+		}
+	}
+	if opts.NameLength <= 0 {
+		opts.NameLength = DefaultOverheadNameLength
+	}
+	if opts.NameLength > 1<<16-1 {
+		return nil, errors.New("entry names are at most 65535 bytes")
+	}
+	if opts.Count > maxOverheadCount || opts.AvgSize > math.MaxInt64/opts.Count/2-maxOverheadPerFile {
+		return nil, errors.New("archive is too large to estimate")
+	}
+
+	result := &OverheadResult{
+		Count:     opts.Count,
+		AvgSize:   opts.AvgSize,
+		ChunkSize: opts.ChunkSize,
+		Payload:   opts.Count * opts.AvgSize,
+	}
+
+	// Separate files: each has a header, a data length and its sealing
+	header, err := overheadHeader(opts.ChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	sealed := opts.AvgSize + crypto.DataOverhead
+	if opts.ChunkSize != 0 {
+		sealed = crypto.StreamCiphertextSize(opts.AvgSize, opts.ChunkSize)
+	}
+	result.Separate = newOverhead(opts.Count,
+		opts.Count*types.HeaderSize,
+		opts.Count*int64(header.Size()-types.HeaderSize),
+		opts.Count*(8+sealed-opts.AvgSize))
+
+	// One container: one header whose entry table grows by a record per
+	// file, and every entry sealed on its own
+	header, err = overheadHeader(0)
+	if err != nil {
+		return nil, err
+	}
+	header.Ext.Container = &types.ContainerTable{}
+	empty := header.Size()
+	header.Ext.Container.Entries = []types.ContainerEntry{{Name: strings.Repeat("x", opts.NameLength)}}
+	perEntry := int64(header.Size() - empty)
+	extensions := int64(empty-types.HeaderSize) + opts.Count*perEntry
+	result.Container = newOverhead(opts.Count,
+		types.HeaderSize,
+		extensions,
+		8+opts.Count*crypto.DataOverhead)
+	result.Container.ExceedsHeader = extensions > types.MaxExtensionSize
+	return result, nil
+}
+
+// overheadHeader returns the header encrypt writes for a file, with a
+// stand-in puzzle of the default modulus size, which takes the same room
+// whatever its values.
+func overheadHeader(chunkSize int) (*types.FileHeader, error) {
+	N := new(big.Int).Lsh(big.NewInt(1), crypto.DefaultModulusBits-1)
+	header, err := lockedHeader(EncryptOptions{ChunkSize: chunkSize}, crypto.Puzzle{N: N, G: new(big.Int)})
+	if err != nil {
+		return nil, err
+	}
+	header.MinReaderVersion = header.RequiredReaderVersion()
+	return header, nil
+}
+
+func newOverhead(count, fixed, extensions, framing int64) Overhead {
+	total := fixed + extensions + framing
+	return Overhead{
+		FixedHeader: fixed,
+		Extensions:  extensions,
+		Framing:     framing,
+		Total:       total,
+		PerFile:     total / count,
+	}
+}
@@ -0,0 +1,207 @@
+package operations
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// partialRecordInterval is how many bytes of plaintext writeResumable writes
+// between two saves of its record.
+const partialRecordInterval = 16 << 20
+
+// partialWrite describes how writeResumable went.
+type partialWrite struct {
+	size     int64    // plaintext bytes in the output
+	resumed  uint64   // chunks kept from an interrupted run
+	warnings []string // records or partial files that were not used
+	openErr  error    // the data failed to decrypt (rather than to be written)
+}
+
+// resumableOutput reports whether the plaintext of ef is written through a
+// partial file recorded next to the checkpoint: a chunked file decrypted to
+// a regular file of the OS filesystem with a checkpoint path set.
+func resumableOutput(ef *types.EncryptedFile, opts DecryptOptions, outputFS utils.WriteFS, outputFile string) bool {
+	if ef.Ext.ChunkSize == 0 || opts.CheckpointPath == "" || !utils.IsOS(outputFS) {
+		return false
+	}
+	info, err := os.Stat(outputFile)
+	return err != nil || info.Mode().IsRegular()
+}
+
+// writeResumable decrypts the chunked data section of ef to outputFile
+// through its partial file (see utils.PartialOutput), saving the record at
+// recordPath as chunks are written.  A partial file left by an interrupted
+// run is checked against its record and carried on from its last recorded
+// chunk; one that does not match is written again from the start.  Once
+// complete the partial file is renamed to outputFile and the record removed.
+func writeResumable(ef *types.EncryptedFile, input *utils.MappedFile, key [32]byte, outputFile, recordPath string) (*partialWrite, error) {
+	pw := &partialWrite{}
+	chunkSize := int64(ef.Ext.ChunkSize)
+	plaintextSize, err := crypto.StreamPlaintextSize(int64(len(ef.Data)), int(chunkSize))
+	if err != nil {
+		pw.openErr = err
+		return pw, err
+	}
+	totalChunks := max((plaintextSize+chunkSize-1)/chunkSize, 1)
+
+	fp := ef.Header().Fingerprint()
+	record := &utils.PartialOutput{
+		Fingerprint: hex.EncodeToString(fp[:]),
+		Output:      outputFile,
+		Partial:     utils.PartialFileName(outputFile),
+		ChunkSize:   int(chunkSize),
+	}
+	f, err := os.OpenFile(record.Partial, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return pw, err
+	}
+	defer f.Close()
+
+	// Carry on from the chunks an interrupted run recorded, if still intact
+	digest := sha256.New()
+	prev, err := utils.LoadPartialOutput(recordPath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		pw.warnings = append(pw.warnings, fmt.Sprintf("ignoring output record %s and writing the output from the start: %v", recordPath, err))
+	default:
+		var warning string
+		pw.resumed, warning = resumePartial(prev, record, f, digest, uint64(totalChunks))
+		if warning != "" {
+			pw.warnings = append(pw.warnings, warning)
+		}
+	}
+	offset := int64(pw.resumed) * chunkSize
+	if err := f.Truncate(offset); err != nil {
+		return pw, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return pw, err
+	}
+	record.Chunks = pw.resumed
+	record.Hash = hex.EncodeToString(digest.Sum(nil))
+
+	rw := &recordingWriter{
+		bw:        bufio.NewWriterSize(f, 1<<20),
+		digest:    digest,
+		record:    record,
+		path:      recordPath,
+		chunkSize: chunkSize,
+		maxChunks: uint64(totalChunks) - 1,
+	}
+	out := &outputWriter{w: rw}
+	err = input.Access(func([]byte) error {
+		return crypto.DecryptStreamWithOptions(key, bytes.NewReader(ef.Data), out,
+			crypto.StreamOptions{ChunkSize: int(chunkSize), Skip: pw.resumed})
+	})
+	if err != nil && out.err == nil {
+		// Nothing a later run could carry on from
+		pw.openErr = err
+		f.Close()
+		os.Remove(record.Partial)
+		os.Remove(recordPath)
+		return pw, err
+	}
+	if err == nil {
+		err = rw.bw.Flush()
+	}
+	pw.size = offset + rw.written
+	if rw.warning != "" {
+		pw.warnings = append(pw.warnings, rw.warning)
+	}
+	if err != nil {
+		// The partial file and its record are kept for the next run
+		return pw, err
+	}
+
+	if err := f.Chmod(0644); err != nil {
+		return pw, err
+	}
+	if err := f.Close(); err != nil {
+		return pw, err
+	}
+	if err := os.Rename(record.Partial, outputFile); err != nil {
+		return pw, err
+	}
+	if err := os.Remove(recordPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		pw.warnings = append(pw.warnings, fmt.Sprintf("failed to remove output record: %v", err))
+	}
+	return pw, nil
+}
+
+// resumePartial checks the partial file f against prev, the record of an
+// interrupted run, and returns how many of its chunks can be kept, having
+// fed their plaintext to digest.  When none can, it returns 0 with a warning
+// saying why.
+func resumePartial(prev, cur *utils.PartialOutput, f *os.File, digest hash.Hash, totalChunks uint64) (uint64, string) {
+	if prev.Fingerprint != cur.Fingerprint || prev.Output != cur.Output || prev.Partial != cur.Partial || prev.ChunkSize != cur.ChunkSize {
+		return 0, fmt.Sprintf("the output record is for another file or output; writing %s from the start", cur.Output)
+	}
+	if prev.Chunks == 0 {
+		return 0, ""
+	}
+	n := int64(prev.Chunks) * int64(prev.ChunkSize)
+	copied, err := io.CopyN(digest, f, n)
+	if prev.Chunks >= totalChunks || copied < n || err != nil || hex.EncodeToString(digest.Sum(nil)) != prev.Hash {
+		digest.Reset()
+		return 0, fmt.Sprintf("partial output %s does not match its record (changed since it was written?); writing it again from the start", cur.Partial)
+	}
+	return prev.Chunks, ""
+}
+
+// recordingWriter writes the plaintext of a resumable output through a
+// buffer and, every partialRecordInterval bytes, flushes it and saves the
+// record of the chunks written so far.  It is written whole chunks at a time.
+type recordingWriter struct {
+	bw         *bufio.Writer
+	digest     hash.Hash
+	record     *utils.PartialOutput
+	path       string
+	chunkSize  int64
+	maxChunks  uint64 // chunks that may be recorded: all but the last
+	written    int64  // bytes written by this run
+	unrecorded int64  // of which not yet in the record
+	warning    string // the record could not be saved
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	n, err := w.bw.Write(p)
+	w.digest.Write(p[:n])
+	w.written += int64(n)
+	w.unrecorded += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if w.unrecorded < partialRecordInterval || w.written%w.chunkSize != 0 {
+		return n, nil
+	}
+
+	// Only chunks already handed to the filesystem are recorded
+	if err := w.bw.Flush(); err != nil {
+		return n, err
+	}
+	w.unrecorded = 0
+	chunks := w.record.Chunks + uint64(w.written/w.chunkSize)
+	if chunks > w.maxChunks {
+		return n, nil
+	}
+	saved := *w.record
+	saved.Chunks = chunks
+	saved.Hash = hex.EncodeToString(w.digest.Sum(nil))
+	if err := utils.SavePartialOutput(&saved, w.path); err != nil && w.warning == "" {
+		w.warning = fmt.Sprintf("failed to save output record: %v", err)
+	}
+	return n, nil
+}
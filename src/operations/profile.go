@@ -0,0 +1,126 @@
+package operations
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/utils"
+)
+
+// Profile is a calibration profile exported on one machine (see
+// ExportProfile) and read on another, to estimate how long solves take on
+// the machine it was measured on.
+type Profile struct {
+	Path string
+	*utils.Calibration
+
+	// Mismatch lists how the profile's host clearly differs from this one
+	// (see utils.HostFingerprint.Mismatch; nil if it matches or the profile
+	// records no host).
+	Mismatch []string
+}
+
+// LoadProfile reads the profile at path and compares its host with this
+// one.
+func LoadProfile(path string) (*Profile, error) {
+	c, err := utils.LoadProfile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profile: %v", err)
+	}
+	return newProfile(path, c), nil
+}
+
+func newProfile(path string, c *utils.Calibration) *Profile {
+	p := &Profile{Path: path, Calibration: c}
+	if c.Host != nil {
+		p.Mismatch = c.Host.Mismatch(utils.CurrentHost())
+	}
+	return p
+}
+
+// ProfileRate returns the rate the profile records for a bits-bit modulus,
+// or an error naming the sizes it does record.
+func (p *Profile) ProfileRate(bits int) (*utils.CalibrationEntry, error) {
+	if e := p.Rate(bits); e != nil {
+		return e, nil
+	}
+	return nil, fmt.Errorf("profile %s has no rate for %d-bit moduli (it has: %v)", p.Path, bits, p.ModulusSizes())
+}
+
+// ExportProfile writes this machine's calibration profile to path together
+// with its host fingerprint.  bench, a benchmark just run (nil if none),
+// supplies the rate for its modulus size when no solve on this machine
+// has; the entry then counts no samples, so the first solve recorded
+// where it is imported replaces it.
+func ExportProfile(path string, bench *BenchmarkResult) (*Profile, error) {
+	own, err := utils.CalibrationPath()
+	if err != nil {
+		return nil, err
+	}
+	c, err := utils.LoadCalibration(own)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if bench != nil && bench.Modulus != nil && c.Rate(bench.Modulus.BitLen()) == nil {
+		c.Moduli[bench.Modulus.BitLen()] = &utils.CalibrationEntry{Rate: bench.AvgOpsPerSecond, Updated: now}
+	}
+	if len(c.ModulusSizes()) == 0 {
+		return nil, fmt.Errorf("no squaring rate measured on this machine to export")
+	}
+	if err := utils.ExportProfile(c, path, now); err != nil {
+		return nil, fmt.Errorf("failed to write profile: %v", err)
+	}
+	return LoadProfile(path)
+}
+
+// ImportProfile merges the profile at path into this machine's calibration
+// profile, so that its rates replace older ones here, and returns it with
+// the modulus sizes taken from it.
+func ImportProfile(path string) (*Profile, []int, error) {
+	c, merged, err := utils.ImportProfile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to import profile: %v", err)
+	}
+	return newProfile(path, c), merged, nil
+}
+
+// WorkFactorForProfile picks the work factor the profile's machine solves
+// within target, for a puzzle of a bits-bit modulus (0 =
+// crypto.DefaultModulusBits, the size new files use).  The profile keeps
+// only an average rate, so the work factor is the one solved in target at
+// that rate.
+func WorkFactorForProfile(p *Profile, target time.Duration, bits int) (*Tuning, error) {
+	if target <= 0 {
+		return nil, fmt.Errorf("target time must be positive")
+	}
+	if bits == 0 {
+		bits = crypto.DefaultModulusBits
+	}
+	e, err := p.ProfileRate(bits)
+	if err != nil {
+		return nil, err
+	}
+	return workFactorAtRate(target, e)
+}
+
+// workFactorAtRate picks the work factor solved within target at the
+// average rate of e.
+func workFactorAtRate(target time.Duration, e *utils.CalibrationEntry) (*Tuning, error) {
+	work := math.Floor(target.Seconds() * e.Rate)
+	if work < 1 {
+		work = 1
+	}
+	if work >= math.MaxUint64 {
+		return nil, fmt.Errorf("target time is too long for a work factor")
+	}
+	t := &Tuning{
+		WorkFactor: uint64(work),
+		TargetTime: target,
+		Rate:       utils.Interval{Mean: e.Rate, Lower: e.Rate, Upper: e.Rate, Samples: e.Samples},
+	}
+	t.MeanTime = utils.EstimateTime(t.WorkFactor, e.Rate)
+	return t, nil
+}
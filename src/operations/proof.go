@@ -0,0 +1,94 @@
+package operations
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"time"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// VerifySolveProofOptions contains all the parameters needed for checking a
+// proof written by DecryptOptions.ProofFile
+type VerifySolveProofOptions struct {
+	ProofFile string
+
+	// InputFile, if set, is the encrypted file the proof must be about: its
+	// modulus, base and work factor must be those of the proof.
+	InputFile string
+}
+
+// VerifySolveProofResult describes a proof that checked out
+type VerifySolveProofResult struct {
+	ProofFile   string
+	InputFile   string   // the file the proof was matched with, if any
+	WorkFactor  uint64   // squarings the proof shows were done
+	Fingerprint [32]byte // of the puzzle solved (see crypto.Puzzle.Fingerprint)
+	Target      *big.Int // the solution proven
+	Created     time.Time
+}
+
+// writeSolveProof writes the proof that target solves puzzle, the puzzle of
+// the file with header fingerprint fp, to filename.
+func writeSolveProof(filename string, puzzle crypto.Puzzle, fp [32]byte, target *big.Int, proof *crypto.SolveProof) error {
+	pf := &types.SolveProofFile{
+		Format:      types.SolveProofFormat,
+		Version:     types.SolveProofVersion,
+		ModulusN:    puzzle.N.Text(16),
+		BaseG:       puzzle.G.Text(16),
+		WorkFactor:  puzzle.T,
+		Solution:    target.Text(16),
+		Partial:     proof.Partial.Text(16),
+		Fingerprint: hex.EncodeToString(fp[:]),
+		Created:     time.Now().UTC().Truncate(time.Second),
+	}
+	for _, mu := range proof.Mu {
+		pf.Mu = append(pf.Mu, mu.Text(16))
+	}
+	return utils.WriteSolveProof(filename, pf)
+}
+
+// VerifySolveProof checks a proof that a puzzle was solved, written by
+// DecryptOptions.ProofFile, in a small fraction of the time the solve took
+// (see crypto.VerifySolveProof).  With opts.InputFile, the proof must be
+// about that file's puzzle.  A file's header records the base even when
+// the file needs a passphrase, so none is needed to match them.
+func VerifySolveProof(opts VerifySolveProofOptions) (*VerifySolveProofResult, error) {
+	pf, puzzle, target, proof, err := utils.ReadSolveProof(opts.ProofFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read solve proof from %s: %v", opts.ProofFile, err)
+	}
+
+	if opts.InputFile != "" {
+		header, err := utils.ReadFileHeader(opts.InputFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encrypted file: %v", err)
+		}
+		if more := utils.AndPuzzlesFromHeader(header); len(more) > 0 {
+			return nil, fmt.Errorf("%s needs %d puzzles solved; a solve proof covers one", opts.InputFile, len(more)+1)
+		}
+		switch {
+		case header.Modulus().Cmp(puzzle.N) != 0:
+			return nil, fmt.Errorf("the proof is about another puzzle than %s (another modulus)", opts.InputFile)
+		case header.Base().Cmp(puzzle.G) != 0:
+			return nil, fmt.Errorf("the proof is about another puzzle than %s (another base)", opts.InputFile)
+		case header.WorkFactor != puzzle.T:
+			return nil, fmt.Errorf("the proof is about another puzzle than %s (work factor %d, not %d)", opts.InputFile, puzzle.T, header.WorkFactor)
+		}
+	}
+
+	if err := crypto.VerifySolveProof(puzzle, target, proof); err != nil {
+		return nil, fmt.Errorf("invalid solve proof: %v", err)
+	}
+	return &VerifySolveProofResult{
+		ProofFile:   opts.ProofFile,
+		InputFile:   opts.InputFile,
+		WorkFactor:  puzzle.T,
+		Fingerprint: puzzle.Fingerprint(),
+		Target:      target,
+		Created:     pf.Created,
+	}, nil
+}
@@ -0,0 +1,179 @@
+package operations
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"cryptotimed/src/crypto"
+)
+
+// SignatureHeader carries the HMAC-SHA256 of a published request body, as
+// "sha256=" followed by the hex digest.
+const SignatureHeader = "X-Cryptotimed-Signature"
+
+// KeyRelease is the JSON body POSTed by PublishKey once a puzzle is solved.
+// Anyone holding it can decrypt the file.
+type KeyRelease struct {
+	File          string    `json:"file"`
+	Fingerprint   string    `json:"fingerprint"`    // SHA-256 of the file header, hex
+	Target        string    `json:"target"`         // solved puzzle target, hex, padded to the modulus width
+	Key           string    `json:"key"`            // symmetric key derived from the target, hex
+	KeyDerivation string    `json:"key_derivation"` // how Key was derived from Target
+	SolvedAt      time.Time `json:"solved_at"`
+
+	// MoreTargets are the targets of a file's further puzzles, like Target
+	// (see types.AndPuzzles); Key then combines the keys of all of them
+	MoreTargets []string `json:"more_targets,omitempty"`
+}
+
+// NewKeyRelease describes the key recovered by a successful decryption.
+func NewKeyRelease(result *DecryptResult, solvedAt time.Time) KeyRelease {
+	release := KeyRelease{
+		File:          result.InputFile,
+		Fingerprint:   hex.EncodeToString(result.Fingerprint[:]),
+		Target:        hex.EncodeToString(result.Target.FillBytes(make([]byte, result.TargetWidth))),
+		Key:           hex.EncodeToString(result.Key[:]),
+		KeyDerivation: crypto.KeyDerivationName(result.KeyDerivation),
+		SolvedAt:      solvedAt.UTC(),
+	}
+	for _, target := range result.MoreTargets {
+		release.MoreTargets = append(release.MoreTargets, hex.EncodeToString(target.FillBytes(make([]byte, result.TargetWidth))))
+	}
+	return release
+}
+
+// PublishOptions contains all the parameters needed for publishing a key
+type PublishOptions struct {
+	URL    string
+	Secret []byte // HMAC key for SignatureHeader (unsigned if empty)
+
+	// Attempts is how many times the POST is tried (1 if less); the delay
+	// before each retry starts at Backoff and doubles up to MaxBackoff.
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// FallbackFile receives the body, readable only by the owner, when
+	// every attempt fails ("" = none).
+	FallbackFile string
+
+	// DryRun builds and signs the request without sending it.
+	DryRun bool
+
+	Client *http.Client // http.DefaultClient with a 30s timeout if nil
+
+	// OnRetry is called before waiting to retry after a failed attempt.
+	OnRetry func(attempt int, delay time.Duration, err error)
+}
+
+// PublishResult describes what PublishKey did
+type PublishResult struct {
+	Body         []byte // the JSON that was (or would be) sent
+	Signature    string // value of SignatureHeader ("" if unsigned)
+	Sent         bool
+	Attempts     int
+	Status       int    // HTTP status of the accepted request
+	FallbackFile string // written because publishing failed
+}
+
+// PublishKey POSTs the release as JSON to opts.URL, retrying network errors,
+// 5xx, 408 and 429 responses with exponential backoff.  If it cannot be
+// delivered the body is saved to opts.FallbackFile and an error is returned
+// together with the result.
+func PublishKey(release KeyRelease, opts PublishOptions) (*PublishResult, error) {
+	body, err := json.MarshalIndent(release, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode key release: %v", err)
+	}
+	result := &PublishResult{Body: body}
+	if len(opts.Secret) > 0 {
+		mac := hmac.New(sha256.New, opts.Secret)
+		mac.Write(body)
+		result.Signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	if opts.DryRun {
+		return result, nil
+	}
+
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	attempts := opts.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := opts.Backoff
+
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			if opts.OnRetry != nil {
+				opts.OnRetry(attempt-1, delay, lastErr)
+			}
+			time.Sleep(delay)
+			delay *= 2
+			if opts.MaxBackoff > 0 && delay > opts.MaxBackoff {
+				delay = opts.MaxBackoff
+			}
+		}
+		result.Attempts = attempt
+
+		status, retry, err := postRelease(client, opts.URL, body, result.Signature)
+		if err == nil {
+			result.Sent = true
+			result.Status = status
+			return result, nil
+		}
+		lastErr = err
+		if !retry {
+			break
+		}
+	}
+
+	if opts.FallbackFile != "" {
+		if err := os.WriteFile(opts.FallbackFile, append(body, '\n'), 0600); err != nil {
+			return result, fmt.Errorf("failed to publish key: %v (saving it to %s failed: %v)", lastErr, opts.FallbackFile, err)
+		}
+		result.FallbackFile = opts.FallbackFile
+		return result, fmt.Errorf("failed to publish key: %v (saved to %s)", lastErr, opts.FallbackFile)
+	}
+	return result, fmt.Errorf("failed to publish key: %v", lastErr)
+}
+
+// postRelease sends one request and reports whether a failure is worth
+// retrying.
+func postRelease(client *http.Client, url string, body []byte, signature string) (int, bool, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if signature != "" {
+		req.Header.Set(SignatureHeader, signature)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return resp.StatusCode, false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return resp.StatusCode, true, fmt.Errorf("server returned %s", resp.Status)
+	default:
+		return resp.StatusCode, false, fmt.Errorf("server returned %s", resp.Status)
+	}
+}
@@ -0,0 +1,135 @@
+package operations
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"time"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// PuzzleOptions contains all the parameters needed for generating a
+// standalone puzzle
+type PuzzleOptions struct {
+	WorkFactor uint64
+	OutputFile string
+
+	// NoTrapdoor computes the target by sequential squaring, as for
+	// EncryptOptions.NoTrapdoor.
+	NoTrapdoor bool
+	Progress   ProgressCallback
+}
+
+// PuzzleResult contains the results of puzzle generation
+type PuzzleResult struct {
+	OutputFile  string
+	WorkFactor  uint64
+	Fingerprint [32]byte
+	Commitment  [32]byte
+}
+
+// GeneratePuzzleFile writes a time-lock challenge with no payload: the
+// public parameters and a commitment to the target.  The target itself is
+// not kept anywhere.
+func GeneratePuzzleFile(opts PuzzleOptions) (*PuzzleResult, error) {
+	if opts.OutputFile == "" {
+		return nil, fmt.Errorf("an output file is required")
+	}
+
+	puzzle, _, err := crypto.GeneratePuzzleWithOptions(opts.WorkFactor, nil, crypto.GenerateOptions{
+		NoTrapdoor: opts.NoTrapdoor,
+		Progress:   opts.Progress,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate puzzle: %v", err)
+	}
+	commitment := puzzle.Commitment(puzzle.Target)
+	puzzle.Target = nil
+
+	pf := &types.PuzzleFile{
+		Format:     types.PuzzleFileFormat,
+		Version:    types.PuzzleFileVersion,
+		ModulusN:   puzzle.N.Text(16),
+		BaseG:      puzzle.G.Text(16),
+		WorkFactor: puzzle.T,
+		Commitment: hex.EncodeToString(commitment[:]),
+		Created:    time.Now().UTC().Truncate(time.Second),
+	}
+	if err := utils.WritePuzzleFile(opts.OutputFile, pf); err != nil {
+		return nil, fmt.Errorf("failed to write puzzle file: %v", err)
+	}
+
+	return &PuzzleResult{
+		OutputFile:  opts.OutputFile,
+		WorkFactor:  puzzle.T,
+		Fingerprint: puzzle.Fingerprint(),
+		Commitment:  commitment,
+	}, nil
+}
+
+// SolvePuzzleFileOptions contains all the parameters needed for solving a
+// standalone puzzle
+type SolvePuzzleFileOptions struct {
+	InputFile string
+	PinThread bool // lock the solver to one OS thread
+	GCPercent int  // GOGC while solving (0 = unchanged)
+
+	// NoCalibrate keeps the rate of this solve out of the calibration
+	// profile (see DecryptOptions.NoCalibrate).
+	NoCalibrate bool
+}
+
+// SolvePuzzleFileResult contains the solution of a standalone puzzle
+type SolvePuzzleFileResult struct {
+	InputFile  string
+	WorkFactor uint64
+	Target     *big.Int
+	Verified   bool     // the target matches the file's commitment
+	Warnings   []string // non-fatal problems, e.g. a calibration profile that could not be updated
+}
+
+// ReadPuzzleWorkFactor returns the number of squarings a puzzle file asks
+// for, so that progress can be shown before solving.
+func ReadPuzzleWorkFactor(filename string) (uint64, error) {
+	_, puzzle, _, err := utils.ReadPuzzleFile(filename)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read puzzle file: %v", err)
+	}
+	return puzzle.T, nil
+}
+
+// SolvePuzzleFile solves a standalone puzzle and checks the target against
+// its commitment.  A target that does not match is returned with Verified
+// false: either the file was altered or it was generated dishonestly.
+func SolvePuzzleFile(opts SolvePuzzleFileOptions, progressCallback ProgressCallback) (*SolvePuzzleFileResult, error) {
+	_, puzzle, commitment, err := utils.ReadPuzzleFile(opts.InputFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read puzzle file: %v", err)
+	}
+
+	start := time.Now()
+	target, err := crypto.SolvePuzzleWithOptions(puzzle, crypto.SolveOptions{
+		Progress:  progressCallback,
+		PinThread: opts.PinThread,
+		GCPercent: opts.GCPercent,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &SolvePuzzleFileResult{
+		InputFile:  opts.InputFile,
+		WorkFactor: puzzle.T,
+		Target:     target,
+		Verified:   puzzle.Commitment(target) == commitment,
+	}
+	if !opts.NoCalibrate && CalibrateSolves {
+		if warning := calibrate(puzzle, puzzle.T, time.Since(start)); warning != "" {
+			result.Warnings = append(result.Warnings, warning)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,100 @@
+package operations
+
+import (
+	"fmt"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// ReconstructOptions contains all the parameters needed for rebuilding an
+// encrypted file from its parts
+type ReconstructOptions struct {
+	DataFile   string // data section, as written by ExtractData
+	PuzzleFile string // puzzle parameters, as written by ExtractData with a PuzzleFile
+	KeyInput   string // passphrase or @file:path checked against a password-derived base
+	OutputFile string // the encrypted file to write
+}
+
+// ReconstructResult contains the results of the reconstruct operation
+type ReconstructResult struct {
+	OutputFile    string
+	DataSize      int
+	EncryptedSize int
+	WorkFactor    uint64
+	KeyRequired   bool
+	KeyChecked    bool // KeyInput derives the base of the puzzle parameters
+}
+
+// Reconstruct writes an encrypted file from a data section and the puzzle
+// parameters of the file it came from, for a file whose header is damaged
+// but whose parameters were exported (see ExtractDataOptions.PuzzleFile).
+// The header is written in the current format, so the rebuilt file need
+// not be byte for byte the original, but it decrypts the same.  The
+// parameters are checked as decrypt would before solving, and the data
+// against the size they record and their layout.  For a file needing a
+// passphrase, the passphrase, if given, must derive the recorded base.
+func Reconstruct(opts ReconstructOptions) (*ReconstructResult, error) {
+	if opts.OutputFile == "" {
+		return nil, fmt.Errorf("the encrypted file needs an output file")
+	}
+	if opts.OutputFile == opts.DataFile || opts.OutputFile == opts.PuzzleFile {
+		return nil, fmt.Errorf("the output must not overwrite an input")
+	}
+
+	pe, header, err := utils.ReadPuzzleExport(opts.PuzzleFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read puzzle parameters from %s: %v", opts.PuzzleFile, err)
+	}
+	if header.KeyRequired == 0 && opts.KeyInput != "" {
+		return nil, fmt.Errorf("the puzzle parameters are of a file encrypted without a passphrase")
+	}
+	// Without a passphrase to derive the base with, only the rest is checked
+	check := *header
+	if opts.KeyInput == "" {
+		check.KeyRequired = 0
+	}
+	puzzle, err := headerPuzzle(&check, opts.KeyInput)
+	if err != nil {
+		return nil, fmt.Errorf("invalid puzzle parameters: %v", err)
+	}
+	if opts.KeyInput != "" && puzzle.G.Cmp(header.Base()) != 0 {
+		return nil, fmt.Errorf("the passphrase does not derive the base in the puzzle parameters (wrong passphrase, or parameters of another file)")
+	}
+
+	data, err := utils.OpenMapped(opts.DataFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data: %v", err)
+	}
+	defer data.Close()
+	size := uint64(len(data.Bytes()))
+	if size != pe.DataSize {
+		return nil, fmt.Errorf("%s holds %d bytes but the puzzle parameters record %d", opts.DataFile, size, pe.DataSize)
+	}
+	if chunkSize := int(header.Ext.ChunkSize); chunkSize != 0 {
+		if _, err := crypto.StreamPlaintextSize(int64(size), chunkSize); err != nil {
+			return nil, fmt.Errorf("%s is not a chunked data section: %v", opts.DataFile, err)
+		}
+	} else if header.Ext.Cipher == crypto.CipherChaCha20Poly1305 && size < crypto.DataOverhead {
+		return nil, fmt.Errorf("%s is too short for a sealed data section (%d bytes, at least %d)", opts.DataFile, size, crypto.DataOverhead)
+	}
+	if header.Ext.PayloadType == types.PayloadDataKey && header.Ext.Cipher == crypto.CipherChaCha20Poly1305 && size != crypto.DataOverhead+utils.DataKeySize {
+		return nil, fmt.Errorf("%s is %d bytes, not a sealed %d-byte data key", opts.DataFile, size, utils.DataKeySize)
+	}
+
+	err = data.Access(func(b []byte) error {
+		return utils.WriteEncryptedFile(opts.OutputFile, types.NewEncryptedFile(header, b))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write encrypted file: %v", err)
+	}
+	return &ReconstructResult{
+		OutputFile:    opts.OutputFile,
+		DataSize:      int(size),
+		EncryptedSize: header.Size() + 8 + int(size),
+		WorkFactor:    header.WorkFactor,
+		KeyRequired:   header.KeyRequired == 1,
+		KeyChecked:    opts.KeyInput != "",
+	}, nil
+}
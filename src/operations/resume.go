@@ -0,0 +1,82 @@
+package operations
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// InspectResumeOptions contains all the parameters needed for inspecting a
+// resume checkpoint
+type InspectResumeOptions struct {
+	CheckpointFile string
+
+	// LockedFile is the encrypted file the checkpoint is compared against
+	// (default: CheckpointFile without its .resume extension).
+	LockedFile string
+}
+
+// InspectResumeResult describes a resume checkpoint
+type InspectResumeResult struct {
+	CheckpointFile string
+	Fingerprint    [32]byte // puzzle fingerprint over N, G and T
+	Done           uint64   // squarings already done
+	WorkFactor     uint64
+	Percent        float64
+	Updated        time.Time
+
+	LockedFile string // encrypted file it was compared against ("" if none)
+	Matches    bool   // LockedFile holds the checkpoint's puzzle
+	Mismatch   string // why it does not (missing file, different puzzle)
+}
+
+// InspectResume reads a checkpoint written while decrypting, validates it,
+// and reports whether it belongs to its encrypted file.  No squaring is done.
+func InspectResume(opts InspectResumeOptions) (*InspectResumeResult, error) {
+	state, err := utils.LoadState(opts.CheckpointFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %v", err)
+	}
+
+	result := &InspectResumeResult{
+		CheckpointFile: opts.CheckpointFile,
+		Fingerprint:    state.Puzzle.Fingerprint(),
+		Done:           state.Done,
+		WorkFactor:     state.Puzzle.T,
+		Percent:        100,
+		Updated:        state.Updated,
+		LockedFile:     opts.LockedFile,
+	}
+	if state.Puzzle.T > 0 {
+		result.Percent = float64(state.Done) / float64(state.Puzzle.T) * 100
+	}
+
+	if result.LockedFile == "" {
+		if !strings.HasSuffix(opts.CheckpointFile, ".resume") {
+			return result, nil
+		}
+		result.LockedFile = strings.TrimSuffix(opts.CheckpointFile, ".resume")
+	}
+
+	header, err := utils.ReadFileHeader(result.LockedFile)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		result.Mismatch = "encrypted file not found"
+	case err != nil:
+		result.Mismatch = fmt.Sprintf("failed to read encrypted file: %v", err)
+	default:
+		// The stored base is the one solved, password-derived or not
+		puzzle := utils.PuzzleFromEncryptedFile(types.NewEncryptedFile(header, nil))
+		if err := state.Matches(puzzle); err != nil {
+			result.Mismatch = err.Error()
+		} else {
+			result.Matches = true
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,396 @@
+package operations
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"cryptotimed/src/utils"
+)
+
+// ServiceOptions contains all the parameters needed for installing a
+// supervised background solve
+type ServiceOptions struct {
+	InputFile  string
+	KeyFile    string // file holding the passphrase, for files that need one
+	OutputFile string // default: the input without .locked
+	User       bool   // per-user service instead of a system one
+	Name       string // service name (default derived from the input path)
+	StateDir   string // checkpoint, status and log directory (default per User)
+	Binary     string // cryptotimed executable (default: the running one)
+	Platform   string // "linux" (systemd) or "darwin" (launchd); default runtime.GOOS
+	UnitDir    string // where the unit or plist goes (default per platform and User)
+
+	// CheckpointInterval is passed to decrypt (defaults to 10 minutes).
+	CheckpointInterval time.Duration
+}
+
+// ServicePlan is everything InstallService writes and runs
+type ServicePlan struct {
+	Name           string
+	Platform       string
+	User           bool
+	UnitFile       string
+	Unit           []byte // empty when planned for uninstalling only
+	StateDir       string
+	CheckpointFile string
+	StatusFile     string
+	LogFile        string // launchd only; systemd services log to the journal
+	OutputFile     string
+	Args           []string   // the decrypt command line the service runs
+	Enable         [][]string // commands that enable and start the service
+	Disable        [][]string // commands that stop and disable it, run before removing the definition
+	Cleanup        [][]string // commands run after removing the definition
+	Follow         []string   // commands to follow progress with
+}
+
+// CommandRunner runs an external command such as systemctl.
+type CommandRunner func(name string, args ...string) error
+
+// PlanService works out the service definition for solving opts.InputFile
+// in the background: decrypt with periodic checkpoints and a status file,
+// at low priority, restarted after failures and resumed at boot until the
+// output exists.  With an empty InputFile (and a Name) only the paths
+// needed to uninstall are planned.
+func PlanService(opts ServiceOptions) (*ServicePlan, error) {
+	platform := opts.Platform
+	if platform == "" {
+		platform = runtime.GOOS
+	}
+	if platform != "linux" && platform != "darwin" {
+		return nil, fmt.Errorf("background solve services are supported on Linux (systemd) and macOS (launchd), not %s", platform)
+	}
+
+	var input string
+	if opts.InputFile != "" {
+		var err error
+		if input, err = filepath.Abs(opts.InputFile); err != nil {
+			return nil, err
+		}
+	}
+	name := opts.Name
+	if name == "" {
+		if input == "" {
+			return nil, errors.New("an input file or service name is required")
+		}
+		name = serviceName(input)
+	}
+	if strings.ContainsAny(name, "/\\ ") || name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid service name %q", name)
+	}
+
+	plan := &ServicePlan{Name: name, Platform: platform, User: opts.User}
+	var err error
+	if plan.StateDir, err = serviceStateDir(opts, name); err != nil {
+		return nil, err
+	}
+	unitDir := opts.UnitDir
+	if unitDir == "" {
+		if unitDir, err = serviceUnitDir(platform, opts.User); err != nil {
+			return nil, err
+		}
+	}
+	plan.CheckpointFile = filepath.Join(plan.StateDir, "solve.resume")
+	plan.StatusFile = filepath.Join(plan.StateDir, "status.json")
+
+	systemctl := []string{"systemctl"}
+	journalctl := []string{"journalctl"}
+	if opts.User {
+		systemctl = append(systemctl, "--user")
+		journalctl = append(journalctl, "--user")
+	}
+	if platform == "linux" {
+		plan.UnitFile = filepath.Join(unitDir, name+".service")
+		plan.Enable = [][]string{
+			append(append([]string{}, systemctl...), "daemon-reload"),
+			append(append([]string{}, systemctl...), "enable", "--now", name+".service"),
+		}
+		plan.Disable = [][]string{
+			append(append([]string{}, systemctl...), "disable", "--now", name+".service"),
+		}
+		plan.Cleanup = [][]string{
+			append(append([]string{}, systemctl...), "daemon-reload"),
+		}
+		plan.Follow = []string{
+			strings.Join(append(journalctl, "-u", name, "-f"), " "),
+		}
+	} else {
+		plan.UnitFile = filepath.Join(unitDir, name+".plist")
+		plan.LogFile = filepath.Join(plan.StateDir, "solve.log")
+		plan.Enable = [][]string{{"launchctl", "load", "-w", plan.UnitFile}}
+		plan.Disable = [][]string{{"launchctl", "unload", "-w", plan.UnitFile}}
+		plan.Follow = []string{"tail -f " + plan.LogFile}
+	}
+	plan.Follow = append(plan.Follow, "cat "+plan.StatusFile)
+
+	if input == "" {
+		return plan, nil
+	}
+
+	// Refuse work the service could only fail at
+	header, err := utils.ReadFileHeader(input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encrypted file: %v", err)
+	}
+	plan.Args, err = serviceArgs(opts, plan, input, header.KeyRequired == 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if platform == "linux" {
+		plan.Unit = systemdUnit(plan, input)
+	} else {
+		plan.Unit = launchdPlist(plan)
+	}
+	return plan, nil
+}
+
+// serviceArgs builds the decrypt command line run by the service.
+func serviceArgs(opts ServiceOptions, plan *ServicePlan, input string, keyRequired bool) ([]string, error) {
+	binary := opts.Binary
+	if binary == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate the cryptotimed binary: %v", err)
+		}
+		if binary, err = filepath.EvalSymlinks(exe); err != nil {
+			return nil, err
+		}
+	}
+	if !filepath.IsAbs(binary) {
+		return nil, fmt.Errorf("binary path %s is not absolute", binary)
+	}
+
+	output := opts.OutputFile
+	if output == "" {
+		output = defaultOutputFile(input)
+	}
+	output, err := filepath.Abs(output)
+	if err != nil {
+		return nil, err
+	}
+	plan.OutputFile = output
+	if _, err := os.Stat(output); err == nil {
+		return nil, fmt.Errorf("output %s already exists (the service stops once it does)", output)
+	}
+
+	interval := opts.CheckpointInterval
+	if interval <= 0 {
+		interval = 10 * time.Minute
+	}
+	args := []string{binary, "decrypt",
+		"--input", input,
+		"--output", output,
+		"--checkpoint-file", plan.CheckpointFile,
+		"--checkpoint-interval", interval.String(),
+		"--status-file", plan.StatusFile,
+		"--progress-interval", "0",
+		"--yes", // nobody is there to confirm a long solve
+	}
+
+	switch {
+	case keyRequired && opts.KeyFile == "":
+		return nil, errors.New("this file requires a key: pass it in a file (--key-file) so it is not written into the service definition")
+	case opts.KeyFile != "":
+		keyFile, err := filepath.Abs(opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(keyFile); err != nil {
+			return nil, fmt.Errorf("key file: %v", err)
+		}
+		args = append(args, "--key", "@file:"+keyFile)
+	}
+	return args, nil
+}
+
+// serviceName derives a stable name from the input's base name and a short
+// hash of its absolute path, so files with the same name do not collide.
+func serviceName(input string) string {
+	base := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		}
+		return '-'
+	}, filepath.Base(input))
+	sum := sha256.Sum256([]byte(input))
+	return "cryptotimed-solve-" + base + "-" + hex.EncodeToString(sum[:4])
+}
+
+// serviceStateDir returns the directory holding the service's checkpoint,
+// status and log.
+func serviceStateDir(opts ServiceOptions, name string) (string, error) {
+	if opts.StateDir != "" {
+		return filepath.Abs(opts.StateDir)
+	}
+	if opts.User {
+		dir, err := utils.StateDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Abs(filepath.Join(dir, "solves", name))
+	}
+	if opts.Platform == "darwin" || (opts.Platform == "" && runtime.GOOS == "darwin") {
+		return filepath.Join("/Library/Application Support/cryptotimed", name), nil
+	}
+	return filepath.Join("/var/lib/cryptotimed", name), nil
+}
+
+// serviceUnitDir returns where the service manager looks for definitions.
+func serviceUnitDir(platform string, user bool) (string, error) {
+	switch {
+	case platform == "linux" && user:
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dir, "systemd", "user"), nil
+	case platform == "linux":
+		return "/etc/systemd/system", nil
+	case user:
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, "Library", "LaunchAgents"), nil
+	default:
+		return "/Library/LaunchDaemons", nil
+	}
+}
+
+// systemdUnit renders the service unit.  The condition on the output keeps a
+// finished solve from being repeated at the next boot.
+func systemdUnit(plan *ServicePlan, input string) []byte {
+	quoted := make([]string, len(plan.Args))
+	for i, arg := range plan.Args {
+		quoted[i] = systemdQuote(arg)
+	}
+	target := "multi-user.target"
+	if plan.User {
+		target = "default.target"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\n")
+	fmt.Fprintf(&b, "Description=cryptotimed solve of %s\n", strings.ReplaceAll(input, "%", "%%"))
+	fmt.Fprintf(&b, "After=local-fs.target\n")
+	fmt.Fprintf(&b, "ConditionPathExists=!%s\n", strings.ReplaceAll(plan.OutputFile, "%", "%%"))
+	fmt.Fprintf(&b, "\n[Service]\n")
+	fmt.Fprintf(&b, "Type=simple\n")
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(quoted, " "))
+	fmt.Fprintf(&b, "WorkingDirectory=%s\n", strings.ReplaceAll(plan.StateDir, "%", "%%"))
+	fmt.Fprintf(&b, "Nice=19\n")
+	fmt.Fprintf(&b, "CPUSchedulingPolicy=batch\n")
+	fmt.Fprintf(&b, "IOSchedulingClass=idle\n")
+	fmt.Fprintf(&b, "Restart=on-failure\n")
+	fmt.Fprintf(&b, "RestartSec=60\n")
+	fmt.Fprintf(&b, "\n[Install]\n")
+	fmt.Fprintf(&b, "WantedBy=%s\n", target)
+	return []byte(b.String())
+}
+
+// systemdQuote quotes an ExecStart argument so that systemd passes it
+// through unchanged.
+func systemdQuote(arg string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$")
+	return `"` + r.Replace(arg) + `"`
+}
+
+// launchdPlist renders the launchd job.  It runs while the output does not
+// exist, so it starts at load and boot and stops for good once decrypted.
+func launchdPlist(plan *ServicePlan) []byte {
+	esc := func(s string) string {
+		var b strings.Builder
+		xml.EscapeText(&b, []byte(s))
+		return b.String()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	fmt.Fprintf(&b, "<!DOCTYPE plist PUBLIC \"-//Apple//DTD PLIST 1.0//EN\" \"http://www.apple.com/DTDs/PropertyList-1.0.dtd\">\n")
+	fmt.Fprintf(&b, "<plist version=\"1.0\">\n<dict>\n")
+	fmt.Fprintf(&b, "  <key>Label</key>\n  <string>%s</string>\n", esc(plan.Name))
+	fmt.Fprintf(&b, "  <key>ProgramArguments</key>\n  <array>\n")
+	for _, arg := range plan.Args {
+		fmt.Fprintf(&b, "    <string>%s</string>\n", esc(arg))
+	}
+	fmt.Fprintf(&b, "  </array>\n")
+	fmt.Fprintf(&b, "  <key>WorkingDirectory</key>\n  <string>%s</string>\n", esc(plan.StateDir))
+	fmt.Fprintf(&b, "  <key>KeepAlive</key>\n  <dict>\n")
+	fmt.Fprintf(&b, "    <key>PathState</key>\n    <dict>\n")
+	fmt.Fprintf(&b, "      <key>%s</key>\n      <false/>\n", esc(plan.OutputFile))
+	fmt.Fprintf(&b, "    </dict>\n  </dict>\n")
+	fmt.Fprintf(&b, "  <key>ThrottleInterval</key>\n  <integer>60</integer>\n")
+	fmt.Fprintf(&b, "  <key>ProcessType</key>\n  <string>Background</string>\n")
+	fmt.Fprintf(&b, "  <key>Nice</key>\n  <integer>19</integer>\n")
+	fmt.Fprintf(&b, "  <key>LowPriorityIO</key>\n  <true/>\n")
+	fmt.Fprintf(&b, "  <key>StandardOutPath</key>\n  <string>%s</string>\n", esc(plan.LogFile))
+	fmt.Fprintf(&b, "  <key>StandardErrorPath</key>\n  <string>%s</string>\n", esc(plan.LogFile))
+	fmt.Fprintf(&b, "</dict>\n</plist>\n")
+	return []byte(b.String())
+}
+
+// InstallService creates the state directory (private to its owner), writes
+// the service definition and enables and starts it with run.
+func InstallService(plan *ServicePlan, run CommandRunner) error {
+	if len(plan.Unit) == 0 {
+		return errors.New("service plan has no definition to install")
+	}
+	if err := os.MkdirAll(plan.StateDir, 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	if err := os.Chmod(plan.StateDir, 0700); err != nil {
+		return fmt.Errorf("failed to secure state directory: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(plan.UnitFile), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(plan.UnitFile), err)
+	}
+	if err := os.WriteFile(plan.UnitFile, plan.Unit, 0644); err != nil {
+		return fmt.Errorf("failed to write service definition: %v", err)
+	}
+	for _, cmd := range plan.Enable {
+		if err := run(cmd[0], cmd[1:]...); err != nil {
+			return fmt.Errorf("%s failed: %v", strings.Join(cmd, " "), err)
+		}
+	}
+	return nil
+}
+
+// UninstallService stops and disables the service and removes its
+// definition.  The state directory, which holds the checkpoint, is only
+// removed with purge.
+func UninstallService(plan *ServicePlan, run CommandRunner, purge bool) error {
+	if _, err := os.Stat(plan.UnitFile); err != nil {
+		return fmt.Errorf("service %s is not installed: %v", plan.Name, err)
+	}
+
+	var errs []error
+	for _, cmd := range plan.Disable {
+		if err := run(cmd[0], cmd[1:]...); err != nil {
+			errs = append(errs, fmt.Errorf("%s failed: %v", strings.Join(cmd, " "), err))
+		}
+	}
+	if err := os.Remove(plan.UnitFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		errs = append(errs, fmt.Errorf("failed to remove service definition: %v", err))
+	}
+	for _, cmd := range plan.Cleanup {
+		if err := run(cmd[0], cmd[1:]...); err != nil {
+			errs = append(errs, fmt.Errorf("%s failed: %v", strings.Join(cmd, " "), err))
+		}
+	}
+	if purge {
+		if err := os.RemoveAll(plan.StateDir); err != nil {
+			errs = append(errs, fmt.Errorf("failed to remove state directory: %v", err))
+		}
+	}
+	return errors.Join(errs...)
+}
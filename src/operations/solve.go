@@ -0,0 +1,270 @@
+package operations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/utils"
+)
+
+// solveResult describes how solvePuzzle (or findTarget) went
+type solveResult struct {
+	target      *big.Int
+	fromCache   bool               // target came from the target cache
+	reused      bool               // target was solved earlier in the batch
+	supplied    bool               // target was given in DecryptOptions.Target
+	resumedFrom uint64             // squarings restored from a checkpoint
+	warnings    []string           // checkpoints that were ignored or could not be written
+	proof       *crypto.SolveProof // proof of the solve, if DecryptOptions.ProofFile asked for one
+
+	// more holds the solutions of the further puzzles of a file that has
+	// them (see solveHeader), in order
+	more []*big.Int
+}
+
+// solvePuzzle solves puzzle with the solver settings of opts, resuming from
+// and saving checkpoints to opts.CheckpointPath when it is set.  The
+// checkpoint is removed once the puzzle is solved, and none is written
+// before the first squaring, so a solve stopped at once or a puzzle of no
+// work leaves no file behind.  With opts.RequireCheckpoint, a checkpoint
+// that is missing or cannot be resumed is an error.  With opts.ProofFile,
+// the proof of the solve is built as well, and a checkpoint with progress
+// is refused rather than resumed.
+func solvePuzzle(puzzle crypto.Puzzle, opts DecryptOptions, progress ProgressCallback) (*solveResult, error) {
+	result := &solveResult{}
+	solveOpts := crypto.SolveOptions{
+		Progress:         progress,
+		ProgressStrategy: opts.ProgressStrategy,
+		PinThread:        opts.PinThread,
+		GCPercent:        opts.GCPercent,
+		Control:          opts.Control,
+		Throttle:         opts.Throttle,
+	}
+
+	path := opts.CheckpointPath
+	stopCheckpoints := func() {}
+	var checkpoints *checkpointScheduler
+	if path != "" {
+		state, err := utils.LoadState(path)
+		if err == nil {
+			err = state.Matches(puzzle)
+		}
+		switch {
+		case errors.Is(err, fs.ErrNotExist) && opts.RequireCheckpoint:
+			return nil, fmt.Errorf("no checkpoint at %s to resume from", path)
+		case errors.Is(err, fs.ErrNotExist):
+		case err != nil && opts.RequireCheckpoint:
+			return nil, fmt.Errorf("cannot resume from checkpoint %s: %v", path, err)
+		case err != nil:
+			result.warnings = append(result.warnings, fmt.Sprintf("ignoring checkpoint %s and starting over: %v", path, err))
+		case opts.ProofFile != "" && state.Done > 0:
+			return nil, fmt.Errorf("%s holds %d squarings of progress, but a proof of the solve needs the puzzle solved from the start (remove the checkpoint, or decrypt without a proof)", path, state.Done)
+		default:
+			solveOpts.Resume = &state
+			result.resumedFrom = state.Done
+			if opts.OnResume != nil {
+				opts.OnResume(state.Done)
+			}
+		}
+
+		checkpoints = &checkpointScheduler{path: path, onCheckpoint: opts.OnCheckpoint, written: result.resumedFrom}
+		solveOpts.Checkpoint = checkpoints.save
+		// Checkpoints by squaring count are taken from the snapshots the
+		// solver delivers, which is also when the state is kept in memory
+		if opts.CheckpointEvery > 0 {
+			solveOpts.Snapshot = checkpoints.saveAndKeep
+			solveOpts.SnapshotInterval = opts.CheckpointEvery
+		} else if opts.MemoryCheckpointEvery > 0 {
+			solveOpts.Snapshot = checkpoints.keep
+			solveOpts.SnapshotInterval = opts.MemoryCheckpointEvery
+		}
+
+		// Periodic and flushed checkpoints are written from memory, or
+		// requested like interactive ones
+		if opts.CheckpointInterval > 0 || opts.FlushCheckpoint != nil {
+			if solveOpts.Control == nil {
+				solveOpts.Control = &crypto.SolveControl{}
+			}
+			checkpoint := solveOpts.Control.RequestCheckpoint
+			if opts.MemoryCheckpointEvery > 0 {
+				checkpoint = checkpoints.flush
+			}
+			stop := make(chan struct{})
+			stopped := make(chan struct{})
+			stopCheckpoints = func() {
+				close(stop)
+				<-stopped
+			}
+			go func() {
+				defer close(stopped)
+				var tick <-chan time.Time
+				if opts.CheckpointInterval > 0 {
+					ticker := time.NewTicker(opts.CheckpointInterval)
+					defer ticker.Stop()
+					tick = ticker.C
+				}
+				for {
+					select {
+					case <-stop:
+						return
+					case <-tick:
+						checkpoint()
+					case <-opts.FlushCheckpoint:
+						checkpoint()
+					}
+				}
+			}()
+		}
+	}
+
+	var recorder *crypto.ProofRecorder
+	if opts.ProofFile != "" {
+		recorder = crypto.NewProofRecorder(puzzle)
+		solveOpts.Proof = recorder
+	}
+
+	// A done context stops the solve like a Control stop
+	cancelled := func() bool { return false }
+	if opts.Context != nil {
+		if solveOpts.Control == nil {
+			solveOpts.Control = &crypto.SolveControl{}
+		}
+		cancelled = solveOpts.Control.StopWhenDone(opts.Context)
+	}
+
+	start := time.Now()
+	var slept time.Duration
+	if opts.Throttle != nil {
+		slept = opts.Throttle.Slept()
+	}
+	target, err := crypto.SolvePuzzleWithOptions(puzzle, solveOpts)
+	// Nothing may be written once the checkpoint is removed
+	stopCheckpoints()
+	if cancelled() && errors.Is(err, crypto.ErrSolveStopped) {
+		err = fmt.Errorf("%w: %w", err, context.Cause(opts.Context))
+	}
+	if errors.Is(err, crypto.ErrSolveStopped) && checkpoints != nil && checkpoints.saved() {
+		return nil, fmt.Errorf("%w; progress saved to %s", err, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.target = target
+
+	if !opts.NoCalibrate && CalibrateSolves {
+		elapsed := time.Since(start)
+		if solveOpts.Control != nil {
+			elapsed -= solveOpts.Control.PausedFor()
+		}
+		if opts.Throttle != nil {
+			elapsed -= opts.Throttle.Slept() - slept
+		}
+		if warning := calibrate(puzzle, puzzle.T-result.resumedFrom, elapsed); warning != "" {
+			result.warnings = append(result.warnings, warning)
+		}
+	}
+
+	if recorder != nil {
+		if result.proof, err = recorder.Prove(target); err != nil {
+			return nil, fmt.Errorf("failed to build the proof of the solve: %v", err)
+		}
+	}
+
+	if path != "" {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			result.warnings = append(result.warnings, fmt.Sprintf("failed to remove checkpoint: %v", err))
+		}
+	}
+	return result, nil
+}
+
+// checkpointScheduler writes the checkpoints of a solve to path: those the
+// solver delivers at once, and the states it keeps in memory when asked to
+// flush them.
+type checkpointScheduler struct {
+	path         string
+	onCheckpoint func(state crypto.SolvingState, err error)
+
+	mu      sync.Mutex
+	latest  *crypto.SolvingState // kept in memory, nil until the first
+	written uint64               // squarings done in the last checkpoint written
+}
+
+// save writes a checkpoint delivered by the solver.
+func (s *checkpointScheduler) save(state crypto.SolvingState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.write(state)
+}
+
+// keep holds a state delivered by the solver in memory, to be written by
+// flush.
+func (s *checkpointScheduler) keep(state crypto.SolvingState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latest = &state
+}
+
+// saveAndKeep writes a state delivered by the solver and holds it in memory
+// like keep.
+func (s *checkpointScheduler) saveAndKeep(state crypto.SolvingState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latest = &state
+	s.write(state)
+}
+
+// flush writes the state kept in memory, unless a checkpoint written since
+// has as much progress.
+func (s *checkpointScheduler) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.latest != nil && s.latest.Done > s.written {
+		s.write(*s.latest)
+	}
+}
+
+// saved reports whether the checkpoint file holds any progress, written
+// now or resumed from.
+func (s *checkpointScheduler) saved() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.written > 0
+}
+
+// write saves state to the checkpoint file; s.mu is held.  A state of no
+// squarings is not worth resuming and is dropped.
+func (s *checkpointScheduler) write(state crypto.SolvingState) {
+	if state.Done == 0 {
+		return
+	}
+	err := utils.SaveState(state, s.path)
+	if err == nil && state.Done > s.written {
+		s.written = state.Done
+	}
+	if s.onCheckpoint != nil {
+		s.onCheckpoint(state, err)
+	}
+}
+
+// CalibrateSolves is whether solves not run with NoCalibrate fold their
+// rate into the calibration profile.  Tests turn it off so that their solves
+// leave the estimates alone.
+var CalibrateSolves = true
+
+// calibrate folds the rate of a finished solve into this machine's
+// calibration profile, so later estimates follow real solves.  It returns a
+// warning if the profile could not be updated.
+func calibrate(puzzle crypto.Puzzle, squarings uint64, elapsed time.Duration) string {
+	if err := utils.RecordSolveRate(puzzle.N.BitLen(), squarings, elapsed); err != nil {
+		return fmt.Sprintf("failed to update calibration profile: %v", err)
+	}
+	return ""
+}
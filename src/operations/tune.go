@@ -0,0 +1,219 @@
+package operations
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/utils"
+)
+
+// DefaultTuneConfidence is the confidence level TuneWorkFactor uses when
+// given none.
+const DefaultTuneConfidence = 0.95
+
+// TuneOptions contains all the parameters needed to pick a work factor for
+// a target time.
+type TuneOptions struct {
+	TargetTime time.Duration
+	Confidence float64          // confidence level of the rate interval, e.g. 0.95 (DefaultTuneConfidence if zero)
+	Benchmark  BenchmarkOptions // how the rate is sampled (adaptive, 1s samples if zero)
+}
+
+// Tuning is a work factor picked for a target time from a confidence
+// interval on this machine's squaring rate: the squarings done in
+// TargetTime at Rate.Lower.
+type Tuning struct {
+	WorkFactor uint64
+	TargetTime time.Duration
+	Rate       utils.Interval   // squarings/second
+	MeanTime   time.Duration    // WorkFactor squarings at the mean rate
+	Benchmark  *BenchmarkResult // nil when tuned from given samples
+}
+
+// TuneWorkFactor benchmarks this machine and picks the work factor it
+// solves within opts.TargetTime with the requested confidence.
+func TuneWorkFactor(opts TuneOptions) (*Tuning, error) {
+	bench := opts.Benchmark
+	if bench.Duration == 0 {
+		bench.Duration = time.Second
+	}
+	if bench.TargetPrecision == 0 && bench.Samples == 0 {
+		bench.TargetPrecision = DefaultBenchmarkPrecision
+	}
+	if bench.TargetPrecision == 0 && bench.Samples < 2 {
+		return nil, errors.New("a confidence interval needs at least two benchmark samples")
+	}
+	result, err := RunBenchmark(bench)
+	if err != nil {
+		return nil, err
+	}
+	tuning, err := WorkFactorForTime(result.Samples, opts.TargetTime, opts.Confidence)
+	if err != nil {
+		return nil, err
+	}
+	tuning.Benchmark = result
+	return tuning, nil
+}
+
+// WorkFactorForTime picks the work factor for target from benchmark
+// samples.  It computes the Student t interval on the mean rate at
+// confidence (DefaultTuneConfidence if zero) and uses its lower bound: the
+// true rate is at least that with the requested confidence, so the puzzle is
+// solved within target on this machine.  At the mean rate it takes
+// Tuning.MeanTime, somewhat less.
+func WorkFactorForTime(samples []BenchmarkSample, target time.Duration, confidence float64) (*Tuning, error) {
+	if target <= 0 {
+		return nil, errors.New("target time must be positive")
+	}
+	if confidence == 0 {
+		confidence = DefaultTuneConfidence
+	}
+	rates := make([]float64, len(samples))
+	for i, s := range samples {
+		rates[i] = s.OpsPerSecond
+	}
+	interval, err := utils.MeanInterval(rates, confidence)
+	if err != nil {
+		return nil, err
+	}
+	if interval.Lower <= 0 {
+		return nil, fmt.Errorf("the rate varies too much between samples to bound it at %.0f%% confidence; take more samples", confidence*100)
+	}
+
+	work := math.Floor(target.Seconds() * interval.Lower)
+	if work < 1 {
+		work = 1
+	}
+	if work >= math.MaxUint64 {
+		return nil, errors.New("target time is too long for a work factor")
+	}
+	t := &Tuning{
+		WorkFactor: uint64(work),
+		TargetTime: target,
+		Rate:       interval,
+	}
+	t.MeanTime = utils.EstimateTime(t.WorkFactor, interval.Mean)
+	return t, nil
+}
+
+// RelativeWorkSample is the length of the reference operation count a
+// relative work factor multiplies: the squarings this machine does in one
+// sample of the adaptive benchmark.
+const RelativeWorkSample = time.Second
+
+// relativeWorkSamples is how many samples WorkFactorRelative takes.
+const relativeWorkSamples = 3
+
+// RelativeWork is a work factor picked as a multiple of the squarings this
+// machine does in RelativeWorkSample.
+type RelativeWork struct {
+	WorkFactor    uint64
+	Multiplier    float64
+	Reference     uint64        // squarings in RelativeWorkSample at the measured rate
+	Rate          float64       // squarings/second
+	EstimatedTime time.Duration // WorkFactor squarings at Rate
+}
+
+// WorkFactorRelative runs a quick benchmark and picks multiplier times the
+// squarings this machine does in RelativeWorkSample with a bits-bit modulus
+// (0 = crypto.DefaultModulusBits).
+func WorkFactorRelative(multiplier float64, bits int) (*RelativeWork, error) {
+	if !(multiplier > 0) {
+		return nil, errors.New("work multiplier must be positive")
+	}
+	result, err := RunBenchmark(BenchmarkOptions{
+		Duration:    RelativeWorkSample,
+		Samples:     relativeWorkSamples,
+		ModulusBits: bits,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return WorkFactorForMultiplier(result, multiplier)
+}
+
+// WorkFactorForMultiplier picks multiplier times the reference operation
+// count of a benchmark: its mean rate over RelativeWorkSample.
+func WorkFactorForMultiplier(bench *BenchmarkResult, multiplier float64) (*RelativeWork, error) {
+	if !(multiplier > 0) || math.IsInf(multiplier, 1) {
+		return nil, errors.New("work multiplier must be positive")
+	}
+	if !(bench.AvgOpsPerSecond > 0) {
+		return nil, errors.New("the benchmark measured no squarings")
+	}
+	reference := math.Floor(bench.AvgOpsPerSecond * RelativeWorkSample.Seconds())
+	work := math.Round(reference * multiplier)
+	if work < 1 {
+		work = 1
+	}
+	if work >= math.MaxUint64 {
+		return nil, errors.New("work multiplier is too large for a work factor")
+	}
+	r := &RelativeWork{
+		WorkFactor: uint64(work),
+		Multiplier: multiplier,
+		Reference:  uint64(reference),
+		Rate:       bench.AvgOpsPerSecond,
+	}
+	r.EstimatedTime = utils.EstimateTime(r.WorkFactor, r.Rate)
+	return r, nil
+}
+
+// targetDurationSamples and targetDurationSample shape the quick benchmark
+// of WorkFactorForDuration: about a second, enough samples for a
+// confidence interval.
+const (
+	targetDurationSamples = 5
+	targetDurationSample  = 200 * time.Millisecond
+)
+
+// WorkFactorForDuration picks the work factor this machine solves within
+// target for a bits-bit modulus (0 = crypto.DefaultModulusBits) without
+// a long benchmark: at its calibrated rate for that size, when solves here
+// have measured one, or else at the lower end of the rate interval of a
+// benchmark of about a second.  The Tuning's Benchmark is nil when the
+// calibrated rate was used.
+func WorkFactorForDuration(target time.Duration, bits int) (*Tuning, error) {
+	if target <= 0 {
+		return nil, errors.New("target duration must be positive")
+	}
+	if bits == 0 {
+		bits = crypto.DefaultModulusBits
+	}
+	if e := utils.CalibratedRate(bits); e != nil && e.Rate > 0 {
+		return workFactorAtRate(target, e)
+	}
+	return TuneWorkFactor(TuneOptions{
+		TargetTime: target,
+		Benchmark: BenchmarkOptions{
+			Duration:    targetDurationSample,
+			Samples:     targetDurationSamples,
+			ModulusBits: bits,
+		},
+	})
+}
+
+// tuneEncrypt picks opts.WorkFactor from opts.TargetDuration, when that is
+// set (see WorkFactorForDuration), and records the rate it was picked at
+// unless a rate is already given.  It returns how the work factor was
+// picked (nil if it was given).
+func tuneEncrypt(opts *EncryptOptions) (*Tuning, error) {
+	switch {
+	case opts.TargetDuration == 0:
+		return nil, nil
+	case opts.WorkFactor != 0:
+		return nil, errors.New("a work factor and a target duration cannot both be given")
+	}
+	tuning, err := WorkFactorForDuration(opts.TargetDuration, opts.ModulusBits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pick the work factor: %v", err)
+	}
+	opts.WorkFactor = tuning.WorkFactor
+	if opts.OpsPerSecond == 0 {
+		opts.OpsPerSecond = tuning.Rate.Lower
+	}
+	return tuning, nil
+}
@@ -0,0 +1,176 @@
+package operations
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// UpgradeOptions contains the parameters of UpgradeFile
+type UpgradeOptions struct {
+	// DecryptOptions names the file to upgrade, a file of the OS
+	// filesystem, and holds the passphrase and the solver options (cache,
+	// checkpoint, control) used when the upgrade needs the puzzle solved.
+	// The output options are ignored: the file is replaced.
+	DecryptOptions
+
+	// DryRun reports what the upgrade would change without solving the
+	// puzzle or writing anything.
+	DryRun bool
+}
+
+// UpgradeResult describes the upgrade of one file
+type UpgradeResult struct {
+	InputFile     string
+	FromVersion   uint32
+	ToVersion     uint32
+	Changes       []string // what the upgrade changes, one item each
+	Current       bool     // the file is already in the current layout; nothing was done
+	NeedsSolve    bool     // the payload is sealed anew under a key derived from the solved puzzle
+	Upgraded      bool     // the file was replaced (false for a dry run)
+	EncryptedSize int      // size of the upgraded file
+	FromCache     bool     // the puzzle solution came from the target cache
+	ResumedFrom   uint64   // squarings restored from a checkpoint
+	Warnings      []string // non-fatal problems, e.g. an ignored checkpoint
+}
+
+// UpgradeFile rewrites an encrypted file of a format older than version 3
+// in the current format, replacing it only once the new file is complete.
+// Later versions keep the version 3 layout and only add extensions, so
+// their files are reported as current and left alone.
+//
+// The file keeps its puzzle: the same modulus, base, salt and work factor,
+// so the same passphrase opens it and a solve already under way carries
+// over.  Only the version fields and extension block are rewritten, which
+// needs no solve, unless the file derives its key with the legacy SHA-256
+// derivation of version 1: the puzzle is then solved, or its solution taken
+// from the target cache (opts.CacheTarget), and the payload sealed anew
+// under the key crypto.CurrentKeyDerivation derives from it.
+func UpgradeFile(opts UpgradeOptions, progressCallback ProgressCallback) (*UpgradeResult, error) {
+	if utils.IsURL(opts.InputFile) || !utils.IsOS(opts.FS) {
+		return nil, fmt.Errorf("only files of the OS filesystem can be upgraded")
+	}
+	if err := checkNoInPlaceJournal(opts.InputFile); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(opts.InputFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encrypted file: %v", err)
+	}
+	ef, err := utils.ReadEncryptedFile(opts.InputFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encrypted file: %v", err)
+	}
+
+	old := ef.Header()
+	header, result, err := planUpgrade(old)
+	if err != nil {
+		return nil, err
+	}
+	result.InputFile = opts.InputFile
+	if result.Current || opts.DryRun {
+		return result, nil
+	}
+
+	data := ef.Data
+	if result.NeedsSolve {
+		puzzle, err := headerPuzzle(old, opts.KeyInput)
+		if err != nil {
+			return nil, err
+		}
+		solve, err := findTarget(puzzle, opts.DecryptOptions, progressCallback, nil)
+		if err != nil {
+			return nil, err
+		}
+		result.FromCache, result.ResumedFrom, result.Warnings = solve.fromCache, solve.resumedFrom, solve.warnings
+
+		oldKey, err := derivePuzzleKey(old, puzzle.N, solve.target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive decryption key: %v", err)
+		}
+		var plaintext bytes.Buffer
+		if _, err := decryptTo(ef, oldKey, &plaintext); err != nil {
+			return nil, decryptError(err, puzzle, solve)
+		}
+		newKey, err := derivePuzzleKey(header, puzzle.N, solve.target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive encryption key: %v", err)
+		}
+		if data, err = resealPayload(header, newKey, plaintext.Bytes()); err != nil {
+			return nil, fmt.Errorf("failed to encrypt data: %v", err)
+		}
+	}
+
+	upgraded := types.NewEncryptedFile(header, data)
+	encoded, err := utils.EncodeEncryptedFile(upgraded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode upgraded file: %v", err)
+	}
+	err = utils.OS.(utils.StreamFS).WriteFileFrom(opts.InputFile, info.Mode().Perm(), func(w io.Writer) error {
+		_, err := w.Write(encoded)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to write upgraded file: %v", err)
+	}
+	result.Upgraded = true
+	result.EncryptedSize = len(encoded)
+	return result, nil
+}
+
+// planUpgrade returns the header old is upgraded to and what changes,
+// without solving anything.
+func planUpgrade(old *types.FileHeader) (*types.FileHeader, *UpgradeResult, error) {
+	result := &UpgradeResult{FromVersion: old.Version, ToVersion: old.Version}
+	legacyKey := old.Ext.KeyDerivation == crypto.KeyDerivationLegacy
+	if old.Version >= types.VersionMinReader && !legacyKey {
+		result.Current = true
+		return old, result, nil
+	}
+	if old.Version > types.CurrentVersion {
+		return nil, nil, fmt.Errorf("unsupported file: format version %d is newer than this version", old.Version)
+	}
+
+	header := *old
+	header.Version = types.CurrentVersion
+	result.ToVersion = header.Version
+	result.Changes = append(result.Changes, fmt.Sprintf("format version %d -> %d", old.Version, header.Version))
+	if old.Version < 2 {
+		result.Changes = append(result.Changes, "adds an extension block")
+	}
+
+	if legacyKey {
+		switch {
+		case old.Ext.Container != nil:
+			return nil, nil, fmt.Errorf("a container with the legacy key derivation cannot be upgraded; decrypt it and encrypt it again")
+		case old.Ext.Shared != nil || old.Ext.Bundle != nil || old.Ext.KeySlots != nil:
+			return nil, nil, fmt.Errorf("unsupported file: legacy key derivation combined with a later layout")
+		}
+		header.Ext.KeyDerivation = crypto.CurrentKeyDerivation
+		result.NeedsSolve = true
+		result.Changes = append(result.Changes, fmt.Sprintf("key derivation %s -> %s (the payload is sealed anew)",
+			crypto.KeyDerivationName(old.Ext.KeyDerivation), crypto.KeyDerivationName(header.Ext.KeyDerivation)))
+	}
+
+	header.MinReaderVersion = header.RequiredReaderVersion()
+	result.Changes = append(result.Changes, fmt.Sprintf("records minimum reader version %d", header.MinReaderVersion))
+	return &header, result, nil
+}
+
+// resealPayload seals plaintext under key in the layout header describes:
+// chunked or in one piece.
+func resealPayload(header *types.FileHeader, key [32]byte, plaintext []byte) ([]byte, error) {
+	if header.Ext.ChunkSize == 0 {
+		return crypto.Seal(header.Ext.Cipher, key, plaintext, nil)
+	}
+	chunkSize := int(header.Ext.ChunkSize)
+	var buf bytes.Buffer
+	buf.Grow(int(crypto.StreamCiphertextSize(int64(len(plaintext)), chunkSize)))
+	err := crypto.EncryptStreamWithOptions(key, bytes.NewReader(plaintext), &buf, crypto.StreamOptions{ChunkSize: chunkSize})
+	return buf.Bytes(), err
+}
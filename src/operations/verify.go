@@ -0,0 +1,119 @@
+package operations
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// DefaultVerifySolveLimit is the largest work factor EncryptOptions.Verify
+// solves by default (some seconds of work) to check that a file decrypts.
+const DefaultVerifySolveLimit uint64 = 10_000_000
+
+// VerifyLevel is how thoroughly an encrypted file was checked after it was
+// written (EncryptOptions.Verify).
+type VerifyLevel int
+
+const (
+	// VerifyNone: the file was not checked.
+	VerifyNone VerifyLevel = iota
+
+	// VerifyReadBack: the file was read back and parsed, and its header and
+	// data section are byte for byte the ones written.
+	VerifyReadBack
+
+	// VerifyDecrypted: besides, its puzzle was solved from the header read
+	// back and its data decrypted to the original plaintext.
+	VerifyDecrypted
+)
+
+// String describes the level for the user.
+func (l VerifyLevel) String() string {
+	switch l {
+	case VerifyReadBack:
+		return "read back (header and data section match what was written)"
+	case VerifyDecrypted:
+		return "solved and decrypted (the plaintext matches the input)"
+	default:
+		return "not verified"
+	}
+}
+
+// lockedData identifies the data section of an encrypted file as written:
+// its size and SHA-256.
+type lockedData struct {
+	size int64
+	hash [32]byte
+}
+
+// verifyLocked reads back the encrypted file just written with header and
+// data and checks it as EncryptOptions.Verify describes, recording the
+// outcome in result.  plaintextHash is the SHA-256 of what decrypting the
+// file must give, or nil where that cannot be compared with a single hash
+// (containers).  A file of its own is memory-mapped and decrypted chunk by
+// chunk, so verifying a chunked file takes no memory for its contents.
+func verifyLocked(opts EncryptOptions, header *types.FileHeader, data lockedData, result *EncryptResult, plaintextHash *[32]byte) error {
+	// Make sure the bytes come from the device, not from the page cache
+	if opts.AppendTo != "" || utils.IsOS(opts.OutputFS) {
+		result.VerifiedFromDisk = utils.DropFileCache(result.OutputFile) == nil
+	}
+	if opts.AppendTo != "" {
+		rec, err := utils.ReadLogRecord(opts.AppendTo, result.LogRecord)
+		if err != nil {
+			return fmt.Errorf("failed to read back encrypted file: %v", err)
+		}
+		return verifyWritten(opts, header, data, rec.Data, result, plaintextHash)
+	}
+	m, err := utils.OpenMappedFS(utils.WritableOrOS(opts.OutputFS), result.OutputFile)
+	if err != nil {
+		return fmt.Errorf("failed to read back encrypted file: %v", err)
+	}
+	defer m.Close()
+	return m.Access(func(written []byte) error {
+		return verifyWritten(opts, header, data, written, result, plaintextHash)
+	})
+}
+
+// verifyWritten checks the bytes written read back for verifyLocked.
+func verifyWritten(opts EncryptOptions, header *types.FileHeader, data lockedData, written []byte, result *EncryptResult, plaintextHash *[32]byte) error {
+	// The header and the data section must be exactly what was written
+	headerSize := header.Size()
+	if len(written) < headerSize || sha256.Sum256(written[:headerSize]) != header.Fingerprint() {
+		return fmt.Errorf("verification failed: the header read back from %s differs from the one written", result.OutputFile)
+	}
+	readBack, err := utils.ParseEncryptedFile(written)
+	if err != nil {
+		return fmt.Errorf("verification failed: %s does not parse: %v", result.OutputFile, err)
+	}
+	if int64(len(readBack.Data)) != data.size || sha256.Sum256(readBack.Data) != data.hash {
+		return fmt.Errorf("verification failed: the data section read back from %s differs from the one written", result.OutputFile)
+	}
+	result.Verified = VerifyReadBack
+
+	switch {
+	case plaintextHash == nil:
+		result.VerifySkipped = "the contents of a container are not compared"
+		return nil
+	case opts.VerifySolveLimit == 0 || header.TotalWork() > opts.VerifySolveLimit:
+		result.VerifySkipped = fmt.Sprintf("the work factor is above the limit of %d squarings for solving", opts.VerifySolveLimit)
+		return nil
+	}
+
+	// Solve the puzzle read back, as a later decrypt would
+	key, _, err := payloadKey(readBack.Header(), DecryptOptions{KeyInput: opts.KeyInput}, opts.VerifyProgress)
+	if err != nil {
+		return fmt.Errorf("verification failed: %v", err)
+	}
+	hash := sha256.New()
+	if _, err := decryptTo(readBack, key, hash); err != nil {
+		return fmt.Errorf("verification failed: %s does not decrypt: %v", result.OutputFile, err)
+	}
+	if !bytes.Equal(hash.Sum(nil), plaintextHash[:]) {
+		return fmt.Errorf("verification failed: %s decrypts to something other than the input", result.OutputFile)
+	}
+	result.Verified = VerifyDecrypted
+	return nil
+}
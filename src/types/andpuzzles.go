@@ -0,0 +1,90 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// AndPuzzleSize is the encoded size of one AndPuzzle with a 2048-bit
+// modulus.
+const AndPuzzleSize = 8 + 2*FixedModulusBytes
+
+// MaxAndPuzzles bounds the number of puzzles a file may require, its own
+// included.
+const MaxAndPuzzles = 64
+
+// AndPuzzle is one of the further puzzles of a file (see AndPuzzles).
+type AndPuzzle struct {
+	WorkFactor uint64 // t (number of squarings)
+	ModulusN   []byte // RSA modulus N (big-endian, as wide as the file's)
+	BaseG      []byte // base g (always random)
+}
+
+// AndPuzzles lists the puzzles of a file beyond the one in its fixed header
+// fields, all of which must be solved: the puzzle key combines the keys of
+// every puzzle (see crypto.CombinePuzzleKeys), so their work adds up while
+// each can be solved on a machine of its own.  Only the first puzzle's base
+// is derived from the passphrase of a file that requires one.
+type AndPuzzles struct {
+	Puzzles []AndPuzzle
+}
+
+// encode encodes the puzzles as one record per puzzle: the work factor
+// (little-endian), N and G, both as wide as the modulus of the file.
+func (a *AndPuzzles) encode() []byte {
+	var buf []byte
+	for _, p := range a.Puzzles {
+		buf = binary.LittleEndian.AppendUint64(buf, p.WorkFactor)
+		buf = append(buf, p.ModulusN[:]...)
+		buf = append(buf, p.BaseG[:]...)
+	}
+	return buf
+}
+
+// decode decodes puzzles produced by encode, of moduli of width bytes.
+func (a *AndPuzzles) decode(data []byte, width int) error {
+	*a = AndPuzzles{}
+	size := 8 + 2*width
+	if len(data) == 0 {
+		return errors.New("empty and-puzzles extension")
+	}
+	if len(data)%size != 0 {
+		return fmt.Errorf("invalid and-puzzles extension length %d for %d-byte moduli", len(data), width)
+	}
+	if n := len(data) / size; n+1 > MaxAndPuzzles {
+		return fmt.Errorf("invalid and-puzzles extension: %d puzzles, at most %d", n+1, MaxAndPuzzles)
+	}
+	for ; len(data) > 0; data = data[size:] {
+		p := AndPuzzle{
+			WorkFactor: binary.LittleEndian.Uint64(data),
+			ModulusN:   append([]byte{}, data[8:8+width]...),
+			BaseG:      append([]byte{}, data[8+width:size]...),
+		}
+		if p.WorkFactor == 0 {
+			return errors.New("invalid and-puzzles extension: a puzzle of no work")
+		}
+		a.Puzzles = append(a.Puzzles, p)
+	}
+	return nil
+}
+
+// PuzzleCount returns the number of puzzles that must be solved to decrypt
+// the file with header h.
+func (h *FileHeader) PuzzleCount() int {
+	if h.Ext.AndPuzzles == nil {
+		return 1
+	}
+	return 1 + len(h.Ext.AndPuzzles.Puzzles)
+}
+
+// TotalWork returns the squarings of every puzzle of h together.
+func (h *FileHeader) TotalWork() uint64 {
+	total := h.WorkFactor
+	if h.Ext.AndPuzzles != nil {
+		for _, p := range h.Ext.AndPuzzles.Puzzles {
+			total += p.WorkFactor
+		}
+	}
+	return total
+}
@@ -0,0 +1,88 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// BundleMember describes one encrypted file stored whole in a bundle.
+type BundleMember struct {
+	Name   string // file name of the member as it was bundled (no directories)
+	Length uint64 // length of the member file within the data section
+}
+
+// BundleManifest lists the members of a bundle: files sharing one puzzle,
+// stored back to back in the data section in manifest order.  The manifest is
+// not authenticated, but every member is (its data key is bound to its own
+// header), so tampering can at worst rename or drop members.
+type BundleManifest struct {
+	Members []BundleMember
+}
+
+// encode encodes the manifest as a uint32 count followed by one
+// little-endian record per member:
+//
+//	name length (2) || name || length (8)
+func (b *BundleManifest) encode() []byte {
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(len(b.Members)))
+	for _, m := range b.Members {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(m.Name)))
+		buf = append(buf, m.Name...)
+		buf = binary.LittleEndian.AppendUint64(buf, m.Length)
+	}
+	return buf
+}
+
+// decode decodes a manifest produced by encode and rejects member names that
+// are not plain file names.
+func (b *BundleManifest) decode(data []byte) error {
+	*b = BundleManifest{}
+	if len(data) < 4 {
+		return errors.New("truncated bundle manifest")
+	}
+	count := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+
+	const fixedSize = 2 + 8
+	if uint64(count)*fixedSize > uint64(len(data)) {
+		return fmt.Errorf("bundle manifest too short for %d members", count)
+	}
+
+	b.Members = make([]BundleMember, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(data) < 2 {
+			return errors.New("truncated bundle member")
+		}
+		nameLen := int(binary.LittleEndian.Uint16(data))
+		data = data[2:]
+		if len(data) < nameLen+8 {
+			return errors.New("truncated bundle member")
+		}
+		m := BundleMember{Name: string(data[:nameLen])}
+		m.Length = binary.LittleEndian.Uint64(data[nameLen:])
+		data = data[nameLen+8:]
+
+		if err := ValidateMemberName(m.Name); err != nil {
+			return err
+		}
+		b.Members = append(b.Members, m)
+	}
+	if len(data) != 0 {
+		return errors.New("trailing bytes after bundle manifest")
+	}
+	return nil
+}
+
+// ValidateMemberName checks that name is a plain file name, so that a
+// member can only ever be extracted into the bundle's output directory.
+func ValidateMemberName(name string) error {
+	if err := ValidateEntryName(name); err != nil {
+		return fmt.Errorf("invalid bundle member name: %v", err)
+	}
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("invalid bundle member name %q: must not contain directories", name)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// ContainerEntry describes one file or directory stored in a container.
+// Offset and Length locate the entry's sealed bytes within the data section.
+type ContainerEntry struct {
+	Name    string // slash-separated path relative to the container root
+	Mode    uint32 // fs.FileMode bits (type and permissions)
+	Size    uint64 // plaintext size in bytes (0 for directories)
+	ModTime int64  // modification time, Unix nanoseconds
+	Offset  uint64 // offset of the sealed entry within the data section
+	Length  uint64 // length of the sealed entry (0 for directories)
+}
+
+// IsDir reports whether the entry is a directory.
+func (e *ContainerEntry) IsDir() bool {
+	return fs.FileMode(e.Mode).IsDir()
+}
+
+// ContainerTable is the entry table of a container file.  When Private is
+// set the table is sealed at the start of the data section (TableLength
+// bytes) and Entries is empty until the puzzle has been solved; otherwise
+// the entries are stored in the header extension block, readable without
+// solving and authenticated as associated data of every sealed entry.
+//
+// When Dedup is set, files with identical contents are stored once: their
+// entries have the same Offset and Length, and the blob there is sealed
+// under the key of the first entry that refers to it (see BlobOwners).
+type ContainerTable struct {
+	Private     bool
+	Dedup       bool
+	TableLength uint64 // length of the sealed table in the data section (Private only)
+	Entries     []ContainerEntry
+}
+
+// Container flags
+const (
+	containerFlagPrivate = 0x01 // the entry table is encrypted
+	containerFlagDedup   = 0x02 // entries may share a sealed blob
+)
+
+// maxEntryNameLength bounds entry names; it matches the uint16 length prefix.
+const maxEntryNameLength = 1<<16 - 1
+
+// encode encodes the header-extension form of the table: a flags byte
+// followed by either the sealed table length (private) or the entries.
+func (t *ContainerTable) encode() []byte {
+	var flags byte
+	if t.Dedup {
+		flags |= containerFlagDedup
+	}
+	if t.Private {
+		buf := []byte{flags | containerFlagPrivate}
+		return binary.LittleEndian.AppendUint64(buf, t.TableLength)
+	}
+	return append([]byte{flags}, EncodeEntries(t.Entries)...)
+}
+
+// decode decodes the header-extension form produced by encode.
+func (t *ContainerTable) decode(data []byte) error {
+	*t = ContainerTable{}
+	if len(data) < 1 {
+		return errors.New("empty container extension")
+	}
+	flags, data := data[0], data[1:]
+	t.Dedup = flags&containerFlagDedup != 0
+	if flags&containerFlagPrivate != 0 {
+		if len(data) != 8 {
+			return fmt.Errorf("invalid private container extension length %d", len(data))
+		}
+		t.Private = true
+		t.TableLength = binary.LittleEndian.Uint64(data)
+		return nil
+	}
+	entries, err := DecodeEntries(data)
+	if err != nil {
+		return err
+	}
+	t.Entries = entries
+	return nil
+}
+
+// EncodeEntries encodes an entry list as a uint32 count followed by one
+// little-endian record per entry:
+//
+//	name length (2) || name || mode (4) || size (8) || mtime (8) || offset (8) || length (8)
+func EncodeEntries(entries []ContainerEntry) []byte {
+	buf := binary.LittleEndian.AppendUint32(nil, uint32(len(entries)))
+	for _, e := range entries {
+		buf = binary.LittleEndian.AppendUint16(buf, uint16(len(e.Name)))
+		buf = append(buf, e.Name...)
+		buf = binary.LittleEndian.AppendUint32(buf, e.Mode)
+		buf = binary.LittleEndian.AppendUint64(buf, e.Size)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(e.ModTime))
+		buf = binary.LittleEndian.AppendUint64(buf, e.Offset)
+		buf = binary.LittleEndian.AppendUint64(buf, e.Length)
+	}
+	return buf
+}
+
+// DecodeEntries decodes an entry list produced by EncodeEntries and rejects
+// names that could escape the extraction directory.
+func DecodeEntries(data []byte) ([]ContainerEntry, error) {
+	if len(data) < 4 {
+		return nil, errors.New("truncated container entry table")
+	}
+	count := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+
+	const fixedSize = 2 + 4 + 8 + 8 + 8 + 8
+	if uint64(count)*fixedSize > uint64(len(data)) {
+		return nil, fmt.Errorf("container entry table too short for %d entries", count)
+	}
+
+	entries := make([]ContainerEntry, 0, count)
+	for i := uint32(0); i < count; i++ {
+		if len(data) < 2 {
+			return nil, errors.New("truncated container entry")
+		}
+		nameLen := int(binary.LittleEndian.Uint16(data))
+		data = data[2:]
+		if len(data) < nameLen+fixedSize-2 {
+			return nil, errors.New("truncated container entry")
+		}
+		e := ContainerEntry{Name: string(data[:nameLen])}
+		data = data[nameLen:]
+		e.Mode = binary.LittleEndian.Uint32(data)
+		e.Size = binary.LittleEndian.Uint64(data[4:])
+		e.ModTime = int64(binary.LittleEndian.Uint64(data[12:]))
+		e.Offset = binary.LittleEndian.Uint64(data[20:])
+		e.Length = binary.LittleEndian.Uint64(data[28:])
+		data = data[36:]
+
+		if err := ValidateEntryName(e.Name); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	if len(data) != 0 {
+		return nil, errors.New("trailing bytes after container entry table")
+	}
+	return entries, nil
+}
+
+// BlobOwners returns, for each entry of a table with the given Dedup flag,
+// the index of the entry whose key seals its contents: the first file entry
+// at the same offset when dedup is set, and the entry itself otherwise.
+// Directories own nothing and map to themselves.
+func BlobOwners(entries []ContainerEntry, dedup bool) []int {
+	owners := make([]int, len(entries))
+	first := make(map[uint64]int)
+	for i, e := range entries {
+		owners[i] = i
+		if !dedup || e.IsDir() {
+			continue
+		}
+		if j, ok := first[e.Offset]; ok {
+			owners[i] = j
+		} else {
+			first[e.Offset] = i
+		}
+	}
+	return owners
+}
+
+// ValidateEntryName checks that name is a clean, relative, slash-separated
+// path that stays inside the container root.
+func ValidateEntryName(name string) error {
+	if name == "" || len(name) > maxEntryNameLength {
+		return fmt.Errorf("invalid container entry name length %d", len(name))
+	}
+	if strings.Contains(name, "\\") || strings.HasPrefix(name, "/") || path.Clean(name) != name ||
+		name == ".." || strings.HasPrefix(name, "../") || name == "." {
+		return fmt.Errorf("unsafe container entry name %q", name)
+	}
+	return nil
+}
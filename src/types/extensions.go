@@ -0,0 +1,349 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Header extension tags.  Each extension is stored as a record of
+// tag (1 byte) + length (4 bytes, little-endian) + value.  Readers skip tags
+// they do not recognise, so new optional fields can be added without a new
+// format version.
+const (
+	ExtKeyDerivation uint8 = 0x01 // key-derivation version (1 byte)
+	ExtEncryptorRate uint8 = 0x02 // encryptor's squarings/second (float64, 8 bytes)
+	ExtContainer     uint8 = 0x03 // container entry table (see ContainerTable)
+	ExtChunkSize     uint8 = 0x04 // chunk size of a chunked data section (uint32)
+	ExtSharedPuzzle  uint8 = 0x05 // shared puzzle group membership (see SharedPuzzle)
+	ExtPayloadType   uint8 = 0x06 // what the data section holds (1 byte, see PayloadDocument)
+	ExtBundle        uint8 = 0x07 // bundle member manifest (see BundleManifest)
+	ExtKeySlots      uint8 = 0x08 // per-passphrase data keys (see KeySlots)
+	ExtPadding       uint8 = 0x09 // random filler bringing the header to a fixed size (see PadTo)
+	ExtCipher        uint8 = 0x0A // cipher the data section is sealed with (1 byte)
+	ExtKDFParams     uint8 = 0x0B // parameters of the key derivation (see KDFParams)
+	ExtBaseTweak     uint8 = 0x0C // file ID mixed into the password base (see BaseTweak)
+	ExtAndPuzzles    uint8 = 0x0D // further puzzles that must all be solved (see AndPuzzles)
+)
+
+// Payload types.  The data section of a document is the encrypted input
+// itself; that of a data key is an externally supplied 32-byte key, sealed
+// like a document, that the user's payload is encrypted under elsewhere.
+const (
+	PayloadDocument uint8 = 0 // a file or container (not written)
+	PayloadDataKey  uint8 = 1 // a wrapped 32-byte data key
+)
+
+// MaxExtensionSize bounds the extension block so a corrupted length field
+// cannot trigger a huge allocation.
+const MaxExtensionSize = 16 << 20
+
+// HeaderExtensions holds the optional header fields introduced in format
+// version 2.  The zero value of each field means "absent" and is not written.
+type HeaderExtensions struct {
+	KeyDerivation uint8           // puzzle-key derivation version (0 = legacy SHA-256)
+	EncryptorRate float64         // encryptor's benchmarked squarings/second (0 = unknown)
+	Container     *ContainerTable // entry table for multi-file containers (nil = single file)
+	ChunkSize     uint32          // plaintext bytes per chunk of a chunked data section (0 = sealed in one piece)
+	Shared        *SharedPuzzle   // group sharing this file's puzzle (nil = puzzle of its own)
+	PayloadType   uint8           // what the data section holds (PayloadDocument or PayloadDataKey)
+	Bundle        *BundleManifest // members of a bundle of files sharing this puzzle (nil = not a bundle)
+	KeySlots      *KeySlots       // one data key per passphrase (nil = data sealed under the puzzle key)
+	Padding       *HeaderPadding  // random filler bringing the header to a fixed size (nil = none)
+	Cipher        uint8           // cipher the data section is sealed with (0 = ChaCha20-Poly1305)
+	KDFParams     *KDFParams      // parameters of the key derivation (nil = none)
+	BaseTweak     *BaseTweak      // file ID the password base is derived with (nil = none)
+	AndPuzzles    *AndPuzzles     // further puzzles that must all be solved (nil = one puzzle)
+}
+
+// SharedPuzzleSize is the encoded size of a SharedPuzzle extension.
+const SharedPuzzleSize = 16 + 4 + 4
+
+// SharedPuzzle marks a file as one of a group encrypted under the same
+// puzzle, so that solving any one of them unlocks them all.  Each member's
+// data is sealed under a subkey of the puzzle key bound to its own header.
+type SharedPuzzle struct {
+	Group [16]byte // random identifier common to the group
+	Index uint32   // position of this file in the group (from 0)
+	Count uint32   // number of files in the group
+}
+
+// encode encodes the group as Group, Index and Count (little-endian).
+func (s *SharedPuzzle) encode() []byte {
+	buf := append(make([]byte, 0, SharedPuzzleSize), s.Group[:]...)
+	buf = binary.LittleEndian.AppendUint32(buf, s.Index)
+	return binary.LittleEndian.AppendUint32(buf, s.Count)
+}
+
+// BaseTweakSize is the encoded size of a BaseTweak extension.
+const BaseTweakSize = 16
+
+// BaseTweak records the random file ID that, together with the work
+// factor, is mixed into the derivation of a password base, so that the same
+// passphrase gives unrelated bases in different files.
+type BaseTweak struct {
+	FileID [BaseTweakSize]byte
+}
+
+// HeaderPadding is random filler that brings a header to a fixed size (see
+// FileHeader.PadTo).  Its bytes mean nothing; they are kept so that a header
+// read back encodes, and fingerprints, as it was written.
+type HeaderPadding struct {
+	Filler []byte
+}
+
+// KDFParams holds the parameters of a key derivation that takes some, as
+// encoded by the derivation itself; the format does not interpret them.
+type KDFParams struct {
+	Encoded []byte
+}
+
+// Bytes returns the encoded parameters, nil if p is nil.
+func (p *KDFParams) Bytes() []byte {
+	if p == nil {
+		return nil
+	}
+	return p.Encoded
+}
+
+// extRecord is a single encoded tag/value pair.
+type extRecord struct {
+	tag   uint8
+	value []byte
+}
+
+// records returns the non-empty extensions in tag order, padding last.
+func (e *HeaderExtensions) records() []extRecord {
+	var recs []extRecord
+	if e.KeyDerivation != 0 {
+		recs = append(recs, extRecord{ExtKeyDerivation, []byte{e.KeyDerivation}})
+	}
+	if e.EncryptorRate != 0 {
+		recs = append(recs, extRecord{ExtEncryptorRate,
+			binary.LittleEndian.AppendUint64(nil, math.Float64bits(e.EncryptorRate))})
+	}
+	if e.Container != nil {
+		recs = append(recs, extRecord{ExtContainer, e.Container.encode()})
+	}
+	if e.ChunkSize != 0 {
+		recs = append(recs, extRecord{ExtChunkSize, binary.LittleEndian.AppendUint32(nil, e.ChunkSize)})
+	}
+	if e.Shared != nil {
+		recs = append(recs, extRecord{ExtSharedPuzzle, e.Shared.encode()})
+	}
+	if e.PayloadType != PayloadDocument {
+		recs = append(recs, extRecord{ExtPayloadType, []byte{e.PayloadType}})
+	}
+	if e.Bundle != nil {
+		recs = append(recs, extRecord{ExtBundle, e.Bundle.encode()})
+	}
+	if e.KeySlots != nil {
+		recs = append(recs, extRecord{ExtKeySlots, e.KeySlots.encode()})
+	}
+	if e.Cipher != 0 {
+		recs = append(recs, extRecord{ExtCipher, []byte{e.Cipher}})
+	}
+	if e.KDFParams != nil {
+		recs = append(recs, extRecord{ExtKDFParams, e.KDFParams.Encoded})
+	}
+	if e.BaseTweak != nil {
+		recs = append(recs, extRecord{ExtBaseTweak, append([]byte{}, e.BaseTweak.FileID[:]...)})
+	}
+	if e.AndPuzzles != nil {
+		recs = append(recs, extRecord{ExtAndPuzzles, e.AndPuzzles.encode()})
+	}
+	if e.Padding != nil {
+		recs = append(recs, extRecord{ExtPadding, e.Padding.Filler})
+	}
+	return recs
+}
+
+// encodedLen returns the length of Encode's output.
+func (e *HeaderExtensions) encodedLen() int {
+	n := 0
+	for _, rec := range e.records() {
+		n += 1 + 4 + len(rec.value)
+	}
+	return n
+}
+
+// Encode encodes the extensions as a sequence of tag/length/value
+// records.
+func (e *HeaderExtensions) Encode() []byte {
+	buf := make([]byte, 0, e.encodedLen())
+	for _, rec := range e.records() {
+		buf = append(buf, rec.tag)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(rec.value)))
+		buf = append(buf, rec.value...)
+	}
+	return buf
+}
+
+// extFixedSize is the value length of the extensions that have one.
+var extFixedSize = map[uint8]int{
+	ExtKeyDerivation: 1,
+	ExtEncryptorRate: 8,
+	ExtChunkSize:     4,
+	ExtSharedPuzzle:  SharedPuzzleSize,
+	ExtPayloadType:   1,
+	ExtCipher:        1,
+	ExtBaseTweak:     BaseTweakSize,
+}
+
+// Decode decodes an extension block produced by Encode for a header with a
+// 2048-bit modulus (see FileHeader.DecodeExtensions).  Unknown tags are
+// skipped.  Errors are *ParseError, with offsets from the start of data.
+func (e *HeaderExtensions) Decode(data []byte) error {
+	return e.decode(data, FixedModulusBytes)
+}
+
+// decode is Decode for a header whose modulus is width bytes wide.
+func (e *HeaderExtensions) decode(data []byte, width int) error {
+	*e = HeaderExtensions{}
+	for off := 0; off < len(data); {
+		if len(data)-off < 5 {
+			return &ParseError{Field: "extension record", Offset: int64(off), Length: 5,
+				Err: errors.New("truncated header extension record")}
+		}
+		tag := data[off]
+		length := binary.LittleEndian.Uint32(data[off+1 : off+5])
+		off += 5
+		fail := func(size int64, err error) error {
+			return &ParseError{Field: ExtensionName(tag), Offset: int64(off), Length: size, Err: err}
+		}
+		if uint64(length) > uint64(len(data)-off) {
+			return fail(int64(length), fmt.Errorf("header extension 0x%02x overruns extension block (%d bytes left)", tag, len(data)-off))
+		}
+		value := data[off : off+int(length)]
+		if size, ok := extFixedSize[tag]; ok && len(value) != size {
+			return fail(int64(size), fmt.Errorf("invalid %s length %d", ExtensionName(tag), len(value)))
+		}
+		if err := e.decodeRecord(tag, value, width); err != nil {
+			return fail(int64(length), err)
+		}
+		off += int(length)
+	}
+	return nil
+}
+
+// ValidateEncryptorRate checks that rate is a usable squarings/second
+// figure: finite and positive.  A header records 0 as "unknown" by leaving
+// the extension out.
+func ValidateEncryptorRate(rate float64) error {
+	if math.IsNaN(rate) || math.IsInf(rate, 0) || rate <= 0 {
+		return fmt.Errorf("encryptor rate %v is not a positive number of squarings/second", rate)
+	}
+	return nil
+}
+
+// decodeRecord decodes the value of one extension record, whose length has
+// been checked against extFixedSize, for a header whose modulus is width
+// bytes wide.
+func (e *HeaderExtensions) decodeRecord(tag uint8, value []byte, width int) error {
+	switch tag {
+	case ExtKeyDerivation:
+		e.KeyDerivation = value[0]
+	case ExtEncryptorRate:
+		rate := math.Float64frombits(binary.LittleEndian.Uint64(value))
+		if err := ValidateEncryptorRate(rate); err != nil {
+			return fmt.Errorf("invalid encryptor-rate extension: %v", err)
+		}
+		e.EncryptorRate = rate
+	case ExtContainer:
+		e.Container = &ContainerTable{}
+		return e.Container.decode(value)
+	case ExtChunkSize:
+		e.ChunkSize = binary.LittleEndian.Uint32(value)
+	case ExtSharedPuzzle:
+		e.Shared = &SharedPuzzle{
+			Index: binary.LittleEndian.Uint32(value[16:20]),
+			Count: binary.LittleEndian.Uint32(value[20:24]),
+		}
+		copy(e.Shared.Group[:], value[:16])
+		if e.Shared.Index >= e.Shared.Count {
+			return fmt.Errorf("invalid shared-puzzle extension: member %d of %d", e.Shared.Index, e.Shared.Count)
+		}
+	case ExtPayloadType:
+		e.PayloadType = value[0]
+	case ExtBundle:
+		e.Bundle = &BundleManifest{}
+		return e.Bundle.decode(value)
+	case ExtKeySlots:
+		e.KeySlots = &KeySlots{}
+		return e.KeySlots.decode(value)
+	case ExtPadding:
+		e.Padding = &HeaderPadding{Filler: append([]byte{}, value...)}
+	case ExtCipher:
+		e.Cipher = value[0]
+	case ExtKDFParams:
+		e.KDFParams = &KDFParams{Encoded: append([]byte{}, value...)}
+	case ExtBaseTweak:
+		e.BaseTweak = &BaseTweak{}
+		copy(e.BaseTweak.FileID[:], value)
+	case ExtAndPuzzles:
+		e.AndPuzzles = &AndPuzzles{}
+		return e.AndPuzzles.decode(value, width)
+	}
+	return nil
+}
+
+// DescribeExtension decodes the value of one extension record for display,
+// e.g. "65536 bytes" for a chunk size.  A tag this version does not know is
+// described as skipped, an invalid value by what is wrong with it.  width
+// is the byte length of the header's modulus.
+func DescribeExtension(tag uint8, value []byte, width int) string {
+	if size, ok := extFixedSize[tag]; ok && len(value) != size {
+		return fmt.Sprintf("invalid: %d bytes, want %d", len(value), size)
+	}
+	var e HeaderExtensions
+	if err := e.decodeRecord(tag, value, width); err != nil {
+		return fmt.Sprintf("invalid: %v", err)
+	}
+	switch tag {
+	case ExtKeyDerivation:
+		return fmt.Sprintf("version %d", e.KeyDerivation)
+	case ExtEncryptorRate:
+		return fmt.Sprintf("%.0f squarings/second", e.EncryptorRate)
+	case ExtContainer:
+		desc := fmt.Sprintf("%d entries", len(e.Container.Entries))
+		if e.Container.Private {
+			desc = fmt.Sprintf("private entry table, sealed in the first %d bytes of data", e.Container.TableLength)
+		}
+		if e.Container.Dedup {
+			desc += ", identical entries stored once"
+		}
+		return desc
+	case ExtChunkSize:
+		return fmt.Sprintf("%d bytes", e.ChunkSize)
+	case ExtSharedPuzzle:
+		return fmt.Sprintf("group %x, member %d of %d", e.Shared.Group, e.Shared.Index+1, e.Shared.Count)
+	case ExtPayloadType:
+		switch e.PayloadType {
+		case PayloadDocument:
+			return "document"
+		case PayloadDataKey:
+			return "data key"
+		}
+		return fmt.Sprintf("unknown payload type %d", e.PayloadType)
+	case ExtBundle:
+		return fmt.Sprintf("%d members", len(e.Bundle.Members))
+	case ExtKeySlots:
+		return fmt.Sprintf("%d key slots", len(e.KeySlots.Slots))
+	case ExtPadding:
+		return fmt.Sprintf("%d random bytes", len(value))
+	case ExtCipher:
+		return fmt.Sprintf("cipher 0x%02x", e.Cipher)
+	case ExtKDFParams:
+		return fmt.Sprintf("%d bytes of parameters", len(value))
+	case ExtBaseTweak:
+		return fmt.Sprintf("file ID %x", e.BaseTweak.FileID)
+	case ExtAndPuzzles:
+		var work uint64
+		for _, p := range e.AndPuzzles.Puzzles {
+			work += p.WorkFactor
+		}
+		return fmt.Sprintf("%d more puzzles, %d squarings", len(e.AndPuzzles.Puzzles), work)
+	}
+	return "unknown, skipped"
+}
@@ -0,0 +1,59 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// WrappedKeySize is the size of a data key sealed in a key slot: nonce (12),
+// key (32) and authentication tag (16).
+const WrappedKeySize = 12 + 32 + 16
+
+// KeySlotSize is the encoded size of one KeySlot.
+const KeySlotSize = WrappedKeySize + 8
+
+// KeySlot wraps the data key of one payload under the puzzle key of one
+// passphrase.
+type KeySlot struct {
+	Wrapped [WrappedKeySize]byte // data key sealed under the puzzle key
+	Length  uint64               // length of the sealed payload within the data section
+}
+
+// KeySlots lets a file decrypt to a different payload for each of several
+// passphrases, such as a real one and a duress one.  Every passphrase
+// derives its own puzzle base, so each slot opens only with the solution of
+// its own puzzle; the payloads are stored back to back in the data section
+// in slot order.  Nothing records which slot is which.
+type KeySlots struct {
+	Slots []KeySlot
+}
+
+// encode encodes the slots as one record per slot, each the wrapped key
+// followed by the payload length (little-endian).
+func (k *KeySlots) encode() []byte {
+	buf := make([]byte, 0, len(k.Slots)*KeySlotSize)
+	for _, s := range k.Slots {
+		buf = append(buf, s.Wrapped[:]...)
+		buf = binary.LittleEndian.AppendUint64(buf, s.Length)
+	}
+	return buf
+}
+
+// decode decodes slots produced by encode.
+func (k *KeySlots) decode(data []byte) error {
+	*k = KeySlots{}
+	if len(data) == 0 {
+		return errors.New("empty key-slot extension")
+	}
+	if len(data)%KeySlotSize != 0 {
+		return fmt.Errorf("invalid key-slot extension length %d", len(data))
+	}
+	for ; len(data) > 0; data = data[KeySlotSize:] {
+		var s KeySlot
+		copy(s.Wrapped[:], data)
+		s.Length = binary.LittleEndian.Uint64(data[WrappedKeySize:])
+		k.Slots = append(k.Slots, s)
+	}
+	return nil
+}
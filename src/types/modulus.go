@@ -0,0 +1,116 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// MaxModulusBytes bounds the modulus of a header of the sized layout, so a
+// corrupted header cannot ask for a huge solve per squaring.
+const MaxModulusBytes = 1024
+
+// SizedModulus reports whether the header stores its modulus and base at
+// the byte length of the modulus, after a 2-byte length (little-endian),
+// rather than in fields of FixedModulusBytes.  Headers of a puzzle other
+// than 2048 bits do, and so those only readers of VersionModulusSize or
+// later can decrypt, which older readers refuse by their minimum reader
+// version before reaching the fields.
+func (h *FileHeader) SizedModulus() bool {
+	return h.Version >= VersionModulusSize && (h.MinReaderVersion >= VersionModulusSize || h.otherModulusSize())
+}
+
+// otherModulusSize reports whether any puzzle of the header has a modulus
+// of another size than 2048 bits.
+func (h *FileHeader) otherModulusSize() bool {
+	if bits := h.Modulus().BitLen(); bits != 0 && bits != FixedModulusBytes*8 {
+		return true
+	}
+	if h.Ext.AndPuzzles != nil {
+		for _, p := range h.Ext.AndPuzzles.Puzzles {
+			if len(p.ModulusN) != FixedModulusBytes {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Modulus returns the puzzle modulus N of the header.
+func (h *FileHeader) Modulus() *big.Int {
+	return new(big.Int).SetBytes(h.ModulusN)
+}
+
+// Base returns the puzzle base G of the header.
+func (h *FileHeader) Base() *big.Int {
+	return new(big.Int).SetBytes(h.BaseG)
+}
+
+// SetModulus stores the puzzle modulus N and base G in the header, both
+// zero-padded to the byte length of N.  G must be less than N.
+func (h *FileHeader) SetModulus(N, G *big.Int) error {
+	if width := modulusBytes(N); width > MaxModulusBytes {
+		return fmt.Errorf("a %d-bit modulus is too wide to store (at most %d bits)", N.BitLen(), MaxModulusBytes*8)
+	}
+	if G.Sign() < 0 || G.Cmp(N) >= 0 {
+		return errors.New("the base is out of range")
+	}
+	h.ModulusN, h.BaseG = modulusFields(N, G)
+	return nil
+}
+
+// modulusWidth returns the byte length of the modulus and base fields of
+// the header as WriteTo writes them.
+func (h *FileHeader) modulusWidth() int {
+	if !h.SizedModulus() {
+		return FixedModulusBytes
+	}
+	return modulusBytes(h.Modulus())
+}
+
+// writeModulus returns the modulus and base fields of the header, checking
+// that they fit its layout and that every further puzzle has a modulus of
+// the same width.
+func (h *FileHeader) writeModulus() (n, g []byte, err error) {
+	N, G := h.Modulus(), h.Base()
+	width := h.modulusWidth()
+	if width == 0 {
+		return nil, nil, errors.New("the header has no modulus")
+	}
+	if modulusBytes(N) > width || modulusBytes(G) > width {
+		return nil, nil, fmt.Errorf("a %d-bit modulus needs format version %d", N.BitLen(), VersionModulusSize)
+	}
+	if width > MaxModulusBytes {
+		return nil, nil, fmt.Errorf("a %d-bit modulus is too wide to store (at most %d bits)", N.BitLen(), MaxModulusBytes*8)
+	}
+	if h.SizedModulus() && h.Version >= VersionMinReader && h.MinReaderVersion < VersionModulusSize {
+		return nil, nil, fmt.Errorf("a %d-bit modulus needs minimum reader version %d, not %d", N.BitLen(), VersionModulusSize, h.MinReaderVersion)
+	}
+	if h.Ext.AndPuzzles != nil {
+		for i, p := range h.Ext.AndPuzzles.Puzzles {
+			if len(p.ModulusN) != width || len(p.BaseG) != width {
+				return nil, nil, fmt.Errorf("puzzle %d has a modulus of %d bytes, not %d like the first", i+2, len(p.ModulusN), width)
+			}
+		}
+	}
+	n, g = make([]byte, width), make([]byte, width)
+	return N.FillBytes(n), G.FillBytes(g), nil
+}
+
+// DecodeExtensions decodes the extension block of the header, produced by
+// Encode, once the fields before it are set: further puzzles have a
+// modulus as wide as the header's.
+func (h *FileHeader) DecodeExtensions(data []byte) error {
+	return h.Ext.decode(data, h.modulusWidth())
+}
+
+// modulusFields returns N and G zero-padded to the byte length of N.
+func modulusFields(N, G *big.Int) (n, g []byte) {
+	width := modulusBytes(N)
+	return N.FillBytes(make([]byte, width)), G.FillBytes(make([]byte, width))
+}
+
+// modulusBytes returns the byte length of N.
+func modulusBytes(N *big.Int) int {
+	return (N.BitLen() + 7) / 8
+}
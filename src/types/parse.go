@@ -0,0 +1,42 @@
+package types
+
+import "fmt"
+
+// ParseError describes a malformed encrypted file: which field could not be
+// read or was invalid, where it starts and how long it should be.
+type ParseError struct {
+	Field  string // name of the field, e.g. "work factor" or "extension 0x03 (container)"
+	Offset int64  // byte offset of the field from the start of the file
+	Length int64  // expected length of the field in bytes
+	Err    error  // what went wrong, e.g. io.ErrUnexpectedEOF
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s (%d bytes at offset %d): %v", e.Field, e.Length, e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// ExtensionName returns a readable name for an extension tag.
+func ExtensionName(tag uint8) string {
+	names := map[uint8]string{
+		ExtKeyDerivation: "key derivation",
+		ExtEncryptorRate: "encryptor rate",
+		ExtContainer:     "container",
+		ExtChunkSize:     "chunk size",
+		ExtSharedPuzzle:  "shared puzzle",
+		ExtPayloadType:   "payload type",
+		ExtBundle:        "bundle",
+		ExtKeySlots:      "key slots",
+		ExtPadding:       "padding",
+		ExtCipher:        "cipher",
+		ExtKDFParams:     "key-derivation parameters",
+		ExtBaseTweak:     "base tweak",
+		ExtAndPuzzles:    "and puzzles",
+	}
+	name, ok := names[tag]
+	if !ok {
+		name = "unknown"
+	}
+	return fmt.Sprintf("extension 0x%02x (%s)", tag, name)
+}
@@ -0,0 +1,76 @@
+package types
+
+import "time"
+
+// PuzzleFileFormat identifies a standalone puzzle file.
+const PuzzleFileFormat = "cryptotimed-puzzle"
+
+// PuzzleFileVersion is the current version of the puzzle file format.
+const PuzzleFileVersion = 1
+
+// PuzzleFile is the JSON form of a time-lock challenge with no encrypted
+// payload: the public parameters and a commitment to the solution.  Big
+// integers are hex without a prefix.
+type PuzzleFile struct {
+	Format     string    `json:"format"`  // PuzzleFileFormat
+	Version    int       `json:"version"` // PuzzleFileVersion
+	ModulusN   string    `json:"n"`
+	BaseG      string    `json:"g"`
+	WorkFactor uint64    `json:"t"`
+	Commitment string    `json:"commitment"` // crypto.Puzzle.Commitment of the target, hex
+	Created    time.Time `json:"created"`
+}
+
+// PuzzleExportFormat identifies the exported puzzle parameters of an
+// encrypted file.
+const PuzzleExportFormat = "cryptotimed-file-puzzle"
+
+// PuzzleExportVersion is the current version of the puzzle export format.
+const PuzzleExportVersion = 1
+
+// PuzzleExport is the JSON form of everything the header of a single
+// encrypted file holds besides its data section: its puzzle and how its
+// data is sealed.  Kept apart from the file, it is enough to rebuild a
+// damaged header around the data section.  Big integers are hex without a
+// prefix, byte strings plain hex.
+type PuzzleExport struct {
+	Format        string    `json:"format"`  // PuzzleExportFormat
+	Version       int       `json:"version"` // PuzzleExportVersion
+	ModulusN      string    `json:"n"`
+	BaseG         string    `json:"g"` // password-derived if KeyRequired
+	WorkFactor    uint64    `json:"t"`
+	KeyRequired   bool      `json:"key_required"`
+	Salt          string    `json:"salt"`
+	FileID        string    `json:"file_id,omitempty"` // see BaseTweak
+	KeyDerivation uint8     `json:"key_derivation"`
+	KDFParams     string    `json:"kdf_params,omitempty"`
+	Cipher        uint8     `json:"cipher"`
+	ChunkSize     uint32    `json:"chunk_size,omitempty"`
+	PayloadType   uint8     `json:"payload_type,omitempty"`
+	EncryptorRate float64   `json:"encryptor_rate,omitempty"`
+	DataSize      uint64    `json:"data_size"` // bytes of the data section
+	Created       time.Time `json:"created"`
+}
+
+// SolveProofFormat identifies a proof that a puzzle was solved.
+const SolveProofFormat = "cryptotimed-solve-proof"
+
+// SolveProofVersion is the current version of the solve proof format.
+const SolveProofVersion = 1
+
+// SolveProofFile is the JSON form of a crypto.SolveProof with the puzzle and
+// solution it is about.  The solution is that of an encrypted file, so the
+// file is as secret as the file's key.  Big integers are hex without a
+// prefix.
+type SolveProofFile struct {
+	Format      string    `json:"format"`  // SolveProofFormat
+	Version     int       `json:"version"` // SolveProofVersion
+	ModulusN    string    `json:"n"`
+	BaseG       string    `json:"g"`
+	WorkFactor  uint64    `json:"t"`
+	Solution    string    `json:"y"`       // G^(2^T) mod N
+	Partial     string    `json:"partial"` // see crypto.SolveProof
+	Mu          []string  `json:"mu"`
+	Fingerprint string    `json:"fingerprint,omitempty"` // header fingerprint of the file solved, hex
+	Created     time.Time `json:"created"`
+}
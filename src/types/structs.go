@@ -1,24 +1,298 @@
 package types
 
-// Rsa2048Bytes is the length in bytes of a 2048-bit RSA modulus
-const Rsa2048Bytes = 256
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// FixedModulusBytes is the length in bytes of a 2048-bit RSA modulus, the
+// width of the modulus and base fields of a header of the fixed layout (see
+// FileHeader.SizedModulus).
+const FixedModulusBytes = 256
 
 // EncryptedFile represents the binary format of an encrypted file with time-lock puzzle
 type EncryptedFile struct {
-	Version     uint32             // format version
-	WorkFactor  uint64             // t (number of squarings, from --work)
-	ModulusN    [Rsa2048Bytes]byte // RSA modulus N
-	BaseG       [Rsa2048Bytes]byte // base g (now password-derived if KeyRequired=1)
-	KeyRequired uint8              // 0 = puzzle-only, 1 = puzzle + user key
-	Salt        [16]byte           // random salt for password-based G derivation (only if KeyRequired=1)
-	Data        []byte             // ChaCha20-Poly1305 ciphertext (includes nonce)
+	Version          uint32           // format version
+	MinReaderVersion uint32           // oldest format version able to decrypt the file (version 3+)
+	WorkFactor       uint64           // t (number of squarings, from --work)
+	ModulusN         []byte           // RSA modulus N (big-endian)
+	BaseG            []byte           // base g (now password-derived if KeyRequired=1)
+	KeyRequired      uint8            // 0 = puzzle-only, 1 = puzzle + user key
+	Salt             [16]byte         // random salt for password-based G derivation (only if KeyRequired=1)
+	Ext              HeaderExtensions // optional header fields (version 2+)
+	Data             []byte           // ChaCha20-Poly1305 ciphertext (includes nonce)
+}
+
+// FileHeader is the fixed header that precedes the data section of an
+// encrypted file.  It carries everything needed to describe the puzzle, so it
+// can be parsed (and inspected) without reading the ciphertext.
+type FileHeader struct {
+	Version          uint32           // format version
+	MinReaderVersion uint32           // oldest format version able to decrypt the file (version 3+)
+	WorkFactor       uint64           // t (number of squarings)
+	ModulusN         []byte           // RSA modulus N (big-endian)
+	BaseG            []byte           // base g (password-derived if KeyRequired=1)
+	KeyRequired      uint8            // 0 = puzzle-only, 1 = puzzle + user key
+	Salt             [16]byte         // salt for password-based G derivation
+	Ext              HeaderExtensions // optional header fields (version 2+)
 }
 
 const (
-	// CurrentVersion is the current file format version
-	CurrentVersion = 1
+	// VersionLegacy is the original format without header extensions
+	VersionLegacy = 1
+
+	// CurrentVersion is the current file format version.  Version 2 adds a
+	// length-prefixed extension block after the fixed header fields,
+	// version 3 the minimum reader version right after the format version,
+	// version 4 shared puzzle groups, version 5 payload types, version 6
+	// bundles, version 7 key slots, version 8 pluggable ciphers and
+	// key-derivation parameters, version 9 tweaked password bases,
+	// version 10 deduplicated container entries, version 11 files of
+	// several puzzles and version 12 moduli of other sizes than 2048 bits.
+	CurrentVersion = 12
+
+	// VersionMinReader is the first format version whose header records the
+	// minimum reader version.  Later versions keep the version 3 layout (new
+	// fields go into extensions) up to the minimum reader version, so a
+	// reader can open any file whose minimum reader version it supports,
+	// even one of a newer format, and refuse any other before the fields
+	// that follow.
+	VersionMinReader = 3
+
+	// VersionSharedPuzzle is the first format version able to decrypt
+	// members of a shared puzzle group, whose data key is derived from the
+	// puzzle key and the header.
+	VersionSharedPuzzle = 4
+
+	// VersionPayloadType is the first format version that knows a data
+	// section may hold something other than the encrypted input (see
+	// PayloadDataKey).
+	VersionPayloadType = 5
+
+	// VersionBundle is the first format version able to unpack a bundle of
+	// files sharing one puzzle (see BundleManifest).
+	VersionBundle = 6
+
+	// VersionKeySlots is the first format version able to open a file with
+	// a data key per passphrase (see KeySlots).
+	VersionKeySlots = 7
+
+	// VersionAlgorithms is the first format version that reads the cipher
+	// and key-derivation parameters a header records, rather than sealing
+	// every file with ChaCha20-Poly1305.
+	VersionAlgorithms = 8
+
+	// VersionBaseTweak is the first format version that mixes the file ID
+	// a header records into the derivation of its password base (see
+	// BaseTweak).
+	VersionBaseTweak = 9
+
+	// VersionDedup is the first format version whose containers may store
+	// identical entries once (see ContainerTable.Dedup).
+	VersionDedup = 10
+
+	// VersionAndPuzzles is the first format version able to decrypt a file
+	// whose key needs several puzzles solved (see AndPuzzles).
+	VersionAndPuzzles = 11
+
+	// VersionModulusSize is the first format version able to decrypt a
+	// file whose modulus is not of 2048 bits, stored at its own width (see
+	// FileHeader.SizedModulus).
+	VersionModulusSize = 12
 
 	// HeaderSize is the size of the fixed header in bytes
 	// 4 (Version) + 8 (WorkFactor) + 256 (ModulusN) + 256 (BaseG) + 1 (KeyRequired) + 16 (Salt)
-	HeaderSize = 4 + 8 + Rsa2048Bytes + Rsa2048Bytes + 1 + 16
+	// A sized modulus (see FileHeader.SizedModulus) takes 2 + 2 × its
+	// width instead of 512 bytes.
+	HeaderSize = 4 + 8 + FixedModulusBytes + FixedModulusBytes + 1 + 16
 )
+
+// Header returns the fixed header portion of the encrypted file.
+func (ef *EncryptedFile) Header() *FileHeader {
+	return &FileHeader{
+		Version:          ef.Version,
+		MinReaderVersion: ef.MinReaderVersion,
+		WorkFactor:       ef.WorkFactor,
+		ModulusN:         ef.ModulusN,
+		BaseG:            ef.BaseG,
+		KeyRequired:      ef.KeyRequired,
+		Salt:             ef.Salt,
+		Ext:              ef.Ext,
+	}
+}
+
+// NewEncryptedFile combines a header and a data section into an EncryptedFile.
+func NewEncryptedFile(h *FileHeader, data []byte) *EncryptedFile {
+	return &EncryptedFile{
+		Version:          h.Version,
+		MinReaderVersion: h.MinReaderVersion,
+		WorkFactor:       h.WorkFactor,
+		ModulusN:         h.ModulusN,
+		BaseG:            h.BaseG,
+		KeyRequired:      h.KeyRequired,
+		Salt:             h.Salt,
+		Ext:              h.Ext,
+		Data:             data,
+	}
+}
+
+// Size returns the number of bytes WriteTo produces for this header: the fixed
+// HeaderSize plus, for version 2 and later, the extension block and, for
+// version 3 and later, the minimum reader version.
+func (h *FileHeader) Size() int {
+	if h.Version < 2 {
+		return HeaderSize
+	}
+	if h.Version < VersionMinReader {
+		return HeaderSize + 4 + h.Ext.encodedLen()
+	}
+	fixed := HeaderSize
+	if h.SizedModulus() {
+		fixed += 2 + 2*h.modulusWidth() - 2*FixedModulusBytes
+	}
+	return fixed + 4 + 4 + h.Ext.encodedLen()
+}
+
+// PadTo adds a padding extension of random bytes that brings the header to
+// size bytes, so that headers describing different contents (entry names,
+// key slots) have the same size.  Any earlier padding is replaced.  The
+// padding record takes 5 bytes even when empty, so size must be the
+// unpadded size or at least 5 more.
+func (h *FileHeader) PadTo(size int) error {
+	h.Ext.Padding = nil
+	if h.Version < 2 {
+		return errors.New("only headers with an extension block can be padded")
+	}
+	unpadded := h.Size()
+	switch {
+	case size == unpadded:
+		return nil
+	case size < unpadded:
+		return fmt.Errorf("the header is already %d bytes, more than %d; pad to %d bytes or more", unpadded, size, unpadded+5)
+	case size < unpadded+5:
+		return fmt.Errorf("the header is %d bytes and padding takes at least 5 more; pad to %d bytes or more", unpadded, unpadded+5)
+	case h.Ext.encodedLen()+size-unpadded > MaxExtensionSize:
+		return fmt.Errorf("padding to %d bytes exceeds the extension block limit of %d bytes", size, MaxExtensionSize)
+	}
+	filler := make([]byte, size-unpadded-5)
+	if _, err := rand.Read(filler); err != nil {
+		return fmt.Errorf("failed to generate header padding: %v", err)
+	}
+	h.Ext.Padding = &HeaderPadding{Filler: filler}
+	return nil
+}
+
+// RequiredReaderVersion returns the oldest format version able to fully
+// decrypt a file with this header, which writers record as its
+// MinReaderVersion.  A feature that older readers would misread (rather than
+// skip) must raise it: version 3 readers would skip the shared-puzzle
+// extension and decrypt with the wrong key, version 4 readers would write
+// a wrapped data key out as if it were the user's document, version 5
+// readers would try to open a bundle's members as one sealed document,
+// version 6 readers would try to open key slots and payloads as one, and
+// version 7 readers would open any cipher as ChaCha20-Poly1305 and derive
+// the key without its parameters, version 8 readers would derive a
+// tweaked password base without its tweak and report the right passphrase
+// as wrong, version 9 readers would open an entry stored once for
+// several under its own key instead of the first's, version 10 readers
+// would solve only the first of several puzzles and derive the wrong key,
+// and version 11 readers would reject a modulus of another size than 2048
+// bits, and could not find the fields after one stored at its own width.
+func (h *FileHeader) RequiredReaderVersion() uint32 {
+	if h.otherModulusSize() {
+		return VersionModulusSize
+	}
+	if h.Ext.AndPuzzles != nil {
+		return VersionAndPuzzles
+	}
+	if h.Ext.Container != nil && h.Ext.Container.Dedup {
+		return VersionDedup
+	}
+	if h.Ext.BaseTweak != nil {
+		return VersionBaseTweak
+	}
+	if h.Ext.Cipher != 0 || h.Ext.KDFParams != nil {
+		return VersionAlgorithms
+	}
+	if h.Ext.KeySlots != nil {
+		return VersionKeySlots
+	}
+	if h.Ext.Bundle != nil {
+		return VersionBundle
+	}
+	if h.Ext.PayloadType != PayloadDocument {
+		return VersionPayloadType
+	}
+	if h.Ext.Shared != nil {
+		return VersionSharedPuzzle
+	}
+	return VersionMinReader
+}
+
+// WriteTo serializes the header in its little-endian on-disk format.  It
+// implements io.WriterTo and writes exactly Size() bytes on success.
+func (h *FileHeader) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	n, g, err := h.writeModulus()
+	if err != nil {
+		return 0, err
+	}
+	fields := []interface{}{h.Version}
+	if h.Version >= VersionMinReader {
+		fields = append(fields, h.MinReaderVersion)
+	}
+	fields = append(fields, h.WorkFactor)
+	if h.SizedModulus() {
+		fields = append(fields, uint16(len(n)))
+	}
+	fields = append(fields,
+		n,
+		g,
+		h.KeyRequired,
+		h.Salt,
+	)
+	for _, field := range fields {
+		if err := binary.Write(cw, binary.LittleEndian, field); err != nil {
+			return cw.n, err
+		}
+	}
+	if h.Version < 2 {
+		return cw.n, nil
+	}
+
+	// Version 2+: length-prefixed extension block
+	ext := h.Ext.Encode()
+	if err := binary.Write(cw, binary.LittleEndian, uint32(len(ext))); err != nil {
+		return cw.n, err
+	}
+	if _, err := cw.Write(ext); err != nil {
+		return cw.n, err
+	}
+	return cw.n, nil
+}
+
+// Fingerprint returns the SHA-256 of the serialized header.  It identifies
+// an encrypted file without reading its data section.
+func (h *FileHeader) Fingerprint() [32]byte {
+	hash := sha256.New()
+	h.WriteTo(hash) // writes to a hash never fail
+	var sum [32]byte
+	copy(sum[:], hash.Sum(nil))
+	return sum
+}
+
+// countingWriter tracks how many bytes have been written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// logMagic starts every append-only log written by AppendLogRecord.
+const logMagic = "CTIMELOG"
+
+// logVersion is the append-only log format version.
+const logVersion = 1
+
+// logHeaderSize is the size of the magic and version at the start of a log.
+const logHeaderSize = len(logMagic) + 1
+
+// logChainLabel separates the chain hashes of a log from other SHA-256 uses.
+const logChainLabel = "cryptotimed log record v1"
+
+// LogRecord is one record of an append-only log.
+type LogRecord struct {
+	Index  int
+	Offset int64    // position of the record in the log
+	Data   []byte   // an encrypted file, as written by WriteEncryptedFile
+	Hash   [32]byte // chain hash of this record, covering every earlier one
+}
+
+// errStopWalk ends WalkLog early without an error.
+var errStopWalk = errors.New("stop walking the log")
+
+// logGenesis is the chain hash the first record of a log links to.
+func logGenesis() [32]byte {
+	return sha256.Sum256([]byte{logVersion})
+}
+
+// chainHash links a record's data to the chain hash of the record before it.
+func chainHash(prev [32]byte, data []byte) [32]byte {
+	h := sha256.New()
+	h.Write([]byte(logChainLabel))
+	h.Write(prev[:])
+	binary.Write(h, binary.LittleEndian, uint64(len(data)))
+	h.Write(data)
+	var sum [32]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// AppendLogRecord appends data as a new record to the append-only log at
+// path, creating the log if it does not exist.  The log holds the magic
+// "CTIMELOG" and a version byte, followed by the records, each (little-endian)
+// an 8-byte length, the data and a SHA-256 chain hash of a label, the previous
+// record's chain hash, the length and the data.  Every record thereby
+// commits to all records before it, so modifying, inserting or removing one
+// breaks the chain of the records after it (see WalkLog).  Only the
+// structure of the existing log is checked before appending, not its
+// hashes.  Concurrent appends to the same log are not supported.
+func AppendLogRecord(path string, data []byte) (LogRecord, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return LogRecord{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return LogRecord{}, err
+	}
+	size := info.Size()
+
+	rec := LogRecord{Offset: int64(logHeaderSize), Hash: logGenesis()}
+	var buf []byte
+	if size == 0 {
+		buf = append([]byte(logMagic), logVersion)
+	} else {
+		// Find the last record's chain hash without reading any data
+		if err := readLogHeader(f, path); err != nil {
+			return LogRecord{}, err
+		}
+		for rec.Offset < size {
+			length, err := readLogLength(f, path, rec.Index, size-rec.Offset)
+			if err != nil {
+				return LogRecord{}, err
+			}
+			if _, err := f.Seek(int64(length), io.SeekCurrent); err != nil {
+				return LogRecord{}, err
+			}
+			if _, err := io.ReadFull(f, rec.Hash[:]); err != nil {
+				return LogRecord{}, err
+			}
+			rec.Offset += 8 + int64(length) + sha256.Size
+			rec.Index++
+		}
+	}
+
+	rec.Data = data
+	rec.Hash = chainHash(rec.Hash, data)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(len(data)))
+	buf = append(buf, data...)
+	buf = append(buf, rec.Hash[:]...)
+
+	if _, err := f.WriteAt(buf, size); err != nil {
+		// Leave no partial record behind
+		f.Truncate(size)
+		return LogRecord{}, err
+	}
+	if err := f.Sync(); err != nil {
+		return LogRecord{}, err
+	}
+	return rec, nil
+}
+
+// WalkLog reads the records of the append-only log at path in order,
+// checking each one's chain hash, and calls fn with every record whose chain
+// is intact.  It returns the chain hash of the last record (which commits to
+// the whole log) and the number of records.  An error names the first
+// record that does not verify; records removed from the end of a log cannot
+// be detected this way, only by comparing the returned hash with one
+// recorded earlier.
+func WalkLog(path string, fn func(rec LogRecord) error) ([32]byte, int, error) {
+	head := logGenesis()
+	f, err := os.Open(path)
+	if err != nil {
+		return head, 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return head, 0, err
+	}
+	size := info.Size()
+
+	r := bufio.NewReader(f)
+	if err := readLogHeader(r, path); err != nil {
+		return head, 0, err
+	}
+
+	rec := LogRecord{Offset: int64(logHeaderSize)}
+	for ; rec.Offset < size; rec.Index++ {
+		length, err := readLogLength(r, path, rec.Index, size-rec.Offset)
+		if err != nil {
+			return head, rec.Index, err
+		}
+		rec.Data = make([]byte, length)
+		if _, err := io.ReadFull(r, rec.Data); err != nil {
+			return head, rec.Index, err
+		}
+		if _, err := io.ReadFull(r, rec.Hash[:]); err != nil {
+			return head, rec.Index, err
+		}
+		if chainHash(head, rec.Data) != rec.Hash {
+			return head, rec.Index, fmt.Errorf("record %d (offset %d) breaks the hash chain: it was modified, or records before it were inserted or removed", rec.Index, rec.Offset)
+		}
+		head = rec.Hash
+		if fn != nil {
+			if err := fn(rec); err == errStopWalk {
+				return head, rec.Index + 1, nil
+			} else if err != nil {
+				return head, rec.Index, err
+			}
+		}
+		rec.Offset += 8 + int64(length) + sha256.Size
+	}
+	return head, rec.Index, nil
+}
+
+// ReadLogRecord returns the record with the given index from the
+// append-only log at path, after verifying the chain up to it.
+func ReadLogRecord(path string, index int) (LogRecord, error) {
+	var found *LogRecord
+	_, count, err := WalkLog(path, func(rec LogRecord) error {
+		if rec.Index == index {
+			found = &rec
+			return errStopWalk
+		}
+		return nil
+	})
+	if err != nil {
+		return LogRecord{}, err
+	}
+	if found == nil {
+		return LogRecord{}, fmt.Errorf("%s has no record %d (it has %d records)", path, index, count)
+	}
+	return *found, nil
+}
+
+// readLogHeader checks the magic and version at the start of a log.
+func readLogHeader(r io.Reader, path string) error {
+	header := make([]byte, logHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(logMagic)]) != logMagic {
+		return fmt.Errorf("%s is not an append-only log", path)
+	}
+	if header[len(logMagic)] != logVersion {
+		return fmt.Errorf("unsupported log version %d", header[len(logMagic)])
+	}
+	return nil
+}
+
+// readLogLength reads the length of a record and checks that the record fits
+// in the remaining bytes of the log.
+func readLogLength(r io.Reader, path string, index int, remaining int64) (uint64, error) {
+	var length uint64
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return 0, fmt.Errorf("%s ends with an incomplete record %d", path, index)
+	}
+	if remaining < 8+sha256.Size || length > uint64(remaining-8-sha256.Size) {
+		return 0, fmt.Errorf("%s ends with an incomplete record %d", path, index)
+	}
+	return length, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package utils
+
+import "errors"
+
+// DropFileCache is not supported on this platform.
+func DropFileCache(path string) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,348 @@
+package utils
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+)
+
+const (
+	// MinCalibrationSolve is the shortest solve whose rate is folded into the
+	// calibration profile; shorter ones are dominated by start-up noise.
+	MinCalibrationSolve = 10 * time.Second
+
+	// calibrationWeight is the weight of a new sample once the profile holds
+	// enough of them; until then samples are averaged evenly.
+	calibrationWeight = 0.25
+)
+
+// Calibration is this machine's sustained squaring rate per modulus size, as
+// measured by real solves, and the benchmarks of particular files.  A
+// profile exported to estimate solves on another machine (see
+// ExportProfile) also describes the host it was measured on.
+type Calibration struct {
+	Host   *HostFingerprint            `json:"host,omitempty"`  // nil in this machine's own profile
+	Moduli map[int]*CalibrationEntry   `json:"moduli"`          // keyed by modulus bits
+	Files  map[string]*FileCalibration `json:"files,omitempty"` // keyed by header fingerprint, hex
+}
+
+// HostFingerprint describes the machine a calibration profile was measured
+// on, so that a profile imported elsewhere can be told apart from one of
+// that machine.
+type HostFingerprint struct {
+	CPUModel    string    `json:"cpu_model,omitempty"` // empty where the platform does not report it
+	Cores       int       `json:"cores"`
+	OS          string    `json:"os"`
+	Arch        string    `json:"arch"`
+	ModulusBits []int     `json:"modulus_bits"` // sizes the profile has a rate for
+	Measured    time.Time `json:"measured"`     // the most recent rate update
+	Exported    time.Time `json:"exported"`
+}
+
+// CalibrationEntry is the rate for one modulus size.
+type CalibrationEntry struct {
+	Rate    float64   `json:"rate"`    // squarings per second, a weighted moving average
+	Samples int       `json:"samples"` // solves folded into Rate
+	Updated time.Time `json:"updated"` // when the last sample was folded in
+}
+
+// FileCalibration is what benchmark --for-file measured for one encrypted
+// file on this machine.
+type FileCalibration struct {
+	ModulusBits   int           `json:"modulus_bits"`
+	WorkFactor    uint64        `json:"work_factor"`
+	Rate          float64       `json:"rate"`           // squarings per second on the file's modulus
+	KeyDerivation time.Duration `json:"key_derivation"` // one Argon2id derivation (0 if no key is required)
+	DataSize      int64         `json:"data_size"`      // bytes of the data section
+	AEADRate      float64       `json:"aead_rate"`      // bytes per second authenticated and decrypted
+	Estimate      time.Duration `json:"estimate"`       // solve, key derivation and decryption together
+	Measured      time.Time     `json:"measured"`
+}
+
+// CalibrationPath returns the file the calibration profile is kept in.
+func CalibrationPath() (string, error) {
+	dir, err := StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "calibration.json"), nil
+}
+
+// LoadCalibration reads the calibration profile at path.  A missing file is
+// an empty profile.
+func LoadCalibration(path string) (*Calibration, error) {
+	c := &Calibration{Moduli: map[int]*CalibrationEntry{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("corrupt calibration profile %s: %v", path, err)
+	}
+	if c.Moduli == nil {
+		c.Moduli = map[int]*CalibrationEntry{}
+	}
+	return c, nil
+}
+
+// SaveCalibration writes the calibration profile to path.
+func SaveCalibration(c *Calibration, path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0600)
+}
+
+// Record folds a measured rate for a bits-bit modulus into the profile.  The
+// first samples are averaged evenly; later ones move the average by a fixed
+// weight, so the profile follows changes to the machine.
+func (c *Calibration) Record(bits int, rate float64, at time.Time) {
+	if rate <= 0 {
+		return
+	}
+	if c.Moduli == nil {
+		c.Moduli = map[int]*CalibrationEntry{}
+	}
+	e := c.Moduli[bits]
+	if e == nil {
+		e = &CalibrationEntry{}
+		c.Moduli[bits] = e
+	}
+	weight := 1 / float64(e.Samples+1)
+	if weight < calibrationWeight {
+		weight = calibrationWeight
+	}
+	e.Rate += weight * (rate - e.Rate)
+	e.Samples++
+	e.Updated = at
+}
+
+// Rate returns the calibrated rate for a bits-bit modulus, or nil if no solve
+// of that size has been recorded.
+func (c *Calibration) Rate(bits int) *CalibrationEntry {
+	if e := c.Moduli[bits]; e != nil && e.Rate > 0 {
+		return e
+	}
+	return nil
+}
+
+// RecordFile stores the benchmark of the file whose header has fingerprint
+// fp, replacing any earlier one.
+func (c *Calibration) RecordFile(fp [32]byte, f *FileCalibration) {
+	if c.Files == nil {
+		c.Files = map[string]*FileCalibration{}
+	}
+	c.Files[hex.EncodeToString(fp[:])] = f
+}
+
+// File returns the benchmark of the file whose header has fingerprint fp,
+// or nil if it was never benchmarked.
+func (c *Calibration) File(fp [32]byte) *FileCalibration {
+	return c.Files[hex.EncodeToString(fp[:])]
+}
+
+// RecordSolveRate folds the rate of a solve of squarings squarings in
+// elapsed (not counting pauses) into the profile at CalibrationPath.  Solves
+// shorter than MinCalibrationSolve are ignored.
+func RecordSolveRate(bits int, squarings uint64, elapsed time.Duration) error {
+	if elapsed < MinCalibrationSolve || squarings == 0 {
+		return nil
+	}
+	path, err := CalibrationPath()
+	if err != nil {
+		return err
+	}
+	c, err := LoadCalibration(path)
+	if err != nil {
+		return err
+	}
+	c.Record(bits, float64(squarings)/elapsed.Seconds(), time.Now())
+	return SaveCalibration(c, path)
+}
+
+// CalibratedRate returns the calibrated rate for a bits-bit modulus from the
+// profile at CalibrationPath, or nil if there is none (or it cannot be read).
+func CalibratedRate(bits int) *CalibrationEntry {
+	path, err := CalibrationPath()
+	if err != nil {
+		return nil
+	}
+	c, err := LoadCalibration(path)
+	if err != nil {
+		return nil
+	}
+	return c.Rate(bits)
+}
+
+// RecordFileBenchmark stores the benchmark of the file whose header has
+// fingerprint fp in the profile at CalibrationPath.
+func RecordFileBenchmark(fp [32]byte, f *FileCalibration) error {
+	path, err := CalibrationPath()
+	if err != nil {
+		return err
+	}
+	c, err := LoadCalibration(path)
+	if err != nil {
+		return err
+	}
+	c.RecordFile(fp, f)
+	return SaveCalibration(c, path)
+}
+
+// CalibratedFile returns the benchmark of the file whose header has
+// fingerprint fp from the profile at CalibrationPath, or nil if there is
+// none (or it cannot be read).
+func CalibratedFile(fp [32]byte) *FileCalibration {
+	path, err := CalibrationPath()
+	if err != nil {
+		return nil
+	}
+	c, err := LoadCalibration(path)
+	if err != nil {
+		return nil
+	}
+	return c.File(fp)
+}
+
+// CurrentHost returns the fingerprint of this machine, without the fields
+// that describe a profile.
+func CurrentHost() HostFingerprint {
+	return HostFingerprint{
+		CPUModel: cpuModel(),
+		Cores:    runtime.NumCPU(),
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+	}
+}
+
+// String describes the host in a few words.
+func (h *HostFingerprint) String() string {
+	model := h.CPUModel
+	if model == "" {
+		model = "unknown CPU"
+	}
+	return fmt.Sprintf("%s, %d cores, %s/%s", model, h.Cores, h.OS, h.Arch)
+}
+
+// Mismatch lists how h clearly differs from the host other: another
+// operating system, architecture, CPU model or core count.  A CPU model
+// missing from either is not compared.
+func (h *HostFingerprint) Mismatch(other HostFingerprint) []string {
+	var diffs []string
+	if h.OS != other.OS || h.Arch != other.Arch {
+		diffs = append(diffs, fmt.Sprintf("measured on %s/%s, this host is %s/%s", h.OS, h.Arch, other.OS, other.Arch))
+	}
+	if h.CPUModel != "" && other.CPUModel != "" && h.CPUModel != other.CPUModel {
+		diffs = append(diffs, fmt.Sprintf("measured on CPU %q, this host has %q", h.CPUModel, other.CPUModel))
+	}
+	if h.Cores != other.Cores {
+		diffs = append(diffs, fmt.Sprintf("measured on %d cores, this host has %d", h.Cores, other.Cores))
+	}
+	return diffs
+}
+
+// ModulusSizes returns the modulus sizes the profile has a rate for, in
+// increasing order.
+func (c *Calibration) ModulusSizes() []int {
+	var sizes []int
+	for bits := range c.Moduli {
+		if c.Rate(bits) != nil {
+			sizes = append(sizes, bits)
+		}
+	}
+	sort.Ints(sizes)
+	return sizes
+}
+
+// Merge folds the rates and file benchmarks of other into the profile.
+// Each replaces the profile's own for the same modulus size or file unless
+// that one is more recent.  It returns the modulus sizes taken from other.
+func (c *Calibration) Merge(other *Calibration) []int {
+	if c.Moduli == nil {
+		c.Moduli = map[int]*CalibrationEntry{}
+	}
+	var merged []int
+	for _, bits := range other.ModulusSizes() {
+		e := other.Moduli[bits]
+		if own := c.Rate(bits); own == nil || !own.Updated.After(e.Updated) {
+			entry := *e
+			c.Moduli[bits] = &entry
+			merged = append(merged, bits)
+		}
+	}
+	for fp, f := range other.Files {
+		if own := c.Files[fp]; own == nil || !own.Measured.After(f.Measured) {
+			if c.Files == nil {
+				c.Files = map[string]*FileCalibration{}
+			}
+			file := *f
+			c.Files[fp] = &file
+		}
+	}
+	return merged
+}
+
+// ExportProfile writes c to path as a profile of this machine: its rates
+// and file benchmarks with the fingerprint of the host, for estimating
+// solves here from another machine (see LoadProfile).
+func ExportProfile(c *Calibration, path string, at time.Time) error {
+	host := CurrentHost()
+	host.ModulusBits = c.ModulusSizes()
+	for _, bits := range host.ModulusBits {
+		if updated := c.Moduli[bits].Updated; updated.After(host.Measured) {
+			host.Measured = updated
+		}
+	}
+	host.Exported = at
+	exported := *c
+	exported.Host = &host
+	return SaveCalibration(&exported, path)
+}
+
+// LoadProfile reads a profile written by ExportProfile.  Unlike
+// LoadCalibration it fails if path is missing.  A profile without a host
+// fingerprint, such as a copy of another machine's calibration.json, has a
+// nil Host.
+func LoadProfile(path string) (*Calibration, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return LoadCalibration(path)
+}
+
+// ImportProfile merges the profile at path into this machine's profile at
+// CalibrationPath (see Calibration.Merge) and returns it with the modulus
+// sizes taken from it.
+func ImportProfile(path string) (*Calibration, []int, error) {
+	imported, err := LoadProfile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	own, err := CalibrationPath()
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := LoadCalibration(own)
+	if err != nil {
+		return nil, nil, err
+	}
+	merged := c.Merge(imported)
+	if err := SaveCalibration(c, own); err != nil {
+		return nil, nil, err
+	}
+	return imported, merged, nil
+}
@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCalibrationMovingAverage(t *testing.T) {
+	var c Calibration
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	if c.Rate(2048) != nil {
+		t.Fatalf("empty profile has a rate")
+	}
+
+	// The first samples are averaged evenly
+	c.Record(2048, 100, at)
+	c.Record(2048, 200, at)
+	c.Record(2048, 300, at.Add(time.Hour))
+	e := c.Rate(2048)
+	if e == nil || math.Abs(e.Rate-200) > 1e-9 || e.Samples != 3 || !e.Updated.Equal(at.Add(time.Hour)) {
+		t.Fatalf("after three samples got %+v, want rate 200 from 3 samples", e)
+	}
+
+	// Later ones move it by a fixed weight
+	c.Record(2048, 200, at)
+	c.Record(2048, 600, at)
+	if e := c.Rate(2048); math.Abs(e.Rate-300) > 1e-9 || e.Samples != 5 {
+		t.Errorf("after five samples got %+v, want rate 300", e)
+	}
+
+	// Modulus sizes are kept apart; nonsense rates are ignored
+	c.Record(3072, 50, at)
+	c.Record(3072, 0, at)
+	c.Record(3072, -1, at)
+	if e := c.Rate(3072); e == nil || e.Rate != 50 || e.Samples != 1 {
+		t.Errorf("3072-bit entry = %+v, want rate 50 from 1 sample", e)
+	}
+}
+
+func TestCalibrationProfile(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(StateDirEnv, dir)
+
+	if e := CalibratedRate(2048); e != nil {
+		t.Fatalf("missing profile has a rate: %+v", e)
+	}
+
+	// Short solves say more about start-up than about the sustained rate
+	if err := RecordSolveRate(2048, 1000, time.Second); err != nil {
+		t.Fatalf("RecordSolveRate failed: %v", err)
+	}
+	if e := CalibratedRate(2048); e != nil {
+		t.Fatalf("short solve was recorded: %+v", e)
+	}
+
+	if err := RecordSolveRate(2048, 20*500000, 20*time.Second); err != nil {
+		t.Fatalf("RecordSolveRate failed: %v", err)
+	}
+	e := CalibratedRate(2048)
+	if e == nil || e.Rate != 500000 || e.Samples != 1 {
+		t.Fatalf("CalibratedRate = %+v, want 500000 from 1 sample", e)
+	}
+
+	path, err := CalibrationPath()
+	if err != nil {
+		t.Fatalf("CalibrationPath failed: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("profile mode = %v (%v), want 0600", info.Mode().Perm(), err)
+	}
+
+	// A corrupt profile is reported, not silently replaced
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordSolveRate(2048, 20*500000, 20*time.Second); err == nil {
+		t.Errorf("RecordSolveRate overwrote a corrupt profile")
+	}
+	if e := CalibratedRate(2048); e != nil {
+		t.Errorf("corrupt profile has a rate: %+v", e)
+	}
+}
+
+func TestCalibrationFiles(t *testing.T) {
+	t.Setenv(StateDirEnv, t.TempDir())
+	fp := [32]byte{1, 2, 3}
+	if f := CalibratedFile(fp); f != nil {
+		t.Fatalf("missing profile has a file benchmark: %+v", f)
+	}
+
+	if err := RecordSolveRate(2048, 20*500000, 20*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	for _, estimate := range []time.Duration{time.Hour, 2 * time.Hour} {
+		if err := RecordFileBenchmark(fp, &FileCalibration{ModulusBits: 2048, Rate: 400000, Estimate: estimate}); err != nil {
+			t.Fatalf("RecordFileBenchmark failed: %v", err)
+		}
+	}
+
+	// A new benchmark of the same file replaces the old one, and leaves the
+	// solve rates alone
+	if f := CalibratedFile(fp); f == nil || f.Estimate != 2*time.Hour || f.Rate != 400000 {
+		t.Errorf("CalibratedFile = %+v, want the latest benchmark", f)
+	}
+	if f := CalibratedFile([32]byte{9}); f != nil {
+		t.Errorf("another file has benchmark %+v", f)
+	}
+	if e := CalibratedRate(2048); e == nil || e.Rate != 500000 {
+		t.Errorf("CalibratedRate = %+v after a file benchmark, want 500000", e)
+	}
+}
+
+func TestCalibrationProfileExportImport(t *testing.T) {
+	at := time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC)
+	server := &Calibration{Moduli: map[int]*CalibrationEntry{
+		2048: {Rate: 900000, Samples: 4, Updated: at},
+		3072: {Rate: 400000, Samples: 1, Updated: at.Add(-time.Hour)},
+	}}
+	path := filepath.Join(t.TempDir(), "server.json")
+	if err := ExportProfile(server, path, at.Add(time.Minute)); err != nil {
+		t.Fatalf("ExportProfile failed: %v", err)
+	}
+	profile, err := LoadProfile(path)
+	if err != nil {
+		t.Fatalf("LoadProfile failed: %v", err)
+	}
+	h := profile.Host
+	if h == nil || h.Cores != runtime.NumCPU() || h.OS != runtime.GOOS || !h.Measured.Equal(at) || !h.Exported.Equal(at.Add(time.Minute)) {
+		t.Fatalf("Host = %+v", h)
+	}
+	if fmt.Sprint(h.ModulusBits) != "[2048 3072]" {
+		t.Errorf("ModulusBits = %v, want [2048 3072]", h.ModulusBits)
+	}
+	if diffs := h.Mismatch(CurrentHost()); len(diffs) != 0 {
+		t.Errorf("a profile of this host mismatches it: %v", diffs)
+	}
+	other := *h
+	other.CPUModel, other.Cores = "Other CPU", h.Cores+8
+	if h.CPUModel != "" && len(other.Mismatch(CurrentHost())) != 2 {
+		t.Errorf("Mismatch = %v, want CPU model and cores", other.Mismatch(CurrentHost()))
+	}
+	if _, err := LoadProfile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("LoadProfile read a missing profile")
+	}
+
+	// Importing keeps this machine's more recent rates
+	t.Setenv(StateDirEnv, t.TempDir())
+	own, _ := CalibrationPath()
+	local := &Calibration{Moduli: map[int]*CalibrationEntry{3072: {Rate: 300000, Samples: 2, Updated: at}}}
+	if err := SaveCalibration(local, own); err != nil {
+		t.Fatal(err)
+	}
+	_, merged, err := ImportProfile(path)
+	if err != nil {
+		t.Fatalf("ImportProfile failed: %v", err)
+	}
+	if fmt.Sprint(merged) != "[2048]" {
+		t.Errorf("merged %v, want [2048]", merged)
+	}
+	if e := CalibratedRate(2048); e == nil || e.Rate != 900000 || e.Samples != 4 {
+		t.Errorf("2048-bit rate = %+v, want the imported one", e)
+	}
+	if e := CalibratedRate(3072); e == nil || e.Rate != 300000 {
+		t.Errorf("3072-bit rate = %+v, want this machine's", e)
+	}
+	if c, _ := LoadCalibration(own); c.Host != nil {
+		t.Errorf("this machine's profile took the host of the imported one: %+v", c.Host)
+	}
+}
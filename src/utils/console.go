@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PlainProgressInterval is how often a progress bar writes a line of its
+// own when the console cannot redraw one in place (see ConsoleCaps).
+const PlainProgressInterval = 10 * time.Second
+
+// ConsoleCaps describes what the console an output goes to can display.
+// Output that is not a console (a file, a pipe, a Unix terminal) is passed
+// on byte for byte and can do both.
+type ConsoleCaps struct {
+	Redraw bool // \r and ANSI escape sequences redraw a line in place
+	UTF8   bool // UTF-8 text shows as such, not as mojibake
+}
+
+// StdoutConsole returns the capabilities of standard output, enabling
+// escape sequences the first time it is called where that is needed (see
+// Console).
+var StdoutConsole = sync.OnceValue(func() ConsoleCaps { return Console(os.Stdout) })
+
+// Values of the Windows console API, spelt out here so that
+// windowsConsoleCaps builds and is tested on every platform.
+const (
+	enableVirtualTerminalProcessing = 0x0004 // console mode flag
+	codePageUTF8                    = 65001
+)
+
+// consoleAPI is the part of the Windows console API that detecting a
+// console's capabilities needs.
+type consoleAPI interface {
+	GetMode() (uint32, error) // fails unless the handle is a console
+	SetMode(mode uint32) error
+	OutputCP() uint32 // output code page
+}
+
+// windowsConsoleCaps detects the capabilities of a Windows console,
+// enabling virtual terminal processing if it is off.  Classic consoles of
+// Windows before 10 refuse it, and then neither \r nor escape sequences can
+// be relied on.  UTF-8 shows as such only under code page 65001, which is
+// not the default.
+func windowsConsoleCaps(c consoleAPI) ConsoleCaps {
+	mode, err := c.GetMode()
+	if err != nil {
+		return ConsoleCaps{Redraw: true, UTF8: true}
+	}
+	caps := ConsoleCaps{UTF8: c.OutputCP() == codePageUTF8}
+	if mode&enableVirtualTerminalProcessing != 0 || c.SetMode(mode|enableVirtualTerminalProcessing) == nil {
+		caps.Redraw = true
+	}
+	return caps
+}
+
+// asciiFallback spells the decorative characters of the output in ASCII.
+var asciiFallback = strings.NewReplacer(
+	"═", "=",
+	"─", "-",
+	"…", "...",
+	"📁 ", "",
+	"🔒 ", "",
+	"⏰ ", "",
+	"🔢 ", "",
+)
+
+// ASCIIWriter returns w if caps can show UTF-8, and otherwise a writer that
+// spells the decorative characters of the output in ASCII before writing
+// it to w.  Each Write must hold whole characters, as each Printf does.
+func ASCIIWriter(w io.Writer, caps ConsoleCaps) io.Writer {
+	if caps.UTF8 {
+		return w
+	}
+	return asciiWriter{w}
+}
+
+type asciiWriter struct {
+	w io.Writer
+}
+
+func (a asciiWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(a.w, asciiFallback.Replace(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package utils
+
+import "os"
+
+// Console returns the capabilities of the console f writes to.  Outside
+// Windows, terminals redraw lines and the bytes are passed on as they are.
+func Console(f *os.File) ConsoleCaps {
+	return ConsoleCaps{Redraw: true, UTF8: true}
+}
@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeConsole is a consoleAPI whose answers the test sets.
+type fakeConsole struct {
+	mode     uint32
+	notTTY   bool   // GetMode fails, as for a file or pipe
+	refuseVT bool   // SetMode refuses virtual terminal processing
+	cp       uint32 // output code page
+	set      []uint32
+}
+
+func (c *fakeConsole) GetMode() (uint32, error) {
+	if c.notTTY {
+		return 0, errors.New("the handle is invalid")
+	}
+	return c.mode, nil
+}
+
+func (c *fakeConsole) SetMode(mode uint32) error {
+	c.set = append(c.set, mode)
+	if c.refuseVT && mode&enableVirtualTerminalProcessing != 0 {
+		return errors.New("the parameter is incorrect")
+	}
+	c.mode = mode
+	return nil
+}
+
+func (c *fakeConsole) OutputCP() uint32 {
+	return c.cp
+}
+
+func TestWindowsConsoleCaps(t *testing.T) {
+	const processedOutput = 0x0001
+
+	tests := []struct {
+		name    string
+		console fakeConsole
+		want    ConsoleCaps
+		setMode []uint32
+	}{
+		{"redirected", fakeConsole{notTTY: true}, ConsoleCaps{Redraw: true, UTF8: true}, nil},
+		{"terminal already enabled", fakeConsole{mode: enableVirtualTerminalProcessing, cp: codePageUTF8}, ConsoleCaps{Redraw: true, UTF8: true}, nil},
+		{"enabled now", fakeConsole{mode: processedOutput, cp: 437}, ConsoleCaps{Redraw: true}, []uint32{processedOutput | enableVirtualTerminalProcessing}},
+		{"classic console", fakeConsole{mode: processedOutput, refuseVT: true, cp: 850}, ConsoleCaps{}, []uint32{processedOutput | enableVirtualTerminalProcessing}},
+		{"classic console in UTF-8", fakeConsole{mode: processedOutput, refuseVT: true, cp: codePageUTF8}, ConsoleCaps{UTF8: true}, []uint32{processedOutput | enableVirtualTerminalProcessing}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := tc.console
+			if got := windowsConsoleCaps(&c); got != tc.want {
+				t.Errorf("windowsConsoleCaps = %+v, want %+v", got, tc.want)
+			}
+			if fmt.Sprint(c.set) != fmt.Sprint(tc.setMode) {
+				t.Errorf("SetMode calls %v, want %v", c.set, tc.setMode)
+			}
+		})
+	}
+}
+
+func TestASCIIWriter(t *testing.T) {
+	var buf bytes.Buffer
+	if w := ASCIIWriter(&buf, ConsoleCaps{UTF8: true}); w != &buf {
+		t.Error("a UTF-8 console got a wrapped writer")
+	}
+
+	w := ASCIIWriter(&buf, ConsoleCaps{})
+	fmt.Fprintf(w, "══════\n")
+	fmt.Fprintf(w, "📁 FILE INFORMATION\n")
+	fmt.Fprintf(w, "   Fingerprint:    %s… (header only)\n", "ab12")
+	n, err := fmt.Fprintf(w, "⏰ TIME-LOCK PUZZLE ───\n")
+	if err != nil || n != len("⏰ TIME-LOCK PUZZLE ───\n") {
+		t.Errorf("Write returned %d, %v; want the length of its input", n, err)
+	}
+
+	want := "======\nFILE INFORMATION\n   Fingerprint:    ab12... (header only)\nTIME-LOCK PUZZLE ---\n"
+	if buf.String() != want {
+		t.Errorf("ASCII output %q, want %q", buf.String(), want)
+	}
+	for _, r := range buf.String() {
+		if r > 0x7f {
+			t.Errorf("ASCII output holds %q", r)
+		}
+	}
+}
+
+func TestProgressBarLogLines(t *testing.T) {
+	var buf bytes.Buffer
+	pb := NewProgressBar(100)
+	pb.SetOutput(&buf)
+	pb.LogLines(time.Hour)
+
+	// Nothing is written until the interval has passed
+	pb.Update(10)
+	pb.Update(20)
+	if buf.Len() != 0 {
+		t.Errorf("progress lines written within the interval: %q", buf.String())
+	}
+	pb.Printf("Resuming from checkpoint")
+
+	pb.mu.Lock()
+	pb.lastLog = time.Now().Add(-time.Hour)
+	pb.mu.Unlock()
+	pb.Update(50)
+	pb.Update(60)
+	pb.Finish()
+	pb.Finish()
+
+	out := buf.String()
+	if strings.ContainsAny(out, "\r\033") {
+		t.Errorf("log lines hold terminal control codes: %q", out)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected the message, one progress line and the completion, got %q", lines)
+	}
+	if lines[0] != "Resuming from checkpoint" {
+		t.Errorf("message written as %q", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "Progress: 50.0% (50/100)") {
+		t.Errorf("progress line %q", lines[1])
+	}
+	if !strings.HasPrefix(lines[2], "Progress: 100.0% (100/100)") {
+		t.Errorf("completion line %q", lines[2])
+	}
+}
@@ -0,0 +1,33 @@
+//go:build windows
+
+package utils
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Console returns the capabilities of the console f writes to, enabling
+// virtual terminal processing on it if it is off.
+func Console(f *os.File) ConsoleCaps {
+	return windowsConsoleCaps(windowsConsole(f.Fd()))
+}
+
+// windowsConsole is the console API of a handle.
+type windowsConsole windows.Handle
+
+func (c windowsConsole) GetMode() (uint32, error) {
+	var mode uint32
+	err := windows.GetConsoleMode(windows.Handle(c), &mode)
+	return mode, err
+}
+
+func (c windowsConsole) SetMode(mode uint32) error {
+	return windows.SetConsoleMode(windows.Handle(c), mode)
+}
+
+func (c windowsConsole) OutputCP() uint32 {
+	cp, _ := windows.GetConsoleOutputCP()
+	return cp
+}
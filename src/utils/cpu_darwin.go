@@ -0,0 +1,12 @@
+package utils
+
+import "golang.org/x/sys/unix"
+
+// cpuModel returns the processor's brand string, or "" if it is unknown.
+func cpuModel() string {
+	model, err := unix.Sysctl("machdep.cpu.brand_string")
+	if err != nil {
+		return ""
+	}
+	return model
+}
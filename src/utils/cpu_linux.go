@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// cpuModel returns the model name of the first processor in /proc/cpuinfo,
+// or "" if there is none.
+func cpuModel() string {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		// x86 reports "model name"; some ARM kernels only "Hardware"
+		switch strings.TrimSpace(key) {
+		case "model name", "Hardware":
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package utils
+
+// cpuModel is not known on this platform.
+func cpuModel() string {
+	return ""
+}
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ErrNoSpace reports that a filesystem has less free space than an output
+// needs.
+var ErrNoSpace = errors.New("not enough free space")
+
+// CheckWritable makes sure a file of about size bytes can be written into
+// dir before any long work is done: it creates and removes a small file in
+// the nearest existing ancestor of dir (dir itself is created later), and
+// checks the free space there where the platform reports it.  A size of 0
+// skips the free-space check.
+func CheckWritable(dir string, size int64) error {
+	existing, err := nearestDir(dir)
+	if err != nil {
+		return err
+	}
+
+	probe, err := os.CreateTemp(existing, ".cryptotimed-probe-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %v", existing, err)
+	}
+	name := probe.Name()
+	_, err = probe.Write([]byte{0})
+	if closeErr := probe.Close(); err == nil {
+		err = closeErr
+	}
+	os.Remove(name)
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %v", existing, err)
+	}
+
+	free, err := FreeSpace(existing)
+	if err == nil && size > 0 && free < uint64(size) {
+		return fmt.Errorf("%w in %s: %d bytes free, about %d needed", ErrNoSpace, existing, free, size)
+	}
+	return nil
+}
+
+// nearestDir returns dir or its closest ancestor that exists.  An existing
+// ancestor that is not a directory is an error.
+func nearestDir(dir string) (string, error) {
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return "", fmt.Errorf("%s is not a directory", dir)
+			}
+			return dir, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", err
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package utils
+
+import "errors"
+
+// FreeSpace is not supported on this platform.
+func FreeSpace(path string) (uint64, error) {
+	return 0, errors.ErrUnsupported
+}
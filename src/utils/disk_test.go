@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckWritableFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	free, err := FreeSpace(dir)
+	if err != nil {
+		t.Skipf("free space not reported here: %v", err)
+	}
+
+	// The output directory need not exist yet
+	target := filepath.Join(dir, "restored", "deep")
+	if err := CheckWritable(target, 1); err != nil {
+		t.Fatalf("CheckWritable failed: %v", err)
+	}
+	if err := CheckWritable(target, int64(free)+1<<40); !errors.Is(err, ErrNoSpace) {
+		t.Errorf("oversized output: got %v, want ErrNoSpace", err)
+	}
+	if err := CheckWritable(target, 0); err != nil {
+		t.Errorf("size 0 should skip the space check, got %v", err)
+	}
+
+	// No probe files are left behind
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("CheckWritable left %v behind (%v)", entries, err)
+	}
+}
+
+func TestDropFileCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "written")
+	content := []byte("read me back from the disk")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := DropFileCache(path); errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("dropping the page cache is not supported here")
+	} else if err != nil {
+		t.Fatalf("DropFileCache failed: %v", err)
+	}
+
+	// The file itself is untouched
+	got, err := os.ReadFile(path)
+	if err != nil || string(got) != string(content) {
+		t.Fatalf("file changed: %q, %v", got, err)
+	}
+	if err := DropFileCache(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("no error for a missing file")
+	}
+}
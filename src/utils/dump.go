@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+
+	"cryptotimed/src/types"
+)
+
+// DumpDataBytes is how many bytes of the data section DumpHeader shows.
+const DumpDataBytes = 32
+
+// HeaderField is one field of an encrypted file as laid out on disk.
+type HeaderField struct {
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+	Field  string `json:"field"`
+	Raw    []byte `json:"raw"`   // the bytes at Offset (base64 in JSON)
+	Value  string `json:"value"` // what they decode to
+}
+
+// DumpHeader reads the header of an encrypted file from r and returns each
+// of its fields as it is laid out on disk, for whichever format version the
+// file uses: fixed fields, then the tag, length and value of every
+// extension record (including ones this version does not know), the data
+// length and the first DumpDataBytes bytes of the data section.  Fields are
+// read in order; a malformed one ends the dump with a *types.ParseError,
+// the fields before it still returned.  Unlike ReadHeader it does not
+// refuse a newer format version, so that its header can still be seen.
+func DumpHeader(r io.Reader) ([]HeaderField, error) {
+	d := &headerDumper{fr: &fieldReader{r: r}}
+
+	version, err := d.uint32("version", func(v uint32) string { return fmt.Sprintf("%d", v) })
+	if err != nil {
+		return d.fields, err
+	}
+	if version < types.VersionLegacy {
+		return d.fields, d.fr.fail("version", 0, 4, fmt.Errorf("unsupported file format version %d", version))
+	}
+	var minReader uint32
+	if version >= types.VersionMinReader {
+		if minReader, err = d.uint32("minimum reader version", func(v uint32) string { return fmt.Sprintf("%d", v) }); err != nil {
+			return d.fields, err
+		}
+	}
+	if _, err := d.next("work factor", 8, func(b []byte) string {
+		return fmt.Sprintf("%d squarings", binary.LittleEndian.Uint64(b))
+	}); err != nil {
+		return d.fields, err
+	}
+	d.width = types.FixedModulusBytes
+	if minReader >= types.VersionModulusSize {
+		raw, err := d.next("modulus width", 2, func(b []byte) string {
+			return fmt.Sprintf("%d bytes", binary.LittleEndian.Uint16(b))
+		})
+		if err != nil {
+			return d.fields, err
+		}
+		d.width = int(binary.LittleEndian.Uint16(raw))
+		if d.width == 0 || d.width > types.MaxModulusBytes {
+			return d.fields, d.fr.fail("modulus width", d.fr.off-2, 2,
+				fmt.Errorf("invalid modulus width %d, want 1 to %d bytes", d.width, types.MaxModulusBytes))
+		}
+	}
+	bigInt := func(b []byte) string { return fmt.Sprintf("%d-bit integer", new(big.Int).SetBytes(b).BitLen()) }
+	if _, err := d.next("modulus N", d.width, bigInt); err != nil {
+		return d.fields, err
+	}
+	if _, err := d.next("base G", d.width, bigInt); err != nil {
+		return d.fields, err
+	}
+	if _, err := d.next("key required", 1, func(b []byte) string {
+		switch b[0] {
+		case 0:
+			return "no"
+		case 1:
+			return "yes"
+		}
+		return fmt.Sprintf("invalid (%d)", b[0])
+	}); err != nil {
+		return d.fields, err
+	}
+	if _, err := d.next("salt", 16, func(b []byte) string { return fmt.Sprintf("%x", b) }); err != nil {
+		return d.fields, err
+	}
+
+	if version >= 2 {
+		extLen, err := d.uint32("extension length", func(v uint32) string { return fmt.Sprintf("%d bytes", v) })
+		if err != nil {
+			return d.fields, err
+		}
+		if extLen > types.MaxExtensionSize {
+			return d.fields, d.fr.fail("extension length", d.fr.off-4, 4,
+				fmt.Errorf("header extension block of %d bytes exceeds limit of %d", extLen, types.MaxExtensionSize))
+		}
+		if err := d.extensions(int64(extLen)); err != nil {
+			return d.fields, err
+		}
+	}
+
+	dataLen, err := d.next("data length", 8, func(b []byte) string {
+		return fmt.Sprintf("%d bytes", binary.LittleEndian.Uint64(b))
+	})
+	if err != nil {
+		return d.fields, err
+	}
+	size := binary.LittleEndian.Uint64(dataLen)
+	head := make([]byte, min(size, DumpDataBytes))
+	n, err := io.ReadFull(r, head)
+	if n > 0 {
+		d.fields = append(d.fields, HeaderField{
+			Offset: d.fr.off,
+			Length: int64(n),
+			Field:  "data",
+			Raw:    head[:n],
+			Value:  fmt.Sprintf("first %d of %d bytes", n, size),
+		})
+	}
+	if err != nil {
+		return d.fields, d.fr.fail("data", d.fr.off, int64(size), io.ErrUnexpectedEOF)
+	}
+	return d.fields, nil
+}
+
+// headerDumper collects the fields DumpHeader reads.
+type headerDumper struct {
+	fr     *fieldReader
+	fields []HeaderField
+	width  int // byte length of the modulus
+}
+
+// next reads the next field of length bytes and records it with the value
+// describe decodes from it.
+func (d *headerDumper) next(field string, length int, describe func([]byte) string) ([]byte, error) {
+	raw := make([]byte, length)
+	offset := d.fr.off
+	if err := d.fr.read(field, raw); err != nil {
+		return nil, err
+	}
+	d.fields = append(d.fields, HeaderField{Offset: offset, Length: int64(length), Field: field, Raw: raw, Value: describe(raw)})
+	return raw, nil
+}
+
+// uint32 reads the next field as a little-endian uint32.
+func (d *headerDumper) uint32(field string, describe func(uint32) string) (uint32, error) {
+	raw, err := d.next(field, 4, func(b []byte) string { return describe(binary.LittleEndian.Uint32(b)) })
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(raw), nil
+}
+
+// extensions reads the records of an extension block of size bytes.
+func (d *headerDumper) extensions(size int64) error {
+	end := d.fr.off + size
+	for d.fr.off < end {
+		if end-d.fr.off < 5 {
+			return d.fr.fail("extension record", d.fr.off, 5, fmt.Errorf("truncated header extension record"))
+		}
+		tagByte, err := d.next("extension record tag", 1, func(b []byte) string { return types.ExtensionName(b[0]) })
+		if err != nil {
+			return err
+		}
+		tag := tagByte[0]
+		name := types.ExtensionName(tag)
+		raw, err := d.next("extension record length", 4, func(b []byte) string {
+			return fmt.Sprintf("%d bytes", binary.LittleEndian.Uint32(b))
+		})
+		if err != nil {
+			return err
+		}
+		length := int64(binary.LittleEndian.Uint32(raw))
+		if length > end-d.fr.off {
+			return d.fr.fail(name, d.fr.off, length,
+				fmt.Errorf("header extension 0x%02x overruns extension block (%d bytes left)", tag, end-d.fr.off))
+		}
+		if _, err := d.next(name, int(length), func(b []byte) string { return types.DescribeExtension(tag, b, d.width) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ExcludePattern is one pattern of an Excluder, in gitignore syntax.
+type ExcludePattern struct {
+	Source string // the pattern as given
+
+	negate  bool // "!pattern": re-include what an earlier pattern excluded
+	dirOnly bool // "pattern/": only match directories
+	re      *regexp.Regexp
+}
+
+// Excluder decides which paths below a root are left out of a walk, from
+// gitignore-style patterns matched against slash-separated paths relative to
+// the root:
+//
+//   - a pattern without a slash, other than a trailing one, matches a name at
+//     any depth; one with a slash is anchored at the root (a leading slash
+//     only anchors it);
+//   - a trailing slash matches only directories;
+//   - * and ? match within a name, [...] a class of characters, and **
+//     any number of directories ("**/x", "x/**", "a/**/b");
+//   - ! re-includes what an earlier pattern excluded, and the last matching
+//     pattern decides.
+//
+// As with git, nothing below an excluded directory can be re-included:
+// walks skip excluded directories whole.
+type Excluder struct {
+	patterns []ExcludePattern
+}
+
+// NewExcluder compiles patterns, skipping blank lines and # comments as an
+// ignore file would.
+func NewExcluder(patterns []string) (*Excluder, error) {
+	e := &Excluder{}
+	for _, p := range patterns {
+		pattern, ok, err := parseExcludePattern(p)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			e.patterns = append(e.patterns, pattern)
+		}
+	}
+	return e, nil
+}
+
+// ReadExcludeFile returns the lines of a gitignore-style file, for
+// NewExcluder.
+func ReadExcludeFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSuffix(scanner.Text(), "\r"))
+	}
+	return lines, scanner.Err()
+}
+
+// Empty reports whether e excludes nothing.
+func (e *Excluder) Empty() bool {
+	return e == nil || len(e.patterns) == 0
+}
+
+// Match reports whether the path rel (slash-separated, relative to the root)
+// is excluded and, if so, the pattern that excluded it.
+func (e *Excluder) Match(rel string, isDir bool) (string, bool) {
+	if e == nil {
+		return "", false
+	}
+	for i := len(e.patterns) - 1; i >= 0; i-- {
+		p := &e.patterns[i]
+		if p.dirOnly && !isDir || !p.re.MatchString(rel) {
+			continue
+		}
+		if p.negate {
+			return "", false
+		}
+		return p.Source, true
+	}
+	return "", false
+}
+
+// parseExcludePattern compiles one line of gitignore syntax; ok is false for
+// a blank line or comment.
+func parseExcludePattern(line string) (pattern ExcludePattern, ok bool, err error) {
+	pattern.Source = line
+
+	// Trailing spaces are dropped unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return pattern, false, nil
+	}
+	pattern.Source = line
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return pattern, false, fmt.Errorf("invalid exclude pattern %q: it names no path", pattern.Source)
+	}
+
+	expr, err := globRegexp(line)
+	if err != nil {
+		return pattern, false, fmt.Errorf("invalid exclude pattern %q: %v", pattern.Source, err)
+	}
+	if !anchored {
+		expr = "(?:.*/)?" + expr
+	}
+	pattern.re, err = regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return pattern, false, fmt.Errorf("invalid exclude pattern %q: %v", pattern.Source, err)
+	}
+	return pattern, true, nil
+}
+
+// globRegexp translates a gitignore glob into a regular expression.
+func globRegexp(glob string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			b.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated character class")
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, "\\", "\\\\") + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String(), nil
+}
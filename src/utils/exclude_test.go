@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestExcluderMatch(t *testing.T) {
+	e, err := NewExcluder([]string{
+		"# build output",
+		"",
+		"*.o",
+		"node_modules/",
+		"/build",
+		"docs/*.tmp",
+		"**/cache/**",
+		"a/**/z",
+		"!keep.o",
+		"\\#notes  ",
+		"file?.[ch]",
+	})
+	if err != nil {
+		t.Fatalf("NewExcluder failed: %v", err)
+	}
+
+	cases := []struct {
+		path    string
+		isDir   bool
+		pattern string // "" if not excluded
+	}{
+		{"main.o", false, "*.o"},
+		{"src/deep/util.o", false, "*.o"},
+		{"keep.o", false, ""},
+		{"src/keep.o", false, ""},
+		{"main.c", false, ""},
+		{"node_modules", true, "node_modules/"},
+		{"web/node_modules", true, "node_modules/"},
+		{"node_modules", false, ""}, // a file of that name
+		{"build", true, "/build"},
+		{"src/build", true, ""}, // anchored at the root
+		{"docs/a.tmp", false, "docs/*.tmp"},
+		{"docs/sub/a.tmp", false, ""}, // * does not cross directories
+		{"x/cache/y/z.bin", false, "**/cache/**"},
+		{"cache/z.bin", false, "**/cache/**"},
+		{"cache", true, ""}, // only what is inside
+		{"a/z", false, "a/**/z"},
+		{"a/b/c/z", false, "a/**/z"},
+		{"#notes", false, "\\#notes"},
+		{"file1.c", false, "file?.[ch]"},
+		{"file1.s", false, ""},
+		{"file12.c", false, ""},
+	}
+	for _, tc := range cases {
+		pattern, excluded := e.Match(tc.path, tc.isDir)
+		if excluded != (tc.pattern != "") || pattern != tc.pattern {
+			t.Errorf("Match(%q, %v) = %q, %v; want %q", tc.path, tc.isDir, pattern, excluded, tc.pattern)
+		}
+	}
+}
+
+func TestExcluderInvalidPatterns(t *testing.T) {
+	for _, p := range []string{"/", "data[0-9", "!"} {
+		if _, err := NewExcluder([]string{p}); err == nil {
+			t.Errorf("NewExcluder(%q) accepted an invalid pattern", p)
+		}
+	}
+	var e *Excluder
+	if !e.Empty() {
+		t.Error("a nil excluder is not empty")
+	}
+	if _, excluded := e.Match("a", false); excluded {
+		t.Error("a nil excluder excludes")
+	}
+}
+
+func TestReadExcludeFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), ".cryptoignore")
+	if err := os.WriteFile(name, []byte("# comment\r\n*.log\r\n\r\n/dist/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lines, err := ReadExcludeFile(name)
+	if err != nil {
+		t.Fatalf("ReadExcludeFile failed: %v", err)
+	}
+	if want := []string{"# comment", "*.log", "", "/dist/"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("ReadExcludeFile = %q, want %q", lines, want)
+	}
+}
@@ -1,11 +1,21 @@
 package utils
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"math"
 	"math/big"
 	"os"
+	"strings"
+	"time"
 
 	"cryptotimed/src/crypto"
 	"cryptotimed/src/types"
@@ -23,92 +33,347 @@ func WriteFile(filename string, data []byte) error {
 
 // WriteEncryptedFile writes an EncryptedFile structure to disk in binary format
 func WriteEncryptedFile(filename string, ef *types.EncryptedFile) error {
-	var buf bytes.Buffer
+	return WriteEncryptedFileFS(OS, filename, ef)
+}
 
-	// Write header fields in binary format
-	if err := binary.Write(&buf, binary.LittleEndian, ef.Version); err != nil {
-		return err
-	}
-	if err := binary.Write(&buf, binary.LittleEndian, ef.WorkFactor); err != nil {
-		return err
-	}
-	if err := binary.Write(&buf, binary.LittleEndian, ef.ModulusN); err != nil {
-		return err
-	}
-	if err := binary.Write(&buf, binary.LittleEndian, ef.BaseG); err != nil {
-		return err
-	}
-	if err := binary.Write(&buf, binary.LittleEndian, ef.KeyRequired); err != nil {
+// WriteEncryptedFileFS writes an EncryptedFile structure to fsys in binary
+// format.
+func WriteEncryptedFileFS(fsys WriteFS, filename string, ef *types.EncryptedFile) error {
+	data, err := EncodeEncryptedFile(ef)
+	if err != nil {
 		return err
 	}
-	if err := binary.Write(&buf, binary.LittleEndian, ef.Salt); err != nil {
-		return err
+	return fsys.WriteFile(filename, data, 0644)
+}
+
+// EncodeEncryptedFile returns the binary format of an EncryptedFile, as
+// written by WriteEncryptedFile and read by ParseEncryptedFile.
+func EncodeEncryptedFile(ef *types.EncryptedFile) ([]byte, error) {
+	var buf bytes.Buffer
+
+	// Write header fields in binary format
+	if _, err := ef.Header().WriteTo(&buf); err != nil {
+		return nil, err
 	}
 
 	// Write data length and data
 	dataLen := uint64(len(ef.Data))
 	if err := binary.Write(&buf, binary.LittleEndian, dataLen); err != nil {
-		return err
+		return nil, err
 	}
 	if _, err := buf.Write(ef.Data); err != nil {
-		return err
+		return nil, err
 	}
 
-	return WriteFile(filename, buf.Bytes())
+	return buf.Bytes(), nil
 }
 
 // ReadEncryptedFile reads an EncryptedFile structure from disk
 func ReadEncryptedFile(filename string) (*types.EncryptedFile, error) {
-	data, err := ReadFile(filename)
+	return ReadEncryptedFileFS(OS, filename)
+}
+
+// ReadEncryptedFileFS reads an EncryptedFile structure from fsys
+func ReadEncryptedFileFS(fsys fs.FS, filename string) (*types.EncryptedFile, error) {
+	data, err := fs.ReadFile(fsys, filename)
 	if err != nil {
 		return nil, err
 	}
+	return ParseEncryptedFile(data)
+}
+
+// ReadEncryptedFileMapped reads an EncryptedFile whose Data section aliases a
+// memory mapping of the file (for large files).  The returned MappedFile must
+// be closed once ef.Data is no longer needed, and the data should be accessed
+// inside its Access method.
+func ReadEncryptedFileMapped(filename string) (*types.EncryptedFile, *MappedFile, error) {
+	return ReadEncryptedFileMappedFS(OS, filename)
+}
+
+// ReadEncryptedFileMappedFS is ReadEncryptedFileMapped for a file in fsys.
+// Only files of the OS filesystem are memory-mapped.  A file of another
+// filesystem that can be read at an offset, such as a range reader over
+// object storage, is read with ReadEncryptedFileFromReaderAt.
+func ReadEncryptedFileMappedFS(fsys fs.FS, filename string) (*types.EncryptedFile, *MappedFile, error) {
+	if !IsOS(fsys) {
+		f, err := fsys.Open(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		if r, ok := f.(io.ReaderAt); ok {
+			info, err := f.Stat()
+			if err != nil {
+				return nil, nil, err
+			}
+			ef, err := ReadEncryptedFileFromReaderAt(r, info.Size())
+			if err != nil {
+				return nil, nil, err
+			}
+			return ef, &MappedFile{fsys: fsys, path: filename, size: info.Size(), modTime: info.ModTime()}, nil
+		}
+	}
+	m, err := OpenMappedFS(fsys, filename)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	buf := bytes.NewReader(data)
-	ef := &types.EncryptedFile{}
+	var ef *types.EncryptedFile
+	err = m.Access(func(data []byte) error {
+		var err error
+		ef, err = ParseEncryptedFile(data)
+		return err
+	})
+	if err != nil {
+		m.Close()
+		return nil, nil, err
+	}
+	return ef, m, nil
+}
+
+// ReadFileHeader reads only the header of an encrypted file on disk, without
+// reading its data section.
+func ReadFileHeader(filename string) (*types.FileHeader, error) {
+	return ReadFileHeaderFS(OS, filename)
+}
+
+// ReadFileHeaderFS reads only the header of an encrypted file in fsys.
+func ReadFileHeaderFS(fsys fs.FS, filename string) (*types.FileHeader, error) {
+	f, err := fsys.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadHeader(bufio.NewReader(f))
+}
+
+// ReadFileHeaderFromReaderAt reads only the header of an encrypted file of
+// size bytes from r, such as a range reader over object storage, and the
+// length of the data section it declares, checked against size.  Each field
+// is read as it is reached, so nothing past the data length is fetched.
+func ReadFileHeaderFromReaderAt(r io.ReaderAt, size int64) (*types.FileHeader, int64, error) {
+	header, _, dataLen, err := readHeaderAt(r, size)
+	return header, dataLen, err
+}
+
+// ReadEncryptedFileFromReaderAt reads an encrypted file of size bytes from
+// r, as ParseEncryptedFile parses one in memory.  The header is read and
+// checked before the data section is fetched, in one read, into memory of
+// its own.
+func ReadEncryptedFileFromReaderAt(r io.ReaderAt, size int64) (*types.EncryptedFile, error) {
+	header, start, dataLen, err := readHeaderAt(r, size)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, dataLen)
+	if n, err := r.ReadAt(data, start); n < len(data) {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, &types.ParseError{Field: "data", Offset: start, Length: dataLen, Err: err}
+	}
+	return types.NewEncryptedFile(header, data), nil
+}
+
+// ReadEncryptedFileMappedFromReaderAt is ReadEncryptedFileFromReaderAt
+// returning, like ReadEncryptedFileMapped, a MappedFile for the data to be
+// accessed through.  Nothing is held open, so there is nothing to close, and
+// the data is taken to stay as read.
+func ReadEncryptedFileMappedFromReaderAt(r io.ReaderAt, size int64) (*types.EncryptedFile, *MappedFile, error) {
+	ef, err := ReadEncryptedFileFromReaderAt(r, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ef, &MappedFile{size: size}, nil
+}
+
+// readHeaderAt reads the header and data length field of an encrypted file
+// of size bytes from r, and returns them with the offset of the data
+// section.
+func readHeaderAt(r io.ReaderAt, size int64) (*types.FileHeader, int64, int64, error) {
+	fr := &fieldReader{r: io.NewSectionReader(r, 0, size)}
+	header, err := readHeader(fr)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	var dataLen uint64
+	if err := fr.read("data length", &dataLen); err != nil {
+		return nil, 0, 0, err
+	}
+	start := fr.off
+	if dataLen > uint64(size-start) {
+		return nil, 0, 0, fr.fail("data", start, int64(min(dataLen, math.MaxInt64)),
+			fmt.Errorf("%w: %d bytes left", io.ErrUnexpectedEOF, size-start))
+	}
+	return header, start, int64(dataLen), nil
+}
+
+// ParseEncryptedFile parses a complete encrypted file held in memory.  The
+// returned Data section aliases data rather than copying it.  A malformed
+// file fails with a *types.ParseError.
+func ParseEncryptedFile(data []byte) (*types.EncryptedFile, error) {
+	r := &fieldReader{r: bytes.NewReader(data)}
+
+	// Read the fixed header
+	header, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read data length
+	var dataLen uint64
+	if err := r.read("data length", &dataLen); err != nil {
+		return nil, err
+	}
+	start := r.off
+	if dataLen > uint64(int64(len(data))-start) {
+		return nil, r.fail("data", start, int64(dataLen),
+			fmt.Errorf("%w: %d bytes left", io.ErrUnexpectedEOF, int64(len(data))-start))
+	}
+
+	// Slice out the data section
+	end := start + int64(dataLen)
+	efData := data[start:end:end]
+
+	return types.NewEncryptedFile(header, efData), nil
+}
+
+// ReadHeader reads the file header (including any version 2 extensions) from
+// r, leaving r positioned at the start of the data length field.  It does not
+// read or allocate the data section, so it is cheap even for very large files.
+// A malformed header fails with a *types.ParseError.
+func ReadHeader(r io.Reader) (*types.FileHeader, error) {
+	return readHeader(&fieldReader{r: r})
+}
+
+func readHeader(r *fieldReader) (*types.FileHeader, error) {
+	h := &types.FileHeader{}
 
 	// Read version first to determine file format
-	if err := binary.Read(buf, binary.LittleEndian, &ef.Version); err != nil {
+	if err := r.read("version", &h.Version); err != nil {
 		return nil, err
 	}
+	if h.Version < types.VersionLegacy {
+		return nil, r.fail("version", 0, 4, fmt.Errorf("unsupported file format version %d", h.Version))
+	}
+
+	// Version 3+: newer formats are readable if their minimum reader version is
+	if h.Version >= types.VersionMinReader {
+		if err := r.read("minimum reader version", &h.MinReaderVersion); err != nil {
+			return nil, err
+		}
+		if h.MinReaderVersion < types.VersionMinReader || h.MinReaderVersion > h.Version {
+			return nil, r.fail("minimum reader version", r.off-4, 4,
+				fmt.Errorf("corrupt header: minimum reader version %d for format version %d", h.MinReaderVersion, h.Version))
+		}
+		if h.MinReaderVersion > types.CurrentVersion {
+			return nil, r.fail("minimum reader version", r.off-4, 4,
+				fmt.Errorf("this file requires cryptotimed format v%d support (this version reads up to v%d)", h.MinReaderVersion, types.CurrentVersion))
+		}
+	}
 
 	// Read common fields
-	if err := binary.Read(buf, binary.LittleEndian, &ef.WorkFactor); err != nil {
+	if err := r.read("work factor", &h.WorkFactor); err != nil {
 		return nil, err
 	}
-	if err := binary.Read(buf, binary.LittleEndian, &ef.ModulusN); err != nil {
+	width := types.FixedModulusBytes
+	sized := h.SizedModulus()
+	if sized {
+		var w uint16
+		if err := r.read("modulus width", &w); err != nil {
+			return nil, err
+		}
+		if width = int(w); width == 0 || width > types.MaxModulusBytes {
+			return nil, r.fail("modulus width", r.off-2, 2, fmt.Errorf("invalid modulus width %d, want 1 to %d bytes", width, types.MaxModulusBytes))
+		}
+	}
+	h.ModulusN, h.BaseG = make([]byte, width), make([]byte, width)
+	if err := r.read("modulus N", h.ModulusN); err != nil {
 		return nil, err
 	}
-	if err := binary.Read(buf, binary.LittleEndian, &ef.BaseG); err != nil {
+	switch {
+	case sized && h.ModulusN[0] == 0:
+		return nil, r.fail("modulus N", r.off-int64(width), int64(width), errors.New("corrupt header: the modulus has leading zero bytes"))
+	case !sized && h.SizedModulus():
+		return nil, r.fail("modulus N", r.off-int64(width), int64(width),
+			fmt.Errorf("corrupt header: a %d-bit modulus in the fixed fields", h.Modulus().BitLen()))
+	}
+	if err := r.read("base G", h.BaseG); err != nil {
 		return nil, err
 	}
-	if err := binary.Read(buf, binary.LittleEndian, &ef.KeyRequired); err != nil {
+	if err := r.read("key required", &h.KeyRequired); err != nil {
 		return nil, err
 	}
-
-	if err := binary.Read(buf, binary.LittleEndian, &ef.Salt); err != nil {
+	if err := r.read("salt", &h.Salt); err != nil {
 		return nil, err
 	}
+	if h.Version < 2 {
+		return h, nil
+	}
 
-	// Read data length
-	var dataLen uint64
-	if err := binary.Read(buf, binary.LittleEndian, &dataLen); err != nil {
+	// Version 2+: length-prefixed extension block
+	var extLen uint32
+	if err := r.read("extension length", &extLen); err != nil {
 		return nil, err
 	}
-
-	// Read data
-	ef.Data = make([]byte, dataLen)
-	if _, err := io.ReadFull(buf, ef.Data); err != nil {
+	if extLen > types.MaxExtensionSize {
+		return nil, r.fail("extension length", r.off-4, 4, fmt.Errorf("header extension block too large (%d bytes)", extLen))
+	}
+	ext := make([]byte, extLen)
+	start := r.off
+	if err := r.read("extension block", ext); err != nil {
 		return nil, err
 	}
+	if err := h.DecodeExtensions(ext); err != nil {
+		var pe *types.ParseError
+		if errors.As(err, &pe) {
+			pe.Offset += start
+			return nil, pe
+		}
+		return nil, r.fail("extension block", start, int64(extLen), err)
+	}
 
-	return ef, nil
+	return h, nil
+}
+
+// fieldReader reads the fields of an encrypted file, keeping track of the
+// offset so failures can say where they happened.
+type fieldReader struct {
+	r   io.Reader
+	off int64
+}
+
+// read reads the fixed-size value v (see binary.Read) as field.
+func (f *fieldReader) read(field string, v any) error {
+	var size int64
+	var err error
+	if b, ok := v.([]byte); ok {
+		size = int64(len(b))
+		_, err = io.ReadFull(f.r, b)
+	} else {
+		size = int64(binary.Size(v))
+		err = binary.Read(f.r, binary.LittleEndian, v)
+	}
+	if err == io.EOF && size > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return f.fail(field, f.off, size, err)
+	}
+	f.off += size
+	return nil
+}
+
+// fail returns the error of a field of length bytes at offset.
+func (f *fieldReader) fail(field string, offset, length int64, err error) *types.ParseError {
+	return &types.ParseError{Field: field, Offset: offset, Length: length, Err: err}
 }
 
 // PuzzleFromEncryptedFile extracts a crypto.Puzzle from an EncryptedFile
 func PuzzleFromEncryptedFile(ef *types.EncryptedFile) crypto.Puzzle {
-	N := new(big.Int).SetBytes(ef.ModulusN[:])
-	G := new(big.Int).SetBytes(ef.BaseG[:])
+	h := ef.Header()
+	N := h.Modulus()
+	G := h.Base()
 
 	puzzle := crypto.Puzzle{
 		N: N,
@@ -122,24 +387,39 @@ func PuzzleFromEncryptedFile(ef *types.EncryptedFile) crypto.Puzzle {
 	if ef.KeyRequired == 1 {
 		puzzle.KdfID = 1 // Argon2id
 		puzzle.KdfParams = crypto.DefaultArgon2idParams
+		if ef.Ext.BaseTweak != nil {
+			fileID := [crypto.FileIDSize]byte(ef.Ext.BaseTweak.FileID)
+			puzzle.FileID = &fileID
+		}
 	}
 
 	return puzzle
 }
 
-// PuzzleToBytes converts puzzle components to byte arrays for storage
-func PuzzleToBytes(puzzle crypto.Puzzle) ([types.Rsa2048Bytes]byte, [types.Rsa2048Bytes]byte) {
-	var nBytes, gBytes [types.Rsa2048Bytes]byte
-
-	// Convert N to bytes (big-endian, zero-padded)
-	nBytesSlice := puzzle.N.FillBytes(make([]byte, types.Rsa2048Bytes))
-	copy(nBytes[:], nBytesSlice)
-
-	// Convert G to bytes (big-endian, zero-padded)
-	gBytesSlice := puzzle.G.FillBytes(make([]byte, types.Rsa2048Bytes))
-	copy(gBytes[:], gBytesSlice)
+// AndPuzzlesFromHeader returns the further puzzles of a file whose key
+// needs several solved (see types.AndPuzzles), in order: nil for a file of
+// one puzzle.
+func AndPuzzlesFromHeader(h *types.FileHeader) []crypto.Puzzle {
+	if h.Ext.AndPuzzles == nil {
+		return nil
+	}
+	var puzzles []crypto.Puzzle
+	for _, p := range h.Ext.AndPuzzles.Puzzles {
+		puzzles = append(puzzles, crypto.Puzzle{
+			N: new(big.Int).SetBytes(p.ModulusN),
+			G: new(big.Int).SetBytes(p.BaseG),
+			T: p.WorkFactor,
+		})
+	}
+	return puzzles
+}
 
-	return nBytes, gBytes
+// PuzzleToBytes converts puzzle components to big-endian bytes for
+// storage, both zero-padded to the byte length of N (of G if wider, which
+// no valid puzzle's is).
+func PuzzleToBytes(puzzle crypto.Puzzle) (nBytes, gBytes []byte) {
+	width := max(crypto.ModulusBytes(puzzle.N), crypto.ModulusBytes(puzzle.G))
+	return puzzle.N.FillBytes(make([]byte, width)), puzzle.G.FillBytes(make([]byte, width))
 }
 
 // ParseKeyInput parses key input from CLI, supporting both direct strings and @file:path syntax
@@ -158,7 +438,138 @@ func ParseKeyInput(keyInput string) ([]byte, error) {
 	return []byte(keyInput), nil
 }
 
+// DataKeySize is the size of an externally supplied data key.
+const DataKeySize = 32
+
+// ParseDataKey parses a 32-byte data key given as hex or base64, or as
+// @file:path to a file holding the key in either encoding or as raw bytes.
+func ParseDataKey(input string) ([DataKeySize]byte, error) {
+	var key [DataKeySize]byte
+	text := input
+	if strings.HasPrefix(input, "@file:") {
+		data, err := ReadFile(input[6:])
+		if err != nil {
+			return key, err
+		}
+		if len(data) == DataKeySize {
+			copy(key[:], data)
+			return key, nil
+		}
+		text = string(data)
+	}
+	text = strings.TrimSpace(text)
+
+	decoded, err := hex.DecodeString(text)
+	if err != nil {
+		for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+			if decoded, err = enc.DecodeString(text); err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return key, fmt.Errorf("data key is neither hex nor base64")
+	}
+	if len(decoded) != DataKeySize {
+		return key, fmt.Errorf("data key is %d bytes, want %d", len(decoded), DataKeySize)
+	}
+	copy(key[:], decoded)
+	return key, nil
+}
+
 // GetFileInfo returns file information
 func GetFileInfo(filename string) (os.FileInfo, error) {
 	return os.Stat(filename)
 }
+
+// stateMagic starts every checkpoint file written by SaveState.
+const stateMagic = "CTRESUME"
+
+// stateVersion is the checkpoint format version.
+const stateVersion = 1
+
+// maxStateIntBytes bounds the integers in a checkpoint file.
+const maxStateIntBytes = 1 << 16
+
+// SaveState writes a solving checkpoint to path atomically, readable only by
+// the owner.  The file holds (little-endian): the magic "CTRESUME", a version
+// byte, the puzzle fingerprint, T, the squarings done, the time of the
+// snapshot in Unix nanoseconds, N, G and the intermediate value (each a
+// 4-byte length and big-endian bytes), and a SHA-256 of all of the above.
+func SaveState(state crypto.SolvingState, path string) error {
+	if state.Puzzle.N == nil || state.Puzzle.G == nil || state.Result == nil {
+		return fmt.Errorf("incomplete solving state")
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(stateMagic)
+	buf.WriteByte(stateVersion)
+	fp := state.Puzzle.Fingerprint()
+	buf.Write(fp[:])
+	binary.Write(&buf, binary.LittleEndian, state.Puzzle.T)
+	binary.Write(&buf, binary.LittleEndian, state.Done)
+	binary.Write(&buf, binary.LittleEndian, state.Updated.UnixNano())
+	for _, n := range []*big.Int{state.Puzzle.N, state.Puzzle.G, state.Result} {
+		b := n.Bytes()
+		binary.Write(&buf, binary.LittleEndian, uint32(len(b)))
+		buf.Write(b)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+
+	return writeFileAtomic(path, buf.Bytes(), 0600)
+}
+
+// LoadState reads a checkpoint written by SaveState.  It checks the file's
+// integrity but not which puzzle it belongs to; see SolvingState.Matches.
+func LoadState(path string) (crypto.SolvingState, error) {
+	var state crypto.SolvingState
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return state, err
+	}
+
+	if len(data) < len(stateMagic)+1+32+24+sha256.Size || string(data[:len(stateMagic)]) != stateMagic {
+		return state, fmt.Errorf("%s is not a checkpoint file", path)
+	}
+	body, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if expected := sha256.Sum256(body); !bytes.Equal(sum, expected[:]) {
+		return state, fmt.Errorf("checkpoint %s is corrupted", path)
+	}
+	r := bytes.NewReader(body[len(stateMagic):])
+	version, _ := r.ReadByte()
+	if version != stateVersion {
+		return state, fmt.Errorf("unsupported checkpoint version %d", version)
+	}
+
+	var fp [32]byte
+	var updated int64
+	io.ReadFull(r, fp[:])
+	binary.Read(r, binary.LittleEndian, &state.Puzzle.T)
+	binary.Read(r, binary.LittleEndian, &state.Done)
+	binary.Read(r, binary.LittleEndian, &updated)
+	state.Updated = time.Unix(0, updated)
+
+	ints := make([]*big.Int, 3)
+	for i := range ints {
+		var n uint32
+		if err := binary.Read(r, binary.LittleEndian, &n); err != nil || n > maxStateIntBytes || int(n) > r.Len() {
+			return crypto.SolvingState{}, fmt.Errorf("checkpoint %s is truncated", path)
+		}
+		b := make([]byte, n)
+		io.ReadFull(r, b)
+		ints[i] = new(big.Int).SetBytes(b)
+	}
+	if r.Len() != 0 {
+		return crypto.SolvingState{}, fmt.Errorf("checkpoint %s has trailing data", path)
+	}
+	state.Puzzle.N, state.Puzzle.G, state.Result = ints[0], ints[1], ints[2]
+
+	if state.Puzzle.Fingerprint() != fp {
+		return crypto.SolvingState{}, fmt.Errorf("checkpoint %s does not match its fingerprint", path)
+	}
+	if err := state.Matches(state.Puzzle); err != nil {
+		return crypto.SolvingState{}, fmt.Errorf("checkpoint %s: %v", path, err)
+	}
+	return state, nil
+}
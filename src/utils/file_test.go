@@ -2,9 +2,19 @@ package utils
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
 	"math/big"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"cryptotimed/src/crypto"
@@ -21,15 +31,18 @@ func TestWriteReadEncryptedFile(t *testing.T) {
 
 	// Create test encrypted file
 	ef := &types.EncryptedFile{
-		Version:     types.CurrentVersion,
-		WorkFactor:  12345,
-		KeyRequired: 1,
-		Data:        []byte("test encrypted data"),
+		Version:          types.CurrentVersion,
+		MinReaderVersion: types.VersionMinReader,
+		WorkFactor:       12345,
+		ModulusN:         make([]byte, types.FixedModulusBytes),
+		BaseG:            make([]byte, types.FixedModulusBytes),
+		KeyRequired:      1,
+		Data:             []byte("test encrypted data"),
 	}
 
 	// Fill in some test values for the arrays
-	for i := 0; i < types.Rsa2048Bytes; i++ {
-		ef.ModulusN[i] = byte(i % 256)
+	for i := 0; i < types.FixedModulusBytes; i++ {
+		ef.ModulusN[i] = byte(255 - i%256)
 		ef.BaseG[i] = byte((i + 100) % 256)
 	}
 	for i := 0; i < 16; i++ {
@@ -62,10 +75,10 @@ func TestWriteReadEncryptedFile(t *testing.T) {
 	if ef2.Salt != ef.Salt {
 		t.Errorf("Salt mismatch")
 	}
-	if ef2.ModulusN != ef.ModulusN {
+	if !bytes.Equal(ef2.ModulusN, ef.ModulusN) {
 		t.Errorf("ModulusN mismatch")
 	}
-	if ef2.BaseG != ef.BaseG {
+	if !bytes.Equal(ef2.BaseG, ef.BaseG) {
 		t.Errorf("BaseG mismatch")
 	}
 	if !bytes.Equal(ef2.Data, ef.Data) {
@@ -75,7 +88,7 @@ func TestWriteReadEncryptedFile(t *testing.T) {
 
 func TestPuzzleFromEncryptedFile(t *testing.T) {
 	// Generate a real puzzle for testing
-	originalPuzzle, _, err := crypto.GeneratePuzzle(100, nil) // No password for test
+	originalPuzzle, _, err := crypto.GeneratePuzzle(100, nil, crypto.DefaultModulusBits) // No password for test
 	if err != nil {
 		t.Fatalf("Failed to generate puzzle: %v", err)
 	}
@@ -129,6 +142,69 @@ func TestPuzzleToBytes(t *testing.T) {
 	}
 }
 
+// TestModulusSizeRoundTrip checks that moduli of other sizes than 2048
+// bits are stored at their own width, read back whole, and make the file
+// need a reader of that format.
+func TestModulusSizeRoundTrip(t *testing.T) {
+	for _, bits := range []int{1024, 4096} {
+		N := new(big.Int).Add(new(big.Int).Lsh(big.NewInt(1), uint(bits-1)), big.NewInt(12345))
+		G := new(big.Int).Lsh(big.NewInt(3), uint(bits-100))
+		h := &types.FileHeader{Version: types.CurrentVersion, WorkFactor: 100, Ext: types.HeaderExtensions{ChunkSize: 4096}}
+		if err := h.SetModulus(N, G); err != nil {
+			t.Fatalf("SetModulus failed: %v", err)
+		}
+		if len(h.ModulusN) != bits/8 || len(h.BaseG) != bits/8 {
+			t.Errorf("%d-bit modulus stored in %d and %d bytes, want %d", bits, len(h.ModulusN), len(h.BaseG), bits/8)
+		}
+		h.MinReaderVersion = types.VersionMinReader
+		if _, err := h.WriteTo(io.Discard); err == nil {
+			t.Errorf("a %d-bit modulus was written for readers of version %d", bits, h.MinReaderVersion)
+		}
+		h.MinReaderVersion = h.RequiredReaderVersion()
+		if h.MinReaderVersion != types.VersionModulusSize {
+			t.Errorf("minimum reader version %d, want %d", h.MinReaderVersion, types.VersionModulusSize)
+		}
+		if want := types.HeaderSize - 2*types.FixedModulusBytes + 2 + bits/4 + 4 + 4 + 9; h.Size() != want {
+			t.Errorf("%d-bit header is %d bytes, want %d", bits, h.Size(), want)
+		}
+
+		encoded, err := EncodeEncryptedFile(types.NewEncryptedFile(h, []byte("data")))
+		if err != nil {
+			t.Fatalf("EncodeEncryptedFile failed: %v", err)
+		}
+		if len(encoded) != h.Size()+8+4 {
+			t.Errorf("encoded %d bytes, want %d", len(encoded), h.Size()+8+4)
+		}
+		ef, err := ParseEncryptedFile(encoded)
+		if err != nil {
+			t.Fatalf("ParseEncryptedFile failed: %v", err)
+		}
+		puzzle := PuzzleFromEncryptedFile(ef)
+		if puzzle.N.Cmp(N) != 0 || puzzle.G.Cmp(G) != 0 || string(ef.Data) != "data" || ef.Ext.ChunkSize != 4096 {
+			t.Errorf("the %d-bit modulus, base or what follows changed in the round trip", bits)
+		}
+	}
+
+	// The width of a sized modulus must match its leading byte
+	h := &types.FileHeader{Version: types.CurrentVersion, WorkFactor: 100}
+	if err := h.SetModulus(new(big.Int).Lsh(big.NewInt(1), 1023), big.NewInt(2)); err != nil {
+		t.Fatalf("SetModulus failed: %v", err)
+	}
+	h.MinReaderVersion = h.RequiredReaderVersion()
+	var buf bytes.Buffer
+	if _, err := h.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	encoded := buf.Bytes()
+	binary.LittleEndian.PutUint16(encoded[16:], 129)
+	if _, err := ReadHeader(bytes.NewReader(append(encoded[:18:18], append([]byte{0}, encoded[18:]...)...))); err == nil {
+		t.Error("read a modulus with a leading zero byte")
+	}
+	if err := h.SetModulus(h.Modulus(), h.Modulus()); err == nil {
+		t.Error("SetModulus accepted a base not less than the modulus")
+	}
+}
+
 func TestParseKeyInput(t *testing.T) {
 	// Test empty input
 	result, err := ParseKeyInput("")
@@ -178,6 +254,50 @@ func TestParseKeyInput(t *testing.T) {
 	}
 }
 
+func TestParseDataKey(t *testing.T) {
+	var want [DataKeySize]byte
+	for i := range want {
+		want[i] = byte(i * 7)
+	}
+	tempDir := t.TempDir()
+	rawFile := filepath.Join(tempDir, "raw.key")
+	if err := os.WriteFile(rawFile, want[:], 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	hexFile := filepath.Join(tempDir, "hex.key")
+	if err := os.WriteFile(hexFile, []byte(hex.EncodeToString(want[:])+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+
+	for _, input := range []string{
+		hex.EncodeToString(want[:]),
+		strings.ToUpper(hex.EncodeToString(want[:])),
+		base64.StdEncoding.EncodeToString(want[:]),
+		base64.RawURLEncoding.EncodeToString(want[:]),
+		"@file:" + rawFile,
+		"@file:" + hexFile,
+	} {
+		got, err := ParseDataKey(input)
+		if err != nil {
+			t.Errorf("ParseDataKey(%q) failed: %v", input, err)
+		} else if got != want {
+			t.Errorf("ParseDataKey(%q) = %x, want %x", input, got, want)
+		}
+	}
+
+	for _, input := range []string{
+		"",
+		"not a key",
+		hex.EncodeToString(want[:31]),
+		base64.StdEncoding.EncodeToString(append(want[:], 0)),
+		"@file:/nonexistent/file",
+	} {
+		if _, err := ParseDataKey(input); err == nil {
+			t.Errorf("ParseDataKey(%q) succeeded, want an error", input)
+		}
+	}
+}
+
 func TestReadWriteFile(t *testing.T) {
 	tempDir, err := os.MkdirTemp("", "cryptotimed_test")
 	if err != nil {
@@ -205,3 +325,814 @@ func TestReadWriteFile(t *testing.T) {
 		t.Errorf("File content mismatch: got %s, want %s", readData, testData)
 	}
 }
+
+func TestFileHeaderRoundTrip(t *testing.T) {
+	h := &types.FileHeader{
+		Version:          types.CurrentVersion,
+		MinReaderVersion: types.VersionMinReader,
+		WorkFactor:       987654321,
+		ModulusN:         make([]byte, types.FixedModulusBytes),
+		BaseG:            make([]byte, types.FixedModulusBytes),
+		KeyRequired:      1,
+		Ext:              types.HeaderExtensions{KeyDerivation: 1, EncryptorRate: 1234567.5, ChunkSize: 1 << 20},
+	}
+	for i := 0; i < types.FixedModulusBytes; i++ {
+		h.ModulusN[i] = byte(250 - i%251)
+		h.BaseG[i] = byte((i * 7) % 256)
+	}
+	for i := 0; i < 16; i++ {
+		h.Salt[i] = byte(0xA0 + i)
+	}
+
+	// Serialize the header alone
+	var buf bytes.Buffer
+	n, err := h.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	if n != int64(h.Size()) || buf.Len() != h.Size() {
+		t.Fatalf("WriteTo wrote %d bytes (buffer %d), want %d", n, buf.Len(), h.Size())
+	}
+
+	// Parse it back
+	h2, err := ReadHeader(&buf)
+	if err != nil {
+		t.Fatalf("ReadHeader failed: %v", err)
+	}
+	if !reflect.DeepEqual(h2, h) {
+		t.Errorf("header mismatch after round trip")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("ReadHeader left %d unread bytes", buf.Len())
+	}
+}
+
+func TestReadHeaderIgnoresData(t *testing.T) {
+	tempDir := t.TempDir()
+
+	ef := &types.EncryptedFile{
+		Version:          types.CurrentVersion,
+		MinReaderVersion: types.VersionMinReader,
+		WorkFactor:       42,
+		ModulusN:         make([]byte, types.FixedModulusBytes),
+		BaseG:            make([]byte, types.FixedModulusBytes),
+		Data:             bytes.Repeat([]byte{0xEE}, 4096),
+	}
+	ef.ModulusN[0] = 0xC3
+	ef.BaseG[types.FixedModulusBytes-1] = 0x05
+
+	testFile := filepath.Join(tempDir, "header.locked")
+	if err := WriteEncryptedFile(testFile, ef); err != nil {
+		t.Fatalf("WriteEncryptedFile failed: %v", err)
+	}
+
+	f, err := os.Open(testFile)
+	if err != nil {
+		t.Fatalf("Failed to open test file: %v", err)
+	}
+	defer f.Close()
+
+	h, err := ReadHeader(f)
+	if err != nil {
+		t.Fatalf("ReadHeader failed: %v", err)
+	}
+	if !reflect.DeepEqual(h, ef.Header()) {
+		t.Errorf("header read from file does not match written header")
+	}
+
+	// The reader must be positioned at the data length field
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	if pos != int64(h.Size()) {
+		t.Errorf("reader positioned at %d, want %d", pos, h.Size())
+	}
+}
+
+// countingReaderAt counts the bytes read through it.
+type countingReaderAt struct {
+	r    io.ReaderAt
+	read int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.read += int64(n)
+	return n, err
+}
+
+func TestReadEncryptedFileFromReaderAt(t *testing.T) {
+	ef := &types.EncryptedFile{
+		Version:          types.CurrentVersion,
+		MinReaderVersion: types.VersionMinReader,
+		WorkFactor:       42,
+		ModulusN:         make([]byte, types.FixedModulusBytes),
+		BaseG:            make([]byte, types.FixedModulusBytes),
+		Data:             bytes.Repeat([]byte{0xEE}, 1<<20),
+	}
+	ef.ModulusN[0] = 0xC3
+	ef.BaseG[types.FixedModulusBytes-1] = 0x05
+	encoded, err := EncodeEncryptedFile(ef)
+	if err != nil {
+		t.Fatalf("EncodeEncryptedFile failed: %v", err)
+	}
+	size := int64(len(encoded))
+
+	// Only the header and the data length are fetched for the header
+	r := &countingReaderAt{r: bytes.NewReader(encoded)}
+	h, dataSize, err := ReadFileHeaderFromReaderAt(r, size)
+	if err != nil {
+		t.Fatalf("ReadFileHeaderFromReaderAt failed: %v", err)
+	}
+	if !reflect.DeepEqual(h, ef.Header()) || dataSize != int64(len(ef.Data)) {
+		t.Errorf("header read does not match the written one (data size %d)", dataSize)
+	}
+	headerSize := int64(h.Size()) + 8
+	if r.read != headerSize {
+		t.Errorf("read %d bytes for a header and data length of %d", r.read, headerSize)
+	}
+
+	r = &countingReaderAt{r: bytes.NewReader(encoded)}
+	read, err := ReadEncryptedFileFromReaderAt(r, size)
+	if err != nil {
+		t.Fatalf("ReadEncryptedFileFromReaderAt failed: %v", err)
+	}
+	if !reflect.DeepEqual(read.Header(), ef.Header()) || !bytes.Equal(read.Data, ef.Data) {
+		t.Error("file read does not match the written one")
+	}
+	if r.read != size {
+		t.Errorf("read %d bytes of a %d-byte file", r.read, size)
+	}
+
+	// A truncated file fails at its data section, before it is fetched
+	for _, read := range []func(io.ReaderAt, int64) error{
+		func(r io.ReaderAt, size int64) error { _, _, err := ReadFileHeaderFromReaderAt(r, size); return err },
+		func(r io.ReaderAt, size int64) error { _, err := ReadEncryptedFileFromReaderAt(r, size); return err },
+	} {
+		r := &countingReaderAt{r: bytes.NewReader(encoded[:size-1])}
+		var pe *types.ParseError
+		if err := read(r, size-1); !errors.As(err, &pe) || pe.Field != "data" {
+			t.Errorf("truncated file: got %v, want a data parse error", err)
+		}
+		if r.read != headerSize {
+			t.Errorf("read %d bytes of a truncated file, want the %d of its header and data length", r.read, headerSize)
+		}
+	}
+}
+
+func TestReadHeaderTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := (&types.FileHeader{Version: types.CurrentVersion}).WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+
+	truncated := bytes.NewReader(buf.Bytes()[:types.HeaderSize-1])
+	if _, err := ReadHeader(truncated); err == nil {
+		t.Errorf("expected error for truncated header")
+	}
+}
+
+func TestReadHeaderLegacyVersion(t *testing.T) {
+	// Version 1 files have no extension block; the header ends after the salt.
+	h := &types.FileHeader{Version: types.VersionLegacy, WorkFactor: 7,
+		ModulusN: make([]byte, types.FixedModulusBytes), BaseG: make([]byte, types.FixedModulusBytes)}
+	var buf bytes.Buffer
+	if _, err := h.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	if buf.Len() != types.HeaderSize {
+		t.Fatalf("legacy header is %d bytes, want %d", buf.Len(), types.HeaderSize)
+	}
+
+	h2, err := ReadHeader(&buf)
+	if err != nil {
+		t.Fatalf("ReadHeader failed: %v", err)
+	}
+	if !reflect.DeepEqual(h2, h) {
+		t.Errorf("legacy header mismatch after round trip")
+	}
+}
+
+func TestReadHeaderRejectsUnknownVersion(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := (&types.FileHeader{Version: types.CurrentVersion + 1}).WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	if _, err := ReadHeader(&buf); err == nil {
+		t.Errorf("expected error for unsupported version")
+	}
+}
+
+func TestHeaderExtensionsSkipUnknownTags(t *testing.T) {
+	ext := types.HeaderExtensions{KeyDerivation: 1}
+	block := append([]byte{0xFE, 3, 0, 0, 0, 'x', 'y', 'z'}, ext.Encode()...)
+
+	var decoded types.HeaderExtensions
+	if err := decoded.Decode(block); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if decoded != ext {
+		t.Errorf("decoded extensions %+v, want %+v", decoded, ext)
+	}
+
+	// A record whose length runs past the block must be rejected
+	if err := decoded.Decode([]byte{0x01, 9, 0, 0, 0, 1}); err == nil {
+		t.Errorf("expected error for overrunning extension record")
+	}
+}
+
+func TestEncryptorRateExtensionRejectsBadRates(t *testing.T) {
+	for _, rate := range []float64{0, -5e5, math.NaN(), math.Inf(1), math.Inf(-1)} {
+		block := append([]byte{types.ExtEncryptorRate, 8, 0, 0, 0},
+			binary.LittleEndian.AppendUint64(nil, math.Float64bits(rate))...)
+		var decoded types.HeaderExtensions
+		if err := decoded.Decode(block); err == nil {
+			t.Errorf("expected error for an encryptor rate of %v", rate)
+		}
+	}
+}
+
+func TestPayloadTypeExtension(t *testing.T) {
+	header := &types.FileHeader{Version: types.CurrentVersion}
+	if v := header.RequiredReaderVersion(); v != types.VersionMinReader {
+		t.Errorf("document requires reader version %d, want %d", v, types.VersionMinReader)
+	}
+	if len(header.Ext.Encode()) != 0 {
+		t.Error("document payload type should not be written")
+	}
+
+	header.Ext.PayloadType = types.PayloadDataKey
+	if v := header.RequiredReaderVersion(); v != types.VersionPayloadType {
+		t.Errorf("data key requires reader version %d, want %d", v, types.VersionPayloadType)
+	}
+	var decoded types.HeaderExtensions
+	if err := decoded.Decode(header.Ext.Encode()); err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if decoded.PayloadType != types.PayloadDataKey {
+		t.Errorf("decoded payload type %d, want %d", decoded.PayloadType, types.PayloadDataKey)
+	}
+	if err := decoded.Decode([]byte{types.ExtPayloadType, 2, 0, 0, 0, 1, 0}); err == nil {
+		t.Error("expected error for a payload-type extension of the wrong length")
+	}
+}
+
+func TestBundleExtension(t *testing.T) {
+	manifest := &types.BundleManifest{Members: []types.BundleMember{
+		{Name: "notes.txt.locked", Length: 612},
+		{Name: "build.bin.locked", Length: 4700},
+	}}
+	h := &types.FileHeader{Version: types.CurrentVersion, Ext: types.HeaderExtensions{Bundle: manifest}}
+	if v := h.RequiredReaderVersion(); v != types.VersionBundle {
+		t.Errorf("bundle requires reader version %d, want %d", v, types.VersionBundle)
+	}
+	h.MinReaderVersion = h.RequiredReaderVersion()
+
+	var buf bytes.Buffer
+	if _, err := h.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	got, err := ReadHeader(&buf)
+	if err != nil {
+		t.Fatalf("ReadHeader failed: %v", err)
+	}
+	if got.Ext.Bundle == nil || !reflect.DeepEqual(got.Ext.Bundle.Members, manifest.Members) {
+		t.Errorf("decoded manifest %+v, want %+v", got.Ext.Bundle, manifest)
+	}
+
+	// Members are plain file names, never paths
+	for _, name := range []string{"", "../x.locked", "dir/x.locked", "/x.locked", "."} {
+		bad := &types.HeaderExtensions{Bundle: &types.BundleManifest{Members: []types.BundleMember{{Name: name, Length: 1}}}}
+		var decoded types.HeaderExtensions
+		if err := decoded.Decode(bad.Encode()); err == nil {
+			t.Errorf("member name %q was accepted", name)
+		}
+	}
+}
+
+func TestKeySlotsExtension(t *testing.T) {
+	slots := &types.KeySlots{Slots: []types.KeySlot{{Length: 44}, {Length: 9000}}}
+	for i := range slots.Slots {
+		for j := range slots.Slots[i].Wrapped {
+			slots.Slots[i].Wrapped[j] = byte(i*7 + j)
+		}
+	}
+	h := &types.FileHeader{Version: types.CurrentVersion, KeyRequired: 1, Ext: types.HeaderExtensions{KeySlots: slots}}
+	if v := h.RequiredReaderVersion(); v != types.VersionKeySlots {
+		t.Errorf("key slots require reader version %d, want %d", v, types.VersionKeySlots)
+	}
+	h.MinReaderVersion = h.RequiredReaderVersion()
+
+	var buf bytes.Buffer
+	if _, err := h.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	got, err := ReadHeader(&buf)
+	if err != nil {
+		t.Fatalf("ReadHeader failed: %v", err)
+	}
+	if got.Ext.KeySlots == nil || !reflect.DeepEqual(got.Ext.KeySlots.Slots, slots.Slots) {
+		t.Errorf("decoded key slots %+v, want %+v", got.Ext.KeySlots, slots)
+	}
+
+	// Slots are whole records, and there is at least one
+	for _, value := range [][]byte{{}, make([]byte, types.KeySlotSize-1), make([]byte, types.KeySlotSize+1)} {
+		var decoded types.HeaderExtensions
+		rec := append([]byte{types.ExtKeySlots}, binary.LittleEndian.AppendUint32(nil, uint32(len(value)))...)
+		if err := decoded.Decode(append(rec, value...)); err == nil {
+			t.Errorf("key-slot extension of %d bytes was accepted", len(value))
+		}
+	}
+}
+
+func TestContainerExtensionRoundTrip(t *testing.T) {
+	entries := []types.ContainerEntry{
+		{Name: "docs", Mode: uint32(os.ModeDir | 0755), ModTime: 1700000000000000000},
+		{Name: "docs/readme.txt", Mode: 0644, Size: 11, ModTime: 1700000000123456789, Offset: 0, Length: 39},
+		{Name: "empty.bin", Mode: 0600, Size: 0, Offset: 39, Length: 28},
+	}
+
+	for _, table := range []*types.ContainerTable{
+		{Entries: entries},
+		{Private: true, TableLength: 4242},
+		{Dedup: true, Entries: entries},
+		{Private: true, Dedup: true, TableLength: 4242},
+	} {
+		h := &types.FileHeader{Version: types.CurrentVersion, MinReaderVersion: types.VersionMinReader, Ext: types.HeaderExtensions{Container: table}}
+		var buf bytes.Buffer
+		if _, err := h.WriteTo(&buf); err != nil {
+			t.Fatalf("WriteTo failed: %v", err)
+		}
+		h2, err := ReadHeader(&buf)
+		if err != nil {
+			t.Fatalf("ReadHeader failed: %v", err)
+		}
+		if !reflect.DeepEqual(h2.Ext.Container, table) {
+			t.Errorf("container table mismatch: got %+v, want %+v", h2.Ext.Container, table)
+		}
+	}
+}
+
+func TestContainerDedupOwners(t *testing.T) {
+	entries := []types.ContainerEntry{
+		{Name: "a", Mode: 0644, Size: 5, Offset: 0, Length: 33},
+		{Name: "b", Mode: 0644, Size: 5, Offset: 0, Length: 33},
+		{Name: "d", Mode: uint32(os.ModeDir | 0755)},
+		{Name: "d/c", Mode: 0644, Size: 2, Offset: 33, Length: 30},
+		{Name: "d/e", Mode: 0644, Size: 5, Offset: 0, Length: 33},
+	}
+	if got, want := types.BlobOwners(entries, true), []int{0, 0, 2, 3, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("BlobOwners = %v, want %v", got, want)
+	}
+	if got, want := types.BlobOwners(entries, false), []int{0, 1, 2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("BlobOwners without dedup = %v, want %v", got, want)
+	}
+
+	// Only a container that shares blobs needs a reader that knows how
+	h := &types.FileHeader{Version: types.CurrentVersion, Ext: types.HeaderExtensions{
+		Container: &types.ContainerTable{Entries: entries},
+	}}
+	if v := h.RequiredReaderVersion(); v != types.VersionMinReader {
+		t.Errorf("a container without dedup requires reader version %d, want %d", v, types.VersionMinReader)
+	}
+	h.Ext.Container.Dedup = true
+	if v := h.RequiredReaderVersion(); v != types.VersionDedup {
+		t.Errorf("a deduplicated container requires reader version %d, want %d", v, types.VersionDedup)
+	}
+}
+
+func TestHeaderPadding(t *testing.T) {
+	header := func(name string) *types.FileHeader {
+		return &types.FileHeader{Version: types.CurrentVersion, MinReaderVersion: types.VersionMinReader, Ext: types.HeaderExtensions{
+			Container: &types.ContainerTable{Entries: []types.ContainerEntry{{Name: name, Mode: 0644, Size: 1, Length: 29}}},
+		}}
+	}
+	short, long := header("a.txt"), header("a-much-longer-name-that-would-show-in-the-file-size.txt")
+	if short.Size() == long.Size() {
+		t.Fatal("headers of different names already have the same size")
+	}
+
+	// Padded to one size, both encode to exactly that many bytes and read
+	// back with their contents and fingerprints intact
+	const size = 4096
+	for _, h := range []*types.FileHeader{short, long} {
+		if err := h.PadTo(size); err != nil {
+			t.Fatalf("PadTo failed: %v", err)
+		}
+		var buf bytes.Buffer
+		if n, err := h.WriteTo(&buf); err != nil || n != size || h.Size() != size {
+			t.Fatalf("padded header wrote %d bytes (%v), Size %d; want %d", n, err, h.Size(), size)
+		}
+		h2, err := ReadHeader(&buf)
+		if err != nil {
+			t.Fatalf("ReadHeader failed: %v", err)
+		}
+		if !reflect.DeepEqual(h2.Ext.Container, h.Ext.Container) {
+			t.Errorf("container table changed by padding: %+v", h2.Ext.Container)
+		}
+		if h2.Fingerprint() != h.Fingerprint() {
+			t.Error("padded header fingerprints differently once read back")
+		}
+	}
+	if bytes.Equal(short.Ext.Padding.Filler[:32], long.Ext.Padding.Filler[:32]) {
+		t.Error("padding is not random")
+	}
+
+	// Padding again replaces the earlier padding
+	if err := short.PadTo(size + 100); err != nil || short.Size() != size+100 {
+		t.Errorf("repadding: size %d (%v), want %d", short.Size(), err, size+100)
+	}
+
+	// Padding needs room for its own record
+	unpadded := header("a.txt")
+	n := unpadded.Size()
+	if err := unpadded.PadTo(n); err != nil || unpadded.Ext.Padding != nil {
+		t.Errorf("padding to the unpadded size: %v, padding %v", err, unpadded.Ext.Padding)
+	}
+	for _, size := range []int{n - 1, n + 4} {
+		if err := unpadded.PadTo(size); err == nil {
+			t.Errorf("padding a %d-byte header to %d bytes accepted", n, size)
+		}
+	}
+	if err := unpadded.PadTo(n + 5); err != nil || unpadded.Size() != n+5 {
+		t.Errorf("empty padding record: size %d (%v), want %d", unpadded.Size(), err, n+5)
+	}
+}
+
+func TestContainerEntriesRejectUnsafeNames(t *testing.T) {
+	for _, name := range []string{"", "/etc/passwd", "../escape", "a/../../b", "a//b", "./a", "a\\b", "."} {
+		encoded := types.EncodeEntries([]types.ContainerEntry{{Name: name, Mode: 0644}})
+		if _, err := types.DecodeEntries(encoded); err == nil {
+			t.Errorf("expected unsafe entry name %q to be rejected", name)
+		}
+	}
+
+	// Truncated tables must fail cleanly
+	encoded := types.EncodeEntries([]types.ContainerEntry{{Name: "ok.txt", Mode: 0644, Size: 1}})
+	for i := 0; i < len(encoded); i++ {
+		if _, err := types.DecodeEntries(encoded[:i]); err == nil {
+			t.Errorf("expected error for table truncated to %d bytes", i)
+		}
+	}
+}
+
+func TestReadHeaderMinReaderVersion(t *testing.T) {
+	write := func(h *types.FileHeader) *bytes.Buffer {
+		var buf bytes.Buffer
+		if _, err := h.WriteTo(&buf); err != nil {
+			t.Fatalf("WriteTo failed: %v", err)
+		}
+		if buf.Len() != h.Size() {
+			t.Fatalf("WriteTo wrote %d bytes, want %d", buf.Len(), h.Size())
+		}
+		return &buf
+	}
+
+	modulus := func(h *types.FileHeader) *types.FileHeader {
+		h.ModulusN = append([]byte{0x80}, make([]byte, types.FixedModulusBytes-1)...)
+		h.BaseG = make([]byte, types.FixedModulusBytes)
+		return h
+	}
+
+	// A newer format that this version can still decrypt
+	newer := modulus(&types.FileHeader{Version: types.CurrentVersion + 1, MinReaderVersion: types.CurrentVersion, WorkFactor: 9})
+	h, err := ReadHeader(write(newer))
+	if err != nil {
+		t.Fatalf("ReadHeader failed for a readable newer format: %v", err)
+	}
+	if !reflect.DeepEqual(h, newer) {
+		t.Errorf("header mismatch after round trip: got %+v", h)
+	}
+
+	// A newer format that needs a newer reader
+	future := modulus(&types.FileHeader{Version: types.CurrentVersion + 1, MinReaderVersion: types.CurrentVersion + 1})
+	want := fmt.Sprintf("this file requires cryptotimed format v%d support", types.CurrentVersion+1)
+	if _, err := ReadHeader(write(future)); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("expected %q, got %v", want, err)
+	}
+
+	// The minimum cannot exceed the format version or predate the field
+	for _, min := range []uint32{0, types.VersionMinReader - 1, types.CurrentVersion + 1} {
+		h := modulus(&types.FileHeader{Version: types.CurrentVersion, MinReaderVersion: min})
+		if _, err := ReadHeader(write(h)); err == nil || !strings.Contains(err.Error(), "corrupt header") {
+			t.Errorf("minimum reader version %d: expected a corrupt header error, got %v", min, err)
+		}
+	}
+
+	// Version 2 headers have no such field
+	v2 := modulus(&types.FileHeader{Version: 2, WorkFactor: 5})
+	if h, err := ReadHeader(write(v2)); err != nil || !reflect.DeepEqual(h, v2) {
+		t.Errorf("version 2 header round trip = %+v, %v", h, err)
+	}
+}
+
+// malformedSeeds returns valid files of every header layout, for cutting up.
+func malformedSeeds(t testing.TB) [][]byte {
+	var seeds [][]byte
+	for _, h := range []*types.FileHeader{
+		{Version: types.VersionLegacy, WorkFactor: 7},
+		{Version: 2, Ext: types.HeaderExtensions{KeyDerivation: 1, EncryptorRate: 5e5}},
+		{Version: types.CurrentVersion, MinReaderVersion: types.VersionMinReader, Ext: types.HeaderExtensions{
+			KeyDerivation: 1,
+			ChunkSize:     1 << 16,
+			Shared:        &types.SharedPuzzle{Index: 1, Count: 2},
+		}},
+		{Version: types.CurrentVersion, MinReaderVersion: types.VersionModulusSize,
+			ModulusN: append([]byte{0xC0}, make([]byte, 127)...), BaseG: make([]byte, 128),
+			Ext: types.HeaderExtensions{ChunkSize: 1 << 16}},
+	} {
+		data, err := EncodeEncryptedFile(types.NewEncryptedFile(h, []byte("sealed data")))
+		if err != nil {
+			t.Fatalf("EncodeEncryptedFile failed: %v", err)
+		}
+		seeds = append(seeds, data)
+	}
+	return seeds
+}
+
+// TestParseErrorsIdentifyField cuts valid files short at every byte and
+// checks that the failure names the field that was cut.
+func TestParseErrorsIdentifyField(t *testing.T) {
+	for _, data := range malformedSeeds(t) {
+		if _, err := ParseEncryptedFile(data); err != nil {
+			t.Fatalf("valid file failed to parse: %v", err)
+		}
+		for cut := 0; cut < len(data); cut++ {
+			_, err := ParseEncryptedFile(data[:cut])
+			var pe *types.ParseError
+			if !errors.As(err, &pe) {
+				t.Fatalf("version %d cut at %d: got %v, want a ParseError", data[0], cut, err)
+			}
+			if pe.Field == "" || pe.Offset > int64(cut) || pe.Offset+pe.Length <= int64(cut) {
+				t.Fatalf("version %d cut at %d: error %q does not cover the cut", data[0], cut, err)
+			}
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("version %d cut at %d: error %q is not an unexpected EOF", data[0], cut, err)
+			}
+		}
+	}
+
+	// Invalid values are located too, inside the extension block included
+	data := malformedSeeds(t)[2]
+	extStart := types.HeaderSize + 4 + 4
+	for _, tc := range []struct {
+		offset int
+		value  byte
+		field  string
+		at     int64
+	}{
+		{0, 0, "version", 0},
+		{4, 99, "minimum reader version", 4},
+		{extStart + 1, 2, "extension 0x01 (key derivation)", int64(extStart + 5)},
+		{extStart + 7, 200, "extension 0x04 (chunk size)", int64(extStart + 6 + 5)},
+	} {
+		bad := bytes.Clone(data)
+		bad[tc.offset] = tc.value
+		_, err := ParseEncryptedFile(bad)
+		var pe *types.ParseError
+		if !errors.As(err, &pe) || !strings.HasPrefix(pe.Field, tc.field) || pe.Offset != tc.at {
+			t.Errorf("byte %d set to %d: got %v, want %s at offset %d", tc.offset, tc.value, err, tc.field, tc.at)
+		}
+	}
+}
+
+// FuzzParseEncryptedFile checks that no input panics the parser and that
+// every failure identifies a field and an offset within the input.
+func FuzzParseEncryptedFile(f *testing.F) {
+	for _, data := range malformedSeeds(f) {
+		f.Add(data)
+		f.Add(data[:len(data)/2])
+		bad := bytes.Clone(data)
+		bad[len(bad)/3] ^= 0xFF
+		f.Add(bad)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ef, err := ParseEncryptedFile(data)
+		if err == nil {
+			if ef.Header().Size()+8+len(ef.Data) > len(data) {
+				t.Fatalf("parsed %d bytes out of %d", ef.Header().Size()+8+len(ef.Data), len(data))
+			}
+			return
+		}
+		var pe *types.ParseError
+		if !errors.As(err, &pe) {
+			t.Fatalf("error %q is not a ParseError", err)
+		}
+		if pe.Field == "" || pe.Offset < 0 || pe.Offset > int64(len(data)) {
+			t.Fatalf("error %q does not locate a field within %d bytes", err, len(data))
+		}
+	})
+}
+
+func TestHeaderAlgorithms(t *testing.T) {
+	h := &types.FileHeader{Version: types.CurrentVersion, Ext: types.HeaderExtensions{
+		KeyDerivation: 0x81,
+		Cipher:        0x80,
+		KDFParams:     &types.KDFParams{Encoded: []byte("cost=3")},
+	}}
+	if v := h.RequiredReaderVersion(); v != types.VersionAlgorithms {
+		t.Errorf("cipher and parameters require reader version %d, want %d", v, types.VersionAlgorithms)
+	}
+	h.MinReaderVersion = h.RequiredReaderVersion()
+
+	var buf bytes.Buffer
+	if _, err := h.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	h2, err := ReadHeader(&buf)
+	if err != nil {
+		t.Fatalf("ReadHeader failed: %v", err)
+	}
+	if h2.Ext.Cipher != 0x80 || h2.Ext.KeyDerivation != 0x81 || string(h2.Ext.KDFParams.Bytes()) != "cost=3" {
+		t.Errorf("read back cipher 0x%02x, key derivation 0x%02x, parameters %q",
+			h2.Ext.Cipher, h2.Ext.KeyDerivation, h2.Ext.KDFParams.Bytes())
+	}
+
+	// The defaults are not written
+	plain := &types.FileHeader{Version: types.CurrentVersion}
+	if v := plain.RequiredReaderVersion(); v != types.VersionMinReader {
+		t.Errorf("default algorithms require reader version %d, want %d", v, types.VersionMinReader)
+	}
+	if len(plain.Ext.Encode()) != 0 {
+		t.Error("default cipher and key derivation written to the header")
+	}
+}
+
+func TestHeaderBaseTweak(t *testing.T) {
+	h := &types.FileHeader{Version: types.CurrentVersion, WorkFactor: 1000, KeyRequired: 1, Ext: types.HeaderExtensions{
+		BaseTweak: &types.BaseTweak{FileID: [types.BaseTweakSize]byte{1, 2, 3}},
+	}}
+	if v := h.RequiredReaderVersion(); v != types.VersionBaseTweak {
+		t.Errorf("a base tweak requires reader version %d, want %d", v, types.VersionBaseTweak)
+	}
+	h.MinReaderVersion = h.RequiredReaderVersion()
+
+	var buf bytes.Buffer
+	if _, err := h.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	h2, err := ReadHeader(&buf)
+	if err != nil {
+		t.Fatalf("ReadHeader failed: %v", err)
+	}
+	if h2.Ext.BaseTweak == nil || *h2.Ext.BaseTweak != *h.Ext.BaseTweak {
+		t.Fatalf("read back base tweak %v, want %v", h2.Ext.BaseTweak, h.Ext.BaseTweak)
+	}
+	puzzle := PuzzleFromEncryptedFile(types.NewEncryptedFile(h2, nil))
+	if puzzle.FileID == nil || puzzle.FileID[0] != 1 || puzzle.FileID[2] != 3 {
+		t.Errorf("puzzle file ID = %v, want the header's", puzzle.FileID)
+	}
+}
+
+func TestAndPuzzlesExtension(t *testing.T) {
+	more := &types.AndPuzzles{Puzzles: []types.AndPuzzle{{WorkFactor: 2000}, {WorkFactor: 3000}}}
+	for i := range more.Puzzles {
+		more.Puzzles[i].ModulusN = make([]byte, types.FixedModulusBytes)
+		more.Puzzles[i].BaseG = make([]byte, types.FixedModulusBytes)
+		more.Puzzles[i].ModulusN[0], more.Puzzles[i].BaseG[types.FixedModulusBytes-1] = byte(0x80+i), byte(i+2)
+	}
+	h := &types.FileHeader{Version: types.CurrentVersion, WorkFactor: 1000, Ext: types.HeaderExtensions{AndPuzzles: more}}
+	if v := h.RequiredReaderVersion(); v != types.VersionAndPuzzles {
+		t.Errorf("further puzzles require reader version %d, want %d", v, types.VersionAndPuzzles)
+	}
+	if h.PuzzleCount() != 3 || h.TotalWork() != 6000 {
+		t.Errorf("got %d puzzles of %d squarings, want 3 of 6000", h.PuzzleCount(), h.TotalWork())
+	}
+	h.MinReaderVersion = h.RequiredReaderVersion()
+
+	var buf bytes.Buffer
+	if _, err := h.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	got, err := ReadHeader(&buf)
+	if err != nil {
+		t.Fatalf("ReadHeader failed: %v", err)
+	}
+	if got.Ext.AndPuzzles == nil || !reflect.DeepEqual(got.Ext.AndPuzzles.Puzzles, more.Puzzles) {
+		t.Fatalf("decoded further puzzles %+v, want %+v", got.Ext.AndPuzzles, more)
+	}
+	puzzles := AndPuzzlesFromHeader(got)
+	if len(puzzles) != 2 || puzzles[1].T != 3000 || puzzles[1].G.Int64() != 3 || puzzles[0].N.BitLen() != 2048 {
+		t.Errorf("puzzles from header = %+v", puzzles)
+	}
+
+	// Puzzles are whole records, there is at least one and none is empty
+	for _, value := range [][]byte{{}, make([]byte, types.AndPuzzleSize-1), make([]byte, types.AndPuzzleSize)} {
+		var decoded types.HeaderExtensions
+		rec := append([]byte{types.ExtAndPuzzles}, binary.LittleEndian.AppendUint32(nil, uint32(len(value)))...)
+		if err := decoded.Decode(append(rec, value...)); err == nil {
+			t.Errorf("and-puzzles extension of %d bytes was accepted", len(value))
+		}
+	}
+}
+
+func TestDumpHeader(t *testing.T) {
+	h := &types.FileHeader{Version: types.CurrentVersion, WorkFactor: 1000, KeyRequired: 1, Ext: types.HeaderExtensions{ChunkSize: 4096}}
+	h.MinReaderVersion = h.RequiredReaderVersion()
+	h.ModulusN = append([]byte{0x80}, make([]byte, types.FixedModulusBytes-1)...)
+	ef := types.NewEncryptedFile(h, bytes.Repeat([]byte{0xAB}, 100))
+	encoded, err := EncodeEncryptedFile(ef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An extension record this version does not know is still shown
+	extStart := types.HeaderSize + 4 + 4
+	unknown := []byte{0xEE, 2, 0, 0, 0, 'h', 'i'}
+	file := append(append([]byte{}, encoded[:extStart]...), unknown...)
+	file = append(file, encoded[extStart:]...)
+	binary.LittleEndian.PutUint32(file[extStart-4:], binary.LittleEndian.Uint32(encoded[extStart-4:])+uint32(len(unknown)))
+
+	fields, err := DumpHeader(bytes.NewReader(file))
+	if err != nil {
+		t.Fatalf("DumpHeader failed: %v", err)
+	}
+	// The fields are contiguous and hold the bytes at their offsets
+	var off int64
+	values := map[string]string{}
+	for _, f := range fields {
+		if f.Offset != off || int64(len(f.Raw)) != f.Length || !bytes.Equal(f.Raw, file[off:off+f.Length]) {
+			t.Fatalf("field %s at %d (%d bytes) does not match the file at %d", f.Field, f.Offset, f.Length, off)
+		}
+		off += f.Length
+		values[f.Field] = f.Value
+	}
+	if last := fields[len(fields)-1]; last.Field != "data" || last.Length != DumpDataBytes {
+		t.Errorf("last field %s of %d bytes, want %d bytes of data", last.Field, last.Length, DumpDataBytes)
+	}
+	for field, want := range map[string]string{
+		"version":                     fmt.Sprint(types.CurrentVersion),
+		"work factor":                 "1000 squarings",
+		"modulus N":                   "2048-bit integer",
+		"key required":                "yes",
+		"extension 0x04 (chunk size)": "4096 bytes",
+		"extension 0xee (unknown)":    "unknown, skipped",
+		"data length":                 "100 bytes",
+	} {
+		if values[field] != want {
+			t.Errorf("%s = %q, want %q", field, values[field], want)
+		}
+	}
+
+	// A truncated file dumps the fields before the break
+	fields, err = DumpHeader(bytes.NewReader(file[:types.HeaderSize-10]))
+	var pe *types.ParseError
+	if !errors.As(err, &pe) || pe.Field != "salt" {
+		t.Fatalf("truncated dump failed with %v, want a salt parse error", err)
+	}
+	if len(fields) != 6 || fields[5].Field != "key required" {
+		t.Errorf("truncated dump returned %d fields", len(fields))
+	}
+}
+
+func TestFingerprintFile(t *testing.T) {
+	dir := t.TempDir()
+	ef := &types.EncryptedFile{
+		Version:          types.CurrentVersion,
+		MinReaderVersion: types.VersionMinReader,
+		WorkFactor:       42,
+		ModulusN:         make([]byte, types.FixedModulusBytes),
+		BaseG:            make([]byte, types.FixedModulusBytes),
+		Data:             bytes.Repeat([]byte{0xEE}, 100000),
+	}
+	ef.ModulusN[0] = 0xC3
+	ef.BaseG[types.FixedModulusBytes-1] = 0x05
+	if err := WriteEncryptedFile(filepath.Join(dir, "a.locked"), ef); err != nil {
+		t.Fatal(err)
+	}
+	ef.Data = []byte("other data")
+	if err := WriteEncryptedFile(filepath.Join(dir, "b.locked"), ef); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := FingerprintFile(os.DirFS(dir), "a.locked")
+	if err != nil {
+		t.Fatalf("FingerprintFile failed: %v", err)
+	}
+	raw, _ := os.ReadFile(filepath.Join(dir, "a.locked"))
+	if a.File != sha256.Sum256(raw) {
+		t.Errorf("File = %x, want the SHA-256 of every byte", a.File)
+	}
+	if a.Header != ef.Header().Fingerprint() {
+		t.Errorf("Header = %x, want the header's fingerprint", a.Header)
+	}
+	if got := ShortFingerprint(a.Header); got != hex.EncodeToString(a.Header[:8]) {
+		t.Errorf("ShortFingerprint = %s", got)
+	}
+
+	// Same header, other data
+	b, err := FingerprintFile(os.DirFS(dir), "b.locked")
+	if err != nil {
+		t.Fatalf("FingerprintFile failed: %v", err)
+	}
+	if b.Header != a.Header || b.File == a.File {
+		t.Errorf("fingerprints of a file with the same header: %x, %x", b.Header, b.File)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "c.locked"), raw[:100], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FingerprintFile(os.DirFS(dir), "c.locked"); err == nil {
+		t.Error("fingerprinted a truncated header")
+	}
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+)
+
+// ShortFingerprintBytes is how many leading bytes of a fingerprint are shown
+// where the full 32 would not fit.
+const ShortFingerprintBytes = 8
+
+// FileFingerprints identifies an encrypted file, to tell whether two people
+// are looking at the same one.
+type FileFingerprints struct {
+	// File is the SHA-256 of every byte of the file: only identical copies
+	// share it.
+	File [32]byte
+
+	// Header is the SHA-256 of the header in canonical form, the one
+	// types.FileHeader.Fingerprint computes and partial outputs, calibration
+	// and log records are keyed by.  Copies that describe the same puzzle
+	// and data share it however the bytes around the header were rewritten.
+	Header [32]byte
+}
+
+// FingerprintFile computes both fingerprints of the encrypted file name in
+// a single pass over it.
+func FingerprintFile(fsys fs.FS, name string) (*FileFingerprints, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	r := bufio.NewReader(io.TeeReader(f, hash))
+	header, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return nil, err
+	}
+	fp := &FileFingerprints{Header: header.Fingerprint()}
+	hash.Sum(fp.File[:0])
+	return fp, nil
+}
+
+// ShortFingerprint returns the first ShortFingerprintBytes of fp in hex,
+// enough to tell files apart by eye.
+func ShortFingerprint(fp [32]byte) string {
+	return hex.EncodeToString(fp[:ShortFingerprintBytes])
+}
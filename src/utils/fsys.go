@@ -0,0 +1,218 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// WriteFS is a filesystem that outputs can be written to: an fs.FS that can
+// also create directories and write whole files.  Names follow the rules of
+// the implementation (OS accepts any path the os package does).
+type WriteFS interface {
+	fs.FS
+	MkdirAll(name string, perm fs.FileMode) error
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+}
+
+// ChtimesFS is implemented by a WriteFS that can set modification times,
+// which extracted containers restore when possible.
+type ChtimesFS interface {
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// StreamFS is implemented by a WriteFS that can write a file from a stream,
+// so the contents never need to be held in memory.  write is called once
+// with the file's writer; the file only appears under name if it succeeds,
+// and nothing is left behind if it fails.
+type StreamFS interface {
+	WriteFileFrom(name string, perm fs.FileMode, write func(w io.Writer) error) error
+}
+
+// OS is the operating system's filesystem.  Unlike os.DirFS it is not rooted
+// anywhere: names are passed to the os package unchanged, so absolute and
+// relative paths both work.  It is the default wherever a filesystem is
+// optional.
+var OS WriteFS = osFS{}
+
+// osFS implements OS.
+type osFS struct{}
+
+func (osFS) Open(name string) (fs.File, error)            { return os.Open(name) }
+func (osFS) Stat(name string) (fs.FileInfo, error)        { return os.Stat(name) }
+func (osFS) ReadFile(name string) ([]byte, error)         { return os.ReadFile(name) }
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error)   { return os.ReadDir(name) }
+func (osFS) MkdirAll(name string, perm fs.FileMode) error { return os.MkdirAll(name, perm) }
+func (osFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+func (osFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+// WriteFileFrom writes to a temporary file next to name and renames it into
+// place once write and the final flush have succeeded.  An existing name
+// that is not a regular file, such as /dev/stdout, is written directly.
+func (osFS) WriteFileFrom(name string, perm fs.FileMode, write func(w io.Writer) error) error {
+	if info, err := os.Stat(name); err == nil && !info.Mode().IsRegular() {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_TRUNC, perm)
+		if err != nil {
+			return err
+		}
+		bw := bufio.NewWriterSize(f, streamBufferSize)
+		err = write(bw)
+		if err == nil {
+			err = bw.Flush()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".partial*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	bw := bufio.NewWriterSize(tmp, streamBufferSize)
+	err = write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// streamBufferSize is the write buffer of WriteFileFrom.
+const streamBufferSize = 1 << 20
+
+// IsOS reports whether fsys is the operating system's filesystem (or nil,
+// which stands for it).
+func IsOS(fsys fs.FS) bool {
+	return fsys == nil || fsys == OS
+}
+
+// OrOS returns fsys, or OS if fsys is nil.
+func OrOS(fsys fs.FS) fs.FS {
+	if fsys == nil {
+		return OS
+	}
+	return fsys
+}
+
+// WritableOrOS returns fsys, or OS if fsys is nil.
+func WritableOrOS(fsys WriteFS) WriteFS {
+	if fsys == nil {
+		return OS
+	}
+	return fsys
+}
+
+// NewWriterFS returns a filesystem that writes every file to w, whatever its
+// name, for piping a single output, e.g. to stdout.  Directories are not
+// created and nothing can be read back.  A file written from a stream
+// reaches w as it is written, so one that fails part way through may leave
+// part of it behind.
+func NewWriterFS(w io.Writer) WriteFS {
+	return writerFS{w: w}
+}
+
+// writerFS implements NewWriterFS.
+type writerFS struct {
+	w io.Writer
+}
+
+func (writerFS) Open(name string) (fs.File, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+func (writerFS) MkdirAll(name string, perm fs.FileMode) error { return nil }
+func (f writerFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	_, err := f.w.Write(data)
+	return err
+}
+
+// WriteFileFrom streams the file to w through a buffer, flushed once write
+// has succeeded.
+func (f writerFS) WriteFileFrom(name string, perm fs.FileMode, write func(w io.Writer) error) error {
+	bw := bufio.NewWriterSize(f.w, streamBufferSize)
+	if err := write(bw); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// NewMemoryFS returns a read-only filesystem holding files, by name, all with
+// modification time modTime.  Names are matched exactly, so they need not be
+// valid fs paths (a fetched file is named by its URL).  There are no
+// directories to list.
+func NewMemoryFS(files map[string][]byte, modTime time.Time) fs.FS {
+	return &memoryFS{files: files, modTime: modTime}
+}
+
+// memoryFS implements NewMemoryFS.
+type memoryFS struct {
+	files   map[string][]byte
+	modTime time.Time
+}
+
+func (m *memoryFS) Open(name string) (fs.File, error) {
+	data, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &memoryFile{Reader: bytes.NewReader(data), info: memoryInfo{name, int64(len(data)), m.modTime}}, nil
+}
+
+func (m *memoryFS) Stat(name string) (fs.FileInfo, error) {
+	data, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return memoryInfo{name, int64(len(data)), m.modTime}, nil
+}
+
+func (m *memoryFS) ReadFile(name string) ([]byte, error) {
+	data, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return data, nil
+}
+
+// memoryFile is an open memoryFS file.
+type memoryFile struct {
+	*bytes.Reader
+	info memoryInfo
+}
+
+func (f *memoryFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memoryFile) Close() error               { return nil }
+
+// memoryInfo describes a memoryFS file.
+type memoryInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i memoryInfo) Name() string       { return path.Base(i.name) }
+func (i memoryInfo) Size() int64        { return i.size }
+func (i memoryInfo) Mode() fs.FileMode  { return 0444 }
+func (i memoryInfo) ModTime() time.Time { return i.modTime }
+func (i memoryInfo) IsDir() bool        { return false }
+func (i memoryInfo) Sys() any           { return nil }
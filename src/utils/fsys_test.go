@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileFromIsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "out.bin")
+	streamFS, ok := OS.(StreamFS)
+	if !ok {
+		t.Fatal("OS does not stream writes")
+	}
+
+	err := streamFS.WriteFileFrom(name, 0640, func(w io.Writer) error {
+		for i := 0; i < 3; i++ {
+			if _, err := w.Write([]byte("chunk ")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WriteFileFrom failed: %v", err)
+	}
+	if got, err := os.ReadFile(name); err != nil || string(got) != "chunk chunk chunk " {
+		t.Fatalf("got %q (%v)", got, err)
+	}
+	if info, err := os.Stat(name); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("mode %v (%v), want 0640", info.Mode().Perm(), err)
+	}
+
+	// A failed write leaves the previous file and no partial one
+	failure := errors.New("authentication failed")
+	err = streamFS.WriteFileFrom(name, 0640, func(w io.Writer) error {
+		w.Write([]byte("junk"))
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("got %v, want the write's error", err)
+	}
+	if got, _ := os.ReadFile(name); string(got) != "chunk chunk chunk " {
+		t.Errorf("failed write replaced the file with %q", got)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("failed write left %d files, want 1", len(entries))
+	}
+
+	// Something that is not a regular file is written in place
+	if err := streamFS.WriteFileFrom(os.DevNull, 0644, func(w io.Writer) error {
+		_, err := w.Write([]byte("discarded"))
+		return err
+	}); err != nil {
+		t.Errorf("writing to %s failed: %v", os.DevNull, err)
+	}
+}
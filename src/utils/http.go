@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"cryptotimed/src/types"
+)
+
+// DefaultFetchTimeout bounds fetching an encrypted file given as a URL.
+const DefaultFetchTimeout = 5 * time.Minute
+
+// headerRange is the number of bytes FetchHeader asks for first.  It covers
+// the header of any file but a container with a very large entry table.
+const headerRange = 64 << 10
+
+// IsURL reports whether name is an http:// or https:// URL rather than a path.
+func IsURL(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://")
+}
+
+// URLBase returns the last element of the path of the URL rawURL, for naming
+// local files after it ("download" if it has none).
+func URLBase(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err == nil {
+		if base := path.Base(u.Path); base != "/" && base != "." {
+			return base
+		}
+	}
+	return "download"
+}
+
+// FetchFile downloads rawURL into memory and returns a filesystem holding
+// just that file, under rawURL as its name, so it can be read like a local
+// one.  timeout bounds the whole download (0 = DefaultFetchTimeout).
+func FetchFile(rawURL string, timeout time.Duration) (fs.FS, error) {
+	resp, err := fetch(rawURL, timeout, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fetchStatusError(rawURL, resp)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %v", rawURL, err)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return NewMemoryFS(map[string][]byte{rawURL: data}, modTime), nil
+}
+
+// FetchHeader reads only the header of the encrypted file at rawURL and
+// returns it with the size of the whole file (-1 if the server does not
+// say).  It asks for the first bytes with a range request; a server that
+// ignores ranges sends the whole file, of which only the header is read.
+func FetchHeader(rawURL string, timeout time.Duration) (*types.FileHeader, int64, error) {
+	header, size, err := fetchHeader(rawURL, timeout, fmt.Sprintf("bytes=0-%d", headerRange-1))
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		// The header is longer than the range; read it from the whole file
+		header, size, err = fetchHeader(rawURL, timeout, "")
+	}
+	return header, size, err
+}
+
+// fetchHeader reads a header from a GET of rawURL with the given Range.
+func fetchHeader(rawURL string, timeout time.Duration, byteRange string) (*types.FileHeader, int64, error) {
+	resp, err := fetch(rawURL, timeout, byteRange)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	size := resp.ContentLength
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusPartialContent:
+		// Content-Range: bytes 0-65535/123456
+		size = -1
+		if _, total, ok := strings.Cut(resp.Header.Get("Content-Range"), "/"); ok {
+			if n, err := strconv.ParseInt(total, 10, 64); err == nil {
+				size = n
+			}
+		}
+	default:
+		return nil, 0, fetchStatusError(rawURL, resp)
+	}
+
+	header, err := ReadHeader(bufio.NewReader(resp.Body))
+	if err != nil {
+		return nil, 0, err
+	}
+	return header, size, nil
+}
+
+// fetch sends a GET for rawURL, with a Range header if byteRange is set.
+func fetch(rawURL string, timeout time.Duration, byteRange string) (*http.Response, error) {
+	if timeout <= 0 {
+		timeout = DefaultFetchTimeout
+	}
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL %s: %v", rawURL, err)
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %v", rawURL, err)
+	}
+	return resp, nil
+}
+
+// fetchStatusError describes an unsuccessful HTTP response.
+func fetchStatusError(rawURL string, resp *http.Response) error {
+	return fmt.Errorf("failed to fetch %s: server returned %s", rawURL, resp.Status)
+}
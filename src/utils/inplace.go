@@ -0,0 +1,370 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"cryptotimed/src/crypto"
+)
+
+// InPlaceJournalSuffix is appended to the name of a file being transformed
+// in place to name its journal.
+const InPlaceJournalSuffix = ".inplace-journal"
+
+// Stages of an in-place transformation, as recorded in its journal.
+const (
+	inPlaceChunks = "chunks" // transforming chunk by chunk
+	inPlaceFinish = "finish" // every chunk done; header, size and name remain
+)
+
+// InPlace describes a file transformed within its own bytes between a
+// plaintext and an encrypted file with a chunked data section (see
+// crypto.EncryptStream), for disks too full to hold both at once.
+//
+// Sealing extends the file to its encrypted size and moves the chunks
+// towards the end, last chunk first, so no chunk is overwritten before it
+// has been read; opening moves them towards the start, first chunk first,
+// and truncates the file.  Before a chunk is overwritten its input is saved
+// in a journal next to the file, so an interrupted transformation can be
+// finished by ResumeInPlace.  The file is then renamed to Final.
+//
+// The journal holds the key and a chunk of plaintext, so it is only readable
+// by the owner and is removed once the file is renamed.  Neither direction
+// wipes the blocks the old contents occupied.
+type InPlace struct {
+	Path  string `json:"path"`  // the file transformed
+	Final string `json:"final"` // name the file ends up under
+	Seal  bool   `json:"seal"`  // plaintext to encrypted file (false: the reverse)
+
+	Key       []byte `json:"key"`        // key of the data section
+	ChunkSize int    `json:"chunk_size"` // plaintext bytes per chunk
+	Plaintext int64  `json:"plaintext"`  // size of the plaintext
+	HeadSize  int64  `json:"head_size"`  // bytes before the first chunk: header, data length and nonce prefix
+	Head      []byte `json:"head"`       // sealing: those bytes, written last
+	Prefix    []byte `json:"prefix"`     // the stream's nonce prefix (read from the file when opening)
+
+	Stage   string        `json:"stage"`
+	Pending *inPlaceChunk `json:"pending,omitempty"` // chunk being overwritten
+}
+
+// inPlaceChunk is the input of the chunk being overwritten.
+type inPlaceChunk struct {
+	Index int64  `json:"index"`
+	Data  []byte `json:"data"`
+}
+
+// inPlaceStep, if set, is called after every durable step of a
+// transformation; an error stops it there, as a crash would.
+var inPlaceStep func(step string) error
+
+// InPlaceJournalPath returns the journal of a transformation of path.
+func InPlaceJournalPath(path string) string {
+	return path + InPlaceJournalSuffix
+}
+
+// TransformInPlace transforms t.Path as t describes and renames it to
+// t.Final.  Opening first authenticates every chunk, so a damaged or
+// mismatched file fails before anything is overwritten.
+func TransformInPlace(t *InPlace) error {
+	if len(t.Key) != 32 {
+		return errors.New("in-place key must be 32 bytes")
+	}
+	if err := crypto.ValidateChunkSize(t.ChunkSize); err != nil {
+		return err
+	}
+	if t.Seal && int64(len(t.Head)) != t.HeadSize {
+		return errors.New("in-place header does not match its size")
+	}
+	if t.HeadSize < crypto.StreamNoncePrefixSize {
+		return errors.New("in-place header too short for the nonce prefix")
+	}
+	journal := InPlaceJournalPath(t.Path)
+	if _, err := os.Stat(journal); err == nil {
+		return fmt.Errorf("%s has an interrupted in-place operation (journal %s); finish it first", t.Path, journal)
+	}
+
+	f, err := os.OpenFile(t.Path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	want := t.Plaintext
+	if !t.Seal {
+		want = t.encryptedSize()
+	}
+	if info.Size() != want {
+		return fmt.Errorf("%s is %d bytes, expected %d", t.Path, info.Size(), want)
+	}
+
+	if !t.Seal {
+		t.Prefix = make([]byte, crypto.StreamNoncePrefixSize)
+		if _, err := f.ReadAt(t.Prefix, t.HeadSize-crypto.StreamNoncePrefixSize); err != nil {
+			return fmt.Errorf("failed to read nonce prefix: %v", err)
+		}
+		if err := t.verify(f); err != nil {
+			return err
+		}
+	} else if len(t.Prefix) != crypto.StreamNoncePrefixSize {
+		return errors.New("in-place nonce prefix must be 7 bytes")
+	}
+
+	t.Stage = inPlaceChunks
+	t.Pending = nil
+	if err := t.save(); err != nil {
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+	if err := inPlaceCheckpoint("journal"); err != nil {
+		return err
+	}
+	return t.run(f)
+}
+
+// ResumeInPlace finishes the transformation interrupted with the journal of
+// path.  It returns the finished transformation, or nil (and no error) if
+// path has no journal.
+func ResumeInPlace(path string) (*InPlace, error) {
+	data, err := os.ReadFile(InPlaceJournalPath(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := &InPlace{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("corrupt in-place journal %s: %v", InPlaceJournalPath(path), err)
+	}
+	if t.Path != path || len(t.Key) != 32 || len(t.Prefix) != crypto.StreamNoncePrefixSize ||
+		(t.Seal && int64(len(t.Head)) != t.HeadSize) || crypto.ValidateChunkSize(t.ChunkSize) != nil || (t.Stage != inPlaceChunks && t.Stage != inPlaceFinish) {
+		return nil, fmt.Errorf("invalid in-place journal %s", InPlaceJournalPath(path))
+	}
+
+	// Past the rename only the journal is left to remove
+	if t.Stage == inPlaceFinish {
+		if _, err := os.Stat(t.Path); errors.Is(err, fs.ErrNotExist) {
+			if _, err := os.Stat(t.Final); err == nil {
+				return t, os.Remove(InPlaceJournalPath(path))
+			}
+		}
+	}
+
+	f, err := os.OpenFile(t.Path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return t, t.run(f)
+}
+
+// run transforms the chunks of f not yet done, then finishes the file.
+func (t *InPlace) run(f *os.File) error {
+	if t.Stage == inPlaceChunks {
+		if t.Seal {
+			if err := f.Truncate(t.encryptedSize()); err != nil {
+				return fmt.Errorf("failed to extend %s: %v", t.Path, err)
+			}
+		}
+
+		n := t.chunks()
+		next, stop, dir := int64(0), n, int64(1)
+		if t.Seal {
+			next, stop, dir = n-1, -1, -1
+		}
+		if t.Pending != nil {
+			if err := t.writeChunk(f, t.Pending.Index, t.Pending.Data); err != nil {
+				return err
+			}
+			next = t.Pending.Index + dir
+		}
+		for i := next; i != stop; i += dir {
+			in := make([]byte, t.inputLen(i))
+			if _, err := f.ReadAt(in, t.inputOffset(i)); err != nil {
+				return fmt.Errorf("failed to read chunk %d: %v", i, err)
+			}
+			t.Pending = &inPlaceChunk{Index: i, Data: in}
+			if err := t.save(); err != nil {
+				return fmt.Errorf("failed to write journal: %v", err)
+			}
+			if err := inPlaceCheckpoint("pending"); err != nil {
+				return err
+			}
+			if err := t.writeChunk(f, i, in); err != nil {
+				return err
+			}
+		}
+
+		t.Stage = inPlaceFinish
+		t.Pending = nil
+		if err := t.save(); err != nil {
+			return fmt.Errorf("failed to write journal: %v", err)
+		}
+		if err := inPlaceCheckpoint("finish"); err != nil {
+			return err
+		}
+	}
+
+	if t.Seal {
+		if _, err := f.WriteAt(t.Head, 0); err != nil {
+			return fmt.Errorf("failed to write header: %v", err)
+		}
+	} else if err := f.Truncate(t.Plaintext); err != nil {
+		return fmt.Errorf("failed to truncate %s: %v", t.Path, err)
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := inPlaceCheckpoint("head"); err != nil {
+		return err
+	}
+	f.Close()
+
+	if err := os.Rename(t.Path, t.Final); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %v", t.Path, t.Final, err)
+	}
+	syncDir(filepath.Dir(t.Final))
+	if err := inPlaceCheckpoint("rename"); err != nil {
+		return err
+	}
+	return os.Remove(InPlaceJournalPath(t.Path))
+}
+
+// writeChunk transforms the input of chunk i and writes it in place.
+func (t *InPlace) writeChunk(f *os.File, i int64, in []byte) error {
+	var key [32]byte
+	copy(key[:], t.Key)
+	last := i == t.chunks()-1
+
+	var out []byte
+	var err error
+	if t.Seal {
+		out, err = crypto.SealStreamChunk(key, t.Prefix, uint64(i), last, in)
+	} else {
+		out, err = crypto.OpenStreamChunk(key, t.Prefix, uint64(i), last, in)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(out, t.outputOffset(i)); err != nil {
+		return fmt.Errorf("failed to write chunk %d: %v", i, err)
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return inPlaceCheckpoint("write")
+}
+
+// verify authenticates every chunk of f without writing anything.
+func (t *InPlace) verify(f *os.File) error {
+	var key [32]byte
+	copy(key[:], t.Key)
+	n := t.chunks()
+	for i := int64(0); i < n; i++ {
+		in := make([]byte, t.inputLen(i))
+		if _, err := f.ReadAt(in, t.inputOffset(i)); err != nil {
+			return fmt.Errorf("failed to read chunk %d: %v", i, err)
+		}
+		if _, err := crypto.OpenStreamChunk(key, t.Prefix, uint64(i), i == n-1, in); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunks returns the number of chunks; an empty plaintext is one empty
+// chunk.
+func (t *InPlace) chunks() int64 {
+	return max((t.Plaintext+int64(t.ChunkSize)-1)/int64(t.ChunkSize), 1)
+}
+
+// plainLen returns the plaintext length of chunk i.
+func (t *InPlace) plainLen(i int64) int64 {
+	return min(t.Plaintext-i*int64(t.ChunkSize), int64(t.ChunkSize))
+}
+
+// plainOffset and sealedOffset return where chunk i starts in the plaintext
+// and in the encrypted file.
+func (t *InPlace) plainOffset(i int64) int64 { return i * int64(t.ChunkSize) }
+func (t *InPlace) sealedOffset(i int64) int64 {
+	return t.HeadSize + i*int64(t.ChunkSize+crypto.StreamChunkOverhead)
+}
+
+func (t *InPlace) inputLen(i int64) int64 {
+	if t.Seal {
+		return t.plainLen(i)
+	}
+	return t.plainLen(i) + crypto.StreamChunkOverhead
+}
+
+func (t *InPlace) inputOffset(i int64) int64 {
+	if t.Seal {
+		return t.plainOffset(i)
+	}
+	return t.sealedOffset(i)
+}
+
+func (t *InPlace) outputOffset(i int64) int64 {
+	if t.Seal {
+		return t.sealedOffset(i)
+	}
+	return t.plainOffset(i)
+}
+
+// encryptedSize returns the size of the encrypted file.
+func (t *InPlace) encryptedSize() int64 {
+	return t.HeadSize - crypto.StreamNoncePrefixSize + crypto.StreamCiphertextSize(t.Plaintext, t.ChunkSize)
+}
+
+// save writes the journal durably: to a temporary file that is synced and
+// renamed over the previous journal.
+func (t *InPlace) save() error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	path := InPlaceJournalPath(t.Path)
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// syncDir makes a rename in dir durable where the platform allows it.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// inPlaceCheckpoint reports a durable step to inPlaceStep.
+func inPlaceCheckpoint(name string) error {
+	if inPlaceStep == nil {
+		return nil
+	}
+	return inPlaceStep(name)
+}
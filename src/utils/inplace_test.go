@@ -0,0 +1,205 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cryptotimed/src/crypto"
+)
+
+var errCrash = errors.New("simulated crash")
+
+// inPlaceFixture returns a plaintext, the encrypted file it must become and
+// the transformation between them (sealing; flip Seal and the names to open).
+func inPlaceFixture(t *testing.T, dir string, size int) ([]byte, []byte, *InPlace) {
+	t.Helper()
+	const chunk = crypto.MinChunkSize
+	plaintext := make([]byte, size)
+	rand.Read(plaintext)
+	key := make([]byte, 32)
+	rand.Read(key)
+	prefix := []byte{7, 6, 5, 4, 3, 2, 1}
+	head := append([]byte("header and data length"), prefix...)
+
+	var stream bytes.Buffer
+	if err := crypto.EncryptStreamWithOptions([32]byte(key), bytes.NewReader(plaintext), &stream,
+		crypto.StreamOptions{ChunkSize: chunk, NoncePrefix: prefix}); err != nil {
+		t.Fatal(err)
+	}
+	sealed := append(append([]byte(nil), head[:len(head)-len(prefix)]...), stream.Bytes()...)
+
+	return plaintext, sealed, &InPlace{
+		Path:      filepath.Join(dir, "doc.bin"),
+		Final:     filepath.Join(dir, "doc.bin.locked"),
+		Seal:      true,
+		Key:       key,
+		ChunkSize: chunk,
+		Plaintext: int64(size),
+		HeadSize:  int64(len(head)),
+		Head:      head,
+		Prefix:    prefix,
+	}
+}
+
+// opening returns the transformation that reverses tr.
+func opening(tr *InPlace) *InPlace {
+	return &InPlace{
+		Path:      tr.Final,
+		Final:     tr.Path,
+		Key:       tr.Key,
+		ChunkSize: tr.ChunkSize,
+		Plaintext: tr.Plaintext,
+		HeadSize:  tr.HeadSize,
+	}
+}
+
+func TestTransformInPlace(t *testing.T) {
+	for _, size := range []int{0, 100, 3*crypto.MinChunkSize + 5} {
+		dir := t.TempDir()
+		plaintext, sealed, tr := inPlaceFixture(t, dir, size)
+		if err := os.WriteFile(tr.Path, plaintext, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := TransformInPlace(tr); err != nil {
+			t.Fatalf("size %d: sealing failed: %v", size, err)
+		}
+		assertOnlyFile(t, dir, tr.Final, sealed)
+
+		if err := TransformInPlace(opening(tr)); err != nil {
+			t.Fatalf("size %d: opening failed: %v", size, err)
+		}
+		assertOnlyFile(t, dir, tr.Path, plaintext)
+	}
+}
+
+// inPlaceCase writes the input of a sealing or opening transformation to a
+// new directory and returns the transformation and its expected output.
+func inPlaceCase(t *testing.T, seal bool, size int) (string, *InPlace, []byte) {
+	t.Helper()
+	dir := t.TempDir()
+	plaintext, sealed, tr := inPlaceFixture(t, dir, size)
+	if seal {
+		if err := os.WriteFile(tr.Path, plaintext, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return dir, tr, sealed
+	}
+	if err := os.WriteFile(tr.Final, sealed, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, opening(tr), plaintext
+}
+
+// TestTransformInPlaceResumesAfterCrash stops a transformation after every
+// durable step in turn, optionally tearing the chunk being written, and
+// checks that ResumeInPlace finishes it.
+func TestTransformInPlaceResumesAfterCrash(t *testing.T) {
+	t.Cleanup(func() { inPlaceStep = nil })
+	size := 3*crypto.MinChunkSize + 5
+
+	for _, seal := range []bool{true, false} {
+		// Count the steps of an uninterrupted run
+		steps := 0
+		inPlaceStep = func(string) error { steps++; return nil }
+		_, tr, _ := inPlaceCase(t, seal, size)
+		if err := TransformInPlace(tr); err != nil {
+			t.Fatal(err)
+		}
+
+		for crashAt := 1; crashAt <= steps; crashAt++ {
+			for _, tear := range []bool{false, true} {
+				name := fmt.Sprintf("seal %v, crash at step %d, torn %v", seal, crashAt, tear)
+				dir, tr, want := inPlaceCase(t, seal, size)
+
+				call := 0
+				inPlaceStep = func(step string) error {
+					if call++; call < crashAt {
+						return nil
+					}
+					if tear && step == "pending" {
+						// Part of the chunk reached the disk before the crash
+						i := tr.Pending.Index
+						garbage := make([]byte, tr.inputLen(i)/2+1)
+						rand.Read(garbage)
+						f, err := os.OpenFile(tr.Path, os.O_WRONLY, 0)
+						if err != nil {
+							t.Fatal(err)
+						}
+						f.WriteAt(garbage, tr.outputOffset(i))
+						f.Close()
+					}
+					return errCrash
+				}
+				if err := TransformInPlace(tr); !errors.Is(err, errCrash) {
+					t.Fatalf("%s: got %v, want the simulated crash", name, err)
+				}
+
+				inPlaceStep = nil
+				resumed, err := ResumeInPlace(tr.Path)
+				if err != nil || resumed == nil {
+					t.Fatalf("%s: resume failed: %v", name, err)
+				}
+				assertOnlyFile(t, dir, tr.Final, want)
+				if again, err := ResumeInPlace(tr.Path); again != nil || err != nil {
+					t.Fatalf("%s: finished transformation resumed again (%v)", name, err)
+				}
+			}
+		}
+	}
+}
+
+func TestTransformInPlaceRefusesDamagedFile(t *testing.T) {
+	dir := t.TempDir()
+	_, sealed, tr := inPlaceFixture(t, dir, 2*crypto.MinChunkSize)
+	sealed[len(sealed)-1] ^= 1
+	if err := os.WriteFile(tr.Final, sealed, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is overwritten when any chunk fails to authenticate
+	if err := TransformInPlace(opening(tr)); err == nil {
+		t.Fatal("opened a damaged file")
+	}
+	assertOnlyFile(t, dir, tr.Final, sealed)
+
+	// An interrupted transformation must be finished before another starts
+	tr.Path = tr.Final
+	if err := os.WriteFile(InPlaceJournalPath(tr.Path), []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := TransformInPlace(opening(tr)); err == nil {
+		t.Error("started over an existing journal")
+	}
+	if _, err := ResumeInPlace(tr.Path); err == nil {
+		t.Error("resumed an invalid journal")
+	}
+}
+
+// assertOnlyFile checks that dir holds only name, with contents want.
+func assertOnlyFile(t *testing.T, dir, name string, want []byte) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != filepath.Base(name) {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Fatalf("directory holds %v, want only %s", names, filepath.Base(name))
+	}
+	got, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("%s has %d bytes that differ from the %d expected", name, len(got), len(want))
+	}
+}
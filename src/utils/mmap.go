@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// mmapThreshold is the file size above which OpenMapped memory-maps a file
+// instead of reading it into a heap buffer.  Small files are cheaper to read.
+var mmapThreshold int64 = 64 << 20
+
+// errMmapUnsupported is returned by mmapFile on platforms without mmap support.
+var errMmapUnsupported = errors.New("memory mapping not supported on this platform")
+
+// ErrSourceModified reports that a file changed while its contents were being
+// used.
+var ErrSourceModified = errors.New("file was modified while it was being read")
+
+// MappedFile is a read-only view of a file's contents.  Large files are
+// memory-mapped so their pages are shared with the page cache rather than
+// copied onto the heap; small files, and files on platforms or filesystems
+// where mapping fails, are read into memory instead.
+//
+// Accessing mapped memory after the underlying file has been truncated raises
+// SIGBUS, so callers should touch the data only inside Access.  Close must be
+// called on every exit path to release the mapping.
+//
+// The MappedFile of an encrypted file read at offsets (see
+// ReadEncryptedFileMappedFS) holds none of its contents: Access passes nil,
+// and the data is in the EncryptedFile.
+type MappedFile struct {
+	fsys    fs.FS // nil when there is no file to check
+	path    string
+	data    []byte
+	size    int64
+	modTime time.Time
+	unmap   func() error
+}
+
+// OpenMapped opens filename for reading, mapping it into memory when it is at
+// least mmapThreshold bytes long.
+func OpenMapped(filename string) (*MappedFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	m := &MappedFile{fsys: OS, path: filename, size: info.Size(), modTime: info.ModTime()}
+
+	if info.Mode().IsRegular() && info.Size() >= mmapThreshold && info.Size() == int64(int(info.Size())) {
+		data, unmap, err := mmapFile(f, int(info.Size()))
+		if err == nil {
+			m.data, m.unmap = data, unmap
+			runtime.SetFinalizer(m, (*MappedFile).Close)
+			return m, nil
+		}
+		// Fall back to a buffered read (unsupported platform or filesystem)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	m.data = data
+	return m, nil
+}
+
+// OpenMappedFS opens filename in fsys for reading.  Files of the OS
+// filesystem are opened with OpenMapped; others are read into memory.
+func OpenMappedFS(fsys fs.FS, filename string) (*MappedFile, error) {
+	if IsOS(fsys) {
+		return OpenMapped(filename)
+	}
+	info, err := fs.Stat(fsys, filename)
+	if err != nil {
+		return nil, err
+	}
+	data, err := fs.ReadFile(fsys, filename)
+	if err != nil {
+		return nil, err
+	}
+	return &MappedFile{fsys: fsys, path: filename, data: data, size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+// Bytes returns the file contents.  For mapped files the slice is only valid
+// until Close and should be accessed inside Access.
+func (m *MappedFile) Bytes() []byte {
+	return m.data
+}
+
+// Mapped reports whether the contents are backed by a memory mapping.
+func (m *MappedFile) Mapped() bool {
+	return m.unmap != nil
+}
+
+// Access runs fn with the file contents, converting a memory fault (for
+// example SIGBUS after the file was truncated) into ErrSourceModified instead
+// of crashing.  After fn returns, the file is checked for size or
+// modification-time changes.
+func (m *MappedFile) Access(fn func(data []byte) error) (err error) {
+	if m.Mapped() {
+		old := debug.SetPanicOnFault(true)
+		defer debug.SetPanicOnFault(old)
+		defer func() {
+			if r := recover(); r != nil {
+				if _, ok := r.(interface{ Addr() uintptr }); ok {
+					err = fmt.Errorf("%s: %w", m.path, ErrSourceModified)
+					return
+				}
+				panic(r)
+			}
+		}()
+	}
+
+	if err := fn(m.data); err != nil {
+		return err
+	}
+	return m.CheckUnchanged()
+}
+
+// CheckUnchanged returns ErrSourceModified if the file's size or modification
+// time differs from when it was opened.
+func (m *MappedFile) CheckUnchanged() error {
+	if m.fsys == nil {
+		return nil
+	}
+	info, err := fs.Stat(m.fsys, m.path)
+	if err != nil {
+		return err
+	}
+	if info.Size() != m.size || !info.ModTime().Equal(m.modTime) {
+		return fmt.Errorf("%s: %w", m.path, ErrSourceModified)
+	}
+	return nil
+}
+
+// Close releases the mapping.  It is safe to call more than once.
+func (m *MappedFile) Close() error {
+	m.data = nil
+	if m.unmap == nil {
+		return nil
+	}
+	unmap := m.unmap
+	m.unmap = nil
+	runtime.SetFinalizer(m, nil)
+	return unmap()
+}
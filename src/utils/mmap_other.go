@@ -0,0 +1,11 @@
+//go:build !unix && !windows
+
+package utils
+
+import "os"
+
+// mmapFile is unavailable on this platform; OpenMapped falls back to reading
+// the file into memory.
+func mmapFile(f *os.File, size int) ([]byte, func() error, error) {
+	return nil, nil, errMmapUnsupported
+}
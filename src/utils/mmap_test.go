@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// withMmapThreshold lowers the mapping threshold for the duration of a test.
+func withMmapThreshold(t *testing.T, threshold int64) {
+	old := mmapThreshold
+	mmapThreshold = threshold
+	t.Cleanup(func() { mmapThreshold = old })
+}
+
+func TestOpenMappedSmallFileIsRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "small.bin")
+	content := []byte("small file")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	m, err := OpenMapped(path)
+	if err != nil {
+		t.Fatalf("OpenMapped failed: %v", err)
+	}
+	defer m.Close()
+
+	if m.Mapped() {
+		t.Errorf("file below threshold should not be mapped")
+	}
+	if !bytes.Equal(m.Bytes(), content) {
+		t.Errorf("content mismatch")
+	}
+}
+
+func TestOpenMappedLargeFile(t *testing.T) {
+	withMmapThreshold(t, 4096)
+
+	path := filepath.Join(t.TempDir(), "large.bin")
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	m, err := OpenMapped(path)
+	if err != nil {
+		t.Fatalf("OpenMapped failed: %v", err)
+	}
+	if !m.Mapped() {
+		t.Skip("memory mapping unavailable on this platform/filesystem")
+	}
+
+	err = m.Access(func(data []byte) error {
+		if !bytes.Equal(data, content) {
+			t.Errorf("mapped content mismatch")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Access failed: %v", err)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Errorf("second Close failed: %v", err)
+	}
+	if m.Bytes() != nil {
+		t.Errorf("Bytes should be nil after Close")
+	}
+}
+
+func TestMappedFileDetectsTruncation(t *testing.T) {
+	withMmapThreshold(t, 4096)
+
+	path := filepath.Join(t.TempDir(), "shrinking.bin")
+	content := bytes.Repeat([]byte{0x5A}, 1<<20)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	m, err := OpenMapped(path)
+	if err != nil {
+		t.Fatalf("OpenMapped failed: %v", err)
+	}
+	defer m.Close()
+	if !m.Mapped() {
+		t.Skip("memory mapping unavailable on this platform/filesystem")
+	}
+
+	// Truncate the file underneath the mapping; touching the tail now faults
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+
+	err = m.Access(func(data []byte) error {
+		bytes.IndexByte(data, 0xFF) // scans every page
+		return nil
+	})
+	if !errors.Is(err, ErrSourceModified) {
+		t.Fatalf("expected ErrSourceModified, got %v", err)
+	}
+}
+
+func TestMappedFileDetectsModification(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "growing.bin")
+	if err := os.WriteFile(path, []byte("original"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	m, err := OpenMapped(path)
+	if err != nil {
+		t.Fatalf("OpenMapped failed: %v", err)
+	}
+	defer m.Close()
+
+	err = m.Access(func([]byte) error {
+		// Simulate another process appending while we work
+		later := time.Now().Add(time.Second)
+		if err := os.WriteFile(path, []byte("original plus more"), 0644); err != nil {
+			return err
+		}
+		return os.Chtimes(path, later, later)
+	})
+	if !errors.Is(err, ErrSourceModified) {
+		t.Fatalf("expected ErrSourceModified, got %v", err)
+	}
+}
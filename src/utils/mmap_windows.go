@@ -0,0 +1,29 @@
+//go:build windows
+
+package utils
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// mmapFile maps the first size bytes of f read-only.
+func mmapFile(f *os.File, size int) ([]byte, func() error, error) {
+	mapping, err := windows.CreateFileMapping(windows.Handle(f.Fd()), nil, windows.PAGE_READONLY, 0, 0, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	addr, err := windows.MapViewOfFile(mapping, windows.FILE_MAP_READ, 0, 0, uintptr(size))
+	// The view keeps the mapping object alive, so the handle can be closed now
+	windows.CloseHandle(mapping)
+	if err != nil {
+		return nil, nil, err
+	}
+	// addr is OS-owned memory outside the Go heap; reinterpret it without a
+	// uintptr->Pointer conversion that vet would flag.
+	ptr := *(*unsafe.Pointer)(unsafe.Pointer(&addr))
+	data := unsafe.Slice((*byte)(ptr), size)
+	return data, func() error { return windows.UnmapViewOfFile(addr) }, nil
+}
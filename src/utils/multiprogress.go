@@ -0,0 +1,296 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLogInterval is how often MultiProgress logs the progress of each
+// operation when its output is not a terminal.
+const DefaultLogInterval = time.Minute
+
+const (
+	// multiBarWidth is the width of each bar drawn by MultiProgress.
+	multiBarWidth = 30
+
+	// multiNameWidth is the widest operation name MultiProgress draws;
+	// longer names are shortened from the left.
+	multiNameWidth = 28
+)
+
+// MultiProgress shows the progress of several operations at once, such as
+// the solves of a batch.  On a terminal it owns the lines at the bottom of
+// the output: one per running operation (name, bar, ETA) and a totals line,
+// redrawn together in a single write so that concurrent updates never
+// garble each other.  Anywhere else it writes plain log lines instead, at
+// most one per operation every DefaultLogInterval.  Each operation only
+// reports its own progress, through the Update method of its
+// ProgressTask; none of them needs to know about the others.
+type MultiProgress struct {
+	mu          sync.Mutex
+	out         io.Writer
+	terminal    bool          // draw bars in place rather than log lines
+	logInterval time.Duration // time between log lines of one operation
+	startTime   time.Time
+	tasks       []*ProgressTask // running operations, in the order they started
+	drawn       int             // lines of the region on screen (0 = none)
+
+	expectTasks int    // operations expected in all (0 = unknown)
+	expectTotal uint64 // their combined total (0 = unknown)
+	finished    int    // operations finished so far
+	finishedSum uint64 // combined total of the finished operations
+
+	stopTicker chan struct{}
+	tickerDone chan struct{}
+	stopOnce   sync.Once
+}
+
+// ProgressTask is one operation shown by a MultiProgress.
+type ProgressTask struct {
+	m        *MultiProgress
+	name     string
+	bar      *ProgressBar // keeps the numbers; never drawn itself
+	lastLog  time.Time
+	finished bool
+}
+
+// NewMultiProgress returns a MultiProgress writing to w, drawing bars if w
+// is a terminal.
+func NewMultiProgress(w io.Writer) *MultiProgress {
+	f, ok := w.(*os.File)
+	return &MultiProgress{
+		out:         w,
+		terminal:    ok && IsTerminal(f),
+		logInterval: DefaultLogInterval,
+		startTime:   time.Now(),
+	}
+}
+
+// Expect records how many operations will run and their combined total, so
+// that the totals line can show the progress of all of them.
+func (m *MultiProgress) Expect(tasks int, total uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.expectTasks, m.expectTotal = tasks, total
+	m.redraw()
+}
+
+// Add starts showing an operation of total steps under name.
+func (m *MultiProgress) Add(name string, total uint64) *ProgressTask {
+	bar := NewProgressBar(total)
+	bar.HideBar()
+	t := &ProgressTask{m: m, name: name, bar: bar}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tasks = append(m.tasks, t)
+	if !m.terminal {
+		t.lastLog = time.Now()
+		fmt.Fprintf(m.out, "%s: started (%d squarings)\n", name, total)
+	}
+	m.redraw()
+	return t
+}
+
+// Update records the progress of the operation; it has the signature of a
+// progress callback.  An operation that reaches its total is finished.
+func (t *ProgressTask) Update(done uint64) {
+	t.bar.Update(done)
+	info := t.bar.Info()
+	if done >= info.Total {
+		t.Finish()
+		return
+	}
+
+	m := t.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t.finished {
+		return
+	}
+	if m.terminal {
+		m.redraw()
+		return
+	}
+	if now := time.Now(); now.Sub(t.lastLog) >= m.logInterval {
+		t.lastLog = now
+		fmt.Fprintf(m.out, "%s: %s\n", t.name, info.Snapshot(time.Time{}))
+	}
+}
+
+// Finish stops showing the operation, printing one line saying it finished
+// and how long it took.  It is safe to call more than once.
+func (t *ProgressTask) Finish() {
+	m := t.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t.finished {
+		return
+	}
+	t.finished = true
+	for i, other := range m.tasks {
+		if other == t {
+			m.tasks = append(m.tasks[:i], m.tasks[i+1:]...)
+			break
+		}
+	}
+	info := t.bar.Info()
+	m.finished++
+	m.finishedSum += info.Total
+	m.printLine(fmt.Sprintf("%s: done in %s", t.name, FormatDuration(info.Elapsed)))
+}
+
+// Printf prints a line of text above the bars.
+func (m *MultiProgress) Printf(format string, args ...interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.printLine(fmt.Sprintf(format, args...))
+}
+
+// StartTicker redraws the bars every interval, so that elapsed times and
+// ETAs keep moving between updates.  It does nothing unless the output is a
+// terminal or interval is positive.
+func (m *MultiProgress) StartTicker(interval time.Duration) {
+	if interval <= 0 || !m.terminal || m.stopTicker != nil {
+		return
+	}
+	m.stopTicker = make(chan struct{})
+	m.tickerDone = make(chan struct{})
+
+	go func() {
+		defer close(m.tickerDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stopTicker:
+				return
+			case <-ticker.C:
+				m.mu.Lock()
+				m.redraw()
+				m.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// Stop stops the ticker and leaves the last drawn bars on screen, with the
+// cursor on the line below them.  Operations still running are not
+// finished.  It is safe to call more than once.
+func (m *MultiProgress) Stop() {
+	if m.stopTicker != nil {
+		m.stopOnce.Do(func() { close(m.stopTicker) })
+		<-m.tickerDone
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.drawn > 0 {
+		fmt.Fprintln(m.out)
+		m.drawn = 0
+	}
+}
+
+// printLine writes line above the region and redraws it.  The caller must
+// hold m.mu.
+func (m *MultiProgress) printLine(line string) {
+	if !m.terminal {
+		fmt.Fprintln(m.out, line)
+		return
+	}
+	var frame bytes.Buffer
+	m.clear(&frame)
+	frame.WriteString(line + "\n")
+	m.draw(&frame)
+	m.out.Write(frame.Bytes())
+}
+
+// redraw replaces the region with its current contents.  The caller must
+// hold m.mu.
+func (m *MultiProgress) redraw() {
+	if !m.terminal {
+		return
+	}
+	var frame bytes.Buffer
+	m.clear(&frame)
+	m.draw(&frame)
+	m.out.Write(frame.Bytes())
+}
+
+// clear moves the cursor to the start of the region and erases it.
+func (m *MultiProgress) clear(frame *bytes.Buffer) {
+	if m.drawn > 1 {
+		fmt.Fprintf(frame, "\033[%dA", m.drawn-1)
+	}
+	frame.WriteString("\r\033[J")
+	m.drawn = 0
+}
+
+// draw writes the region, leaving the cursor at the end of its last line.
+func (m *MultiProgress) draw(frame *bytes.Buffer) {
+	lines := make([]string, 0, len(m.tasks)+1)
+	for _, t := range m.tasks {
+		lines = append(lines, t.line())
+	}
+	lines = append(lines, m.totals())
+	frame.WriteString(strings.Join(lines, "\n"))
+	m.drawn = len(lines)
+}
+
+// line formats the bar of a running operation.
+func (t *ProgressTask) line() string {
+	info := t.bar.Info()
+	fraction := 0.0
+	if info.Total > 0 {
+		fraction = float64(info.Done) / float64(info.Total)
+	}
+	filled := int(fraction * multiBarWidth)
+	bar := strings.Repeat("=", filled)
+	if filled < multiBarWidth {
+		bar += ">" + strings.Repeat(" ", multiBarWidth-filled-1)
+	}
+	eta := "ETA --"
+	if info.Rate > 0 {
+		eta = "ETA " + FormatDuration(info.ETA)
+	}
+
+	name := t.name
+	if r := []rune(name); len(r) > multiNameWidth {
+		name = "…" + string(r[len(r)-multiNameWidth+1:])
+	}
+	return fmt.Sprintf("%-*s [%s] %5.1f%% %s", multiNameWidth, name, bar, fraction*100, eta)
+}
+
+// totals formats the line summing up every operation.  The caller must hold
+// m.mu.
+func (m *MultiProgress) totals() string {
+	done, total := m.finishedSum, m.finishedSum
+	for _, t := range m.tasks {
+		info := t.bar.Info()
+		done += info.Done
+		total += info.Total
+	}
+	if m.expectTotal > total {
+		total = m.expectTotal
+	}
+	count := fmt.Sprintf("%d", m.finished)
+	if m.expectTasks > 0 {
+		count += fmt.Sprintf("/%d", m.expectTasks)
+	}
+
+	line := fmt.Sprintf("Total: %s done, %d running", count, len(m.tasks))
+	if total > 0 {
+		line += fmt.Sprintf(", %.1f%% of %d squarings", float64(done)/float64(total)*100, total)
+	}
+	// Overall throughput, which counts every operation running at once
+	if elapsed := time.Since(m.startTime); done > 0 && done < total && elapsed > 0 {
+		rate := float64(done) / elapsed.Seconds()
+		line += ", ETA " + FormatDuration(EstimateTime(total-done, rate))
+	}
+	return line
+}
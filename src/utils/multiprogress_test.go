@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// frameRecorder keeps every Write separately, to check that each redraw
+// reaches the terminal in one piece.
+type frameRecorder struct {
+	mu     sync.Mutex
+	frames []string
+}
+
+func (r *frameRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.frames = append(r.frames, string(p))
+	return len(p), nil
+}
+
+func TestMultiProgressTerminal(t *testing.T) {
+	rec := &frameRecorder{}
+	m := NewMultiProgress(rec)
+	m.terminal = true
+	m.Expect(3, 3000)
+
+	// Concurrent operations update at once
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		task := m.Add(fmt.Sprintf("file%d.locked", i), 1000)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for done := uint64(100); done <= 1000; done += 100 {
+				task.Update(done)
+			}
+		}()
+	}
+	wg.Wait()
+	m.Printf("all solved")
+	m.Stop()
+
+	for i, frame := range rec.frames[:len(rec.frames)-1] {
+		// Every frame erases the region and redraws it whole, ending with
+		// the totals line
+		if !strings.Contains(frame, "\r\033[J") {
+			t.Fatalf("frame %d does not clear the region: %q", i, frame)
+		}
+		lines := strings.Split(frame[strings.LastIndex(frame, "\033[J")+3:], "\n")
+		if last := lines[len(lines)-1]; !strings.HasPrefix(last, "Total: ") {
+			t.Fatalf("frame %d ends with %q, want the totals line", i, last)
+		}
+		for _, line := range lines[:len(lines)-1] {
+			if !strings.Contains(line, ".locked") && line != "all solved" {
+				t.Fatalf("frame %d has stray line %q", i, line)
+			}
+		}
+	}
+
+	all := strings.Join(rec.frames, "")
+	for i := 0; i < 3; i++ {
+		if !strings.Contains(all, fmt.Sprintf("file%d.locked: done in", i)) {
+			t.Errorf("no completion line for file%d", i)
+		}
+	}
+	last := rec.frames[len(rec.frames)-2]
+	if !strings.Contains(last, "Total: 3/3 done, 0 running, 100.0% of 3000 squarings") {
+		t.Errorf("final totals line wrong: %q", last)
+	}
+	if rec.frames[len(rec.frames)-1] != "\n" {
+		t.Errorf("Stop wrote %q, want a newline below the region", rec.frames[len(rec.frames)-1])
+	}
+}
+
+func TestMultiProgressLog(t *testing.T) {
+	var out bytes.Buffer
+	m := NewMultiProgress(&out)
+	if m.terminal {
+		t.Fatal("a buffer is treated as a terminal")
+	}
+	m.logInterval = 0
+
+	a := m.Add("a.locked", 100)
+	b := m.Add("b.locked", 200)
+	a.Update(50)
+	b.Update(50)
+	a.Update(100)
+	b.Finish()
+	b.Finish()
+	m.Stop()
+
+	got := out.String()
+	if strings.Contains(got, "\r") || strings.Contains(got, "\033") {
+		t.Errorf("log output has terminal control codes: %q", got)
+	}
+	want := []string{
+		"a.locked: started (100 squarings)",
+		"b.locked: started (200 squarings)",
+		"a.locked: 50/100 squarings (50.00%)",
+		"b.locked: 50/200 squarings (25.00%)",
+		"a.locked: done in",
+		"b.locked: done in",
+	}
+	lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(want), got)
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix(lines[i], prefix) {
+			t.Errorf("line %d = %q, want it to start with %q", i, lines[i], prefix)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// PartialOutputSuffix is appended to the name of a decrypt checkpoint to name
+// the record of the output it is writing.
+const PartialOutputSuffix = ".output"
+
+// PartialOutput records how far the plaintext of a chunked file has been
+// written, so that a decrypt interrupted while writing it carries on from
+// the last chunk recorded instead of starting over.  Each recorded chunk
+// was flushed to the partial file before the record was saved.
+//
+// The record holds a hash of plaintext, so it is only readable by the owner.
+type PartialOutput struct {
+	Fingerprint string `json:"fingerprint"` // SHA-256 of the encrypted file's header, in hex
+	Output      string `json:"output"`      // name the output gets once complete
+	Partial     string `json:"partial"`     // file the plaintext is written to until then
+	ChunkSize   int    `json:"chunk_size"`  // plaintext bytes per chunk
+	Chunks      uint64 `json:"chunks"`      // chunks fully written to Partial
+	Hash        string `json:"hash"`        // SHA-256 of their plaintext, in hex
+}
+
+// PartialOutputPath returns the record kept alongside checkpoint.
+func PartialOutputPath(checkpoint string) string {
+	return checkpoint + PartialOutputSuffix
+}
+
+// PartialFileName returns the file the output is written to until it is
+// complete: a hidden file next to it.
+func PartialFileName(output string) string {
+	return filepath.Join(filepath.Dir(output), "."+filepath.Base(output)+".partial")
+}
+
+// SavePartialOutput writes the record to path, replacing it atomically.
+func SavePartialOutput(p *PartialOutput, path string) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+// LoadPartialOutput reads a record written by SavePartialOutput.
+func LoadPartialOutput(path string) (*PartialOutput, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p PartialOutput
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("%s is not an output record: %v", path, err)
+	}
+	return &p, nil
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ReadPIDFile returns the process ID recorded in the pidfile at path.
+func ReadPIDFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid pidfile %s", path)
+	}
+	return pid, nil
+}
+
+// CheckPIDFile returns the process recorded in the pidfile at path and
+// whether it is still running.  A pidfile left behind by a process that has
+// exited (e.g. after a crash) is stale: it is removed, and its pid returned
+// with running false.  Without a pidfile it returns 0, false.
+func CheckPIDFile(path string) (pid int, running bool, err error) {
+	pid, err = ReadPIDFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if ProcessRunning(pid) {
+		return pid, true, nil
+	}
+	if err := RemovePIDFile(path, pid); err != nil {
+		return pid, false, fmt.Errorf("failed to remove stale pidfile: %v", err)
+	}
+	return pid, false, nil
+}
+
+// CreatePIDFile records pid in a new pidfile at path.  It fails if the file
+// already exists, so two processes cannot claim the same pidfile.
+func CreatePIDFile(path string, pid int) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%d\n", pid); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// RemovePIDFile removes the pidfile at path if it still records pid, so a
+// process never removes a pidfile that has since been claimed by another.
+func RemovePIDFile(path string, pid int) error {
+	recorded, err := ReadPIDFile(path)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && recorded != pid) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !unix
+
+package utils
+
+import (
+	"os"
+	"syscall"
+)
+
+// ProcessRunning reports whether a process with this pid exists.
+func ProcessRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// DetachedProcAttr returns nil: processes are not tied to a terminal session
+// on this platform.
+func DetachedProcAttr() *syscall.SysProcAttr {
+	return nil
+}
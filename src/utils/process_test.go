@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestPIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "solve.pid")
+
+	if pid, running, err := CheckPIDFile(path); pid != 0 || running || err != nil {
+		t.Fatalf("CheckPIDFile without a pidfile = %d, %v, %v", pid, running, err)
+	}
+
+	// This process is running
+	if err := CreatePIDFile(path, os.Getpid()); err != nil {
+		t.Fatalf("CreatePIDFile failed: %v", err)
+	}
+	if err := CreatePIDFile(path, os.Getpid()); err == nil {
+		t.Error("CreatePIDFile should not replace an existing pidfile")
+	}
+	if pid, running, err := CheckPIDFile(path); pid != os.Getpid() || !running || err != nil {
+		t.Fatalf("CheckPIDFile = %d, %v, %v; want our pid, running", pid, running, err)
+	}
+
+	// Another process's pidfile is left alone
+	if err := RemovePIDFile(path, os.Getpid()+1); err != nil {
+		t.Fatalf("RemovePIDFile failed: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("RemovePIDFile removed a pidfile recording another pid")
+	}
+	if err := RemovePIDFile(path, os.Getpid()); err != nil {
+		t.Fatalf("RemovePIDFile failed: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("RemovePIDFile left our pidfile behind")
+	}
+}
+
+func TestPIDFileStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "solve.pid")
+
+	// A process that has exited, as after a crash
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("failed to run a short-lived process: %v", err)
+	}
+	exited := cmd.ProcessState.Pid()
+	if err := CreatePIDFile(path, exited); err != nil {
+		t.Fatalf("CreatePIDFile failed: %v", err)
+	}
+
+	pid, running, err := CheckPIDFile(path)
+	if err != nil || running || pid != exited {
+		t.Fatalf("CheckPIDFile = %d, %v, %v; want stale pid %d", pid, running, err, exited)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("stale pidfile was not removed")
+	}
+
+	if err := os.WriteFile(path, []byte("not a pid\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := CheckPIDFile(path); err == nil {
+		t.Error("expected an error for an invalid pidfile")
+	}
+}
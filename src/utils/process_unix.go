@@ -0,0 +1,22 @@
+//go:build unix
+
+package utils
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ProcessRunning reports whether a process with this pid exists.  A pid
+// reused by an unrelated process counts as running.
+func ProcessRunning(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || err == unix.EPERM
+}
+
+// DetachedProcAttr returns the attributes that start a process in its own
+// session, so it survives the terminal it was started from.
+func DetachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
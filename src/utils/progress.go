@@ -2,36 +2,133 @@ package utils
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"sync"
 	"time"
+
+	"cryptotimed/src/crypto"
 )
 
-// ProgressBar represents a simple progress bar for long-running operations
+// DefaultRedrawInterval is how often a ticking progress bar redraws itself
+// when no progress update has arrived.
+const DefaultRedrawInterval = time.Second
+
+// ProgressBar represents a simple progress bar for long-running operations.
+// Update and the redraw ticker may run on different goroutines.
 type ProgressBar struct {
+	mu        sync.Mutex
 	total     uint64
 	current   uint64
 	startTime time.Time
 	lastPrint time.Time
 	width     int
+	out       io.Writer
+	hidden    bool                    // only Printf lines are written (see HideBar)
+	logEvery  time.Duration           // write progress lines this often instead of drawing (see LogLines)
+	lastLog   time.Time               // when the last progress line was written
+	loggedEnd bool                    // the line of the complete bar was written
+	strategy  crypto.ProgressStrategy // when Update redraws (see SetStrategy)
+
+	baseline  uint64        // progress already made when the bar started (resumed work)
+	paused    bool          // progress is paused; elapsed time stops counting
+	pausedAt  time.Time     // start of the current pause
+	pausedFor time.Duration // total time of earlier pauses
+
+	stopTicker chan struct{} // closed to stop the redraw ticker
+	tickerDone chan struct{} // closed when the redraw ticker has exited
+	stopOnce   sync.Once
 }
 
-// NewProgressBar creates a new progress bar
+// NewProgressBar creates a new progress bar.  If standard output is a
+// console that cannot redraw a line, it writes progress lines every
+// PlainProgressInterval instead (see LogLines).
 func NewProgressBar(total uint64) *ProgressBar {
-	return &ProgressBar{
+	pb := &ProgressBar{
 		total:     total,
 		current:   0,
 		startTime: time.Now(),
 		lastPrint: time.Now(),
 		width:     50,
+		out:       os.Stdout,
+		strategy:  DefaultRedrawStrategy,
+	}
+	if !StdoutConsole().Redraw {
+		pb.LogLines(PlainProgressInterval)
+	}
+	return pb
+}
+
+// SetOutput sends the bar and its messages to w instead of stdout.
+func (pb *ProgressBar) SetOutput(w io.Writer) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	pb.out = w
+}
+
+// DefaultRedrawStrategy limits Update to redrawing every 100ms, so fast
+// progress does not flood the terminal.
+var DefaultRedrawStrategy crypto.ProgressStrategy = crypto.TimeBased(100 * time.Millisecond)
+
+// SetStrategy changes when Update redraws the bar.  Completion is always
+// drawn.
+func (pb *ProgressBar) SetStrategy(strategy crypto.ProgressStrategy) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	pb.strategy = strategy
+}
+
+// StartTicker redraws the bar every interval, independently of Update, so
+// that elapsed time and ETA keep moving while progress callbacks are far
+// apart.  It is stopped by StopTicker or Finish.  A non-positive interval
+// disables it.
+func (pb *ProgressBar) StartTicker(interval time.Duration) {
+	if interval <= 0 || pb.stopTicker != nil {
+		return
+	}
+	pb.stopTicker = make(chan struct{})
+	pb.tickerDone = make(chan struct{})
+
+	go func() {
+		defer close(pb.tickerDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pb.stopTicker:
+				return
+			case <-ticker.C:
+				pb.mu.Lock()
+				if time.Since(pb.lastPrint) >= interval {
+					pb.lastPrint = time.Now()
+					pb.print()
+				}
+				pb.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// StopTicker stops the redraw ticker started by StartTicker and waits for it
+// to exit.  It is safe to call more than once.
+func (pb *ProgressBar) StopTicker() {
+	if pb.stopTicker == nil {
+		return
 	}
+	pb.stopOnce.Do(func() { close(pb.stopTicker) })
+	<-pb.tickerDone
 }
 
 // Update updates the progress bar with the current progress
 func (pb *ProgressBar) Update(current uint64) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
 	pb.current = current
 
-	// Only print updates every 100ms to avoid flooding the terminal
+	// Only redraw as often as the strategy allows; progress lines keep to
+	// their own interval
 	now := time.Now()
-	if now.Sub(pb.lastPrint) < 100*time.Millisecond && current < pb.total {
+	if current < pb.total && pb.logEvery == 0 && !pb.strategy.ShouldReport(current, pb.total, now.Sub(pb.lastPrint)) {
 		return
 	}
 	pb.lastPrint = now
@@ -39,24 +136,158 @@ func (pb *ProgressBar) Update(current uint64) {
 	pb.print()
 }
 
-// Finish completes the progress bar
+// Finish stops the redraw ticker and completes the progress bar
 func (pb *ProgressBar) Finish() {
+	pb.StopTicker()
+
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
 	pb.current = pb.total
+	if pb.hidden {
+		return
+	}
+	pb.print()
+	if pb.logEvery == 0 {
+		fmt.Fprintln(pb.out) // New line after completion
+	}
+}
+
+// HideBar stops the bar itself from being drawn, for output that goes to a
+// log file: only the lines passed to Printf are written, without terminal
+// control codes.  The numbers reported by Info are unaffected.
+func (pb *ProgressBar) HideBar() {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	pb.hidden = true
+}
+
+// LogLines stops the bar from being redrawn in place, for consoles that do
+// not honour \r or escape sequences: a line with the same numbers is written
+// instead, at most every interval and on completion, and Printf lines are
+// written as they are.
+func (pb *ProgressBar) LogLines(interval time.Duration) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	pb.logEvery = interval
+	pb.lastLog = time.Now()
+}
+
+// SetBaseline records progress that was already made before the bar
+// started, such as resumed work, so that the rate and ETA only count the
+// work done since.
+func (pb *ProgressBar) SetBaseline(done uint64) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	pb.baseline = done
+	if pb.current < done {
+		pb.current = done
+	}
+	pb.print()
+}
+
+// SetPaused marks the bar as paused or running.  Paused time is left out of
+// the elapsed time, rate and ETA.
+func (pb *ProgressBar) SetPaused(paused bool) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	if paused == pb.paused {
+		return
+	}
+	if paused {
+		pb.pausedAt = time.Now()
+	} else {
+		pb.pausedFor += time.Since(pb.pausedAt)
+	}
+	pb.paused = paused
+	pb.print()
+}
+
+// Printf prints a line of text above the bar and redraws it.
+func (pb *ProgressBar) Printf(format string, args ...interface{}) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	if pb.hidden || pb.logEvery > 0 {
+		fmt.Fprintf(pb.out, format+"\n", args...)
+		return
+	}
+	fmt.Fprintf(pb.out, "\r\033[K"+format+"\n", args...)
 	pb.print()
-	fmt.Println() // New line after completion
 }
 
-// print renders the progress bar to stdout
+// ProgressInfo is a snapshot of a progress bar's numbers
+type ProgressInfo struct {
+	Done     uint64
+	Total    uint64
+	Elapsed  time.Duration // active time, excluding pauses
+	Paused   time.Duration // total time spent paused
+	Rate     float64       // operations per second since the bar started (0 = unknown)
+	ETA      time.Duration // 0 when unknown
+	IsPaused bool
+}
+
+// Info returns the current numbers of the bar.
+func (pb *ProgressBar) Info() ProgressInfo {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	return pb.info()
+}
+
+// info computes Info.  The caller must hold pb.mu.
+func (pb *ProgressBar) info() ProgressInfo {
+	paused := pb.pausedFor
+	if pb.paused {
+		paused += time.Since(pb.pausedAt)
+	}
+	info := ProgressInfo{
+		Done:     pb.current,
+		Total:    pb.total,
+		Elapsed:  time.Since(pb.startTime) - paused,
+		Paused:   paused,
+		IsPaused: pb.paused,
+	}
+	if done := pb.current - pb.baseline; pb.current > pb.baseline && info.Elapsed > 0 {
+		info.Rate = float64(done) / info.Elapsed.Seconds()
+		info.ETA = time.Duration(float64(info.Elapsed) * float64(pb.total-pb.current) / float64(done))
+	}
+	return info
+}
+
+// Snapshot formats info as a single status line, like dd prints on SIGUSR1.
+// lastCheckpoint is when progress was last saved (zero if never).
+func (info ProgressInfo) Snapshot(lastCheckpoint time.Time) string {
+	var percentage float64
+	if info.Total > 0 {
+		percentage = float64(info.Done) / float64(info.Total) * 100
+	}
+	line := fmt.Sprintf("%d/%d squarings (%.2f%%)", info.Done, info.Total, percentage)
+	if info.Rate > 0 {
+		line += fmt.Sprintf(", %.0f squarings/s, ETA %s", info.Rate, FormatDuration(info.ETA))
+	} else {
+		line += ", rate unknown"
+	}
+	if lastCheckpoint.IsZero() {
+		line += ", no checkpoint yet"
+	} else {
+		line += fmt.Sprintf(", checkpoint %s ago", FormatDuration(time.Since(lastCheckpoint)))
+	}
+	if info.IsPaused {
+		line += ", paused"
+	}
+	return line
+}
+
+// print renders the progress bar.  The caller must hold pb.mu.
 func (pb *ProgressBar) print() {
+	if pb.hidden {
+		return
+	}
+	info := pb.info()
 	percentage := float64(pb.current) / float64(pb.total) * 100
-	filled := int(float64(pb.width) * float64(pb.current) / float64(pb.total))
-
-	// Calculate elapsed time and ETA
-	elapsed := time.Since(pb.startTime)
-	var eta time.Duration
-	if pb.current > 0 {
-		eta = time.Duration(float64(elapsed)*(float64(pb.total)/float64(pb.current)) - float64(elapsed))
+	if pb.logEvery > 0 {
+		pb.printLine(info, percentage)
+		return
 	}
+	filled := int(float64(pb.width) * float64(pb.current) / float64(pb.total))
 
 	// Build progress bar string
 	bar := "["
@@ -71,10 +302,37 @@ func (pb *ProgressBar) print() {
 	}
 	bar += "]"
 
+	state := ""
+	if pb.paused {
+		state = " PAUSED"
+	} else if pb.pausedFor > 0 {
+		state = "       " // blank out an earlier PAUSED
+	}
+
 	// Format the output
-	fmt.Printf("\r%s %.1f%% (%d/%d) Elapsed: %v ETA: %v",
+	fmt.Fprintf(pb.out, "\r%s %.1f%% (%d/%d) Elapsed: %v ETA: %v%s",
 		bar, percentage, pb.current, pb.total,
-		elapsed.Round(time.Second), eta.Round(time.Second))
+		info.Elapsed.Round(time.Second), info.ETA.Round(time.Second), state)
+}
+
+// printLine writes the numbers of the bar as a line of their own, if
+// logEvery has passed since the last or the bar is complete.  The caller
+// must hold pb.mu.
+func (pb *ProgressBar) printLine(info ProgressInfo, percentage float64) {
+	now := time.Now()
+	complete := pb.current >= pb.total
+	if complete && pb.loggedEnd || !complete && now.Sub(pb.lastLog) < pb.logEvery {
+		return
+	}
+	pb.lastLog, pb.loggedEnd = now, complete
+
+	state := ""
+	if pb.paused {
+		state = " PAUSED"
+	}
+	fmt.Fprintf(pb.out, "Progress: %.1f%% (%d/%d) Elapsed: %v ETA: %v%s\n",
+		percentage, pb.current, pb.total,
+		info.Elapsed.Round(time.Second), info.ETA.Round(time.Second), state)
 }
 
 // EstimateTime estimates the time required for a given number of operations
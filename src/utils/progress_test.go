@@ -1,8 +1,13 @@
 package utils
 
 import (
+	"bytes"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"cryptotimed/src/crypto"
 )
 
 func TestProgressBar(t *testing.T) {
@@ -109,3 +114,156 @@ func TestNewProgressBar(t *testing.T) {
 		}
 	}
 }
+
+// syncBuffer is a bytes.Buffer safe for use from the ticker goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestProgressBarTickerRedraws(t *testing.T) {
+	// The ticker should redraw the bar even though Update is never called
+	out := &syncBuffer{}
+	pb := NewProgressBar(1000)
+	pb.out = out
+
+	pb.Update(10)
+	before := strings.Count(out.String(), "\r")
+
+	pb.StartTicker(10 * time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	pb.StopTicker()
+
+	redraws := strings.Count(out.String(), "\r") - before
+	if redraws < 2 {
+		t.Fatalf("Expected at least 2 time-based redraws, got %d", redraws)
+	}
+	if !strings.Contains(out.String(), "(10/1000)") {
+		t.Errorf("Redraws should show the last reported progress, got %q", out.String())
+	}
+
+	// No redraws after the ticker is stopped
+	stopped := out.String()
+	time.Sleep(30 * time.Millisecond)
+	if out.String() != stopped {
+		t.Error("Progress bar redrew after StopTicker")
+	}
+
+	pb.StopTicker() // second call must not block or panic
+	pb.Finish()
+}
+
+func TestProgressBarTickerDisabled(t *testing.T) {
+	out := &syncBuffer{}
+	pb := NewProgressBar(100)
+	pb.out = out
+
+	pb.StartTicker(0)
+	time.Sleep(20 * time.Millisecond)
+	if out.String() != "" {
+		t.Errorf("Disabled ticker should not draw, got %q", out.String())
+	}
+	pb.Finish()
+	if !strings.HasSuffix(out.String(), "\n") {
+		t.Error("Finish should end the bar with a newline")
+	}
+}
+
+func TestProgressBarPauseExcludedFromRate(t *testing.T) {
+	out := &syncBuffer{}
+	pb := NewProgressBar(1000)
+	pb.out = out
+	pb.SetBaseline(400)
+
+	pb.SetPaused(true)
+	time.Sleep(50 * time.Millisecond)
+	if !strings.Contains(out.String(), "PAUSED") {
+		t.Errorf("Paused bar should say so, got %q", out.String())
+	}
+	info := pb.Info()
+	if !info.IsPaused || info.Paused < 50*time.Millisecond {
+		t.Errorf("Info while paused = %+v", info)
+	}
+	pb.SetPaused(false)
+
+	pb.Update(500)
+	info = pb.Info()
+	if info.Elapsed >= 50*time.Millisecond {
+		t.Errorf("Elapsed %v should leave out the 50ms pause", info.Elapsed)
+	}
+	// Only the 100 squarings since the baseline count towards the rate
+	if want := 100 / info.Elapsed.Seconds(); info.Rate > want*1.01 || info.Rate < want*0.5 {
+		t.Errorf("Rate = %.0f, want about %.0f", info.Rate, want)
+	}
+	if info.ETA <= 0 {
+		t.Errorf("ETA should be known after progress, got %v", info.ETA)
+	}
+}
+
+func TestProgressBarHidden(t *testing.T) {
+	out := &syncBuffer{}
+	pb := NewProgressBar(1000)
+	pb.out = out
+	pb.HideBar()
+
+	pb.StartTicker(5 * time.Millisecond)
+	pb.Update(1000)
+	time.Sleep(20 * time.Millisecond)
+	pb.Printf("Checkpoint saved: %s", "f.resume")
+	pb.Finish()
+
+	if got := out.String(); got != "Checkpoint saved: f.resume\n" {
+		t.Errorf("Hidden bar should only write Printf lines, got %q", got)
+	}
+	if pb.Info().Done != 1000 {
+		t.Errorf("Hidden bar should still track progress, got %+v", pb.Info())
+	}
+}
+
+func TestProgressInfoSnapshot(t *testing.T) {
+	info := ProgressInfo{Done: 250, Total: 1000, Rate: 50, ETA: 15 * time.Second}
+	line := info.Snapshot(time.Now().Add(-2 * time.Minute))
+	for _, want := range []string{"250/1000 squarings (25.00%)", "50 squarings/s", "ETA 15.0s", "checkpoint 2.0m ago"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("Snapshot %q should contain %q", line, want)
+		}
+	}
+	if strings.Contains(line, "\n") {
+		t.Errorf("Snapshot should be a single line, got %q", line)
+	}
+
+	line = ProgressInfo{Total: 1000, IsPaused: true}.Snapshot(time.Time{})
+	for _, want := range []string{"0/1000", "rate unknown", "no checkpoint yet", "paused"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("Snapshot %q should contain %q", line, want)
+		}
+	}
+}
+
+func TestProgressBarStrategy(t *testing.T) {
+	out := &syncBuffer{}
+	pb := NewProgressBar(1000)
+	pb.out = out
+	pb.SetStrategy(crypto.FixedStep(500))
+
+	pb.Update(100)
+	if out.String() != "" {
+		t.Errorf("Update off the step should not redraw, got %q", out.String())
+	}
+	pb.Update(500)
+	if !strings.Contains(out.String(), "(500/1000)") {
+		t.Errorf("Update on the step should redraw, got %q", out.String())
+	}
+}
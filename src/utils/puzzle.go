@@ -0,0 +1,230 @@
+package utils
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/types"
+)
+
+// WritePuzzleFile writes a standalone puzzle file as indented JSON.
+func WritePuzzleFile(filename string, pf *types.PuzzleFile) error {
+	data, err := json.MarshalIndent(pf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFile(filename, append(data, '\n'))
+}
+
+// ReadPuzzleFile reads a standalone puzzle file and returns it with the
+// puzzle and commitment it describes.
+func ReadPuzzleFile(filename string) (*types.PuzzleFile, crypto.Puzzle, [32]byte, error) {
+	var pf types.PuzzleFile
+	var commitment [32]byte
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, crypto.Puzzle{}, commitment, err
+	}
+	if err := json.Unmarshal(data, &pf); err != nil {
+		return nil, crypto.Puzzle{}, commitment, fmt.Errorf("invalid puzzle file: %v", err)
+	}
+	if pf.Format != types.PuzzleFileFormat {
+		return nil, crypto.Puzzle{}, commitment, fmt.Errorf("not a puzzle file (format %q)", pf.Format)
+	}
+	if pf.Version != types.PuzzleFileVersion {
+		return nil, crypto.Puzzle{}, commitment, fmt.Errorf("unsupported puzzle file version %d", pf.Version)
+	}
+
+	N, err := parseHexInt(pf.ModulusN)
+	if err != nil {
+		return nil, crypto.Puzzle{}, commitment, fmt.Errorf("invalid modulus: %v", err)
+	}
+	G, err := parseHexInt(pf.BaseG)
+	if err != nil {
+		return nil, crypto.Puzzle{}, commitment, fmt.Errorf("invalid base: %v", err)
+	}
+	if err := crypto.CheckKeyModulus(N); err != nil {
+		return nil, crypto.Puzzle{}, commitment, err
+	}
+	if G.Cmp(big.NewInt(2)) < 0 || G.Cmp(N) >= 0 {
+		return nil, crypto.Puzzle{}, commitment, fmt.Errorf("base is out of range")
+	}
+	c, err := hex.DecodeString(pf.Commitment)
+	if err != nil || len(c) != len(commitment) {
+		return nil, crypto.Puzzle{}, commitment, fmt.Errorf("invalid commitment")
+	}
+	copy(commitment[:], c)
+
+	return &pf, crypto.Puzzle{N: N, G: G, T: pf.WorkFactor}, commitment, nil
+}
+
+// parseHexInt parses a non-empty hex string into a big integer.
+func parseHexInt(s string) (*big.Int, error) {
+	n, ok := new(big.Int).SetString(s, 16)
+	if s == "" || !ok || n.Sign() < 0 {
+		return nil, fmt.Errorf("not a hex number")
+	}
+	return n, nil
+}
+
+// WritePuzzleExport writes the exported puzzle parameters of an encrypted
+// file as indented JSON.
+func WritePuzzleExport(filename string, pe *types.PuzzleExport) error {
+	data, err := json.MarshalIndent(pe, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFile(filename, append(data, '\n'))
+}
+
+// ReadPuzzleExport reads puzzle parameters written by WritePuzzleExport and
+// returns them with the header they describe.  The header's values are
+// only decoded here; whether they can be decrypted is for the caller to
+// check.
+func ReadPuzzleExport(filename string) (*types.PuzzleExport, *types.FileHeader, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	var pe types.PuzzleExport
+	if err := json.Unmarshal(data, &pe); err != nil {
+		return nil, nil, fmt.Errorf("invalid puzzle parameters: %v", err)
+	}
+	if pe.Format != types.PuzzleExportFormat {
+		return nil, nil, fmt.Errorf("not the puzzle parameters of an encrypted file (format %q)", pe.Format)
+	}
+	if pe.Version != types.PuzzleExportVersion {
+		return nil, nil, fmt.Errorf("unsupported puzzle parameters version %d", pe.Version)
+	}
+
+	N, err := parseHexInt(pe.ModulusN)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid modulus: %v", err)
+	}
+	G, err := parseHexInt(pe.BaseG)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid base: %v", err)
+	}
+	if err := crypto.CheckKeyModulus(N); err != nil {
+		return nil, nil, err
+	}
+	if G.Cmp(big.NewInt(2)) < 0 || G.Cmp(N) >= 0 {
+		return nil, nil, fmt.Errorf("base is out of range")
+	}
+	if pe.WorkFactor == 0 {
+		return nil, nil, fmt.Errorf("work factor must be positive")
+	}
+
+	h := &types.FileHeader{
+		Version:    types.CurrentVersion,
+		WorkFactor: pe.WorkFactor,
+		Ext: types.HeaderExtensions{
+			KeyDerivation: pe.KeyDerivation,
+			EncryptorRate: pe.EncryptorRate,
+			ChunkSize:     pe.ChunkSize,
+			PayloadType:   pe.PayloadType,
+			Cipher:        pe.Cipher,
+		},
+	}
+	if err := h.SetModulus(N, G); err != nil {
+		return nil, nil, err
+	}
+	if pe.KeyRequired {
+		h.KeyRequired = 1
+	}
+	if err := decodeHexInto(h.Salt[:], pe.Salt); err != nil {
+		return nil, nil, fmt.Errorf("invalid salt: %v", err)
+	}
+	if pe.FileID != "" {
+		h.Ext.BaseTweak = &types.BaseTweak{}
+		if err := decodeHexInto(h.Ext.BaseTweak.FileID[:], pe.FileID); err != nil {
+			return nil, nil, fmt.Errorf("invalid file ID: %v", err)
+		}
+	}
+	if pe.KDFParams != "" {
+		params, err := hex.DecodeString(pe.KDFParams)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid key-derivation parameters: %v", err)
+		}
+		h.Ext.KDFParams = &types.KDFParams{Encoded: params}
+	}
+	h.MinReaderVersion = h.RequiredReaderVersion()
+	return &pe, h, nil
+}
+
+// decodeHexInto decodes s, which must be exactly len(dst) bytes of hex,
+// into dst.
+func decodeHexInto(dst []byte, s string) error {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(b) != len(dst) {
+		return fmt.Errorf("%d bytes, want %d", len(b), len(dst))
+	}
+	copy(dst, b)
+	return nil
+}
+
+// WriteSolveProof writes a solve proof as indented JSON, readable only by
+// its owner since it holds the solution.
+func WriteSolveProof(filename string, pf *types.SolveProofFile) error {
+	data, err := json.MarshalIndent(pf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, append(data, '\n'), 0600)
+}
+
+// ReadSolveProof reads a solve proof written by WriteSolveProof and returns
+// it with the puzzle, solution and proof it holds.  The values are only
+// decoded here; crypto.VerifySolveProof checks them.
+func ReadSolveProof(filename string) (*types.SolveProofFile, crypto.Puzzle, *big.Int, *crypto.SolveProof, error) {
+	fail := func(err error) (*types.SolveProofFile, crypto.Puzzle, *big.Int, *crypto.SolveProof, error) {
+		return nil, crypto.Puzzle{}, nil, nil, err
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fail(err)
+	}
+	var pf types.SolveProofFile
+	if err := json.Unmarshal(data, &pf); err != nil {
+		return fail(fmt.Errorf("invalid solve proof: %v", err))
+	}
+	if pf.Format != types.SolveProofFormat {
+		return fail(fmt.Errorf("not a solve proof (format %q)", pf.Format))
+	}
+	if pf.Version != types.SolveProofVersion {
+		return fail(fmt.Errorf("unsupported solve proof version %d", pf.Version))
+	}
+
+	N, err := parseHexInt(pf.ModulusN)
+	if err != nil {
+		return fail(fmt.Errorf("invalid modulus: %v", err))
+	}
+	G, err := parseHexInt(pf.BaseG)
+	if err != nil {
+		return fail(fmt.Errorf("invalid base: %v", err))
+	}
+	y, err := parseHexInt(pf.Solution)
+	if err != nil {
+		return fail(fmt.Errorf("invalid solution: %v", err))
+	}
+	proof := &crypto.SolveProof{}
+	if proof.Partial, err = parseHexInt(pf.Partial); err != nil {
+		return fail(fmt.Errorf("invalid partial solution: %v", err))
+	}
+	for i, s := range pf.Mu {
+		mu, err := parseHexInt(s)
+		if err != nil {
+			return fail(fmt.Errorf("invalid value %d of the proof: %v", i+1, err))
+		}
+		proof.Mu = append(proof.Mu, mu)
+	}
+	return &pf, crypto.Puzzle{N: N, G: G, T: pf.WorkFactor}, y, proof, nil
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// sizeUnits maps size suffixes to multipliers.  Binary (KiB) and decimal (KB)
+// units are both accepted; a bare K, M or G is binary.
+var sizeUnits = []struct {
+	suffix string
+	scale  float64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+	{"B", 1},
+}
+
+// ParseSize parses a byte count such as "4096", "64KiB", "1MiB" or "1.5M".
+// Suffixes are case-insensitive.
+func ParseSize(s string) (int64, error) {
+	str := strings.TrimSpace(s)
+	scale := 1.0
+	for _, unit := range sizeUnits {
+		if len(str) > len(unit.suffix) && strings.EqualFold(str[len(str)-len(unit.suffix):], unit.suffix) {
+			str = strings.TrimSpace(str[:len(str)-len(unit.suffix)])
+			scale = unit.scale
+			break
+		}
+	}
+
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil || value < 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	bytes := value * scale
+	if bytes > math.MaxInt64 || bytes != math.Trunc(bytes) {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(bytes), nil
+}
+
+// FormatSize formats a byte count in binary units, such as "512 B",
+// "4.0 KiB" or "39.1 MiB", with one decimal above a KiB.
+func FormatSize(n int64) string {
+	const units = "KMGTPE"
+	if n < 1<<10 && n > -1<<10 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, unit := float64(n)/(1<<10), 0
+	for (value >= 1<<10 || value <= -1<<10) && unit < len(units)-1 {
+		value /= 1 << 10
+		unit++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, units[unit])
+}
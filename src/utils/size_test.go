@@ -0,0 +1,56 @@
+package utils
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	valid := map[string]int64{
+		"4096":    4096,
+		"0":       0,
+		"64KiB":   64 << 10,
+		"64kib":   64 << 10,
+		"1MiB":    1 << 20,
+		"1 MiB":   1 << 20,
+		"1.5M":    3 << 19,
+		"2G":      2 << 30,
+		"64KB":    64000,
+		"1MB":     1000000,
+		"512B":    512,
+		" 8K ":    8192,
+		"0.5KiB":  512,
+		"64mib":   64 << 20,
+		"1GiB":    1 << 30,
+		"100000B": 100000,
+	}
+	for in, want := range valid {
+		got, err := ParseSize(in)
+		if err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+
+	for _, in := range []string{"", "MiB", "-1K", "1.5", "1.1KB5", "abc", "1TiB", "1e30G", "NaN"} {
+		if got, err := ParseSize(in); err == nil {
+			t.Errorf("ParseSize(%q) = %d, want error", in, got)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	cases := map[int64]string{
+		0:         "0 B",
+		541:       "541 B",
+		1023:      "1023 B",
+		1 << 10:   "1.0 KiB",
+		4096:      "4.0 KiB",
+		5410000:   "5.2 MiB",
+		40960000:  "39.1 MiB",
+		3 << 30:   "3.0 GiB",
+		-2048:     "-2.0 KiB",
+		1<<63 - 1: "8.0 EiB",
+	}
+	for in, want := range cases {
+		if got := FormatSize(in); got != want {
+			t.Errorf("FormatSize(%d) = %q, want %q", in, got, want)
+		}
+	}
+}
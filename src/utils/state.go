@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"os"
+	"path/filepath"
+
+	"cryptotimed/src/crypto"
+)
+
+// StateDirEnv overrides the directory cryptotimed keeps local state in.
+const StateDirEnv = "CRYPTOTIMED_STATE_DIR"
+
+// StateDir returns the directory for local state such as cached puzzle
+// solutions: $CRYPTOTIMED_STATE_DIR if set, otherwise a "cryptotimed"
+// directory in the user's cache directory.  It is not created.
+func StateDir() (string, error) {
+	if dir := os.Getenv(StateDirEnv); dir != "" {
+		return dir, nil
+	}
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate state directory: %v", err)
+	}
+	return filepath.Join(cache, "cryptotimed"), nil
+}
+
+// targetCachePath returns the cache file for a puzzle's solution.
+func targetCachePath(p crypto.Puzzle) (string, error) {
+	dir, err := StateDir()
+	if err != nil {
+		return "", err
+	}
+	fp := p.Fingerprint()
+	return filepath.Join(dir, "targets", hex.EncodeToString(fp[:])), nil
+}
+
+// LoadCachedTarget returns the cached solution of p, or nil if none has been
+// cached.  Anyone who can read the cache can decrypt the file without
+// solving, so it is only used when the user asks for it.
+func LoadCachedTarget(p crypto.Puzzle) (*big.Int, error) {
+	path, err := targetCachePath(p)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data) > len(p.N.Bytes())+1 {
+		return nil, fmt.Errorf("corrupt cached solution %s", path)
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// StoreCachedTarget caches the solution of p, readable only by the owner.
+func StoreCachedTarget(p crypto.Puzzle, target *big.Int) error {
+	path, err := targetCachePath(p)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, target.FillBytes(make([]byte, len(p.N.Bytes()))), 0600)
+}
+
+// RemoveCachedTarget deletes the cached solution of p, if any.
+func RemoveCachedTarget(p crypto.Puzzle) error {
+	path, err := targetCachePath(p)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
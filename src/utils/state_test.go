@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cryptotimed/src/crypto"
+)
+
+func TestTargetCacheRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(StateDirEnv, dir)
+
+	p := crypto.Puzzle{
+		N: new(big.Int).Lsh(big.NewInt(1), 2047),
+		G: big.NewInt(5),
+		T: 1234,
+	}
+	p.N.Add(p.N, big.NewInt(159))
+	target := big.NewInt(987654321)
+
+	got, err := LoadCachedTarget(p)
+	if err != nil || got != nil {
+		t.Fatalf("empty cache returned %v, %v", got, err)
+	}
+
+	if err := StoreCachedTarget(p, target); err != nil {
+		t.Fatalf("StoreCachedTarget failed: %v", err)
+	}
+	got, err = LoadCachedTarget(p)
+	if err != nil || got == nil || got.Cmp(target) != 0 {
+		t.Fatalf("LoadCachedTarget = %v, %v; want %v", got, err, target)
+	}
+
+	// The cache file must be private to the owner
+	fp := p.Fingerprint()
+	matches, _ := filepath.Glob(filepath.Join(dir, "targets", "*"))
+	if len(matches) != 1 {
+		t.Fatalf("expected one cache file, found %v (fingerprint %x)", matches, fp[:4])
+	}
+	if info, err := os.Stat(matches[0]); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("cache file mode = %v (%v), want 0600", info.Mode().Perm(), err)
+	}
+
+	// A different work factor is a different puzzle
+	other := p
+	other.T++
+	if got, _ := LoadCachedTarget(other); got != nil {
+		t.Errorf("cache hit for a puzzle with a different work factor")
+	}
+
+	if err := RemoveCachedTarget(p); err != nil {
+		t.Fatalf("RemoveCachedTarget failed: %v", err)
+	}
+	if got, _ := LoadCachedTarget(p); got != nil {
+		t.Errorf("cache entry survived RemoveCachedTarget")
+	}
+	if err := RemoveCachedTarget(p); err != nil {
+		t.Errorf("removing a missing entry should succeed, got %v", err)
+	}
+}
+
+func TestSolvingStateRoundTrip(t *testing.T) {
+	p := crypto.Puzzle{
+		N: new(big.Int).Lsh(big.NewInt(1), 2047),
+		G: big.NewInt(5),
+		T: 1000,
+	}
+	p.N.Add(p.N, big.NewInt(159))
+	state := crypto.SolvingState{
+		Puzzle:  p,
+		Result:  big.NewInt(123456789),
+		Done:    400,
+		Updated: time.Unix(1700000000, 42),
+	}
+
+	path := filepath.Join(t.TempDir(), "file.locked.resume")
+	if err := SaveState(state, path); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("checkpoint mode = %v (%v), want 0600", info.Mode().Perm(), err)
+	}
+
+	got, err := LoadState(path)
+	if err != nil {
+		t.Fatalf("LoadState failed: %v", err)
+	}
+	if got.Done != state.Done || got.Result.Cmp(state.Result) != 0 || !got.Updated.Equal(state.Updated) {
+		t.Errorf("LoadState = %+v, want %+v", got, state)
+	}
+	if err := got.Matches(p); err != nil {
+		t.Errorf("loaded state does not match its puzzle: %v", err)
+	}
+
+	other := p
+	other.G = big.NewInt(7)
+	if err := got.Matches(other); err == nil {
+		t.Error("state matched a puzzle with a different base")
+	}
+
+	// Any flipped byte is detected
+	data, _ := os.ReadFile(path)
+	for _, i := range []int{0, 9, 60, len(data) - 40, len(data) - 1} {
+		corrupt := append([]byte(nil), data...)
+		corrupt[i] ^= 0x01
+		os.WriteFile(path, corrupt, 0600)
+		if _, err := LoadState(path); err == nil {
+			t.Errorf("corruption at byte %d not detected", i)
+		}
+	}
+	os.WriteFile(path, data[:len(data)/2], 0600)
+	if _, err := LoadState(path); err == nil {
+		t.Error("truncated checkpoint loaded")
+	}
+}
+
+func TestSolveStatusRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "status.json")
+	status := &SolveStatus{
+		PID:       os.Getpid(),
+		InputFile: "file.locked",
+		State:     StatusSolving,
+		Done:      250,
+		Total:     1000,
+		Percent:   25,
+		Rate:      100,
+		Started:   time.Unix(1700000000, 0).UTC(),
+		Updated:   time.Unix(1700000003, 0).UTC(),
+	}
+	if err := WriteStatus(path, status); err != nil {
+		t.Fatalf("WriteStatus failed: %v", err)
+	}
+	got, err := ReadStatus(path)
+	if err != nil {
+		t.Fatalf("ReadStatus failed: %v", err)
+	}
+	if *got != *status {
+		t.Errorf("ReadStatus = %+v, want %+v", got, status)
+	}
+	if got.Finished() {
+		t.Error("a solving status should not be finished")
+	}
+
+	os.WriteFile(path, []byte("{"), 0644)
+	if _, err := ReadStatus(path); err == nil {
+		t.Error("truncated status file was accepted")
+	}
+}
+
+func TestPartialOutputRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := PartialOutputPath(filepath.Join(dir, "big.iso.resume"))
+	if filepath.Base(path) != "big.iso.resume.output" {
+		t.Errorf("record path %s", path)
+	}
+	if got := PartialFileName(filepath.Join(dir, "big.iso")); got != filepath.Join(dir, ".big.iso.partial") {
+		t.Errorf("partial file %s", got)
+	}
+
+	want := &PartialOutput{
+		Fingerprint: "ab12",
+		Output:      filepath.Join(dir, "big.iso"),
+		Partial:     PartialFileName(filepath.Join(dir, "big.iso")),
+		ChunkSize:   65536,
+		Chunks:      899,
+		Hash:        "cd34",
+	}
+	if err := SavePartialOutput(want, path); err != nil {
+		t.Fatalf("SavePartialOutput failed: %v", err)
+	}
+	got, err := LoadPartialOutput(path)
+	if err != nil {
+		t.Fatalf("LoadPartialOutput failed: %v", err)
+	}
+	if *got != *want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("record mode %v, want 0600", info.Mode().Perm())
+	}
+
+	if err := os.WriteFile(path, []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPartialOutput(path); err == nil {
+		t.Error("garbage record accepted")
+	}
+}
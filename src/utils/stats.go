@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"errors"
+	"math"
+)
+
+// Interval is a two-sided confidence interval for the mean of some samples.
+type Interval struct {
+	Mean       float64
+	StdDev     float64 // sample standard deviation
+	Lower      float64
+	Upper      float64
+	Confidence float64 // e.g. 0.95
+	Samples    int
+}
+
+// MeanInterval returns the Student t confidence interval for the mean of
+// values at the given confidence level, which must lie strictly between 0
+// and 1.  It needs at least two values.
+func MeanInterval(values []float64, confidence float64) (Interval, error) {
+	if !(confidence > 0 && confidence < 1) {
+		return Interval{}, errors.New("confidence level must be between 0 and 1")
+	}
+	n := len(values)
+	if n < 2 {
+		return Interval{}, errors.New("a confidence interval needs at least two samples")
+	}
+
+	var mean float64
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(n)
+	var sumSq float64
+	for _, v := range values {
+		d := v - mean
+		sumSq += d * d
+	}
+	stdDev := math.Sqrt(sumSq / float64(n-1))
+
+	margin := StudentTQuantile((1+confidence)/2, float64(n-1)) * stdDev / math.Sqrt(float64(n))
+	return Interval{
+		Mean:       mean,
+		StdDev:     stdDev,
+		Lower:      mean - margin,
+		Upper:      mean + margin,
+		Confidence: confidence,
+		Samples:    n,
+	}, nil
+}
+
+// StudentTCDF returns P(X ≤ t) for X following Student's t distribution with
+// df degrees of freedom.
+func StudentTCDF(t, df float64) float64 {
+	tail := 0.5 * regularizedBeta(df/2, 0.5, df/(df+t*t))
+	if t > 0 {
+		return 1 - tail
+	}
+	return tail
+}
+
+// StudentTQuantile returns the t for which StudentTCDF(t, df) is p, found by
+// bisection; p must lie strictly between 0 and 1.
+func StudentTQuantile(p, df float64) float64 {
+	if p == 0.5 {
+		return 0
+	}
+	// The distribution is symmetric: find the upper quantile and mirror it
+	q := p
+	if q < 0.5 {
+		q = 1 - q
+	}
+	lo, hi := 0.0, 1.0
+	for StudentTCDF(hi, df) < q {
+		lo, hi = hi, hi*2
+	}
+	for i := 0; i < 100; i++ {
+		mid := (lo + hi) / 2
+		if StudentTCDF(mid, df) < q {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	t := (lo + hi) / 2
+	if p < 0.5 {
+		return -t
+	}
+	return t
+}
+
+// regularizedBeta returns the regularized incomplete beta function I_x(a, b),
+// evaluated by its continued fraction on whichever side converges fast.
+func regularizedBeta(a, b, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+	front := math.Exp(lab - la - lb + a*math.Log(x) + b*math.Log(1-x))
+	if x < (a+1)/(a+b+2) {
+		return front * betaFraction(a, b, x) / a
+	}
+	return 1 - front*betaFraction(b, a, 1-x)/b
+}
+
+// betaFraction evaluates the continued fraction of the incomplete beta
+// function with Lentz's method.
+func betaFraction(a, b, x float64) float64 {
+	const (
+		tiny    = 1e-300
+		epsilon = 1e-15
+	)
+	c, d := 1.0, 1-(a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1.0; m <= 300; m++ {
+		// Even step
+		num := m * (b - m) * x / ((a + 2*m - 1) * (a + 2*m))
+		d = 1 + num*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		h *= d * c
+
+		// Odd step
+		num = -(a + m) * (a + b + m) * x / ((a + 2*m) * (a + 2*m + 1))
+		d = 1 + num*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < epsilon {
+			break
+		}
+	}
+	return h
+}
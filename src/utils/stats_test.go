@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStudentTQuantile(t *testing.T) {
+	// Values from a t table
+	tests := []struct {
+		p, df, want float64
+	}{
+		{0.975, 1, 12.706},
+		{0.975, 4, 2.776},
+		{0.975, 9, 2.262},
+		{0.95, 9, 1.833},
+		{0.995, 29, 2.756},
+		{0.975, 1000, 1.962},
+		{0.025, 4, -2.776},
+		{0.5, 7, 0},
+	}
+	for _, tt := range tests {
+		if got := StudentTQuantile(tt.p, tt.df); math.Abs(got-tt.want) > 0.001 {
+			t.Errorf("StudentTQuantile(%v, %v) = %.4f, want %.3f", tt.p, tt.df, got, tt.want)
+		}
+	}
+}
+
+func TestMeanInterval(t *testing.T) {
+	// Mean 100, sample standard deviation √2.5, t(0.975, 4) = 2.776
+	values := []float64{98, 99, 100, 101, 102}
+	iv, err := MeanInterval(values, 0.95)
+	if err != nil {
+		t.Fatal(err)
+	}
+	margin := 2.776 * math.Sqrt(2.5) / math.Sqrt(5)
+	if iv.Mean != 100 || math.Abs(iv.StdDev-math.Sqrt(2.5)) > 1e-9 {
+		t.Errorf("mean %v, std dev %v", iv.Mean, iv.StdDev)
+	}
+	if math.Abs(iv.Lower-(100-margin)) > 0.001 || math.Abs(iv.Upper-(100+margin)) > 0.001 {
+		t.Errorf("interval [%v, %v], want 100 ± %.3f", iv.Lower, iv.Upper, margin)
+	}
+
+	// A higher confidence widens the interval
+	wide, _ := MeanInterval(values, 0.99)
+	if wide.Lower >= iv.Lower || wide.Upper <= iv.Upper {
+		t.Errorf("99%% interval [%v, %v] is not wider than the 95%% one", wide.Lower, wide.Upper)
+	}
+
+	if _, err := MeanInterval([]float64{1}, 0.95); err == nil {
+		t.Error("interval of one sample accepted")
+	}
+	for _, c := range []float64{0, 1, 95} {
+		if _, err := MeanInterval(values, c); err == nil {
+			t.Errorf("confidence %v accepted", c)
+		}
+	}
+}
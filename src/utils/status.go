@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Solve states reported in a status file.
+const (
+	StatusSolving = "solving"
+	StatusPaused  = "paused"
+	StatusStopped = "stopped" // stopped with a checkpoint; can be resumed
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+// SolveStatus is the JSON written to a decrypt --status-file so that other
+// processes can follow a solve.
+type SolveStatus struct {
+	PID        int       `json:"pid"`
+	InputFile  string    `json:"input"`
+	OutputFile string    `json:"output,omitempty"`
+	State      string    `json:"state"`
+	Done       uint64    `json:"done"`
+	Resumed    uint64    `json:"resumed,omitempty"` // squarings restored from a checkpoint
+	Total      uint64    `json:"total"`
+	Percent    float64   `json:"percent"`
+	Rate       float64   `json:"rate,omitempty"`        // squarings per second (0 = unknown)
+	ETASeconds float64   `json:"eta_seconds,omitempty"` // 0 = unknown
+	Checkpoint string    `json:"checkpoint,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Started    time.Time `json:"started"`
+	Updated    time.Time `json:"updated"`
+}
+
+// Finished reports whether the solve has ended, successfully or not.
+func (s *SolveStatus) Finished() bool {
+	return s.State == StatusDone || s.State == StatusFailed || s.State == StatusStopped
+}
+
+// WriteStatus replaces the status file at path atomically, so readers never
+// see a partial write.
+func WriteStatus(path string, status *SolveStatus) error {
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0644)
+}
+
+// ReadStatus reads a status file written by WriteStatus.
+func ReadStatus(path string) (*SolveStatus, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var status SolveStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, fmt.Errorf("invalid status file %s: %v", path, err)
+	}
+	return &status, nil
+}
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrNotTerminal is returned by NewKeyReader for files that are not a
+// terminal (or on platforms without terminal support).
+var ErrNotTerminal = errors.New("not a terminal")
+
+// KeyReader delivers single key presses from a terminal.  While it is open
+// the terminal is in cbreak mode: keys arrive without Enter and are not
+// echoed, but Ctrl+C still raises SIGINT.  Close restores the previous
+// terminal state; callers should defer it so the terminal is restored on
+// every exit path, including panics.
+type KeyReader struct {
+	keys    chan byte
+	stop    chan struct{}
+	done    chan struct{}
+	restore func() error
+	once    sync.Once
+	err     error
+}
+
+// Keys returns the channel of key presses.  It is closed after Close.
+func (k *KeyReader) Keys() <-chan byte {
+	return k.keys
+}
+
+// Close stops reading and restores the terminal.  It is safe to call more
+// than once.
+func (k *KeyReader) Close() error {
+	k.once.Do(func() {
+		close(k.stop)
+		<-k.done
+		k.err = k.restore()
+	})
+	return k.err
+}
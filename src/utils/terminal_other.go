@@ -0,0 +1,16 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package utils
+
+import "os"
+
+// IsTerminal reports whether f is a terminal.  Terminal control is not
+// supported on this platform.
+func IsTerminal(f *os.File) bool {
+	return false
+}
+
+// NewKeyReader is not supported on this platform.
+func NewKeyReader(f *os.File) (*KeyReader, error) {
+	return nil, ErrNotTerminal
+}
@@ -0,0 +1,81 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package utils
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// keyPollInterval bounds how long Close waits for the reading goroutine.
+const keyPollInterval = 100 // milliseconds
+
+// IsTerminal reports whether f is a terminal.
+func IsTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), ioctlGetTermios)
+	return err == nil
+}
+
+// NewKeyReader puts the terminal f into cbreak mode and starts delivering
+// its key presses.
+func NewKeyReader(f *os.File) (*KeyReader, error) {
+	fd := int(f.Fd())
+	saved, err := unix.IoctlGetTermios(fd, ioctlGetTermios)
+	if err != nil {
+		return nil, ErrNotTerminal
+	}
+
+	raw := *saved
+	raw.Lflag &^= unix.ICANON | unix.ECHO
+	raw.Cc[unix.VMIN] = 1
+	raw.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, ioctlSetTermios, &raw); err != nil {
+		return nil, err
+	}
+
+	k := &KeyReader{
+		keys: make(chan byte, 16),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+		restore: func() error {
+			return unix.IoctlSetTermios(fd, ioctlSetTermios, saved)
+		},
+	}
+	go k.read(fd)
+	return k, nil
+}
+
+// read polls the terminal so that it notices Close promptly instead of
+// staying blocked in read(2).
+func (k *KeyReader) read(fd int) {
+	defer close(k.done)
+	defer close(k.keys)
+
+	buf := make([]byte, 16)
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for {
+		select {
+		case <-k.stop:
+			return
+		default:
+		}
+		n, err := unix.Poll(fds, keyPollInterval)
+		if err == unix.EINTR || (err == nil && n == 0) {
+			continue
+		}
+		if err != nil || fds[0].Revents&(unix.POLLERR|unix.POLLHUP|unix.POLLNVAL) != 0 {
+			return
+		}
+		n, err = unix.Read(fd, buf)
+		if err != nil || n == 0 {
+			return
+		}
+		for _, b := range buf[:n] {
+			select {
+			case k.keys <- b:
+			default: // drop keys nobody is reading
+			}
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package utils
+
+import "io/fs"
+
+// Umask returns 0: there is no file mode creation mask on this platform.
+func Umask() fs.FileMode {
+	return 0
+}
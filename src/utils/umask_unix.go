@@ -0,0 +1,23 @@
+//go:build unix
+
+package utils
+
+import (
+	"io/fs"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// umask is read once: the only way to read it is to set it, and setting it
+// while other goroutines create files would race with them.
+var umask = sync.OnceValue(func() fs.FileMode {
+	mask := unix.Umask(0)
+	unix.Umask(mask)
+	return fs.FileMode(mask) & fs.ModePerm
+})
+
+// Umask returns the process's file mode creation mask.
+func Umask() fs.FileMode {
+	return umask()
+}
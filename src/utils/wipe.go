@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"crypto/rand"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SecureDelete overwrites a file's contents with random bytes, flushes them to
+// disk and then removes the file.  A directory (such as an extracted
+// container) has every regular file below it wiped before it is removed.
+//
+// This is best effort: on copy-on-write filesystems, SSDs with wear levelling
+// or systems with snapshots the original blocks may survive elsewhere.
+func SecureDelete(filename string) error {
+	if info, err := os.Lstat(filename); err == nil && info.IsDir() {
+		return secureDeleteTree(filename)
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := io.CopyN(f, rand.Reader, info.Size()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
+
+// secureDeleteTree wipes every regular file below dir and then removes it.
+func secureDeleteTree(dir string) error {
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			return SecureDelete(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// EphemeralFile is a file scheduled for secure deletion.  The deletion only
+// happens while the process is alive, so callers must keep running (for
+// example by waiting on Done) until it completes.
+type EphemeralFile struct {
+	path string
+	once sync.Once
+	done chan error
+}
+
+// ScheduleSecureDelete arranges for SecureDelete(path) to run after the given
+// delay.
+func ScheduleSecureDelete(path string, after time.Duration) *EphemeralFile {
+	e := &EphemeralFile{path: path, done: make(chan error, 1)}
+	// A timer firing after an explicit DeleteNow is a no-op thanks to once.
+	time.AfterFunc(after, e.DeleteNow)
+	return e
+}
+
+// DeleteNow deletes the file immediately instead of waiting for the timer.
+// It is safe to call more than once; only the first call has any effect.
+func (e *EphemeralFile) DeleteNow() {
+	e.once.Do(func() {
+		e.done <- SecureDelete(e.path)
+	})
+}
+
+// Done returns a channel that receives the result of the deletion.
+func (e *EphemeralFile) Done() <-chan error {
+	return e.done
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSecureDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret.txt")
+	if err := os.WriteFile(path, []byte("top secret"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	if err := SecureDelete(path); err != nil {
+		t.Fatalf("SecureDelete failed: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("file still exists after SecureDelete")
+	}
+
+	if err := SecureDelete(path); err == nil {
+		t.Errorf("expected error deleting a missing file")
+	}
+}
+
+func TestScheduleSecureDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ephemeral.txt")
+	if err := os.WriteFile(path, []byte("view once"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	e := ScheduleSecureDelete(path, 50*time.Millisecond)
+
+	// Still present before the timeout
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("file removed too early: %v", err)
+	}
+
+	select {
+	case err := <-e.Done():
+		if err != nil {
+			t.Fatalf("scheduled deletion failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("scheduled deletion did not run")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("file still exists after scheduled deletion")
+	}
+
+	// A later DeleteNow is a no-op
+	e.DeleteNow()
+}
+
+func TestScheduleSecureDeleteNow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "interrupted.txt")
+	if err := os.WriteFile(path, []byte("wipe on interrupt"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	e := ScheduleSecureDelete(path, time.Hour)
+	e.DeleteNow()
+	if err := <-e.Done(); err != nil {
+		t.Fatalf("DeleteNow failed: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("file still exists after DeleteNow")
+	}
+}
@@ -0,0 +1,239 @@
+package integration
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+func TestAndPuzzlesRoundTrip(t *testing.T) {
+	testData := []byte("Locked until every one of three puzzles is solved")
+	inputFile := createTempFile(t, "and.txt", testData)
+
+	for _, key := range []string{"", "and passphrase"} {
+		name := "no_key"
+		if key != "" {
+			name = "with_key"
+		}
+		t.Run(name, func(t *testing.T) {
+			encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+				InputFile:      inputFile,
+				WorkFactor:     testWorkFactor,
+				KeyInput:       key,
+				AndPuzzles:     3,
+				OutputTemplate: filepath.Join(t.TempDir(), "{base}"),
+			})
+			if err != nil {
+				t.Fatalf("Encryption failed: %v", err)
+			}
+
+			header, err := utils.ReadFileHeader(encryptResult.OutputFile)
+			if err != nil {
+				t.Fatalf("Failed to read header: %v", err)
+			}
+			if header.PuzzleCount() != 3 || header.TotalWork() != 3*testWorkFactor {
+				t.Errorf("Expected 3 puzzles of %d squarings in all, got %d of %d", 3*testWorkFactor, header.PuzzleCount(), header.TotalWork())
+			}
+			if header.MinReaderVersion != types.VersionAndPuzzles {
+				t.Errorf("Expected minimum reader version %d, got %d", types.VersionAndPuzzles, header.MinReaderVersion)
+			}
+
+			// Progress counts through every puzzle
+			var last uint64
+			decryptResult, err := operations.DecryptFile(operations.DecryptOptions{
+				InputFile: encryptResult.OutputFile,
+				KeyInput:  key,
+			}, func(done uint64) { last = done })
+			if err != nil {
+				t.Fatalf("Decryption failed: %v", err)
+			}
+			if last != 3*testWorkFactor {
+				t.Errorf("Expected progress to end at %d squarings, got %d", 3*testWorkFactor, last)
+			}
+			if len(decryptResult.MoreTargets) != 2 {
+				t.Errorf("Expected the solutions of 2 more puzzles, got %d", len(decryptResult.MoreTargets))
+			}
+			decryptedData, err := utils.ReadFile(decryptResult.OutputFile)
+			if err != nil {
+				t.Fatalf("Failed to read decrypted file: %v", err)
+			}
+			assertBytesEqual(t, testData, decryptedData, "File of three puzzles")
+		})
+	}
+}
+
+func TestAndPuzzlesAllMustBeSolved(t *testing.T) {
+	testData := []byte("No subset of the solutions opens this")
+	inputFile := createTempFile(t, "all.txt", testData)
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: testWorkFactor,
+		AndPuzzles: 3,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	ef, err := utils.ReadEncryptedFile(encryptResult.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+
+	// Solve each puzzle on its own, as separate machines would
+	puzzles := append([]crypto.Puzzle{utils.PuzzleFromEncryptedFile(ef)}, utils.AndPuzzlesFromHeader(ef.Header())...)
+	var keys [][32]byte
+	for _, p := range puzzles {
+		target := solvePuzzle(t, p)
+		key, err := crypto.DerivePuzzleKeyParams(target, p.N, ef.Ext.KeyDerivation, ef.Ext.KDFParams.Bytes())
+		if err != nil {
+			t.Fatalf("Failed to derive key: %v", err)
+		}
+		keys = append(keys, key)
+	}
+
+	plaintext, err := crypto.Open(ef.Ext.Cipher, crypto.CombinePuzzleKeys(keys...), ef.Data, nil)
+	if err != nil {
+		t.Fatalf("The solutions of all three puzzles did not open the file: %v", err)
+	}
+	assertBytesEqual(t, testData, plaintext, "Combined key")
+
+	// Any one solution missing, or any one puzzle's key alone, opens nothing
+	for skip := range keys {
+		var partial [][32]byte
+		for i, key := range keys {
+			if i != skip {
+				partial = append(partial, key)
+			}
+		}
+		if _, err := crypto.Open(ef.Ext.Cipher, crypto.CombinePuzzleKeys(partial...), ef.Data, nil); err == nil {
+			t.Errorf("The file opened without puzzle %d solved", skip+1)
+		}
+		if _, err := crypto.Open(ef.Ext.Cipher, keys[skip], ef.Data, nil); err == nil {
+			t.Errorf("The file opened with puzzle %d solved alone", skip+1)
+		}
+	}
+
+	// A solution to the first puzzle alone is refused before decrypting
+	target := solvePuzzle(t, puzzles[0])
+	if _, err := operations.DecryptWithTarget(encryptResult.OutputFile, target, ""); err == nil {
+		t.Error("Decrypting with the solution of one puzzle of three succeeded")
+	}
+}
+
+func TestAndPuzzlesStopAndResume(t *testing.T) {
+	data := generateRandomData(1024)
+	inputFile := createTempFile(t, "input.bin", data)
+
+	const work = 200000
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: work,
+		AndPuzzles: 2,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	checkpoint := encryptResult.OutputFile + ".resume"
+	second := operations.PuzzleCheckpointPath(checkpoint, 1)
+
+	// Stop once into the second puzzle
+	ctl := &crypto.SolveControl{}
+	opts := operations.DecryptOptions{
+		InputFile:          encryptResult.OutputFile,
+		CheckpointPath:     checkpoint,
+		CheckpointInterval: time.Millisecond,
+		Control:            ctl,
+		OnCheckpoint: func(state crypto.SolvingState, err error) {
+			if err != nil {
+				t.Errorf("checkpoint failed: %v", err)
+			}
+			if state.Done > work {
+				ctl.Stop()
+			}
+		},
+	}
+	_, err = operations.DecryptFile(opts, nil)
+	if !errors.Is(err, crypto.ErrSolveStopped) {
+		t.Fatalf("expected a stopped solve, got %v", err)
+	}
+
+	// The first puzzle's checkpoint is kept finished, the second's partway
+	first, err := utils.LoadState(checkpoint)
+	if err != nil || first.Done != work {
+		t.Fatalf("expected the first puzzle's checkpoint to be finished, got %+v (%v)", first, err)
+	}
+	state, err := utils.LoadState(second)
+	if err != nil || state.Done == 0 || state.Done >= work {
+		t.Fatalf("expected the second puzzle's checkpoint partway, got %+v (%v)", state, err)
+	}
+
+	// Nothing is solved over again
+	var resumed []uint64
+	opts.Control = nil
+	opts.OnCheckpoint = nil
+	opts.CheckpointInterval = 0
+	opts.OnResume = func(done uint64) { resumed = append(resumed, done) }
+	result, err := operations.DecryptFile(opts, nil)
+	if err != nil {
+		t.Fatalf("resumed decryption failed: %v", err)
+	}
+	if len(resumed) != 2 || resumed[0] != work || resumed[1] != work+state.Done {
+		t.Errorf("resumed at %v, want [%d %d]", resumed, work, work+state.Done)
+	}
+	if result.ResumedFrom != work+state.Done {
+		t.Errorf("result resumed from %d, want %d", result.ResumedFrom, work+state.Done)
+	}
+	decrypted, err := utils.ReadFile(result.OutputFile)
+	if err != nil {
+		t.Fatalf("failed to read decrypted file: %v", err)
+	}
+	assertBytesEqual(t, data, decrypted, "resumed decryption")
+	for _, path := range []string{checkpoint, second} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("checkpoint %s should be removed after solving, stat: %v", path, err)
+		}
+	}
+}
+
+func TestAndPuzzlesRefusedLayouts(t *testing.T) {
+	inputFile := createTempFile(t, "refused.txt", []byte("refused"))
+	decoyFile := createTempFile(t, "decoy.txt", []byte("decoy"))
+	for name, opts := range map[string]operations.EncryptOptions{
+		"decoy":    {InputFile: inputFile, WorkFactor: testWorkFactor, AndPuzzles: 2, KeyInput: "real", DecoyFile: decoyFile, DecoyKeyInput: "duress"},
+		"too_many": {InputFile: inputFile, WorkFactor: testWorkFactor, AndPuzzles: types.MaxAndPuzzles + 1},
+		"negative": {InputFile: inputFile, WorkFactor: testWorkFactor, AndPuzzles: -1},
+	} {
+		if _, err := operations.EncryptFile(opts); err == nil {
+			t.Errorf("%s: encryption succeeded", name)
+		}
+	}
+
+	// Bundles share one puzzle, so files of several are not bundled
+	otherFile := createTempFile(t, "other.txt", []byte("other"))
+	results, err := operations.EncryptGroup([]string{inputFile, otherFile}, operations.EncryptOptions{
+		WorkFactor: testWorkFactor,
+		AndPuzzles: 2,
+	})
+	if err != nil {
+		t.Fatalf("Group encryption failed: %v", err)
+	}
+	if _, err := operations.BundleFiles(operations.BundleOptions{
+		InputFiles: []string{results[0].OutputFile, results[1].OutputFile},
+		OutputFile: filepath.Join(t.TempDir(), "bundle.locked"),
+	}); err == nil {
+		t.Error("Bundling files of several puzzles succeeded")
+	}
+
+	// Each member of the group decrypts on its own
+	for _, result := range results {
+		if _, err := operations.DecryptFile(operations.DecryptOptions{InputFile: result.OutputFile}, nil); err != nil {
+			t.Errorf("Decrypting group member %s failed: %v", result.OutputFile, err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package integration
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cryptotimed/src/operations"
+)
+
+// appendRecords encrypts one small file per record into a new log and
+// returns the log and the encrypt results.
+func appendRecords(t *testing.T, count int) (string, []*operations.EncryptResult) {
+	t.Helper()
+	logFile := filepath.Join(t.TempDir(), "archive.ctlog")
+	var results []*operations.EncryptResult
+	for i := 0; i < count; i++ {
+		input := createTempFile(t, fmt.Sprintf("minutes-%d.txt", i), []byte(fmt.Sprintf("meeting minutes %d", i)))
+		result, err := operations.EncryptFile(operations.EncryptOptions{
+			InputFile:  input,
+			WorkFactor: testWorkFactor,
+			AppendTo:   logFile,
+		})
+		if err != nil {
+			t.Fatalf("Appending record %d failed: %v", i, err)
+		}
+		if result.OutputFile != logFile || result.LogRecord != i {
+			t.Fatalf("record %d appended as %d to %s", i, result.LogRecord, result.OutputFile)
+		}
+		results = append(results, result)
+	}
+	return logFile, results
+}
+
+func TestAppendLogVerifyAndExtract(t *testing.T) {
+	logFile, results := appendRecords(t, 4)
+
+	verified, err := operations.VerifyLog(operations.VerifyLogOptions{InputFile: logFile})
+	if err != nil {
+		t.Fatalf("VerifyLog failed: %v", err)
+	}
+	if len(verified.Records) != 4 {
+		t.Fatalf("verified %d records, want 4", len(verified.Records))
+	}
+	if verified.Head != results[3].LogHead {
+		t.Error("log head differs from the one reported by the last append")
+	}
+	for i, rec := range verified.Records {
+		if rec.Size != results[i].EncryptedSize || rec.WorkFactor != testWorkFactor {
+			t.Errorf("record %d = %+v", i, rec)
+		}
+	}
+
+	// Any record can be taken out and decrypted on its own
+	locked := filepath.Join(t.TempDir(), "record.locked")
+	if _, err := operations.ExtractLogRecord(logFile, 2, locked); err != nil {
+		t.Fatalf("ExtractLogRecord failed: %v", err)
+	}
+	decrypted, err := operations.DecryptFile(operations.DecryptOptions{InputFile: locked}, nil)
+	if err != nil {
+		t.Fatalf("Decrypting an extracted record failed: %v", err)
+	}
+	content, _ := os.ReadFile(decrypted.OutputFile)
+	assertBytesEqual(t, []byte("meeting minutes 2"), content, "extracted record")
+
+	if _, err := operations.ExtractLogRecord(logFile, 4, locked); err == nil || !strings.Contains(err.Error(), "has 4 records") {
+		t.Errorf("expected a missing record error, got %v", err)
+	}
+}
+
+func TestAppendLogDetectsTampering(t *testing.T) {
+	logFile, _ := appendRecords(t, 3)
+	original, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified, err := operations.VerifyLog(operations.VerifyLogOptions{InputFile: logFile})
+	if err != nil {
+		t.Fatalf("VerifyLog failed: %v", err)
+	}
+	second, third := verified.Records[1], verified.Records[2]
+
+	check := func(name string, data []byte, want string, intact int) {
+		t.Helper()
+		if err := os.WriteFile(logFile, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		result, err := operations.VerifyLog(operations.VerifyLogOptions{InputFile: logFile})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected an error containing %q, got %v", name, want, err)
+		}
+		if len(result.Records) != intact {
+			t.Errorf("%s: %d records verified before the failure, want %d", name, len(result.Records), intact)
+		}
+	}
+
+	// A byte flipped in the middle record's ciphertext
+	tampered := bytes.Clone(original)
+	tampered[third.Offset-40] ^= 0x01
+	check("modified record", tampered, "record 1 (offset", 1)
+
+	// The middle record removed, its successor now in its place
+	removed := append(bytes.Clone(original[:second.Offset]), original[third.Offset:]...)
+	check("removed record", removed, "record 1 (offset", 1)
+
+	// A record from another log inserted in the middle
+	other, _ := appendRecords(t, 1)
+	foreign, _ := os.ReadFile(other)
+	inserted := append(bytes.Clone(original[:third.Offset]), foreign[9:]...)
+	inserted = append(inserted, original[third.Offset:]...)
+	check("inserted record", inserted, "record 2 (offset", 2)
+
+	// A torn append at the end
+	check("truncated log", original[:len(original)-10], "incomplete record 2", 2)
+}
@@ -0,0 +1,192 @@
+package integration
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/utils"
+)
+
+// encryptInto encrypts each of names, with the given chunk size, into
+// dir as NAME.locked and returns the encrypted files.
+func encryptInto(t *testing.T, dir string, chunkSize int, names ...string) []string {
+	t.Helper()
+	var files []string
+	for _, name := range names {
+		result, err := operations.EncryptFile(operations.EncryptOptions{
+			InputFile:      createTempFile(t, name, generateRandomData(256)),
+			WorkFactor:     testWorkFactor,
+			ChunkSize:      chunkSize,
+			OutputTemplate: filepath.Join(dir, "{base}.locked"),
+		})
+		if err != nil {
+			t.Fatalf("Encryption of %s failed: %v", name, err)
+		}
+		files = append(files, result.OutputFile)
+	}
+	return files
+}
+
+// copyNonce overwrites the first size bytes of the data section of dst
+// with those of src.
+func copyNonce(t *testing.T, src, dst string, size int) {
+	t.Helper()
+	from, err := utils.ReadEncryptedFile(src)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", src, err)
+	}
+	to, err := utils.ReadEncryptedFile(dst)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", dst, err)
+	}
+	copy(to.Data, from.Data[:size])
+	if err := utils.WriteEncryptedFile(dst, to); err != nil {
+		t.Fatalf("Failed to write %s: %v", dst, err)
+	}
+}
+
+func TestAuditNoncesCleanBatch(t *testing.T) {
+	dir := t.TempDir()
+	encryptInto(t, dir, 0, "a.txt", "b.txt", "c.txt")
+	encryptInto(t, dir, crypto.MinChunkSize, "d.txt", "e.txt")
+
+	// A file matched by two patterns is not a collision with itself
+	result, err := operations.AuditNonces(operations.AuditNoncesOptions{
+		Inputs: []string{filepath.Join(dir, "*.locked"), filepath.Join(dir, "a.txt.locked")},
+	})
+	if err != nil {
+		t.Fatalf("Audit failed: %v", err)
+	}
+	if result.Audited != 5 || len(result.Collisions) != 0 || len(result.Skipped) != 0 {
+		t.Errorf("Expected 5 nonces and nothing else, got %+v", result)
+	}
+}
+
+func TestAuditNoncesFlagsCollisions(t *testing.T) {
+	dir := t.TempDir()
+	plain := encryptInto(t, dir, 0, "a.txt", "b.txt", "c.txt", "d.txt")
+	chunked := encryptInto(t, dir, crypto.MinChunkSize, "e.txt", "f.txt")
+
+	// a, b and c share a nonce, and so do the two chunked files; d's nonce
+	// starts with e's stream prefix, which is not a collision
+	copyNonce(t, plain[0], plain[1], crypto.DataNonceSize)
+	copyNonce(t, plain[0], plain[2], crypto.DataNonceSize)
+	copyNonce(t, chunked[0], chunked[1], crypto.StreamNoncePrefixSize)
+	copyNonce(t, chunked[0], plain[3], crypto.StreamNoncePrefixSize)
+
+	notEncrypted := filepath.Join(dir, "notes.locked")
+	if err := utils.WriteFile(notEncrypted, []byte("not an encrypted file")); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := operations.AuditNonces(operations.AuditNoncesOptions{
+		Inputs: []string{filepath.Join(dir, "*.locked")},
+	})
+	if err != nil {
+		t.Fatalf("Audit failed: %v", err)
+	}
+	if result.Audited != 6 {
+		t.Errorf("Expected 6 nonces audited, got %d", result.Audited)
+	}
+	if len(result.Skipped) != 1 || result.Skipped[0].File != notEncrypted {
+		t.Errorf("Expected %s to be skipped, got %+v", notEncrypted, result.Skipped)
+	}
+	if len(result.Collisions) != 2 {
+		t.Fatalf("Expected 2 collisions, got %+v", result.Collisions)
+	}
+
+	want := map[string][]string{
+		operations.NonceData:         plain[:3],
+		operations.NonceStreamPrefix: chunked,
+	}
+	for _, col := range result.Collisions {
+		files, ok := want[col.Kind]
+		if !ok {
+			t.Errorf("Unexpected collision of kind %q", col.Kind)
+			continue
+		}
+		delete(want, col.Kind)
+		if strings.Join(col.Files, ",") != strings.Join(files, ",") {
+			t.Errorf("%s collision in %v, want %v", col.Kind, col.Files, files)
+		}
+		ef, err := utils.ReadEncryptedFile(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(ef.Data, col.Nonce) {
+			t.Errorf("%s collision reports nonce %x, not the one in %s", col.Kind, col.Nonce, files[0])
+		}
+	}
+}
+
+func TestAuditNoncesBundleMembers(t *testing.T) {
+	dir := t.TempDir()
+	a := createTempFile(t, "a.txt", []byte("first member"))
+	b := createTempFile(t, "b.txt", []byte("second member"))
+	members, err := operations.EncryptGroup([]string{a, b}, operations.EncryptOptions{WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Group encryption failed: %v", err)
+	}
+	bundle := filepath.Join(dir, "all.locked")
+	if _, err := operations.BundleFiles(operations.BundleOptions{
+		InputFiles: []string{members[0].OutputFile, members[1].OutputFile},
+		OutputFile: bundle,
+	}); err != nil {
+		t.Fatalf("Bundling failed: %v", err)
+	}
+
+	// The bundle alone holds two distinct nonces
+	result, err := operations.AuditNonces(operations.AuditNoncesOptions{Inputs: []string{bundle}})
+	if err != nil {
+		t.Fatalf("Audit failed: %v", err)
+	}
+	if result.Audited != 2 || len(result.Collisions) != 0 {
+		t.Errorf("Expected the 2 members audited without collision, got %+v", result)
+	}
+
+	// Audited with the files it was made of, each member repeats
+	result, err = operations.AuditNonces(operations.AuditNoncesOptions{
+		Inputs: []string{bundle, members[0].OutputFile, members[1].OutputFile},
+	})
+	if err != nil {
+		t.Fatalf("Audit failed: %v", err)
+	}
+	if len(result.Collisions) != 2 {
+		t.Fatalf("Expected each member to collide with its file, got %+v", result.Collisions)
+	}
+	for _, col := range result.Collisions {
+		if len(col.Files) != 2 || !strings.HasPrefix(col.Files[0], bundle+":") && !strings.HasPrefix(col.Files[1], bundle+":") {
+			t.Errorf("Expected a bundle member and its file, got %v", col.Files)
+		}
+	}
+}
+
+func TestAuditNoncesCLI(t *testing.T) {
+	dir := t.TempDir()
+	files := encryptInto(t, dir, 0, "a.txt", "b.txt")
+
+	code, stdout, stderr := execute(t, "audit-nonces", "--input-glob", filepath.Join(dir, "*.locked"))
+	if code != 0 || !strings.Contains(stdout, "Audited 2 nonces") || !strings.Contains(stdout, "No nonce repeats") {
+		t.Fatalf("audit of a clean batch exited with %d:\n%s%s", code, stdout, stderr)
+	}
+
+	copyNonce(t, files[0], files[1], crypto.DataNonceSize)
+	code, stdout, stderr = execute(t, "audit-nonces", "--input-glob", filepath.Join(dir, "*.locked"))
+	if code != 1 {
+		t.Errorf("audit with a repeated nonce exited with %d", code)
+	}
+	if !strings.Contains(stdout, "Repeated nonce") || !strings.Contains(stdout, files[0]) || !strings.Contains(stdout, files[1]) {
+		t.Errorf("collision not reported:\n%s", stdout)
+	}
+	if !strings.Contains(stderr, "repeated nonces found (1)") {
+		t.Errorf("expected the error to count the collision, got %q", stderr)
+	}
+
+	if code, _, _ := execute(t, "audit-nonces"); code == 0 {
+		t.Error("audit of no files succeeded")
+	}
+}
@@ -0,0 +1,169 @@
+package integration
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cryptotimed/src/operations"
+	"cryptotimed/src/utils"
+)
+
+// createLockedTree encrypts a small tree of files in place and removes the
+// plaintexts, returning the root and the expected contents by relative path.
+func createLockedTree(t *testing.T) (string, map[string][]byte) {
+	root := t.TempDir()
+	files := map[string][]byte{
+		"a.txt":          []byte("first file"),
+		"sub/b.bin":      generateRandomData(2048),
+		"sub/deep/c.txt": []byte("third file"),
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := utils.WriteFile(path, content); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		if _, err := operations.EncryptFile(operations.EncryptOptions{
+			InputFile:  path,
+			WorkFactor: testWorkFactor,
+			KeyInput:   "batch_password",
+		}); err != nil {
+			t.Fatalf("Encryption of %s failed: %v", name, err)
+		}
+		if err := os.Remove(path); err != nil {
+			t.Fatalf("Failed to remove plaintext: %v", err)
+		}
+	}
+	return root, files
+}
+
+func TestDecryptBatchOutputDirKeepsStructure(t *testing.T) {
+	root, files := createLockedTree(t)
+	outputDir := filepath.Join(t.TempDir(), "restored")
+
+	started := 0
+	results, err := operations.DecryptBatch([]string{root}, operations.DecryptOptions{
+		KeyInput:  "batch_password",
+		OutputDir: outputDir,
+	}, func(item operations.BatchItem) operations.ProgressCallback {
+		started++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Batch decryption failed: %v", err)
+	}
+	if len(results) != len(files) || started != len(files) {
+		t.Fatalf("Expected %d results, got %d (%d started)", len(files), len(results), started)
+	}
+
+	for name, content := range files {
+		got, err := utils.ReadFile(filepath.Join(outputDir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("Missing output for %s: %v", name, err)
+		}
+		assertBytesEqual(t, content, got, "Batch output "+name)
+
+		// Nothing is written next to the inputs
+		if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(name))); !os.IsNotExist(err) {
+			t.Errorf("Output for %s was written next to its input", name)
+		}
+	}
+}
+
+func TestDecryptBatchGlobWithoutOutputDir(t *testing.T) {
+	root, files := createLockedTree(t)
+
+	results, err := operations.DecryptBatch([]string{filepath.Join(root, "*.locked")}, operations.DecryptOptions{
+		KeyInput: "batch_password",
+	}, nil)
+	if err != nil {
+		t.Fatalf("Batch decryption failed: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("Glob should match only the top-level file, got %d results", len(results))
+	}
+	got, err := utils.ReadFile(filepath.Join(root, "a.txt"))
+	if err != nil {
+		t.Fatalf("Missing output next to input: %v", err)
+	}
+	assertBytesEqual(t, files["a.txt"], got, "Batch output a.txt")
+}
+
+func TestDecryptBatchRejectsOutputDirInsideInput(t *testing.T) {
+	root, _ := createLockedTree(t)
+
+	for _, outputDir := range []string{root, filepath.Join(root, "out"), filepath.Join(root, "sub", "new", "out")} {
+		_, err := operations.DecryptBatch([]string{root}, operations.DecryptOptions{
+			KeyInput:  "batch_password",
+			OutputDir: outputDir,
+		}, nil)
+		if err == nil {
+			t.Errorf("Expected output directory %s inside the input tree to be rejected", outputDir)
+		}
+	}
+
+	// The same check sees through a symlink to the input tree
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(root, link); err != nil {
+		t.Skipf("Symlinks not supported: %v", err)
+	}
+	_, err := operations.DecryptBatch([]string{root}, operations.DecryptOptions{
+		KeyInput:  "batch_password",
+		OutputDir: filepath.Join(link, "out"),
+	}, nil)
+	if err == nil {
+		t.Error("Expected output directory reached through a symlink to be rejected")
+	}
+}
+
+func TestDecryptOutputDirSingleFileAndContainer(t *testing.T) {
+	content := []byte("single file output dir")
+	inputFile := createTempFile(t, "single.txt", content)
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: testWorkFactor,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	outputDir := filepath.Join(t.TempDir(), "created", "on", "demand")
+	result, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile: encryptResult.OutputFile,
+		OutputDir: outputDir,
+	}, nil)
+	if err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+	if result.OutputFile != filepath.Join(outputDir, "single.txt") {
+		t.Errorf("Unexpected output path %s", result.OutputFile)
+	}
+	got, err := utils.ReadFile(result.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	assertBytesEqual(t, content, got, "Output dir file")
+
+	treeRoot, files := createTestTree(t)
+	containerResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  treeRoot,
+		WorkFactor: testWorkFactor,
+	})
+	if err != nil {
+		t.Fatalf("Container encryption failed: %v", err)
+	}
+	result, err = operations.DecryptFile(operations.DecryptOptions{
+		InputFile: containerResult.OutputFile,
+		OutputDir: outputDir,
+	}, nil)
+	if err != nil {
+		t.Fatalf("Container decryption failed: %v", err)
+	}
+	if filepath.Dir(result.OutputFile) != outputDir {
+		t.Errorf("Container extracted to %s, outside %s", result.OutputFile, outputDir)
+	}
+	assertTreeMatches(t, result.OutputFile, files)
+}
@@ -66,6 +66,52 @@ func BenchmarkDecryption(b *testing.B) {
 	}
 }
 
+// BenchmarkCheckpointCadence compares the solve rate without checkpoints,
+// with checkpoints written at several intervals, and with the state kept in
+// memory and written as often.
+func BenchmarkCheckpointCadence(b *testing.B) {
+	const work = 200000
+	inputFile := createTempFileForBench(b, "bench_cadence.txt", generateRandomData(1024))
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: work})
+	if err != nil {
+		b.Fatalf("Pre-encryption failed: %v", err)
+	}
+
+	cadences := []struct {
+		name     string
+		interval time.Duration
+		memory   uint64
+	}{
+		{"none", 0, 0},
+		{"disk-100ms", 100 * time.Millisecond, 0},
+		{"disk-10ms", 10 * time.Millisecond, 0},
+		{"disk-1ms", time.Millisecond, 0},
+		{"memory-10ms", 10 * time.Millisecond, 4096},
+		{"memory-1ms", time.Millisecond, 4096},
+	}
+	for _, c := range cadences {
+		b.Run(c.name, func(b *testing.B) {
+			checkpoint := encryptResult.OutputFile + ".resume"
+			for i := 0; i < b.N; i++ {
+				opts := operations.DecryptOptions{
+					InputFile:             encryptResult.OutputFile,
+					OutputFile:            encryptResult.OutputFile + ".out",
+					NoCalibrate:           true,
+					CheckpointInterval:    c.interval,
+					MemoryCheckpointEvery: c.memory,
+				}
+				if c.interval > 0 {
+					opts.CheckpointPath = checkpoint
+				}
+				if _, err := operations.DecryptFile(opts, nil); err != nil {
+					b.Fatalf("Decryption failed: %v", err)
+				}
+			}
+			b.ReportMetric(float64(work)*float64(b.N)/b.Elapsed().Seconds(), "squarings/s")
+		})
+	}
+}
+
 func BenchmarkBenchmarkOperation(b *testing.B) {
 	opts := operations.BenchmarkOptions{
 		Duration: 10 * time.Millisecond, // Very short for benchmarking
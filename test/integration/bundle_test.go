@@ -0,0 +1,121 @@
+package integration
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+func TestBundleDecryptsAllFromOneSolve(t *testing.T) {
+	for _, key := range []string{"", "bundle_password"} {
+		t.Run("key_"+key, func(t *testing.T) {
+			outputs, contents := createSharedGroup(t, key)
+			bundleFile := filepath.Join(t.TempDir(), "all.locked")
+
+			bundle, err := operations.BundleFiles(operations.BundleOptions{
+				InputFiles: outputs,
+				OutputFile: bundleFile,
+			})
+			if err != nil {
+				t.Fatalf("Bundling failed: %v", err)
+			}
+			if len(bundle.Members) != len(outputs) {
+				t.Fatalf("Bundled %d members, want %d", len(bundle.Members), len(outputs))
+			}
+
+			header, err := utils.ReadFileHeader(bundleFile)
+			if err != nil {
+				t.Fatalf("Failed to read bundle header: %v", err)
+			}
+			if header.MinReaderVersion != types.VersionBundle {
+				t.Errorf("Min reader version %d, want %d", header.MinReaderVersion, types.VersionBundle)
+			}
+			check, err := operations.CheckFile(operations.CheckOptions{InputFile: bundleFile})
+			if err != nil {
+				t.Fatalf("Check failed: %v", err)
+			}
+			if len(check.Bundle) != len(outputs) || check.Bundle[0].Name != filepath.Base(outputs[0]) {
+				t.Errorf("check should list the members, got %+v", check.Bundle)
+			}
+
+			// Count finished solves: every solve reports its last squaring
+			solves := 0
+			outputDir := t.TempDir()
+			result, err := operations.DecryptFile(operations.DecryptOptions{
+				InputFile: bundleFile,
+				KeyInput:  key,
+				OutputDir: outputDir,
+			}, func(done uint64) {
+				if done == header.WorkFactor {
+					solves++
+				}
+			})
+			if err != nil {
+				t.Fatalf("Decrypting the bundle failed: %v", err)
+			}
+			if solves != 1 {
+				t.Errorf("Solved %d times, want once", solves)
+			}
+			if !result.Bundle || result.EntryCount != len(outputs) {
+				t.Errorf("Result %+v, want a bundle of %d members", result, len(outputs))
+			}
+
+			dir := filepath.Join(outputDir, "all")
+			if result.OutputFile != dir {
+				t.Errorf("Output %s, want %s", result.OutputFile, dir)
+			}
+			for i, content := range contents {
+				got, err := os.ReadFile(filepath.Join(dir, strings.TrimSuffix(filepath.Base(outputs[i]), ".locked")))
+				if err != nil {
+					t.Fatalf("Failed to read member output: %v", err)
+				}
+				assertBytesEqual(t, content, got, "Bundle member")
+			}
+			if got, err := os.ReadFile(filepath.Join(dir, "docs", "readme.txt")); err != nil || string(got) != "docs" {
+				t.Errorf("Container member: got %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestBundleRejectsDifferentPuzzles(t *testing.T) {
+	outputs, _ := createSharedGroup(t, "")
+	other := createTempFile(t, "other.txt", []byte("a puzzle of its own"))
+	otherResult, err := operations.EncryptFile(operations.EncryptOptions{InputFile: other, WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	bundleFile := filepath.Join(t.TempDir(), "all.locked")
+
+	tests := map[string][]string{
+		"different_puzzle": {outputs[0], otherResult.OutputFile},
+		"single_file":      {outputs[0]},
+		"same_name":        {outputs[0], outputs[0]},
+	}
+	for name, inputs := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := operations.BundleFiles(operations.BundleOptions{InputFiles: inputs, OutputFile: bundleFile})
+			if err == nil {
+				t.Fatalf("Bundling %v succeeded", inputs)
+			}
+			if _, statErr := os.Stat(bundleFile); statErr == nil {
+				t.Errorf("A bundle was written despite: %v", err)
+			}
+		})
+	}
+
+	// A bundle cannot be bundled again
+	if _, err := operations.BundleFiles(operations.BundleOptions{InputFiles: outputs[:2], OutputFile: bundleFile}); err != nil {
+		t.Fatalf("Bundling failed: %v", err)
+	}
+	nested := filepath.Join(t.TempDir(), "nested.locked")
+	_, err = operations.BundleFiles(operations.BundleOptions{InputFiles: []string{bundleFile, outputs[2]}, OutputFile: nested})
+	if err == nil || !strings.Contains(err.Error(), "already a bundle") {
+		t.Errorf("Bundling a bundle: got %v", err)
+	}
+}
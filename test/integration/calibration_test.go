@@ -0,0 +1,452 @@
+package integration
+
+import (
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/utils"
+)
+
+// Rate calibration and machine comparison tests
+
+func TestCompareRates(t *testing.T) {
+	tests := []struct {
+		name          string
+		encryptorRate float64
+		localRate     float64
+		wantFactor    float64
+		wantPhrase    string
+	}{
+		{"local_3x_slower", 3000000, 1000000, 3.0, "~3.0x slower"},
+		{"local_2x_faster", 1000000, 2000000, 0.5, "~2.0x faster"},
+		{"comparable", 1000000, 1050000, 1000000.0 / 1050000.0, "about the encryptor's speed"},
+		{"unknown_rate", 0, 1000000, 0, "unknown"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cmp := operations.CompareRates(test.encryptorRate, test.localRate)
+			if math.Abs(cmp.DelayFactor-test.wantFactor) > 1e-9 {
+				t.Errorf("DelayFactor = %v, want %v", cmp.DelayFactor, test.wantFactor)
+			}
+			if !strings.Contains(cmp.Message, test.wantPhrase) {
+				t.Errorf("Message %q does not contain %q", cmp.Message, test.wantPhrase)
+			}
+		})
+	}
+
+	// The slower-machine message must spell out the expected delay multiplier
+	cmp := operations.CompareRates(3000000, 1000000)
+	if !strings.Contains(cmp.Message, "expect ~3.0x the intended delay") {
+		t.Errorf("unexpected message for slower machine: %q", cmp.Message)
+	}
+}
+
+func TestWorkFactorForTime(t *testing.T) {
+	// Synthetic samples: mean 1,000,000 squarings/second, sample standard
+	// deviation √(2.5e10/4), so the 95% interval is the mean ± 2.7764·s/√5
+	var samples []operations.BenchmarkSample
+	for _, rate := range []float64{900000, 950000, 1000000, 1050000, 1100000} {
+		samples = append(samples, operations.BenchmarkSample{Operations: uint64(rate), Elapsed: time.Second, OpsPerSecond: rate})
+	}
+	target := time.Hour
+
+	tuning, err := operations.WorkFactorForTime(samples, target, 0.95)
+	if err != nil {
+		t.Fatalf("WorkFactorForTime failed: %v", err)
+	}
+	lower := 1000000 - 2.776445*math.Sqrt(2.5e10/4)/math.Sqrt(5)
+	if tuning.Rate.Mean != 1000000 || math.Abs(tuning.Rate.Lower-lower) > 10 {
+		t.Errorf("rate interval: mean %.0f, lower %.0f; want 1000000, %.0f", tuning.Rate.Mean, tuning.Rate.Lower, lower)
+	}
+
+	// The conservative choice: T is taken at the lower bound, not the mean
+	want := uint64(math.Floor(target.Seconds() * tuning.Rate.Lower))
+	if tuning.WorkFactor != want {
+		t.Errorf("work factor %d, want %d (target × lower bound)", tuning.WorkFactor, want)
+	}
+	if mean := uint64(target.Seconds() * 1000000); tuning.WorkFactor >= mean {
+		t.Errorf("work factor %d is not below the %d of the mean rate", tuning.WorkFactor, mean)
+	}
+	if tuning.MeanTime >= target {
+		t.Errorf("time at the mean rate %v, want less than the target", tuning.MeanTime)
+	}
+
+	// More confidence means a lower bound further down
+	strict, err := operations.WorkFactorForTime(samples, target, 0.99)
+	if err != nil {
+		t.Fatalf("WorkFactorForTime failed at 99%%: %v", err)
+	}
+	if strict.WorkFactor >= tuning.WorkFactor {
+		t.Errorf("99%% confidence picked %d, want less than the %d of 95%%", strict.WorkFactor, tuning.WorkFactor)
+	}
+
+	// An interval reaching down to zero bounds nothing
+	noisy := []operations.BenchmarkSample{{OpsPerSecond: 10}, {OpsPerSecond: 1000000}}
+	if _, err := operations.WorkFactorForTime(noisy, target, 0.95); err == nil {
+		t.Error("samples too noisy to bound the rate were accepted")
+	}
+	if _, err := operations.WorkFactorForTime(samples[:1], target, 0.95); err == nil {
+		t.Error("a single sample was accepted")
+	}
+}
+
+func TestEncryptorRateRecordedInHeader(t *testing.T) {
+	inputFile := createTempFile(t, "rate.txt", []byte("rate recording"))
+
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:    inputFile,
+		WorkFactor:   testWorkFactor,
+		OpsPerSecond: 654321,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	checkResult, err := operations.CheckFile(operations.CheckOptions{InputFile: encryptResult.OutputFile})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if checkResult.EncryptorRate != 654321 {
+		t.Errorf("EncryptorRate = %v, want 654321", checkResult.EncryptorRate)
+	}
+
+	// A file encrypted without a recorded rate reports zero
+	plainResult, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	checkResult, err = operations.CheckFile(operations.CheckOptions{InputFile: plainResult.OutputFile})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if checkResult.EncryptorRate != 0 {
+		t.Errorf("EncryptorRate = %v, want 0 when not recorded", checkResult.EncryptorRate)
+	}
+}
+
+func TestEncryptTargetDuration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("benchmarks this machine")
+	}
+	// Without a calibrated rate, one is benchmarked
+	t.Setenv(utils.StateDirEnv, t.TempDir())
+	inputFile := createTempFile(t, "duration.txt", []byte("locked for a fraction of a second"))
+
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:      inputFile,
+		TargetDuration: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	if encryptResult.Tuning == nil || encryptResult.Tuning.Benchmark == nil || encryptResult.Tuning.WorkFactor != encryptResult.WorkFactor {
+		t.Errorf("Tuning = %+v, want the benchmark the work factor was picked from", encryptResult.Tuning)
+	}
+	checkResult, err := operations.CheckFile(operations.CheckOptions{InputFile: encryptResult.OutputFile})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if checkResult.EncryptorRate <= 0 {
+		t.Fatal("The rate the work factor was picked from was not recorded")
+	}
+	// The rate recorded is the lower end of the rate interval, which the
+	// work factor was picked at
+	if rate := encryptResult.Tuning.Rate.Lower; checkResult.EncryptorRate != rate || encryptResult.WorkFactor != uint64(0.2*rate) {
+		t.Errorf("Work factor %d for 200ms recorded at %.0f squarings/second, want %d at %.0f",
+			encryptResult.WorkFactor, checkResult.EncryptorRate, uint64(0.2*rate), rate)
+	}
+
+	_, err = operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: testWorkFactor, TargetDuration: time.Second})
+	if err == nil || !strings.Contains(err.Error(), "cannot both be given") {
+		t.Errorf("A work factor and a target duration were both accepted: %v", err)
+	}
+	code, _, stderr := execute(t, "encrypt", "--input", inputFile, "--work", "1000", "--work-duration", "1h")
+	if code != 1 || !strings.Contains(stderr, "--work and --work-duration") {
+		t.Errorf("--work with --work-duration: exit %d, stderr %q", code, stderr)
+	}
+	code, _, stderr = execute(t, "encrypt", "--input", inputFile, "--target-time", "1h", "--work-duration", "1h")
+	if code != 1 || !strings.Contains(stderr, "they are the same option") {
+		t.Errorf("--target-time with --work-duration: exit %d, stderr %q", code, stderr)
+	}
+}
+
+func TestEncryptTimeFromCalibration(t *testing.T) {
+	// A calibration profile of its own, not the one the other tests share
+	t.Setenv(utils.StateDirEnv, t.TempDir())
+	if err := utils.RecordSolveRate(crypto.DefaultModulusBits, 3600000000, time.Hour); err != nil {
+		t.Fatalf("RecordSolveRate failed: %v", err)
+	}
+	inputFile := createTempFile(t, "time.txt", []byte("about two seconds here"))
+
+	// The calibrated rate is used as is, without a benchmark
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, TargetDuration: 2 * time.Second})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	if encryptResult.WorkFactor != 2000000 || encryptResult.Tuning == nil || encryptResult.Tuning.Benchmark != nil {
+		t.Errorf("work factor %d from %+v, want 2000000 from the calibrated rate", encryptResult.WorkFactor, encryptResult.Tuning)
+	}
+
+	outputFile := filepath.Join(t.TempDir(), "time.locked")
+	code, stdout, stderr := execute(t, "encrypt", "--input", inputFile, "--time", "2s", "--record-rate", "--output", outputFile)
+	if code != 0 {
+		t.Fatalf("encrypt --time: exit %d, stderr %q", code, stderr)
+	}
+	for _, want := range []string{"1000000 squarings/second (from this machine's calibrated rate)", "Work factor: 2000000 sequential squarings", "Recording rate: 1000000"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("encrypt --time output lacks %q:\n%s", want, stdout)
+		}
+	}
+	if strings.Contains(stdout, "Measuring") {
+		t.Errorf("encrypt --time --record-rate benchmarked again:\n%s", stdout)
+	}
+	checkResult, err := operations.CheckFile(operations.CheckOptions{InputFile: outputFile})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if checkResult.WorkFactor != 2000000 || checkResult.EncryptorRate != 1000000 {
+		t.Errorf("work factor %d and rate %v recorded, want 2000000 at 1000000", checkResult.WorkFactor, checkResult.EncryptorRate)
+	}
+
+	for _, args := range [][]string{{"--work", "1000"}, {"--target-time", "1h"}, {"--work-relative", "2"}} {
+		code, _, stderr := execute(t, append([]string{"encrypt", "--input", inputFile, "--time", "1h"}, args...)...)
+		if code != 1 || !strings.Contains(stderr, "--time") {
+			t.Errorf("--time with %v: exit %d, stderr %q", args, code, stderr)
+		}
+	}
+}
+
+func TestMeasureRateUsesGivenModulus(t *testing.T) {
+	inputFile := createTempFile(t, "probe.txt", []byte("probe"))
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	checkResult, err := operations.CheckFile(operations.CheckOptions{InputFile: encryptResult.OutputFile})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+
+	if rate := operations.MeasureRate(checkResult.ModulusN, 20*time.Millisecond); rate <= 0 {
+		t.Errorf("MeasureRate returned %v, want a positive rate", rate)
+	}
+}
+
+func TestCheckEstimateUsesCalibration(t *testing.T) {
+	// A calibration profile of its own, not the one the other tests share
+	t.Setenv(utils.StateDirEnv, t.TempDir())
+	inputFile := createTempFile(t, "calibrated.txt", []byte("calibrated estimate"))
+
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: 200000,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	uncalibrated, err := operations.CheckFile(operations.CheckOptions{InputFile: encryptResult.OutputFile})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if uncalibrated.Calibration != nil {
+		t.Fatalf("Calibration = %+v with an empty profile", uncalibrated.Calibration)
+	}
+
+	// Two solves on this machine, at 1M and 3M squarings per second
+	bits := uncalibrated.ModulusN.BitLen()
+	for _, rate := range []uint64{1000000, 3000000} {
+		if err := utils.RecordSolveRate(bits, 20*rate, 20*time.Second); err != nil {
+			t.Fatalf("RecordSolveRate failed: %v", err)
+		}
+	}
+
+	calibrated, err := operations.CheckFile(operations.CheckOptions{InputFile: encryptResult.OutputFile})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if c := calibrated.Calibration; c == nil || c.Rate != 2000000 || c.Samples != 2 {
+		t.Fatalf("Calibration = %+v, want 2000000 squarings/s from 2 solves", c)
+	}
+	if calibrated.EstimatedSecs != 0.1 {
+		t.Errorf("EstimatedSecs = %v, want 0.1 at the calibrated rate", calibrated.EstimatedSecs)
+	}
+
+	// A short solve says little about the sustained rate and is left out
+	decryptResult, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile:  encryptResult.OutputFile,
+		OutputFile: filepath.Join(t.TempDir(), "out.txt"),
+	}, nil)
+	if err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+	if len(decryptResult.Warnings) != 0 {
+		t.Errorf("Unexpected warnings: %v", decryptResult.Warnings)
+	}
+	if c := utils.CalibratedRate(bits); c == nil || c.Samples != 2 {
+		t.Errorf("a short solve changed the profile: %+v", c)
+	}
+}
+
+func TestBenchmarkFile(t *testing.T) {
+	// A calibration profile of its own, not the one the other tests share
+	t.Setenv(utils.StateDirEnv, t.TempDir())
+	inputFile := createTempFile(t, "measured.bin", generateRandomData(3*crypto.MinChunkSize))
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: 200000,
+		KeyInput:   "passphrase",
+		ChunkSize:  crypto.MinChunkSize,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	b, err := operations.BenchmarkFile(operations.FileBenchmarkOptions{
+		InputFile:     encryptResult.OutputFile,
+		ProbeDuration: 50 * time.Millisecond,
+		Save:          true,
+	})
+	if err != nil {
+		t.Fatalf("BenchmarkFile failed: %v", err)
+	}
+	if b.Rate <= 0 || b.AEADRate <= 0 || b.KeyDerivation <= 0 || !b.Saved {
+		t.Fatalf("Benchmark %+v, want every stage measured", b)
+	}
+	if b.WorkFactor != 200000 || b.ModulusBits != 2048 || b.DataSize != int64(crypto.StreamCiphertextSize(3*crypto.MinChunkSize, crypto.MinChunkSize)) {
+		t.Errorf("Benchmark %+v does not describe the file", b)
+	}
+	if b.Estimate != b.Solve+b.KeyDerivation+b.Decrypt {
+		t.Errorf("Estimate %v is not the sum of %v, %v and %v", b.Estimate, b.Solve, b.KeyDerivation, b.Decrypt)
+	}
+
+	// The saved result is found again by the file's fingerprint
+	checkResult, err := operations.CheckFile(operations.CheckOptions{InputFile: encryptResult.OutputFile})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if checkResult.Benchmark == nil || checkResult.Benchmark.Estimate != b.Estimate {
+		t.Errorf("Check shows benchmark %+v, want the saved one", checkResult.Benchmark)
+	}
+}
+
+func TestCheckWithProfile(t *testing.T) {
+	// A calibration profile of its own, not the one the other tests share
+	t.Setenv(utils.StateDirEnv, t.TempDir())
+	inputFile := createTempFile(t, "profiled.txt", []byte("estimated elsewhere"))
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: 400000})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	// A profile exported on a machine whose solves ran at 4M squarings per
+	// second
+	server := &utils.Calibration{Moduli: map[int]*utils.CalibrationEntry{
+		crypto.DefaultModulusBits: {Rate: 4000000, Samples: 3, Updated: time.Now()},
+	}}
+	path := filepath.Join(t.TempDir(), "server.json")
+	if err := utils.ExportProfile(server, path, time.Now()); err != nil {
+		t.Fatalf("ExportProfile failed: %v", err)
+	}
+
+	result, err := operations.CheckFile(operations.CheckOptions{InputFile: encryptResult.OutputFile, Profile: path})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if result.Profile == nil || result.Profile.Host == nil || result.Calibration.Rate != 4000000 {
+		t.Fatalf("Profile = %+v, Calibration = %+v", result.Profile, result.Calibration)
+	}
+	if result.EstimatedSecs != 0.1 {
+		t.Errorf("EstimatedSecs = %v, want 0.1 at the profiled rate", result.EstimatedSecs)
+	}
+	if utils.CalibratedRate(crypto.DefaultModulusBits) != nil {
+		t.Error("reading a profile changed this machine's")
+	}
+
+	// The same rate picks the work factor for a target time there
+	profile, err := operations.LoadProfile(path)
+	if err != nil {
+		t.Fatalf("LoadProfile failed: %v", err)
+	}
+	tuning, err := operations.WorkFactorForProfile(profile, time.Minute, 0)
+	if err != nil || tuning.WorkFactor != 240000000 {
+		t.Errorf("WorkFactorForProfile = %+v, %v; want 240000000", tuning, err)
+	}
+
+	// and is the rate recorded, without benchmarking this machine
+	outputFile := filepath.Join(t.TempDir(), "profiled.locked")
+	code, stdout, stderr := execute(t, "encrypt", "--input", inputFile, "--target-time", "1s", "--profile", path, "--record-rate", "--output", outputFile)
+	if code != 0 {
+		t.Fatalf("encrypt --profile: exit %d, stderr %q", code, stderr)
+	}
+	if strings.Contains(stdout, "Measuring") {
+		t.Errorf("encrypt --profile --record-rate benchmarked this machine:\n%s", stdout)
+	}
+	result, err = operations.CheckFile(operations.CheckOptions{InputFile: outputFile})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if result.WorkFactor != 4000000 || result.EncryptorRate != 4000000 {
+		t.Errorf("work factor %d and rate %v recorded, want 4000000 at 4000000", result.WorkFactor, result.EncryptorRate)
+	}
+
+	// A profile without the file's modulus size cannot estimate it
+	other := &utils.Calibration{Moduli: map[int]*utils.CalibrationEntry{3072: {Rate: 1000000, Samples: 1}}}
+	if err := utils.ExportProfile(other, path, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := operations.CheckFile(operations.CheckOptions{InputFile: encryptResult.OutputFile, Profile: path}); err == nil || !strings.Contains(err.Error(), "3072") {
+		t.Errorf("expected a missing modulus size error, got %v", err)
+	}
+}
+
+func TestWorkFactorForMultiplier(t *testing.T) {
+	// A mocked benchmark: 1,234,567 squarings/second is the reference count
+	// of one RelativeWorkSample
+	bench := &operations.BenchmarkResult{AvgOpsPerSecond: 1234567}
+	reference := uint64(1234567 * operations.RelativeWorkSample.Seconds())
+
+	for _, test := range []struct {
+		multiplier float64
+		want       uint64
+	}{
+		{1, reference},
+		{2, 2 * reference},
+		{0.5, reference / 2},
+		{3600, 3600 * reference},
+	} {
+		rel, err := operations.WorkFactorForMultiplier(bench, test.multiplier)
+		if err != nil {
+			t.Fatalf("WorkFactorForMultiplier(%g) failed: %v", test.multiplier, err)
+		}
+		if diff := int64(rel.WorkFactor) - int64(test.want); diff < -1 || diff > 1 {
+			t.Errorf("multiplier %g: work factor %d, want %d", test.multiplier, rel.WorkFactor, test.want)
+		}
+		if rel.Reference != reference {
+			t.Errorf("multiplier %g: reference %d, want %d", test.multiplier, rel.Reference, reference)
+		}
+		want := time.Duration(test.multiplier * float64(operations.RelativeWorkSample))
+		if d := rel.EstimatedTime - want; d < -time.Millisecond || d > time.Millisecond {
+			t.Errorf("multiplier %g: estimated time %v, want %v", test.multiplier, rel.EstimatedTime, want)
+		}
+	}
+
+	// A tiny multiplier still needs one squaring
+	if rel, err := operations.WorkFactorForMultiplier(bench, 1e-12); err != nil || rel.WorkFactor != 1 {
+		t.Errorf("tiny multiplier: %v, %v; want a work factor of 1", rel, err)
+	}
+	for _, bad := range []float64{0, -2, math.Inf(1), math.NaN()} {
+		if _, err := operations.WorkFactorForMultiplier(bench, bad); err == nil {
+			t.Errorf("multiplier %g was accepted", bad)
+		}
+	}
+	if _, err := operations.WorkFactorForMultiplier(&operations.BenchmarkResult{}, 2); err == nil {
+		t.Error("a benchmark without a rate was accepted")
+	}
+}
@@ -0,0 +1,792 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cryptotimed/src/cmd"
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/utils"
+)
+
+func TestDecryptStopAndResumeFromCheckpoint(t *testing.T) {
+	data := generateRandomData(4096)
+	inputFile := createTempFile(t, "input.bin", data)
+
+	const work = 300000
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: work,
+		KeyInput:   "resume me",
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	checkpoint := encryptResult.OutputFile + ".resume"
+
+	// Stop after the first periodic checkpoint with some progress in it
+	ctl := &crypto.SolveControl{}
+	var saved atomic.Uint64
+	opts := operations.DecryptOptions{
+		InputFile:          encryptResult.OutputFile,
+		KeyInput:           "resume me",
+		CheckpointPath:     checkpoint,
+		CheckpointInterval: time.Millisecond,
+		Control:            ctl,
+		OnCheckpoint: func(state crypto.SolvingState, err error) {
+			if err != nil {
+				t.Errorf("checkpoint failed: %v", err)
+			}
+			if state.Done > 0 {
+				saved.Store(state.Done)
+				ctl.Stop()
+			}
+		},
+	}
+	_, err = operations.DecryptFile(opts, nil)
+	if !errors.Is(err, crypto.ErrSolveStopped) {
+		t.Fatalf("expected a stopped solve, got %v", err)
+	}
+	state, err := utils.LoadState(checkpoint)
+	if err != nil {
+		t.Fatalf("checkpoint not readable after stop: %v", err)
+	}
+	if state.Done == 0 || state.Done >= work || state.Done < saved.Load() {
+		t.Fatalf("checkpoint has %d squarings done, want between %d and %d", state.Done, saved.Load(), work)
+	}
+
+	// The next run picks up from the checkpoint and removes it
+	var resumed uint64
+	opts.Control = nil
+	opts.OnCheckpoint = nil
+	opts.CheckpointInterval = 0
+	opts.OnResume = func(done uint64) { resumed = done }
+	result, err := operations.DecryptFile(opts, nil)
+	if err != nil {
+		t.Fatalf("resumed decryption failed: %v", err)
+	}
+	if resumed != state.Done || result.ResumedFrom != state.Done {
+		t.Errorf("resumed from %d (result %d), want %d", resumed, result.ResumedFrom, state.Done)
+	}
+	decrypted, err := utils.ReadFile(result.OutputFile)
+	if err != nil {
+		t.Fatalf("failed to read decrypted file: %v", err)
+	}
+	assertBytesEqual(t, data, decrypted, "resumed decryption")
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Errorf("checkpoint should be removed after solving, stat: %v", err)
+	}
+}
+
+func TestDecryptCancelledByContext(t *testing.T) {
+	inputFile := createTempFile(t, "input.bin", generateRandomData(1024))
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: 300000,
+		KeyInput:   "cancel me",
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	checkpoint := encryptResult.OutputFile + ".resume"
+
+	// Cancel once some progress has been saved
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err = operations.DecryptFile(operations.DecryptOptions{
+		InputFile:          encryptResult.OutputFile,
+		KeyInput:           "cancel me",
+		CheckpointPath:     checkpoint,
+		CheckpointInterval: time.Millisecond,
+		Context:            ctx,
+		OnCheckpoint: func(state crypto.SolvingState, err error) {
+			if state.Done > 0 {
+				cancel()
+			}
+		},
+	}, nil)
+	if !errors.Is(err, context.Canceled) || !errors.Is(err, crypto.ErrSolveStopped) {
+		t.Fatalf("expected a cancelled solve, got %v", err)
+	}
+	if state, err := utils.LoadState(checkpoint); err != nil || state.Done == 0 {
+		t.Errorf("no progress saved on cancel: %v", err)
+	}
+
+	// A context already done stops the solve before it starts
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	_, err = operations.DecryptFile(operations.DecryptOptions{
+		InputFile: encryptResult.OutputFile,
+		KeyInput:  "cancel me",
+		Context:   ctx,
+	}, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a solve past its deadline, got %v", err)
+	}
+
+	// A wrong passphrase is not mistaken for a cancellation
+	_, err = operations.DecryptFile(operations.DecryptOptions{
+		InputFile: encryptResult.OutputFile,
+		KeyInput:  "wrong",
+		Target:    big.NewInt(2),
+		Context:   context.Background(),
+	}, nil)
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, crypto.ErrSolveStopped) {
+		t.Errorf("expected a failure to decrypt, got %v", err)
+	}
+}
+
+func TestDecryptIgnoresMismatchedCheckpoint(t *testing.T) {
+	inputFile := createTempFile(t, "input.txt", []byte("checkpoint of another file"))
+
+	first, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	ef, err := utils.ReadEncryptedFile(first.OutputFile)
+	if err != nil {
+		t.Fatalf("failed to read encrypted file: %v", err)
+	}
+	other := utils.PuzzleFromEncryptedFile(ef)
+	other.T++
+	checkpoint := first.OutputFile + ".resume"
+	err = utils.SaveState(crypto.SolvingState{Puzzle: other, Result: other.G, Done: 10, Updated: time.Now()}, checkpoint)
+	if err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+
+	result, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile:      first.OutputFile,
+		OutputFile:     first.OutputFile + ".out",
+		CheckpointPath: checkpoint,
+	}, nil)
+	if err != nil {
+		t.Fatalf("decryption with a mismatched checkpoint failed: %v", err)
+	}
+	if result.ResumedFrom != 0 || len(result.Warnings) != 1 {
+		t.Errorf("expected a fresh solve with one warning, got resumed %d, warnings %q", result.ResumedFrom, result.Warnings)
+	}
+}
+
+func TestInspectResume(t *testing.T) {
+	inputFile := createTempFile(t, "input.txt", []byte("inspect my checkpoint"))
+	locked, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: testWorkFactor, KeyInput: "pw"})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	ef, err := utils.ReadEncryptedFile(locked.OutputFile)
+	if err != nil {
+		t.Fatalf("failed to read encrypted file: %v", err)
+	}
+	puzzle := utils.PuzzleFromEncryptedFile(ef)
+
+	// A checkpoint a quarter of the way through
+	g := new(big.Int).Set(puzzle.G)
+	for i := 0; i < testWorkFactor/4; i++ {
+		g.Mul(g, g).Mod(g, puzzle.N)
+	}
+	updated := time.Now().Add(-time.Hour).Truncate(time.Second)
+	checkpoint := locked.OutputFile + ".resume"
+	if err := utils.SaveState(crypto.SolvingState{Puzzle: puzzle, Result: g, Done: testWorkFactor / 4, Updated: updated}, checkpoint); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+
+	result, err := operations.InspectResume(operations.InspectResumeOptions{CheckpointFile: checkpoint})
+	if err != nil {
+		t.Fatalf("InspectResume failed: %v", err)
+	}
+	if result.LockedFile != locked.OutputFile || !result.Matches {
+		t.Errorf("checkpoint should belong to %s, got %q (matches %v: %s)", locked.OutputFile, result.LockedFile, result.Matches, result.Mismatch)
+	}
+	if result.Fingerprint != puzzle.Fingerprint() {
+		t.Errorf("fingerprint %x, want %x", result.Fingerprint[:4], puzzle.Fingerprint())
+	}
+	if result.Done != testWorkFactor/4 || result.WorkFactor != testWorkFactor || result.Percent != 25 {
+		t.Errorf("progress %d/%d (%.2f%%), want %d/%d (25%%)", result.Done, result.WorkFactor, result.Percent, testWorkFactor/4, testWorkFactor)
+	}
+	if !result.Updated.Equal(updated) {
+		t.Errorf("updated %v, want %v", result.Updated, updated)
+	}
+
+	// Stale: the encrypted file was replaced by another puzzle
+	other, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: testWorkFactor, OutputTemplate: "{path}.other"})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	result, err = operations.InspectResume(operations.InspectResumeOptions{CheckpointFile: checkpoint, LockedFile: other.OutputFile})
+	if err != nil {
+		t.Fatalf("InspectResume failed: %v", err)
+	}
+	if result.Matches || result.Mismatch == "" {
+		t.Errorf("checkpoint matched the wrong file %s", other.OutputFile)
+	}
+
+	// A checkpoint whose contents disagree with its stored fingerprint is rejected
+	data, _ := os.ReadFile(checkpoint)
+	data[len("CTRESUME")+1] ^= 0xff
+	os.WriteFile(checkpoint, data, 0600)
+	if _, err := operations.InspectResume(operations.InspectResumeOptions{CheckpointFile: checkpoint}); err == nil {
+		t.Error("corrupted checkpoint was accepted")
+	}
+}
+
+func TestDecryptRestartsWhenFileReplaced(t *testing.T) {
+	inputFile := createTempFile(t, "input.txt", []byte("first version"))
+	first, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	// A genuine checkpoint of the first file, halfway through its solve
+	ef, err := utils.ReadEncryptedFile(first.OutputFile)
+	if err != nil {
+		t.Fatalf("failed to read encrypted file: %v", err)
+	}
+	old := utils.PuzzleFromEncryptedFile(ef)
+	half := old
+	half.T = old.T / 2
+	checkpoint := first.OutputFile + ".resume"
+	state := crypto.SolvingState{Puzzle: old, Result: solvePuzzle(t, half), Done: half.T, Updated: time.Now()}
+	if err := utils.SaveState(state, checkpoint); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+
+	// The file is then encrypted again in its place with another work factor
+	content := []byte("second version")
+	if err := os.WriteFile(inputFile, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(first.OutputFile); err != nil {
+		t.Fatal(err)
+	}
+	second, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: testWorkFactor * 2})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	if second.OutputFile != first.OutputFile {
+		t.Fatalf("encrypted to %s, want %s in its place", second.OutputFile, first.OutputFile)
+	}
+
+	output := filepath.Join(t.TempDir(), "out.txt")
+	result, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile:      second.OutputFile,
+		OutputFile:     output,
+		CheckpointPath: checkpoint,
+	}, nil)
+	if err != nil {
+		t.Fatalf("decryption with a stale checkpoint failed: %v", err)
+	}
+	if result.ResumedFrom != 0 || len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "different puzzle") {
+		t.Errorf("expected a fresh solve with one warning, got resumed %d, warnings %q", result.ResumedFrom, result.Warnings)
+	}
+	got, _ := os.ReadFile(output)
+	assertBytesEqual(t, content, got, "decrypted after a stale checkpoint")
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Errorf("stale checkpoint left behind: %v", err)
+	}
+}
+
+// saveCheckpoint writes a checkpoint of the puzzle of an encrypted file
+// without a passphrase, done squarings in.
+func saveCheckpoint(t *testing.T, lockedFile string, done uint64) string {
+	t.Helper()
+	ef, err := utils.ReadEncryptedFile(lockedFile)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", lockedFile, err)
+	}
+	puzzle := utils.PuzzleFromEncryptedFile(ef)
+	path := lockedFile + ".resume"
+	state := crypto.SolvingState{Puzzle: puzzle, Result: puzzle.G, Done: done, Updated: time.Now()}
+	if err := utils.SaveState(state, path); err != nil {
+		t.Fatalf("failed to save checkpoint: %v", err)
+	}
+	return path
+}
+
+func TestCheckpointListAndGC(t *testing.T) {
+	dir := t.TempDir()
+	encrypt := func(name string) string {
+		input := filepath.Join(dir, name)
+		if err := os.WriteFile(input, []byte("contents of "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		result, err := operations.EncryptFile(operations.EncryptOptions{InputFile: input, WorkFactor: testWorkFactor})
+		if err != nil {
+			t.Fatalf("Encryption failed: %v", err)
+		}
+		return result.OutputFile
+	}
+
+	// One checkpoint in progress, one of a deleted file, one of a file since
+	// encrypted again, one finished and one file that is no checkpoint
+	active := saveCheckpoint(t, encrypt("active.txt"), testWorkFactor/2)
+	deletedFile := encrypt("deleted.txt")
+	deleted := saveCheckpoint(t, deletedFile, 1)
+	os.Remove(deletedFile)
+	replaced := saveCheckpoint(t, encrypt("replaced.txt"), 1)
+	encrypt("replaced.txt")
+	complete := saveCheckpoint(t, encrypt("complete.txt"), testWorkFactor)
+	invalid := filepath.Join(dir, "notes.resume")
+	if err := os.WriteFile(invalid, []byte("not a checkpoint"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := operations.ListCheckpoints(operations.CheckpointListOptions{Dirs: []string{dir}})
+	if err != nil {
+		t.Fatalf("ListCheckpoints failed: %v", err)
+	}
+	want := map[string]string{
+		active:   operations.CheckpointActive,
+		deleted:  operations.CheckpointOrphaned,
+		replaced: operations.CheckpointOrphaned,
+		complete: operations.CheckpointComplete,
+		invalid:  operations.CheckpointInvalid,
+	}
+	if len(list) != len(want) {
+		t.Fatalf("listed %d checkpoints, want %d: %+v", len(list), len(want), list)
+	}
+	for _, cp := range list {
+		if cp.State != want[cp.Path] {
+			t.Errorf("%s: state %s (%s), want %s", cp.Path, cp.State, cp.Reason, want[cp.Path])
+		}
+		if cp.Size <= 0 {
+			t.Errorf("%s: size %d", cp.Path, cp.Size)
+		}
+		if cp.Path == active && (cp.Done != testWorkFactor/2 || cp.Percent != 50 || cp.LockedFile != strings.TrimSuffix(active, ".resume")) {
+			t.Errorf("active checkpoint: %d done (%.1f%%) of %s", cp.Done, cp.Percent, cp.LockedFile)
+		}
+	}
+
+	// Too recent to remove, then only reported
+	opts := operations.CheckpointGCOptions{CheckpointListOptions: operations.CheckpointListOptions{Dirs: []string{dir}}}
+	opts.OlderThan = time.Hour
+	if result, err := operations.GCCheckpoints(opts); err != nil || len(result.Removed) != 0 {
+		t.Fatalf("gc --older-than 1h: %v, %+v", err, result)
+	}
+	opts.OlderThan = 0
+	opts.DryRun = true
+	result, err := operations.GCCheckpoints(opts)
+	if err != nil {
+		t.Fatalf("gc --dry-run failed: %v", err)
+	}
+	if len(result.Removed) != 3 || len(result.Kept) != 2 {
+		t.Errorf("dry run would remove %d and keep %d, want 3 and 2", len(result.Removed), len(result.Kept))
+	}
+	for path := range want {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("dry run removed %s", path)
+		}
+	}
+
+	opts.DryRun = false
+	if result, err = operations.GCCheckpoints(opts); err != nil {
+		t.Fatalf("gc failed: %v", err)
+	}
+	for path, state := range want {
+		_, err := os.Stat(path)
+		if removed := errors.Is(err, os.ErrNotExist); removed != (state == operations.CheckpointOrphaned || state == operations.CheckpointComplete) {
+			t.Errorf("%s (%s): removed %v", path, state, removed)
+		}
+	}
+	if result.Freed <= 0 {
+		t.Errorf("freed %d bytes", result.Freed)
+	}
+}
+
+func TestDecryptRemovesCheckpointWithoutSolving(t *testing.T) {
+	inputFile := createTempFile(t, "cached.txt", []byte("decrypted from the cache"))
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	opts := operations.DecryptOptions{
+		InputFile:   encryptResult.OutputFile,
+		OutputFile:  inputFile + ".out",
+		CacheTarget: true,
+	}
+	if _, err := operations.DecryptFile(opts, nil); err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+
+	// A checkpoint left by another run is of no use once decrypted
+	opts.CheckpointPath = saveCheckpoint(t, encryptResult.OutputFile, testWorkFactor/2)
+	result, err := operations.DecryptFile(opts, nil)
+	if err != nil {
+		t.Fatalf("Decryption from the cache failed: %v", err)
+	}
+	if !result.FromCache {
+		t.Fatal("the solution did not come from the cache")
+	}
+	if _, err := os.Stat(opts.CheckpointPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("checkpoint not removed after decrypting: %v", err)
+	}
+
+	// A checkpoint of another puzzle is left alone
+	other := createTempFile(t, "other.txt", []byte("other"))
+	otherResult, err := operations.EncryptFile(operations.EncryptOptions{InputFile: other, WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	foreign := saveCheckpoint(t, otherResult.OutputFile, 1)
+	opts.CheckpointPath = foreign
+	if _, err := operations.DecryptFile(opts, nil); err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+	if _, err := os.Stat(foreign); err != nil {
+		t.Errorf("checkpoint of another file removed: %v", err)
+	}
+}
+
+func TestDecryptLeavesNoEmptyCheckpoint(t *testing.T) {
+	inputFile := createTempFile(t, "tiny.txt", []byte("next to no work"))
+
+	// A solve stopped before its first squaring has nothing to save
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	checkpoint := encryptResult.OutputFile + ".resume"
+	ctl := &crypto.SolveControl{}
+	ctl.Stop()
+	var written atomic.Int32
+	_, err = operations.DecryptFile(operations.DecryptOptions{
+		InputFile:          encryptResult.OutputFile,
+		OutputFile:         inputFile + ".out",
+		CheckpointPath:     checkpoint,
+		CheckpointInterval: time.Nanosecond,
+		Control:            ctl,
+		OnCheckpoint:       func(crypto.SolvingState, error) { written.Add(1) },
+	}, nil)
+	if !errors.Is(err, crypto.ErrSolveStopped) {
+		t.Fatalf("Expected the solve to stop, got %v", err)
+	}
+	if strings.Contains(err.Error(), "progress saved") {
+		t.Errorf("Claimed progress was saved: %v", err)
+	}
+	if _, err := os.Stat(checkpoint); !errors.Is(err, os.ErrNotExist) || written.Load() != 0 {
+		t.Errorf("A checkpoint of no squarings was written (%d times): %v", written.Load(), err)
+	}
+
+	// Nor does a puzzle solved at once
+	encryptResult, err = operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: 1, OutputTemplate: filepath.Join(t.TempDir(), "{base}")})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	checkpoint = encryptResult.OutputFile + ".resume"
+	if _, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile:          encryptResult.OutputFile,
+		OutputFile:         inputFile + ".tiny.out",
+		CheckpointPath:     checkpoint,
+		CheckpointInterval: time.Nanosecond,
+	}, nil); err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+	if _, err := os.Stat(checkpoint); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("A solve of one squaring left a checkpoint: %v", err)
+	}
+}
+
+func TestDecryptTimeBoxedRuns(t *testing.T) {
+	data := generateRandomData(4096)
+	inputFile := createTempFile(t, "input.bin", data)
+
+	const work = 300000
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: work,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	checkpoint := encryptResult.OutputFile + ".resume"
+
+	// A time-boxed solve must be able to save its progress
+	_, err = operations.DecryptFile(operations.DecryptOptions{InputFile: encryptResult.OutputFile, SolveFor: time.Second}, nil)
+	if err == nil || !strings.Contains(err.Error(), "checkpoint") {
+		t.Fatalf("expected a missing checkpoint path to be refused, got %v", err)
+	}
+
+	// Each short run carries on where the last one stopped
+	opts := operations.DecryptOptions{
+		InputFile:      encryptResult.OutputFile,
+		CheckpointPath: checkpoint,
+		SolveFor:       20 * time.Millisecond,
+	}
+	var result *operations.DecryptResult
+	var runs int
+	var done uint64
+	for runs = 1; runs <= 1000; runs++ {
+		result, err = operations.DecryptFile(opts, nil)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, operations.ErrSolveTimeUp) || !errors.Is(err, crypto.ErrSolveStopped) {
+			t.Fatalf("run %d: expected the time box to stop the solve, got %v", runs, err)
+		}
+		state, err := utils.LoadState(checkpoint)
+		if err != nil {
+			t.Fatalf("run %d: checkpoint not readable: %v", runs, err)
+		}
+		if state.Done < done || state.Done >= work {
+			t.Fatalf("run %d: checkpoint has %d squarings done after %d", runs, state.Done, done)
+		}
+		done = state.Done
+	}
+	if err != nil {
+		t.Fatalf("solve did not finish in %d runs: %v", runs, err)
+	}
+	if runs < 2 {
+		t.Fatalf("solve finished in the first 20ms run; the time box was not tested")
+	}
+	if result.ResumedFrom != done {
+		t.Errorf("last run resumed from %d, want %d", result.ResumedFrom, done)
+	}
+	decrypted, err := utils.ReadFile(result.OutputFile)
+	if err != nil {
+		t.Fatalf("failed to read decrypted file: %v", err)
+	}
+	assertBytesEqual(t, data, decrypted, "time-boxed decryption")
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Errorf("checkpoint should be removed after solving, stat: %v", err)
+	}
+}
+
+func TestDecryptSolveForExitStatus(t *testing.T) {
+	inputFile := createTempFile(t, "input.txt", []byte("not finished yet"))
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: 50000000})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	code, stdout, stderr := execute(t, "decrypt", "--input", encryptResult.OutputFile, "--solve-for", "200ms", "--no-calibrate")
+	if code != cmd.ExitUnfinished {
+		t.Fatalf("exit status %d, want %d; stdout %q, stderr %q", code, cmd.ExitUnfinished, stdout, stderr)
+	}
+	if stderr != "" {
+		t.Errorf("unexpected error output: %q", stderr)
+	}
+	for _, want := range []string{"solve time used up", "Progress:", "Estimated solving time left:", "Run the same command again"} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("output lacks %q:\n%s", want, stdout)
+		}
+	}
+	if _, err := utils.LoadState(encryptResult.OutputFile + ".resume"); err != nil {
+		t.Errorf("no checkpoint saved: %v", err)
+	}
+}
+
+func TestDecryptFlushesMemoryCheckpoint(t *testing.T) {
+	data := generateRandomData(4096)
+	inputFile := createTempFile(t, "input.bin", data)
+
+	const work = 300000
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: work})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	checkpoint := encryptResult.OutputFile + ".resume"
+
+	// Pause part way through, once some state is kept in memory, and flush
+	// it: the paused solver cannot be asked for a checkpoint itself
+	ctl := &crypto.SolveControl{}
+	flush := make(chan struct{}, 1)
+	flushed := make(chan crypto.SolvingState, 1)
+	var paused atomic.Bool
+	opts := operations.DecryptOptions{
+		InputFile:             encryptResult.OutputFile,
+		CheckpointPath:        checkpoint,
+		MemoryCheckpointEvery: 4096,
+		FlushCheckpoint:       flush,
+		Control:               ctl,
+		ProgressStrategy:      crypto.FixedStep(4096),
+		OnCheckpoint: func(state crypto.SolvingState, err error) {
+			if err != nil {
+				t.Errorf("checkpoint failed: %v", err)
+			}
+			if ctl.Paused() {
+				flushed <- state
+			}
+		},
+	}
+	solved := make(chan error, 1)
+	go func() {
+		_, err := operations.DecryptFile(opts, func(done uint64) {
+			if done >= 3*4096 && paused.CompareAndSwap(false, true) {
+				ctl.Pause()
+				// Let the states already taken reach memory
+				time.Sleep(50 * time.Millisecond)
+				flush <- struct{}{}
+			}
+		})
+		solved <- err
+	}()
+
+	var state crypto.SolvingState
+	select {
+	case state = <-flushed:
+	case <-time.After(30 * time.Second):
+		t.Fatal("no checkpoint written while paused")
+	}
+	saved, err := utils.LoadState(checkpoint)
+	if err != nil {
+		t.Fatalf("flushed checkpoint not readable: %v", err)
+	}
+	if saved.Done != state.Done || saved.Done == 0 || saved.Done >= work || saved.Done%4096 != 0 {
+		t.Fatalf("flushed checkpoint has %d squarings done (reported %d)", saved.Done, state.Done)
+	}
+	flushedCheckpoint, err := os.ReadFile(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctl.Stop()
+	if err := <-solved; !errors.Is(err, crypto.ErrSolveStopped) {
+		t.Fatalf("expected a stopped solve, got %v", err)
+	}
+
+	// The flushed checkpoint resumes to the right plaintext
+	if err := os.WriteFile(checkpoint, flushedCheckpoint, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	result, err := operations.DecryptFile(operations.DecryptOptions{InputFile: encryptResult.OutputFile, CheckpointPath: checkpoint}, nil)
+	if err != nil {
+		t.Fatalf("resumed decryption failed: %v", err)
+	}
+	if result.ResumedFrom != saved.Done {
+		t.Errorf("resumed from %d, want %d", result.ResumedFrom, saved.Done)
+	}
+	decrypted, err := utils.ReadFile(result.OutputFile)
+	if err != nil {
+		t.Fatalf("failed to read decrypted file: %v", err)
+	}
+	assertBytesEqual(t, data, decrypted, "decryption resumed from a flushed checkpoint")
+}
+
+func TestDecryptCheckpointEvery(t *testing.T) {
+	data := []byte("checkpointed by squaring count")
+	inputFile := createTempFile(t, "input.txt", data)
+
+	const work, every = 50000, 10000
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: work})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	checkpoint := encryptResult.OutputFile + ".resume"
+
+	// Without a time interval, checkpoints are saved every 10000 squarings
+	var saved []uint64
+	result, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile:       encryptResult.OutputFile,
+		OutputFile:      inputFile + ".out",
+		CheckpointPath:  checkpoint,
+		CheckpointEvery: every,
+		OnCheckpoint: func(state crypto.SolvingState, err error) {
+			if err != nil {
+				t.Errorf("checkpoint failed: %v", err)
+			}
+			saved = append(saved, state.Done)
+		},
+	}, nil)
+	if err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+	for i := uint64(1); i*every < work; i++ {
+		if uint64(len(saved)) < i || saved[i-1] != i*every {
+			t.Fatalf("checkpoints saved at %v, want every %d squarings", saved, every)
+		}
+	}
+	if _, err := os.Stat(checkpoint); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the checkpoint was left behind: %v", err)
+	}
+	decrypted, err := utils.ReadFile(result.OutputFile)
+	if err != nil {
+		t.Fatalf("failed to read decrypted file: %v", err)
+	}
+	assertBytesEqual(t, data, decrypted, "decryption with checkpoints by squaring count")
+}
+
+func TestDecryptCPULimit(t *testing.T) {
+	data := []byte("decrypted at half speed")
+	inputFile := createTempFile(t, "input.txt", data)
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: 50000})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	for _, limit := range []string{"0", "150%", "half"} {
+		code, _, stderr := execute(t, "decrypt", "--input", encryptResult.OutputFile, "--cpu-limit", limit)
+		if code != 1 || !strings.Contains(stderr, "--cpu-limit") {
+			t.Errorf("--cpu-limit %s: exit %d, stderr %q; want a failure", limit, code, stderr)
+		}
+	}
+
+	outputFile := filepath.Join(t.TempDir(), "out.txt")
+	code, stdout, stderr := execute(t, "decrypt", "--input", encryptResult.OutputFile, "--output", outputFile, "--cpu-limit", "50%", "--no-calibrate")
+	if code != 0 {
+		t.Fatalf("exit status %d; stdout %q, stderr %q", code, stdout, stderr)
+	}
+	if !strings.Contains(stdout, "CPU used while solving:") || !strings.Contains(stdout, "(limit 50%)") {
+		t.Errorf("output lacks the CPU used:\n%s", stdout)
+	}
+	decrypted, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("failed to read decrypted file: %v", err)
+	}
+	assertBytesEqual(t, data, decrypted, "throttled decryption")
+}
+
+func TestDecryptRequireCheckpoint(t *testing.T) {
+	inputFile := createTempFile(t, "input.txt", []byte("only resumed"))
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: 300000})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	checkpoint := encryptResult.OutputFile + ".resume"
+
+	// Nothing to resume is an error, not a fresh start
+	code, _, stderr := execute(t, "decrypt", "--input", encryptResult.OutputFile, "--resume", "--yes")
+	if code != 1 || !strings.Contains(stderr, "no checkpoint") {
+		t.Errorf("--resume without a checkpoint: exit %d, stderr %q; want a failure", code, stderr)
+	}
+	opts := operations.DecryptOptions{InputFile: encryptResult.OutputFile, CheckpointPath: checkpoint, RequireCheckpoint: true}
+	if _, err := operations.DecryptFile(opts, nil); err == nil || !strings.Contains(err.Error(), "no checkpoint") {
+		t.Errorf("RequireCheckpoint without a checkpoint: %v", err)
+	}
+
+	// Neither is a checkpoint of another puzzle
+	other := crypto.Puzzle{N: big.NewInt(3233), G: big.NewInt(2), T: 10}
+	if err := utils.SaveState(crypto.SolvingState{Puzzle: other, Result: big.NewInt(4), Done: 1, Updated: time.Now()}, checkpoint); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	if _, err := operations.DecryptFile(opts, nil); err == nil || !strings.Contains(err.Error(), "cannot resume") {
+		t.Errorf("RequireCheckpoint with a checkpoint of another puzzle: %v", err)
+	}
+	if _, err := utils.LoadState(checkpoint); err != nil {
+		t.Errorf("the checkpoint that did not fit was replaced: %v", err)
+	}
+
+	// A checkpoint of this puzzle is resumed
+	ef, err := utils.ReadEncryptedFile(encryptResult.OutputFile)
+	if err != nil {
+		t.Fatalf("failed to read encrypted file: %v", err)
+	}
+	puzzle := utils.PuzzleFromEncryptedFile(ef)
+	g := new(big.Int).Exp(puzzle.G, big.NewInt(1<<10), puzzle.N)
+	if err := utils.SaveState(crypto.SolvingState{Puzzle: puzzle, Result: g, Done: 10, Updated: time.Now()}, checkpoint); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	result, err := operations.DecryptFile(opts, nil)
+	if err != nil {
+		t.Fatalf("resumed decryption failed: %v", err)
+	}
+	if result.ResumedFrom != 10 {
+		t.Errorf("resumed from %d, want 10", result.ResumedFrom)
+	}
+}
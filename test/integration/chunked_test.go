@@ -0,0 +1,435 @@
+package integration
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+func TestChunkedEncryptDecryptChunkSizes(t *testing.T) {
+	// Sizes straddle chunk boundaries for the smaller chunk sizes
+	plaintext := generateRandomData(3*64*1024 + 17)
+
+	for _, chunkSize := range []int{crypto.MinChunkSize, 64 * 1024, 1 << 20} {
+		t.Run(fmt.Sprintf("chunk_%d", chunkSize), func(t *testing.T) {
+			inputFile := createTempFile(t, "chunked.bin", plaintext)
+			encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+				InputFile:  inputFile,
+				WorkFactor: testWorkFactor,
+				ChunkSize:  chunkSize,
+			})
+			if err != nil {
+				t.Fatalf("Encryption failed: %v", err)
+			}
+
+			// The chunk size is recorded in the header
+			header, err := utils.ReadFileHeader(encryptResult.OutputFile)
+			if err != nil {
+				t.Fatalf("Failed to read header: %v", err)
+			}
+			if header.Ext.ChunkSize != uint32(chunkSize) {
+				t.Fatalf("Header chunk size = %d, want %d", header.Ext.ChunkSize, chunkSize)
+			}
+
+			checkResult, err := operations.CheckFile(operations.CheckOptions{InputFile: encryptResult.OutputFile})
+			if err != nil {
+				t.Fatalf("Check failed: %v", err)
+			}
+			if checkResult.ChunkSize != uint32(chunkSize) || checkResult.PlaintextSize != len(plaintext) || checkResult.DataTooShort {
+				t.Errorf("Check reported chunk size %d, plaintext %d (too short %v); want %d, %d",
+					checkResult.ChunkSize, checkResult.PlaintextSize, checkResult.DataTooShort, chunkSize, len(plaintext))
+			}
+
+			decryptResult, err := operations.DecryptFile(operations.DecryptOptions{
+				InputFile:  encryptResult.OutputFile,
+				OutputFile: inputFile + ".out",
+			}, nil)
+			if err != nil {
+				t.Fatalf("Decryption failed: %v", err)
+			}
+			got, err := utils.ReadFile(decryptResult.OutputFile)
+			if err != nil {
+				t.Fatalf("Failed to read output: %v", err)
+			}
+			assertBytesEqual(t, plaintext, got, "Chunked round trip")
+		})
+	}
+}
+
+func TestChunkedEncryptRejectsOutOfRangeChunkSize(t *testing.T) {
+	inputFile := createTempFile(t, "small.txt", []byte("chunk size bounds"))
+	for _, chunkSize := range []int{1, crypto.MinChunkSize - 1, crypto.MaxChunkSize + 1, -4096} {
+		_, err := operations.EncryptFile(operations.EncryptOptions{
+			InputFile:  inputFile,
+			WorkFactor: testWorkFactor,
+			ChunkSize:  chunkSize,
+		})
+		if err == nil {
+			t.Errorf("Expected chunk size %d to be rejected", chunkSize)
+		}
+	}
+}
+
+func TestChunkedDecryptUsesStoredChunkSize(t *testing.T) {
+	plaintext := generateRandomData(40 * 1024)
+	inputFile := createTempFile(t, "stored.bin", plaintext)
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: testWorkFactor,
+		ChunkSize:  16 * 1024,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	// Rewrite the header with a different (valid) chunk size: the chunk
+	// boundaries no longer line up, so decryption must fail
+	ef, err := utils.ReadEncryptedFile(encryptResult.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+	header := ef.Header()
+	header.Ext.ChunkSize = 8 * 1024
+	tampered := encryptResult.OutputFile + ".tampered"
+	if err := utils.WriteEncryptedFile(tampered, types.NewEncryptedFile(header, ef.Data)); err != nil {
+		t.Fatalf("Failed to write tampered file: %v", err)
+	}
+	defer os.Remove(tampered)
+
+	if _, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile:  tampered,
+		OutputFile: tampered + ".out",
+	}, nil); err == nil {
+		t.Fatal("Expected decryption with the wrong chunk size to fail")
+	}
+
+	// An out-of-range stored chunk size is refused before solving
+	header.Ext.ChunkSize = 1
+	if err := utils.WriteEncryptedFile(tampered, types.NewEncryptedFile(header, ef.Data)); err != nil {
+		t.Fatalf("Failed to write tampered file: %v", err)
+	}
+	solved := false
+	if _, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile:  tampered,
+		OutputFile: tampered + ".out",
+	}, func(uint64) { solved = true }); err == nil || solved {
+		t.Errorf("Expected out-of-range chunk size to be refused before solving (err=%v, solved=%v)", err, solved)
+	}
+}
+
+func TestChunkedDecryptWritesOnlyCompleteOutput(t *testing.T) {
+	plaintext := generateRandomData(5*crypto.MinChunkSize + 100)
+	inputFile := createTempFile(t, "streamed.bin", plaintext)
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: testWorkFactor,
+		ChunkSize:  crypto.MinChunkSize,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	// Damage the last chunk: every earlier chunk is streamed out before the
+	// damage is found, but no output may appear
+	ef, err := utils.ReadEncryptedFile(encryptResult.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+	ef.Data[len(ef.Data)-1] ^= 1
+	damaged := filepath.Join(t.TempDir(), "damaged.bin.locked")
+	if err := utils.WriteEncryptedFile(damaged, ef); err != nil {
+		t.Fatalf("Failed to write damaged file: %v", err)
+	}
+	outputDir := t.TempDir()
+	_, err = operations.DecryptFile(operations.DecryptOptions{
+		InputFile: damaged,
+		OutputDir: outputDir,
+	}, nil)
+	if err == nil || !strings.Contains(err.Error(), "failed to decrypt data") {
+		t.Fatalf("Damaged file: got %v, want a decryption failure", err)
+	}
+	if entries, _ := os.ReadDir(outputDir); len(entries) != 0 {
+		t.Errorf("Failed decryption left %d files behind", len(entries))
+	}
+
+	// The intact file is streamed to exactly one output
+	ef.Data[len(ef.Data)-1] ^= 1
+	if err := utils.WriteEncryptedFile(damaged, ef); err != nil {
+		t.Fatalf("Failed to write repaired file: %v", err)
+	}
+	result, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile: damaged,
+		OutputDir: outputDir,
+	}, nil)
+	if err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+	if result.PlaintextSize != len(plaintext) {
+		t.Errorf("Plaintext size %d, want %d", result.PlaintextSize, len(plaintext))
+	}
+	got, err := os.ReadFile(result.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	assertBytesEqual(t, plaintext, got, "Streamed output")
+	if entries, _ := os.ReadDir(outputDir); len(entries) != 1 {
+		t.Errorf("Decryption left %d files, want only the output", len(entries))
+	}
+}
+
+func TestChunkedDecryptResumesPartialOutput(t *testing.T) {
+	const chunk = crypto.MinChunkSize
+	plaintext := generateRandomData(10*chunk + 100)
+	inputFile := createTempFile(t, "resumable.bin", plaintext)
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: testWorkFactor,
+		ChunkSize:  chunk,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	ef, err := utils.ReadEncryptedFile(encryptResult.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+	fp := ef.Header().Fingerprint()
+
+	dir := t.TempDir()
+	output := filepath.Join(dir, "resumable.bin")
+	checkpoint := filepath.Join(dir, "resumable.bin.resume")
+	partial := utils.PartialFileName(output)
+	record := utils.PartialOutputPath(checkpoint)
+
+	// Leave what a decrypt killed while writing chunk 5 leaves: four chunks
+	// recorded, and part of the next one written after them
+	interrupt := func(partialData []byte) {
+		if err := os.WriteFile(partial, partialData, 0600); err != nil {
+			t.Fatalf("Failed to write partial output: %v", err)
+		}
+		hash := sha256.Sum256(plaintext[:4*chunk])
+		if err := utils.SavePartialOutput(&utils.PartialOutput{
+			Fingerprint: hex.EncodeToString(fp[:]),
+			Output:      output,
+			Partial:     partial,
+			ChunkSize:   chunk,
+			Chunks:      4,
+			Hash:        hex.EncodeToString(hash[:]),
+		}, record); err != nil {
+			t.Fatalf("Failed to save output record: %v", err)
+		}
+	}
+	decrypt := func() *operations.DecryptResult {
+		result, err := operations.DecryptFile(operations.DecryptOptions{
+			InputFile:      encryptResult.OutputFile,
+			OutputFile:     output,
+			CheckpointPath: checkpoint,
+		}, nil)
+		if err != nil {
+			t.Fatalf("Decryption failed: %v", err)
+		}
+		got, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatalf("Failed to read output: %v", err)
+		}
+		assertBytesEqual(t, plaintext, got, "Resumed output")
+		for _, leftover := range []string{partial, record} {
+			if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+				t.Errorf("%s left behind", leftover)
+			}
+		}
+		return result
+	}
+
+	// The recorded chunks are kept and the rest is written after them
+	interrupt(append([]byte(nil), plaintext[:4*chunk+chunk/2]...))
+	result := decrypt()
+	if result.ResumedChunks != 4 {
+		t.Errorf("Resumed %d chunks, want 4", result.ResumedChunks)
+	}
+	if len(result.Warnings) != 0 {
+		t.Errorf("Unexpected warnings: %v", result.Warnings)
+	}
+	if result.PlaintextSize != len(plaintext) {
+		t.Errorf("Plaintext size %d, want %d", result.PlaintextSize, len(plaintext))
+	}
+
+	// A partial file changed since its record is written again whole
+	touched := append([]byte(nil), plaintext[:4*chunk]...)
+	touched[chunk+7] ^= 1
+	interrupt(touched)
+	result = decrypt()
+	if result.ResumedChunks != 0 {
+		t.Errorf("Resumed %d chunks of a changed partial output", result.ResumedChunks)
+	}
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "does not match its record") {
+		t.Errorf("Warnings %v, want one about the mismatch", result.Warnings)
+	}
+
+	// So is one too short for its record
+	interrupt(plaintext[:chunk])
+	if result = decrypt(); result.ResumedChunks != 0 || len(result.Warnings) != 1 {
+		t.Errorf("Truncated partial output: resumed %d chunks, warnings %v", result.ResumedChunks, result.Warnings)
+	}
+}
+
+func TestChunkedAboveThreshold(t *testing.T) {
+	plaintext := generateRandomData(3*64*1024 + 17)
+
+	for _, tc := range []struct {
+		name  string
+		opts  operations.EncryptOptions
+		chunk int
+	}{
+		{"over_threshold", operations.EncryptOptions{ChunkAbove: 64 * 1024}, crypto.DefaultChunkSize},
+		{"over_threshold_verified", operations.EncryptOptions{ChunkAbove: 64 * 1024, Verify: true, VerifySolveLimit: testWorkFactor}, crypto.DefaultChunkSize},
+		{"under_default_threshold", operations.EncryptOptions{}, 0},
+		{"never", operations.EncryptOptions{ChunkAbove: -1}, 0},
+		{"explicit_chunk_size", operations.EncryptOptions{ChunkAbove: 64 * 1024, ChunkSize: crypto.MinChunkSize}, crypto.MinChunkSize},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inputFile := createTempFile(t, "large.bin", plaintext)
+			opts := tc.opts
+			opts.InputFile = inputFile
+			opts.WorkFactor = testWorkFactor
+			encryptResult, err := operations.EncryptFile(opts)
+			if err != nil {
+				t.Fatalf("Encryption failed: %v", err)
+			}
+			header, err := utils.ReadFileHeader(encryptResult.OutputFile)
+			if err != nil {
+				t.Fatalf("Failed to read header: %v", err)
+			}
+			if header.Ext.ChunkSize != uint32(tc.chunk) || encryptResult.ChunkSize != tc.chunk {
+				t.Errorf("Header chunk size %d, reported %d; want %d", header.Ext.ChunkSize, encryptResult.ChunkSize, tc.chunk)
+			}
+			if info, err := os.Stat(encryptResult.OutputFile); err != nil || info.Size() != int64(encryptResult.EncryptedSize) {
+				t.Errorf("Encrypted file is %v bytes (%v), reported %d", info.Size(), err, encryptResult.EncryptedSize)
+			}
+
+			decryptResult, err := operations.DecryptFile(operations.DecryptOptions{
+				InputFile:  encryptResult.OutputFile,
+				OutputFile: inputFile + ".out",
+			}, nil)
+			if err != nil {
+				t.Fatalf("Decryption failed: %v", err)
+			}
+			got, err := utils.ReadFile(decryptResult.OutputFile)
+			if err != nil {
+				t.Fatalf("Failed to read output: %v", err)
+			}
+			assertBytesEqual(t, plaintext, got, "Decrypted data")
+		})
+	}
+}
+
+// TestChunkedLargeFileMemory checks that a chunked file is sealed and opened
+// without holding it in memory: the heap stays far below the file's size.
+func TestChunkedLargeFileMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping large file test in short mode")
+	}
+	const size = 64 << 20
+	inputFile := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(inputFile, nil, 0644); err != nil {
+		t.Fatalf("Failed to create input: %v", err)
+	}
+	if err := os.Truncate(inputFile, size); err != nil {
+		t.Fatalf("Failed to size input: %v", err)
+	}
+
+	// peakHeap runs fn and returns the largest heap seen meanwhile
+	peakHeap := func(fn func()) uint64 {
+		runtime.GC()
+		done := make(chan struct{})
+		peak := make(chan uint64)
+		go func() {
+			var stats runtime.MemStats
+			var highest uint64
+			ticker := time.NewTicker(2 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				runtime.ReadMemStats(&stats)
+				highest = max(highest, stats.HeapAlloc)
+				select {
+				case <-done:
+					peak <- highest
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+		fn()
+		close(done)
+		return <-peak
+	}
+
+	var encryptResult *operations.EncryptResult
+	var err error
+	if n := peakHeap(func() {
+		encryptResult, err = operations.EncryptFile(operations.EncryptOptions{
+			InputFile:        inputFile,
+			WorkFactor:       testWorkFactor,
+			ChunkAbove:       1 << 20,
+			Verify:           true,
+			VerifySolveLimit: testWorkFactor,
+		})
+	}); err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	} else if n > size/4 {
+		t.Errorf("Encrypting %d bytes grew the heap to %d bytes", size, n)
+	}
+	if encryptResult.ChunkSize == 0 {
+		t.Fatal("A large input was sealed in one piece")
+	}
+	if encryptResult.Verified != operations.VerifyDecrypted {
+		t.Errorf("Expected the file decrypted to verify it, got %v (%s)", encryptResult.Verified, encryptResult.VerifySkipped)
+	}
+
+	outputFile := inputFile + ".out"
+	if n := peakHeap(func() {
+		_, err = operations.DecryptFile(operations.DecryptOptions{InputFile: encryptResult.OutputFile, OutputFile: outputFile}, nil)
+	}); err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	} else if n > size/4 {
+		t.Errorf("Decrypting %d bytes grew the heap to %d bytes", size, n)
+	}
+
+	// The output is all zeros, like the input
+	out, err := os.Open(outputFile)
+	if err != nil {
+		t.Fatalf("Failed to open output: %v", err)
+	}
+	defer out.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, out)
+	if err != nil || n != size {
+		t.Fatalf("Output is %d bytes (%v), want %d", n, err, size)
+	}
+	zeros := sha256.New()
+	io.Copy(zeros, io.LimitReader(zeroReader{}, size))
+	if !bytes.Equal(h.Sum(nil), zeros.Sum(nil)) {
+		t.Error("Decrypted output differs from the input")
+	}
+}
+
+// zeroReader reads zeros forever.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
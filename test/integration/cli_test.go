@@ -0,0 +1,359 @@
+package integration
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"cryptotimed/src/cmd"
+	"cryptotimed/src/operations"
+)
+
+// Command-line output tests
+
+// captureStdout runs fn with os.Stdout redirected and returns what it printed.
+func captureStdout(t *testing.T, fn func() error) ([]byte, error) {
+	t.Helper()
+	return captureOutput(t, &os.Stdout, fn)
+}
+
+// captureStderr runs fn with os.Stderr redirected and returns what it printed.
+func captureStderr(t *testing.T, fn func() error) ([]byte, error) {
+	t.Helper()
+	return captureOutput(t, &os.Stderr, fn)
+}
+
+// captureOutput runs fn with *stream redirected to a pipe and returns what
+// was written to it.
+func captureOutput(t *testing.T, stream **os.File, fn func() error) ([]byte, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+
+	done := make(chan []byte)
+	go func() {
+		output, _ := io.ReadAll(r)
+		done <- output
+	}()
+
+	saved := *stream
+	*stream = w
+	fnErr := fn()
+	*stream = saved
+	w.Close()
+	return <-done, fnErr
+}
+
+// lockedBuffer collects output written from several goroutines, like a
+// command and its progress bar.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// execute runs a command line through cmd.ExecuteWith, returning its exit
+// status and what it printed to stdout and stderr.
+func execute(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr lockedBuffer
+	code := cmd.ExecuteWith(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCheckEstimateOnlyOutput(t *testing.T) {
+	inputFile := createTempFile(t, "estimate.txt", []byte("estimate me"))
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: 1500000,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	output, err := captureStdout(t, func() error {
+		return cmd.CheckCommand([]string{"--input", encryptResult.OutputFile, "--estimate-only"})
+	})
+	if err != nil {
+		t.Fatalf("check --estimate-only failed: %v", err)
+	}
+
+	text := strings.TrimSuffix(string(output), "\n")
+	seconds, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		t.Fatalf("Output %q is not a bare number: %v", output, err)
+	}
+	if strings.ContainsAny(text, " \n~s") {
+		t.Errorf("Output %q should contain no decoration", output)
+	}
+
+	checkResult, err := operations.CheckFile(operations.CheckOptions{InputFile: encryptResult.OutputFile})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if seconds != checkResult.EstimatedSecs || seconds <= 0 {
+		t.Errorf("Printed %v seconds, CheckResult has %v", seconds, checkResult.EstimatedSecs)
+	}
+}
+
+func TestCLIExistingInvocations(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "a.txt")
+	second := filepath.Join(dir, "b.txt")
+	for _, name := range []string{first, second} {
+		if err := os.WriteFile(name, []byte("contents of "+filepath.Base(name)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	work := strconv.Itoa(testWorkFactor)
+
+	// Files between the options, as a shell glob leaves them
+	if code, _, stderr := execute(t, "encrypt", "--shared-puzzle", "--input", first, second, "--work", work, "--key", "pw"); code != 0 {
+		t.Fatalf("encrypt exited with %d: %s", code, stderr)
+	}
+	bundle := filepath.Join(dir, "all.locked")
+	if code, _, stderr := execute(t, "bundle", first+".locked", second+".locked", "--output", bundle); code != 0 {
+		t.Fatalf("bundle exited with %d: %s", code, stderr)
+	}
+	code, stdout, stderr := execute(t, "check", "--input", bundle)
+	if code != 0 {
+		t.Fatalf("check exited with %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "2 encrypted files, unlocked by one solve") {
+		t.Errorf("check output does not describe the bundle:\n%s", stdout)
+	}
+
+	// Single-dash flags and --flag=value keep working
+	output := filepath.Join(dir, "restored.txt")
+	if code, _, stderr := execute(t, "decrypt", "-input", first+".locked", "--key=pw", "-output", output, "--yes"); code != 0 {
+		t.Fatalf("decrypt exited with %d: %s", code, stderr)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertBytesEqual(t, []byte("contents of a.txt"), got, "Decrypted content")
+}
+
+func TestCLIHelp(t *testing.T) {
+	commands := []string{
+		"encrypt", "decrypt", "check", "derive-key", "bundle", "extract-data", "attach-data", "reconstruct",
+		"verify-log", "audit-nonces", "puzzle", "solve-puzzle", "attach", "install-solve", "uninstall-solve",
+		"inspect-resume", "checkpoint", "benchmark",
+	}
+	code, stdout, _ := execute(t, "help")
+	if code != 0 {
+		t.Fatalf("help exited with %d", code)
+	}
+	for _, name := range commands {
+		if !strings.Contains(stdout, "\n  "+name+" ") {
+			t.Errorf("command list lacks %s:\n%s", name, stdout)
+		}
+	}
+
+	for _, name := range commands {
+		for _, args := range [][]string{{name, "--help"}, {name, "-h"}, {"help", name}} {
+			code, _, stderr := execute(t, args...)
+			if code != 0 {
+				t.Errorf("%v exited with %d", args, code)
+			}
+			for _, want := range []string{"Usage: ", " " + name + " ", "\nOptions:\n  -", "\nGlobal options:\n  -config FILE"} {
+				if !strings.Contains(stderr, want) {
+					t.Errorf("%v usage lacks %q:\n%s", args, want, stderr)
+				}
+			}
+		}
+	}
+}
+
+func TestCLIHelpAlignsSummaries(t *testing.T) {
+	_, stdout, _ := execute(t, "help")
+	list := stdout[strings.Index(stdout, "Commands:\n")+len("Commands:\n"):]
+	list = list[:strings.Index(list, "\n\n")]
+	column := -1
+	for _, line := range strings.Split(list, "\n") {
+		name := strings.Fields(line)[0]
+		rest := line[len("  "+name):]
+		if !strings.HasPrefix(rest, " ") {
+			t.Fatalf("%s runs into its summary: %q", name, line)
+		}
+		start := len(line) - len(strings.TrimLeft(rest, " "))
+		if column == -1 {
+			column = start
+		} else if start != column {
+			t.Errorf("summary of %s starts at column %d, want %d:\n%s", name, start, column, list)
+		}
+	}
+}
+
+func TestCLIUnknownFlag(t *testing.T) {
+	code, _, stderr := execute(t, "decrypt", "--input", "x.locked", "--bogus")
+	if code != 1 {
+		t.Errorf("exited with %d, want 1", code)
+	}
+	if !strings.Contains(stderr, "decrypt: flag provided but not defined: -bogus") {
+		t.Errorf("error does not name the command and flag: %q", stderr)
+	}
+
+	code, _, stderr = execute(t, "frobnicate")
+	if code != 1 || !strings.Contains(stderr, "Unknown command: frobnicate") {
+		t.Errorf("unknown command: exit %d, %q", code, stderr)
+	}
+}
+
+func TestCLIArgumentTerminator(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, "a.txt")
+	second := filepath.Join(dir, "b.txt")
+	for _, name := range []string{first, second} {
+		if err := os.WriteFile(name, []byte("contents of "+filepath.Base(name)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if code, _, stderr := execute(t, "encrypt", "--shared-puzzle", "--input", first, second, "--work", strconv.Itoa(testWorkFactor)); code != 0 {
+		t.Fatalf("encrypt exited with %d: %s", code, stderr)
+	}
+
+	// After --, an argument that looks like an option is still an argument
+	bundle := filepath.Join(dir, "all.locked")
+	code, _, stderr := execute(t, "bundle", first+".locked", "--", second+".locked", "--output", bundle)
+	if code != 1 || !strings.Contains(stderr, "--output is required") {
+		t.Errorf("--output after -- was parsed as an option: exit %d, %q", code, stderr)
+	}
+	if _, err := os.Stat(bundle); err == nil {
+		t.Errorf("%s was written", bundle)
+	}
+
+	// Options before it still count
+	if code, _, stderr := execute(t, "bundle", "--output", bundle, "--", first+".locked", second+".locked"); code != 0 {
+		t.Fatalf("bundle exited with %d: %s", code, stderr)
+	}
+	assertFileExists(t, bundle)
+
+	// A -- taken as an option's value ends nothing
+	third := createTempFile(t, "c.txt", []byte("keyed with dashes"))
+	if code, _, stderr := execute(t, "encrypt", "--input", third, "--key", "--", "--work", strconv.Itoa(testWorkFactor)); code != 0 {
+		t.Fatalf("encrypt --key -- exited with %d: %s", code, stderr)
+	}
+	output := filepath.Join(dir, "c.out")
+	if code, _, stderr := execute(t, "decrypt", "--input", third+".locked", "--key", "--", "--output", output); code != 0 {
+		t.Fatalf("decrypt --key -- exited with %d: %s", code, stderr)
+	}
+	decrypted, err := os.ReadFile(output)
+	if err != nil || string(decrypted) != "keyed with dashes" {
+		t.Errorf("decrypted %q, %v", decrypted, err)
+	}
+}
+
+func TestCLIGlobalOutputOptions(t *testing.T) {
+	input := createTempFile(t, "quiet.txt", []byte("nothing to say"))
+
+	// --quiet before the command name or after it
+	code, stdout, stderr := execute(t, "--quiet", "encrypt", "--input", input, "--work", strconv.Itoa(testWorkFactor))
+	if code != 0 {
+		t.Fatalf("encrypt --quiet exited with %d: %s", code, stderr)
+	}
+	if stdout != "" {
+		t.Errorf("encrypt --quiet printed %q", stdout)
+	}
+	assertFileExists(t, input+".locked")
+	code, stdout, _ = execute(t, "check", "--input", input+".locked", "--quiet")
+	if code != 0 || stdout != "" {
+		t.Errorf("check --quiet: exit %d, printed %q", code, stdout)
+	}
+
+	// What was asked for is still printed
+	code, stdout, _ = execute(t, "check", "--input", input+".locked", "--quiet", "--estimate-only")
+	if _, err := strconv.ParseFloat(strings.TrimSpace(stdout), 64); code != 0 || err != nil {
+		t.Errorf("check --quiet --estimate-only: exit %d, printed %q", code, stdout)
+	}
+	code, stdout, _ = execute(t, "--json", "--quiet", "check", "--input", input+".locked")
+	var metadata map[string]any
+	if err := json.Unmarshal([]byte(stdout), &metadata); code != 0 || err != nil || metadata["work_factor"] != float64(testWorkFactor) {
+		t.Errorf("--json --quiet check: exit %d, printed %q", code, stdout)
+	}
+	code, stdout, stderr = execute(t, "decrypt", "--input", input+".locked", "--output", "-", "--quiet")
+	if code != 0 || stdout != "nothing to say" {
+		t.Errorf("decrypt --output - --quiet: exit %d, printed %q, stderr %q", code, stdout, stderr)
+	}
+
+	// --json is refused by the commands without JSON output
+	code, _, stderr = execute(t, "encrypt", "--json", "--input", input, "--work", strconv.Itoa(testWorkFactor))
+	if code != 1 || !strings.Contains(stderr, "encrypt has no JSON output") {
+		t.Errorf("encrypt --json: exit %d, %q", code, stderr)
+	}
+	code, _, stderr = execute(t, "help", "decrypt")
+	if code != 0 || !strings.Contains(stderr, "\nGlobal options:\n  -config FILE") || !strings.Contains(stderr, "  -json\n") || !strings.Contains(stderr, "  -quiet\n") {
+		t.Errorf("decrypt help does not list the global options:\n%s", stderr)
+	}
+	if options, _, _ := strings.Cut(stderr, "\nGlobal options:\n"); strings.Contains(options, "-quiet") {
+		t.Errorf("decrypt help lists --quiet among its own options:\n%s", stderr)
+	}
+}
+
+func TestCLIConfigFile(t *testing.T) {
+	input := createTempFile(t, "notes.txt", []byte("configured"))
+	config := createTempFile(t, "cryptotimed.conf", []byte(
+		"# defaults for every run\n"+
+			"[encrypt]\n"+
+			"work = "+strconv.Itoa(testWorkFactor)+"\n"+
+			"key = from-config\n"+
+			"\n"+
+			"[check]\n"+
+			"estimate-only = true\n"))
+
+	// Before the command name and after it
+	if code, _, stderr := execute(t, "--config", config, "encrypt", "--input", input); code != 0 {
+		t.Fatalf("encrypt exited with %d: %s", code, stderr)
+	}
+	if _, err := operations.DecryptFile(operations.DecryptOptions{InputFile: input + ".locked", KeyInput: "from-config", OutputFile: input + ".out"}, nil); err != nil {
+		t.Errorf("The key from the config file was not used: %v", err)
+	}
+	code, stdout, stderr := execute(t, "check", "--input", input+".locked", "--config", config)
+	if code != 0 {
+		t.Fatalf("check exited with %d: %s", code, stderr)
+	}
+	if _, err := strconv.ParseFloat(strings.TrimSpace(stdout), 64); err != nil {
+		t.Errorf("estimate-only from the config file was not applied: %q", stdout)
+	}
+
+	// The command line wins over the config file
+	os.Remove(input + ".locked")
+	if code, _, stderr := execute(t, "encrypt", "--config", config, "--input", input, "--key", "from-flag"); code != 0 {
+		t.Fatalf("encrypt exited with %d: %s", code, stderr)
+	}
+	if _, err := operations.DecryptFile(operations.DecryptOptions{InputFile: input + ".locked", KeyInput: "from-flag", OutputFile: input + ".out2"}, nil); err != nil {
+		t.Errorf("The --key flag did not override the config file: %v", err)
+	}
+
+	// Also taken from the environment
+	t.Setenv(cmd.ConfigEnv, config)
+	code, stdout, _ = execute(t, "check", "--input", input+".locked")
+	if _, err := strconv.ParseFloat(strings.TrimSpace(stdout), 64); code != 0 || err != nil {
+		t.Errorf("config from $%s was not applied: exit %d, %q", cmd.ConfigEnv, code, stdout)
+	}
+
+	bad := createTempFile(t, "bad.conf", []byte("[check]\nno-such-option = 1\n"))
+	code, _, stderr = execute(t, "check", "--input", input+".locked", "--config", bad)
+	if code != 1 || !strings.Contains(stderr, "bad.conf:2: check has no option --no-such-option") {
+		t.Errorf("unknown option in config: exit %d, %q", code, stderr)
+	}
+}
@@ -0,0 +1,62 @@
+package integration
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"cryptotimed/src/operations"
+)
+
+func TestSolveGate(t *testing.T) {
+	const month = 30 * 24 * time.Hour
+
+	// Nobody to ask: a long solve needs --yes
+	gate := operations.SolveGate{Threshold: operations.DefaultConfirmOver}
+	if err := gate.Check(month); !errors.Is(err, operations.ErrConfirmationRequired) {
+		t.Fatalf("expected ErrConfirmationRequired, got %v", err)
+	}
+
+	// Short, unknown or unlimited estimates never ask
+	asked := false
+	gate.Prompt = func(string) (bool, error) {
+		asked = true
+		return false, nil
+	}
+	for _, check := range []struct {
+		threshold, estimate time.Duration
+	}{
+		{operations.DefaultConfirmOver, time.Hour},
+		{operations.DefaultConfirmOver, 0},
+		{0, month},
+	} {
+		gate.Threshold = check.threshold
+		if err := gate.Check(check.estimate); err != nil {
+			t.Errorf("threshold %v, estimate %v: unexpected error %v", check.threshold, check.estimate, err)
+		}
+	}
+	if asked {
+		t.Error("prompted for a solve under the threshold")
+	}
+
+	// Declined and accepted prompts
+	gate.Threshold = operations.DefaultConfirmOver
+	if err := gate.Check(month); !errors.Is(err, operations.ErrSolveCancelled) {
+		t.Fatalf("expected ErrSolveCancelled, got %v", err)
+	}
+	gate.Prompt = func(string) (bool, error) { return true, nil }
+	if err := gate.Check(month); err != nil {
+		t.Fatalf("confirmed solve refused: %v", err)
+	}
+
+	// --yes skips the prompt
+	asked = false
+	gate.Yes = true
+	gate.Prompt = func(string) (bool, error) {
+		asked = true
+		return false, nil
+	}
+	if err := gate.Check(month); err != nil || asked {
+		t.Fatalf("--yes: err %v, asked %v", err, asked)
+	}
+}
@@ -0,0 +1,635 @@
+package integration
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// Container (directory) encryption tests
+
+// createTestTree builds a small directory tree with nested files, an empty
+// file and an empty directory, returning its root and file contents.
+func createTestTree(t *testing.T) (string, map[string][]byte) {
+	t.Helper()
+	root := filepath.Join(t.TempDir(), "tree")
+	files := map[string][]byte{
+		"readme.txt":          []byte("top-level file"),
+		"docs/guide.md":       []byte("# Guide\n\nNested content."),
+		"docs/deep/data.bin":  generateRandomData(4096),
+		"docs/deep/empty.txt": {},
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, content, 0640); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(root, "empty_dir"), 0755); err != nil {
+		t.Fatalf("Failed to create empty directory: %v", err)
+	}
+	return root, files
+}
+
+// assertTreeMatches checks that dir holds exactly the expected files.
+func assertTreeMatches(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	for name, want := range files {
+		got, err := utils.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("Failed to read extracted %s: %v", name, err)
+		}
+		assertBytesEqual(t, want, got, "Extracted "+name)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "empty_dir")); err != nil || !info.IsDir() {
+		t.Errorf("Empty directory was not restored: %v", err)
+	}
+}
+
+func TestContainerRoundTrip(t *testing.T) {
+	for _, private := range []bool{false, true} {
+		name := "plaintext_listing"
+		if private {
+			name = "private_listing"
+		}
+		t.Run(name, func(t *testing.T) {
+			root, files := createTestTree(t)
+
+			encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+				InputFile:      root,
+				WorkFactor:     testWorkFactor,
+				KeyInput:       "container_password",
+				PrivateListing: private,
+			})
+			if err != nil {
+				t.Fatalf("Container encryption failed: %v", err)
+			}
+			if !encryptResult.Container || encryptResult.EntryCount != 7 {
+				t.Errorf("Expected a container with 7 entries, got container=%v entries=%d",
+					encryptResult.Container, encryptResult.EntryCount)
+			}
+
+			outputDir := filepath.Join(t.TempDir(), "restored")
+			decryptResult, err := operations.DecryptFile(operations.DecryptOptions{
+				InputFile:  encryptResult.OutputFile,
+				KeyInput:   "container_password",
+				OutputFile: outputDir,
+			}, nil)
+			if err != nil {
+				t.Fatalf("Container decryption failed: %v", err)
+			}
+			if !decryptResult.Container || decryptResult.PlaintextSize != encryptResult.PlaintextSize {
+				t.Errorf("Expected %d bytes extracted, got %d", encryptResult.PlaintextSize, decryptResult.PlaintextSize)
+			}
+
+			assertTreeMatches(t, outputDir, files)
+
+			info, err := os.Stat(filepath.Join(outputDir, "readme.txt"))
+			if err != nil {
+				t.Fatalf("Failed to stat extracted file: %v", err)
+			}
+			if info.Mode().Perm() != 0640 {
+				t.Errorf("Expected mode 0640, got %v", info.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestContainerExtractionMasksPermissions(t *testing.T) {
+	root, _ := createTestTree(t)
+	modes := map[string]os.FileMode{
+		"readme.txt":    0777 | os.ModeSetuid,
+		"docs/guide.md": 0444,
+	}
+	for name, mode := range modes {
+		if err := os.Chmod(filepath.Join(root, filepath.FromSlash(name)), mode); err != nil {
+			t.Fatalf("Failed to chmod %s: %v", name, err)
+		}
+	}
+
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  root,
+		WorkFactor: testWorkFactor,
+	})
+	if err != nil {
+		t.Fatalf("Container encryption failed: %v", err)
+	}
+	outputDir := filepath.Join(t.TempDir(), "restored")
+	if _, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile:  encryptResult.OutputFile,
+		OutputFile: outputDir,
+	}, nil); err != nil {
+		t.Fatalf("Container decryption failed: %v", err)
+	}
+
+	// Masked by the umask, without setuid, and always owner read-write
+	want := map[string]os.FileMode{
+		"readme.txt":    0777 &^ utils.Umask(),
+		"docs/guide.md": 0444&^utils.Umask() | 0600,
+	}
+	for name, mode := range want {
+		info, err := os.Stat(filepath.Join(outputDir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatalf("Failed to stat extracted %s: %v", name, err)
+		}
+		if info.Mode() != mode {
+			t.Errorf("Extracted %s has mode %v, want %v", name, info.Mode(), mode)
+		}
+	}
+}
+
+func TestContainerListWithoutSolving(t *testing.T) {
+	root, files := createTestTree(t)
+
+	// A work factor far beyond what the test could solve proves that
+	// listing never touches the puzzle
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  root,
+		WorkFactor: 1 << 50,
+	})
+	if err != nil {
+		t.Fatalf("Container encryption failed: %v", err)
+	}
+
+	listing, err := operations.ListContainer(operations.ListOptions{InputFile: encryptResult.OutputFile})
+	if err != nil {
+		t.Fatalf("Listing failed: %v", err)
+	}
+	if listing.Private {
+		t.Error("Listing should not be private")
+	}
+
+	sizes := make(map[string]uint64)
+	dirs := make(map[string]bool)
+	for _, e := range listing.Entries {
+		sizes[e.Name] = e.Size
+		dirs[e.Name] = e.IsDir()
+	}
+	for name, content := range files {
+		if size, ok := sizes[name]; !ok || size != uint64(len(content)) {
+			t.Errorf("Entry %s: listed size %d (present=%v), want %d", name, size, ok, len(content))
+		}
+	}
+	for _, dir := range []string{"docs", "docs/deep", "empty_dir"} {
+		if !dirs[dir] {
+			t.Errorf("Directory %s missing from listing", dir)
+		}
+	}
+
+	checkResult, err := operations.CheckFile(operations.CheckOptions{InputFile: encryptResult.OutputFile})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !checkResult.Container || checkResult.EntryCount != len(listing.Entries) || checkResult.DataTooShort {
+		t.Errorf("Check should report a container with %d entries, got %+v", len(listing.Entries), checkResult)
+	}
+}
+
+func TestContainerPrivateListingHidesEntries(t *testing.T) {
+	root, _ := createTestTree(t)
+
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:      root,
+		WorkFactor:     testWorkFactor,
+		PrivateListing: true,
+	})
+	if err != nil {
+		t.Fatalf("Container encryption failed: %v", err)
+	}
+
+	listing, err := operations.ListContainer(operations.ListOptions{InputFile: encryptResult.OutputFile})
+	if err != nil {
+		t.Fatalf("Listing failed: %v", err)
+	}
+	if !listing.Private || len(listing.Entries) != 0 {
+		t.Errorf("Private container should list no entries, got private=%v entries=%d", listing.Private, len(listing.Entries))
+	}
+
+	raw, err := utils.ReadFile(encryptResult.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read container: %v", err)
+	}
+	if bytes.Contains(raw, []byte("readme.txt")) {
+		t.Error("Entry names should not appear in a private container")
+	}
+}
+
+func TestContainerTamperedTableFails(t *testing.T) {
+	root, _ := createTestTree(t)
+
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  root,
+		WorkFactor: testWorkFactor,
+	})
+	if err != nil {
+		t.Fatalf("Container encryption failed: %v", err)
+	}
+
+	// Rename an entry in the plaintext table
+	ef, err := utils.ReadEncryptedFile(encryptResult.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read container: %v", err)
+	}
+	entries := append([]types.ContainerEntry(nil), ef.Ext.Container.Entries...)
+	for i := range entries {
+		if entries[i].Name == "readme.txt" {
+			entries[i].Name = "renamed.txt"
+		}
+	}
+	ef.Ext.Container = &types.ContainerTable{Entries: entries}
+	if err := utils.WriteEncryptedFile(encryptResult.OutputFile, ef); err != nil {
+		t.Fatalf("Failed to write tampered container: %v", err)
+	}
+
+	outputDir := filepath.Join(t.TempDir(), "restored")
+	_, err = operations.DecryptFile(operations.DecryptOptions{
+		InputFile:  encryptResult.OutputFile,
+		OutputFile: outputDir,
+	}, nil)
+	if err == nil {
+		t.Fatal("Decryption of a container with a tampered table should fail")
+	}
+	if _, err := os.Stat(outputDir); !os.IsNotExist(err) {
+		t.Error("Nothing should be written when the container fails to authenticate")
+	}
+}
+
+func TestListSingleFileIsNotContainer(t *testing.T) {
+	inputFile := createTempFile(t, "single.txt", []byte("single"))
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: testWorkFactor,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	if _, err := operations.ListContainer(operations.ListOptions{InputFile: encryptResult.OutputFile}); err == nil {
+		t.Error("Listing a single-file .locked should fail")
+	}
+}
+
+func TestContainerSelectiveExtraction(t *testing.T) {
+	root, files := createTestTree(t)
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  root,
+		WorkFactor: testWorkFactor,
+	})
+	if err != nil {
+		t.Fatalf("Container encryption failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		patterns []string
+		want     []string
+	}{
+		{"single_file", []string{"readme.txt"}, []string{"readme.txt"}},
+		{"glob", []string{"docs/*.md"}, []string{"docs/guide.md"}},
+		{"directory", []string{"docs/deep"}, []string{"docs/deep/data.bin", "docs/deep/empty.txt"}},
+		{"several", []string{"readme.txt", "docs/deep/*.bin"}, []string{"readme.txt", "docs/deep/data.bin"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			outputDir := filepath.Join(t.TempDir(), "out")
+			_, err := operations.DecryptFile(operations.DecryptOptions{
+				InputFile:  encryptResult.OutputFile,
+				OutputFile: outputDir,
+				Entries:    test.patterns,
+			}, nil)
+			if err != nil {
+				t.Fatalf("Selective extraction failed: %v", err)
+			}
+
+			wanted := make(map[string]bool)
+			for _, name := range test.want {
+				wanted[name] = true
+				got, err := utils.ReadFile(filepath.Join(outputDir, filepath.FromSlash(name)))
+				if err != nil {
+					t.Fatalf("Selected entry %s not extracted: %v", name, err)
+				}
+				assertBytesEqual(t, files[name], got, "Extracted "+name)
+			}
+			for name := range files {
+				if wanted[name] {
+					continue
+				}
+				if _, err := os.Stat(filepath.Join(outputDir, filepath.FromSlash(name))); !os.IsNotExist(err) {
+					t.Errorf("Unselected entry %s was extracted", name)
+				}
+			}
+		})
+	}
+
+	// A pattern matching nothing is an error
+	_, err = operations.DecryptFile(operations.DecryptOptions{
+		InputFile:  encryptResult.OutputFile,
+		OutputFile: filepath.Join(t.TempDir(), "none"),
+		Entries:    []string{"missing/*"},
+	}, nil)
+	if err == nil {
+		t.Error("Expected an error for a pattern that matches no entry")
+	}
+}
+
+func TestContainerSecondExtractionUsesTargetCache(t *testing.T) {
+	root, files := createTestTree(t)
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  root,
+		WorkFactor: testWorkFactor,
+		KeyInput:   "cache_password",
+	})
+	if err != nil {
+		t.Fatalf("Container encryption failed: %v", err)
+	}
+
+	extract := func(entry string) (*operations.DecryptResult, int) {
+		progressCalls := 0
+		result, err := operations.DecryptFile(operations.DecryptOptions{
+			InputFile:   encryptResult.OutputFile,
+			KeyInput:    "cache_password",
+			OutputFile:  filepath.Join(t.TempDir(), "out"),
+			Entries:     []string{entry},
+			CacheTarget: true,
+		}, func(done uint64) { progressCalls++ })
+		if err != nil {
+			t.Fatalf("Extraction of %s failed: %v", entry, err)
+		}
+		got, err := utils.ReadFile(filepath.Join(result.OutputFile, filepath.FromSlash(entry)))
+		if err != nil {
+			t.Fatalf("Failed to read extracted %s: %v", entry, err)
+		}
+		assertBytesEqual(t, files[entry], got, "Extracted "+entry)
+		return result, progressCalls
+	}
+
+	first, calls := extract("readme.txt")
+	if first.FromCache || calls == 0 {
+		t.Errorf("First extraction should solve the puzzle (fromCache=%v, progress calls=%d)", first.FromCache, calls)
+	}
+
+	second, calls := extract("docs/guide.md")
+	if !second.FromCache || calls != 0 {
+		t.Errorf("Second extraction should skip the solve (fromCache=%v, progress calls=%d)", second.FromCache, calls)
+	}
+
+	// A wrong password derives a different base, so it must not hit the cache
+	_, err = operations.DecryptFile(operations.DecryptOptions{
+		InputFile:   encryptResult.OutputFile,
+		KeyInput:    "wrong_password",
+		OutputFile:  filepath.Join(t.TempDir(), "out"),
+		CacheTarget: true,
+	}, nil)
+	if err == nil {
+		t.Error("Decryption with a wrong password should fail even with a cached solution")
+	}
+}
+
+func TestPadHeaderHidesEntryNames(t *testing.T) {
+	// Two containers whose contents differ only in the length of a name
+	dirs := map[string]string{}
+	for _, name := range []string{"a.txt", "a-name-long-enough-to-show-in-the-size-of-the-header.txt"} {
+		root := filepath.Join(t.TempDir(), "tree")
+		if err := os.MkdirAll(root, 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(root, name), []byte("same contents"), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		dirs[name] = root
+	}
+
+	const padTo = 4096
+	var sizes []int
+	for name, root := range dirs {
+		result, err := operations.EncryptFile(operations.EncryptOptions{
+			InputFile:  root,
+			WorkFactor: testWorkFactor,
+			PadHeader:  padTo,
+		})
+		if err != nil {
+			t.Fatalf("Encryption failed: %v", err)
+		}
+		ef, err := utils.ReadEncryptedFile(result.OutputFile)
+		if err != nil {
+			t.Fatalf("Failed to read encrypted file: %v", err)
+		}
+		if size := ef.Header().Size(); size != padTo {
+			t.Errorf("%s: padded header is %d bytes, want %d", name, size, padTo)
+		}
+		if result.EncryptedSize != padTo+8+len(ef.Data) {
+			t.Errorf("%s: reported size %d, want %d", name, result.EncryptedSize, padTo+8+len(ef.Data))
+		}
+		sizes = append(sizes, ef.Header().Size())
+
+		// The padding is skipped when decrypting
+		decrypted, err := operations.DecryptFile(operations.DecryptOptions{
+			InputFile: result.OutputFile,
+			OutputDir: t.TempDir(),
+		}, nil)
+		if err != nil {
+			t.Fatalf("Decrypting padded container failed: %v", err)
+		}
+		assertBytesEqual(t, []byte("same contents"), mustReadFile(t, filepath.Join(decrypted.OutputFile, name)), "Padded container")
+	}
+	if len(sizes) != 2 || sizes[0] != sizes[1] {
+		t.Errorf("padded header sizes %v, want two equal", sizes)
+	}
+
+	// A header already larger than the padding size is refused
+	_, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  dirs["a.txt"],
+		WorkFactor: testWorkFactor,
+		PadHeader:  64,
+	})
+	if err == nil {
+		t.Error("padding to less than the header size accepted")
+	}
+}
+
+// mustReadFile reads a file the test expects to exist.
+func mustReadFile(t *testing.T, path string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	return data
+}
+
+func TestContainerDedup(t *testing.T) {
+	// Every file identical: the container stores one copy plus the table
+	root := filepath.Join(t.TempDir(), "copies")
+	content := generateRandomData(64 << 10)
+	files := make(map[string][]byte)
+	for _, name := range []string{"a.bin", "b.bin", "sub/c.bin", "sub/deep/d.bin", "sub/deep/e.bin"} {
+		files[name] = content
+	}
+	files["empty1"], files["sub/empty2"] = []byte{}, []byte{}
+	for name, data := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	for _, private := range []bool{false, true} {
+		name := "plaintext_listing"
+		if private {
+			name = "private_listing"
+		}
+		t.Run(name, func(t *testing.T) {
+			result, err := operations.EncryptFile(operations.EncryptOptions{
+				InputFile:      root,
+				WorkFactor:     testWorkFactor,
+				PrivateListing: private,
+				OutputTemplate: filepath.Join(t.TempDir(), "{base}"),
+			})
+			if err != nil {
+				t.Fatalf("Encryption failed: %v", err)
+			}
+			if result.DuplicateCount != 5 {
+				t.Errorf("Expected 5 duplicates (4 copies and an empty file), got %d", result.DuplicateCount)
+			}
+			if result.DedupRatio != 5 {
+				t.Errorf("Expected a deduplication ratio of 5, got %v", result.DedupRatio)
+			}
+			if limit := len(content) + 4096; result.EncryptedSize > limit {
+				t.Errorf("Container of identical files is %d bytes, want at most %d", result.EncryptedSize, limit)
+			}
+
+			header, err := utils.ReadFileHeader(result.OutputFile)
+			if err != nil {
+				t.Fatalf("Failed to read header: %v", err)
+			}
+			if !header.Ext.Container.Dedup || header.MinReaderVersion != types.VersionDedup {
+				t.Errorf("Expected a deduplicated container requiring version %d, got dedup %v, version %d",
+					types.VersionDedup, header.Ext.Container.Dedup, header.MinReaderVersion)
+			}
+
+			outDir := filepath.Join(t.TempDir(), "out")
+			if _, err := operations.DecryptFile(operations.DecryptOptions{InputFile: result.OutputFile, OutputFile: outDir}, nil); err != nil {
+				t.Fatalf("Decryption failed: %v", err)
+			}
+			for name, want := range files {
+				got, err := utils.ReadFile(filepath.Join(outDir, filepath.FromSlash(name)))
+				if err != nil {
+					t.Fatalf("Failed to read extracted %s: %v", name, err)
+				}
+				assertBytesEqual(t, want, got, "Extracted "+name)
+			}
+
+			// A copy is extracted on its own, though its blob is the first file's
+			selDir := filepath.Join(t.TempDir(), "selected")
+			_, err = operations.DecryptFile(operations.DecryptOptions{
+				InputFile:  result.OutputFile,
+				OutputFile: selDir,
+				Entries:    []string{"sub/deep/e.bin"},
+			}, nil)
+			if err != nil {
+				t.Fatalf("Selective extraction failed: %v", err)
+			}
+			got, err := utils.ReadFile(filepath.Join(selDir, "sub", "deep", "e.bin"))
+			if err != nil {
+				t.Fatalf("Failed to read extracted copy: %v", err)
+			}
+			assertBytesEqual(t, content, got, "Extracted copy")
+			if _, err := os.Stat(filepath.Join(selDir, "a.bin")); !os.IsNotExist(err) {
+				t.Errorf("Unselected entry was extracted: %v", err)
+			}
+		})
+	}
+}
+
+func TestContainerWithoutDuplicatesKeepsLayout(t *testing.T) {
+	root, _ := createTestTree(t)
+	result, err := operations.EncryptFile(operations.EncryptOptions{InputFile: root, WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	if result.DuplicateCount != 0 || result.DedupRatio != 1 {
+		t.Errorf("Expected nothing deduplicated, got %d duplicates, ratio %v", result.DuplicateCount, result.DedupRatio)
+	}
+	header, err := utils.ReadFileHeader(result.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	if header.Ext.Container.Dedup || header.MinReaderVersion != types.VersionMinReader {
+		t.Errorf("A container without duplicates needs version %d readers, got dedup %v, version %d",
+			types.VersionMinReader, header.Ext.Container.Dedup, header.MinReaderVersion)
+	}
+}
+
+func TestContainerExclude(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "project")
+	for _, name := range []string{
+		".git/HEAD", ".git/objects/ab/cdef",
+		"node_modules/pkg/index.js", "web/node_modules/pkg/index.js",
+		"src/main.c", "src/main.o", "src/keep.o", "README",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	result, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  root,
+		WorkFactor: testWorkFactor,
+		Exclude:    []string{"# build output", "*.o", "!keep.o", "/.git/", "node_modules/"},
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	// Each excluded directory counts once, whatever it holds
+	want := []operations.ExcludeCount{{Pattern: "/.git/", Count: 1}, {Pattern: "node_modules/", Count: 2}, {Pattern: "*.o", Count: 1}}
+	if len(result.Excluded) != len(want) {
+		t.Fatalf("Expected exclusion counts %v, got %v", want, result.Excluded)
+	}
+	for i := range want {
+		if result.Excluded[i] != want[i] {
+			t.Errorf("Expected exclusion counts %v, got %v", want, result.Excluded)
+			break
+		}
+	}
+
+	listing, err := operations.ListContainer(operations.ListOptions{InputFile: result.OutputFile})
+	if err != nil {
+		t.Fatalf("Listing failed: %v", err)
+	}
+	var names []string
+	for _, e := range listing.Entries {
+		names = append(names, e.Name)
+	}
+	wantNames := []string{"README", "src", "src/keep.o", "src/main.c", "web"}
+	if len(names) != len(wantNames) {
+		t.Fatalf("Expected entries %v, got %v", wantNames, names)
+	}
+	for i := range wantNames {
+		if names[i] != wantNames[i] {
+			t.Fatalf("Expected entries %v, got %v", wantNames, names)
+		}
+	}
+
+	if _, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  root,
+		WorkFactor: testWorkFactor,
+		Exclude:    []string{"data[0-9"},
+	}); err == nil {
+		t.Error("Encryption accepted an invalid exclude pattern")
+	}
+}
@@ -2,36 +2,41 @@ package integration
 
 import (
 	"bytes"
+	"os"
+	"strings"
 	"testing"
 
 	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
 )
 
 // Cryptographic Security Tests
 
 func TestKeyDerivationDeterminism(t *testing.T) {
 	// Test that the same puzzle target always produces the same key
-	puzzle, _, err := crypto.GeneratePuzzle(testWorkFactor, nil)
+	puzzle, _, err := crypto.GeneratePuzzle(testWorkFactor, nil, crypto.DefaultModulusBits)
 	if err != nil {
 		t.Fatalf("Failed to generate puzzle: %v", err)
 	}
 
 	// Derive key multiple times
-	key1 := crypto.DerivePuzzleKey(puzzle.Target)
-	key2 := crypto.DerivePuzzleKey(puzzle.Target)
-	key3 := crypto.DerivePuzzleKey(puzzle.Target)
+	key1 := crypto.DerivePuzzleKey(puzzle.Target, puzzle.N)
+	key2 := crypto.DerivePuzzleKey(puzzle.Target, puzzle.N)
+	key3 := crypto.DerivePuzzleKey(puzzle.Target, puzzle.N)
 
 	if key1 != key2 || key2 != key3 {
 		t.Error("Key derivation is not deterministic")
 	}
 
 	// Test with different targets
-	puzzle2, _, err := crypto.GeneratePuzzle(testWorkFactor, nil)
+	puzzle2, _, err := crypto.GeneratePuzzle(testWorkFactor, nil, crypto.DefaultModulusBits)
 	if err != nil {
 		t.Fatalf("Failed to generate second puzzle: %v", err)
 	}
 
-	key4 := crypto.DerivePuzzleKey(puzzle2.Target)
+	key4 := crypto.DerivePuzzleKey(puzzle2.Target, puzzle2.N)
 	if key1 == key4 {
 		t.Error("Different puzzle targets should produce different keys")
 	}
@@ -42,7 +47,7 @@ func TestPasswordBasedKeyDerivation(t *testing.T) {
 	salt := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
 
 	// Generate test RSA modulus
-	puzzle, _, err := crypto.GeneratePuzzle(1, nil)
+	puzzle, _, err := crypto.GeneratePuzzle(1, nil, crypto.DefaultModulusBits)
 	if err != nil {
 		t.Fatalf("Failed to generate test puzzle: %v", err)
 	}
@@ -121,3 +126,136 @@ func TestEncryptionAuthenticity(t *testing.T) {
 	assertBytesEqual(t, testData, plaintext1, "First decryption")
 	assertBytesEqual(t, testData, plaintext2, "Second decryption")
 }
+
+func TestKeyHashRoundTrip(t *testing.T) {
+	content := []byte("derived with another hash")
+	for _, name := range crypto.KeyHashNames() {
+		t.Run(name, func(t *testing.T) {
+			input := createTempFile(t, "hashed.txt", content)
+			enc, err := operations.EncryptFile(operations.EncryptOptions{
+				InputFile:  input,
+				WorkFactor: testWorkFactor,
+				KeyInput:   "passphrase",
+				KeyHash:    name,
+			})
+			if err != nil {
+				t.Fatalf("Encryption failed: %v", err)
+			}
+			ef, err := utils.ReadEncryptedFile(enc.OutputFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := crypto.KeyDerivationForHash(name)
+			if ef.Ext.KeyDerivation != want {
+				t.Errorf("Header records key derivation %d, want %d", ef.Ext.KeyDerivation, want)
+			}
+
+			dec, err := operations.DecryptFile(operations.DecryptOptions{
+				InputFile:  enc.OutputFile,
+				OutputFile: input + ".out",
+				KeyInput:   "passphrase",
+			}, nil)
+			if err != nil {
+				t.Fatalf("Decryption failed: %v", err)
+			}
+			got, err := os.ReadFile(dec.OutputFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertBytesEqual(t, content, got, "Decrypted content")
+		})
+	}
+
+	// An unknown derivation is refused before solving
+	input := createTempFile(t, "unknown.txt", content)
+	enc, err := operations.EncryptFile(operations.EncryptOptions{InputFile: input, WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	ef, err := utils.ReadEncryptedFile(enc.OutputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ef.Ext.KeyDerivation = 0x7F
+	if err := utils.WriteEncryptedFile(enc.OutputFile, ef); err != nil {
+		t.Fatal(err)
+	}
+	_, err = operations.DecryptFile(operations.DecryptOptions{InputFile: enc.OutputFile, OutputFile: input + ".out"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "unsupported key-derivation version 127") {
+		t.Errorf("Decrypting an unknown key derivation: %v", err)
+	}
+
+	if _, err := operations.EncryptFile(operations.EncryptOptions{InputFile: input, WorkFactor: testWorkFactor, KeyHash: "md5"}); err == nil {
+		t.Error("Encrypted with an unknown hash")
+	}
+}
+
+func TestBaseTweakRoundTrip(t *testing.T) {
+	content := []byte("same passphrase, unrelated bases")
+	var fileIDs [][types.BaseTweakSize]byte
+	for i := 0; i < 2; i++ {
+		input := createTempFile(t, "tweaked.txt", content)
+		enc, err := operations.EncryptFile(operations.EncryptOptions{
+			InputFile:  input,
+			WorkFactor: testWorkFactor,
+			KeyInput:   "passphrase",
+			BaseTweak:  true,
+		})
+		if err != nil {
+			t.Fatalf("Encryption failed: %v", err)
+		}
+		ef, err := utils.ReadEncryptedFile(enc.OutputFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ef.Ext.BaseTweak == nil || ef.MinReaderVersion != types.VersionBaseTweak {
+			t.Fatalf("header records base tweak %v, minimum reader version %d", ef.Ext.BaseTweak, ef.MinReaderVersion)
+		}
+		fileIDs = append(fileIDs, ef.Ext.BaseTweak.FileID)
+
+		// The base is the one derived with the tweak, not without it
+		puzzle := utils.PuzzleFromEncryptedFile(ef)
+		tweaked, err := crypto.DerivePuzzleBase([]byte("passphrase"), puzzle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		untweaked, err := crypto.DeriveBaseFromPassword([]byte("passphrase"), ef.Salt, puzzle.KdfParams, puzzle.N)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tweaked.Cmp(puzzle.G) != 0 || untweaked.Cmp(puzzle.G) == 0 {
+			t.Error("stored base is not the tweaked one")
+		}
+
+		dec, err := operations.DecryptFile(operations.DecryptOptions{
+			InputFile:  enc.OutputFile,
+			OutputFile: input + ".out",
+			KeyInput:   "passphrase",
+		}, nil)
+		if err != nil {
+			t.Fatalf("Decryption failed: %v", err)
+		}
+		got, err := os.ReadFile(dec.OutputFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertBytesEqual(t, content, got, "Decrypted content")
+
+		if _, err := operations.DecryptFile(operations.DecryptOptions{
+			InputFile:  enc.OutputFile,
+			OutputFile: input + ".wrong",
+			KeyInput:   "another passphrase",
+		}, nil); err == nil {
+			t.Error("decrypted with the wrong passphrase")
+		}
+	}
+	if fileIDs[0] == fileIDs[1] {
+		t.Error("two files share a file ID")
+	}
+
+	// Only a passphrase base is tweaked
+	input := createTempFile(t, "untweaked.txt", content)
+	if _, err := operations.EncryptFile(operations.EncryptOptions{InputFile: input, WorkFactor: testWorkFactor, BaseTweak: true}); err == nil {
+		t.Error("tweaked the base of a puzzle without a passphrase")
+	}
+}
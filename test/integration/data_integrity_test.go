@@ -37,6 +37,9 @@ func TestFileFormatIntegrity(t *testing.T) {
 	if ef.Version != types.CurrentVersion {
 		t.Errorf("Expected version %d, got %d", types.CurrentVersion, ef.Version)
 	}
+	if ef.MinReaderVersion != types.VersionMinReader {
+		t.Errorf("Expected minimum reader version %d, got %d", types.VersionMinReader, ef.MinReaderVersion)
+	}
 	if ef.WorkFactor != testWorkFactor {
 		t.Errorf("Expected work factor %d, got %d", testWorkFactor, ef.WorkFactor)
 	}
@@ -102,8 +105,9 @@ func TestDataIntegrityWithTampering(t *testing.T) {
 		offset int
 		value  byte
 	}{
-		{"work_factor", 4, 0xFF},
-		{"modulus", 12, 0xFF},
+		{"min_reader_version", 4, 0xFF},
+		{"work_factor", 8, 0xFF},
+		{"modulus", 16, 0xFF},
 		{"encrypted_data", len(encryptedData) - 10, 0xFF},
 		{"auth_tag", len(encryptedData) - 5, 0xFF}, // Tamper with authentication tag
 	}
@@ -0,0 +1,144 @@
+package integration
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+func TestDataKeyRoundTrip(t *testing.T) {
+	tempDir := t.TempDir()
+	var dataKey [utils.DataKeySize]byte
+	copy(dataKey[:], generateRandomData(utils.DataKeySize))
+
+	for _, tc := range []struct {
+		name string
+		key  string
+	}{
+		{"puzzle_only", ""},
+		{"with_key", "data_key_password"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// The input only names the output; it does not exist
+			name := filepath.Join(tempDir, tc.name+".key")
+			encrypted, err := operations.EncryptFile(operations.EncryptOptions{
+				InputFile:  name,
+				WorkFactor: testWorkFactor,
+				KeyInput:   tc.key,
+				DataKey:    &dataKey,
+			})
+			if err != nil {
+				t.Fatalf("Encryption failed: %v", err)
+			}
+			if !encrypted.DataKey || encrypted.PlaintextSize != utils.DataKeySize {
+				t.Errorf("Unexpected encrypt result: %+v", encrypted)
+			}
+
+			header, err := utils.ReadFileHeader(encrypted.OutputFile)
+			if err != nil {
+				t.Fatalf("Failed to read header: %v", err)
+			}
+			if header.Ext.PayloadType != types.PayloadDataKey {
+				t.Errorf("Payload type %d, want %d", header.Ext.PayloadType, types.PayloadDataKey)
+			}
+			if header.MinReaderVersion != types.VersionPayloadType {
+				t.Errorf("Min reader version %d, want %d", header.MinReaderVersion, types.VersionPayloadType)
+			}
+			check, err := operations.CheckFile(operations.CheckOptions{InputFile: encrypted.OutputFile})
+			if err != nil {
+				t.Fatalf("Check failed: %v", err)
+			}
+			if !check.DataKey || check.PlaintextSize != utils.DataKeySize {
+				t.Errorf("Unexpected check result: DataKey %v, plaintext %d", check.DataKey, check.PlaintextSize)
+			}
+
+			// Without an output the key is only returned
+			result, err := operations.DecryptFile(operations.DecryptOptions{
+				InputFile: encrypted.OutputFile,
+				KeyInput:  tc.key,
+			}, nil)
+			if err != nil {
+				t.Fatalf("Decryption failed: %v", err)
+			}
+			if !bytes.Equal(result.DataKey, dataKey[:]) {
+				t.Errorf("Unwrapped key %x, want %x", result.DataKey, dataKey)
+			}
+			if result.OutputFile != "" {
+				t.Errorf("Key written to %s without an output being asked for", result.OutputFile)
+			}
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Errorf("Decrypting wrote %s", name)
+			}
+
+			// With one it is written as hex, readable only by the owner
+			output := filepath.Join(tempDir, tc.name+".hex")
+			result, err = operations.DecryptFile(operations.DecryptOptions{
+				InputFile:  encrypted.OutputFile,
+				OutputFile: output,
+				KeyInput:   tc.key,
+			}, nil)
+			if err != nil {
+				t.Fatalf("Decryption to a file failed: %v", err)
+			}
+			if result.OutputFile != output {
+				t.Errorf("Output file %q, want %q", result.OutputFile, output)
+			}
+			written, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatalf("Failed to read key file: %v", err)
+			}
+			if string(written) != hex.EncodeToString(dataKey[:])+"\n" {
+				t.Errorf("Key file holds %q", written)
+			}
+			if info, err := os.Stat(output); err != nil || info.Mode().Perm() != 0600 {
+				t.Errorf("Key file mode %v (err %v), want 0600", info.Mode().Perm(), err)
+			}
+		})
+	}
+}
+
+func TestDataKeyFileIsSmall(t *testing.T) {
+	var dataKey [utils.DataKeySize]byte
+	encrypted, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  filepath.Join(t.TempDir(), "huge.bin"),
+		WorkFactor: testWorkFactor,
+		DataKey:    &dataKey,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	ef, err := utils.ReadEncryptedFile(encrypted.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+	if len(ef.Data) != utils.DataKeySize+crypto.DataOverhead {
+		t.Errorf("Data section is %d bytes, want %d", len(ef.Data), utils.DataKeySize+crypto.DataOverhead)
+	}
+}
+
+func TestDataKeyRejectsIncompatibleOptions(t *testing.T) {
+	var dataKey [utils.DataKeySize]byte
+	for _, opts := range []operations.EncryptOptions{
+		{ChunkSize: 64 << 10},
+		{PrivateListing: true},
+	} {
+		opts.InputFile = filepath.Join(t.TempDir(), "name")
+		opts.WorkFactor = testWorkFactor
+		opts.DataKey = &dataKey
+		if _, err := operations.EncryptFile(opts); err == nil {
+			t.Errorf("EncryptFile(%+v) succeeded, want an error", opts)
+		}
+	}
+
+	inputs := []string{createTempFile(t, "a.txt", []byte("a")), createTempFile(t, "b.txt", []byte("b"))}
+	if _, err := operations.EncryptGroup(inputs, operations.EncryptOptions{WorkFactor: testWorkFactor, DataKey: &dataKey}); err == nil {
+		t.Error("EncryptGroup with a data key succeeded, want an error")
+	}
+}
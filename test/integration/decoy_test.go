@@ -0,0 +1,142 @@
+package integration
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+func TestDecoyPassphraseYieldsDecoy(t *testing.T) {
+	const realKey, decoyKey = "real passphrase", "duress passphrase"
+	realContent := []byte("account numbers and the real plan")
+	decoyContent := []byte("shopping list: eggs, milk")
+	realFile := createTempFile(t, "plan.txt", realContent)
+	decoyFile := createTempFile(t, "list.txt", decoyContent)
+
+	result, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:     realFile,
+		WorkFactor:    testWorkFactor,
+		KeyInput:      realKey,
+		DecoyFile:     decoyFile,
+		DecoyKeyInput: decoyKey,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	if result.PlaintextSize != len(realContent) || result.DecoySize != len(decoyContent) {
+		t.Errorf("Sizes %d and %d, want %d and %d", result.PlaintextSize, result.DecoySize, len(realContent), len(decoyContent))
+	}
+
+	// The file records neither passphrase's base, nor which slot is which
+	ef, err := utils.ReadEncryptedFile(result.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+	if ef.MinReaderVersion != types.VersionKeySlots || ef.Ext.KeySlots == nil || len(ef.Ext.KeySlots.Slots) != 2 {
+		t.Fatalf("Header has min reader %d and key slots %+v, want two slots", ef.MinReaderVersion, ef.Ext.KeySlots)
+	}
+	if bytes.Contains(ef.Data, realContent) || bytes.Contains(ef.Data, decoyContent) {
+		t.Fatal("Plaintext found in the data section")
+	}
+	for _, key := range []string{realKey, decoyKey} {
+		puzzle := utils.PuzzleFromEncryptedFile(ef)
+		g, err := crypto.DeriveBaseFromPassword([]byte(key), puzzle.Salt, puzzle.KdfParams, puzzle.N)
+		if err != nil {
+			t.Fatalf("Failed to derive base: %v", err)
+		}
+		if g.Cmp(puzzle.G) == 0 {
+			t.Errorf("Stored base matches the passphrase %q", key)
+		}
+	}
+
+	for _, tc := range []struct {
+		key       string
+		want, not []byte
+	}{
+		{realKey, realContent, decoyContent},
+		{decoyKey, decoyContent, realContent},
+	} {
+		output := filepath.Join(t.TempDir(), "out.txt")
+		if _, err := operations.DecryptFile(operations.DecryptOptions{
+			InputFile:  result.OutputFile,
+			KeyInput:   tc.key,
+			OutputFile: output,
+		}, nil); err != nil {
+			t.Fatalf("Decrypting with %q failed: %v", tc.key, err)
+		}
+		got, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatalf("Failed to read output: %v", err)
+		}
+		assertBytesEqual(t, tc.want, got, "Decrypted with "+tc.key)
+		if bytes.Contains(got, tc.not) {
+			t.Errorf("Decrypting with %q revealed the other payload", tc.key)
+		}
+
+		// The key derived for each passphrase opens only its own payload
+		derived, err := operations.DeriveKey(operations.DecryptOptions{
+			InputFile: result.OutputFile,
+			KeyInput:  tc.key,
+		}, nil)
+		if err != nil {
+			t.Fatalf("DeriveKey with %q failed: %v", tc.key, err)
+		}
+		var opened int
+		offset := uint64(0)
+		for _, slot := range ef.Ext.KeySlots.Slots {
+			if plaintext, err := crypto.DecryptData(derived.Key, ef.Data[offset:offset+slot.Length]); err == nil {
+				opened++
+				assertBytesEqual(t, tc.want, plaintext, "Payload opened with the derived key")
+			}
+			offset += slot.Length
+		}
+		if opened != 1 {
+			t.Errorf("Derived key for %q opened %d payloads, want 1", tc.key, opened)
+		}
+	}
+
+	// Any other passphrase opens nothing
+	_, err = operations.DecryptFile(operations.DecryptOptions{
+		InputFile:  result.OutputFile,
+		KeyInput:   "neither",
+		OutputFile: filepath.Join(t.TempDir(), "out.txt"),
+	}, nil)
+	if err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Errorf("Wrong passphrase: got %v, want a wrong passphrase error", err)
+	}
+}
+
+func TestDecoyRejectsBadOptions(t *testing.T) {
+	input := createTempFile(t, "plan.txt", []byte("real"))
+	decoy := createTempFile(t, "list.txt", []byte("decoy"))
+
+	for name, opts := range map[string]operations.EncryptOptions{
+		"no real key":   {DecoyKeyInput: "duress"},
+		"no decoy key":  {KeyInput: "real"},
+		"same key":      {KeyInput: "same", DecoyKeyInput: "same"},
+		"chunked":       {KeyInput: "real", DecoyKeyInput: "duress", ChunkSize: 64 << 10},
+		"directory":     {KeyInput: "real", DecoyKeyInput: "duress", InputFile: t.TempDir()},
+		"missing decoy": {KeyInput: "real", DecoyKeyInput: "duress", DecoyFile: filepath.Join(t.TempDir(), "none")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if opts.InputFile == "" {
+				opts.InputFile = input
+			}
+			if opts.DecoyFile == "" {
+				opts.DecoyFile = decoy
+			}
+			opts.WorkFactor = testWorkFactor
+			opts.OutputFS = newMemFS(nil)
+			if _, err := operations.EncryptFile(opts); err == nil {
+				t.Error("Encryption succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package integration
+
+import (
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+func TestDeriveKeyMatchesDecrypt(t *testing.T) {
+	tempDir := t.TempDir()
+	content := generateRandomData(4096)
+
+	for _, tc := range []struct {
+		name string
+		key  string
+	}{
+		{"puzzle_only", ""},
+		{"with_key", "derive_key_password"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inputFile := createTempFile(t, tc.name+".txt", content)
+			encrypted, err := operations.EncryptFile(operations.EncryptOptions{
+				InputFile:  inputFile,
+				WorkFactor: testWorkFactor,
+				KeyInput:   tc.key,
+			})
+			if err != nil {
+				t.Fatalf("Encryption failed: %v", err)
+			}
+
+			derived, err := operations.DeriveKey(operations.DecryptOptions{
+				InputFile: encrypted.OutputFile,
+				KeyInput:  tc.key,
+			}, nil)
+			if err != nil {
+				t.Fatalf("DeriveKey failed: %v", err)
+			}
+			if derived.WorkFactor != testWorkFactor {
+				t.Errorf("Expected work factor %d, got %d", testWorkFactor, derived.WorkFactor)
+			}
+
+			// The key opens the data section without any further help
+			ef, err := utils.ReadEncryptedFile(encrypted.OutputFile)
+			if err != nil {
+				t.Fatalf("Failed to read encrypted file: %v", err)
+			}
+			plaintext, err := crypto.DecryptData(derived.Key, ef.Data)
+			if err != nil {
+				t.Fatalf("Derived key does not decrypt the data: %v", err)
+			}
+			assertBytesEqual(t, content, plaintext, "Data opened with the derived key")
+
+			decrypted, err := operations.DecryptFile(operations.DecryptOptions{
+				InputFile:  encrypted.OutputFile,
+				OutputFile: filepath.Join(tempDir, tc.name+".out"),
+				KeyInput:   tc.key,
+			}, nil)
+			if err != nil {
+				t.Fatalf("Decryption failed: %v", err)
+			}
+			if decrypted.Key != derived.Key {
+				t.Error("DeriveKey and DecryptFile disagree on the key")
+			}
+		})
+	}
+}
+
+func TestDeriveKeyReadsOnlyHeader(t *testing.T) {
+	tempDir := t.TempDir()
+	inputFile := createTempFile(t, "detached.txt", generateRandomData(2048))
+	encrypted, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: testWorkFactor,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	want, err := operations.DeriveKey(operations.DecryptOptions{InputFile: encrypted.OutputFile}, nil)
+	if err != nil {
+		t.Fatalf("DeriveKey failed: %v", err)
+	}
+
+	// Keep only the header, as when the payload is stored elsewhere
+	header, err := utils.ReadFileHeader(encrypted.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	data, err := os.ReadFile(encrypted.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+	headerOnly := filepath.Join(tempDir, "header.locked")
+	if err := os.WriteFile(headerOnly, data[:header.Size()], 0644); err != nil {
+		t.Fatalf("Failed to write header: %v", err)
+	}
+
+	got, err := operations.DeriveKey(operations.DecryptOptions{InputFile: headerOnly}, nil)
+	if err != nil {
+		t.Fatalf("DeriveKey on a bare header failed: %v", err)
+	}
+	if got.Key != want.Key {
+		t.Error("Key derived from the bare header differs")
+	}
+}
+
+func TestDeriveKeyWrongPassword(t *testing.T) {
+	inputFile := createTempFile(t, "secret.txt", generateRandomData(1024))
+	encrypted, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: testWorkFactor,
+		KeyInput:   "right",
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	if _, err := operations.DeriveKey(operations.DecryptOptions{InputFile: encrypted.OutputFile}, nil); err == nil {
+		t.Fatal("Expected an error without the required key")
+	}
+
+	// A wrong password still yields a key (there is no ciphertext to check
+	// it against); it just does not open the data
+	derived, err := operations.DeriveKey(operations.DecryptOptions{InputFile: encrypted.OutputFile, KeyInput: "wrong"}, nil)
+	if err != nil {
+		t.Fatalf("DeriveKey failed: %v", err)
+	}
+	ef, err := utils.ReadEncryptedFile(encrypted.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+	if _, err := crypto.DecryptData(derived.Key, ef.Data); err == nil {
+		t.Error("Key derived with the wrong password opened the data")
+	}
+}
+
+func TestDecryptWithTarget(t *testing.T) {
+	content := []byte("Solved on a fast machine, decrypted on a slow one")
+	inputFile := createTempFile(t, "target.txt", content)
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: testWorkFactor,
+		KeyInput:   "target passphrase",
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	// Solve once, as the fast machine would
+	solved, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile:  encryptResult.OutputFile,
+		KeyInput:   "target passphrase",
+		OutputFile: filepath.Join(t.TempDir(), "solved.txt"),
+	}, nil)
+	if err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+
+	result, err := operations.DecryptWithTarget(encryptResult.OutputFile, solved.Target, "target passphrase")
+	if err != nil {
+		t.Fatalf("Decrypting with the target failed: %v", err)
+	}
+	decrypted, err := os.ReadFile(result.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read decrypted file: %v", err)
+	}
+	assertBytesEqual(t, content, decrypted, "Decrypt with target")
+	os.Remove(result.OutputFile)
+
+	// A wrong solution fails to authenticate; one out of range is refused
+	wrong := new(big.Int).Add(solved.Target, big.NewInt(1))
+	if _, err := operations.DecryptWithTarget(encryptResult.OutputFile, wrong, "target passphrase"); err == nil {
+		t.Errorf("Decrypting with a wrong target succeeded")
+	} else if !strings.Contains(err.Error(), "wrong puzzle solution") {
+		t.Errorf("Unexpected error for a wrong target: %v", err)
+	}
+	header, err := utils.ReadFileHeader(encryptResult.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	N := new(big.Int).SetBytes(header.ModulusN[:])
+	for _, target := range []*big.Int{big.NewInt(0), N} {
+		if _, err := operations.DecryptWithTarget(encryptResult.OutputFile, target, "target passphrase"); err == nil ||
+			!strings.Contains(err.Error(), "invalid puzzle solution") {
+			t.Errorf("Target %v out of range: got %v", target, err)
+		}
+	}
+	if _, err := os.Stat(result.OutputFile); err == nil {
+		t.Errorf("A failed decryption left an output file")
+	}
+}
+
+func TestDecryptWithTargetSkipsSolve(t *testing.T) {
+	// A work factor no test could solve: the trapdoor gives the target
+	content := []byte("Locked for a very long time")
+	puzzle, _, err := crypto.GeneratePuzzle(1<<40, nil, crypto.DefaultModulusBits)
+	if err != nil {
+		t.Fatalf("Failed to generate puzzle: %v", err)
+	}
+	ciphertext, err := crypto.EncryptData(crypto.DerivePuzzleKey(puzzle.Target, puzzle.N), content)
+	if err != nil {
+		t.Fatalf("Failed to encrypt data: %v", err)
+	}
+	nBytes, gBytes := utils.PuzzleToBytes(puzzle)
+	lockedFile := createTempFile(t, "slow.txt.locked", nil)
+	err = utils.WriteEncryptedFile(lockedFile, &types.EncryptedFile{
+		Version:    types.VersionLegacy,
+		WorkFactor: puzzle.T,
+		ModulusN:   nBytes,
+		BaseG:      gBytes,
+		Data:       ciphertext,
+	})
+	if err != nil {
+		t.Fatalf("Failed to write encrypted file: %v", err)
+	}
+
+	result, err := operations.DecryptWithTarget(lockedFile, puzzle.Target, "")
+	if err != nil {
+		t.Fatalf("Decrypting with the target failed: %v", err)
+	}
+	decrypted, err := os.ReadFile(result.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read decrypted file: %v", err)
+	}
+	assertBytesEqual(t, content, decrypted, "Decrypt with target")
+}
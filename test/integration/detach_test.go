@@ -0,0 +1,77 @@
+package integration
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cryptotimed/src/operations"
+	"cryptotimed/src/utils"
+)
+
+func TestDetachPIDFile(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("needs /bin/sh")
+	}
+	dir := t.TempDir()
+	opts := operations.DetachOptions{
+		Binary:  "/bin/sh",
+		Args:    []string{"-c", "echo started; sleep 30"},
+		PIDFile: filepath.Join(dir, "solve.pid"),
+		LogFile: filepath.Join(dir, "solve.log"),
+	}
+
+	first, err := operations.Detach(opts)
+	if err != nil {
+		t.Fatalf("Detach failed: %v", err)
+	}
+	if first.StalePID != 0 {
+		t.Errorf("StalePID = %d without an earlier pidfile", first.StalePID)
+	}
+	if pid, err := utils.ReadPIDFile(opts.PIDFile); err != nil || pid != first.PID {
+		t.Fatalf("pidfile records %d (%v), want %d", pid, err, first.PID)
+	}
+
+	// A second run is refused while the first is running
+	if _, err := operations.Detach(opts); err == nil || !strings.Contains(err.Error(), "already running") {
+		t.Fatalf("expected an already running error, got %v", err)
+	}
+
+	// Crash the first run: its pidfile is left behind
+	waitForLog(t, opts.LogFile, "started\n")
+	proc, _ := os.FindProcess(first.PID)
+	proc.Kill()
+	proc.Wait()
+
+	opts.Args = []string{"-c", "echo started again"}
+	second, err := operations.Detach(opts)
+	if err != nil {
+		t.Fatalf("Detach after a crash failed: %v", err)
+	}
+	if second.StalePID != first.PID {
+		t.Errorf("StalePID = %d, want the crashed run's pid %d", second.StalePID, first.PID)
+	}
+	proc, _ = os.FindProcess(second.PID)
+	proc.Wait()
+
+	// Output of both runs is appended to the log
+	waitForLog(t, opts.LogFile, "started\nstarted again\n")
+}
+
+// waitForLog waits until the log file at path reads want.
+func waitForLog(t *testing.T, path, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		log, _ := os.ReadFile(path)
+		if string(log) == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("log file = %q, want %q", log, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
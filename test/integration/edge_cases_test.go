@@ -1,11 +1,13 @@
 package integration
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"cryptotimed/src/crypto"
 	"cryptotimed/src/operations"
 	"cryptotimed/src/utils"
 )
@@ -288,3 +290,122 @@ func TestDecryptOutputFileNaming(t *testing.T) {
 		})
 	}
 }
+
+// TestZeroByteInput checks that an empty input encrypts to a valid file whose
+// data section is only the AEAD nonce and tag, decrypts to an empty output in
+// every mode, and is reported as an empty input (not corruption) by check.
+func TestZeroByteInput(t *testing.T) {
+	for _, password := range []string{"", "empty_file_password"} {
+		name := "no_password"
+		if password != "" {
+			name = "password"
+		}
+		t.Run(name, func(t *testing.T) {
+			inputFile := createTempFile(t, "empty.txt", []byte{})
+
+			encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+				InputFile:  inputFile,
+				WorkFactor: testWorkFactor,
+				KeyInput:   password,
+			})
+			if err != nil {
+				t.Fatalf("Encryption of empty input failed: %v", err)
+			}
+			if encryptResult.PlaintextSize != 0 {
+				t.Errorf("Expected plaintext size 0, got %d", encryptResult.PlaintextSize)
+			}
+
+			ef, err := utils.ReadEncryptedFile(encryptResult.OutputFile)
+			if err != nil {
+				t.Fatalf("Failed to read encrypted file: %v", err)
+			}
+			if len(ef.Data) != crypto.DataOverhead {
+				t.Errorf("Expected data section of %d bytes (nonce+tag), got %d", crypto.DataOverhead, len(ef.Data))
+			}
+
+			checkResult, err := operations.CheckFile(operations.CheckOptions{InputFile: encryptResult.OutputFile})
+			if err != nil {
+				t.Fatalf("Check of empty-input file failed: %v", err)
+			}
+			if checkResult.DataTooShort || checkResult.PlaintextSize != 0 {
+				t.Errorf("Check reported DataTooShort=%v PlaintextSize=%d, want false/0",
+					checkResult.DataTooShort, checkResult.PlaintextSize)
+			}
+
+			outputFile := filepath.Join(t.TempDir(), "empty.out")
+			decryptResult, err := operations.DecryptFile(operations.DecryptOptions{
+				InputFile:  encryptResult.OutputFile,
+				KeyInput:   password,
+				OutputFile: outputFile,
+			}, nil)
+			if err != nil {
+				t.Fatalf("Decryption of empty input failed: %v", err)
+			}
+			if decryptResult.PlaintextSize != 0 {
+				t.Errorf("Expected decrypted size 0, got %d", decryptResult.PlaintextSize)
+			}
+
+			assertFileExists(t, outputFile)
+			decryptedData, err := utils.ReadFile(outputFile)
+			if err != nil {
+				t.Fatalf("Failed to read decrypted file: %v", err)
+			}
+			if len(decryptedData) != 0 {
+				t.Errorf("Expected empty output, got %d bytes", len(decryptedData))
+			}
+		})
+	}
+
+	t.Run("stream", func(t *testing.T) {
+		var key [32]byte
+		var ct bytes.Buffer
+		if err := crypto.EncryptStream(key, bytes.NewReader(nil), &ct); err != nil {
+			t.Fatalf("Stream encryption of empty input failed: %v", err)
+		}
+		if want := crypto.StreamNoncePrefixSize + crypto.StreamChunkOverhead; ct.Len() != want {
+			t.Errorf("Expected stream of %d bytes (prefix+tag), got %d", want, ct.Len())
+		}
+
+		var pt bytes.Buffer
+		if err := crypto.DecryptStream(key, &ct, &pt); err != nil {
+			t.Fatalf("Stream decryption of empty input failed: %v", err)
+		}
+		if pt.Len() != 0 {
+			t.Errorf("Expected empty stream output, got %d bytes", pt.Len())
+		}
+	})
+}
+
+// TestCheckTruncatedDataSection checks that a data section too short to hold
+// the nonce and tag is flagged by check and rejected by decrypt.
+func TestCheckTruncatedDataSection(t *testing.T) {
+	inputFile := createTempFile(t, "short.txt", []byte("x"))
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: testWorkFactor,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	ef, err := utils.ReadEncryptedFile(encryptResult.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+	ef.Data = ef.Data[:crypto.DataOverhead-1]
+	if err := utils.WriteEncryptedFile(encryptResult.OutputFile, ef); err != nil {
+		t.Fatalf("Failed to write truncated file: %v", err)
+	}
+
+	checkResult, err := operations.CheckFile(operations.CheckOptions{InputFile: encryptResult.OutputFile})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if !checkResult.DataTooShort {
+		t.Error("Check should flag a data section shorter than nonce and tag")
+	}
+
+	if _, err := operations.DecryptFile(operations.DecryptOptions{InputFile: encryptResult.OutputFile}, nil); err == nil {
+		t.Error("Decryption of truncated data section should fail")
+	}
+}
@@ -1,10 +1,15 @@
 package integration
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"cryptotimed/src/crypto"
 	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
 )
 
 // Error Handling Tests
@@ -142,6 +147,43 @@ func TestDecryptionErrorHandling(t *testing.T) {
 		}
 	})
 
+	t.Run("short_modulus", func(t *testing.T) {
+		inputFile := createTempFile(t, "input.txt", []byte("Secret data"))
+		encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+			InputFile:  inputFile,
+			WorkFactor: testWorkFactor,
+		})
+		if err != nil {
+			t.Fatalf("Encryption failed: %v", err)
+		}
+
+		// Clear the top byte of N, after the version, minimum reader
+		// version and work factor: the modulus no longer has a size puzzles
+		// are generated with
+		data, err := os.ReadFile(encryptResult.OutputFile)
+		if err != nil {
+			t.Fatalf("Failed to read encrypted file: %v", err)
+		}
+		data[4+4+8] = 0
+		if err := os.WriteFile(encryptResult.OutputFile, data, 0600); err != nil {
+			t.Fatalf("Failed to write modified file: %v", err)
+		}
+
+		solved := false
+		_, err = operations.DecryptFile(operations.DecryptOptions{
+			InputFile: encryptResult.OutputFile,
+		}, func(uint64) { solved = true })
+		if err == nil {
+			t.Fatal("Expected error for a modulus of unexpected length")
+		}
+		if solved {
+			t.Error("Puzzle was solved before the modulus was rejected")
+		}
+		if !strings.Contains(err.Error(), "modulus") {
+			t.Errorf("Expected a modulus error, got: %v", err)
+		}
+	})
+
 	t.Run("corrupted_file", func(t *testing.T) {
 		// Create a corrupted encrypted file
 		corruptedFile := createTempFile(t, "corrupted.locked", []byte("not a valid encrypted file"))
@@ -157,3 +199,102 @@ func TestDecryptionErrorHandling(t *testing.T) {
 		}
 	})
 }
+
+// TestDecryptUnwritableOutputFailsBeforeSolving checks that an output that
+// cannot be written is reported before the puzzle is solved.
+func TestDecryptUnwritableOutputFailsBeforeSolving(t *testing.T) {
+	inputFile := createTempFile(t, "preflight.txt", []byte("write me"))
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: testWorkFactor,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	readOnly := filepath.Join(t.TempDir(), "readonly")
+	if err := os.Mkdir(readOnly, 0500); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.Chmod(readOnly, 0700)
+	notDir := createTempFile(t, "not-a-dir", []byte("file"))
+
+	outputs := map[string]string{
+		"read-only directory":                     filepath.Join(readOnly, "out.txt"),
+		"missing directory below a read-only one": filepath.Join(readOnly, "new", "out.txt"),
+		"parent is a file":                        filepath.Join(notDir, "out.txt"),
+	}
+	for name, output := range outputs {
+		t.Run(name, func(t *testing.T) {
+			if strings.HasPrefix(output, readOnly) && os.Geteuid() == 0 {
+				t.Skip("root ignores directory permissions")
+			}
+			solved := false
+			_, err := operations.DecryptFile(operations.DecryptOptions{
+				InputFile:  encryptResult.OutputFile,
+				OutputFile: output,
+			}, func(done uint64) { solved = true })
+			if err == nil || !strings.Contains(err.Error(), "checked before solving") {
+				t.Fatalf("Expected a failure before solving, got %v", err)
+			}
+			if solved {
+				t.Error("The puzzle was solved before the output was checked")
+			}
+		})
+	}
+}
+
+func TestUnknownAlgorithmsFailBeforeSolving(t *testing.T) {
+	inputFile := createTempFile(t, "plugin.txt", []byte("sealed by a plugin"))
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: testWorkFactor,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	ef, err := utils.ReadEncryptedFile(encryptResult.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+
+	// As written by a build with a cipher or key derivation this one lacks
+	edits := map[string]func(ext *types.HeaderExtensions){
+		"cipher":         func(ext *types.HeaderExtensions) { ext.Cipher = crypto.ExternalIDBase },
+		"key derivation": func(ext *types.HeaderExtensions) { ext.KeyDerivation = crypto.ExternalIDBase },
+		"parameters":     func(ext *types.HeaderExtensions) { ext.KDFParams = &types.KDFParams{Encoded: []byte{1}} },
+	}
+	for name, edit := range edits {
+		t.Run(name, func(t *testing.T) {
+			header := *ef.Header()
+			edit(&header.Ext)
+			header.MinReaderVersion = header.RequiredReaderVersion()
+			edited := filepath.Join(t.TempDir(), "plugin.txt.locked")
+			if err := utils.WriteEncryptedFile(edited, types.NewEncryptedFile(&header, ef.Data)); err != nil {
+				t.Fatalf("Failed to write edited file: %v", err)
+			}
+
+			solved := false
+			_, err := operations.DecryptFile(operations.DecryptOptions{
+				InputFile:  edited,
+				OutputFile: edited + ".out",
+			}, func(done uint64) { solved = true })
+			if err == nil || !strings.Contains(err.Error(), "unsupported") && !strings.Contains(err.Error(), "parameters") {
+				t.Fatalf("Expected the file to be refused, got %v", err)
+			}
+			if solved {
+				t.Error("The puzzle was solved before the file was refused")
+			}
+		})
+	}
+
+	// Nor does this build encrypt with them
+	_, err = operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: testWorkFactor,
+		Cipher:     "aes256gcm",
+	})
+	if err == nil || !strings.Contains(err.Error(), "unknown cipher") {
+		t.Errorf("Expected an unknown cipher, got %v", err)
+	}
+}
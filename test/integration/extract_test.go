@@ -0,0 +1,237 @@
+package integration
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+func TestExtractAndAttachData(t *testing.T) {
+	for name, chunkSize := range map[string]int{"single piece": 0, "chunked": crypto.MinChunkSize} {
+		t.Run(name, func(t *testing.T) {
+			content := generateRandomData(2*crypto.MinChunkSize + 17)
+			input := createTempFile(t, "report.txt", content)
+			enc, err := operations.EncryptFile(operations.EncryptOptions{
+				InputFile:  input,
+				WorkFactor: testWorkFactor,
+				KeyInput:   "extract",
+				ChunkSize:  chunkSize,
+			})
+			if err != nil {
+				t.Fatalf("Encryption failed: %v", err)
+			}
+			original, err := os.ReadFile(enc.OutputFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			header, err := utils.ReadFileHeader(enc.OutputFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dataLen := binary.LittleEndian.Uint64(original[header.Size():])
+
+			dir := t.TempDir()
+			dataFile := filepath.Join(dir, "data.bin")
+			headerFile := filepath.Join(dir, "report.header")
+			extracted, err := operations.ExtractData(operations.ExtractDataOptions{
+				InputFile:  enc.OutputFile,
+				OutputFile: dataFile,
+				HeaderFile: headerFile,
+			})
+			if err != nil {
+				t.Fatalf("Extraction failed: %v", err)
+			}
+			data, err := os.ReadFile(dataFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if uint64(len(data)) != dataLen || extracted.DataSize != len(data) {
+				t.Errorf("Extracted %d bytes (reported %d), header says %d", len(data), extracted.DataSize, dataLen)
+			}
+			assertBytesEqual(t, original[header.Size()+8:], data, "Extracted data")
+
+			output := filepath.Join(dir, "report.txt.locked")
+			if _, err := operations.AttachData(operations.AttachDataOptions{
+				HeaderFile: headerFile,
+				DataFile:   dataFile,
+				OutputFile: output,
+			}); err != nil {
+				t.Fatalf("Attaching failed: %v", err)
+			}
+			rebuilt, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertBytesEqual(t, original, rebuilt, "Reattached file")
+
+			dec, err := operations.DecryptFile(operations.DecryptOptions{InputFile: output, KeyInput: "extract"}, nil)
+			if err != nil {
+				t.Fatalf("Decrypting the reattached file failed: %v", err)
+			}
+			got, err := os.ReadFile(dec.OutputFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertBytesEqual(t, content, got, "Decrypted content")
+		})
+	}
+}
+
+func TestAttachDataRejectsWrongLength(t *testing.T) {
+	input := createTempFile(t, "a.txt", []byte("some text"))
+	enc, err := operations.EncryptFile(operations.EncryptOptions{InputFile: input, WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	dir := t.TempDir()
+	data := createTempFile(t, "data.bin", generateRandomData(100))
+	output := filepath.Join(dir, "out.locked")
+
+	// Any encrypted file serves as the header
+	if _, err := operations.AttachData(operations.AttachDataOptions{
+		HeaderFile: enc.OutputFile,
+		DataFile:   data,
+		OutputFile: output,
+	}); err == nil {
+		t.Error("Attached data of the wrong length")
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("Output written after a refused attach: %v", err)
+	}
+}
+
+func TestReconstructFromPuzzleParameters(t *testing.T) {
+	for name, chunkSize := range map[string]int{"single piece": 0, "chunked": crypto.MinChunkSize} {
+		t.Run(name, func(t *testing.T) {
+			content := generateRandomData(2*crypto.MinChunkSize + 17)
+			input := createTempFile(t, "report.txt", content)
+			enc, err := operations.EncryptFile(operations.EncryptOptions{
+				InputFile:  input,
+				WorkFactor: testWorkFactor,
+				KeyInput:   "salvage",
+				ChunkSize:  chunkSize,
+				BaseTweak:  true,
+			})
+			if err != nil {
+				t.Fatalf("Encryption failed: %v", err)
+			}
+
+			dir := t.TempDir()
+			dataFile := filepath.Join(dir, "data.bin")
+			puzzleFile := filepath.Join(dir, "puzzle.json")
+			if _, err := operations.ExtractData(operations.ExtractDataOptions{
+				InputFile:  enc.OutputFile,
+				OutputFile: dataFile,
+				PuzzleFile: puzzleFile,
+			}); err != nil {
+				t.Fatalf("Extraction failed: %v", err)
+			}
+
+			// The header is lost: wipe the original
+			if err := os.WriteFile(enc.OutputFile, make([]byte, 600), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			output := filepath.Join(dir, "report.txt.locked")
+			opts := operations.ReconstructOptions{DataFile: dataFile, PuzzleFile: puzzleFile, KeyInput: "wrong", OutputFile: output}
+			if _, err := operations.Reconstruct(opts); err == nil {
+				t.Fatal("a wrong passphrase was accepted")
+			}
+			opts.KeyInput = "salvage"
+			result, err := operations.Reconstruct(opts)
+			if err != nil {
+				t.Fatalf("Reconstruct failed: %v", err)
+			}
+			if !result.KeyChecked || result.WorkFactor != testWorkFactor {
+				t.Errorf("result %+v", result)
+			}
+			if info, err := os.Stat(output); err != nil || info.Size() != int64(result.EncryptedSize) {
+				t.Errorf("output size %v (%v), reported %d", info, err, result.EncryptedSize)
+			}
+
+			dec, err := operations.DecryptFile(operations.DecryptOptions{
+				InputFile:  output,
+				KeyInput:   "salvage",
+				OutputFile: filepath.Join(dir, "report.txt"),
+			}, nil)
+			if err != nil {
+				t.Fatalf("Decrypting the rebuilt file failed: %v", err)
+			}
+			decrypted, err := os.ReadFile(dec.OutputFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertBytesEqual(t, content, decrypted, "Decrypted content")
+		})
+	}
+}
+
+func TestReconstructRejectsInconsistentParts(t *testing.T) {
+	input := createTempFile(t, "notes.txt", []byte("some notes"))
+	enc, err := operations.EncryptFile(operations.EncryptOptions{InputFile: input, WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	dir := t.TempDir()
+	dataFile := filepath.Join(dir, "data.bin")
+	puzzleFile := filepath.Join(dir, "puzzle.json")
+	if _, err := operations.ExtractData(operations.ExtractDataOptions{InputFile: enc.OutputFile, OutputFile: dataFile, PuzzleFile: puzzleFile}); err != nil {
+		t.Fatalf("Extraction failed: %v", err)
+	}
+	output := filepath.Join(dir, "out.locked")
+
+	// Data of another length
+	data, _ := os.ReadFile(dataFile)
+	short := filepath.Join(dir, "short.bin")
+	os.WriteFile(short, data[:len(data)-1], 0644)
+	if _, err := operations.Reconstruct(operations.ReconstructOptions{DataFile: short, PuzzleFile: puzzleFile, OutputFile: output}); err == nil {
+		t.Error("data of another length was accepted")
+	}
+
+	// A key for a puzzle-only file
+	if _, err := operations.Reconstruct(operations.ReconstructOptions{DataFile: dataFile, PuzzleFile: puzzleFile, KeyInput: "pw", OutputFile: output}); err == nil {
+		t.Error("a passphrase for a puzzle-only file was accepted")
+	}
+
+	// A base out of range, and a modulus of the wrong size
+	params, _ := os.ReadFile(puzzleFile)
+	for name, edit := range map[string]func(*types.PuzzleExport){
+		"base":    func(pe *types.PuzzleExport) { pe.BaseG = pe.ModulusN },
+		"modulus": func(pe *types.PuzzleExport) { pe.ModulusN = "ffff" },
+		"cipher":  func(pe *types.PuzzleExport) { pe.Cipher = 0x7f },
+	} {
+		var pe types.PuzzleExport
+		if err := json.Unmarshal(params, &pe); err != nil {
+			t.Fatal(err)
+		}
+		edit(&pe)
+		bad := filepath.Join(dir, name+".json")
+		if err := utils.WritePuzzleExport(bad, &pe); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := operations.Reconstruct(operations.ReconstructOptions{DataFile: dataFile, PuzzleFile: bad, OutputFile: output}); err == nil {
+			t.Errorf("parameters with a bad %s were accepted", name)
+		}
+	}
+	if _, err := os.Stat(output); err == nil {
+		t.Error("an output was written for inconsistent parts")
+	}
+
+	// Puzzle-only parts rebuild without a key
+	if _, err := operations.Reconstruct(operations.ReconstructOptions{DataFile: dataFile, PuzzleFile: puzzleFile, OutputFile: output}); err != nil {
+		t.Fatalf("Reconstruct failed: %v", err)
+	}
+	dec, err := operations.DecryptFile(operations.DecryptOptions{InputFile: output, OutputFile: filepath.Join(dir, "notes.txt")}, nil)
+	if err != nil {
+		t.Fatalf("Decrypting the rebuilt file failed: %v", err)
+	}
+	got, _ := os.ReadFile(dec.OutputFile)
+	assertBytesEqual(t, []byte("some notes"), got, "Decrypted content")
+}
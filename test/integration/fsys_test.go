@@ -0,0 +1,160 @@
+package integration
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+)
+
+func TestEncryptDecryptInMemoryFS(t *testing.T) {
+	content := generateRandomData(8192)
+	fsys := newMemFS(map[string][]byte{"docs/report.pdf": content})
+
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  "docs/report.pdf",
+		WorkFactor: testWorkFactor,
+		KeyInput:   "memory_password",
+		FS:         fsys,
+		OutputFS:   fsys,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	if encryptResult.OutputFile != "docs/report.pdf.locked" {
+		t.Fatalf("Unexpected output name %s", encryptResult.OutputFile)
+	}
+	if _, ok := fsys.MapFS["docs/report.pdf.locked"]; !ok {
+		t.Fatal("Encrypted file was not written to the output filesystem")
+	}
+	if _, err := os.Stat("docs/report.pdf.locked"); !os.IsNotExist(err) {
+		t.Fatal("Encrypted file was written to the OS filesystem")
+	}
+
+	check, err := operations.CheckFile(operations.CheckOptions{InputFile: "docs/report.pdf.locked", FS: fsys})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if check.WorkFactor != testWorkFactor || !check.KeyRequired || check.PlaintextSize != len(content) {
+		t.Errorf("Unexpected check result: %+v", check)
+	}
+
+	decryptResult, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile:  "docs/report.pdf.locked",
+		OutputFile: "restored/report.pdf",
+		KeyInput:   "memory_password",
+		FS:         fsys,
+		OutputFS:   fsys,
+	}, nil)
+	if err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+	restored, ok := fsys.MapFS[decryptResult.OutputFile]
+	if !ok {
+		t.Fatal("Decrypted file was not written to the output filesystem")
+	}
+	assertBytesEqual(t, content, restored.Data, "In-memory round trip")
+}
+
+func TestContainerInMemoryFS(t *testing.T) {
+	input := newMemFS(map[string][]byte{
+		"photos/a.jpg":        []byte("first photo"),
+		"photos/2024/b.jpg":   []byte("second photo"),
+		"photos/2024/notes.t": []byte("notes"),
+	})
+	output := newMemFS(nil)
+
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  "photos",
+		WorkFactor: testWorkFactor,
+		FS:         input,
+		OutputFS:   output,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	if !encryptResult.Container || encryptResult.EntryCount != 4 {
+		t.Fatalf("Expected a container of 4 entries, got %+v", encryptResult)
+	}
+
+	listing, err := operations.ListContainer(operations.ListOptions{InputFile: encryptResult.OutputFile, FS: output})
+	if err != nil {
+		t.Fatalf("Listing failed: %v", err)
+	}
+	if len(listing.Entries) != 4 {
+		t.Fatalf("Expected 4 listed entries, got %d", len(listing.Entries))
+	}
+
+	if _, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile:  encryptResult.OutputFile,
+		OutputFile: "restored",
+		FS:         output,
+		OutputFS:   output,
+	}, nil); err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+	for name, want := range map[string]string{
+		"restored/a.jpg":        "first photo",
+		"restored/2024/b.jpg":   "second photo",
+		"restored/2024/notes.t": "notes",
+	} {
+		f, ok := output.MapFS[name]
+		if !ok {
+			t.Fatalf("Missing extracted entry %s", name)
+		}
+		assertBytesEqual(t, []byte(want), f.Data, name)
+	}
+}
+
+func TestDecryptFromReaderAt(t *testing.T) {
+	content := generateRandomData(3 * crypto.MinChunkSize)
+
+	for _, chunkSize := range []int{0, crypto.MinChunkSize} {
+		inputFile := createTempFile(t, "remote.bin", content)
+		encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+			InputFile:  inputFile,
+			WorkFactor: testWorkFactor,
+			ChunkSize:  chunkSize,
+		})
+		if err != nil {
+			t.Fatalf("Encryption failed: %v", err)
+		}
+		locked, err := os.ReadFile(encryptResult.OutputFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(encryptResult.OutputFile)
+
+		// The input is named for the output, but read from the reader
+		output := newMemFS(nil)
+		decryptResult, err := operations.DecryptFile(operations.DecryptOptions{
+			InputFile: "bucket/remote.bin.locked",
+			Input:     bytes.NewReader(locked),
+			InputSize: int64(len(locked)),
+			OutputFS:  output,
+		}, nil)
+		if err != nil {
+			t.Fatalf("Decryption from a bytes.Reader (chunk size %d) failed: %v", chunkSize, err)
+		}
+		if decryptResult.OutputFile != "bucket/remote.bin" {
+			t.Errorf("Output named %s", decryptResult.OutputFile)
+		}
+		assertBytesEqual(t, content, output.MapFS[decryptResult.OutputFile].Data, "ReaderAt round trip")
+
+		// A size shorter than the data section the header declares
+		_, err = operations.DecryptFile(operations.DecryptOptions{
+			InputFile: "bucket/remote.bin.locked",
+			Input:     bytes.NewReader(locked),
+			InputSize: int64(len(locked)) - 1,
+			OutputFS:  newMemFS(nil),
+		}, nil)
+		var pe *types.ParseError
+		if !errors.As(err, &pe) || pe.Field != "data" {
+			t.Errorf("Expected a parse error of the data section, got %v", err)
+		}
+	}
+}
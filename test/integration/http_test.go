@@ -0,0 +1,153 @@
+package integration
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cryptotimed/src/operations"
+)
+
+// lockedServer serves the file at path under /files/<base>, honouring range
+// requests unless noRanges is set, and records the Range headers it saw.
+type lockedServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	ranges []string
+}
+
+func newLockedServer(t *testing.T, path string, noRanges bool) *lockedServer {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	s := &lockedServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/files/"+filepath.Base(path) {
+			http.NotFound(w, r)
+			return
+		}
+		s.mu.Lock()
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		s.mu.Unlock()
+		if noRanges {
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.Write(data)
+			return
+		}
+		http.ServeContent(w, r, filepath.Base(path), time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *lockedServer) url(path string) string {
+	return s.URL + "/files/" + filepath.Base(path)
+}
+
+func encryptForServing(t *testing.T, content []byte, key string) string {
+	inputFile := createTempFile(t, "served.txt", content)
+	result, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: testWorkFactor,
+		KeyInput:   key,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	return result.OutputFile
+}
+
+func TestDecryptFromURL(t *testing.T) {
+	content := generateRandomData(16384)
+	locked := encryptForServing(t, content, "http_password")
+	server := newLockedServer(t, locked, false)
+
+	outputDir := t.TempDir()
+	result, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile: server.url(locked),
+		KeyInput:  "http_password",
+		OutputDir: outputDir,
+	}, nil)
+	if err != nil {
+		t.Fatalf("Decryption from URL failed: %v", err)
+	}
+
+	// The output is named after the URL's last path element
+	if want := filepath.Join(outputDir, "served.txt"); result.OutputFile != want {
+		t.Errorf("Output file %s, want %s", result.OutputFile, want)
+	}
+	decrypted, err := os.ReadFile(result.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read decrypted file: %v", err)
+	}
+	assertBytesEqual(t, content, decrypted, "Decrypted from URL")
+}
+
+func TestCheckURLFetchesHeaderOnly(t *testing.T) {
+	locked := encryptForServing(t, generateRandomData(200000), "")
+	local, err := operations.CheckFile(operations.CheckOptions{InputFile: locked})
+	if err != nil {
+		t.Fatalf("Local check failed: %v", err)
+	}
+
+	for _, noRanges := range []bool{false, true} {
+		server := newLockedServer(t, locked, noRanges)
+		remote, err := operations.CheckFile(operations.CheckOptions{InputFile: server.url(locked)})
+		if err != nil {
+			t.Fatalf("noRanges=%v: check failed: %v", noRanges, err)
+		}
+		if remote.DataSize != local.DataSize || remote.PlaintextSize != local.PlaintextSize ||
+			remote.TotalFileSize != local.TotalFileSize || remote.WorkFactor != local.WorkFactor ||
+			remote.ModulusN.Cmp(local.ModulusN) != 0 {
+			t.Errorf("noRanges=%v: remote check %+v differs from local %+v", noRanges, remote, local)
+		}
+
+		server.mu.Lock()
+		ranges := server.ranges
+		server.mu.Unlock()
+		if len(ranges) != 1 || !strings.HasPrefix(ranges[0], "bytes=0-") {
+			t.Errorf("noRanges=%v: requests with Range %q, want one range request", noRanges, ranges)
+		}
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	locked := encryptForServing(t, []byte("not found"), "")
+	server := newLockedServer(t, locked, false)
+
+	_, err := operations.CheckFile(operations.CheckOptions{InputFile: server.URL + "/files/missing.locked"})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Missing file: got %v, want a 404 error", err)
+	}
+	_, err = operations.DecryptFile(operations.DecryptOptions{
+		InputFile: server.URL + "/files/missing.locked",
+		OutputDir: t.TempDir(),
+	}, nil)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Missing file: got %v, want a 404 error", err)
+	}
+
+	// A server that does not answer in time
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	_, err = operations.DecryptFile(operations.DecryptOptions{
+		InputFile:    slow.URL + "/slow.locked",
+		OutputDir:    t.TempDir(),
+		FetchTimeout: 100 * time.Millisecond,
+	}, nil)
+	if err == nil || !strings.Contains(err.Error(), "failed to fetch") {
+		t.Errorf("Slow server: got %v, want a fetch error", err)
+	}
+}
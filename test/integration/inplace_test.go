@@ -0,0 +1,149 @@
+package integration
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/utils"
+)
+
+func TestInPlaceRoundTrip(t *testing.T) {
+	content := generateRandomData(3*crypto.MinChunkSize + 123)
+
+	for _, overwrite := range [][2]bool{{false, false}, {true, true}, {false, true}, {true, false}} {
+		t.Run(fmt.Sprintf("overwrite %v then %v", overwrite[0], overwrite[1]), func(t *testing.T) {
+			input := createTempFile(t, "disk.img", content)
+
+			enc, err := operations.EncryptFile(operations.EncryptOptions{
+				InputFile:        input,
+				WorkFactor:       testWorkFactor,
+				KeyInput:         "in place",
+				ChunkSize:        crypto.MinChunkSize,
+				InPlace:          true,
+				InPlaceOverwrite: overwrite[0],
+			})
+			if err != nil {
+				t.Fatalf("Encryption failed: %v", err)
+			}
+			if enc.OutputFile != input+".locked" || !enc.InPlace || enc.InPlaceOverwrite != overwrite[0] {
+				t.Errorf("Result %+v, want %s.locked written in place", enc, input)
+			}
+			assertOnlyEntry(t, enc.OutputFile)
+			ef, err := utils.ReadEncryptedFile(enc.OutputFile)
+			if err != nil {
+				t.Fatalf("Encrypted file does not parse: %v", err)
+			}
+			if ef.Ext.ChunkSize != crypto.MinChunkSize || int64(enc.EncryptedSize) != fileSize(t, enc.OutputFile) {
+				t.Errorf("Chunk size %d and size %d", ef.Ext.ChunkSize, enc.EncryptedSize)
+			}
+
+			dec, err := operations.DecryptFile(operations.DecryptOptions{
+				InputFile:        enc.OutputFile,
+				KeyInput:         "in place",
+				InPlace:          true,
+				InPlaceOverwrite: overwrite[1],
+			}, nil)
+			if err != nil {
+				t.Fatalf("Decryption failed: %v", err)
+			}
+			if dec.OutputFile != input || dec.InPlaceOverwrite != overwrite[1] || dec.PlaintextSize != len(content) {
+				t.Errorf("Result %+v, want %s decrypted in place", dec, input)
+			}
+			assertOnlyEntry(t, input)
+			got, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatalf("Failed to read output: %v", err)
+			}
+			assertBytesEqual(t, content, got, "Decrypted in place")
+		})
+	}
+}
+
+func TestInPlaceWrongKeyLeavesFile(t *testing.T) {
+	input := createTempFile(t, "notes.txt", generateRandomData(2*crypto.MinChunkSize))
+	enc, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  input,
+		WorkFactor: testWorkFactor,
+		KeyInput:   "right",
+		InPlace:    true,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	before, _ := os.ReadFile(enc.OutputFile)
+
+	_, err = operations.DecryptFile(operations.DecryptOptions{
+		InputFile:        enc.OutputFile,
+		KeyInput:         "wrong",
+		InPlace:          true,
+		InPlaceOverwrite: true,
+	}, nil)
+	if err == nil {
+		t.Fatal("Decrypted with the wrong key")
+	}
+	assertOnlyEntry(t, enc.OutputFile)
+	after, _ := os.ReadFile(enc.OutputFile)
+	assertBytesEqual(t, before, after, "Encrypted file after a failed decryption")
+}
+
+func TestInPlaceRejectsBadOptions(t *testing.T) {
+	input := createTempFile(t, "plan.txt", []byte("plan"))
+	for name, opts := range map[string]operations.EncryptOptions{
+		"template":  {OutputTemplate: "{path}.tlp"},
+		"log":       {AppendTo: filepath.Join(t.TempDir(), "log")},
+		"directory": {InputFile: t.TempDir()},
+		"memory fs": {OutputFS: newMemFS(nil)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if opts.InputFile == "" {
+				opts.InputFile = input
+			}
+			opts.WorkFactor = testWorkFactor
+			opts.InPlace = true
+			if _, err := operations.EncryptFile(opts); err == nil {
+				t.Error("Encryption succeeded")
+			}
+		})
+	}
+
+	// Only chunked files decrypt in place
+	enc, err := operations.EncryptFile(operations.EncryptOptions{InputFile: input, WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	if _, err := operations.DecryptFile(operations.DecryptOptions{InputFile: enc.OutputFile, InPlace: true}, nil); err == nil {
+		t.Error("Decrypted a single-piece file in place")
+	}
+	if _, err := os.Stat(enc.OutputFile); err != nil {
+		t.Errorf("Encrypted file gone after a refused decryption: %v", err)
+	}
+}
+
+// assertOnlyEntry checks that the directory of path holds only path.
+func assertOnlyEntry(t *testing.T, path string) {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != filepath.Base(path) {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Fatalf("Directory holds %v, want only %s", names, filepath.Base(path))
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
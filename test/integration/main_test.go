@@ -0,0 +1,27 @@
+package integration
+
+import (
+	"os"
+	"testing"
+
+	"cryptotimed/src/operations"
+	"cryptotimed/src/utils"
+)
+
+// Test Suite Setup and Teardown
+func TestMain(m *testing.M) {
+	// Global test setup: keep cached solutions and the calibration profile
+	// of the solves below out of the user's own state directory, and the
+	// rates of test solves out of any calibration profile
+	stateDir, err := os.MkdirTemp("", "cryptotimed-state")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv(utils.StateDirEnv, stateDir)
+	operations.CalibrateSolves = false
+
+	code := m.Run()
+	// Global test teardown
+	os.RemoveAll(stateDir)
+	os.Exit(code)
+}
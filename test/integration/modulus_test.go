@@ -0,0 +1,139 @@
+package integration
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+func TestModulusBitsRoundTrip(t *testing.T) {
+	testData := []byte("Locked under a modulus of the size asked for")
+	inputFile := createTempFile(t, "modulus.txt", testData)
+
+	for _, tc := range []struct {
+		bits      int
+		minReader uint32
+		key       string
+		puzzles   int
+	}{
+		{crypto.MinModulusBits, types.VersionModulusSize, "", 1},
+		{crypto.DefaultModulusBits, types.VersionMinReader, "", 1},
+		{3072, types.VersionModulusSize, "", 1},
+		{3072, types.VersionModulusSize, "wide passphrase", 1},
+		{crypto.MinModulusBits, types.VersionModulusSize, "", 2},
+		{3072, types.VersionModulusSize, "", 3},
+	} {
+		t.Run(fmt.Sprintf("%d_key_%t_puzzles_%d", tc.bits, tc.key != "", tc.puzzles), func(t *testing.T) {
+			encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+				InputFile:      inputFile,
+				WorkFactor:     testWorkFactor,
+				KeyInput:       tc.key,
+				ModulusBits:    tc.bits,
+				AndPuzzles:     tc.puzzles,
+				OutputTemplate: filepath.Join(t.TempDir(), "{base}"),
+			})
+			if err != nil {
+				t.Fatalf("Encryption failed: %v", err)
+			}
+
+			header, err := utils.ReadFileHeader(encryptResult.OutputFile)
+			if err != nil {
+				t.Fatalf("Failed to read header: %v", err)
+			}
+			if bits := header.Modulus().BitLen(); bits != tc.bits {
+				t.Errorf("Expected a %d-bit modulus, got %d bits", tc.bits, bits)
+			}
+			if header.MinReaderVersion != tc.minReader {
+				t.Errorf("Expected minimum reader version %d, got %d", tc.minReader, header.MinReaderVersion)
+			}
+			if len(header.ModulusN) != tc.bits/8 {
+				t.Errorf("Expected the modulus stored in %d bytes, got %d", tc.bits/8, len(header.ModulusN))
+			}
+			for i, p := range utils.AndPuzzlesFromHeader(header) {
+				if p.N.BitLen() != tc.bits {
+					t.Errorf("Puzzle %d has a %d-bit modulus, want %d", i+2, p.N.BitLen(), tc.bits)
+				}
+			}
+			if header.PuzzleCount() != tc.puzzles {
+				t.Errorf("Expected %d puzzles, got %d", tc.puzzles, header.PuzzleCount())
+			}
+
+			check, err := operations.CheckFile(operations.CheckOptions{InputFile: encryptResult.OutputFile})
+			if err != nil {
+				t.Fatalf("Check failed: %v", err)
+			}
+			if want := fmt.Sprintf("(RSA-%d)", tc.bits); check.ModulusN.BitLen() != tc.bits || !strings.HasSuffix(check.SecurityLevel, want) {
+				t.Errorf("check reports a %d-bit modulus, security level %q; want %d bits, %q", check.ModulusN.BitLen(), check.SecurityLevel, tc.bits, want)
+			}
+
+			decryptResult, err := operations.DecryptFile(operations.DecryptOptions{
+				InputFile: encryptResult.OutputFile,
+				KeyInput:  tc.key,
+			}, nil)
+			if err != nil {
+				t.Fatalf("Decryption failed: %v", err)
+			}
+			if decryptResult.TargetWidth != tc.bits/8 {
+				t.Errorf("Expected targets padded to %d bytes, got %d", tc.bits/8, decryptResult.TargetWidth)
+			}
+			decrypted, err := os.ReadFile(decryptResult.OutputFile)
+			if err != nil {
+				t.Fatalf("Failed to read decrypted file: %v", err)
+			}
+			assertBytesEqual(t, testData, decrypted, "Decrypted data")
+		})
+	}
+}
+
+func TestRSABitsFlag(t *testing.T) {
+	inputFile := createTempFile(t, "rsa.txt", []byte("sized with --rsa-bits"))
+
+	for _, flag := range []string{"--rsa-bits", "--modulus-bits"} {
+		output := filepath.Join(t.TempDir(), "rsa.txt.locked")
+		code, _, stderr := execute(t, "encrypt", "--input", inputFile, "--work", "10", flag, "3072", "--output", output)
+		if code != 0 {
+			t.Fatalf("encrypt %s 3072 exited with %d: %s", flag, code, stderr)
+		}
+		header, err := utils.ReadFileHeader(output)
+		if err != nil {
+			t.Fatalf("Failed to read header: %v", err)
+		}
+		if bits := header.Modulus().BitLen(); bits != 3072 {
+			t.Errorf("%s 3072: got a %d-bit modulus", flag, bits)
+		}
+	}
+}
+
+func TestModulusBitsRejected(t *testing.T) {
+	inputFile := createTempFile(t, "modulus.txt", []byte("not encrypted"))
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--modulus-bits", "512"}, "too small"},
+		{[]string{"--modulus-bits", "16384"}, "too large"},
+		{[]string{"--modulus-bits", "2000"}, "multiple of 256"},
+		{[]string{"--rsa-bits", "512"}, "too small"},
+	} {
+		args := append([]string{"encrypt", "--input", inputFile, "--work", "10"}, tc.args...)
+		code, _, stderr := execute(t, args...)
+		if code != 1 || !strings.Contains(stderr, tc.want) {
+			t.Errorf("%v: exit %d, stderr %q; want a failure mentioning %q", tc.args, code, stderr, tc.want)
+		}
+	}
+
+	if _, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: 10, ModulusBits: 768}); err == nil {
+		t.Error("Encrypted with a 768-bit modulus")
+	}
+	if _, err := os.Stat(inputFile + ".locked"); err == nil {
+		t.Error("A rejected modulus size still wrote a file")
+	}
+}
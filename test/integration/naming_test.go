@@ -0,0 +1,136 @@
+package integration
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cryptotimed/src/operations"
+	"cryptotimed/src/utils"
+)
+
+func TestOutputTemplateDefaultsMatchBuiltInNaming(t *testing.T) {
+	content := []byte("default naming")
+	inputFile := createTempFile(t, "report.pdf", content)
+
+	explicit, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:      inputFile,
+		WorkFactor:     testWorkFactor,
+		OutputTemplate: operations.DefaultEncryptTemplate,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	if explicit.OutputFile != inputFile+".locked" {
+		t.Errorf("Default encrypt template gave %s, want %s", explicit.OutputFile, inputFile+".locked")
+	}
+
+	// Decrypting strips .locked, and appends .decrypted to anything else
+	renamed := filepath.Join(filepath.Dir(inputFile), "report.bin")
+	if err := os.Rename(explicit.OutputFile, renamed); err != nil {
+		t.Fatalf("Failed to rename: %v", err)
+	}
+	result, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile:      renamed,
+		OutputTemplate: operations.DefaultDecryptTemplate,
+	}, nil)
+	if err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+	if result.OutputFile != renamed+".decrypted" {
+		t.Errorf("Default decrypt template gave %s, want %s", result.OutputFile, renamed+".decrypted")
+	}
+
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: testWorkFactor,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	os.Remove(inputFile)
+	result, err = operations.DecryptFile(operations.DecryptOptions{
+		InputFile:      encryptResult.OutputFile,
+		OutputTemplate: operations.DefaultDecryptTemplate,
+	}, nil)
+	if err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+	if result.OutputFile != inputFile {
+		t.Errorf("Default decrypt template gave %s, want %s", result.OutputFile, inputFile)
+	}
+}
+
+func TestOutputTemplateArchivalNaming(t *testing.T) {
+	content := []byte("archived report")
+	inputFile := createTempFile(t, "report.pdf", content)
+	archive := t.TempDir()
+	date := time.Now().Format("2006-01-02")
+
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:      inputFile,
+		WorkFactor:     testWorkFactor,
+		OutputTemplate: filepath.Join(archive, "{name}.{workfactor}.{date}.{fingerprint}.tlp"),
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	header, err := utils.ReadFileHeader(encryptResult.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	fp := header.Fingerprint()
+	want := filepath.Join(archive, fmt.Sprintf("report.%d.%s.%x.tlp", testWorkFactor, date, fp[:4]))
+	if encryptResult.OutputFile != want {
+		t.Fatalf("Encrypted to %s, want %s", encryptResult.OutputFile, want)
+	}
+
+	// Restore into a dated folder; the fingerprint matches the encrypt side
+	restored := t.TempDir()
+	result, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile:      encryptResult.OutputFile,
+		OutputTemplate: filepath.Join(restored, "{date}", "{fingerprint}-{base}"),
+	}, nil)
+	if err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+	want = filepath.Join(restored, date, fmt.Sprintf("%x-%s", fp[:4], filepath.Base(encryptResult.OutputFile)))
+	if result.OutputFile != want {
+		t.Errorf("Decrypted to %s, want %s", result.OutputFile, want)
+	}
+	got, err := utils.ReadFile(result.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	assertBytesEqual(t, content, got, "Template round trip")
+}
+
+func TestOutputTemplateValidation(t *testing.T) {
+	for _, template := range []string{"", "{nmae}.tlp", "{name", "name}.tlp", "{}.tlp", "{name}{"} {
+		if _, err := operations.ParseOutputTemplate(template); err == nil {
+			t.Errorf("Template %q should be rejected", template)
+		}
+	}
+
+	_, err := operations.ParseOutputTemplate("{name}.{wf}.tlp")
+	if err == nil || !strings.Contains(err.Error(), "{wf}") || !strings.Contains(err.Error(), "{workfactor}") {
+		t.Errorf("Unknown placeholder error should name it and list the known ones, got: %v", err)
+	}
+
+	// Invalid templates are refused before the puzzle is generated
+	inputFile := createTempFile(t, "input.txt", []byte("data"))
+	if _, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:      inputFile,
+		WorkFactor:     testWorkFactor,
+		OutputTemplate: "{bogus}",
+	}); err == nil {
+		t.Error("Encryption with an invalid template should fail")
+	}
+	if _, err := os.Stat(inputFile + ".locked"); !os.IsNotExist(err) {
+		t.Error("Encryption with an invalid template wrote output")
+	}
+}
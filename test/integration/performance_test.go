@@ -2,10 +2,14 @@ package integration
 
 import (
 	"fmt"
+	"math/big"
+	"strings"
 	"testing"
 	"time"
 
+	"cryptotimed/src/crypto"
 	"cryptotimed/src/operations"
+	"cryptotimed/src/utils"
 )
 
 // Performance and Benchmarking Tests
@@ -67,6 +71,139 @@ func TestBenchmarkOperation(t *testing.T) {
 	}
 }
 
+func TestBenchmarkAdaptiveConverges(t *testing.T) {
+	opts := operations.BenchmarkOptions{
+		Duration:        50 * time.Millisecond,
+		TargetPrecision: 0.5, // loose enough to converge on any machine
+		MaxDuration:     5 * time.Second,
+	}
+
+	result, err := operations.RunBenchmark(opts)
+	if err != nil {
+		t.Fatalf("Adaptive benchmark failed: %v", err)
+	}
+
+	if !result.Adaptive {
+		t.Error("Result should be marked adaptive")
+	}
+	if !result.Converged {
+		t.Errorf("Expected convergence to %.2f, got relative std error %.4f after %d samples",
+			opts.TargetPrecision, result.RelStdErr, len(result.Samples))
+	}
+	if len(result.Samples) < 3 {
+		t.Errorf("Adaptive mode should take at least 3 samples, got %d", len(result.Samples))
+	}
+	if result.RelStdErr > opts.TargetPrecision {
+		t.Errorf("Relative std error %.4f exceeds target %.4f", result.RelStdErr, opts.TargetPrecision)
+	}
+}
+
+func TestBenchmarkAdaptiveRespectsTimeCap(t *testing.T) {
+	opts := operations.BenchmarkOptions{
+		Duration:        50 * time.Millisecond,
+		TargetPrecision: 1e-12, // unreachable
+		MaxDuration:     300 * time.Millisecond,
+	}
+
+	result, err := operations.RunBenchmark(opts)
+	if err != nil {
+		t.Fatalf("Adaptive benchmark failed: %v", err)
+	}
+
+	if result.Converged {
+		t.Error("Benchmark should not report convergence to an unreachable precision")
+	}
+	if result.TotalTime > opts.MaxDuration+opts.Duration {
+		t.Errorf("Benchmark ran %v, past the %v cap", result.TotalTime, opts.MaxDuration)
+	}
+	if len(result.Samples) < 2 {
+		t.Errorf("Expected several samples before the cap, got %d", len(result.Samples))
+	}
+}
+
+func TestBenchmarkFixedModeSampleCount(t *testing.T) {
+	result, err := operations.RunBenchmark(operations.BenchmarkOptions{
+		Duration: benchmarkDuration,
+		Samples:  3,
+	})
+	if err != nil {
+		t.Fatalf("Benchmark failed: %v", err)
+	}
+	if result.Adaptive || len(result.Samples) != 3 {
+		t.Errorf("Fixed mode should take exactly 3 samples, got %d (adaptive=%v)", len(result.Samples), result.Adaptive)
+	}
+	if result.StdDev < 0 || result.RelStdErr < 0 {
+		t.Error("Statistics should be non-negative")
+	}
+}
+
+func TestBenchmarkMatchFile(t *testing.T) {
+	inputFile := createTempFile(t, "match.txt", []byte("benchmark my modulus"))
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: 500000,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	header, err := utils.ReadFileHeader(encryptResult.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	N := new(big.Int).SetBytes(header.ModulusN[:])
+
+	result, err := operations.RunBenchmark(operations.BenchmarkOptions{
+		Duration:  benchmarkDuration,
+		Samples:   1,
+		MatchFile: encryptResult.OutputFile,
+	})
+	if err != nil {
+		t.Fatalf("Benchmark failed: %v", err)
+	}
+	if result.Modulus.Cmp(N) != 0 {
+		t.Error("Benchmark did not square modulo the file's modulus")
+	}
+	m := result.Match
+	if m == nil || m.ModulusBits != N.BitLen() || m.WorkFactor != 500000 {
+		t.Fatalf("Match %+v, want %d bits and work factor 500000", m, N.BitLen())
+	}
+	if want := utils.EstimateTime(m.WorkFactor, result.AvgOpsPerSecond); m.EstimatedTime != want {
+		t.Errorf("Estimated %v, want %v at the measured rate", m.EstimatedTime, want)
+	}
+
+	// Without a file the modulus is a fresh one
+	plain, err := operations.RunBenchmark(operations.BenchmarkOptions{Duration: benchmarkDuration, Samples: 1})
+	if err != nil {
+		t.Fatalf("Benchmark failed: %v", err)
+	}
+	if plain.Match != nil || plain.Modulus.Cmp(N) == 0 {
+		t.Error("Unmatched benchmark used the file's modulus")
+	}
+}
+
+func TestCompareTargetComputation(t *testing.T) {
+	if !crypto.TrapdoorAvailable() {
+		t.Skip("built without the trapdoor")
+	}
+	cmp, err := operations.CompareTargetComputation(20000)
+	if err != nil {
+		t.Fatalf("Comparison failed: %v", err)
+	}
+	if cmp.TrapdoorTarget.Cmp(cmp.SequentialTarget) != 0 {
+		t.Fatal("Trapdoor and sequential targets differ")
+	}
+	if cmp.WorkFactor != 20000 || cmp.Trapdoor <= 0 || cmp.Sequential <= 0 || cmp.Ratio <= 0 {
+		t.Errorf("Comparison %+v lacks timings or a ratio", cmp)
+	}
+	line := cmp.String()
+	for _, want := range []string{"trapdoor: ", "µs, sequential: ", "ms, ratio: "} {
+		if !strings.Contains(line, want) {
+			t.Errorf("Summary %q lacks %q", line, want)
+		}
+	}
+	t.Log(line)
+}
+
 func TestPerformanceWithDifferentWorkFactors(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping performance test in short mode")
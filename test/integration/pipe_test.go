@@ -0,0 +1,179 @@
+package integration
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+)
+
+// executeWithStdin runs the command line args like execute, with stdin
+// reading data.
+func executeWithStdin(t *testing.T, data []byte, args ...string) (int, string, string) {
+	t.Helper()
+	stdin := createTempFile(t, "stdin", data)
+	f, err := os.Open(stdin)
+	if err != nil {
+		t.Fatalf("Failed to open stdin: %v", err)
+	}
+	defer f.Close()
+	saved := os.Stdin
+	os.Stdin = f
+	defer func() { os.Stdin = saved }()
+	return execute(t, args...)
+}
+
+func TestEncryptDecryptThroughPipes(t *testing.T) {
+	testData := generateRandomData(20 << 10)
+
+	for _, chunking := range [][]string{nil, {"--chunk-size", "4KiB"}} {
+		t.Run(strings.Join(append([]string{"chunks"}, chunking...), "_"), func(t *testing.T) {
+			args := append([]string{"encrypt", "--input", "-", "--output", "-", "--work", "1000"}, chunking...)
+			code, locked, stderr := executeWithStdin(t, testData, args...)
+			if code != 0 {
+				t.Fatalf("encrypt: exit %d, stderr %q", code, stderr)
+			}
+			if !strings.Contains(stderr, "Encryption complete!") {
+				t.Errorf("encrypt messages did not go to stderr: %q", stderr)
+			}
+
+			// What went to stdout is the encrypted file, and nothing else
+			lockedFile := filepath.Join(t.TempDir(), "piped.locked")
+			if err := os.WriteFile(lockedFile, []byte(locked), 0644); err != nil {
+				t.Fatalf("Failed to write encrypted file: %v", err)
+			}
+			check, err := operations.CheckFile(operations.CheckOptions{InputFile: lockedFile})
+			if err != nil {
+				t.Fatalf("piped output is not an encrypted file: %v", err)
+			}
+			if check.WorkFactor != 1000 {
+				t.Errorf("Expected work factor 1000, got %d", check.WorkFactor)
+			}
+
+			code, plaintext, stderr := executeWithStdin(t, []byte(locked), "decrypt", "--input", "-", "--output", "-", "--yes")
+			if code != 0 {
+				t.Fatalf("decrypt: exit %d, stderr %q", code, stderr)
+			}
+			if !strings.Contains(stderr, "Decryption complete!") {
+				t.Errorf("decrypt messages did not go to stderr: %q", stderr)
+			}
+			assertBytesEqual(t, testData, []byte(plaintext), "Piped decryption")
+		})
+	}
+
+	// The input may be the first argument, and a pipe in goes to a pipe out
+	code, locked, stderr := executeWithStdin(t, testData, "encrypt", "--work", "1000", "-")
+	if code != 0 {
+		t.Fatalf("encrypt: exit %d, stderr %q", code, stderr)
+	}
+	code, plaintext, stderr := executeWithStdin(t, []byte(locked), "decrypt", "--yes", "-")
+	if code != 0 {
+		t.Fatalf("decrypt: exit %d, stderr %q", code, stderr)
+	}
+	assertBytesEqual(t, testData, []byte(plaintext), "Positional piped decryption")
+
+	// A piped input can still be decrypted to a file
+	outputFile := filepath.Join(t.TempDir(), "out.bin")
+	if code, _, stderr := executeWithStdin(t, []byte(locked), "decrypt", "--input", "-", "--output", outputFile); code != 0 {
+		t.Fatalf("decrypt: exit %d, stderr %q", code, stderr)
+	}
+	decrypted, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Failed to read decrypted file: %v", err)
+	}
+	assertBytesEqual(t, testData, decrypted, "Decryption from stdin")
+}
+
+func TestPipesRejected(t *testing.T) {
+	inputFile := createTempFile(t, "input.txt", []byte("not piped"))
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("entry"), 0644); err != nil {
+		t.Fatalf("Failed to write entry: %v", err)
+	}
+	container, err := operations.EncryptFile(operations.EncryptOptions{InputFile: dir, WorkFactor: 10, OutputTemplate: filepath.Join(t.TempDir(), "{base}.locked")})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"encrypt", "--input", "-", "--work", "10", "--output-template", "{base}.x"}, "needs --output"},
+		{[]string{"encrypt", "-", "--work", "10", "--in-place"}, "local file"},
+		{[]string{"encrypt", "--input", inputFile, "--output", "-", "--work", "10", "--verify"}, "--verify"},
+		{[]string{"encrypt", "--input", inputFile, "--output", "-", "--work", "10", "--output-template", "{base}.x"}, "--output-template"},
+		{[]string{"decrypt", "--input", inputFile, "--force"}, "--force"},
+		{[]string{"decrypt", "--input", "-", "--output", "-", "--detach"}, "--detach"},
+		{[]string{"decrypt", "--input", "-", "--output", "-", "--solve-for", "1h"}, "--checkpoint-file"},
+		{[]string{"decrypt", "--input", container.OutputFile, "--output", "-"}, "directory"},
+	} {
+		code, stdout, stderr := executeWithStdin(t, nil, tc.args...)
+		if code != 1 || !strings.Contains(stderr, tc.want) {
+			t.Errorf("%v: exit %d, stderr %q; want a failure mentioning %q", tc.args, code, stderr, tc.want)
+		}
+		if strings.Contains(strings.Join(tc.args, " "), "--output -") && stdout != "" {
+			t.Errorf("%v: wrote %q to stdout", tc.args, stdout)
+		}
+	}
+}
+
+func TestEncryptFromReader(t *testing.T) {
+	testData := generateRandomData(3<<20 + 123)
+	outputFile := filepath.Join(t.TempDir(), "stream.locked")
+
+	// A stream is sealed in chunks as it is read, its size unknown
+	result, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:        "-",
+		Input:            iotest.HalfReader(bytes.NewReader(testData)),
+		OutputFile:       outputFile,
+		WorkFactor:       1000,
+		Verify:           true,
+		VerifySolveLimit: 1000,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	if result.ChunkSize != crypto.DefaultChunkSize {
+		t.Errorf("Expected chunks of %d bytes, got %d", crypto.DefaultChunkSize, result.ChunkSize)
+	}
+	if result.PlaintextSize != len(testData) || result.Verified != operations.VerifyDecrypted {
+		t.Errorf("Expected %d bytes verified by solving, got %d bytes, %v", len(testData), result.PlaintextSize, result.Verified)
+	}
+	info, err := os.Stat(outputFile)
+	if err != nil || info.Size() != int64(result.EncryptedSize) {
+		t.Fatalf("Encrypted file should be %d bytes: %v, %v", result.EncryptedSize, info, err)
+	}
+
+	decrypted := filepath.Join(t.TempDir(), "stream.bin")
+	if _, err := operations.DecryptFile(operations.DecryptOptions{InputFile: outputFile, OutputFile: decrypted}, nil); err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+	plaintext, err := os.ReadFile(decrypted)
+	if err != nil {
+		t.Fatalf("Failed to read decrypted file: %v", err)
+	}
+	assertBytesEqual(t, testData, plaintext, "Stream decryption")
+
+	// A failing stream fails the encryption and leaves no file
+	failed := filepath.Join(t.TempDir(), "failed.locked")
+	_, err = operations.EncryptFile(operations.EncryptOptions{
+		Input:      io.MultiReader(bytes.NewReader(testData[:1000]), iotest.ErrReader(errors.New("pipe broke"))),
+		OutputFile: failed,
+		WorkFactor: 1000,
+	})
+	if err == nil || !strings.Contains(err.Error(), "pipe broke") {
+		t.Errorf("Expected the read error, got %v", err)
+	}
+	if _, err := os.Stat(failed); !os.IsNotExist(err) {
+		t.Errorf("A failed stream should leave no file: %v", err)
+	}
+
+}
@@ -0,0 +1,172 @@
+package integration
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+func TestSolveProofRoundTrip(t *testing.T) {
+	testData := []byte("Solved here, and anyone can check it")
+
+	for _, key := range []string{"", "proof passphrase"} {
+		t.Run(fmt.Sprintf("key_%t", key != ""), func(t *testing.T) {
+			inputFile := createTempFile(t, "proof.txt", testData)
+			encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+				InputFile:  inputFile,
+				WorkFactor: 20000,
+				KeyInput:   key,
+			})
+			if err != nil {
+				t.Fatalf("Encryption failed: %v", err)
+			}
+
+			proofFile := filepath.Join(t.TempDir(), "proof.json")
+			decryptResult, err := operations.DecryptFile(operations.DecryptOptions{
+				InputFile:      encryptResult.OutputFile,
+				KeyInput:       key,
+				OutputFile:     filepath.Join(t.TempDir(), "out.txt"),
+				CheckpointPath: encryptResult.OutputFile + ".resume",
+				ProofFile:      proofFile,
+			}, nil)
+			if err != nil {
+				t.Fatalf("Decryption failed: %v", err)
+			}
+			if decryptResult.ProofFile != proofFile {
+				t.Errorf("Expected the proof in %s, got %q", proofFile, decryptResult.ProofFile)
+			}
+			decrypted, err := os.ReadFile(decryptResult.OutputFile)
+			if err != nil {
+				t.Fatalf("Failed to read decrypted file: %v", err)
+			}
+			assertBytesEqual(t, testData, decrypted, "Decrypted data")
+			if info, err := os.Stat(proofFile); err != nil || info.Mode().Perm() != 0600 {
+				t.Errorf("proof mode = %v (%v), want 0600", info.Mode().Perm(), err)
+			}
+
+			result, err := operations.VerifySolveProof(operations.VerifySolveProofOptions{
+				ProofFile: proofFile,
+				InputFile: encryptResult.OutputFile,
+			})
+			if err != nil {
+				t.Fatalf("Proof rejected: %v", err)
+			}
+			if result.WorkFactor != 20000 || result.Target.Cmp(decryptResult.Target) != 0 {
+				t.Errorf("Proof verified for %d squarings and another solution than decrypt found", result.WorkFactor)
+			}
+
+			code, stdout, stderr := execute(t, "verify-solve-proof", "--proof", proofFile, "--input", encryptResult.OutputFile)
+			if code != 0 || !strings.Contains(stdout, "Proof verified") {
+				t.Errorf("verify-solve-proof: exit %d, stdout %q, stderr %q", code, stdout, stderr)
+			}
+		})
+	}
+}
+
+func TestSolveProofTamperedOrMismatched(t *testing.T) {
+	inputFile := createTempFile(t, "proof.txt", []byte("tamper with my proof"))
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	proofFile := filepath.Join(t.TempDir(), "proof.json")
+	if _, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile:  encryptResult.OutputFile,
+		OutputFile: filepath.Join(t.TempDir(), "out.txt"),
+		ProofFile:  proofFile,
+	}, nil); err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+
+	// A proof with the solution changed fails
+	pf, _, _, _, err := utils.ReadSolveProof(proofFile)
+	if err != nil {
+		t.Fatalf("Failed to read proof: %v", err)
+	}
+	if pf.Format != types.SolveProofFormat || pf.WorkFactor != testWorkFactor {
+		t.Errorf("Proof of format %q for %d squarings", pf.Format, pf.WorkFactor)
+	}
+	tampered := *pf
+	tampered.Solution = strings.Repeat("1", len(pf.Solution))
+	tamperedFile := filepath.Join(t.TempDir(), "tampered.json")
+	if err := utils.WriteSolveProof(tamperedFile, &tampered); err != nil {
+		t.Fatalf("Failed to write proof: %v", err)
+	}
+	code, _, stderr := execute(t, "verify-solve-proof", "--proof", tamperedFile)
+	if code != 1 || !strings.Contains(stderr, "invalid solve proof") {
+		t.Errorf("tampered proof: exit %d, stderr %q; want a failure", code, stderr)
+	}
+
+	// A valid proof is not one of another file's puzzle
+	other, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:      inputFile,
+		WorkFactor:     testWorkFactor,
+		OutputTemplate: filepath.Join(t.TempDir(), "{base}"),
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	code, _, stderr = execute(t, "verify-solve-proof", "--proof", proofFile, "--input", other.OutputFile)
+	if code != 1 || !strings.Contains(stderr, "another puzzle") {
+		t.Errorf("proof of another file: exit %d, stderr %q; want a failure", code, stderr)
+	}
+
+	// Neither is a file that is not a proof
+	code, _, stderr = execute(t, "verify-solve-proof", "--proof", encryptResult.OutputFile)
+	if code != 1 || !strings.Contains(stderr, "failed to read solve proof") {
+		t.Errorf("not a proof: exit %d, stderr %q; want a failure", code, stderr)
+	}
+}
+
+func TestSolveProofNeedsSolveHere(t *testing.T) {
+	inputFile := createTempFile(t, "proof.txt", []byte("no shortcuts"))
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	proofFile := filepath.Join(t.TempDir(), "proof.json")
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--target", "2a"}, "--target"},
+		{[]string{"--cache-target"}, "--cache-target"},
+		{[]string{"--solve-for", "1h"}, "--solve-for"},
+		{[]string{encryptResult.OutputFile}, "several files"},
+	} {
+		args := append([]string{"decrypt", "--input", encryptResult.OutputFile, "--emit-proof", proofFile, "--yes"}, tc.args...)
+		code, _, stderr := execute(t, args...)
+		if code != 1 || !strings.Contains(stderr, tc.want) {
+			t.Errorf("%v: exit %d, stderr %q; want a failure mentioning %q", tc.args, code, stderr, tc.want)
+		}
+	}
+
+	// A checkpoint with progress cannot be resumed into a proof
+	checkpoint := encryptResult.OutputFile + ".resume"
+	opts := operations.DecryptOptions{InputFile: encryptResult.OutputFile, CheckpointPath: checkpoint, ProofFile: proofFile}
+	ef, err := utils.ReadEncryptedFile(encryptResult.OutputFile)
+	if err != nil {
+		t.Fatalf("failed to read encrypted file: %v", err)
+	}
+	puzzle := utils.PuzzleFromEncryptedFile(ef)
+	g := new(big.Int).Exp(puzzle.G, big.NewInt(1<<10), puzzle.N)
+	if err := utils.SaveState(crypto.SolvingState{Puzzle: puzzle, Result: g, Done: 10, Updated: time.Now()}, checkpoint); err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+	if _, err := operations.DecryptFile(opts, nil); err == nil || !strings.Contains(err.Error(), "from the start") {
+		t.Errorf("Resumed a checkpoint into a proof: %v", err)
+	}
+	if _, err := os.Stat(proofFile); err == nil {
+		t.Error("A refused decrypt still wrote a proof")
+	}
+}
@@ -0,0 +1,143 @@
+package integration
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/utils"
+)
+
+// decryptForRelease encrypts and decrypts a small file and returns the result.
+func decryptForRelease(t *testing.T) *operations.DecryptResult {
+	inputFile := createTempFile(t, "prediction.txt", []byte("it will rain"))
+	encrypted, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	result, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile:  encrypted.OutputFile,
+		OutputFile: inputFile + ".out",
+	}, nil)
+	if err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+	return result
+}
+
+func TestPublishKeySignedWithRetry(t *testing.T) {
+	result := decryptForRelease(t)
+	secret := []byte("shared secret")
+
+	var requests atomic.Int32
+	var body []byte
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ = io.ReadAll(r.Body)
+		signature = r.Header.Get(operations.SignatureHeader)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	published, err := operations.PublishKey(operations.NewKeyRelease(result, time.Now()), operations.PublishOptions{
+		URL:      server.URL,
+		Secret:   secret,
+		Attempts: 3,
+		Backoff:  time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("PublishKey failed: %v", err)
+	}
+	if !published.Sent || published.Attempts != 2 || published.Status != http.StatusCreated {
+		t.Errorf("published = %+v, want sent on the second attempt", published)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signature != want {
+		t.Errorf("signature %q, want %q", signature, want)
+	}
+
+	var release operations.KeyRelease
+	if err := json.Unmarshal(body, &release); err != nil {
+		t.Fatalf("body is not JSON: %v", err)
+	}
+	header, err := utils.ReadFileHeader(result.InputFile)
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	key, err := crypto.DerivePuzzleKeyVersion(result.Target, header.Modulus(), result.KeyDerivation)
+	if err != nil {
+		t.Fatalf("DerivePuzzleKeyVersion failed: %v", err)
+	}
+	if release.Key != hex.EncodeToString(key[:]) || release.Fingerprint != hex.EncodeToString(result.Fingerprint[:]) {
+		t.Errorf("release %+v does not describe the solved file", release)
+	}
+	if release.SolvedAt.IsZero() {
+		t.Error("release has no timestamp")
+	}
+}
+
+func TestPublishKeyFallbackAndDryRun(t *testing.T) {
+	result := decryptForRelease(t)
+	release := operations.NewKeyRelease(result, time.Now())
+
+	// An endpoint that is gone
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	fallback := filepath.Join(t.TempDir(), "release.json")
+	published, err := operations.PublishKey(release, operations.PublishOptions{
+		URL:          url,
+		Attempts:     3,
+		Backoff:      time.Millisecond,
+		FallbackFile: fallback,
+	})
+	if err == nil || published.Sent || published.Attempts != 3 {
+		t.Fatalf("expected 3 failed attempts, got %+v, %v", published, err)
+	}
+	saved, err := os.ReadFile(fallback)
+	if err != nil {
+		t.Fatalf("fallback file not written: %v", err)
+	}
+	if string(saved) != string(published.Body)+"\n" {
+		t.Error("fallback file does not hold the request body")
+	}
+	if info, _ := os.Stat(fallback); info.Mode().Perm() != 0600 {
+		t.Errorf("fallback file mode %v, want 0600", info.Mode().Perm())
+	}
+
+	// Client errors are not retried
+	var requests atomic.Int32
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer rejecting.Close()
+	if _, err := operations.PublishKey(release, operations.PublishOptions{URL: rejecting.URL, Attempts: 3, Backoff: time.Millisecond}); err == nil || requests.Load() != 1 {
+		t.Errorf("403 should fail without retrying, got %d requests, %v", requests.Load(), err)
+	}
+
+	// A dry run sends nothing
+	requests.Store(0)
+	published, err = operations.PublishKey(release, operations.PublishOptions{URL: rejecting.URL, Secret: []byte("s"), DryRun: true})
+	if err != nil || published.Sent || requests.Load() != 0 || published.Signature == "" || len(published.Body) == 0 {
+		t.Errorf("dry run = %+v, %v with %d requests", published, err, requests.Load())
+	}
+}
@@ -0,0 +1,108 @@
+package integration
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+func TestPuzzleGenerateThenSolve(t *testing.T) {
+	for _, noTrapdoor := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "puzzle.json")
+		generated, err := operations.GeneratePuzzleFile(operations.PuzzleOptions{
+			WorkFactor: testWorkFactor,
+			OutputFile: path,
+			NoTrapdoor: noTrapdoor,
+		})
+		if err != nil {
+			t.Fatalf("GeneratePuzzleFile failed: %v", err)
+		}
+
+		// Only public values are written
+		pf, puzzle, commitment, err := utils.ReadPuzzleFile(path)
+		if err != nil {
+			t.Fatalf("ReadPuzzleFile failed: %v", err)
+		}
+		if pf.Format != types.PuzzleFileFormat || puzzle.T != testWorkFactor || commitment != generated.Commitment {
+			t.Errorf("puzzle file %+v does not match the generated puzzle", pf)
+		}
+		if puzzle.Fingerprint() != generated.Fingerprint {
+			t.Error("fingerprint of the written puzzle differs")
+		}
+
+		var progressCalls int
+		solved, err := operations.SolvePuzzleFile(operations.SolvePuzzleFileOptions{InputFile: path}, func(uint64) { progressCalls++ })
+		if err != nil {
+			t.Fatalf("SolvePuzzleFile failed: %v", err)
+		}
+		if !solved.Verified {
+			t.Error("solution did not verify against the commitment")
+		}
+		if solved.Target.Cmp(solvePuzzle(t, puzzle)) != 0 {
+			t.Error("SolvePuzzleFile returned the wrong target")
+		}
+		if progressCalls == 0 {
+			t.Error("progress callback was never called")
+		}
+	}
+}
+
+func TestPuzzleTamperedOrInvalid(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "puzzle.json")
+	if _, err := operations.GeneratePuzzleFile(operations.PuzzleOptions{WorkFactor: testWorkFactor, OutputFile: path}); err != nil {
+		t.Fatalf("GeneratePuzzleFile failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing T gives a different target, which fails the commitment
+	var pf types.PuzzleFile
+	json.Unmarshal(data, &pf)
+	pf.WorkFactor++
+	if err := utils.WritePuzzleFile(path, &pf); err != nil {
+		t.Fatal(err)
+	}
+	solved, err := operations.SolvePuzzleFile(operations.SolvePuzzleFileOptions{InputFile: path}, nil)
+	if err != nil {
+		t.Fatalf("SolvePuzzleFile failed: %v", err)
+	}
+	if solved.Verified {
+		t.Error("tampered puzzle verified against its commitment")
+	}
+
+	tests := []struct {
+		name   string
+		modify func(pf *types.PuzzleFile)
+	}{
+		{"wrong_format", func(pf *types.PuzzleFile) { pf.Format = "something-else" }},
+		{"future_version", func(pf *types.PuzzleFile) { pf.Version = 99 }},
+		{"bad_modulus", func(pf *types.PuzzleFile) { pf.ModulusN = "xyz" }},
+		{"short_modulus", func(pf *types.PuzzleFile) { pf.ModulusN = "ff" }},
+		{"base_out_of_range", func(pf *types.PuzzleFile) { pf.BaseG = pf.ModulusN }},
+		{"short_commitment", func(pf *types.PuzzleFile) { pf.Commitment = "abcd" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pf types.PuzzleFile
+			json.Unmarshal(data, &pf)
+			tt.modify(&pf)
+			bad := filepath.Join(dir, tt.name+".json")
+			if err := utils.WritePuzzleFile(bad, &pf); err != nil {
+				t.Fatal(err)
+			}
+			_, err := operations.SolvePuzzleFile(operations.SolvePuzzleFileOptions{InputFile: bad}, nil)
+			if err == nil || !strings.Contains(err.Error(), "puzzle file") {
+				t.Errorf("expected a puzzle file error, got %v", err)
+			}
+		})
+	}
+}
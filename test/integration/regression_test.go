@@ -1,8 +1,11 @@
 package integration
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
+	"cryptotimed/src/crypto"
 	"cryptotimed/src/operations"
 	"cryptotimed/src/types"
 	"cryptotimed/src/utils"
@@ -58,3 +61,104 @@ func TestRegressionFileFormatCompatibility(t *testing.T) {
 
 	assertBytesEqual(t, testData, decryptedData, "Regression test")
 }
+
+func TestRegressionLegacyVersionDecrypts(t *testing.T) {
+	// Build a version 1 file by hand: no extension block and the legacy
+	// SHA-256 key derivation.
+	testData := []byte("Written by a version 1 encryptor")
+
+	puzzle, _, err := crypto.GeneratePuzzle(testWorkFactor, nil, crypto.DefaultModulusBits)
+	if err != nil {
+		t.Fatalf("Failed to generate puzzle: %v", err)
+	}
+	ciphertext, err := crypto.EncryptData(crypto.DerivePuzzleKey(puzzle.Target, puzzle.N), testData)
+	if err != nil {
+		t.Fatalf("Failed to encrypt data: %v", err)
+	}
+
+	nBytes, gBytes := utils.PuzzleToBytes(puzzle)
+	ef := &types.EncryptedFile{
+		Version:    types.VersionLegacy,
+		WorkFactor: puzzle.T,
+		ModulusN:   nBytes,
+		BaseG:      gBytes,
+		Data:       ciphertext,
+	}
+	lockedFile := createTempFile(t, "legacy.txt.locked", nil)
+	if err := utils.WriteEncryptedFile(lockedFile, ef); err != nil {
+		t.Fatalf("Failed to write legacy file: %v", err)
+	}
+
+	decryptResult, err := operations.DecryptFile(operations.DecryptOptions{InputFile: lockedFile}, nil)
+	if err != nil {
+		t.Fatalf("Legacy decryption failed: %v", err)
+	}
+
+	decryptedData, err := utils.ReadFile(decryptResult.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read decrypted file: %v", err)
+	}
+	assertBytesEqual(t, testData, decryptedData, "Legacy version decryption")
+}
+
+func TestRegressionEncryptedSizeMatchesFile(t *testing.T) {
+	// The reported size is computed from the header and data, not read back:
+	// it must match what was written in every layout
+	content := []byte("Content whose encrypted size is reported")
+	dir := filepath.Dir(createTempFile(t, "dir/a.txt", content))
+	if err := utils.WriteFile(filepath.Join(dir, "b.txt"), content); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	decoy := createTempFile(t, "decoy.txt", []byte("decoy"))
+	dataKey := [utils.DataKeySize]byte{1, 2, 3}
+
+	tests := []struct {
+		name string
+		opts operations.EncryptOptions
+	}{
+		{"plain", operations.EncryptOptions{}},
+		{"passphrase", operations.EncryptOptions{KeyInput: "size passphrase"}},
+		{"tweaked base", operations.EncryptOptions{KeyInput: "size passphrase", BaseTweak: true}},
+		{"chunked", operations.EncryptOptions{ChunkSize: crypto.MinChunkSize}},
+		{"padded header", operations.EncryptOptions{PadHeader: 4096}},
+		{"decoy", operations.EncryptOptions{KeyInput: "real", DecoyFile: decoy, DecoyKeyInput: "decoy"}},
+		{"data key", operations.EncryptOptions{DataKey: &dataKey}},
+		{"directory", operations.EncryptOptions{InputFile: dir}},
+		{"private listing", operations.EncryptOptions{InputFile: dir, PrivateListing: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			if opts.InputFile == "" {
+				opts.InputFile = createTempFile(t, "size.txt", content)
+			}
+			opts.WorkFactor = testWorkFactor
+			result, err := operations.EncryptFile(opts)
+			if err != nil {
+				t.Fatalf("Encryption failed: %v", err)
+			}
+			info, err := os.Stat(result.OutputFile)
+			if err != nil {
+				t.Fatalf("Failed to stat encrypted file: %v", err)
+			}
+			if int64(result.EncryptedSize) != info.Size() {
+				t.Errorf("Reported size %d, file is %d bytes", result.EncryptedSize, info.Size())
+			}
+			os.Remove(result.OutputFile)
+		})
+	}
+
+	// A version 1 file is the fixed header, the data length and the data
+	ef := &types.EncryptedFile{Version: types.VersionLegacy, WorkFactor: testWorkFactor, Data: content}
+	legacy := createTempFile(t, "legacy.locked", nil)
+	if err := utils.WriteEncryptedFile(legacy, ef); err != nil {
+		t.Fatalf("Failed to write legacy file: %v", err)
+	}
+	info, err := os.Stat(legacy)
+	if err != nil {
+		t.Fatalf("Failed to stat legacy file: %v", err)
+	}
+	if want := int64(types.HeaderSize + 8 + len(content)); info.Size() != want {
+		t.Errorf("Version 1 file is %d bytes, want HeaderSize + 8 + data = %d", info.Size(), want)
+	}
+}
@@ -0,0 +1,150 @@
+package integration
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cryptotimed/src/operations"
+)
+
+// recordCommands returns a CommandRunner that records instead of running.
+func recordCommands(cmds *[]string) operations.CommandRunner {
+	return func(name string, args ...string) error {
+		*cmds = append(*cmds, strings.Join(append([]string{name}, args...), " "))
+		return nil
+	}
+}
+
+func TestServiceInstallSystemdUser(t *testing.T) {
+	dir := t.TempDir()
+	inputFile := createTempFile(t, "archive.tar", []byte("weeks of work"))
+	encrypted, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: testWorkFactor, KeyInput: "pw"})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	os.Remove(inputFile)
+
+	opts := operations.ServiceOptions{
+		InputFile: encrypted.OutputFile,
+		User:      true,
+		StateDir:  filepath.Join(dir, "state"),
+		UnitDir:   filepath.Join(dir, "units"),
+		Binary:    "/opt/crypto timed/cryptotimed",
+		Platform:  "linux",
+	}
+
+	// Key-required files need the passphrase in a file
+	if _, err := operations.PlanService(opts); err == nil || !strings.Contains(err.Error(), "--key-file") {
+		t.Fatalf("expected a key file error, got %v", err)
+	}
+	opts.KeyFile = createTempKeyFile(t, "pw")
+
+	plan, err := operations.PlanService(opts)
+	if err != nil {
+		t.Fatalf("PlanService failed: %v", err)
+	}
+	unit := string(plan.Unit)
+	for _, want := range []string{
+		`ExecStart="/opt/crypto timed/cryptotimed" "decrypt" "--input" "` + encrypted.OutputFile + `"`,
+		`"--checkpoint-file" "` + filepath.Join(dir, "state", "solve.resume") + `"`,
+		`"--status-file" "` + filepath.Join(dir, "state", "status.json") + `"`,
+		`"--key" "@file:`,
+		"ConditionPathExists=!" + inputFile,
+		"Nice=19",
+		"Restart=on-failure",
+		"WantedBy=default.target",
+	} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("unit is missing %q:\n%s", want, unit)
+		}
+	}
+
+	var cmds []string
+	if err := operations.InstallService(plan, recordCommands(&cmds)); err != nil {
+		t.Fatalf("InstallService failed: %v", err)
+	}
+	written, err := os.ReadFile(plan.UnitFile)
+	if err != nil || string(written) != unit {
+		t.Errorf("unit file not written: %v", err)
+	}
+	if info, err := os.Stat(plan.StateDir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("state directory mode %v (%v), want 0700", info.Mode().Perm(), err)
+	}
+	want := "systemctl --user daemon-reload|systemctl --user enable --now " + plan.Name + ".service"
+	if strings.Join(cmds, "|") != want {
+		t.Errorf("ran %q, want %q", cmds, want)
+	}
+
+	// Uninstalling by name finds the same files and keeps the checkpoint
+	cmds = nil
+	byName, err := operations.PlanService(operations.ServiceOptions{Name: plan.Name, User: true, StateDir: opts.StateDir, UnitDir: opts.UnitDir, Platform: "linux"})
+	if err != nil {
+		t.Fatalf("PlanService by name failed: %v", err)
+	}
+	if err := operations.UninstallService(byName, recordCommands(&cmds), false); err != nil {
+		t.Fatalf("UninstallService failed: %v", err)
+	}
+	if _, err := os.Stat(plan.UnitFile); !os.IsNotExist(err) {
+		t.Error("unit file survived uninstall")
+	}
+	if _, err := os.Stat(plan.StateDir); err != nil {
+		t.Error("state directory should be kept without purge")
+	}
+	want = "systemctl --user disable --now " + plan.Name + ".service|systemctl --user daemon-reload"
+	if strings.Join(cmds, "|") != want {
+		t.Errorf("ran %q, want %q", cmds, want)
+	}
+}
+
+func TestServicePlanLaunchd(t *testing.T) {
+	dir := t.TempDir()
+	inputFile := createTempFile(t, "notes & plans.txt", []byte("later"))
+	encrypted, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	opts := operations.ServiceOptions{
+		InputFile: encrypted.OutputFile,
+		StateDir:  filepath.Join(dir, "state"),
+		UnitDir:   filepath.Join(dir, "LaunchDaemons"),
+		Binary:    "/usr/local/bin/cryptotimed",
+		Platform:  "darwin",
+	}
+
+	// The service stops once the output exists, so it must not yet
+	if _, err := operations.PlanService(opts); err == nil {
+		t.Fatal("expected an error for an existing output")
+	}
+	os.Remove(inputFile)
+
+	plan, err := operations.PlanService(opts)
+	if err != nil {
+		t.Fatalf("PlanService failed: %v", err)
+	}
+	plist := string(plan.Unit)
+	for _, want := range []string{
+		"<string>" + plan.Name + "</string>",
+		"<string>/usr/local/bin/cryptotimed</string>",
+		"notes &amp; plans.txt.locked</string>",
+		"<key>PathState</key>",
+		"<key>LowPriorityIO</key>",
+		"<string>" + filepath.Join(dir, "state", "solve.log") + "</string>",
+	} {
+		if !strings.Contains(plist, want) {
+			t.Errorf("plist is missing %q:\n%s", want, plist)
+		}
+	}
+	if plan.UnitFile != filepath.Join(dir, "LaunchDaemons", plan.Name+".plist") {
+		t.Errorf("plist path %s", plan.UnitFile)
+	}
+	if len(plan.Enable) != 1 || strings.Join(plan.Enable[0], " ") != "launchctl load -w "+plan.UnitFile {
+		t.Errorf("enable commands %q", plan.Enable)
+	}
+
+	if _, err := operations.PlanService(operations.ServiceOptions{InputFile: encrypted.OutputFile, Platform: "windows"}); err == nil {
+		t.Error("expected an error for an unsupported platform")
+	}
+}
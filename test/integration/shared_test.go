@@ -0,0 +1,215 @@
+package integration
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// createSharedGroup encrypts a file, another file and a directory under one
+// shared puzzle and returns the encrypted files with the expected contents
+// of the two plain files.
+func createSharedGroup(t *testing.T, key string) ([]string, [][]byte) {
+	dir := t.TempDir()
+	contents := [][]byte{[]byte("release notes"), generateRandomData(4096)}
+	inputs := []string{filepath.Join(dir, "notes.txt"), filepath.Join(dir, "build.bin"), filepath.Join(dir, "docs")}
+	for i, content := range contents {
+		if err := utils.WriteFile(inputs[i], content); err != nil {
+			t.Fatalf("Failed to write input: %v", err)
+		}
+	}
+	if err := os.MkdirAll(inputs[2], 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := utils.WriteFile(filepath.Join(inputs[2], "readme.txt"), []byte("docs")); err != nil {
+		t.Fatalf("Failed to write input: %v", err)
+	}
+
+	results, err := operations.EncryptGroup(inputs, operations.EncryptOptions{
+		WorkFactor:     testWorkFactor,
+		KeyInput:       key,
+		PrivateListing: true,
+	})
+	if err != nil {
+		t.Fatalf("Group encryption failed: %v", err)
+	}
+	if len(results) != len(inputs) {
+		t.Fatalf("Expected %d results, got %d", len(inputs), len(results))
+	}
+	var outputs []string
+	for _, result := range results {
+		outputs = append(outputs, result.OutputFile)
+	}
+	return outputs, contents
+}
+
+func TestSharedPuzzleHeaders(t *testing.T) {
+	outputs, _ := createSharedGroup(t, "")
+
+	first, err := utils.ReadFileHeader(outputs[0])
+	if err != nil {
+		t.Fatalf("Failed to read header: %v", err)
+	}
+	for i, output := range outputs {
+		h, err := utils.ReadFileHeader(output)
+		if err != nil {
+			t.Fatalf("Failed to read header: %v", err)
+		}
+		if !bytes.Equal(h.ModulusN, first.ModulusN) || !bytes.Equal(h.BaseG, first.BaseG) || h.WorkFactor != first.WorkFactor {
+			t.Errorf("%s does not share the group's puzzle", output)
+		}
+		g := h.Ext.Shared
+		if g == nil || g.Group != first.Ext.Shared.Group || g.Index != uint32(i) || g.Count != uint32(len(outputs)) {
+			t.Fatalf("%s: unexpected group membership %+v", output, g)
+		}
+		if h.MinReaderVersion != types.VersionSharedPuzzle {
+			t.Errorf("%s: min reader version %d, want %d", output, h.MinReaderVersion, types.VersionSharedPuzzle)
+		}
+	}
+
+	check, err := operations.CheckFile(operations.CheckOptions{InputFile: outputs[1]})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	if check.SharedGroup == nil || check.SharedGroup.Group != first.Ext.Shared.Group || check.SharedGroup.Index != 1 {
+		t.Errorf("check should report the shared puzzle group, got %+v", check.SharedGroup)
+	}
+}
+
+func TestSharedPuzzleBatchSolvesOnce(t *testing.T) {
+	outputs, contents := createSharedGroup(t, "group_password")
+	outputDir := t.TempDir()
+
+	solves := 0
+	results, err := operations.DecryptBatch(outputs, operations.DecryptOptions{
+		KeyInput:  "group_password",
+		OutputDir: outputDir,
+	}, func(item operations.BatchItem) operations.ProgressCallback {
+		return func(done uint64) {
+			if done == testWorkFactor {
+				solves++
+			}
+		}
+	})
+	if err != nil {
+		t.Fatalf("Batch decryption failed: %v", err)
+	}
+	if solves != 1 {
+		t.Errorf("Expected the shared puzzle to be solved once, got %d solves", solves)
+	}
+	for i, result := range results {
+		if result.Reused != (i > 0) {
+			t.Errorf("%s: Reused = %v", result.InputFile, result.Reused)
+		}
+	}
+
+	for i, content := range contents {
+		got, err := utils.ReadFile(filepath.Join(outputDir, strings.TrimSuffix(filepath.Base(outputs[i]), ".locked")))
+		if err != nil {
+			t.Fatalf("Missing output: %v", err)
+		}
+		assertBytesEqual(t, content, got, "Shared puzzle output")
+	}
+	got, err := utils.ReadFile(filepath.Join(outputDir, "docs", "readme.txt"))
+	if err != nil {
+		t.Fatalf("Missing container output: %v", err)
+	}
+	assertBytesEqual(t, []byte("docs"), got, "Shared puzzle container output")
+}
+
+func TestSharedPuzzleMemberKeysAreBound(t *testing.T) {
+	outputs, contents := createSharedGroup(t, "")
+
+	// Any member decrypts on its own
+	result, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile:  outputs[1],
+		OutputFile: filepath.Join(t.TempDir(), "build.bin"),
+	}, nil)
+	if err != nil {
+		t.Fatalf("Decrypting a single member failed: %v", err)
+	}
+	got, err := utils.ReadFile(result.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	assertBytesEqual(t, contents[1], got, "Single member output")
+
+	// Moving a member to another position in the group changes its key
+	ef, err := utils.ReadEncryptedFile(outputs[0])
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+	ef.Ext.Shared.Index = 1
+	tampered := filepath.Join(t.TempDir(), "tampered.locked")
+	if err := utils.WriteEncryptedFile(tampered, ef); err != nil {
+		t.Fatalf("Failed to write tampered file: %v", err)
+	}
+	if _, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile:  tampered,
+		OutputFile: filepath.Join(t.TempDir(), "out"),
+	}, nil); err == nil {
+		t.Error("A member with altered group membership should fail to decrypt")
+	}
+}
+
+func TestEncryptGroupRejectsBadInputs(t *testing.T) {
+	input := createTempFile(t, "only.txt", []byte("alone"))
+	opts := operations.EncryptOptions{WorkFactor: testWorkFactor}
+	if _, err := operations.EncryptGroup([]string{input}, opts); err == nil {
+		t.Error("A group of one should be rejected")
+	}
+	if _, err := operations.EncryptGroup([]string{input, input}, opts); err == nil {
+		t.Error("An input given twice should be rejected")
+	}
+	if _, err := operations.EncryptGroup([]string{input, input + ".missing"}, opts); err == nil {
+		t.Error("A missing input should be rejected")
+	}
+	if _, err := os.Stat(input + ".locked"); !os.IsNotExist(err) {
+		t.Error("Nothing should be written when an input is rejected")
+	}
+}
+
+func TestSharedPuzzlePaddedHeaders(t *testing.T) {
+	// Padding is added before each member's key is bound to its header
+	dir := t.TempDir()
+	inputs := []string{filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")}
+	for _, input := range inputs {
+		if err := utils.WriteFile(input, []byte("member of "+input)); err != nil {
+			t.Fatalf("Failed to write input: %v", err)
+		}
+	}
+	results, err := operations.EncryptGroup(inputs, operations.EncryptOptions{
+		WorkFactor: testWorkFactor,
+		PadHeader:  2048,
+	})
+	if err != nil {
+		t.Fatalf("Group encryption failed: %v", err)
+	}
+	for i, result := range results {
+		h, err := utils.ReadFileHeader(result.OutputFile)
+		if err != nil {
+			t.Fatalf("Failed to read header: %v", err)
+		}
+		if h.Size() != 2048 {
+			t.Errorf("%s: header is %d bytes, want 2048", result.OutputFile, h.Size())
+		}
+		decrypted, err := operations.DecryptFile(operations.DecryptOptions{
+			InputFile:  result.OutputFile,
+			OutputFile: filepath.Join(dir, "out", filepath.Base(inputs[i])),
+		}, nil)
+		if err != nil {
+			t.Fatalf("Decrypting padded member failed: %v", err)
+		}
+		got, err := utils.ReadFile(decrypted.OutputFile)
+		if err != nil {
+			t.Fatalf("Failed to read output: %v", err)
+		}
+		assertBytesEqual(t, []byte("member of "+inputs[i]), got, "Padded member")
+	}
+}
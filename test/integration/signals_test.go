@@ -0,0 +1,107 @@
+//go:build unix
+
+package integration
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"cryptotimed/src/cmd"
+	"cryptotimed/src/operations"
+)
+
+// signalUntil sends sig to this process every 50ms until done reports true.
+func signalUntil(t *testing.T, sig syscall.Signal, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(15 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		if err := syscall.Kill(os.Getpid(), sig); err != nil {
+			t.Fatalf("Failed to send %v: %v", sig, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestDecryptStatusAndCheckpointSignals(t *testing.T) {
+	// Signals sent before the command listens must not kill the test
+	sink := make(chan os.Signal, 1)
+	signal.Notify(sink, syscall.SIGUSR1, syscall.SIGUSR2, os.Interrupt)
+	defer signal.Stop(sink)
+
+	inputFile := createTempFile(t, "signals.txt", []byte("signal me"))
+	const workFactor = 1 << 40
+	result, err := operations.EncryptFile(operations.EncryptOptions{InputFile: inputFile, WorkFactor: workFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	checkpoint := result.OutputFile + ".resume"
+
+	// Capture stderr; stdout is discarded
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", os.DevNull, err)
+	}
+	defer devNull.Close()
+	stderr := &lockedBuffer{}
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(stderr, r)
+		close(copied)
+	}()
+	stdout, savedStderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = devNull, w
+	defer func() { os.Stdout, os.Stderr = stdout, savedStderr }()
+
+	finished := make(chan error, 1)
+	go func() {
+		finished <- cmd.DecryptCommand([]string{
+			"--input", result.OutputFile,
+			"--confirm-over", "0",
+			"--checkpoint-interval", "0",
+			"--progress-interval", "0",
+		})
+	}()
+
+	signalUntil(t, syscall.SIGUSR1, "a status line", func() bool {
+		return strings.Contains(stderr.String(), "no checkpoint yet")
+	})
+	signalUntil(t, syscall.SIGUSR2, "a checkpoint", func() bool {
+		_, err := os.Stat(checkpoint)
+		return err == nil
+	})
+	signalUntil(t, syscall.SIGUSR1, "a status line with the checkpoint", func() bool {
+		return strings.Contains(stderr.String(), " ago")
+	})
+	signalUntil(t, syscall.SIGINT, "the solve to stop", func() bool {
+		select {
+		case err := <-finished:
+			if err == nil || !strings.Contains(err.Error(), "interrupted") {
+				t.Errorf("expected an interrupted error, got %v", err)
+			}
+			return true
+		default:
+			return false
+		}
+	})
+
+	os.Stdout, os.Stderr = stdout, savedStderr
+	w.Close()
+	<-copied
+	for _, line := range strings.Split(strings.TrimSpace(stderr.String()), "\n") {
+		if !strings.HasPrefix(line, "cryptotimed: ") || !strings.Contains(line, "/1099511627776 squarings") {
+			t.Errorf("unexpected stderr line %q", line)
+		}
+	}
+}
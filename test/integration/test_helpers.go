@@ -2,12 +2,19 @@ package integration
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"fmt"
+	"io/fs"
+	"math/big"
 	"os"
+	"path"
 	"path/filepath"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"cryptotimed/src/crypto"
 	"cryptotimed/src/utils"
 )
 
@@ -98,6 +105,40 @@ func createTempFile(t *testing.T, name string, content []byte) string {
 	return filePath
 }
 
+// memFS is an in-memory filesystem for operations' FS and OutputFS options,
+// so tests need not touch the disk.
+type memFS struct {
+	fstest.MapFS
+}
+
+// newMemFS returns a memFS holding files, by slash-separated name.
+func newMemFS(files map[string][]byte) *memFS {
+	m := &memFS{MapFS: fstest.MapFS{}}
+	for name, content := range files {
+		m.MkdirAll(path.Dir(name), 0755)
+		m.WriteFile(name, content, 0644)
+	}
+	return m
+}
+
+func (m *memFS) MkdirAll(name string, perm fs.FileMode) error {
+	for dir := name; dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if f, ok := m.MapFS[dir]; ok {
+			if !f.Mode.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: dir, Err: fs.ErrExist}
+			}
+			continue
+		}
+		m.MapFS[dir] = &fstest.MapFile{Mode: fs.ModeDir | perm, ModTime: time.Now()}
+	}
+	return nil
+}
+
+func (m *memFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	m.MapFS[name] = &fstest.MapFile{Data: append([]byte(nil), data...), Mode: perm, ModTime: time.Now()}
+	return nil
+}
+
 // createTempFileForBench creates a temporary file for benchmarks
 func createTempFileForBench(b *testing.B, name string, content []byte) string {
 	tmpDir := b.TempDir()
@@ -108,6 +149,16 @@ func createTempFileForBench(b *testing.B, name string, content []byte) string {
 	return filePath
 }
 
+// solvePuzzle solves p by sequential squaring, failing the test if it cannot
+func solvePuzzle(t *testing.T, p crypto.Puzzle) *big.Int {
+	t.Helper()
+	target, err := crypto.SolvePuzzle(context.Background(), p, nil)
+	if err != nil {
+		t.Fatalf("SolvePuzzle failed: %v", err)
+	}
+	return target
+}
+
 // createTempKeyFile creates a temporary key file
 func createTempKeyFile(t *testing.T, key string) string {
 	return createTempFile(t, "keyfile.txt", []byte(key))
@@ -127,11 +178,3 @@ func assertBytesEqual(t *testing.T, expected, actual []byte, context string) {
 			context, len(expected), len(actual))
 	}
 }
-
-// Test Suite Setup and Teardown
-func TestMain(m *testing.M) {
-	// Global test setup
-	code := m.Run()
-	// Global test teardown
-	os.Exit(code)
-}
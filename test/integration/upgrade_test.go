@@ -0,0 +1,172 @@
+package integration
+
+import (
+	"bytes"
+	"math/big"
+	"os"
+	"testing"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+	"cryptotimed/src/types"
+	"cryptotimed/src/utils"
+)
+
+// writeLegacyFile writes testData in a version 1 file, as
+// TestRegressionLegacyVersionDecrypts does, and returns its path and puzzle.
+func writeLegacyFile(t *testing.T, name string, testData []byte) (string, crypto.Puzzle) {
+	t.Helper()
+	puzzle, _, err := crypto.GeneratePuzzle(testWorkFactor, nil, crypto.DefaultModulusBits)
+	if err != nil {
+		t.Fatalf("Failed to generate puzzle: %v", err)
+	}
+	ciphertext, err := crypto.EncryptData(crypto.DerivePuzzleKey(puzzle.Target, puzzle.N), testData)
+	if err != nil {
+		t.Fatalf("Failed to encrypt data: %v", err)
+	}
+	nBytes, gBytes := utils.PuzzleToBytes(puzzle)
+	ef := &types.EncryptedFile{
+		Version:    types.VersionLegacy,
+		WorkFactor: puzzle.T,
+		ModulusN:   nBytes,
+		BaseG:      gBytes,
+		Data:       ciphertext,
+	}
+	lockedFile := createTempFile(t, name, nil)
+	if err := utils.WriteEncryptedFile(lockedFile, ef); err != nil {
+		t.Fatalf("Failed to write legacy file: %v", err)
+	}
+	return lockedFile, puzzle
+}
+
+func TestUpgradeLegacyFile(t *testing.T) {
+	testData := []byte("Written by a version 1 encryptor, read by the current one")
+	lockedFile, puzzle := writeLegacyFile(t, "legacy.txt.locked", testData)
+	before, err := os.ReadFile(lockedFile)
+	if err != nil {
+		t.Fatalf("Failed to read legacy file: %v", err)
+	}
+
+	// A dry run reports the changes and leaves the file alone
+	opts := operations.UpgradeOptions{DecryptOptions: operations.DecryptOptions{InputFile: lockedFile}, DryRun: true}
+	plan, err := operations.UpgradeFile(opts, nil)
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if plan.Current || !plan.NeedsSolve || plan.Upgraded || len(plan.Changes) == 0 {
+		t.Errorf("Unexpected plan for a version 1 file: %+v", plan)
+	}
+	if plan.FromVersion != types.VersionLegacy || plan.ToVersion != types.CurrentVersion {
+		t.Errorf("Expected an upgrade from %d to %d, got %d to %d", types.VersionLegacy, types.CurrentVersion, plan.FromVersion, plan.ToVersion)
+	}
+	after, _ := os.ReadFile(lockedFile)
+	if !bytes.Equal(before, after) {
+		t.Fatalf("Dry run changed the file")
+	}
+
+	opts.DryRun = false
+	result, err := operations.UpgradeFile(opts, nil)
+	if err != nil {
+		t.Fatalf("Upgrade failed: %v", err)
+	}
+	if !result.Upgraded {
+		t.Errorf("Upgrade did not report the file as upgraded")
+	}
+
+	ef, err := utils.ReadEncryptedFile(lockedFile)
+	if err != nil {
+		t.Fatalf("Failed to read upgraded file: %v", err)
+	}
+	if ef.Version != types.CurrentVersion {
+		t.Errorf("Expected format version %d, got %d", types.CurrentVersion, ef.Version)
+	}
+	if ef.Ext.KeyDerivation != crypto.CurrentKeyDerivation {
+		t.Errorf("Expected key derivation %d, got %d", crypto.CurrentKeyDerivation, ef.Ext.KeyDerivation)
+	}
+	if ef.MinReaderVersion != ef.Header().RequiredReaderVersion() {
+		t.Errorf("Expected minimum reader version %d, got %d", ef.Header().RequiredReaderVersion(), ef.MinReaderVersion)
+	}
+	if ef.WorkFactor != puzzle.T || new(big.Int).SetBytes(ef.ModulusN[:]).Cmp(puzzle.N) != 0 {
+		t.Errorf("Upgrade changed the puzzle")
+	}
+
+	// The upgraded file decrypts as any other, and a second upgrade has
+	// nothing to do
+	decryptResult, err := operations.DecryptFile(operations.DecryptOptions{InputFile: lockedFile}, nil)
+	if err != nil {
+		t.Fatalf("Decrypting the upgraded file failed: %v", err)
+	}
+	decryptedData, err := utils.ReadFile(decryptResult.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read decrypted file: %v", err)
+	}
+	assertBytesEqual(t, testData, decryptedData, "Upgraded legacy file")
+
+	again, err := operations.UpgradeFile(opts, nil)
+	if err != nil {
+		t.Fatalf("Second upgrade failed: %v", err)
+	}
+	if !again.Current || again.Upgraded {
+		t.Errorf("Expected an upgraded file to be current, got %+v", again)
+	}
+}
+
+func TestUpgradeVersion2WithoutSolving(t *testing.T) {
+	testData := []byte("Written by a version 2 encryptor")
+	inputFile := createTempFile(t, "v2.txt", testData)
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: testWorkFactor,
+		KeyInput:   "v2 passphrase",
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+
+	// Rewrite the file as a version 2 encryptor would have: no minimum
+	// reader version and only the extensions version 2 knew
+	ef, err := utils.ReadEncryptedFile(encryptResult.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read encrypted file: %v", err)
+	}
+	ef.Version = 2
+	ef.MinReaderVersion = 0
+	if err := utils.WriteEncryptedFile(encryptResult.OutputFile, ef); err != nil {
+		t.Fatalf("Failed to write version 2 file: %v", err)
+	}
+
+	// No passphrase is needed: nothing is solved
+	result, err := operations.UpgradeFile(operations.UpgradeOptions{
+		DecryptOptions: operations.DecryptOptions{InputFile: encryptResult.OutputFile},
+	}, func(uint64) {
+		t.Errorf("Upgrading a version 2 file solved its puzzle")
+	})
+	if err != nil {
+		t.Fatalf("Upgrade failed: %v", err)
+	}
+	if result.NeedsSolve || !result.Upgraded || result.FromVersion != 2 {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+
+	upgraded, err := utils.ReadEncryptedFile(encryptResult.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read upgraded file: %v", err)
+	}
+	if upgraded.Version != types.CurrentVersion || !bytes.Equal(upgraded.Data, ef.Data) {
+		t.Errorf("Expected version %d with the data untouched", types.CurrentVersion)
+	}
+
+	// The passphrase still opens it
+	decryptResult, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile: encryptResult.OutputFile,
+		KeyInput:  "v2 passphrase",
+	}, nil)
+	if err != nil {
+		t.Fatalf("Decrypting the upgraded file failed: %v", err)
+	}
+	decryptedData, err := utils.ReadFile(decryptResult.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read decrypted file: %v", err)
+	}
+	assertBytesEqual(t, testData, decryptedData, "Upgraded version 2 file")
+}
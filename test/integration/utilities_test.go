@@ -1,9 +1,16 @@
 package integration
 
 import (
+	"crypto/sha256"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
 	"cryptotimed/src/types"
 	"cryptotimed/src/utils"
 )
@@ -48,7 +55,7 @@ func TestUtilityFunctions(t *testing.T) {
 
 	t.Run("puzzle_conversion", func(t *testing.T) {
 		// Generate a test puzzle
-		puzzle, _, err := crypto.GeneratePuzzle(testWorkFactor, []byte("test_password"))
+		puzzle, _, err := crypto.GeneratePuzzle(testWorkFactor, []byte("test_password"), crypto.DefaultModulusBits)
 		if err != nil {
 			t.Fatalf("Failed to generate test puzzle: %v", err)
 		}
@@ -85,3 +92,153 @@ func TestUtilityFunctions(t *testing.T) {
 		}
 	})
 }
+
+func TestCheckFingerprints(t *testing.T) {
+	input := createTempFile(t, "shared.txt", []byte("are we looking at the same file?"))
+	encrypted, err := operations.EncryptFile(operations.EncryptOptions{InputFile: input, WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	result, err := operations.CheckFile(operations.CheckOptions{InputFile: encrypted.OutputFile})
+	if err != nil {
+		t.Fatalf("Check failed: %v", err)
+	}
+	raw, err := os.ReadFile(encrypted.OutputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FileSHA256 == nil || *result.FileSHA256 != sha256.Sum256(raw) {
+		t.Errorf("FileSHA256 = %x, want the SHA-256 of the file", result.FileSHA256)
+	}
+	header, err := utils.ReadFileHeader(encrypted.OutputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.HeaderFingerprint != header.Fingerprint() {
+		t.Errorf("HeaderFingerprint = %x, want the one partial outputs and calibration use", result.HeaderFingerprint)
+	}
+}
+
+func TestEstimateOverhead(t *testing.T) {
+	result, err := operations.EstimateOverhead(operations.OverheadOptions{Count: 10000, AvgSize: 4 << 10})
+	if err != nil {
+		t.Fatalf("EstimateOverhead failed: %v", err)
+	}
+	if result.Separate.FixedHeader != types.HeaderSize*10000 {
+		t.Errorf("FixedHeader = %d, want %d", result.Separate.FixedHeader, types.HeaderSize*10000)
+	}
+	if result.Payload != 10000*4<<10 || result.Container.FixedHeader != types.HeaderSize {
+		t.Errorf("Payload = %d, container FixedHeader = %d", result.Payload, result.Container.FixedHeader)
+	}
+	if result.Container.Total >= result.Separate.Total {
+		t.Errorf("container overhead %d is not below %d for separate files", result.Container.Total, result.Separate.Total)
+	}
+
+	// The estimates match what encrypt writes
+	content := []byte("abc")
+	encrypted, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  createTempFile(t, "one.txt", content),
+		WorkFactor: testWorkFactor,
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	one, err := operations.EstimateOverhead(operations.OverheadOptions{Count: 1, AvgSize: int64(len(content))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := int64(encrypted.EncryptedSize) - int64(len(content)); got != one.Separate.Total {
+		t.Errorf("file overhead = %d, estimated %d", got, one.Separate.Total)
+	}
+
+	// Distinct contents of the same size: identical files would be stored once
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name[:1]+"bc"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	encrypted, err = operations.EncryptFile(operations.EncryptOptions{InputFile: dir, WorkFactor: testWorkFactor})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	three, err := operations.EstimateOverhead(operations.OverheadOptions{Count: 3, AvgSize: int64(len(content)), NameLength: len("a.txt")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := int64(encrypted.EncryptedSize) - three.Payload; got != three.Container.Total {
+		t.Errorf("container overhead = %d, estimated %d", got, three.Container.Total)
+	}
+}
+
+func TestEstimateBreakEven(t *testing.T) {
+	const year = 365.25 * 24 * time.Hour
+	years := func(d time.Duration) float64 { return float64(d) / float64(year) }
+	finishAfter := func(opts operations.BreakEvenOptions, wait float64) float64 {
+		solve := float64(opts.WorkFactor) / (opts.Rate * math.Pow(opts.Growth, wait))
+		return wait + solve/year.Seconds()
+	}
+
+	// Five years today at 30% a year: best started about a year from now
+	opts := operations.BreakEvenOptions{WorkFactor: 81000000000000, Rate: 500000, Growth: 1.3}
+	result, err := operations.EstimateBreakEven(opts)
+	if err != nil {
+		t.Fatalf("EstimateBreakEven failed: %v", err)
+	}
+	lnG := math.Log(opts.Growth)
+	now := finishAfter(opts, 0)
+	if math.Abs(years(result.SolveNow)-now) > 1e-6 {
+		t.Errorf("SolveNow = %.4f years, want %.4f", years(result.SolveNow), now)
+	}
+	wait := math.Log(now*lnG) / lnG
+	if math.Abs(years(result.Wait)-wait) > 1e-6 || wait <= 0 {
+		t.Errorf("Wait = %.4f years, want the closed form %.4f", years(result.Wait), wait)
+	}
+	// At the optimum, the finish is the wait plus 1/ln(growth)
+	if math.Abs(years(result.Finish)-(wait+1/lnG)) > 1e-6 {
+		t.Errorf("Finish = %.4f years, want %.4f", years(result.Finish), wait+1/lnG)
+	}
+	// and no other start on a fine grid does better
+	for d := 0.0; d < 10; d += 0.01 {
+		if f := finishAfter(opts, d); f < years(result.Finish)-1e-9 {
+			t.Fatalf("starting after %.2f years finishes after %.4f, before the optimum's %.4f", d, f, years(result.Finish))
+		}
+	}
+	if want := opts.Rate * math.Pow(opts.Growth, wait); math.Abs(result.WaitRate-want) > 1e-3*want {
+		t.Errorf("WaitRate = %.0f, want %.0f", result.WaitRate, want)
+	}
+	// Moving the checkpoint as hardware improves beats any single start
+	if up := years(result.Upgrading); math.Abs(up-math.Log1p(now*lnG)/lnG) > 1e-6 || up >= years(result.Finish) {
+		t.Errorf("Upgrading = %.4f years, want %.4f, before %.4f", up, math.Log1p(now*lnG)/lnG, years(result.Finish))
+	}
+
+	// Up to S·ln(growth) = 1, waiting never pays off
+	short := operations.BreakEvenOptions{WorkFactor: uint64(year.Seconds() / lnG * opts.Rate * 0.99), Rate: opts.Rate, Growth: opts.Growth}
+	result, err = operations.EstimateBreakEven(short)
+	if err != nil {
+		t.Fatalf("EstimateBreakEven failed: %v", err)
+	}
+	if result.Wait != 0 || result.Finish != result.SolveNow {
+		t.Errorf("a short solve waits %v and finishes after %v instead of %v", result.Wait, result.Finish, result.SolveNow)
+	}
+
+	for _, bad := range []operations.BreakEvenOptions{
+		{WorkFactor: 0, Rate: 1, Growth: 2},
+		{WorkFactor: 1, Rate: 0, Growth: 2},
+		{WorkFactor: 1, Rate: 1, Growth: 1},
+		{WorkFactor: math.MaxUint64, Rate: 1, Growth: 2},
+	} {
+		if _, err := operations.EstimateBreakEven(bad); err == nil {
+			t.Errorf("%+v was accepted", bad)
+		}
+	}
+
+	code, stdout, stderr := execute(t, "breakeven", "--work", "81000000000000", "--growth", "1.3", "--rate", "500000")
+	if code != 0 || !strings.Contains(stdout, "Best start:         in 1.13 years") {
+		t.Errorf("breakeven: exit %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+	code, _, stderr = execute(t, "breakeven", "--work", "1000", "--growth", "0.9", "--rate", "1")
+	if code != 1 || !strings.Contains(stderr, "--growth must be more than 1") {
+		t.Errorf("breakeven --growth 0.9: exit %d, stderr %q", code, stderr)
+	}
+}
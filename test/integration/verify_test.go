@@ -0,0 +1,158 @@
+package integration
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cryptotimed/src/crypto"
+	"cryptotimed/src/operations"
+)
+
+// corruptingFS flips one bit of every file written to it at offset, like a
+// failing disk would.
+type corruptingFS struct {
+	*memFS
+	offset int
+}
+
+func (c *corruptingFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	bad := append([]byte(nil), data...)
+	if c.offset < len(bad) {
+		bad[c.offset] ^= 0x10
+	}
+	return c.memFS.WriteFile(name, bad, perm)
+}
+
+func TestEncryptVerifyLevels(t *testing.T) {
+	content := generateRandomData(5000)
+	input := createTempFile(t, "notes.txt", content)
+
+	cases := []struct {
+		name       string
+		opts       operations.EncryptOptions
+		want       operations.VerifyLevel
+		wantReason string
+	}{
+		{"solved", operations.EncryptOptions{KeyInput: "pw", VerifySolveLimit: operations.DefaultVerifySolveLimit},
+			operations.VerifyDecrypted, ""},
+		{"chunked", operations.EncryptOptions{ChunkSize: crypto.MinChunkSize, VerifySolveLimit: testWorkFactor},
+			operations.VerifyDecrypted, ""},
+		{"above limit", operations.EncryptOptions{VerifySolveLimit: testWorkFactor - 1},
+			operations.VerifyReadBack, "above the limit"},
+		{"read back only", operations.EncryptOptions{},
+			operations.VerifyReadBack, "above the limit"},
+		{"log", operations.EncryptOptions{AppendTo: filepath.Join(t.TempDir(), "a.ctlog"), VerifySolveLimit: testWorkFactor},
+			operations.VerifyDecrypted, ""},
+	}
+	for i, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := tc.opts
+			opts.InputFile = input
+			opts.WorkFactor = testWorkFactor
+			opts.Verify = true
+			opts.OutputTemplate = "{path}." + string(rune('a'+i))
+			result, err := operations.EncryptFile(opts)
+			if err != nil {
+				t.Fatalf("Encryption failed: %v", err)
+			}
+			if result.Verified != tc.want {
+				t.Errorf("Verified = %v, want %v", result.Verified, tc.want)
+			}
+			if !strings.Contains(result.VerifySkipped, tc.wantReason) || (tc.wantReason == "") != (result.VerifySkipped == "") {
+				t.Errorf("VerifySkipped = %q, want it to mention %q", result.VerifySkipped, tc.wantReason)
+			}
+		})
+	}
+
+	// Containers are read back but not decrypted
+	dir := filepath.Dir(createTempFile(t, "album/a.jpg", content))
+	result, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:        dir,
+		WorkFactor:       testWorkFactor,
+		Verify:           true,
+		VerifySolveLimit: testWorkFactor,
+	})
+	if err != nil {
+		t.Fatalf("Encrypting a directory failed: %v", err)
+	}
+	if result.Verified != operations.VerifyReadBack || result.VerifySkipped == "" {
+		t.Errorf("container: Verified = %v (%q)", result.Verified, result.VerifySkipped)
+	}
+
+	// Without Verify nothing is checked
+	plain, err := operations.EncryptFile(operations.EncryptOptions{InputFile: input, WorkFactor: testWorkFactor, OutputTemplate: "{path}.plain"})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	if plain.Verified != operations.VerifyNone {
+		t.Errorf("Verified = %v without Verify", plain.Verified)
+	}
+}
+
+func TestEncryptVerifyDetectsCorruption(t *testing.T) {
+	content := generateRandomData(5000)
+	for name, offset := range map[string]int{"header": 10, "data": 4000} {
+		t.Run(name, func(t *testing.T) {
+			out := &corruptingFS{memFS: newMemFS(nil), offset: offset}
+			_, err := operations.EncryptFile(operations.EncryptOptions{
+				InputFile:  "notes.txt",
+				FS:         newMemFS(map[string][]byte{"notes.txt": content}),
+				OutputFS:   out,
+				WorkFactor: testWorkFactor,
+				Verify:     true,
+			})
+			if err == nil || !strings.Contains(err.Error(), name) {
+				t.Fatalf("corrupted %s not reported: %v", name, err)
+			}
+		})
+	}
+}
+
+func TestEncryptVerifyRefusesInPlace(t *testing.T) {
+	input := createTempFile(t, "disk.img", generateRandomData(100))
+	if _, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  input,
+		WorkFactor: testWorkFactor,
+		InPlace:    true,
+		Verify:     true,
+	}); err == nil {
+		t.Error("verified an in-place encryption whose input is gone")
+	}
+}
+
+func TestEncryptVerifyPuzzle(t *testing.T) {
+	input := createTempFile(t, "notes.txt", generateRandomData(500))
+
+	for name, opts := range map[string]operations.EncryptOptions{
+		"solved":  {},
+		"partial": {VerifyPuzzleSteps: testWorkFactor / 4},
+		"decoy":   {KeyInput: "real", DecoyFile: input, DecoyKeyInput: "decoy"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			opts.InputFile = input
+			opts.WorkFactor = testWorkFactor
+			opts.VerifyPuzzle = true
+			opts.OutputTemplate = "{path}." + name
+			result, err := operations.EncryptFile(opts)
+			if err != nil {
+				t.Fatalf("Encryption failed: %v", err)
+			}
+			check := result.PuzzleCheck
+			if check == nil {
+				t.Fatal("no puzzle check reported")
+			}
+			full := opts.VerifyPuzzleSteps == 0
+			if check.Full != full || !check.Trapdoor {
+				t.Errorf("check = %+v", check)
+			}
+			if !full && check.Steps != opts.VerifyPuzzleSteps {
+				t.Errorf("compared %d squarings, want %d", check.Steps, opts.VerifyPuzzleSteps)
+			}
+			if _, err := operations.DecryptFile(operations.DecryptOptions{InputFile: result.OutputFile, OutputFile: filepath.Join(t.TempDir(), "out"), KeyInput: opts.KeyInput}, nil); err != nil {
+				t.Errorf("Decryption failed: %v", err)
+			}
+		})
+	}
+}
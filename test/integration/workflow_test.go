@@ -185,3 +185,37 @@ func TestKeyFileSupport(t *testing.T) {
 
 	assertBytesEqual(t, testData, decryptedData, "Key file decryption")
 }
+
+func TestNoTrapdoorEncryptDecrypt(t *testing.T) {
+	testData := []byte("sealed without the trapdoor")
+	inputFile := createTempFile(t, "input.txt", testData)
+
+	var encryptProgress uint64
+	encryptResult, err := operations.EncryptFile(operations.EncryptOptions{
+		InputFile:  inputFile,
+		WorkFactor: testWorkFactor,
+		KeyInput:   "no_trapdoor_password",
+		NoTrapdoor: true,
+		Progress:   func(done uint64) { encryptProgress = done },
+	})
+	if err != nil {
+		t.Fatalf("Encryption failed: %v", err)
+	}
+	if encryptProgress != testWorkFactor {
+		t.Errorf("Encryption reported %d of %d squarings", encryptProgress, testWorkFactor)
+	}
+
+	decryptResult, err := operations.DecryptFile(operations.DecryptOptions{
+		InputFile:  encryptResult.OutputFile,
+		KeyInput:   "no_trapdoor_password",
+		OutputFile: inputFile + ".out",
+	}, nil)
+	if err != nil {
+		t.Fatalf("Decryption failed: %v", err)
+	}
+	got, err := utils.ReadFile(decryptResult.OutputFile)
+	if err != nil {
+		t.Fatalf("Failed to read output: %v", err)
+	}
+	assertBytesEqual(t, testData, got, "No-trapdoor round trip")
+}